@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tapi"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tstatus"
+	"fortio.org/tsync/txfer"
+)
+
+// NewAPI returns the control API service (see package tapi) for srv, sending files through host
+// and creating tokens for box. Its Changed must be called from Config.OnChange.
+func NewAPI(srv *tsnet.Server, host *PluginHost, box *txfer.DropBox) *tapi.Service {
+	svc := tapi.NewService(srv)
+	svc.Box = box
+	svc.DropFile = func(_ context.Context, peer, token, path string) error {
+		return host.SendFile(peer, token, path)
+	}
+	svc.NewToken = func() (string, time.Time) {
+		return box.NewToken(DropTokenTTL), time.Now().Add(DropTokenTTL)
+	}
+	return svc
+}
+
+// ServeAPI serves the control API on control.sock in the storage directory until the returned function is called.
+func ServeAPI(svc *tapi.Service) (func(), error) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return nil, err
+	}
+	path := storage.ControlSocket()
+	l, err := tapi.Listen(path)
+	if err != nil {
+		return nil, err
+	}
+	gs := tapi.Serve(l, svc)
+	log.Infof("Serving the control API on %s", path)
+	return gs.Stop, nil // Stop also removes the socket.
+}
+
+// RemoteStatus returns the status of the tsync running with -api, as its terminal UI shows it.
+func RemoteStatus() (*tstatus.Status, error) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tapi.Dial(storage.ControlSocket())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), PeersTimeout)
+	defer cancel()
+	client := tapi.NewControlClient(conn)
+	id, err := client.GetIdentity(ctx, &tapi.GetIdentityRequest{})
+	if err != nil {
+		return nil, err
+	}
+	peers, err := client.ListPeers(ctx, &tapi.ListPeersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	transfers, err := client.ListTransfers(ctx, &tapi.ListTransfersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	st := &tstatus.Status{Self: tapi.SelfView(id), Peers: []tstatus.Peer{}, Transfers: []tstatus.Transfer{}}
+	for i, p := range peers.GetPeers() {
+		st.Peers = append(st.Peers, tapi.PeerView(i+1, p))
+	}
+	for _, t := range transfers.GetTransfers() {
+		st.Transfers = append(st.Transfers, tapi.TransferView(t))
+	}
+	st.Stats = tstatus.NewStats(st.Peers, st.Transfers)
+	return st, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// AuditLog appends the failed connection and trust attempts (tsnet.AuditEvent) as JSON lines
+// to audit.log in the storage directory.
+type AuditLog struct {
+	mu sync.Mutex
+	f  *os.File
+	// Optional callback for the events which banned a source, e.g. to warn in the UI.
+	OnBan func(event tsnet.AuditEvent)
+}
+
+// OpenAuditLog opens (creating it if needed) the audit log and sets cfg.OnAudit to record in it.
+func OpenAuditLog(cfg *tsnet.Config) (*AuditLog, error) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(storage.AuditLog(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditLog{f: f}
+	cfg.OnAudit = a.Record
+	return a, nil
+}
+
+// Record appends the event to the log.
+func (a *AuditLog) Record(event tsnet.AuditEvent) {
+	line, _ := json.Marshal(event)
+	a.mu.Lock()
+	_, err := a.f.Write(append(line, '\n'))
+	a.mu.Unlock()
+	if err != nil {
+		log.Errf("Failed to write to the audit log: %v", err)
+	}
+	if event.Banned > 0 && a.OnBan != nil {
+		a.OnBan(event)
+	}
+}
+
+// Close closes the log file.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// AuditSource describes the source of the event: the peer's name and ip, or only the ip when unknown.
+func AuditSource(event tsnet.AuditEvent) string {
+	if event.Name == "" {
+		return event.IP
+	}
+	return fmt.Sprintf("%q (%s)", event.Name, event.IP)
+}
+
+// BanWarning returns the warning shown in the terminal UI when there are active bans, empty otherwise.
+func BanWarning(bans []tsnet.Ban) string {
+	if len(bans) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("⚠ %d banned", len(bans))
+}
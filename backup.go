@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+	"golang.org/x/term"
+)
+
+// PassphraseEnv is the environment variable with the backup passphrase, for scripts (otherwise
+// it's asked on the terminal).
+const PassphraseEnv = "TSYNC_PASSPHRASE"
+
+// MinPassphrase is the minimum length of backup passphrases.
+const MinPassphrase = 8
+
+// ReadPassphrase returns the PassphraseEnv passphrase or reads it (twice when confirm is true)
+// from the terminal without echo.
+func ReadPassphrase(confirm bool) (string, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return p, nil
+	}
+	fd := int(os.Stdin.Fd()) //nolint:gosec // fds fit in int.
+	if !term.IsTerminal(fd) {
+		return "", errors.New("no terminal to ask the passphrase, set " + PassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil || !confirm {
+		return string(p), err
+	}
+	fmt.Fprint(os.Stderr, "Passphrase again: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(again) != string(p) {
+		return "", errors.New("passphrases don't match")
+	}
+	return string(p), nil
+}
+
+// Backup writes the encrypted backup of our identity, validated keys and plugins to file.
+func Backup(args []string) int {
+	if len(args) != 1 {
+		return log.FErrf("Usage: tsync backup file")
+	}
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return log.FErrf("Failed to access storage: %v", err)
+	}
+	passphrase, err := ReadPassphrase(true)
+	if err != nil {
+		return log.FErrf("Failed to get the passphrase: %v", err)
+	}
+	if len(passphrase) < MinPassphrase {
+		return log.FErrf("Passphrase too short, need at least %d characters", MinPassphrase)
+	}
+	if err = WriteBackup(storage, args[0], passphrase); err != nil {
+		return log.FErrf("Backup failed: %v", err)
+	}
+	return 0
+}
+
+// WriteBackup writes the backup of storage, encrypted with passphrase, to file.
+func WriteBackup(storage *tcrypto.Storage, file, passphrase string) error {
+	backup, err := storage.Backup(passphrase)
+	if err != nil {
+		return err
+	}
+	if err = tcrypto.WriteFileAtomic(file, []byte(backup+"\n"), 0o600); err != nil {
+		return fmt.Errorf("writing %s: %w", file, err)
+	}
+	log.Infof("Backup of %s written to %s, restore it with: tsync restore %s", storage.Dir, file, file)
+	return nil
+}
+
+// Restore restores a Backup file, once its passphrase is verified.
+func Restore(args []string) int {
+	if len(args) != 1 {
+		return log.FErrf("Usage: tsync restore file")
+	}
+	backup, err := os.ReadFile(args[0])
+	if err != nil {
+		return log.FErrf("Failed to read the backup: %v", err)
+	}
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return log.FErrf("Failed to access storage: %v", err)
+	}
+	passphrase, err := ReadPassphrase(false)
+	if err != nil {
+		return log.FErrf("Failed to get the passphrase: %v", err)
+	}
+	files, err := storage.Restore(string(backup), passphrase)
+	if errors.Is(err, tcrypto.ErrBackupPassphrase) {
+		log.FErrf("Restore failed: %v", err)
+		return ExitUntrusted
+	}
+	if err != nil {
+		return log.FErrf("Restore failed: %v", err)
+	}
+	log.Infof("Restored %d files: %s", len(files), strings.Join(files, ", "))
+	return 0
+}
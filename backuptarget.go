@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/txfer"
+)
+
+// SnapshotFrame is the first byte of the data messages of the backup target protocol: "push",
+// answered with "token <drop token>" for the peer to drop its snapshot, and "get <drop token>",
+// answered by dropping the peer's latest snapshot with that token. Either can be answered with
+// "error <reason>" instead.
+const SnapshotFrame = 'B'
+
+const (
+	snapshotPush  = "push"
+	snapshotGet   = "get"
+	snapshotToken = "token"
+	snapshotError = "error"
+	// SnapshotRequestTries is how many times a snapshot request is sent without an answer.
+	SnapshotRequestTries = 3
+)
+
+// SnapshotKeep is how many snapshots of each peer the backup target keeps (-keep flag).
+var SnapshotKeep = txfer.DefaultSnapshotKeep
+
+// SnapshotEvery is the interval between the snapshots of `tsync backup-to`, 0 for just one (-every flag).
+var SnapshotEvery time.Duration
+
+// ErrTargetUntrusted is returned by PushSnapshot and FetchSnapshot when the backup target doesn't
+// trust us.
+var ErrTargetUntrusted = errors.New("not trusted by the backup target")
+
+// snapshotMessage returns the data message of the protocol's words (see SnapshotFrame).
+func snapshotMessage(words ...string) []byte {
+	return append([]byte{SnapshotFrame}, strings.Join(words, " ")...)
+}
+
+// SnapshotOwner returns the directory of the peer's snapshots on a backup target: the KeyID of
+// its public key (in hex), which stays the same once its identity is restored on a new machine.
+func SnapshotOwner(pubKey string) (string, error) {
+	pub, err := tcrypto.IdentityPublicKeyString(pubKey)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tcrypto.KeyID(pub)), nil
+}
+
+// SnapshotTarget keeps the snapshots its trusted peers push (with `tsync backup-to`) and sends
+// the latest one back on request (`tsync restore-from`). The snapshots are encrypted with a key
+// only the peer has (see tcrypto.Identity.Snapshot).
+type SnapshotTarget struct {
+	Store   *txfer.SnapshotStore
+	srv     *tsnet.Server
+	storage *tcrypto.Storage
+	mu      sync.Mutex
+	boxes   map[string]*txfer.DropBox                          // of the peers which asked to push, by name.
+	sends   map[string]func(peer tsnet.Peer, data []byte) bool // restores in progress, by peer name.
+}
+
+// NewSnapshotTarget returns the backup target keeping keep snapshots of each peer in the storage
+// directory.
+func NewSnapshotTarget(keep int) (*SnapshotTarget, error) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return nil, err
+	}
+	store, err := txfer.NewSnapshotStore(storage.Snapshots(), keep)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotTarget{
+		Store:   store,
+		storage: storage,
+		boxes:   make(map[string]*txfer.DropBox),
+		sends:   make(map[string]func(peer tsnet.Peer, data []byte) bool),
+	}, nil
+}
+
+// Receive handles a data message from peer: a snapshot request, a frame of its snapshot being
+// pushed or an ack or reply of the one we're sending back.
+func (t *SnapshotTarget) Receive(peer tsnet.Peer, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	t.mu.Lock()
+	forward, box := t.sends[peer.Name], t.boxes[peer.Name]
+	t.mu.Unlock()
+	if forward != nil && forward(peer, data) {
+		return
+	}
+	if data[0] != SnapshotFrame {
+		if box == nil {
+			log.LogVf("Ignoring data from %q, not pushing a snapshot", peer.Name)
+			return
+		}
+		ReceiveDrop(t.srv, box, peer, data)
+		return
+	}
+	words := strings.Fields(string(data[1:]))
+	if len(words) == 0 || (words[0] != snapshotPush && words[0] != snapshotGet) {
+		log.Warnf("Invalid snapshot request from %q: %q", peer.Name, data[1:])
+		return
+	}
+	if _, trusted, err := t.storage.Trusted(t.srv.Identity, peer.PublicKey); err != nil || !trusted {
+		log.Warnf("Snapshot request from untrusted %q (%v)", peer.Name, err)
+		t.srv.RecordFailure(peer.IP, peer, "snapshot request from an untrusted peer")
+		t.reply(peer, snapshotError, ErrTargetUntrusted.Error())
+		return
+	}
+	owner, err := SnapshotOwner(peer.PublicKey)
+	if err == nil {
+		box, err = t.Store.Box(owner)
+	}
+	if err != nil {
+		log.Errf("Snapshots of %q: %v", peer.Name, err)
+		t.reply(peer, snapshotError, err.Error())
+		return
+	}
+	switch {
+	case words[0] == snapshotPush:
+		t.mu.Lock()
+		t.boxes[peer.Name] = box
+		t.mu.Unlock()
+		t.reply(peer, snapshotToken, box.NewToken(DropTokenTTL))
+	case len(words) == 2:
+		latest, err := t.Store.Latest(owner)
+		if err != nil {
+			t.reply(peer, snapshotError, err.Error())
+			return
+		}
+		go t.send(peer, words[1], latest)
+	}
+}
+
+func (t *SnapshotTarget) reply(peer tsnet.Peer, words ...string) {
+	if err := t.srv.SendData(peer, snapshotMessage(words...)); err != nil {
+		log.Errf("Failed to reply to %q: %v", peer.Name, err)
+	}
+}
+
+// send drops the snapshot file to the peer with its token, unless we're already sending it one
+// (the request was repeated).
+func (t *SnapshotTarget) send(peer tsnet.Peer, token, file string) {
+	acks, onAck := StreamAcks(peer.Name)
+	replies, onReply := DropReplies(peer.Name)
+	t.mu.Lock()
+	if t.sends[peer.Name] != nil {
+		t.mu.Unlock()
+		log.LogVf("Already sending a snapshot to %q", peer.Name)
+		return
+	}
+	t.sends[peer.Name] = func(peer tsnet.Peer, data []byte) bool {
+		return onAck(peer, data) || onReply(peer, data)
+	}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.sends, peer.Name)
+		t.mu.Unlock()
+	}()
+	n, err := DropFile(t.srv, peer, token, file, acks, replies)
+	if err != nil {
+		log.Errf("Failed to send snapshot %q to %q after %d bytes: %v", file, peer.Name, n, err)
+		return
+	}
+	log.Infof("Sent snapshot %q (%d bytes) to %q", file, n, peer.Name)
+}
+
+// BackupTarget runs the backup target for the trusted peers, keeping keep snapshots of each,
+// until interrupted.
+func BackupTarget(cfg *tsnet.Config, keep int) int {
+	target, err := NewSnapshotTarget(keep)
+	if err != nil {
+		return log.FErrf("Failed to create the snapshots directory: %v", err)
+	}
+	audit, err := OpenAuditLog(cfg)
+	if err != nil {
+		return log.FErrf("Failed to open the audit log: %v", err)
+	}
+	defer audit.Close()
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		target.Receive(peer, data)
+	}
+	cfg.RequireEncryption = true // requests, snapshots and replies only through the session.
+	target.srv = cfg.NewServer()
+	if err = target.srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer target.srv.Stop()
+	log.Infof("Backup target %q keeping the %d latest snapshots of each trusted peer in %s",
+		target.srv.Name, target.Store.Keep, target.Store.Dir)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	<-ctx.Done()
+	return 0
+}
+
+// SnapshotAnswers returns a channel for the backup target's answers (words after SnapshotFrame)
+// from peerName and a function to call from Config.OnData which forwards them to it (returning
+// true if data was one).
+func SnapshotAnswers(peerName string) (<-chan []string, func(peer tsnet.Peer, data []byte) bool) {
+	answers := make(chan []string, 1)
+	return answers, func(peer tsnet.Peer, data []byte) bool {
+		if !IsPeer(peer, peerName) || len(data) == 0 || data[0] != SnapshotFrame {
+			return false
+		}
+		select {
+		case answers <- strings.Fields(string(data[1:])):
+		default: // answers to repeated requests.
+		}
+		return true
+	}
+}
+
+// snapshotAnswerError returns the error of an "error" answer.
+func snapshotAnswerError(words []string) error {
+	reason := strings.Join(words[1:], " ")
+	if reason == ErrTargetUntrusted.Error() {
+		return ErrTargetUntrusted
+	}
+	return errors.New(reason)
+}
+
+// ConnectTarget starts srv and returns the trusted backup target (or shares) peerName once
+// connected (see ConnectPeer).
+func ConnectTarget(srv *tsnet.Server, peerName string, timeout time.Duration) (tsnet.Peer, int) {
+	srv.RequireEncryption = true
+	if err := srv.Start(context.Background()); err != nil {
+		return tsnet.Peer{}, log.FErrf("Failed to start tsync server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	peer, err := ConnectPeer(ctx, srv, peerName, true)
+	cancel()
+	if err != nil {
+		log.FErrf("Can't connect to %q: %v", peerName, err)
+		return peer, ConnectExitCode(err)
+	}
+	ProbeMTU(srv, peer)
+	return peer, 0
+}
+
+// PushSnapshot sends a new snapshot of dirs to the backup target peer, acks, replies and answers
+// being fed from Config.OnData (see StreamAcks, DropReplies and SnapshotAnswers).
+func PushSnapshot(srv *tsnet.Server, peer tsnet.Peer, dirs []string, acks, replies <-chan []byte,
+	answers <-chan []string,
+) (int64, error) {
+	snapshot, err := srv.Identity.Snapshot(dirs)
+	if err != nil {
+		return 0, err
+	}
+	for range SnapshotRequestTries {
+		if err = srv.SendData(peer, snapshotMessage(snapshotPush)); err != nil {
+			return 0, err
+		}
+		select {
+		case words := <-answers:
+			switch {
+			case len(words) == 2 && words[0] == snapshotToken:
+				return txfer.SendDrop(context.Background(), DropSender(srv, peer, acks), words[1],
+					txfer.SnapshotName(time.Now()), "", int64(len(snapshot)), bytes.NewReader(snapshot), replies)
+			case len(words) > 0 && words[0] == snapshotError:
+				return 0, snapshotAnswerError(words)
+			default:
+				return 0, errors.New("invalid answer " + strings.Join(words, " "))
+			}
+		case <-time.After(txfer.DropReplyTimeout):
+		}
+	}
+	return 0, txfer.ErrNoReply
+}
+
+// BackupTo pushes a snapshot of dirs to the backup target peerName (running `tsync backup-target`),
+// then every interval if not 0.
+func BackupTo(cfg *tsnet.Config, peerName string, dirs []string, every, timeout time.Duration) int {
+	for _, dir := range dirs {
+		if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+			return log.FErrf("Not a directory: %q (%v)", dir, err)
+		}
+	}
+	acks, onAck := StreamAcks(peerName)
+	replies, onReply := DropReplies(peerName)
+	answers, onAnswer := SnapshotAnswers(peerName)
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		if !onAck(peer, data) && !onReply(peer, data) {
+			onAnswer(peer, data)
+		}
+	}
+	srv := cfg.NewServer()
+	defer srv.Stop()
+	peer, code := ConnectTarget(srv, peerName, timeout)
+	if code != 0 {
+		return code
+	}
+	for {
+		n, err := PushSnapshot(srv, peer, dirs, acks, replies, answers)
+		switch {
+		case err != nil && every == 0:
+			log.FErrf("Snapshot to %q failed after %d bytes: %v", peer.Name, n, err)
+			return TransferExitCode(err)
+		case err != nil:
+			log.Errf("Snapshot to %q failed after %d bytes (next in %v): %v", peer.Name, n, every, err)
+		default:
+			log.Infof("Pushed the snapshot of %s (%d encrypted bytes) to %q", strings.Join(dirs, ", "), n, peer.Name)
+		}
+		if every == 0 {
+			return 0
+		}
+		time.Sleep(every)
+	}
+}
+
+// RestoreFrom fetches our latest snapshot from the backup target peerName and restores its
+// directories under dest.
+func RestoreFrom(cfg *tsnet.Config, peerName, dest string, timeout time.Duration) int {
+	dir, err := os.MkdirTemp("", "tsync-restore-")
+	if err != nil {
+		return log.FErrf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	box, err := txfer.NewDropBox(dir)
+	if err != nil {
+		return log.FErrf("Failed to create the download directory: %v", err)
+	}
+	done := make(chan error, 1)
+	var file string
+	box.OnDrop = func(d *txfer.Drop, _ int64, err error) {
+		file = d.Path
+		done <- err
+	}
+	answers, onAnswer := SnapshotAnswers(peerName)
+	var srv *tsnet.Server
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		if IsPeer(peer, peerName) && !onAnswer(peer, data) {
+			ReceiveDrop(srv, box, peer, data)
+		}
+	}
+	srv = cfg.NewServer()
+	defer srv.Stop()
+	peer, code := ConnectTarget(srv, peerName, timeout)
+	if code != 0 {
+		return code
+	}
+	if err = FetchSnapshot(srv, peer, box, answers, done); err != nil {
+		log.FErrf("Failed to get our snapshot from %q: %v", peer.Name, err)
+		return TransferExitCode(err)
+	}
+	snapshot, err := os.ReadFile(file)
+	if err != nil {
+		return log.FErrf("Failed to read the snapshot: %v", err)
+	}
+	files, err := srv.Identity.RestoreSnapshot(snapshot, dest)
+	if errors.Is(err, tcrypto.ErrSnapshotKey) {
+		log.FErrf("Restore failed: %v", err)
+		return ExitUntrusted
+	}
+	if err != nil {
+		return log.FErrf("Restore failed after %d files: %v", len(files), err)
+	}
+	log.Infof("Restored %d files from %q's snapshot in %s", len(files), peer.Name, dest)
+	return 0
+}
+
+// FetchSnapshot asks the backup target peer for our latest snapshot, to be dropped in box, and
+// waits for it (done, from box.OnDrop) or the target's error answer.
+func FetchSnapshot(srv *tsnet.Server, peer tsnet.Peer, box *txfer.DropBox, answers <-chan []string,
+	done <-chan error,
+) error {
+	request := snapshotMessage(snapshotGet, box.NewToken(DropTokenTTL))
+	for range SnapshotRequestTries {
+		if err := srv.SendData(peer, request); err != nil {
+			return err
+		}
+		timer := time.NewTimer(txfer.DropReplyTimeout)
+		for waiting := true; waiting; {
+			select {
+			case err := <-done:
+				timer.Stop()
+				return err
+			case words := <-answers:
+				if len(words) > 0 && words[0] == snapshotError {
+					timer.Stop()
+					return snapshotAnswerError(words)
+				}
+			case <-timer.C:
+				if len(box.Active()) == 0 {
+					waiting = false
+					continue
+				}
+				timer.Reset(txfer.DropReplyTimeout) // receiving, wait until it's done.
+			}
+		}
+	}
+	return txfer.ErrNoReply
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tlayout"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/txfer"
+)
+
+// Puller pulls files and directories from peerName's shares (see ShareServer), one request at a
+// time: its OnData must be called from Config.OnData for the answers and the pulled files.
+type Puller struct {
+	// Optional check of the pulled files (as for the inbox, see DropBox.Scan).
+	Scan txfer.ScanFunc
+	// When directories are pulled as a single archive (see ShareServer.archive), PullArchive by default.
+	Archive  txfer.ArchiveMode
+	srv      *tsnet.Server
+	peerName string
+	answers  <-chan string
+	onAnswer func(peer tsnet.Peer, data []byte) bool
+	mu       sync.Mutex
+	box      *txfer.DropBox // of the file being pulled.
+}
+
+// NewPuller returns a Puller for the shares of peerName, srv can be set later (before Start).
+func NewPuller(srv *tsnet.Server, peerName string) *Puller {
+	p := &Puller{srv: srv, peerName: peerName, Archive: PullArchive}
+	p.answers, p.onAnswer = ShareAnswers(peerName)
+	return p
+}
+
+// OnData handles the shares answers and the drops of the file being pulled, returns true if data
+// was one of them.
+func (p *Puller) OnData(peer tsnet.Peer, data []byte) bool {
+	if !IsPeer(peer, p.peerName) {
+		return false
+	}
+	if p.onAnswer(peer, data) {
+		return true
+	}
+	p.mu.Lock()
+	box := p.box
+	p.mu.Unlock()
+	if box == nil || !box.Owns(peer.Name, data) {
+		return false
+	}
+	ReceiveDrop(p.srv, box, peer, data)
+	return true
+}
+
+// List returns the entries of the directory dir of the peer's shares (see ListShare).
+func (p *Puller) List(peer tsnet.Peer, dir string) ([]txfer.ShareEntry, error) {
+	return ListShare(p.srv, peer, dir, p.answers)
+}
+
+// Pull pulls the file at sp of the peer's shares into the local directory dest or, for a
+// directory, its content (recursively, as an archive depending on Archive) in the dest
+// subdirectory of the same name. It returns the number of files and bytes pulled (so far on errors).
+func (p *Puller) Pull(peer tsnet.Peer, sp string, dir bool, dest string) (int, int64, error) {
+	if !dir {
+		n, err := p.pullFile(peer, sp, dest)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", sp, err)
+		}
+		log.Infof("Pulled %s (%s) from %q", sp, ByteSize(n), peer.Name)
+		return 1, n, nil
+	}
+	name, err := txfer.SanitizeName(path.Base(path.Clean("/" + sp)))
+	if err != nil {
+		return 0, 0, fmt.Errorf("can't pull %s: %w", sp, err)
+	}
+	if p.Archive != txfer.ArchiveOff {
+		files, size, err := p.pullArchive(peer, sp, filepath.Join(dest, name))
+		if !errors.Is(err, errShareFiles) {
+			if err != nil {
+				return files, size, fmt.Errorf("%s: %w", sp, err)
+			}
+			log.Infof("Pulled %s from %q as an archive: %d file(s), %s", sp, peer.Name, files, ByteSize(size))
+			return files, size, nil
+		}
+	}
+	list, err := p.List(peer, sp)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", sp, err)
+	}
+	dest = filepath.Join(dest, name)
+	if err = os.MkdirAll(dest, 0o755); err != nil {
+		return 0, 0, err
+	}
+	files, size := 0, int64(0)
+	for _, e := range list {
+		if clean, err := txfer.SanitizeName(e.Name); err != nil || clean != e.Name {
+			log.Warnf("Skipping %q of %s from %q: invalid name", e.Name, sp, peer.Name)
+			continue
+		}
+		f, n, err := p.Pull(peer, path.Join(sp, e.Name), e.Dir, dest)
+		files += f
+		size += n
+		if err != nil {
+			return files, size, err
+		}
+	}
+	return files, size, nil
+}
+
+// pullFile pulls the file at sp into dir, returning its size.
+func (p *Puller) pullFile(peer tsnet.Peer, sp, dir string) (int64, error) {
+	box, err := txfer.NewDropBox(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(filepath.Join(box.Dir, txfer.PartialDir)) // if empty.
+	box.Scan = p.Scan
+	var size int64
+	err = p.receive(box, func(d *txfer.Drop, n int64) { size = n }, func(done <-chan error) error {
+		return GetShareFile(p.srv, peer, sp, box, p.answers, done)
+	})
+	return size, err
+}
+
+// pullArchive pulls the directory sp as an archive, in a temporary directory, and extracts it in
+// dest. Returns errShareFiles when the peer prefers sending the files one by one.
+func (p *Puller) pullArchive(peer tsnet.Peer, sp, dest string) (int, int64, error) {
+	tmp, err := os.MkdirTemp("", "tsync-pull-")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.RemoveAll(tmp)
+	box, err := txfer.NewDropBox(tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	var archive string
+	err = p.receive(box, func(d *txfer.Drop, _ int64) { archive = d.Path }, func(done <-chan error) error {
+		req := fmt.Sprintf(shareTarFormat, box.NewToken(DropTokenTTL), p.Archive, sp)
+		return getShare(p.srv, peer, req, box, p.answers, done)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	u := &txfer.Unpacker{From: peer.Name, Scan: p.Scan}
+	return u.Unpack(context.Background(), f, dest)
+}
+
+// receive makes box the one receiving the pulled file while get runs, with done for the
+// completion of its drop (after onDrop is called with it, on success).
+func (p *Puller) receive(box *txfer.DropBox, onDrop func(d *txfer.Drop, n int64), get func(done <-chan error) error) error {
+	done := make(chan error, 1)
+	box.OnDrop = func(d *txfer.Drop, n int64, err error) {
+		if err == nil {
+			onDrop(d, n)
+		}
+		done <- err
+	}
+	p.mu.Lock()
+	p.box = box
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.box = nil
+		p.mu.Unlock()
+	}()
+	return get(done)
+}
+
+// ErrBrowserBusy is returned by Browser.Browse while listing or pulling.
+var ErrBrowserBusy = errors.New("still browsing or pulling")
+
+// Browser browses the shares of the trusted peers in the terminal UI (a Palette per directory)
+// and pulls the picked files and directories, in the background, into Dir.
+type Browser struct {
+	Dir  string
+	Scan txfer.ScanFunc
+	// Shows the dialogs, called from the background goroutines.
+	Show   func(tlayout.Modal)
+	srv    *tsnet.Server
+	busy   atomic.Bool
+	puller atomic.Pointer[Puller]
+}
+
+// OnData is to be called from Config.OnData, returns true if data was for the current Puller.
+func (b *Browser) OnData(peer tsnet.Peer, data []byte) bool {
+	p := b.puller.Load()
+	return p != nil && p.OnData(peer, data)
+}
+
+// Browse connects to the peer (unless we already are) and lists the directory dir of its shares, in
+// the background, and shows it.
+func (b *Browser) Browse(peer tsnet.Peer, dir string) error {
+	if !b.busy.CompareAndSwap(false, true) {
+		return ErrBrowserBusy
+	}
+	p := b.puller.Load()
+	if p == nil || p.peerName != peer.Name {
+		p = NewPuller(b.srv, peer.Name)
+		p.Scan = b.Scan
+		b.puller.Store(p)
+	}
+	go func() {
+		defer b.busy.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), tsnet.ChallengeTimeout)
+		err := Connect(ctx, b.srv, peer) // the shares only answer through the session.
+		cancel()
+		var list []txfer.ShareEntry
+		if err == nil {
+			list, err = p.List(peer, dir)
+		}
+		if err != nil {
+			log.Errf("Can't browse %s on %q: %v", dir, peer.Name, err)
+			return
+		}
+		if dir == "/" && len(list) == 0 {
+			log.Warnf("%q shares no directory", peer.Name)
+			return
+		}
+		b.Show(b.dialog(p, peer, dir, list))
+	}()
+	return nil
+}
+
+// dialog returns the Palette of the entries of dir: picking a directory browses it, a file pulls
+// it, the first items (but at the root) pull the whole directory or go to the parent one.
+func (b *Browser) dialog(p *Puller, peer tsnet.Peer, dir string, list []txfer.ShareEntry) tlayout.Modal {
+	var items []string
+	root := dir == "/"
+	if !root {
+		items = append(items, "[pull this directory]", "../")
+	}
+	for _, e := range list {
+		items = append(items, ShareEntryLine(e))
+	}
+	title := fmt.Sprintf("%s:%s (%d entries, type to filter)", peer.Name, dir, len(list))
+	return &tlayout.Palette{Title: title, Items: items, OnDone: func(idx int, ok bool) {
+		if !ok {
+			return
+		}
+		var err error
+		switch {
+		case !root && idx == 0:
+			err = b.pull(p, peer, dir, true)
+		case !root && idx == 1:
+			err = b.Browse(peer, path.Dir(dir))
+		default:
+			if !root {
+				idx -= 2
+			}
+			e := list[idx]
+			if e.Dir {
+				err = b.Browse(peer, path.Join(dir, e.Name))
+			} else {
+				err = b.pull(p, peer, path.Join(dir, e.Name), false)
+			}
+		}
+		if err != nil {
+			log.Warnf("Can't browse %q: %v", peer.Name, err)
+		}
+	}}
+}
+
+// pull pulls the file or directory sp, in the background, into Dir.
+func (b *Browser) pull(p *Puller, peer tsnet.Peer, sp string, dir bool) error {
+	if !b.busy.CompareAndSwap(false, true) {
+		return ErrBrowserBusy
+	}
+	log.Infof("Pulling %s from %q into %s", sp, peer.Name, b.Dir)
+	go func() {
+		defer b.busy.Store(false)
+		files, size, err := p.Pull(peer, sp, dir, b.Dir)
+		if err != nil {
+			log.Errf("Pulling %s from %q failed after %d file(s), %s: %v", sp, peer.Name, files, ByteSize(size), err)
+			return
+		}
+		log.Infof("Pulled %s from %q: %d file(s), %s", sp, peer.Name, files, ByteSize(size))
+	}()
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"fortio.org/cli"
+	"fortio.org/log"
+	"fortio.org/tsync/tapi"
+	"fortio.org/tsync/tcrypto"
+)
+
+// CompleteCommand is the hidden command the completion scripts call with the words typed so far
+// (the last one being completed). It prints the candidates, one per line, or FilesDirective.
+const CompleteCommand = "__complete"
+
+// FilesDirective is printed by CompleteCommand when the shell should complete file names.
+const FilesDirective = ":files"
+
+// PeersTimeout bounds the query of the running tsync's peers (for completion and peers).
+const PeersTimeout = time.Second
+
+// Arguments placeholders, the others are the alternatives (separated by |) to complete.
+const (
+	ArgPeer  = "peer-name" // completed with the names of the running tsync's peers.
+	ArgFile  = "file"      // completed by the shell.
+	ArgToken = "token"
+	ArgPath  = "path" // of the peer's shares.
+	ArgNodes = "nodes"
+)
+
+// CommandInfo describes a command for completion and -help-json.
+type CommandInfo struct {
+	Name string `json:"name"`
+	// Arguments: placeholders (ArgPeer etc) or alternatives like "check|sign".
+	Args []string `json:"args,omitempty"`
+	Help string   `json:"help"`
+}
+
+// Commands are the tsync commands (the first argument).
+var Commands = []CommandInfo{
+	{Name: "pipe", Args: []string{ArgPeer}, Help: "stream stdin to the peer, which should be running cat"},
+	{Name: "cat", Args: []string{ArgPeer}, Help: "write the stream from the peer (any if not specified) to stdout"},
+	{Name: "inbox", Help: "print a one time drop token and wait for a file to be dropped in the inbox"},
+	{Name: "drop", Args: []string{ArgPeer, ArgToken, ArgFile}, Help: "send a file to the peer's inbox using its token, or to several (peer-name token pairs) at once"},
+	{Name: "soak", Args: []string{ArgNodes}, Help: "run the soak test with many in process nodes"},
+	{Name: "trust", Args: []string{ArgPeer}, Help: "list the trusted peers, or trust the peer (after checking its hash)"},
+	{Name: "endorse", Args: []string{ArgPeer, ArgPeer}, Help: "send our endorsement of the second (trusted) peer to the first one"},
+	{Name: "firewall", Args: []string{"apply"}, Help: "print (or apply) the commands allowing tsync through the firewall"},
+	{Name: "update", Args: []string{"check|sign", ArgFile}, Help: "replace tsync with the latest release, check only reports it"},
+	{Name: "peers", Help: "list the peers of the tsync running with -api"},
+	{Name: "backup", Args: []string{ArgFile}, Help: "write the passphrase encrypted backup of the identity and plugins to file"},
+	{Name: "restore", Args: []string{ArgFile}, Help: "restore a backup file (on a new machine), after verifying its passphrase"},
+	{Name: "backup-target", Help: "keep the encrypted snapshots trusted peers push with backup-to (see -keep)"},
+	{Name: "backup-to", Args: []string{ArgPeer, ArgFile}, Help: "push an encrypted snapshot of the directories to the peer (see -every)"},
+	{Name: "restore-from", Args: []string{ArgPeer, ArgFile}, Help: "restore our latest snapshot from the peer in the directory"},
+	{Name: "schedule", Help: "run the scheduled sync jobs (without the terminal UI, which also runs them)"},
+	{Name: "schedules", Help: "list the scheduled sync jobs with their next run and last result"},
+	{Name: "relay", Help: "run a rendezvous (see -listen-port) relaying the data of the peers using -relay"},
+	{Name: "share", Help: "serve the -share directories to the trusted peers (the terminal UI also does)"},
+	{Name: "ls", Args: []string{ArgPeer, ArgPath}, Help: "list a directory of the peer's shares (default /, the shares)"},
+	{Name: "get", Args: []string{ArgPeer, ArgPath, ArgFile}, Help: "get a file (or a directory, ending with /) of the peer's shares in the directory"},
+	{Name: "put", Args: []string{ArgPeer, ArgFile, ArgPath}, Help: "put the file in a directory of the peer's writable share"},
+	{Name: "completion", Args: []string{"bash|zsh|fish"}, Help: "print the shell completion script"},
+	{Name: "version", Help: "print the version"},
+	{Name: "buildinfo", Help: "print the version and build details"},
+	{Name: "help", Help: "print the usage"},
+	{Name: "envhelp", Help: "print the environment variables"},
+}
+
+// FlagInfo describes a flag for -help-json.
+type FlagInfo struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+}
+
+// HelpInfo is the -help-json output.
+type HelpInfo struct {
+	Program  string         `json:"program"`
+	Version  string         `json:"version"`
+	Usage    string         `json:"usage"`
+	Commands []CommandInfo  `json:"commands"`
+	Flags    []FlagInfo     `json:"flags"`
+	Exit     []ExitCodeInfo `json:"exit_codes"`
+}
+
+// Flags returns the description of the command line flags.
+func Flags() []FlagInfo {
+	var flags []FlagInfo
+	flag.VisitAll(func(f *flag.Flag) {
+		typ := "string"
+		if isBoolFlag(f) {
+			typ = "bool"
+		} else if getter, ok := f.Value.(flag.Getter); ok {
+			switch getter.Get().(type) {
+			case int, int64, uint, uint64:
+				typ = "int"
+			case float64:
+				typ = "float"
+			case time.Duration:
+				typ = "duration"
+			}
+		}
+		flags = append(flags, FlagInfo{Name: f.Name, Type: typ, Default: f.DefValue, Usage: f.Usage})
+	})
+	return flags
+}
+
+// HelpJSON prints the commands and flags in JSON, for wrapper tooling.
+func HelpJSON() int {
+	info := HelpInfo{
+		Program:  cli.ProgramName,
+		Version:  cli.ShortVersion,
+		Usage:    strings.TrimSpace(cli.ArgsHelp),
+		Commands: Commands,
+		Flags:    Flags(),
+		Exit:     ExitCodes,
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(info); err != nil {
+		return log.FErrf("Failed to write the help: %v", err)
+	}
+	return 0
+}
+
+// Complete returns the candidates for the last of words (the arguments typed so far), nil and
+// true when it's a file name.
+func Complete(words []string) ([]string, bool) {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur := words[len(words)-1]
+	var positional []string
+	for i := 0; i < len(words)-1; i++ {
+		w := words[i]
+		if !strings.HasPrefix(w, "-") || w == "-" {
+			positional = append(positional, w)
+			continue
+		}
+		name := strings.TrimLeft(w, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if f := flag.Lookup(name); f != nil && !isBoolFlag(f) {
+			if i == len(words)-2 {
+				return nil, false // completing a flag value.
+			}
+			i++
+		}
+	}
+	if strings.HasPrefix(cur, "-") {
+		var candidates []string
+		flag.VisitAll(func(f *flag.Flag) {
+			candidates = append(candidates, "-"+f.Name)
+		})
+		return withPrefix(candidates, cur), false
+	}
+	if len(positional) == 0 {
+		names := make([]string, 0, len(Commands))
+		for _, c := range Commands {
+			names = append(names, c.Name)
+		}
+		return withPrefix(names, cur), false
+	}
+	idx := slices.IndexFunc(Commands, func(c CommandInfo) bool { return c.Name == positional[0] })
+	argIdx := len(positional) - 1
+	if idx < 0 || argIdx >= len(Commands[idx].Args) {
+		return nil, false
+	}
+	switch arg := Commands[idx].Args[argIdx]; arg {
+	case ArgPeer:
+		names, _ := PeerNames()
+		return withPrefix(names, cur), false
+	case ArgFile:
+		return nil, true
+	case ArgToken, ArgNodes, ArgPath:
+		return nil, false
+	default:
+		return withPrefix(strings.Split(arg, "|"), cur), false
+	}
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func withPrefix(candidates []string, prefix string) []string {
+	return slices.DeleteFunc(candidates, func(c string) bool { return !strings.HasPrefix(c, prefix) })
+}
+
+// PeerNames returns the (sorted, unique) names of the peers of the tsync running with -api.
+func PeerNames() ([]string, error) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tapi.Dial(storage.ControlSocket())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), PeersTimeout)
+	defer cancel()
+	resp, err := tapi.NewControlClient(conn).ListPeers(ctx, &tapi.ListPeersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, p := range resp.GetPeers() {
+		names = append(names, p.GetName())
+	}
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
+
+// PeersJSON makes Peers print the whole status as JSON (-json flag).
+var PeersJSON bool
+
+// Peers prints the names of the peers of the tsync running with -api, or its status (see
+// tstatus.Status) as JSON with PeersJSON.
+func Peers() int {
+	if PeersJSON {
+		st, err := RemoteStatus()
+		if err != nil {
+			return log.FErrf("Can't get the status (is tsync running with -api?): %v", err)
+		}
+		out, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return log.FErrf("Can't encode the status: %v", err)
+		}
+		fmt.Println(string(out))
+		return 0
+	}
+	names, err := PeerNames()
+	if err != nil {
+		return log.FErrf("Can't list the peers (is tsync running with -api?): %v", err)
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return 0
+}
+
+// RunComplete runs the CompleteCommand.
+func RunComplete(words []string) int {
+	candidates, files := Complete(words)
+	if files {
+		fmt.Println(FilesDirective)
+		return 0
+	}
+	for _, c := range candidates {
+		fmt.Println(c)
+	}
+	return 0
+}
+
+// Completion prints the completion script for the shell.
+func Completion(args []string) int {
+	if len(args) != 1 {
+		return log.FErrf("Usage: tsync completion bash|zsh|fish")
+	}
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		return log.FErrf("Unknown shell %q, expecting bash, zsh or fish", args[0])
+	}
+	fmt.Print(script)
+	return 0
+}
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for tsync, load with: source <(tsync completion bash)
+_tsync() {
+	local IFS=$'\n'
+	local out=($("${COMP_WORDS[0]}" ` + CompleteCommand + ` "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+	if [[ "${out[0]}" == "` + FilesDirective + `" ]]; then
+		COMPREPLY=($(compgen -f -- "${COMP_WORDS[COMP_CWORD]}"))
+		return
+	fi
+	COMPREPLY=("${out[@]}")
+}
+complete -o filenames -F _tsync tsync
+`,
+	"zsh": `#compdef tsync
+# zsh completion for tsync, load with: source <(tsync completion zsh)
+_tsync() {
+	local -a out
+	out=(${(f)"$("${words[1]}" ` + CompleteCommand + ` "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+	if [[ "${out[1]}" == "` + FilesDirective + `" ]]; then
+		_files
+		return
+	fi
+	compadd -a out
+}
+compdef _tsync tsync
+`,
+	"fish": `# fish completion for tsync, load with: tsync completion fish | source
+function __tsync_complete
+	set -l out (tsync ` + CompleteCommand + ` (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)
+	if test "$out[1]" = "` + FilesDirective + `"
+		__fish_complete_path (commandline -ct)
+		return
+	end
+	printf '%s\n' $out
+end
+complete -c tsync -f -a '(__tsync_complete)'
+`,
+}
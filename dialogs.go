@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"fortio.org/log"
+	"fortio.org/smap"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tlayout"
+	"fortio.org/tsync/tsnet"
+)
+
+// DialogFiles is the maximum number of files of the current directory offered by SendDialog.
+const DialogFiles = 8
+
+// BackupFile is the default file name in BackupDialog.
+const BackupFile = "tsync.backup"
+
+// TrustDialog asks to confirm trusting the peers, after checking their hashes.
+func TrustDialog(id *tcrypto.Identity, peers []smap.KV[tsnet.Peer, tsnet.PeerData], hooks *Hooks) tlayout.Modal {
+	lines := make([]string, 0, len(peers)+2)
+	for _, kv := range peers {
+		lines = append(lines, fmt.Sprintf("%s at %s, hash %s", kv.Key.Name, kv.Key.IP, kv.Value.HumanHash))
+	}
+	lines = append(lines, "", "Trust them? (the hashes must match the ones they display)")
+	return &tlayout.Confirm{Title: "Trust", Lines: lines, OnDone: func(ok bool) {
+		if ok {
+			TrustPeers(id, peers, hooks)
+		}
+	}}
+}
+
+// SendDialog asks for the drop token of each peer and the file (from the current directory or any
+// path) and then drops it, in the background, in the peers' inboxes (see PluginHost.SendFiles).
+// show replaces the current modal.
+func SendDialog(host *PluginHost, peers []smap.KV[tsnet.Peer, tsnet.PeerData], show func(tlayout.Modal)) tlayout.Modal {
+	names := make([]string, len(peers))
+	for i, kv := range peers {
+		names[i] = kv.Key.Name
+	}
+	to := names[0]
+	if len(peers) > 1 {
+		to = fmt.Sprintf("%d peers", len(peers))
+	}
+	title := "Send to " + to
+	tokens := make([]string, 0, len(peers))
+	send := func(path string) {
+		go func() {
+			if err := host.SendFiles(names, tokens, path); err != nil {
+				log.Errf("Sending %s to %s failed: %v", path, strings.Join(names, ", "), err)
+			}
+		}()
+	}
+	pickFile := func() {
+		other := &tlayout.Prompt{Title: title, Label: "File path:", OnDone: func(path string, ok bool) {
+			if ok && path != "" {
+				send(path)
+			}
+		}}
+		files := DirFiles(".", DialogFiles)
+		if len(files) == 0 {
+			show(other)
+			return
+		}
+		options := append(files, "Other path...")
+		show(&tlayout.Choice{Title: "File to send to " + to, Options: options, OnDone: func(idx int, ok bool) {
+			switch {
+			case !ok:
+			case idx == len(files):
+				show(other)
+			default:
+				send(files[idx])
+			}
+		}})
+	}
+	var askToken func() tlayout.Modal
+	askToken = func() tlayout.Modal {
+		name := names[len(tokens)]
+		return &tlayout.Prompt{
+			Title: title,
+			Label: "Drop token (from tsync inbox on " + name + "):",
+			OnDone: func(token string, ok bool) {
+				if !ok || token == "" {
+					return
+				}
+				tokens = append(tokens, token)
+				if len(tokens) < len(peers) {
+					show(askToken())
+					return
+				}
+				pickFile()
+			},
+		}
+	}
+	return askToken()
+}
+
+// DirFiles returns the names of (at most n of) the regular files in dir, sorted.
+func DirFiles(dir string, n int) []string {
+	entries, err := os.ReadDir(dir) // sorted by name.
+	if err != nil {
+		log.Warnf("Can't list %s: %v", dir, err)
+		return nil
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && len(files) < n {
+			files = append(files, e.Name())
+		}
+	}
+	return files
+}
+
+// BackupDialog asks for the backup file and passphrase (twice) and writes the backup (see WriteBackup).
+// show replaces the current modal.
+func BackupDialog(show func(tlayout.Modal)) tlayout.Modal {
+	return &tlayout.Prompt{Title: "Backup", Label: "Backup file:", Value: BackupFile, OnDone: func(file string, ok bool) {
+		if !ok || file == "" {
+			return
+		}
+		label := fmt.Sprintf("Passphrase (at least %d characters):", MinPassphrase)
+		show(&tlayout.Prompt{Title: "Backup", Label: label, Mask: true, OnDone: func(passphrase string, ok bool) {
+			if !ok {
+				return
+			}
+			if len(passphrase) < MinPassphrase {
+				log.Errf("Passphrase too short, need at least %d characters", MinPassphrase)
+				return
+			}
+			show(&tlayout.Prompt{Title: "Backup", Label: "Passphrase again:", Mask: true, OnDone: func(again string, ok bool) {
+				if !ok {
+					return
+				}
+				if again != passphrase {
+					log.Errf("Passphrases don't match, no backup written")
+					return
+				}
+				go func() { // the key derivation takes a while.
+					storage, err := tcrypto.InitStorage()
+					if err == nil {
+						err = WriteBackup(storage, file, passphrase)
+					}
+					if err != nil {
+						log.Errf("Backup failed: %v", err)
+					}
+				}()
+			}})
+		}})
+	}}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tapi"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/txfer"
+)
+
+// DropTokenTTL is how long a drop token remains valid (it can only be used once).
+const DropTokenTTL = 10 * time.Minute
+
+// NewDropBox returns the DropBox for our inbox (in the storage directory), with an optional scan
+// command files must pass before landing in the inbox, running the file hooks.
+func NewDropBox(scanCommand string, hooks *Hooks) (*txfer.DropBox, error) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return nil, err
+	}
+	box, err := txfer.NewDropBox(storage.Inbox())
+	if err != nil {
+		return nil, err
+	}
+	if scanCommand != "" {
+		if box.Scan, err = txfer.ScanCommand(scanCommand, txfer.DefaultScanTimeout); err != nil {
+			return nil, fmt.Errorf("-scan %q: %w", scanCommand, err)
+		}
+	}
+	box.OnDrop = hooks.OnDrop
+	box.Dedup = true
+	return box, nil
+}
+
+// DropUsage returns the command a sender needs to run to use the token.
+func DropUsage(ourName, token string) string {
+	return fmt.Sprintf("tsync drop %s %s <file>", ourName, token)
+}
+
+// Inbox creates a one time drop token, prints it on stdout and waits for a file to be dropped with it.
+// With api, the control API is served while waiting.
+func Inbox(cfg *tsnet.Config, scanCommand string, hooks *Hooks, api bool) int {
+	box, err := NewDropBox(scanCommand, hooks)
+	if err != nil {
+		return log.FErrf("Failed to create inbox: %v", err)
+	}
+	audit, err := OpenAuditLog(cfg)
+	if err != nil {
+		return log.FErrf("Failed to open the audit log: %v", err)
+	}
+	defer audit.Close()
+	done := make(chan error, 1)
+	box.OnDrop = func(d *txfer.Drop, n int64, err error) {
+		hooks.OnDrop(d, n, err)
+		done <- err
+	}
+	host := &PluginHost{}
+	hooks.Plugins = LoadPlugins(host)
+	var srv *tsnet.Server
+	var svc *tapi.Service
+	cfg.OnChange = func(_ uint64) {
+		hooks.OnChange(srv)
+		if svc != nil {
+			svc.Changed()
+		}
+	}
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		if host.OnData(peer, data) || ReceiveEndorsement(srv, peer, data) {
+			return
+		}
+		ReceiveDrop(srv, box, peer, data)
+	}
+	cfg.RequireEncryption = true // drops (and endorsements) only from connected peers.
+	srv = cfg.NewServer()
+	host.SetServer(srv)
+	if api {
+		svc = NewAPI(srv, host, box)
+	}
+	if err = srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer srv.Stop()
+	if svc != nil {
+		stop, err := ServeAPI(svc)
+		if err != nil {
+			return log.FErrf("Failed to serve the control API: %v", err)
+		}
+		defer stop()
+	}
+	token := box.NewToken(DropTokenTTL)
+	fmt.Println(token)
+	log.Infof("Waiting (for up to %v) for a file to be dropped in %s, sender should run: %s",
+		DropTokenTTL, box.Dir, DropUsage(srv.Name, token))
+	select {
+	case err = <-done:
+		hooks.Wait()
+		if err != nil {
+			log.FErrf("Drop failed: %v", err)
+			return ExitTransferFailed
+		}
+		return 0
+	case <-time.After(DropTokenTTL):
+		log.FErrf("Drop token expired")
+		return ExitTimeout
+	}
+}
+
+// ReceiveDrop passes a data message to the DropBox and sends back its reply, if any.
+func ReceiveDrop(srv *tsnet.Server, box *txfer.DropBox, peer tsnet.Peer, data []byte) {
+	reply, err := box.Receive(peer.Name, data)
+	if err != nil {
+		log.Errf("Drop from %q rejected: %v", peer.Name, err)
+		if errors.Is(err, txfer.ErrInvalidToken) {
+			srv.RecordFailure(peer.IP, peer, "drop with an invalid token")
+		}
+	}
+	if reply == nil {
+		return
+	}
+	if err = srv.SendData(peer, reply); err != nil {
+		log.Errf("Failed to reply to %q: %v", peer.Name, err)
+	}
+}
+
+// DropReplies returns a channel for the drop replies from peerName and a function to call from
+// Config.OnData which forwards them to it (returning true if data was one).
+func DropReplies(peerName string) (<-chan []byte, func(peer tsnet.Peer, data []byte) bool) {
+	replies := make(chan []byte, 1)
+	return replies, func(peer tsnet.Peer, data []byte) bool {
+		if !IsPeer(peer, peerName) || !txfer.IsDropReply(data) {
+			return false
+		}
+		select {
+		case replies <- append([]byte(nil), data...):
+		default: // drop extra replies (to resent headers)
+		}
+		return true
+	}
+}
+
+// DropFile sends the file to the peer's inbox using the token the peer gave us, acks and replies
+// being fed from Config.OnData (see StreamAcks and DropReplies). Returns the number of bytes sent.
+func DropFile(srv *tsnet.Server, peer tsnet.Peer, token, fileName string, acks, replies <-chan []byte) (int64, error) {
+	f, err := txfer.OpenFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	newSender := func() *txfer.StreamSender { return DropSender(srv, peer, acks) }
+	return txfer.SendDropFile(context.Background(), newSender, token, filepath.Base(fileName), "", f, replies)
+}
+
+// DropSender returns a new stream to the peer, with congestion control fed by acks.
+func DropSender(srv *tsnet.Server, peer tsnet.Peer, acks <-chan []byte) *txfer.StreamSender {
+	return &txfer.StreamSender{
+		ID:        rand.Uint32(), //nolint:gosec // not cryptographic, just to tell streams apart.
+		FrameSize: srv.MaxDataSize(peer),
+		Send: func(frame []byte) error {
+			return srv.SendData(peer, frame)
+		},
+		SendBatch: func(frames [][]byte) error {
+			return srv.SendDataBatch(peer, frames)
+		},
+		Congestion: txfer.NewAIMD(0),
+		Acks:       acks,
+	}
+}
+
+// DropTarget is a peer to drop a file to (see DropFiles).
+type DropTarget struct {
+	Name  string     // of the peer as given (see IsPeer)
+	Token string     // the peer gave us
+	Peer  tsnet.Peer // once found and connected
+
+	acks, replies <-chan []byte
+}
+
+// NewDropTargets returns the drop targets of the named peers, each with its token, and the function
+// to call from Config.OnData which forwards them their stream acks and drop replies (returning true
+// if data was one).
+func NewDropTargets(peerNames, tokens []string) ([]*DropTarget, func(peer tsnet.Peer, data []byte) bool, error) {
+	targets := make([]*DropTarget, len(peerNames))
+	handlers := make([]func(peer tsnet.Peer, data []byte) bool, 0, 2*len(peerNames))
+	for i, name := range peerNames {
+		for _, t := range targets[:i] {
+			if t.Name == name {
+				return nil, nil, fmt.Errorf("peer %q given more than once", name)
+			}
+		}
+		t := &DropTarget{Name: name, Token: tokens[i]}
+		var onAck, onReply func(peer tsnet.Peer, data []byte) bool
+		t.acks, onAck = StreamAcks(name)
+		t.replies, onReply = DropReplies(name)
+		handlers = append(handlers, onAck, onReply)
+		targets[i] = t
+	}
+	return targets, func(peer tsnet.Peer, data []byte) bool {
+		for _, h := range handlers {
+			if h(peer, data) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// DropFiles sends the file to the inboxes of the (connected) targets, skipping those which already
+// have it (see txfer.ContentDigest): to a single one streamed directly (see txfer.SendDropFile), to
+// more reading each chunk once for all of them (see txfer.FanOutDropFile). It returns the progress
+// of each target, in the same order, with Bytes the bytes dropped, Skipped set for those which had
+// the file and Err for those which failed.
+func DropFiles(srv *tsnet.Server, targets []*DropTarget, fileName string) []txfer.Progress {
+	res := make([]txfer.Progress, len(targets))
+	f, err := txfer.OpenFile(fileName)
+	var digest string
+	if err == nil {
+		defer f.Close()
+		digest, err = txfer.ContentDigest(f)
+	}
+	if err != nil {
+		for i, t := range targets {
+			res[i] = txfer.Progress{Target: t.Peer.Name, Err: err, Done: true}
+		}
+		return res
+	}
+	if len(targets) == 1 {
+		t := targets[0]
+		newSender := func() *txfer.StreamSender { return DropSender(srv, t.Peer, t.acks) }
+		n, err := txfer.SendDropFile(context.Background(), newSender, t.Token, filepath.Base(fileName), digest, f, t.replies)
+		res[0] = txfer.Progress{Target: t.Peer.Name, Bytes: n, Err: err, Done: true}
+		if errors.Is(err, txfer.ErrDuplicate) {
+			res[0].Err, res[0].Skipped = nil, true
+		}
+		return res
+	}
+	dests := make([]txfer.DropDest, len(targets))
+	for i, t := range targets {
+		newSender := func() *txfer.StreamSender { return DropSender(srv, t.Peer, t.acks) }
+		dests[i] = txfer.DropDest{Name: t.Peer.Name, Token: t.Token, NewSender: newSender, Replies: t.replies}
+	}
+	return txfer.FanOutDropFile(context.Background(), filepath.Base(fileName), digest, f, dests...)
+}
+
+// Drop connects to the named peers and sends the file to their inboxes using the tokens they gave
+// us (see DropFiles). The peers we can't connect to are skipped, the exit code is the one of the
+// first failure.
+func Drop(cfg *tsnet.Config, peerNames, tokens []string, fileName string, timeout time.Duration) int {
+	st, err := os.Stat(fileName)
+	if err != nil {
+		return log.FErrf("Failed to stat %q: %v", fileName, err)
+	}
+	size := st.Size()
+	targets, onData, err := NewDropTargets(peerNames, tokens)
+	if err != nil {
+		return log.FErrf("Invalid drop: %v", err)
+	}
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		onData(peer, data)
+	}
+	cfg.RequireEncryption = true
+	srv := cfg.NewServer()
+	if err = srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer srv.Stop()
+	// The one time tokens are what the inboxes trust, we don't need to trust their keys.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Go(func() {
+			if t.Peer, errs[i] = ConnectPeer(ctx, srv, t.Name, false); errs[i] == nil {
+				ProbeMTU(srv, t.Peer)
+			}
+		})
+	}
+	wg.Wait()
+	cancel()
+	code := 0
+	connected := make([]*DropTarget, 0, len(targets))
+	for i, t := range targets {
+		if errs[i] != nil {
+			log.Errf("Can't connect to %q: %v", t.Name, errs[i])
+			code = cmp.Or(code, ConnectExitCode(errs[i]))
+			continue
+		}
+		connected = append(connected, t)
+	}
+	if len(connected) == 0 {
+		return code
+	}
+	var saved int64
+	for _, p := range DropFiles(srv, connected, fileName) {
+		switch {
+		case p.Err != nil:
+			log.Errf("Error after sending %d bytes to %q: %v", p.Bytes, p.Target, p.Err)
+			code = cmp.Or(code, TransferExitCode(p.Err))
+		case p.Skipped:
+			log.Infof("%q already has %q, skipped", p.Target, fileName)
+			saved += size
+		default:
+			log.Infof("Dropped %q (%d bytes) to %q", fileName, p.Bytes, p.Target)
+		}
+	}
+	if saved > 0 {
+		log.Infof("Saved %d bytes skipping the peers which already had %q", saved, fileName)
+	}
+	return code
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/txfer"
+)
+
+// TestDropFiles drops a file in the inboxes of 2 peers at once.
+func TestDropFiles(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "release.bin")
+	data := bytes.Repeat([]byte("tsync fan-out "), 20000)
+	if err := os.WriteFile(fileName, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sender := newTestServer(t, "sender", false)
+	us := sender.OurAddress()
+	var peerNames, tokens []string
+	var boxes []*txfer.DropBox
+	for _, name := range []string{"inbox-1", "inbox-2"} {
+		box, err := txfer.NewDropBox(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := tcrypto.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var srv *tsnet.Server
+		cfg := tsnet.Config{Name: name, Identity: id, NoDiscovery: true, RequireEncryption: true}
+		cfg.OnData = func(peer tsnet.Peer, data []byte) {
+			ReceiveDrop(srv, box, peer, data)
+		}
+		srv = cfg.NewServer()
+		if err = srv.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		t.Cleanup(srv.Stop)
+		srv.AddPeer(tsnet.Peer{IP: us.IP.String(), Name: sender.Name, PublicKey: sender.Identity.PublicKeyToString()}, us.Port)
+		addr := srv.OurAddress()
+		sender.AddPeer(tsnet.Peer{IP: addr.IP.String(), Name: name, PublicKey: id.PublicKeyToString()}, addr.Port)
+		peerNames, tokens = append(peerNames, name), append(tokens, box.NewToken(time.Minute))
+		boxes = append(boxes, box)
+	}
+	if _, _, err := NewDropTargets([]string{"inbox-1", "inbox-1"}, []string{"a", "b"}); err == nil {
+		t.Errorf("NewDropTargets should refuse the same peer twice")
+	}
+	targets, onData, err := NewDropTargets(peerNames, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.OnData = func(peer tsnet.Peer, data []byte) {
+		onData(peer, data)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, target := range targets {
+		if target.Peer, err = WaitForPeer(ctx, sender, target.Name); err != nil {
+			t.Fatal(err)
+		}
+		if err = Connect(ctx, sender, target.Peer); err != nil {
+			t.Fatalf("Connect to %q failed: %v", target.Name, err)
+		}
+	}
+	for i, p := range DropFiles(sender, targets, fileName) {
+		if p.Err != nil || p.Bytes != int64(len(data)) {
+			t.Errorf("Drop to %q: %+v", targets[i].Name, p)
+		}
+		// the end frame may still be on its way.
+		got, err := os.ReadFile(filepath.Join(boxes[i].Dir, "release.bin"))
+		for ; err != nil && ctx.Err() == nil; got, err = os.ReadFile(filepath.Join(boxes[i].Dir, "release.bin")) {
+			time.Sleep(10 * time.Millisecond)
+			boxes[i].Wait()
+		}
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%q didn't receive the file: %v", targets[i].Name, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tupdate"
+	"fortio.org/tsync/txfer"
+)
+
+// Exit codes of the tsync command, stable so scripts can branch on them.
+const (
+	ExitOK             = 0
+	ExitError          = 1 // usage and other errors.
+	ExitNoPeer         = 2 // the peer wasn't found (or connected to) within -timeout.
+	ExitTransferFailed = 3 // the stream or drop failed.
+	ExitUntrusted      = 4 // the peer isn't trusted or refused our connection, drop token (or snapshot or shares request), a release failed verification or wrong backup passphrase.
+	ExitTimeout        = 5 // the stream went idle or the drop token expired.
+)
+
+// ExitCodeInfo describes an exit code for -help-json.
+type ExitCodeInfo struct {
+	Code    int    `json:"code"`
+	Meaning string `json:"meaning"`
+}
+
+// ExitCodes describes the exit codes.
+var ExitCodes = []ExitCodeInfo{
+	{ExitOK, "ok"},
+	{ExitError, "usage or other error"},
+	{ExitNoPeer, "peer not found or not connected"},
+	{ExitTransferFailed, "transfer failed"},
+	{ExitUntrusted, "peer untrusted, connection or drop token refused, release verification failed or wrong backup passphrase"},
+	{ExitTimeout, "stream idle or drop token expired"},
+}
+
+// TransferExitCode returns the exit code for a failed transfer.
+func TransferExitCode(err error) int {
+	var refused *txfer.RefusedError
+	if errors.As(err, &refused) && refused.Reason == txfer.ErrInvalidToken.Error() || errors.Is(err, ErrTargetUntrusted) ||
+		errors.Is(err, ErrShareUntrusted) {
+		return ExitUntrusted
+	}
+	return ExitTransferFailed
+}
+
+// ConnectExitCode returns the exit code for a failed ConnectPeer.
+func ConnectExitCode(err error) int {
+	if errors.Is(err, ErrPeerUntrusted) || errors.Is(err, tsnet.ErrConnectionRejected) {
+		return ExitUntrusted
+	}
+	return ExitNoPeer
+}
+
+// UpdateExitCode returns the exit code for a failed update download.
+func UpdateExitCode(err error) int {
+	var invalid *tcrypto.SignatureInvalidError
+	if errors.As(err, &invalid) || errors.Is(err, tupdate.ErrChecksum) {
+		return ExitUntrusted
+	}
+	return ExitError
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tsnet"
+)
+
+// FirewallRuleName is the name of the (Windows) firewall rule allowing tsync inbound UDP.
+const FirewallRuleName = "tsync"
+
+// FirewallCommands returns the commands allowing inbound UDP to the tsync executable exe on goos,
+// nil when we don't know them (on Linux inbound UDP is usually allowed on LANs).
+func FirewallCommands(goos, exe string) [][]string {
+	switch goos {
+	case "windows":
+		return [][]string{{
+			"netsh", "advfirewall", "firewall", "add", "rule", "name=" + FirewallRuleName,
+			"dir=in", "action=allow", "protocol=UDP", "profile=private,domain", "program=" + exe, "enable=yes",
+		}}
+	case "darwin":
+		fw := "/usr/libexec/ApplicationFirewall/socketfilterfw"
+		return [][]string{
+			{"sudo", fw, "--add", exe},
+			{"sudo", fw, "--unblockapp", exe},
+		}
+	default:
+		return nil
+	}
+}
+
+// CommandString returns the command as it would be typed in a shell (quoting arguments with spaces).
+func CommandString(cmd []string) string {
+	quoted := make([]string, 0, len(cmd))
+	for _, arg := range cmd {
+		if strings.ContainsAny(arg, " \t") {
+			arg = `"` + arg + `"`
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// executable returns the absolute path of our binary.
+func executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+var firewallWarned atomic.Bool
+
+// CheckFirewall warns (once) with the commands to fix it when inbound UDP looks blocked by the local
+// firewall: the peer is discovered (its announcements reach us) yet MTU probing got no reply at all
+// and we never received any unicast message. Returns true if it looks blocked.
+func CheckFirewall(srv *tsnet.Server, peer tsnet.Peer, mtu int) bool {
+	if mtu > tsnet.DefaultMTU || srv.UnicastReceived() > 0 {
+		return false
+	}
+	if firewallWarned.Swap(true) {
+		return true
+	}
+	log.Warnf("No unicast reply from %q (%s) even though it is discovered: inbound UDP is likely blocked "+
+		"by a firewall (ours or the peer's)", peer.Name, peer.IP)
+	exe, err := executable()
+	if err != nil {
+		return true
+	}
+	cmds := FirewallCommands(runtime.GOOS, exe)
+	if len(cmds) == 0 {
+		log.Warnf("Check that inbound UDP from the local network is allowed to %s", exe)
+		return true
+	}
+	log.Warnf("To allow it (as administrator), run `tsync firewall apply` or:")
+	for _, cmd := range cmds {
+		log.Warnf("  %s", CommandString(cmd))
+	}
+	return true
+}
+
+// Firewall prints the firewall commands allowing tsync inbound UDP or, with the "apply" argument,
+// runs them (which needs administrator rights: run it from an elevated prompt on Windows,
+// sudo asks for the password on macOS).
+func Firewall(args []string) int {
+	apply := len(args) == 1 && args[0] == "apply"
+	if len(args) > 1 || (len(args) == 1 && !apply) {
+		return log.FErrf("Usage: tsync firewall [apply]")
+	}
+	exe, err := executable()
+	if err != nil {
+		return log.FErrf("Can't find our executable: %v", err)
+	}
+	cmds := FirewallCommands(runtime.GOOS, exe)
+	if len(cmds) == 0 {
+		log.Infof("No firewall commands for %s, make sure inbound UDP from the local network is allowed to %s",
+			runtime.GOOS, exe)
+		return 0
+	}
+	for _, cmd := range cmds {
+		if !apply {
+			fmt.Println(CommandString(cmd))
+			continue
+		}
+		log.Infof("Running %s", CommandString(cmd))
+		c := exec.Command(cmd[0], cmd[1:]...) //nolint:gosec // our own fixed commands.
+		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err = c.Run(); err != nil {
+			return log.FErrf("Failed to run %s (administrator rights needed?): %v", CommandString(cmd), err)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tplugin"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tstatus"
+	"fortio.org/tsync/txfer"
+)
+
+// HookTimeout is the maximum time a hook command can run.
+const HookTimeout = time.Minute
+
+// Hook events (TSYNC_EVENT value).
+const (
+	EventPeerDiscovered = "peer-discovered"
+	EventPeerLost       = "peer-lost"
+	EventFileReceived   = "file-received"
+	EventConflict       = "conflict"
+	// Only for the plugins and OnEvent, no hook command.
+	EventPeerStatus  = "peer-status"
+	EventPeerTrusted = "peer-trusted"
+)
+
+// Hooks are the commands run on events, with the event details in TSYNC_* environment variables:
+// TSYNC_EVENT always, TSYNC_PEER, TSYNC_PEER_IP, TSYNC_PEER_KEY and TSYNC_PEER_HASH for peer events,
+// TSYNC_FILE, TSYNC_NAME, TSYNC_FROM (and TSYNC_PEER, same) and TSYNC_SIZE for received files
+// (conflicts are received files which were renamed, TSYNC_NAME being the original name, as another
+// file had it). The events are also passed to the plugins, the details being the fields (in lower
+// case, without the TSYNC_ prefix) of their handlers' argument, and to OnEvent. The plugins and
+// OnEvent also get the peer-status (connection status changes, with a status detail) and
+// peer-trusted events.
+type Hooks struct {
+	PeerDiscovered string
+	PeerLost       string
+	FileReceived   string
+	Conflict       string
+	mu             sync.Mutex
+	peers          map[tsnet.Peer]tsnet.PeerData // known peers, to tell what changed.
+	wg             sync.WaitGroup
+	Plugins        *tplugin.Engine // nil for none
+	// Called (synchronously) with every event, e.g. for the terminal UI's Timeline.
+	OnEvent func(event string, details map[string]string)
+}
+
+// HookFlags defines the -on-* flags.
+func HookFlags() *Hooks {
+	h := &Hooks{}
+	flag.StringVar(&h.PeerDiscovered, "on-peer-discovered", "", "Command to run when a peer is discovered")
+	flag.StringVar(&h.PeerLost, "on-peer-lost", "", "Command to run when a peer is lost (expired)")
+	flag.StringVar(&h.FileReceived, "on-file-received", "", "Command to run when a file is received in the inbox")
+	flag.StringVar(&h.Conflict, "on-conflict", "",
+		"Command to run when a received file is renamed because a file with the same name exists")
+	return h
+}
+
+// run runs the command and the plugins' handlers (in the background) for the event.
+func (h *Hooks) run(command, event string, details map[string]string) {
+	if h.OnEvent != nil {
+		h.OnEvent(event, details)
+	}
+	if h.Plugins != nil {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.Plugins.Fire(event, details)
+		}()
+	}
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return
+	}
+	env := []string{"TSYNC_EVENT=" + event}
+	for k, v := range details {
+		env = append(env, "TSYNC_"+strings.ToUpper(k)+"="+v)
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...) //nolint:gosec // user configured command.
+		cmd.Env = append(os.Environ(), env...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Warnf("Hook %s %q failed: %v: %s", event, command, err, out)
+			return
+		}
+		log.LogVf("Hook %s %q ok: %s", event, command, out)
+	}()
+}
+
+// Wait waits for the running hook commands to finish.
+func (h *Hooks) Wait() {
+	h.wg.Wait()
+}
+
+func peerDetails(peer tsnet.Peer, data tsnet.PeerData) map[string]string {
+	return map[string]string{
+		"peer":      peer.Name,
+		"peer_ip":   peer.IP,
+		"peer_key":  peer.PublicKey,
+		"peer_hash": data.HumanHash,
+	}
+}
+
+// Publish passes an event without hook command (e.g. EventPeerTrusted) to the plugins and OnEvent.
+func (h *Hooks) Publish(event string, details map[string]string) {
+	h.run("", event, details)
+}
+
+// OnChange runs the peer hooks for the peers added to or removed from srv.Peers since the last call,
+// and publishes their connection status changes. To be called from Config.OnChange.
+func (h *Hooks) OnChange(srv *tsnet.Server) {
+	if h.PeerDiscovered == "" && h.PeerLost == "" && h.Plugins == nil && h.OnEvent == nil {
+		return
+	}
+	h.mu.Lock()
+	current := maps.Collect(srv.Peers.All())
+	previous := h.peers
+	h.peers = current
+	h.mu.Unlock()
+	for peer, data := range current {
+		old, ok := previous[peer]
+		switch {
+		case !ok:
+			h.run(h.PeerDiscovered, EventPeerDiscovered, peerDetails(peer, data))
+		case old.Status != data.Status:
+			details := peerDetails(peer, data)
+			details["status"] = tstatus.StatusName(data.Status)
+			h.Publish(EventPeerStatus, details)
+		}
+	}
+	for peer, data := range previous {
+		if _, ok := current[peer]; !ok {
+			h.run(h.PeerLost, EventPeerLost, peerDetails(peer, data))
+		}
+	}
+}
+
+// OnDrop runs the file hooks for a successful drop (not for one the inbox already had). To be called
+// from DropBox.OnDrop.
+func (h *Hooks) OnDrop(d *txfer.Drop, n int64, err error) {
+	if err != nil || d.Duplicate {
+		return
+	}
+	details := map[string]string{
+		"file": d.Path,
+		"name": d.Name,
+		"from": d.From,
+		"peer": d.From,
+		"size": strconv.FormatInt(n, 10),
+	}
+	h.run(h.FileReceived, EventFileReceived, details)
+	if filepath.Base(d.Path) != d.Name {
+		h.run(h.Conflict, EventConflict, details)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tlayout"
+)
+
+// Action is what a key does in the terminal UI.
+type Action string
+
+const (
+	ActionUp        Action = "up"
+	ActionDown      Action = "down"
+	ActionFirst     Action = "first"
+	ActionLast      Action = "last"
+	ActionMark      Action = "mark"
+	ActionMarkAll   Action = "mark-all"
+	ActionConnect   Action = "connect"
+	ActionTrust     Action = "trust"
+	ActionSend      Action = "send"
+	ActionBrowse    Action = "browse"
+	ActionBackup    Action = "backup"
+	ActionSchedules Action = "schedules"
+	ActionToken     Action = "token"
+	ActionRestart   Action = "restart"
+	ActionNextPane  Action = "next-pane"
+	ActionGrow      Action = "grow"
+	ActionShrink    Action = "shrink"
+	ActionColumn    Action = "column"
+	ActionColLeft   Action = "column-left"
+	ActionColRight  Action = "column-right"
+	ActionWiden     Action = "widen"
+	ActionNarrow    Action = "narrow"
+	ActionColReset  Action = "reset-columns"
+	ActionMap       Action = "map"
+	ActionGraph     Action = "graph"
+	ActionTimeline  Action = "timeline"
+	ActionPalette   Action = "palette"
+	ActionHelp      Action = "help"
+	ActionQuit      Action = "quit"
+)
+
+// ActionInfo is an action and its help.
+type ActionInfo struct {
+	Action Action
+	Help   string
+}
+
+// Actions are the terminal UI actions with their help, in the order shown by KeyMap.Help.
+var Actions = []ActionInfo{
+	{ActionUp, "move the peer cursor up"},
+	{ActionDown, "move the peer cursor down"},
+	{ActionFirst, "move the peer cursor to the first peer"},
+	{ActionLast, "move the peer cursor to the last peer"},
+	{ActionMark, "mark or unmark the peer under the cursor"},
+	{ActionMarkAll, "mark all the peers (or none)"},
+	{ActionConnect, "connect to the marked peers (or the one under the cursor)"},
+	{ActionTrust, "trust the marked peers, after checking their hashes"},
+	{ActionSend, "send a file to the marked peers (or the one under the cursor)"},
+	{ActionBrowse, "browse the peer's shared directories and pull files or directories"},
+	{ActionBackup, "backup the identity"},
+	{ActionSchedules, "show the scheduled sync jobs, their next run and last result"},
+	{ActionToken, "show a one time drop token"},
+	{ActionRestart, "announce a restart and stop"},
+	{ActionNextPane, "switch the focused pane"},
+	{ActionGrow, "grow the focused pane"},
+	{ActionShrink, "shrink the focused pane"},
+	{ActionColumn, "select the next column of the peers table, to move or resize it"},
+	{ActionColLeft, "move the selected column left"},
+	{ActionColRight, "move the selected column right"},
+	{ActionWiden, "widen the selected column"},
+	{ActionNarrow, "narrow the selected column"},
+	{ActionColReset, "put the columns back in their order and widths"},
+	{ActionMap, "switch the peers pane between the table and the map"},
+	{ActionGraph, "switch the transfers pane between the transfers and the traffic graph"},
+	{ActionTimeline, "switch the transfers pane to the timeline of the events (of the marked peers)"},
+	{ActionPalette, "command palette, to search and run the actions"},
+	{ActionHelp, "show this help"},
+	{ActionQuit, "stop"},
+}
+
+// KeyPresets are the key bindings KeysConfig.Preset can start from; "default" unless set.
+var KeyPresets = map[string]map[string]Action{
+	"default": defaultKeys,
+	"vi": withKeys(defaultKeys, map[string]Action{
+		"g": ActionFirst, "G": ActionLast, "x": ActionMark, "ctrl-w": ActionNextPane,
+	}),
+}
+
+var defaultKeys = map[string]Action{
+	"up": ActionUp, "k": ActionUp, "down": ActionDown, "j": ActionDown, "home": ActionFirst, "end": ActionLast,
+	"space": ActionMark, "a": ActionMarkAll, "c": ActionConnect, "enter": ActionConnect, "v": ActionTrust,
+	"s": ActionSend, "r": ActionBrowse, "B": ActionBackup, "S": ActionSchedules, "t": ActionToken, "T": ActionToken, "R": ActionRestart,
+	"tab": ActionNextPane, "+": ActionGrow, "-": ActionShrink, "|": ActionColumn, "[": ActionColLeft,
+	"]": ActionColRight, ">": ActionWiden, "<": ActionNarrow, "=": ActionColReset,
+	"m": ActionMap, "b": ActionGraph, "e": ActionTimeline,
+	"ctrl-p": ActionPalette, "?": ActionHelp,
+	"q": ActionQuit, "Q": ActionQuit, "ctrl-c": ActionQuit,
+}
+
+func withKeys(base, extra map[string]Action) map[string]Action {
+	keys := make(map[string]Action, len(base)+len(extra))
+	for _, m := range []map[string]Action{base, extra} {
+		for k, a := range m {
+			keys[k] = a
+		}
+	}
+	return keys
+}
+
+// KeysConfig is the content of the key bindings file (see tcrypto.Storage.Keys), e.g.
+//
+//	{"preset": "vi", "bindings": {"w": "next-pane", "tab": ""}}
+//
+// Bindings are key names (see tlayout.KeyName) to actions, added to (or, with an empty action,
+// removed from) the preset's.
+type KeysConfig struct {
+	Preset   string            `json:"preset,omitempty"`
+	Bindings map[string]Action `json:"bindings,omitempty"`
+}
+
+// KeyMap maps the keys to the terminal UI actions.
+type KeyMap struct {
+	Preset string
+	Source string // configuration file, if one was loaded.
+	keys   map[string]Action
+}
+
+// NewKeyMap returns the key bindings of the preset (see KeyPresets).
+func NewKeyMap(preset string) (*KeyMap, error) {
+	if preset == "" {
+		preset = "default"
+	}
+	keys, ok := KeyPresets[preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown key preset %q", preset)
+	}
+	return &KeyMap{Preset: preset, keys: withKeys(keys, nil)}, nil
+}
+
+// Bind binds the key to the action, or unbinds it if the action is empty.
+func (k *KeyMap) Bind(key string, action Action) error {
+	if !tlayout.ValidKey(key) {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	if action == "" {
+		delete(k.keys, key)
+		return nil
+	}
+	if !slices.ContainsFunc(Actions, func(a ActionInfo) bool { return a.Action == action }) {
+		return fmt.Errorf("unknown action %q for key %q", action, key)
+	}
+	k.keys[key] = action
+	return nil
+}
+
+// Action returns the action of the key read from the terminal, "" if it isn't bound.
+// Ctrl-C always stops.
+func (k *KeyMap) Action(data []byte) Action {
+	key := tlayout.KeyName(data)
+	if key == "ctrl-c" {
+		return ActionQuit
+	}
+	return k.keys[key]
+}
+
+// Keys returns the keys bound to the action, single characters first.
+func (k *KeyMap) Keys(action Action) []string {
+	var keys []string
+	for key, a := range k.keys {
+		if a == action {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return strings.Compare(a, b)
+	})
+	return keys
+}
+
+// Describe returns the keys of the action for messages, e.g. "q or Q".
+func (k *KeyMap) Describe(action Action) string {
+	keys := k.Keys(action)
+	if len(keys) == 0 {
+		return "(unbound)"
+	}
+	return strings.Join(keys, " or ")
+}
+
+// Help returns the lines of the help overlay: the current bindings of each action.
+func (k *KeyMap) Help() []string {
+	lines := make([]string, 0, len(Actions)+3)
+	source := "built in"
+	if k.Source != "" {
+		source = k.Source
+	}
+	lines = append(lines, fmt.Sprintf("Preset %q, %s", k.Preset, source), "")
+	for _, a := range Actions {
+		lines = append(lines, fmt.Sprintf("%-18s %s", strings.Join(k.Keys(a.Action), ", "), a.Help))
+	}
+	lines = append(lines, fmt.Sprintf("%-18s %s", "1-9", "connect to the peer with that number (unless bound)"))
+	return lines
+}
+
+// LoadKeyMap reads the key bindings configuration file, the default bindings are returned
+// when it doesn't exist.
+func LoadKeyMap(file string) (*KeyMap, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewKeyMap("")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg KeysConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	k, err := NewKeyMap(cfg.Preset)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	k.Source = file
+	for key, action := range cfg.Bindings {
+		if err = k.Bind(key, action); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return k, nil
+}
+
+// LoadKeys loads the terminal UI key bindings from the configuration directory (see
+// tcrypto.Storage.Keys), falling back to the default ones on errors.
+func LoadKeys() *KeyMap {
+	storage, err := tcrypto.InitStorage()
+	if err == nil {
+		var k *KeyMap
+		if k, err = LoadKeyMap(storage.Keys()); err == nil {
+			return k
+		}
+	}
+	log.Errf("Using the default key bindings: %v", err)
+	k, _ := NewKeyMap("")
+	return k
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tlayout"
+)
+
+// PeersView is the TableLayouts key of the peers table.
+const PeersView = "peers"
+
+// TableLayouts are the column layouts (order and widths) of the terminal UI's tables by view,
+// e.g. PeersView, saved as JSON in the configuration directory (see tcrypto.Storage.Layout):
+//
+//	{"peers": {"order": ["Name", "Id"], "widths": {"Hash": 8}}}
+type TableLayouts map[string]*tlayout.ColumnLayout
+
+// Get returns the layout of the view, adding an empty one if there is none.
+func (t TableLayouts) Get(view string) *tlayout.ColumnLayout {
+	l := t[view]
+	if l == nil {
+		l = &tlayout.ColumnLayout{}
+		t[view] = l
+	}
+	return l
+}
+
+// LoadTableLayouts reads the layouts file, none are returned when it doesn't exist.
+func LoadTableLayouts(file string) (TableLayouts, error) {
+	layouts := make(TableLayouts)
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return layouts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &layouts); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return layouts, nil
+}
+
+// Save writes the layouts file.
+func (t TableLayouts) Save(file string) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tcrypto.WriteFileAtomic(file, append(data, '\n'), 0o644)
+}
+
+// LoadLayouts loads the terminal UI's table layouts from the configuration directory, returning
+// the file to save them to ("" when it can't be determined). Errors are logged and the default
+// layouts used.
+func LoadLayouts() (TableLayouts, string) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		log.Errf("Using the default table layouts: %v", err)
+		return make(TableLayouts), ""
+	}
+	file := storage.Layout()
+	layouts, err := LoadTableLayouts(file)
+	if err != nil {
+		log.Errf("Using the default table layouts: %v", err)
+		return make(TableLayouts), file
+	}
+	return layouts, file
+}
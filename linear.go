@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/smap"
+	"fortio.org/tsync/tapi"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tstatus"
+	"fortio.org/tsync/tsync"
+)
+
+// LinearHelp lists the commands of the linear (screen reader) mode.
+const LinearHelp = "Commands: a peer number or name to connect to it, l to list the peers, " +
+	"t for a one time drop token, S for the scheduled jobs, R to announce a restart and stop, q to stop"
+
+func peerCompare(a, b tsnet.Peer) int {
+	switch {
+	case tsnet.PeerLess(a, b):
+		return -1
+	case tsnet.PeerLess(b, a):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// PeerChanges returns the labeled, one line, descriptions of what changed from previous to current peers.
+func PeerChanges(previous, current map[tsnet.Peer]tsnet.PeerData) []string {
+	var changes []string
+	for _, peer := range slices.SortedFunc(maps.Keys(current), peerCompare) {
+		data := current[peer]
+		old, known := previous[peer]
+		switch {
+		case !known:
+			changes = append(changes, fmt.Sprintf("Peer %s discovered, ip %s, hash %s", peer.Name, peer.IP, data.HumanHash))
+		case old.Status != data.Status:
+			changes = append(changes, fmt.Sprintf("Peer %s %s, hash %s", peer.Name, tstatus.StatusName(data.Status), data.HumanHash))
+		}
+		if known && data.MTU != old.MTU && data.MTU != 0 {
+			changes = append(changes, fmt.Sprintf("Peer %s MTU %d", peer.Name, data.MTU))
+		}
+	}
+	for _, peer := range slices.SortedFunc(maps.Keys(previous), peerCompare) {
+		if _, ok := current[peer]; !ok {
+			changes = append(changes, fmt.Sprintf("Peer %s lost", peer.Name))
+		}
+	}
+	return changes
+}
+
+// PeerList returns the numbered (as in the terminal UI, to connect to them), labeled, lines describing the peers.
+func PeerList(kvs []smap.KV[tsnet.Peer, tsnet.PeerData]) []string {
+	if len(kvs) == 0 {
+		return []string{"No peers"}
+	}
+	lines := make([]string, 0, len(kvs))
+	for i, kv := range kvs {
+		p := tstatus.NewPeer(i+1, kv.Key, kv.Value)
+		mtu := "not probed"
+		if p.MTU != 0 {
+			mtu = strconv.Itoa(p.MTU)
+		}
+		lines = append(lines, fmt.Sprintf("Peer %d: %s, %s, ip %s, port %d, hash %s, MTU %s",
+			p.ID, p.Name, p.Status, p.IP, p.Port, p.HumanHash, mtu))
+	}
+	return lines
+}
+
+// Linear is the accessible alternative to the terminal UI, for screen readers and captures: no cursor
+// addressing nor colors, only labeled lines written to out for each change, and line commands read from in.
+func Linear(cfg *tsnet.Config, scanCommand string, hooks *Hooks, api bool, in io.Reader, out io.Writer) int {
+	id, err := tsync.LoadIdentity()
+	if err != nil {
+		return log.FErrf("Failed to load or create identity: %v", err)
+	}
+	cfg.Identity = id
+	audit, err := OpenAuditLog(cfg)
+	if err != nil {
+		return log.FErrf("Failed to open the audit log: %v", err)
+	}
+	defer audit.Close()
+	audit.OnBan = func(ev tsnet.AuditEvent) {
+		fmt.Fprintf(out, "Warning: %s banned for %v after repeated failures: %s\n", AuditSource(ev), ev.Banned, ev.Reason)
+	}
+	changed := make(chan struct{}, 1)
+	var srv *tsnet.Server
+	var svc *tapi.Service
+	var host *PluginHost
+	host = &PluginHost{OnStatus: func() {
+		fmt.Fprintf(out, "Status: %s\n", host.Status())
+	}}
+	hooks.Plugins = LoadPlugins(host)
+	schedules := LoadSchedules()
+	shares := LoadShares()
+	cfg.OnChange = func(_ uint64) {
+		hooks.OnChange(srv)
+		if svc != nil {
+			svc.Changed()
+		}
+		select {
+		case changed <- struct{}{}:
+		default: // already pending.
+		}
+	}
+	box, err := NewDropBox(scanCommand, hooks)
+	if err != nil {
+		return log.FErrf("Failed to create inbox: %v", err)
+	}
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		if host.OnData(peer, data) || schedules.OnData(peer, data) || shares.Receive(peer, data) ||
+			ReceiveEndorsement(srv, peer, data) {
+			return
+		}
+		ReceiveDrop(srv, box, peer, data)
+	}
+	srv = cfg.NewServer()
+	host.SetServer(srv)
+	shares.srv = srv
+	if api {
+		svc = NewAPI(srv, host, box)
+	}
+	if err = srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer srv.Stop()
+	if svc != nil {
+		stop, err := ServeAPI(svc)
+		if err != nil {
+			return log.FErrf("Failed to serve the control API: %v", err)
+		}
+		defer stop()
+	}
+	addr := srv.OurAddress()
+	fmt.Fprintf(out, "Started as %s, ip %s, port %d, hash %s\n", srv.Name, addr.IP, addr.Port, id.HumanID())
+	fmt.Fprintln(out, LinearHelp)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	go schedules.Run(ctx, srv)
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- strings.TrimSpace(scanner.Text())
+		}
+		// On EOF (e.g. captures without input) we keep running until interrupted.
+	}()
+	var known map[tsnet.Peer]tsnet.PeerData
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(out, "Stopping")
+			return 0
+		case <-changed:
+			current := maps.Collect(srv.Peers.All())
+			for _, line := range PeerChanges(known, current) {
+				fmt.Fprintln(out, line)
+			}
+			known = current
+		case line := <-lines:
+			if line == "S" {
+				for _, l := range ScheduleLines(schedules.Sched.Status(), time.Now()) {
+					fmt.Fprintln(out, l)
+				}
+				continue
+			}
+			if !LinearCommand(srv, box.NewToken, line, out) {
+				return 0
+			}
+		}
+	}
+}
+
+// LinearCommand runs a command of the linear mode, returns false to stop.
+func LinearCommand(srv *tsnet.Server, newToken func(ttl time.Duration) string, line string, out io.Writer) bool {
+	peers := srv.Peers.KeysValuesSnapshot()
+	slices.SortFunc(peers, tsnet.PeerKVSort)
+	switch line {
+	case "":
+		return true
+	case "q", "Q":
+		fmt.Fprintln(out, "Stopping")
+		return false
+	case "R":
+		if err := srv.AnnounceRestart(RestartDowntime); err != nil {
+			fmt.Fprintf(out, "Restart announcement failed: %v\n", err)
+		}
+		fmt.Fprintf(out, "Stopping for a restart, peers will wait up to %v for us\n", RestartDowntime)
+		return false
+	case "l", "L":
+		for _, l := range PeerList(peers) {
+			fmt.Fprintln(out, l)
+		}
+		return true
+	case "t", "T":
+		token := newToken(DropTokenTTL)
+		fmt.Fprintf(out, "One time drop token, valid %v: %s\n", DropTokenTTL, token)
+		fmt.Fprintf(out, "Sender should run: %s\n", DropUsage(srv.Name, token))
+		return true
+	}
+	idx := slices.IndexFunc(peers, func(kv smap.KV[tsnet.Peer, tsnet.PeerData]) bool { return IsPeer(kv.Key, line) })
+	if n, err := strconv.Atoi(line); err == nil {
+		idx = n - 1
+	}
+	if idx < 0 || idx >= len(peers) {
+		fmt.Fprintf(out, "No peer %s. %s\n", line, LinearHelp)
+		return true
+	}
+	fmt.Fprintf(out, "Connecting to peer %s\n", peers[idx].Key.Name)
+	InitiatePeerConnection(srv, peers[idx].Key, peers[idx].Value)
+	return true
+}
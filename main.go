@@ -1,91 +1,73 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"runtime"
 	"slices"
 	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"fortio.org/cli"
 	"fortio.org/log"
 	"fortio.org/smap"
 	"fortio.org/terminal/ansipixels"
 	"fortio.org/terminal/ansipixels/tcolor"
+	"fortio.org/tsync/tapi"
 	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tlayout"
 	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tsync"
+	"fortio.org/tsync/txfer"
 )
 
+// RestartDowntime is how long peers wait for us after R (announce restart and exit) in the terminal UI.
+const RestartDowntime = time.Minute
+
 func main() {
 	os.Exit(Main())
 }
 
-func LoadIdentity() (*tcrypto.Identity, error) {
-	storage, err := tcrypto.InitStorage()
-	if err != nil {
-		return nil, err
-	}
-	// Try to load existing identity
-	op := "Loaded"
-	level := log.Info
-	id, err := storage.LoadIdentity()
-	if err != nil {
-		log.Infof("No existing identity found, creating new one: %v", err)
-		id, err = tcrypto.NewIdentity()
-		if err != nil {
-			return nil, err
-		}
-		err = storage.SaveIdentity(id)
-		if err != nil {
-			return nil, err
-		}
-		op = "Created"
-		level = log.Warning
-	}
-	log.Logf(level, "%s identity with public key: %s", op, id.PublicKeyToString())
-	return id, nil
-}
-
-var alignment = []ansipixels.Alignment{
-	ansipixels.Right,  // Id
-	ansipixels.Center, // Name
-	ansipixels.Left,   // Ip
-	ansipixels.Right,  // Port
-	ansipixels.Right,  // Human Hash
-}
-
-func PeerLine(idx int, peer tsnet.Peer, peerData tsnet.PeerData) []string {
-	idxStr := strconv.Itoa(idx)
-	switch peerData.Status {
-	case tsnet.NotLinked:
-		// leave uncolored
+// StatusColor returns the color of the connection status, false for NotLinked (uncolored).
+func StatusColor(status tsnet.ConnectionStatus) (tcolor.BasicColor, bool) {
+	switch status {
 	case tsnet.SentConn:
-		idxStr = tcolor.Inverse + Color16(tcolor.BrightYellow, idxStr)
+		return tcolor.BrightYellow, true
 	case tsnet.ReceivedConn:
-		idxStr = tcolor.Inverse + Color16(tcolor.BrightBlue, idxStr)
-	case tsnet.Failed:
-		idxStr = tcolor.Inverse + Color16(tcolor.BrightRed, idxStr)
+		return tcolor.BrightBlue, true
+	case tsnet.Failed, tsnet.Unreachable, tsnet.Disconnected:
+		return tcolor.BrightRed, true
 	case tsnet.Connected:
-		idxStr = tcolor.Inverse + Color16(tcolor.BrightGreen, idxStr)
+		return tcolor.BrightGreen, true
+	case tsnet.Restarting:
+		return tcolor.BrightPurple, true
+	default:
+		return tcolor.DarkGray, false
 	}
-	return []string{
-		idxStr,
-		Color16(tcolor.BrightCyan, peer.Name),
-		Color16(tcolor.BrightGreen, peer.IP),
-		Color16f(tcolor.Blue, "%d", peerData.Port),
-		Color16(tcolor.BrightYellow, peerData.HumanHash),
+}
+
+// MTUString returns the probed MTU or "-" when not probed yet.
+func MTUString(mtu int) string {
+	if mtu == 0 {
+		return DarkGray("-")
 	}
+	return Color16f(tcolor.Purple, "%d", mtu)
 }
 
 func OurLine(srv *tsnet.Server, ourIP, ourPort, humanID string) []string {
 	return []string{
 		"🏠",
-		Color16(tcolor.Cyan, srv.Name),
+		Color16(tcolor.Cyan, srv.RealName()),
 		Color16(tcolor.Green, ourIP),
 		Color16(tcolor.Blue, ourPort),
 		Color16(tcolor.Yellow, humanID),
+		"",
 	}
 }
 
@@ -99,6 +81,19 @@ func Color16f(color tcolor.BasicColor, format string, args ...any) string {
 	return Color16(color, fmt.Sprintf(format, args...))
 }
 
+// ResetScrollRegion makes the whole screen scroll again (see LogRegion).
+const ResetScrollRegion = "\033[r"
+
+// LogRegion confines the log output to area, as a scroll region, with the cursor on its last line.
+func LogRegion(ap *ansipixels.AnsiPixels, area tlayout.Rect) {
+	if area.H <= 0 {
+		return
+	}
+	ap.WriteString(fmt.Sprintf("\033[%d;%dr", area.Y+1, area.Y+area.H))
+	ap.MoveCursor(0, area.Y+area.H-1)
+	ap.SaveCursorPos()
+}
+
 func DarkGray(s string) string {
 	return Color16(tcolor.DarkGray, s)
 }
@@ -107,11 +102,13 @@ func InitiatePeerConnection(srv *tsnet.Server, peer tsnet.Peer, peerData tsnet.P
 	log.Infof("Initiating connection to peer %q at %s:%d", peer.Name, peer.IP, peerData.Port)
 	if connErr := srv.ConnectToPeer(peer); connErr != nil {
 		log.Errf("Failed to connect to peer %s: %v", peer.Name, connErr)
+		return
 	}
+	go ProbeMTU(srv, peer)
 }
 
-// MouseInsideBox returns whether the mouse is inside the box and the index of the line inside the box.
-func MouseInsideBox(ap *ansipixels.AnsiPixels, tableWidth, numPeers int) (int, bool) {
+// MouseInsideBox returns whether the mouse is inside the box (drawn at line tableY) and the index of the line inside the box.
+func MouseInsideBox(ap *ansipixels.AnsiPixels, tableY, tableWidth, numPeers int) (int, bool) {
 	tableWidth -= 2                       // remove the borders
 	startTable := (ap.W-tableWidth)/2 + 1 // mouse coordinates start at 1
 	endTable := startTable + tableWidth
@@ -120,7 +117,7 @@ func MouseInsideBox(ap *ansipixels.AnsiPixels, tableWidth, numPeers int) (int, b
 	if ap.Mx < startTable || ap.Mx >= endTable {
 		return -1, false
 	}
-	line := ap.My - 4 // accounts for border, our line and header and mouse coordinates starting at 1
+	line := ap.My - tableY - 4 // accounts for border, our line and header and mouse coordinates starting at 1
 	if line >= 0 && line < numPeers {
 		return line, true
 	}
@@ -134,65 +131,407 @@ func Main() int {
 	// 239.255."t"."s"
 	fMcast := flag.String("mcast", "239.255.116.115", "Multicast address to use for server discovery")
 	fTarget := flag.String("target", tsnet.DefaultTarget, "Test target udp ip:port to use to find the right interface and local ip")
+	fDiscovery := flag.String("discovery", "multicast",
+		"Peer discovery: multicast (on -mcast), mdns (mDNS/DNS-SD _tsync._udp service, for networks filtering"+
+			" other multicast groups) or both")
+	fBroadcast := flag.String("broadcast", tsnet.BroadcastAuto.String(),
+		"Also send the multicast discovery announcements to the broadcast addresses (255.255.255.255 and the subnet's),"+
+			" for networks dropping multicast: auto (while no peer's multicast announcement is heard), always or off")
+	fWire := flag.String("wire", tsnet.WireText.String(),
+		"Encoding of the direct messages we send: text (understood by all versions) or binary (compact, needs this version or later)")
+	fRequireAuth := flag.Bool("require-auth", false,
+		"Drop the direct messages not authenticated by the peer's session or signature (sent by the older versions)")
+	fKex := flag.String("kex", tcrypto.FormatKex(tcrypto.DefaultKex),
+		"Key exchanges of the connections' encrypted sessions, in order of preference: x25519 or x25519mlkem768"+
+			" (the post quantum hybrid, e.g. x25519mlkem768,x25519 to prefer it but still connect to the older versions)")
+	fPrivateName := flag.Bool("private-name", false,
+		"Advertise only a salted hash of our name, so the network can't list the machine names; it's revealed"+
+			" to the peers once connected")
+	fIface := flag.String("iface", "",
+		"Network interface to use for the discovery and the unicast socket instead of the one reaching -target"+
+			" (e.g. for air-gapped or multi-homed hosts)")
+	fAllInterfaces := flag.Bool("all-interfaces", false,
+		"Announce and discover the peers on every up, multicast capable interface instead of only the one reaching -target"+
+			" (for hosts on several networks, e.g. Ethernet and Wi-Fi)")
+	fLocal := flag.Bool("local-socket", runtime.GOOS != "windows",
+		"Talk to the other tsync of this host (other profiles, other users with -local-socket-shared) through a Unix socket"+
+			" instead of UDP (faster, and works even when multicast loopback doesn't)")
+	fLocalShared := flag.Bool("local-socket-shared", false,
+		"Let the tsync of the other users of this host send to our -local-socket (only ours can otherwise)")
+	fTransport := flag.String("transport", "udp",
+		"Transport of the connected peers' data: udp (datagrams), tcp (a TCP stream per connection, for bulk transfers)"+
+			" or quic (a QUIC connection per connection, on its own UDP port)")
 	fInterval := flag.Duration("interval", tsnet.DefaultBroadcastInterval,
 		"Base interval in milliseconds between broadcasts (before [0-1]s jitter)")
+	fTimeout := flag.Duration("timeout", 10*time.Second,
+		"How long to wait for the peer to be found (pipe) or max idle time once the stream started (cat)"+
+			" or how long to run (soak)")
+	fScan := flag.String("scan", "",
+		"Command to run on each received file (path as last argument), a non zero exit status rejects the file")
+	fChaos := flag.String("chaos", "",
+		"Debug: inject faults on sent packets, e.g. loss=0.05,dup=0.01,reorder=0.1,latency=20ms,jitter=5ms,seed=42")
+	hooks := HookFlags()
+	wifiDirect := WiFiDirectFlags()
+	fEndorsements := flag.String("endorsements", Endorsements.String(),
+		"What to do with endorsements of other peers sent by directly trusted peers: ignore, warn (trust with a warning) or trust")
+	fUpdateCheck := flag.Bool("update-check", false, "Check for a newer release on startup of the terminal UI")
+	fAPI := flag.Bool("api", false,
+		"Serve the gRPC control API (see tapi/control.proto) on the control.sock unix socket of the storage directory"+
+			" (terminal UI and inbox)")
+	fScreenReader := flag.Bool("screen-reader", false,
+		"Accessible terminal UI: labeled line updates and line commands instead of full screen (default when TERM=dumb)")
+	fRecord := flag.String("record", "",
+		"Record the terminal UI session (rendered frames and input) to this file, in asciicast v2 format")
+	fReplay := flag.String("replay", "", "Play back a terminal UI session recorded with -record")
+	fShowFPS := flag.Bool("show-fps", false, "Debug: show the terminal UI's measured frames per second (top right)")
+	fHelpJSON := flag.Bool("help-json", false, "Print the commands and flags in JSON, for wrapper tooling")
+	fJSON := flag.Bool("json", false,
+		"Print the peers command's output as JSON: our identity, the peers, transfers and totals (see package tstatus)"+
+			", and the schedules one's")
+	fRendezvous := flag.String("rendezvous", "",
+		"ip:port of a reachable tsync running with -rendezvous-server, to find and punch holes to peers behind NATs"+
+			" or on other subnets (see -punch)")
+	fRendezvousServer := flag.Bool("rendezvous-server", false,
+		"Act as rendezvous for the peers using our address as their -rendezvous (needs to be reachable by all of them)")
+	fPunch := flag.String("punch", "", "Comma separated names of the peers to find through the -rendezvous and punch holes to")
+	fRelay := flag.Bool("relay", false, "Relay the data through the -rendezvous (running `tsync relay`) to the peers"+
+		" our holes don't get through to (they need -relay too)")
+	fPortMapping := flag.Bool("port-mapping", false, "Ask the gateway (NAT-PMP or UPnP) to forward a port to our unicast"+
+		" socket, sent to the -rendezvous so the peers reach us directly")
+	fGateway := flag.String("gateway", "", "NAT-PMP ip[:port] of the gateway for -port-mapping, instead of the default route's")
+	fSTUN := flag.String("stun", "", "Comma separated STUN servers (host[:port]) to learn our external address from,"+
+		" sent signed to the -rendezvous so the peers punching to us also try it")
+	fListenPort := flag.Int("listen-port", 0, "Port of the unicast socket, 0 for an ephemeral one ("+
+		strconv.Itoa(tsnet.DefaultRendezvousPort)+" for relay)")
+	fPeer := flag.String("peer", "", "Comma separated addresses (ip or host, :port if their -port differs) of peers to also"+
+		" send our announcements to (unicast), for networks where multicast is blocked")
+	fShare := flag.String("share", "", "Comma separated [name=]dir[:rw] directories the trusted peers can browse and get"+
+		" files from (with ls and get), put files in too with :rw (read-only otherwise)")
+	fArchive := flag.String("archive", txfer.ArchiveAuto.String(),
+		"Pull shared directories as a single tar+zstd archive: auto (when they have many small files), always or off"+
+			" (file by file)")
+	fKeep := flag.Int("keep", SnapshotKeep, "How many snapshots of each peer backup-target keeps")
+	fEvery := flag.Duration("every", 0, "Interval between the snapshots of backup-to, 0 for a single one")
+	fHome := flag.String("home", "", "Storage directory for the identity, inbox, plugins etc, instead of ~/.tsync"+
+		" (~/.local/share/tsync and ~/.config/tsync on Linux), can also be set with "+tcrypto.HomeEnv)
+	cli.MaxArgs = 4
+	if len(os.Args) > 1 && (os.Args[1] == CompleteCommand || slices.Contains(os.Args, "backup-to")) {
+		cli.MaxArgs = -1 // words typed so far (flags after the command are arguments) or directories.
+	}
+	cli.ArgsHelp = "[pipe peer-name | cat [peer-name] | inbox | drop peer-name token file | soak [nodes] | firewall [apply]\n" +
+		" | trust [peer-name] | endorse to-peer-name peer-name | update [check] | peers | completion shell\n" +
+		" | backup file | restore file | backup-target | backup-to peer-name dir... | restore-from peer-name [dir]\n" +
+		" | schedule | schedules | relay | share | ls peer-name [path] | get peer-name path [dir]\n" +
+		" | put peer-name file path]\n" +
+		"without arguments the interactive terminal UI starts, with pipe stdin is streamed to the peer\n" +
+		"which should be running cat, which writes the stream to stdout. inbox prints a one time token\n" +
+		"a peer can use with drop to send a single file to our inbox. soak runs many in process nodes\n" +
+		"transferring data and restarting while checking invariants. trust lists the trusted peers or\n" +
+		"trusts a peer (check its hash), endorse sends our endorsement of a trusted peer to another one\n" +
+		"(see -endorsements). firewall prints (or applies) the\n" +
+		"commands allowing tsync's inbound UDP through the Windows or macOS firewall. update replaces\n" +
+		"tsync with the latest (signature verified) release, check only reports if there is one. peers lists\n" +
+		"the peers of the tsync running with -api and completion prints the shell completion script.\n" +
+		"backup writes the passphrase encrypted identity and plugins to file, restore restores them\n" +
+		"(passphrase from the terminal or " + PassphraseEnv + "). backup-target keeps the -keep latest snapshots\n" +
+		"of the directories its trusted peers push with backup-to (every -every), encrypted with a key only\n" +
+		"they have, restore-from extracts our latest one in dir (default current directory). schedule runs\n" +
+		"the scheduled snapshots of the schedules.json config file (as the terminal UI does), schedules lists\n" +
+		"them with their next run and last result. relay runs a rendezvous on -listen-port for the peers\n" +
+		"using it as -rendezvous, relaying the data of those with -relay when hole punching fails. share\n" +
+		"serves the -share directories (as the terminal UI does) to the trusted peers, which can list them\n" +
+		"with ls (path like /share/dir, default / for the list of shares), get a file (a directory when\n" +
+		"the path ends with /) in dir (default current directory) or put one in a directory of a :rw share.\n" +
+		"Exit codes: 0 ok, 1 error, 2 peer not found, 3 transfer failed, 4 drop token refused (untrusted),\n" +
+		"release verification failed or wrong backup passphrase, 5 timeout. Use -quiet to only log errors"
 	cli.Main()
+	if *fHome != "" {
+		os.Setenv(tcrypto.HomeEnv, *fHome) // also for our children (scan command etc).
+	}
+	var err error
+	if Endorsements, err = tcrypto.ParseEndorsementPolicy(*fEndorsements); err != nil {
+		return log.FErrf("Invalid -endorsements: %v", err)
+	}
+	PeersJSON = *fJSON
+	SnapshotKeep, SnapshotEvery = *fKeep, *fEvery
+	if *fShare != "" {
+		if Shared, err = txfer.ParseShares(*fShare); err != nil {
+			return log.FErrf("Invalid -share: %v", err)
+		}
+	}
+	if PullArchive, err = txfer.ParseArchiveMode(*fArchive); err != nil {
+		return log.FErrf("Invalid -archive: %v", err)
+	}
+	if *fHelpJSON {
+		return HelpJSON()
+	}
+	if *fReplay != "" {
+		return Replay(*fReplay, os.Stdout)
+	}
+	if flag.Arg(0) == CompleteCommand {
+		return RunComplete(flag.Args()[1:])
+	}
+	cfg := tsnet.Config{
+		Name:                  *fName,
+		Port:                  *fPort,
+		Mcast:                 *fMcast,
+		Target:                *fTarget,
+		Interface:             *fIface,
+		AllInterfaces:         *fAllInterfaces,
+		LocalSocket:           *fLocal,
+		LocalShared:           *fLocalShared,
+		BaseBroadcastInterval: *fInterval,
+		Rendezvous:            *fRendezvous,
+		RendezvousServer:      *fRendezvousServer,
+		Relay:                 *fRelay,
+		PortMapping:           *fPortMapping,
+		Gateway:               *fGateway,
+		ListenPort:            *fListenPort,
+		RequireAuth:           *fRequireAuth,
+		PrivateName:           *fPrivateName,
+	}
+	if *fRelay && *fRendezvous == "" {
+		return log.FErrf("-relay needs a -rendezvous")
+	}
+	if *fPunch != "" {
+		if *fRendezvous == "" {
+			return log.FErrf("-punch needs a -rendezvous")
+		}
+		cfg.PunchPeers = strings.Split(*fPunch, ",")
+	}
+	switch *fDiscovery {
+	case "multicast":
+	case "mdns":
+		cfg.NoDiscovery, cfg.MDNS = true, true
+	case "both":
+		cfg.MDNS = true
+	default:
+		return log.FErrf("Invalid -discovery %q: must be multicast, mdns or both", *fDiscovery)
+	}
+	if *fPeer != "" {
+		if cfg.NoDiscovery {
+			return log.FErrf("-peer needs the multicast discovery (-discovery multicast or both)")
+		}
+		cfg.StaticPeers = strings.Split(*fPeer, ",")
+	}
+	if *fSTUN != "" {
+		cfg.STUNServers = strings.Split(*fSTUN, ",")
+	}
+	if cfg.Broadcast, err = tsnet.ParseBroadcastMode(*fBroadcast); err != nil {
+		return log.FErrf("Invalid -broadcast: %v", err)
+	}
+	if cfg.Wire, err = tsnet.ParseWireFormat(*fWire); err != nil {
+		return log.FErrf("Invalid -wire: %v", err)
+	}
+	for name := range strings.SplitSeq(*fKex, ",") {
+		kex, err := tcrypto.ParseKexAlgo(strings.TrimSpace(name))
+		if err != nil {
+			return log.FErrf("Invalid -kex: %v", err)
+		}
+		cfg.KeyExchanges = append(cfg.KeyExchanges, kex)
+	}
+	transport, err := tsnet.ParseTransport(*fTransport)
+	if err != nil {
+		return log.FErrf("Invalid -transport: %v", err)
+	}
+	cfg.Transport = transport
+	if *fChaos != "" {
+		chaos, err := tsnet.ParseChaos(*fChaos)
+		if err != nil {
+			return log.FErrf("Invalid -chaos: %v", err)
+		}
+		cfg.WrapTransport = func(t tsnet.Transport) tsnet.Transport {
+			return tsnet.NewChaosTransport(t, chaos)
+		}
+	}
+	closeWiFiDirect, err := wifiDirect(&cfg)
+	if err != nil {
+		return log.FErrf("Wi-Fi Direct: %v", err)
+	}
+	defer closeWiFiDirect()
+	if flag.NArg() > 0 {
+		return RunCommand(&cfg, flag.Args(), *fTimeout, *fScan, hooks, *fAPI)
+	}
+	if *fScreenReader || os.Getenv("TERM") == "dumb" {
+		return Linear(&cfg, *fScan, hooks, *fAPI, os.Stdin, os.Stdout)
+	}
 	ap := ansipixels.NewAnsiPixels(60)
 	if err := ap.Open(); err != nil {
 		return 1 // error already logged
 	}
+	var rec *CastRecorder
+	if *fRecord != "" {
+		var err error
+		if rec, err = NewCastRecorder(*fRecord, ap.W, ap.H); err != nil {
+			ap.Restore()
+			return log.FErrf("Failed to create recording: %v", err)
+		}
+		ap.Out = bufio.NewWriter(io.MultiWriter(os.Stdout, rec))
+	}
 	ap.MouseClickOn()
 	defer func() {
+		ap.WriteString(ResetScrollRegion)
 		ap.MouseClickOff()
 		ap.Restore()
+		if rec != nil {
+			_ = rec.Close()
+		}
 	}()
-	id, err := LoadIdentity()
+	id, err := tsync.LoadIdentity()
 	if err != nil {
 		return log.FErrf("Failed to load or create identity: %v", err)
 	}
 	var version atomic.Uint64
-	cfg := tsnet.Config{
-		Name:   *fName,
-		Port:   *fPort,
-		Mcast:  *fMcast,
-		Target: *fTarget,
-		OnChange: func(v uint64) {
-			version.Store(v)
-		},
-		Identity:              id,
-		BaseBroadcastInterval: *fInterval,
+	var srv *tsnet.Server
+	var svc *tapi.Service
+	var statusChanged atomic.Bool
+	frameRate := tlayout.NewFrameRate() // fast when something changes, idle otherwise.
+	host := &PluginHost{OnStatus: func() {
+		statusChanged.Store(true)
+		frameRate.Wake()
+	}}
+	hooks.Plugins = LoadPlugins(host)
+	schedules := LoadSchedules()
+	shares := LoadShares()
+	timeline := &Timeline{}
+	hooks.OnEvent = timeline.OnEvent
+	cfg.OnReject = func(peer tsnet.Peer, reason string) {
+		timeline.Add(TimelineEvent{Time: time.Now(), Event: EventPeerRejected, Peer: peer.Name, Text: "rejected: " + reason})
+		frameRate.Wake()
+	}
+	cfg.OnChange = func(v uint64) {
+		version.Store(v)
+		frameRate.Wake()
+		hooks.OnChange(srv)
+		if svc != nil {
+			svc.Changed()
+		}
+	}
+	cfg.Identity = id
+	audit, err := OpenAuditLog(&cfg)
+	if err != nil {
+		return log.FErrf("Failed to open the audit log: %v", err)
+	}
+	defer audit.Close()
+	audit.OnBan = func(_ tsnet.AuditEvent) { // tsnet logs the ban.
+		statusChanged.Store(true)
+		frameRate.Wake()
+	}
+	box, err := NewDropBox(*fScan, hooks)
+	if err != nil {
+		return log.FErrf("Failed to create inbox: %v", err)
+	}
+	var pending atomic.Pointer[tlayout.Modal] // shown by the UI goroutine, see Browser.Show.
+	browser := &Browser{Dir: box.Dir, Scan: box.Scan, Show: func(m tlayout.Modal) {
+		pending.Store(&m)
+		statusChanged.Store(true)
+		frameRate.Wake()
+	}}
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		if host.OnData(peer, data) || schedules.OnData(peer, data) || shares.Receive(peer, data) ||
+			browser.OnData(peer, data) || ReceiveEndorsement(srv, peer, data) {
+			return
+		}
+		ReceiveDrop(srv, box, peer, data)
+	}
+	srv = cfg.NewServer()
+	host.SetServer(srv)
+	shares.srv = srv
+	browser.srv = srv
+	if *fAPI {
+		svc = NewAPI(srv, host, box)
 	}
-	srv := cfg.NewServer()
 	if err = srv.Start(context.Background()); err != nil {
 		return log.FErrf("Failed to start tsync server: %v", err)
 	}
 	defer srv.Stop()
+	if svc != nil {
+		stop, err := ServeAPI(svc)
+		if err != nil {
+			return log.FErrf("Failed to serve the control API: %v", err)
+		}
+		defer stop()
+	}
 	log.Infof("Started tsync with name %q", srv.Name)
-	log.Infof("Press Q, q or Ctrl-C to stop")
+	schedulesCtx, stopSchedules := context.WithCancel(context.Background())
+	defer stopSchedules()
+	go schedules.Run(schedulesCtx, srv)
+	if *fUpdateCheck {
+		CheckUpdateNotify()
+	}
+	keyMap := LoadKeys()
+	log.Infof("Press %s for the keys, %s to stop", keyMap.Describe(ActionHelp), keyMap.Describe(ActionQuit))
 	ap.AutoSync = false
 	prev := ^uint64(0)
 	ourAddress := srv.OurAddress()
 	ourIP := ourAddress.IP.String()
 	ourPort := strconv.Itoa(ourAddress.Port)
 	ourLine := OurLine(srv, ourIP, ourPort, id.HumanID())
-	headerLine := []string{
-		DarkGray("Id"),
-		"🔗 " + DarkGray("Name"),
-		DarkGray("Ip"),
-		DarkGray("Port"),
-		DarkGray("Hash"),
+	var peersSnapshot []smap.KV[tsnet.Peer, tsnet.PeerData]
+	var sel Selection
+	var modal tlayout.Modal // dialog taking the input, see dialogs.go.
+	show := func(m tlayout.Modal) { modal = m }
+	transfers := &TransferView{Box: box}
+	traffic := NewTrafficStats()
+	showMap, showGraph, showTimeline := false, false, false
+	logTitle := fmt.Sprintf("Log (%s to switch pane, %s/%s to resize)", keyMap.Describe(ActionNextPane),
+		keyMap.Describe(ActionGrow), keyMap.Describe(ActionShrink))
+	ui := NewUI(logTitle)
+	layout, peersPane, logPane := ui.Layout, ui.PeersPane, ui.LogPane
+	var layoutsFile string
+	ui.Layouts, layoutsFile = LoadLayouts()
+	saveLayouts := func() {
+		prev = ^uint64(0)
+		if layoutsFile == "" {
+			return
+		}
+		if err := ui.Layouts.Save(layoutsFile); err != nil {
+			log.Warnf("Failed to save the table layouts: %v", err)
+		}
 	}
-	ap.OnResize = func() error {
+	layout.Resize(ap.W, ap.H)
+	relayout := func() {
+		layout.Resize(ap.W, ap.H)
+		ap.WriteString(ResetScrollRegion)
+		ap.ClearScreen()
 		prev = ^uint64(0) // force repaint
+	}
+	ap.OnResize = func() error {
+		if rec != nil {
+			rec.Resize(ap.W, ap.H)
+		}
+		relayout()
 		return nil
 	}
-	var peersSnapshot []smap.KV[tsnet.Peer, tsnet.PeerData]
-	tableWidth := 0
+	dragSeparator, dragHeader, dragX := -1, -1, 0 // column being resized or moved with the mouse.
 	ap.OnMouse = func() {
-		if !ap.LeftClick() || !ap.MouseRelease() {
+		if !ap.LeftClick() {
+			return
+		}
+		if !ap.MouseRelease() { // press: on a separator or title of the peers table, drags it.
+			dragSeparator, dragHeader, dragX = ui.SeparatorAt(ap.Mx-1, ap.My-1), ui.HeaderAt(ap.Mx-1, ap.My-1), ap.Mx
+			return
+		}
+		if dragSeparator >= 0 {
+			ui.ResizeColumn(dragSeparator, ap.Mx-dragX)
+			dragSeparator = -1
+			saveLayouts()
+			return
+		}
+		if target := ui.HeaderAt(ap.Mx-1, ap.My-1); dragHeader >= 0 && target >= 0 && target != dragHeader {
+			ui.MoveColumnTo(dragHeader, target)
+			dragHeader = -1
+			saveLayouts()
 			return
 		}
-		if peerLine, ok := MouseInsideBox(ap, tableWidth, len(peersSnapshot)); ok {
+		dragHeader = -1
+		if pane := layout.PaneAt(ap.Mx-1, ap.My-1); pane != nil && pane != layout.Focused() {
+			layout.Focus(pane)
+			prev = ^uint64(0)
+		}
+		first, shown := ui.ShownPeers()
+		if peerLine, ok := MouseInsideBox(ap, peersPane.Area.Y, ui.TableWidth, shown); ok && first+peerLine < len(peersSnapshot) {
+			peerLine += first
 			peer := peersSnapshot[peerLine]
 			log.Infof("Left click (release) at %d,%d -> line %d - connecting to %q", ap.Mx, ap.My, peerLine+1, peer.Key.Name)
 			InitiatePeerConnection(srv, peer.Key, peer.Value)
@@ -200,38 +539,222 @@ func Main() int {
 			log.Infof("Left click (release) at %d,%d -> outside peer list", ap.Mx, ap.My)
 		}
 	}
-	err = ap.FPSTicks(func() bool {
+	var picked Action // in the command palette, run once it's closed.
+	// run does the action, returns false to exit.
+	run := func(action Action) bool {
+		switch action {
+		case ActionNextPane:
+			layout.FocusNext()
+			prev = ^uint64(0)
+		case ActionGrow, ActionShrink:
+			delta := 1
+			if action == ActionShrink {
+				delta = -1
+			}
+			if layout.Grow(delta) {
+				relayout()
+			}
+		case ActionUp, ActionDown, ActionFirst, ActionLast:
+			if showTimeline && layout.Focused() == ui.TransfersPane {
+				switch action { // scrolls the timeline, bounded by its Draw.
+				case ActionUp:
+					timeline.Back++
+				case ActionDown:
+					timeline.Back = max(0, timeline.Back-1)
+				case ActionFirst:
+					timeline.Back = TimelineSize
+				default:
+					timeline.Back = 0
+				}
+				prev = ^uint64(0)
+				break
+			}
+			if layout.Focused() != peersPane {
+				break // the cursor only moves in the peers pane.
+			}
+			switch action {
+			case ActionUp:
+				sel.Move(-1, len(peersSnapshot))
+			case ActionDown:
+				sel.Move(1, len(peersSnapshot))
+			case ActionFirst:
+				sel.Cursor = 0
+			default:
+				sel.Move(len(peersSnapshot), len(peersSnapshot))
+			}
+			prev = ^uint64(0) // repaint.
+		case ActionColumn:
+			ui.SelectNextColumn()
+			prev = ^uint64(0)
+		case ActionColLeft, ActionColRight, ActionWiden, ActionNarrow:
+			if ui.Column < 0 {
+				log.Warnf("Select a column first with %s", keyMap.Describe(ActionColumn))
+				break
+			}
+			switch action {
+			case ActionColLeft:
+				ui.MoveColumn(ui.Column, -1)
+			case ActionColRight:
+				ui.MoveColumn(ui.Column, 1)
+			case ActionWiden:
+				ui.ResizeColumn(ui.Column, 1)
+			default:
+				ui.ResizeColumn(ui.Column, -1)
+			}
+			saveLayouts()
+		case ActionColReset:
+			ui.ResetColumns()
+			saveLayouts()
+		case ActionMark:
+			sel.Toggle(peersSnapshot)
+			prev = ^uint64(0)
+		case ActionMarkAll:
+			sel.ToggleAll(peersSnapshot)
+			prev = ^uint64(0)
+		case ActionConnect:
+			for _, kv := range sel.Targets(peersSnapshot) {
+				InitiatePeerConnection(srv, kv.Key, kv.Value)
+			}
+		case ActionTrust:
+			if targets := sel.Targets(peersSnapshot); len(targets) > 0 {
+				show(TrustDialog(id, targets, hooks))
+				prev = ^uint64(0)
+			}
+		case ActionSend:
+			if targets := sel.Targets(peersSnapshot); len(targets) > 0 {
+				show(SendDialog(host, targets, show))
+				prev = ^uint64(0)
+			}
+		case ActionBrowse:
+			if targets := sel.Targets(peersSnapshot); len(targets) != 1 {
+				log.Warnf("Browsing needs a single peer, marked or under the cursor (%d selected)", len(targets))
+			} else if err := browser.Browse(targets[0].Key, "/"); err != nil {
+				log.Warnf("Can't browse %q: %v", targets[0].Key.Name, err)
+			}
+		case ActionBackup:
+			show(BackupDialog(show))
+			prev = ^uint64(0)
+		case ActionSchedules:
+			show(&tlayout.Message{Title: "Scheduled jobs", Lines: ScheduleLines(schedules.Sched.Status(), time.Now())})
+			prev = ^uint64(0)
+		case ActionMap:
+			showMap = !showMap
+			prev = ^uint64(0)
+		case ActionGraph:
+			showGraph, showTimeline = !showGraph, false
+			prev = ^uint64(0)
+		case ActionTimeline:
+			showTimeline, showGraph = !showTimeline, false
+			prev = ^uint64(0)
+		case ActionPalette:
+			show(PaletteDialog(keyMap, len(peersSnapshot), len(sel.Targets(peersSnapshot)), func(a Action) { picked = a }))
+			prev = ^uint64(0)
+		case ActionHelp:
+			show(&tlayout.Message{Title: "Keys", Lines: keyMap.Help()})
+			prev = ^uint64(0)
+		case ActionToken:
+			token := box.NewToken(DropTokenTTL)
+			log.Infof("One time drop token (valid %v): %s", DropTokenTTL, token)
+			log.Infof("Sender should run: %s", DropUsage(srv.Name, token))
+		case ActionRestart:
+			if err := srv.AnnounceRestart(RestartDowntime); err != nil {
+				log.Warnf("Restart announcement failed: %v", err)
+			}
+			log.Infof("Exiting for a restart, peers will wait up to %v for us", RestartDowntime)
+			return false
+		case ActionQuit:
+			log.Infof("Exiting on %s", action)
+			return false
+		}
+		return true
+	}
+	shownFPS := ""
+	err = frameRate.Ticks(ap, func() bool {
 		// Only refresh if we had (log) output or something changed, so cursor blinks (!).
 		logHadOutput := ap.FlushLogger()
 		if srv.Stopped() {
 			return false
 		}
+		if m := pending.Swap(nil); m != nil {
+			modal = *m
+			prev = ^uint64(0)
+		}
+		now := time.Now()
+		if transfers.Sample(now) {
+			prev = ^uint64(0) // repaint the progress.
+		}
+		streams := srv.Transfers.List()
+		if traffic.Sample(streams, now) && (showMap || showGraph) {
+			prev = ^uint64(0)
+		}
+		if timeline.SampleTransfers(streams, now) && showTimeline {
+			prev = ^uint64(0)
+		}
 		curVersion := version.Load()
 		// log.Debugf("Have %d peers (prev %d), logHadOutput=%v", numPeers, prev, logHadOutput)
-		if logHadOutput || curVersion != prev {
+		changed := logHadOutput || curVersion != prev || statusChanged.Swap(false)
+		if changed {
+			frameRate.Active()
+		}
+		if fps := fmt.Sprintf("%.0f fps", frameRate.FPS()); *fShowFPS && fps != shownFPS {
+			shownFPS = fps
+			changed = true
+		}
+		if changed {
 			if !logHadOutput {
 				ap.StartSyncMode()
 			}
 			prev = curVersion
 			peersSnapshot = srv.Peers.KeysValuesSnapshot()
 			slices.SortFunc(peersSnapshot, tsnet.PeerKVSort)
-			lines := make([][]string, 0, len(peersSnapshot)+2)
-			lines = append(lines, ourLine, headerLine)
-			idx := 1
-			for _, kv := range peersSnapshot {
-				lines = append(lines, PeerLine(idx, kv.Key, kv.Value))
-				idx++
+			sel.Update(peersSnapshot)
+			ourLine[len(ourLine)-1] = ""
+			if status := host.Status(); status != "" {
+				ourLine[len(ourLine)-1] = Color16(tcolor.BrightPurple, status)
+			}
+			if warning := BanWarning(srv.Bans()); warning != "" {
+				ourLine[len(ourLine)-1] = Color16(tcolor.BrightRed, warning)
+			}
+			state := &UIState{OurLine: ourLine, Peers: peersSnapshot, Selection: &sel, Transfers: transfers, Modal: modal,
+				Name: srv.Name, Map: showMap, Traffic: traffic, Graph: showGraph}
+			if *fShowFPS {
+				state.FPS = shownFPS
+			}
+			if showTimeline {
+				state.Timeline = timeline
+				for _, kv := range peersSnapshot {
+					if sel.IsMarked(kv.Key) {
+						state.Filter = append(state.Filter, kv.Key.Name)
+					}
+				}
 			}
-			tableWidth = ap.WriteTable(0, alignment, 1, lines, ansipixels.BorderOuterColumns)
-			ap.RestoreCursorPos()
+			ui.Render(ap, state)
+			LogRegion(ap, logPane.Area)
 			ap.EndSyncMode()
 		}
 		if len(ap.Data) == 0 {
 			return true
 		}
-		c := ap.Data[0]
-		switch c {
-		case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		if p, secret := modal.(*tlayout.Prompt); rec != nil && (!secret || !p.Mask) { // don't record passphrases.
+			rec.Input(ap.Data)
+		}
+		if m := modal; m != nil {
+			if m.HandleKey(ap.Data) {
+				if modal == m { // not replaced by a next step.
+					modal = nil
+				}
+				relayout() // clears the dialog.
+			} else {
+				prev = ^uint64(0)
+			}
+			if action := picked; action != "" {
+				picked = ""
+				return run(action)
+			}
+			return true
+		}
+		action := keyMap.Action(ap.Data)
+		if c := ap.Data[0]; action == "" && len(ap.Data) == 1 && c >= '1' && c <= '9' {
 			connectToPeerIdx := int(c - '0')
 			maxPeerIdx := len(peersSnapshot)
 			if connectToPeerIdx <= maxPeerIdx {
@@ -240,13 +763,13 @@ func Main() int {
 			} else {
 				log.Warnf("No peer with index %d to connect to (max %d).", connectToPeerIdx, maxPeerIdx)
 			}
-		case 'q', 'Q', 3: // Ctrl-C
-			log.Infof("Exiting on %q", c)
-			return false
-		default:
-			log.Infof("Input %q", c)
+			return true
 		}
-		return true
+		if action == "" {
+			log.Infof("Input %q", ap.Data)
+			return true
+		}
+		return run(action)
 	})
 	if err != nil {
 		log.Infof("Exiting on %v", err)
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"fortio.org/tsync/tlayout"
+)
+
+// Applicable returns whether the action makes sense in the command palette with that many peers
+// and targets (marked peers, or the one under the cursor, see Selection.Targets).
+func Applicable(action Action, peers, targets int) bool {
+	switch action {
+	case ActionUp, ActionDown, ActionFirst, ActionLast, ActionPalette:
+		return false // moves and the palette itself are keys, not commands.
+	case ActionMark, ActionMarkAll:
+		return peers > 0
+	case ActionConnect, ActionTrust, ActionSend:
+		return targets > 0
+	case ActionBrowse:
+		return targets == 1
+	default:
+		return true
+	}
+}
+
+// PaletteDialog is the command palette listing the Applicable actions, with their keys;
+// run is called with the picked one.
+func PaletteDialog(keyMap *KeyMap, peers, targets int, run func(Action)) tlayout.Modal {
+	var actions []Action
+	var items []string
+	for _, a := range Actions {
+		if !Applicable(a.Action, peers, targets) {
+			continue
+		}
+		item := a.Help
+		if keys := keyMap.Keys(a.Action); len(keys) > 0 {
+			item = fmt.Sprintf("%s (%s)", item, strings.Join(keys, ", "))
+		}
+		actions = append(actions, a.Action)
+		items = append(items, item)
+	}
+	title := fmt.Sprintf("Commands for %d peer(s)", targets)
+	return &tlayout.Palette{Title: title, Items: items, OnDone: func(idx int, ok bool) {
+		if ok {
+			run(actions[idx])
+		}
+	}}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/terminal/ansipixels/tcolor"
+	"fortio.org/tsync/tlayout"
+)
+
+// MapBusyRate is the throughput (bytes/s) above which the peer map draws the line thick.
+const MapBusyRate = 1 << 20
+
+// MapLegend explains the peer map lines.
+const MapLegend = "· idle  • traffic  ● over 1 MiB/s, colored by connection status"
+
+// MapLine returns the character for a line of the peer map carrying rate bytes/s.
+func MapLine(rate float64) rune {
+	switch {
+	case rate <= 0:
+		return '·'
+	case rate < MapBusyRate:
+		return '•'
+	default:
+		return '●'
+	}
+}
+
+// DrawPeerMap draws the peers of the state around us on an ellipse, with lines colored by
+// connection status and thicker with more traffic (see MapLine).
+func DrawPeerMap(ap *ansipixels.AnsiPixels, area tlayout.Rect, state *UIState) {
+	c := tlayout.NewCanvas(area.W, area.H)
+	h := area.H - 1 // last line is the legend.
+	cx, cy := area.W/2, h/2
+	rx, ry := float64(area.W)/2-12, float64(h)/2-1 // room for the labels.
+	type node struct {
+		x, y  int
+		label string
+		color string
+	}
+	nodes := make([]node, 0, len(state.Peers))
+	for i, kv := range state.Peers {
+		angle := 2*math.Pi*float64(i)/float64(len(state.Peers)) - math.Pi/2
+		x, y := cx+int(math.Round(rx*math.Cos(angle))), cy+int(math.Round(ry*math.Sin(angle)))
+		rate := 0.
+		if state.Traffic != nil {
+			rate = state.Traffic.Rate(kv.Key)
+		}
+		color, _ := StatusColor(kv.Value.Status)
+		c.Line(cx, cy, x, y, MapLine(rate), color.Foreground())
+		label := fmt.Sprintf("%d %s", i+1, kv.Key.Name)
+		if rate > 0 {
+			label += " " + ByteSize(int64(rate)) + "/s"
+		}
+		if state.Selection != nil && state.Selection.IsMarked(kv.Key) {
+			label = "✓" + label
+		}
+		if state.Selection != nil && i == state.Selection.Cursor {
+			label = "▶" + label
+		}
+		nodes = append(nodes, node{x, y, label, tcolor.BrightCyan.Foreground()})
+	}
+	nodes = append(nodes, node{cx, cy, "◉ " + state.Name, tcolor.Cyan.Foreground()})
+	for _, n := range nodes {
+		c.Text(n.x-len([]rune(n.label))/2, n.y, n.label, n.color)
+	}
+	c.Text(1, area.H-1, MapLegend, tcolor.DarkGray.Foreground())
+	c.Draw(ap, area)
+}
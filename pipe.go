@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/smap"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tsnet/soak"
+	"fortio.org/tsync/tsync"
+	"fortio.org/tsync/txfer"
+)
+
+// PipeHash is the hash of the whole stream sent by `tsync pipe` and checked by `tsync cat`.
+const PipeHash = tcrypto.SHA256
+
+// RunCommand runs the non interactive (no TUI) commands: pipe, cat, inbox, drop, soak, firewall, update,
+// peers and completion.
+func RunCommand(cfg *tsnet.Config, args []string, timeout time.Duration, scanCommand string, hooks *Hooks, api bool) int {
+	switch args[0] {
+	case "firewall":
+		return Firewall(args[1:])
+	case "update":
+		return Update(args[1:])
+	case "peers":
+		return Peers()
+	case "completion":
+		return Completion(args[1:])
+	case "backup":
+		return Backup(args[1:])
+	case "restore":
+		return Restore(args[1:])
+	case "schedules":
+		return Schedules()
+	}
+	id, err := tsync.LoadIdentity()
+	if err != nil {
+		return log.FErrf("Failed to load or create identity: %v", err)
+	}
+	cfg.Identity = id
+	switch args[0] {
+	case "pipe":
+		if len(args) != 2 {
+			return log.FErrf("Usage: tsync pipe peer-name")
+		}
+		return Pipe(cfg, args[1], os.Stdin, timeout)
+	case "cat":
+		peerName := ""
+		if len(args) == 2 {
+			peerName = args[1]
+		}
+		return Cat(cfg, peerName, os.Stdout, timeout)
+	case "inbox":
+		return Inbox(cfg, scanCommand, hooks, api)
+	case "drop":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return log.FErrf("Usage: tsync drop peer-name token [peer-name token...] file")
+		}
+		var peerNames, tokens []string
+		for i := 1; i < len(args)-1; i += 2 {
+			peerNames, tokens = append(peerNames, args[i]), append(tokens, args[i+1])
+		}
+		return Drop(cfg, peerNames, tokens, args[len(args)-1], timeout)
+	case "soak":
+		return Soak(cfg, args[1:], timeout)
+	case "trust":
+		return Trust(cfg, args[1:], timeout)
+	case "endorse":
+		if len(args) != 3 {
+			return log.FErrf("Usage: tsync endorse to-peer-name peer-name")
+		}
+		return Endorse(cfg, args[1], args[2], timeout)
+	case "backup-target":
+		return BackupTarget(cfg, SnapshotKeep)
+	case "backup-to":
+		if len(args) < 3 {
+			return log.FErrf("Usage: tsync backup-to peer-name dir...")
+		}
+		return BackupTo(cfg, args[1], args[2:], SnapshotEvery, timeout)
+	case "restore-from":
+		if len(args) != 2 && len(args) != 3 {
+			return log.FErrf("Usage: tsync restore-from peer-name [dir]")
+		}
+		dest := "."
+		if len(args) == 3 {
+			dest = args[2]
+		}
+		return RestoreFrom(cfg, args[1], dest, timeout)
+	case "schedule":
+		return RunSchedules(cfg)
+	case "relay":
+		return Relay(cfg)
+	case "share":
+		return Share(cfg)
+	case "ls":
+		if len(args) != 2 && len(args) != 3 {
+			return log.FErrf("Usage: tsync ls peer-name [path]")
+		}
+		p := "/"
+		if len(args) == 3 {
+			p = args[2]
+		}
+		return ListShares(cfg, args[1], p, timeout)
+	case "get":
+		if len(args) != 3 && len(args) != 4 {
+			return log.FErrf("Usage: tsync get peer-name path [dir]")
+		}
+		dest := "."
+		if len(args) == 4 {
+			dest = args[3]
+		}
+		return GetShare(cfg, args[1], args[2], dest, timeout)
+	case "put":
+		if len(args) != 4 {
+			return log.FErrf("Usage: tsync put peer-name file path")
+		}
+		return PutShare(cfg, args[1], args[2], args[3], timeout)
+	default:
+		return log.FErrf("Unknown command %q, expecting pipe, cat, inbox, drop, soak, trust, endorse, firewall, update, peers,"+
+			" completion, backup, restore, backup-target, backup-to, restore-from, schedule, schedules, relay,"+
+			" share, ls, get or put", args[0])
+	}
+}
+
+// Soak runs the soak test (with the optional number of nodes argument) for duration,
+// on its own multicast address and port so it doesn't disturb regular instances.
+func Soak(cfg *tsnet.Config, args []string, duration time.Duration) int {
+	opts := soak.Options{
+		Duration:      duration,
+		Target:        cfg.Target,
+		WrapTransport: cfg.WrapTransport,
+	}
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 2 {
+			return log.FErrf("Usage: tsync soak [number-of-nodes (at least 2)]")
+		}
+		opts.Nodes = n
+	}
+	report, err := soak.Run(context.Background(), opts)
+	if err != nil {
+		return log.FErrf("Soak test failed: %v", err)
+	}
+	log.Infof("Soak test passed: %v", report)
+	return 0
+}
+
+// WaitForPeer waits until a peer with the given name is discovered (or ctx is done), see IsPeer.
+func WaitForPeer(ctx context.Context, srv *tsnet.Server, name string) (tsnet.Peer, error) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		for peer := range srv.Peers.Keys() {
+			if IsPeer(peer, name) {
+				return peer, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return tsnet.Peer{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// hiddenMatches caches the IsPeer matches of the hidden names, as tcrypto.MatchHiddenName is
+// slow on purpose and called for each data message.
+var hiddenMatches = smap.New[string, bool]()
+
+// IsPeer returns true if the peer is the one named name: by its name or, for a peer with
+// -private-name, its hidden one (see tcrypto.MatchHiddenName).
+func IsPeer(peer tsnet.Peer, name string) bool {
+	if peer.Name == name {
+		return true
+	}
+	if !tcrypto.IsHiddenName(peer.Name) {
+		return false
+	}
+	key := peer.Name + "\x00" + name
+	match, found := hiddenMatches.Get(key)
+	if !found {
+		match = tcrypto.MatchHiddenName(peer.Name, name)
+		hiddenMatches.Set(key, match)
+	}
+	return match
+}
+
+// ErrPeerUntrusted is returned by ConnectPeer for a peer whose key isn't one of our trusted keys.
+var ErrPeerUntrusted = errors.New("peer key not trusted (see tsync trust)")
+
+// CheckTrusted returns ErrPeerUntrusted if the peer's key isn't one of our trusted keys.
+func CheckTrusted(srv *tsnet.Server, peer tsnet.Peer) error {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return err
+	}
+	_, trusted, err := storage.Trusted(srv.Identity, peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !trusted {
+		return fmt.Errorf("%q (%s): %w", peer.Name, KeyHash(peer.PublicKey), ErrPeerUntrusted)
+	}
+	return nil
+}
+
+// ConnectPeer waits for the peer name (see WaitForPeer), connects to it and waits for the encrypted
+// session, which the commands require to exchange data (Config.RequireEncryption). With trusted, the
+// peer's key must be one of our trusted keys.
+func ConnectPeer(ctx context.Context, srv *tsnet.Server, name string, trusted bool) (tsnet.Peer, error) {
+	peer, err := WaitForPeer(ctx, srv, name)
+	if err != nil {
+		return peer, err
+	}
+	if trusted {
+		if err = CheckTrusted(srv, peer); err != nil {
+			return peer, err
+		}
+	}
+	// Make sure the peer also got (at least) one of our announcements, or it would drop our
+	// connection request as coming from an unknown source: wait for the max broadcast interval
+	// (including jitter).
+	select {
+	case <-time.After(srv.BaseBroadcastInterval + time.Second):
+	case <-ctx.Done():
+		return peer, ctx.Err()
+	}
+	return peer, Connect(ctx, srv, peer)
+}
+
+// Connect connects to the peer, unless we already are, and waits for the encrypted session.
+func Connect(ctx context.Context, srv *tsnet.Server, peer tsnet.Peer) error {
+	if srv.Encrypted(peer) {
+		return nil
+	}
+	if err := srv.ConnectToPeer(peer); err != nil {
+		return err
+	}
+	if err := srv.Connections.WaitConnected(ctx, peer); err != nil {
+		return err
+	}
+	if !srv.Encrypted(peer) {
+		return fmt.Errorf("connected to %q: %w", peer.Name, tsnet.ErrNotEncrypted)
+	}
+	return nil
+}
+
+// StreamAcks returns a channel for StreamSender.Acks and a function to call from Config.OnData
+// which forwards the acks from peerName to it (returning true if data was an ack).
+func StreamAcks(peerName string) (<-chan []byte, func(peer tsnet.Peer, data []byte) bool) {
+	acks := make(chan []byte, txfer.DefaultMaxWindow)
+	return acks, func(peer tsnet.Peer, data []byte) bool {
+		if !IsPeer(peer, peerName) || !txfer.IsStreamAck(data) {
+			return false
+		}
+		select {
+		case acks <- append([]byte(nil), data...):
+		default: // same as a lost ack.
+		}
+		return true
+	}
+}
+
+// ProbeMTU probes the path MTU to the peer so we can use larger frames (errors are only logged
+// as the default safe size still works) and checks for a firewall blocking the replies.
+func ProbeMTU(srv *tsnet.Server, peer tsnet.Peer) {
+	mtu, err := srv.ProbeMTU(context.Background(), peer)
+	if err != nil {
+		log.Warnf("MTU probing to %q failed: %v", peer.Name, err)
+		return
+	}
+	CheckFirewall(srv, peer, mtu)
+}
+
+// Pipe streams in (typically stdin) to the named trusted peer, which should be running `tsync cat`.
+func Pipe(cfg *tsnet.Config, peerName string, in io.Reader, timeout time.Duration) int {
+	acks, onAck := StreamAcks(peerName)
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		onAck(peer, data)
+	}
+	cfg.RequireEncryption = true
+	srv := cfg.NewServer()
+	if err := srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer srv.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	peer, err := ConnectPeer(ctx, srv, peerName, true)
+	cancel()
+	if err != nil {
+		log.FErrf("Can't connect to %q: %v", peerName, err)
+		return ConnectExitCode(err)
+	}
+	ProbeMTU(srv, peer)
+	log.Infof("Streaming to %q (%s)", peer.Name, peer.IP)
+	sender := &txfer.StreamSender{
+		ID:        rand.Uint32(), //nolint:gosec // not cryptographic, just to tell streams apart.
+		FrameSize: srv.MaxDataSize(peer),
+		Send: func(frame []byte) error {
+			return srv.SendData(peer, frame)
+		},
+		SendBatch: func(frames [][]byte) error {
+			return srv.SendDataBatch(peer, frames)
+		},
+		Hash:       PipeHash,
+		Congestion: txfer.NewAIMD(0),
+		Acks:       acks,
+	}
+	n, err := sender.Copy(context.Background(), in)
+	if err != nil {
+		log.FErrf("Error after streaming %d bytes to %q: %v", n, peer.Name, err)
+		return ExitTransferFailed
+	}
+	log.Infof("Streamed %d bytes to %q", n, peer.Name)
+	return 0
+}
+
+// Cat writes the first stream received from a trusted peer (peerName if not empty) to out
+// (typically stdout). timeout is the maximum idle time once the stream has started.
+func Cat(cfg *tsnet.Config, peerName string, out io.Writer, timeout time.Duration) int {
+	recv := txfer.NewStreamReceiver(out)
+	recv.Hash = PipeHash
+	var lastFrame atomic.Int64
+	var srv *tsnet.Server
+	var from tsnet.Peer // set before each Receive, which calls Ack from the same goroutine.
+	recv.Ack = func(frame []byte) error {
+		return srv.SendData(from, frame)
+	}
+	// Only the trusted peers can connect, and send data once connected (RequireEncryption).
+	cfg.OnConnectRequest = func(peer tsnet.Peer) error {
+		if peerName != "" && !IsPeer(peer, peerName) {
+			return fmt.Errorf("waiting for %q", peerName)
+		}
+		return CheckTrusted(srv, peer)
+	}
+	cfg.RequireEncryption = true
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		if peerName != "" && !IsPeer(peer, peerName) {
+			log.Warnf("Ignoring data from %q (waiting for %q)", peer.Name, peerName)
+			return
+		}
+		lastFrame.Store(time.Now().UnixNano())
+		from = peer
+		if err := recv.Receive(data); err != nil {
+			log.Errf("Error receiving stream from %q: %v", peer.Name, err)
+		}
+	}
+	srv = cfg.NewServer()
+	if err := srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer srv.Stop()
+	log.Infof("Waiting for a stream as %q", srv.Name)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-recv.Done():
+			if err := recv.Err(); err != nil {
+				log.FErrf("Stream error after %d bytes: %v", recv.Total(), err)
+				return ExitTransferFailed
+			}
+			log.Infof("Received %d bytes", recv.Total())
+			return 0
+		case <-ticker.C:
+			last := lastFrame.Load()
+			if last != 0 && time.Since(time.Unix(0, last)) > timeout {
+				log.FErrf("Stream idle for more than %v after %d bytes", timeout, recv.Total())
+				return ExitTimeout
+			}
+		}
+	}
+}
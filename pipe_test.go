@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+func newTestServer(t *testing.T, name string, private bool) *tsnet.Server {
+	t.Helper()
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := tsnet.Config{Name: name, Identity: id, NoDiscovery: true, PrivateName: private}
+	srv := cfg.NewServer()
+	if err = srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+// TestWaitForPrivatePeer finds a peer with -private-name by its name, which it only advertises
+// hidden.
+func TestWaitForPrivatePeer(t *testing.T) {
+	private := newTestServer(t, "private-host", true)
+	other := newTestServer(t, "other-host", false)
+	srv := newTestServer(t, "client", false)
+	for _, s := range []*tsnet.Server{private, other} {
+		addr := s.OurAddress()
+		srv.AddPeer(tsnet.Peer{IP: addr.IP.String(), Name: s.Name, PublicKey: s.Identity.PublicKeyToString()}, addr.Port)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	peer, err := WaitForPeer(ctx, srv, "private-host")
+	if err != nil {
+		t.Fatalf("WaitForPeer failed: %v", err)
+	}
+	if peer.Name != private.Name || peer.PublicKey != private.Identity.PublicKeyToString() {
+		t.Errorf("Found %+v instead of the private peer %q", peer, private.Name)
+	}
+	if peer, err = WaitForPeer(ctx, srv, "other-host"); err != nil || peer.Name != "other-host" {
+		t.Errorf("WaitForPeer(other-host) returned %+v, %v", peer, err)
+	}
+	if IsPeer(peer, "private-host") || IsPeer(tsnet.Peer{Name: private.Name}, "private") {
+		t.Errorf("IsPeer matched another name")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if peer, err = WaitForPeer(ctx, srv, "unknown"); err == nil {
+		t.Errorf("WaitForPeer(unknown) found %+v", peer)
+	}
+}
+
+// TestConnectPeer only connects to a trusted peer, then sends through the session.
+func TestConnectPeer(t *testing.T) {
+	t.Setenv(tcrypto.HomeEnv, t.TempDir())
+	target := newTestServer(t, "target", false)
+	srv := newTestServer(t, "client", false)
+	srv.RequireEncryption = true
+	peer := tsnet.Peer{IP: target.OurAddress().IP.String(), Name: target.Name, PublicKey: target.Identity.PublicKeyToString()}
+	srv.AddPeer(peer, target.OurAddress().Port)
+	us := srv.OurAddress()
+	target.AddPeer(tsnet.Peer{IP: us.IP.String(), Name: srv.Name, PublicKey: srv.Identity.PublicKeyToString()}, us.Port)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := ConnectPeer(ctx, srv, "target", true); !errors.Is(err, ErrPeerUntrusted) {
+		t.Fatalf("ConnectPeer to an untrusted peer should fail with ErrPeerUntrusted, got %v", err)
+	}
+	if srv.SendData(peer, []byte("data")) == nil {
+		t.Errorf("SendData without a session should fail")
+	}
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.Trust(srv.Identity, tcrypto.TrustEntry{Name: "target", PublicKey: peer.PublicKey}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ConnectPeer(ctx, srv, "target", true)
+	if err != nil || got != peer {
+		t.Fatalf("ConnectPeer returned %+v, %v", got, err)
+	}
+	if !srv.Encrypted(peer) {
+		t.Errorf("No session once connected")
+	}
+	if err = srv.SendData(peer, []byte("data")); err != nil {
+		t.Errorf("SendData once connected failed: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tplugin"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tstatus"
+)
+
+// MaxStatusLen is the maximum length of the status set by plugins shown in the terminal UI.
+const MaxStatusLen = 32
+
+// PluginHost is the tplugin.Host giving the plugins access to the server.
+type PluginHost struct {
+	srv      *tsnet.Server
+	status   atomic.Pointer[string]
+	OnStatus func() // called when the status changes, e.g. to repaint
+	sendMu   sync.Mutex
+	onData   atomic.Pointer[func(peer tsnet.Peer, data []byte) bool]
+}
+
+// LoadPlugins loads the plugins from the plugins directory (see tcrypto.Storage.Plugins) into an
+// engine using host (whose server must be set before any event). Returns nil if there are none.
+func LoadPlugins(host *PluginHost) *tplugin.Engine {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		log.Warnf("Not loading plugins: %v", err)
+		return nil
+	}
+	engine := tplugin.New(host)
+	if err = engine.LoadDir(storage.Plugins()); err != nil {
+		log.Errf("Plugin errors: %v", err)
+	}
+	if len(engine.Plugins()) == 0 {
+		return nil
+	}
+	return engine
+}
+
+// SetServer sets the server the plugins act on.
+func (h *PluginHost) SetServer(srv *tsnet.Server) {
+	h.srv = srv
+}
+
+// Status returns the status set by the plugins, if any.
+func (h *PluginHost) Status() string {
+	if s := h.status.Load(); s != nil {
+		return *s
+	}
+	return ""
+}
+
+// SetStatus sets the status shown in the terminal UI (truncated to MaxStatusLen).
+func (h *PluginHost) SetStatus(status string) {
+	if r := []rune(status); len(r) > MaxStatusLen {
+		status = string(r[:MaxStatusLen-1]) + "…"
+	}
+	h.status.Store(&status)
+	if h.OnStatus != nil {
+		h.OnStatus()
+	}
+}
+
+// Peers returns the current peers, sorted.
+func (h *PluginHost) Peers() []tplugin.Peer {
+	views := tstatus.Peers(h.srv)
+	peers := make([]tplugin.Peer, 0, len(views))
+	for _, p := range views {
+		peers = append(peers, tplugin.Peer{
+			Name:      p.Name,
+			IP:        p.IP,
+			Port:      p.Port,
+			HumanHash: p.HumanHash,
+			Status:    p.Status,
+			MTU:       p.MTU,
+		})
+	}
+	return peers
+}
+
+// SendFile connects to the peer (unless we already are) and drops the file in its inbox (one at a time).
+func (h *PluginHost) SendFile(peerName, token, path string) error {
+	return h.SendFiles([]string{peerName}, []string{token}, path)
+}
+
+// SendFiles connects to the peers (unless we already are) and drops the file in their inboxes, each
+// with its token, reading it once for all of them (see DropFiles). One send at a time.
+func (h *PluginHost) SendFiles(peerNames, tokens []string, path string) error {
+	targets, onData, err := NewDropTargets(peerNames, tokens)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		found := false
+		for p := range h.srv.Peers.Keys() {
+			if IsPeer(p, t.Name) {
+				t.Peer, found = p, true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("peer %q not found", t.Name)
+		}
+	}
+	h.sendMu.Lock()
+	defer h.sendMu.Unlock()
+	h.onData.Store(&onData)
+	defer h.onData.Store(nil)
+	for _, t := range targets {
+		ctx, cancel := context.WithTimeout(context.Background(), tsnet.ChallengeTimeout)
+		err = Connect(ctx, h.srv, t.Peer)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("connecting to %q: %w", t.Name, err)
+		}
+		if data, _ := h.srv.Peers.Get(t.Peer); data.MTU == 0 {
+			ProbeMTU(h.srv, t.Peer)
+		}
+	}
+	var errs []error
+	for _, p := range DropFiles(h.srv, targets, path) {
+		switch {
+		case p.Err != nil:
+			errs = append(errs, fmt.Errorf("%q after %d bytes: %w", p.Target, p.Bytes, p.Err))
+		case p.Skipped:
+			log.Infof("Plugin skipped %q, %q already has it", path, p.Target)
+		default:
+			log.Infof("Plugin dropped %q (%d bytes) to %q", path, p.Bytes, p.Target)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// OnData passes the acks and replies of SendFile's drop in progress, returning true if data was one.
+func (h *PluginHost) OnData(peer tsnet.Peer, data []byte) bool {
+	f := h.onData.Load()
+	return f != nil && (*f)(peer, data)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+)
+
+// ReplayMaxIdle caps the pauses when replaying a recording (like asciinema's idle time limit).
+const ReplayMaxIdle = 2 * time.Second
+
+// maxCastLine is the maximum size of a recorded event (a frame can be large).
+const maxCastLine = 16 << 20
+
+// CastHeader is the first line of an asciicast v2 recording.
+type CastHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Title     string `json:"title,omitempty"`
+}
+
+// CastRecorder records a terminal session in the asciicast v2 format (also playable with asciinema):
+// the output written to it and the Input and Resize events, timed from its creation.
+type CastRecorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	start  time.Time
+	closed bool
+}
+
+// NewCastRecorder creates the file and writes the header for a terminal of width x height.
+func NewCastRecorder(path string, width, height int) (*CastRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &CastRecorder{f: f, w: bufio.NewWriter(f), start: time.Now()}
+	header, _ := json.Marshal(CastHeader{
+		Version: 2, Width: width, Height: height, Timestamp: r.start.Unix(), Title: "tsync",
+	})
+	r.w.Write(header)
+	r.w.WriteByte('\n')
+	return r, nil
+}
+
+func (r *CastRecorder) event(kind, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	t := json.Number(strconv.FormatFloat(time.Since(r.start).Seconds(), 'f', 6, 64))
+	line, _ := json.Marshal([]any{t, kind, data})
+	r.w.Write(line)
+	r.w.WriteByte('\n')
+}
+
+// Write records output (e.g. from an io.MultiWriter with the terminal).
+func (r *CastRecorder) Write(p []byte) (int, error) {
+	r.event("o", string(p))
+	return len(p), nil
+}
+
+// Input records input from the user.
+func (r *CastRecorder) Input(data []byte) {
+	r.event("i", string(data))
+}
+
+// Resize records a terminal size change.
+func (r *CastRecorder) Resize(width, height int) {
+	r.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close flushes and closes the recording, later events are ignored.
+func (r *CastRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return errors.Join(r.w.Flush(), r.f.Close())
+}
+
+// Replay plays back the output of a recording (see CastRecorder) to out, with its timing
+// (pauses capped to ReplayMaxIdle).
+func Replay(path string, out io.Writer) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return log.FErrf("Failed to open recording: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxCastLine)
+	var header CastHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil || header.Version != 2 {
+		return log.FErrf("%s isn't an asciicast v2 recording", path)
+	}
+	log.Infof("Replaying %s recorded on a %dx%d terminal", path, header.Width, header.Height)
+	var last float64
+	for n := 2; scanner.Scan(); n++ {
+		var event []any
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			return log.FErrf("Invalid event line %d of %s", n, path)
+		}
+		t, _ := event[0].(float64)
+		kind, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if kind != "o" {
+			continue
+		}
+		time.Sleep(min(time.Duration((t-last)*float64(time.Second)), ReplayMaxIdle))
+		last = t
+		if _, err = io.WriteString(out, data); err != nil {
+			return log.FErrf("Replay write error: %v", err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return log.FErrf("Failed to read recording: %v", err)
+	}
+	return 0
+}
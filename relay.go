@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tsnet"
+)
+
+// Relay runs a rendezvous which also relays the data of the peers whose holes don't get through
+// (see tsnet.Config.RelayServer), on -listen-port (tsnet.DefaultRendezvousPort by default) and
+// without discovery, until interrupted.
+func Relay(cfg *tsnet.Config) int {
+	cfg.RendezvousServer, cfg.RelayServer = true, true
+	cfg.NoDiscovery, cfg.MDNS, cfg.StaticPeers = true, false, nil
+	if cfg.ListenPort == 0 {
+		cfg.ListenPort = tsnet.DefaultRendezvousPort
+	}
+	srv := cfg.NewServer()
+	if err := srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer srv.Stop()
+	addr := srv.OurAddress()
+	log.Infof("Relay %q listening on %v: run the peers with -rendezvous %v (or this host's public address"+
+		" and port %d) and -relay", srv.Name, addr, addr, addr.Port)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	<-ctx.Done()
+	log.Infof("Relayed %d datagrams", srv.NAT.Relayed())
+	return 0
+}
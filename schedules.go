@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsched"
+	"fortio.org/tsync/tsnet"
+)
+
+// ScheduleCheckInterval is how often the scheduled jobs are checked for being due.
+var ScheduleCheckInterval = 5 * time.Second
+
+// ScheduleRunner runs the scheduled sync jobs (see package tsched and tcrypto.Storage.Schedules),
+// pushing their snapshots to the backup target peers one at a time, in the terminal UI or with
+// `tsync schedule`.
+type ScheduleRunner struct {
+	Sched     *tsched.Scheduler
+	stateFile string
+	srv       *tsnet.Server
+	seen      map[string]time.Time // when the peers were first seen, by name.
+	onData    atomic.Pointer[func(peer tsnet.Peer, data []byte) bool]
+}
+
+// NewScheduleRunner reads the scheduled jobs and their results so far from the storage directories.
+func NewScheduleRunner() (*ScheduleRunner, error) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := tsched.LoadJobs(storage.Schedules())
+	if err != nil {
+		return nil, err
+	}
+	state, err := tsched.LoadState(storage.ScheduleState())
+	if err != nil {
+		return nil, err
+	}
+	return &ScheduleRunner{
+		Sched:     tsched.New(jobs, state, time.Now()),
+		stateFile: storage.ScheduleState(),
+		seen:      make(map[string]time.Time),
+	}, nil
+}
+
+// LoadSchedules returns the runner of the scheduled jobs for the terminal UI: errors are logged
+// and no jobs run.
+func LoadSchedules() *ScheduleRunner {
+	runner, err := NewScheduleRunner()
+	if err != nil {
+		log.Errf("Not running the scheduled jobs: %v", err)
+		return &ScheduleRunner{Sched: tsched.New(nil, nil, time.Now())}
+	}
+	return runner
+}
+
+// OnData passes the acks, replies and answers of the snapshot being pushed, returning true if
+// data was one.
+func (r *ScheduleRunner) OnData(peer tsnet.Peer, data []byte) bool {
+	f := r.onData.Load()
+	return f != nil && (*f)(peer, data)
+}
+
+// Run runs the due jobs every ScheduleCheckInterval until ctx is done.
+func (r *ScheduleRunner) Run(ctx context.Context, srv *tsnet.Server) {
+	r.srv = srv
+	if r.Sched.Jobs() == 0 {
+		return
+	}
+	log.Infof("Running %d scheduled jobs", r.Sched.Jobs())
+	if err := r.Sched.State().Save(r.stateFile); err != nil { // when the new jobs were added.
+		log.Errf("Failed to save the schedules state: %v", err)
+	}
+	ticker := time.NewTicker(ScheduleCheckInterval)
+	defer ticker.Stop()
+	for {
+		r.check(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check runs the jobs due at now. Peers are only online once they had time to see one of our
+// announcements (see Pipe), so they don't drop our data.
+func (r *ScheduleRunner) check(now time.Time) {
+	settle := r.srv.BaseBroadcastInterval + time.Second
+	peers := make(map[string]tsnet.Peer)
+	var online []string
+	for p := range r.srv.Peers.Keys() {
+		peers[p.Name] = p
+		if _, ok := r.seen[p.Name]; !ok {
+			r.seen[p.Name] = now
+		}
+		if now.Sub(r.seen[p.Name]) >= settle {
+			online = append(online, p.Name)
+		}
+	}
+	for name := range r.seen {
+		if _, ok := peers[name]; !ok {
+			delete(r.seen, name)
+		}
+	}
+	r.Sched.Online(now, online)
+	for _, job := range r.Sched.Due(now) {
+		n, err := r.push(job, peers[job.Peer])
+		r.Sched.Done(job.Name, time.Now(), n, err)
+		if err != nil {
+			log.Errf("Scheduled job %q to %q failed after %d bytes: %v", job.Name, job.Peer, n, err)
+		} else {
+			log.Infof("Scheduled job %q pushed the snapshot of %s (%d encrypted bytes) to %q",
+				job.Name, strings.Join(job.Dirs, ", "), n, job.Peer)
+		}
+		if err = r.Sched.State().Save(r.stateFile); err != nil {
+			log.Errf("Failed to save the schedules state: %v", err)
+		}
+	}
+}
+
+// push sends a snapshot of the job's directories to its peer.
+func (r *ScheduleRunner) push(job tsched.Job, peer tsnet.Peer) (int64, error) {
+	acks, onAck := StreamAcks(peer.Name)
+	replies, onReply := DropReplies(peer.Name)
+	answers, onAnswer := SnapshotAnswers(peer.Name)
+	onData := func(peer tsnet.Peer, data []byte) bool {
+		return onAck(peer, data) || onReply(peer, data) || onAnswer(peer, data)
+	}
+	r.onData.Store(&onData)
+	defer r.onData.Store(nil)
+	if data, _ := r.srv.Peers.Get(peer); data.MTU == 0 {
+		ProbeMTU(r.srv, peer)
+	}
+	return PushSnapshot(r.srv, peer, job.Dirs, acks, replies, answers)
+}
+
+// RunSchedules runs the scheduled jobs without the terminal UI, until interrupted.
+func RunSchedules(cfg *tsnet.Config) int {
+	runner, err := NewScheduleRunner()
+	if err != nil {
+		return log.FErrf("Failed to load the schedules: %v", err)
+	}
+	if runner.Sched.Jobs() == 0 {
+		return log.FErrf("No scheduled jobs, see README for the format of the schedules file")
+	}
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		if !runner.OnData(peer, data) {
+			log.LogVf("Ignoring data from %q, not pushing a snapshot to it", peer.Name)
+		}
+	}
+	srv := cfg.NewServer()
+	if err = srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer srv.Stop()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	runner.Run(ctx, srv)
+	return 0
+}
+
+// ScheduleLines returns the lines of the schedules view: the jobs with their next run and last
+// result as of now.
+func ScheduleLines(status []tsched.JobStatus, now time.Time) []string {
+	if len(status) == 0 {
+		return []string{"No scheduled jobs, see README for the format of the schedules file"}
+	}
+	lines := []string{fmt.Sprintf("%-16s %-18s %-12s %-24s %s", "Job", "Schedule", "Peer", "Next run", "Last run")}
+	for _, s := range status {
+		next := "when the peer connects"
+		switch {
+		case !s.Next.IsZero() && !s.Next.After(now) && s.Online:
+			next = "now"
+		case !s.Next.IsZero() && !s.Next.After(now):
+			next = "when the peer is online"
+		case !s.Next.IsZero():
+			next = fmt.Sprintf("%s (in %v)", s.Next.Format("Jan 2 15:04"), s.Next.Sub(now).Round(time.Minute))
+		}
+		last := "never"
+		switch {
+		case s.LastRun.IsZero():
+		case s.Error != "":
+			last = fmt.Sprintf("%s failed: %s", s.LastRun.Format("Jan 2 15:04"), s.Error)
+		default:
+			last = fmt.Sprintf("%s ok, %s", s.LastRun.Format("Jan 2 15:04"), ByteSize(s.Bytes))
+		}
+		lines = append(lines, fmt.Sprintf("%-16s %-18s %-12s %-24s %s", s.Name, s.Schedule, s.Peer, next, last))
+	}
+	return lines
+}
+
+// Schedules prints the scheduled jobs with their next run and last result (as JSON with PeersJSON).
+func Schedules() int {
+	runner, err := NewScheduleRunner()
+	if err != nil {
+		return log.FErrf("Failed to load the schedules: %v", err)
+	}
+	status := runner.Sched.Status()
+	if PeersJSON {
+		out, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return log.FErrf("Can't encode the schedules: %v", err)
+		}
+		fmt.Println(string(out))
+		return 0
+	}
+	for _, line := range ScheduleLines(status, time.Now()) {
+		fmt.Println(line)
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fortio.org/log"
+	"fortio.org/smap"
+	"fortio.org/terminal/ansipixels/tcolor"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// Selection is the terminal UI's peer cursor and the peers marked (with space) for batch actions.
+// Peers are marked by identity so the marks survive reordering of the table.
+type Selection struct {
+	Cursor int // index in the sorted peers snapshot.
+	marked map[tsnet.Peer]bool
+}
+
+// Update removes the marks of the peers which are gone and keeps the cursor inside the table.
+func (s *Selection) Update(peers []smap.KV[tsnet.Peer, tsnet.PeerData]) {
+	present := make(map[tsnet.Peer]bool, len(peers))
+	for _, kv := range peers {
+		present[kv.Key] = true
+	}
+	for peer := range s.marked {
+		if !present[peer] {
+			delete(s.marked, peer)
+		}
+	}
+	s.Cursor = max(0, min(s.Cursor, len(peers)-1))
+}
+
+// Move moves the cursor by delta lines, staying within the n peers.
+func (s *Selection) Move(delta, n int) {
+	s.Cursor = max(0, min(s.Cursor+delta, n-1))
+}
+
+// Toggle marks or unmarks the peer under the cursor.
+func (s *Selection) Toggle(peers []smap.KV[tsnet.Peer, tsnet.PeerData]) {
+	if s.Cursor >= len(peers) {
+		return
+	}
+	if s.marked == nil {
+		s.marked = make(map[tsnet.Peer]bool)
+	}
+	peer := peers[s.Cursor].Key
+	if s.marked[peer] {
+		delete(s.marked, peer)
+	} else {
+		s.marked[peer] = true
+	}
+}
+
+// ToggleAll marks all the peers, or none if they all were.
+func (s *Selection) ToggleAll(peers []smap.KV[tsnet.Peer, tsnet.PeerData]) {
+	if len(s.marked) == len(peers) {
+		clear(s.marked)
+		return
+	}
+	for i := range peers {
+		if !s.IsMarked(peers[i].Key) {
+			s.Cursor = i
+			s.Toggle(peers)
+		}
+	}
+}
+
+// IsMarked returns whether the peer is marked.
+func (s *Selection) IsMarked(peer tsnet.Peer) bool {
+	return s.marked[peer]
+}
+
+// Targets returns the peers a batch action applies to: the marked ones or, if none, the one under the cursor.
+func (s *Selection) Targets(peers []smap.KV[tsnet.Peer, tsnet.PeerData]) []smap.KV[tsnet.Peer, tsnet.PeerData] {
+	var targets []smap.KV[tsnet.Peer, tsnet.PeerData]
+	for _, kv := range peers {
+		if s.marked[kv.Key] {
+			targets = append(targets, kv)
+		}
+	}
+	if len(targets) == 0 && s.Cursor < len(peers) {
+		targets = append(targets, peers[s.Cursor])
+	}
+	return targets
+}
+
+// Decorate shows the cursor and mark on the table line of the peer at idx (see PeerTable).
+func (s *Selection) Decorate(line []string, idx int, peer tsnet.Peer) []string {
+	if s.marked[peer] {
+		line[0] = "✓" + line[0]
+	}
+	if idx == s.Cursor {
+		line[1] = tcolor.Inverse + line[1]
+	}
+	return line
+}
+
+// TrustPeers adds the peers to the trust store (the user checked their hashes in the table),
+// publishing EventPeerTrusted for the newly trusted ones.
+func TrustPeers(id *tcrypto.Identity, peers []smap.KV[tsnet.Peer, tsnet.PeerData], hooks *Hooks) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		log.Errf("Failed to access storage: %v", err)
+		return
+	}
+	for _, kv := range peers {
+		peer := kv.Key
+		added, err := storage.Trust(id, tcrypto.TrustEntry{Name: peer.Name, PublicKey: peer.PublicKey})
+		switch {
+		case err != nil:
+			log.Errf("Failed to trust %q: %v", peer.Name, err)
+		case !added:
+			log.Infof("%q (%s) is already trusted", peer.Name, kv.Value.HumanHash)
+		default:
+			log.Infof("Trusting %q, hash %s", peer.Name, kv.Value.HumanHash)
+			hooks.Publish(EventPeerTrusted, peerDetails(peer, kv.Value))
+		}
+	}
+}
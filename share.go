@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/txfer"
+)
+
+// ShareFrame is the first byte of the data messages of the shares protocol (see txfer.Shares):
+// `ls <offset> "<path>"`, answered with `list <offset> <total> <entries>` (a JSON array of as many
+// entries from offset as fit in a message), `get <drop token> "<path>"`, answered by dropping the
+// file with that token, `tar <drop token> <auto|always> "<path>"`, answered with `wait` while the
+// directory is packed and then by dropping it as a txfer.PackDir archive, or with `files` when (in
+// auto mode) it's better pulled file by file, and `put "<path>"`, answered with `token <drop token>`
+// for the peer to drop a file in that directory of a writable share. Any can be answered with
+// `error <reason>` instead.
+const ShareFrame = 'F'
+
+const (
+	shareListFormat = "ls %d %q"
+	shareGetFormat  = "get %s %q"
+	shareTarFormat  = "tar %s %s %q"
+	sharePutFormat  = "put %q"
+	shareEntries    = "list"
+	shareToken      = "token"
+	shareWait       = "wait"
+	shareFiles      = "files"
+	shareError      = "error"
+)
+
+// Shared are the directories exposed to the trusted peers (-share flag).
+var Shared []txfer.Share
+
+// PullArchive is when the directories are pulled from the peers' shares as an archive (-archive flag).
+var PullArchive txfer.ArchiveMode
+
+// ErrShareUntrusted is returned by the shares requests when the peer doesn't trust us.
+var ErrShareUntrusted = errors.New("not trusted by the peer")
+
+// ShareServer answers the trusted peers' requests to browse, get files from and put files in the
+// Shared directories.
+type ShareServer struct {
+	Shares  *txfer.Shares
+	srv     *tsnet.Server
+	storage *tcrypto.Storage
+	mu      sync.Mutex
+	boxes   map[string]*txfer.DropBox                          // of the writable directories, by path.
+	sends   map[string]func(peer tsnet.Peer, data []byte) bool // gets in progress, by peer name.
+	packing map[string]bool                                    // archives being packed, by peer name.
+}
+
+// NewShareServer checks the shared directories.
+func NewShareServer(shared []txfer.Share) (*ShareServer, error) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return nil, err
+	}
+	shares, err := txfer.NewShares(shared)
+	if err != nil {
+		return nil, err
+	}
+	return &ShareServer{
+		Shares:  shares,
+		storage: storage,
+		boxes:   make(map[string]*txfer.DropBox),
+		sends:   make(map[string]func(peer tsnet.Peer, data []byte) bool),
+		packing: make(map[string]bool),
+	}, nil
+}
+
+// LoadShares returns the share server of the Shared directories for the terminal UI: errors are
+// logged and nothing is shared.
+func LoadShares() *ShareServer {
+	shares, err := NewShareServer(Shared)
+	if err != nil {
+		log.Errf("Not sharing any directory: %v", err)
+		shares, _ = NewShareServer(nil)
+	}
+	return shares
+}
+
+// Receive handles a data message from peer, returning true if it was one of the shares protocol:
+// a request, a frame of a file being put or an ack or reply of one being sent.
+func (s *ShareServer) Receive(peer tsnet.Peer, data []byte) bool {
+	if s == nil || len(data) == 0 {
+		return false
+	}
+	s.mu.Lock()
+	forward := s.sends[peer.Name]
+	var box *txfer.DropBox
+	for _, b := range s.boxes {
+		if b.Owns(peer.Name, data) {
+			box = b
+			break
+		}
+	}
+	s.mu.Unlock()
+	switch {
+	case forward != nil && forward(peer, data):
+	case box != nil:
+		ReceiveDrop(s.srv, box, peer, data)
+	case data[0] == ShareFrame:
+		s.request(peer, string(data[1:]))
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *ShareServer) request(peer tsnet.Peer, req string) {
+	if !s.srv.Encrypted(peer) {
+		log.Warnf("Ignoring the unencrypted shares request from %q, it needs to connect first", peer.Name)
+		return
+	}
+	if _, trusted, err := s.storage.Trusted(s.srv.Identity, peer.PublicKey); err != nil || !trusted {
+		log.Warnf("Shares request from untrusted %q (%v)", peer.Name, err)
+		s.srv.RecordFailure(peer.IP, peer, "shares request from an untrusted peer")
+		s.reply(peer, shareError+" "+ErrShareUntrusted.Error())
+		return
+	}
+	var offset int
+	var token, mode, p string
+	switch {
+	case scanRequest(req, shareListFormat, &offset, &p):
+		s.list(peer, offset, p)
+	case scanRequest(req, shareGetFormat, &token, &p):
+		f, err := s.Shares.Open(p)
+		if err != nil {
+			s.reply(peer, shareError+" "+err.Error())
+			return
+		}
+		go s.send(peer, token, p, f)
+	case scanRequest(req, shareTarFormat, &token, &mode, &p):
+		s.archive(peer, token, mode, p)
+	case scanRequest(req, sharePutFormat, &p):
+		box, err := s.box(p)
+		if err != nil {
+			s.reply(peer, shareError+" "+err.Error())
+			return
+		}
+		s.reply(peer, shareToken+" "+box.NewToken(DropTokenTTL))
+	default:
+		log.Warnf("Invalid shares request from %q: %q", peer.Name, req)
+	}
+}
+
+func scanRequest(req, format string, args ...any) bool {
+	_, err := fmt.Sscanf(req, format, args...)
+	return err == nil
+}
+
+func (s *ShareServer) reply(peer tsnet.Peer, answer string) {
+	if err := s.srv.SendData(peer, append([]byte{ShareFrame}, answer...)); err != nil {
+		log.Errf("Failed to reply to %q: %v", peer.Name, err)
+	}
+}
+
+// list answers with the entries of the directory p, from offset.
+func (s *ShareServer) list(peer tsnet.Peer, offset int, p string) {
+	entries, err := s.Shares.List(p)
+	if err == nil && (offset < 0 || offset > len(entries)) {
+		err = fmt.Errorf("invalid offset %d", offset)
+	}
+	if err != nil {
+		s.reply(peer, shareError+" "+err.Error())
+		return
+	}
+	maxSize := s.srv.MaxDataSize(peer)
+	msg := fmt.Appendf([]byte{ShareFrame}, "%s %d %d [", shareEntries, offset, len(entries))
+	for i, e := range entries[offset:] {
+		entry, _ := json.Marshal(e)
+		if i > 0 && len(msg)+len(entry)+2 > maxSize {
+			break
+		}
+		if i > 0 {
+			msg = append(msg, ',')
+		}
+		msg = append(msg, entry...)
+	}
+	if err = s.srv.SendData(peer, append(msg, ']')); err != nil {
+		log.Errf("Failed to reply to %q: %v", peer.Name, err)
+	}
+}
+
+// box returns the DropBox of the directory p of a writable share.
+func (s *ShareServer) box(p string) (*txfer.DropBox, error) {
+	dir, err := s.Shares.WriteDir(p)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if box := s.boxes[dir]; box != nil {
+		return box, nil
+	}
+	box, err := txfer.NewDropBox(dir)
+	if err != nil {
+		return nil, err
+	}
+	box.OnDrop = func(d *txfer.Drop, n int64, err error) {
+		if err != nil {
+			log.Errf("Put of %q by %q in %s failed after %d bytes: %v", d.Name, d.From, p, n, err)
+			return
+		}
+		log.Infof("%q put %q (%d bytes) in %s", d.From, d.Name, n, d.Path)
+	}
+	s.boxes[dir] = box
+	return box, nil
+}
+
+// send drops the file at p to the peer with its token, unless we're already sending it one
+// (the request was repeated).
+func (s *ShareServer) send(peer tsnet.Peer, token, p string, f *os.File) {
+	defer f.Close()
+	acks, onAck := StreamAcks(peer.Name)
+	replies, onReply := DropReplies(peer.Name)
+	s.mu.Lock()
+	if s.sends[peer.Name] != nil {
+		s.mu.Unlock()
+		log.LogVf("Already sending a shared file to %q", peer.Name)
+		return
+	}
+	s.sends[peer.Name] = func(peer tsnet.Peer, data []byte) bool {
+		return onAck(peer, data) || onReply(peer, data)
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sends, peer.Name)
+		s.mu.Unlock()
+	}()
+	newSender := func() *txfer.StreamSender { return DropSender(s.srv, peer, acks) }
+	n, err := txfer.SendDropFile(context.Background(), newSender, token, path.Base(p), "", f, replies)
+	if err != nil {
+		log.Errf("Failed to send %s to %q after %d bytes: %v", p, peer.Name, n, err)
+		return
+	}
+	log.Infof("Sent %s (%d bytes) to %q", p, n, peer.Name)
+}
+
+// archive answers a tar request: unless it's better pulled file by file, the directory p is packed
+// in a temporary archive, in the background, and sent like a file.
+func (s *ShareServer) archive(peer tsnet.Peer, token, modeName, p string) {
+	mode, err := txfer.ParseArchiveMode(modeName)
+	if err == nil && mode == txfer.ArchiveOff {
+		err = errors.New("archive mode off")
+	}
+	var dir *os.Root
+	if err == nil {
+		dir, err = s.Shares.OpenDir(p)
+	}
+	if err != nil {
+		s.reply(peer, shareError+" "+err.Error())
+		return
+	}
+	files, size, err := txfer.DirStats(dir.FS())
+	if err != nil || !txfer.PreferArchive(mode, files, size) {
+		dir.Close()
+		if err != nil {
+			s.reply(peer, shareError+" "+err.Error())
+		} else {
+			s.reply(peer, shareFiles)
+		}
+		return
+	}
+	s.mu.Lock()
+	busy := s.packing[peer.Name] || s.sends[peer.Name] != nil // the request was repeated.
+	if !busy {
+		s.packing[peer.Name] = true
+	}
+	s.mu.Unlock()
+	s.reply(peer, shareWait)
+	if busy {
+		dir.Close()
+		return
+	}
+	go s.sendArchive(peer, token, p, dir, files, size)
+}
+
+// sendArchive packs dir (the directory p, closed when done) and drops it to the peer with its token.
+func (s *ShareServer) sendArchive(peer tsnet.Peer, token, p string, dir *os.Root, files int, size int64) {
+	defer dir.Close()
+	defer func() {
+		s.mu.Lock()
+		delete(s.packing, peer.Name)
+		s.mu.Unlock()
+	}()
+	f, err := os.CreateTemp("", "tsync-*"+txfer.ArchiveExt)
+	if err != nil {
+		log.Errf("Failed to pack %s for %q: %v", p, peer.Name, err)
+		s.reply(peer, shareError+" "+err.Error())
+		return
+	}
+	defer os.Remove(f.Name())
+	if _, _, err = txfer.PackDir(context.Background(), f, dir.FS()); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		log.Errf("Failed to pack %s for %q: %v", p, peer.Name, err)
+		s.reply(peer, shareError+" "+err.Error())
+		return
+	}
+	log.Infof("Packed %s (%d files, %s) for %q", p, files, ByteSize(size), peer.Name)
+	s.send(peer, token, path.Clean("/"+p)+txfer.ArchiveExt, f)
+}
+
+// Share serves the Shared directories to the trusted peers without the terminal UI, until
+// interrupted.
+func Share(cfg *tsnet.Config) int {
+	if len(Shared) == 0 {
+		return log.FErrf("Nothing to share, use -share [name=]dir[:rw],...")
+	}
+	shares, err := NewShareServer(Shared)
+	if err != nil {
+		return log.FErrf("Invalid -share: %v", err)
+	}
+	audit, err := OpenAuditLog(cfg)
+	if err != nil {
+		return log.FErrf("Failed to open the audit log: %v", err)
+	}
+	defer audit.Close()
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		if !shares.Receive(peer, data) {
+			log.LogVf("Ignoring data from %q, not a shares request", peer.Name)
+		}
+	}
+	cfg.RequireEncryption = true // requests, files and replies only through the session.
+	shares.srv = cfg.NewServer()
+	if err = shares.srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer shares.srv.Stop()
+	log.Infof("Sharing %d directories with the trusted peers as %q", shares.Shares.Len(), shares.srv.Name)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	<-ctx.Done()
+	return 0
+}
+
+// ShareAnswers returns a channel for the shares answers (after ShareFrame) from peerName and a
+// function to call from Config.OnData which forwards them to it (returning true if data was one).
+func ShareAnswers(peerName string) (<-chan string, func(peer tsnet.Peer, data []byte) bool) {
+	answers := make(chan string, 1)
+	return answers, func(peer tsnet.Peer, data []byte) bool {
+		if !IsPeer(peer, peerName) || len(data) == 0 || data[0] != ShareFrame {
+			return false
+		}
+		select {
+		case answers <- string(data[1:]):
+		default: // answers to repeated requests.
+		}
+		return true
+	}
+}
+
+// shareRequest sends the request to the peer until it answers, returning the answer or its error.
+func shareRequest(srv *tsnet.Server, peer tsnet.Peer, req string, answers <-chan string) (string, error) {
+	for range SnapshotRequestTries {
+		if err := srv.SendData(peer, append([]byte{ShareFrame}, req...)); err != nil {
+			return "", err
+		}
+		select {
+		case answer := <-answers:
+			return answer, shareAnswerError(answer)
+		case <-time.After(txfer.DropReplyTimeout):
+		}
+	}
+	return "", txfer.ErrNoReply
+}
+
+// shareAnswerError returns the error of an "error" answer, nil for the others.
+func shareAnswerError(answer string) error {
+	reason, ok := strings.CutPrefix(answer, shareError+" ")
+	switch {
+	case !ok:
+		return nil
+	case reason == ErrShareUntrusted.Error():
+		return ErrShareUntrusted
+	default:
+		return errors.New(reason)
+	}
+}
+
+// ListShare returns the entries of the directory p of the peer's shares ("/" lists the shares),
+// answers being fed from Config.OnData (see ShareAnswers).
+func ListShare(srv *tsnet.Server, peer tsnet.Peer, p string, answers <-chan string) ([]txfer.ShareEntry, error) {
+	var list []txfer.ShareEntry
+	for {
+		answer, err := shareRequest(srv, peer, fmt.Sprintf(shareListFormat, len(list), p), answers)
+		if err != nil {
+			return nil, err
+		}
+		words := strings.SplitN(answer, " ", 4)
+		if len(words) != 4 || words[0] != shareEntries {
+			return nil, errors.New("invalid answer " + answer)
+		}
+		offset, errO := strconv.Atoi(words[1])
+		total, errT := strconv.Atoi(words[2])
+		var page []txfer.ShareEntry
+		if err = errors.Join(errO, errT, json.Unmarshal([]byte(words[3]), &page)); err != nil {
+			return nil, fmt.Errorf("invalid list answer: %w", err)
+		}
+		if offset != len(list) {
+			continue // answer to a repeated request for the previous page.
+		}
+		list = append(list, page...)
+		if len(list) >= total || len(page) == 0 {
+			return list, nil
+		}
+	}
+}
+
+// errShareFiles is returned by getShare when the peer answers a tar request with `files`.
+var errShareFiles = errors.New("better pulled file by file")
+
+// GetShareFile asks the peer for the file at p of its shares, to be dropped in box, and waits for
+// it (done, from box.OnDrop) or the peer's error answer.
+func GetShareFile(srv *tsnet.Server, peer tsnet.Peer, p string, box *txfer.DropBox, answers <-chan string,
+	done <-chan error,
+) error {
+	return getShare(srv, peer, fmt.Sprintf(shareGetFormat, box.NewToken(DropTokenTTL), p), box, answers, done)
+}
+
+// getShare sends the get or tar request until the drop to box is done, the peer answers with an
+// error (or `files`) or it doesn't answer. A `wait` answer (packing) restarts the tries.
+func getShare(srv *tsnet.Server, peer tsnet.Peer, req string, box *txfer.DropBox, answers <-chan string,
+	done <-chan error,
+) error {
+	request := append([]byte{ShareFrame}, req...)
+	for try := 0; try < SnapshotRequestTries; try++ {
+		if err := srv.SendData(peer, request); err != nil {
+			return err
+		}
+		timer := time.NewTimer(txfer.DropReplyTimeout)
+		for waiting := true; waiting; {
+			select {
+			case err := <-done:
+				timer.Stop()
+				return err
+			case answer := <-answers:
+				if err := shareAnswerError(answer); err != nil {
+					timer.Stop()
+					return err
+				}
+				switch answer {
+				case shareFiles:
+					timer.Stop()
+					return errShareFiles
+				case shareWait:
+					try = -1 // still packing, doesn't count.
+				}
+			case <-timer.C:
+				if len(box.Active()) == 0 {
+					waiting = false
+					continue
+				}
+				timer.Reset(txfer.DropReplyTimeout) // receiving, wait until it's done.
+			}
+		}
+	}
+	return txfer.ErrNoReply
+}
+
+// PutShareFile drops the file in the directory p of the peer's writable share, acks, replies and
+// answers being fed from Config.OnData (see StreamAcks, DropReplies and ShareAnswers).
+func PutShareFile(srv *tsnet.Server, peer tsnet.Peer, file, p string, acks, replies <-chan []byte,
+	answers <-chan string,
+) (int64, error) {
+	answer, err := shareRequest(srv, peer, fmt.Sprintf(sharePutFormat, p), answers)
+	if err != nil {
+		return 0, err
+	}
+	token, ok := strings.CutPrefix(answer, shareToken+" ")
+	if !ok {
+		return 0, errors.New("invalid answer " + answer)
+	}
+	return DropFile(srv, peer, token, file, acks, replies)
+}
+
+// ShareEntryLine returns the `ls -l` like line of a shared entry.
+func ShareEntryLine(e txfer.ShareEntry) string {
+	kind, size, name := "-", ByteSize(e.Size), e.Name
+	if e.Dir {
+		kind, size, name = "d", "", name+"/"
+	}
+	if e.Writable {
+		name += " (writable)"
+	}
+	mtime := ""
+	if !e.ModTime.IsZero() {
+		mtime = e.ModTime.Local().Format("Jan 2 15:04")
+	}
+	return fmt.Sprintf("%s %10s %12s  %s", kind, size, mtime, name)
+}
+
+// ListShares prints the entries of the directory p of peerName's shares (as JSON with PeersJSON).
+func ListShares(cfg *tsnet.Config, peerName, p string, timeout time.Duration) int {
+	answers, onAnswer := ShareAnswers(peerName)
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		onAnswer(peer, data)
+	}
+	srv := cfg.NewServer()
+	defer srv.Stop()
+	peer, code := ConnectTarget(srv, peerName, timeout)
+	if code != 0 {
+		return code
+	}
+	list, err := ListShare(srv, peer, p, answers)
+	if err != nil {
+		log.FErrf("Failed to list %s on %q: %v", p, peer.Name, err)
+		return TransferExitCode(err)
+	}
+	if PeersJSON {
+		out, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return log.FErrf("Can't encode the entries: %v", err)
+		}
+		fmt.Println(string(out))
+		return 0
+	}
+	for _, e := range list {
+		fmt.Println(ShareEntryLine(e))
+	}
+	return 0
+}
+
+// GetShare pulls the file at p of peerName's shares into the directory dest or, when p ends with a
+// slash, the directory (recursively, see Puller.Pull).
+func GetShare(cfg *tsnet.Config, peerName, p, dest string, timeout time.Duration) int {
+	puller := NewPuller(nil, peerName)
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		puller.OnData(peer, data)
+	}
+	srv := cfg.NewServer()
+	defer srv.Stop()
+	puller.srv = srv
+	peer, code := ConnectTarget(srv, peerName, timeout)
+	if code != 0 {
+		return code
+	}
+	files, size, err := puller.Pull(peer, p, strings.HasSuffix(p, "/"), dest)
+	if err != nil {
+		log.FErrf("Failed to get %s from %q after %d file(s): %v", p, peer.Name, files, err)
+		return TransferExitCode(err)
+	}
+	log.Infof("Got %s from %q in %s: %d file(s), %s", p, peer.Name, dest, files, ByteSize(size))
+	return 0
+}
+
+// PutShare drops file in the directory p of peerName's writable share.
+func PutShare(cfg *tsnet.Config, peerName, file, p string, timeout time.Duration) int {
+	if _, err := os.Stat(file); err != nil {
+		return log.FErrf("Failed to stat %q: %v", file, err)
+	}
+	acks, onAck := StreamAcks(peerName)
+	replies, onReply := DropReplies(peerName)
+	answers, onAnswer := ShareAnswers(peerName)
+	cfg.OnData = func(peer tsnet.Peer, data []byte) {
+		if !onAck(peer, data) && !onReply(peer, data) {
+			onAnswer(peer, data)
+		}
+	}
+	srv := cfg.NewServer()
+	defer srv.Stop()
+	peer, code := ConnectTarget(srv, peerName, timeout)
+	if code != 0 {
+		return code
+	}
+	n, err := PutShareFile(srv, peer, file, p, acks, replies, answers)
+	if err != nil {
+		log.FErrf("Failed to put %q in %s on %q after %d bytes: %v", file, p, peer.Name, n, err)
+		return TransferExitCode(err)
+	}
+	log.Infof("Put %q (%d bytes) in %s on %q", file, n, p, peer.Name)
+	return 0
+}
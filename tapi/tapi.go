@@ -0,0 +1,252 @@
+// Package tapi is the control API of a running tsync: peers, connections, transfers and identity,
+// defined in control.proto and served with gRPC on a local unix socket (~/.tsync/control.sock for
+// the tsync command's -api flag), so tooling in any language can get typed clients generated from
+// the .proto. Go clients use Dial and the generated NewControlClient:
+//
+//	conn, err := tapi.Dial(socketPath)
+//	...
+//	defer conn.Close()
+//	peers, err := tapi.NewControlClient(conn).ListPeers(ctx, &tapi.ListPeersRequest{})
+//
+// The server also supports gRPC reflection, for generic clients like grpcurl.
+package tapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tstatus"
+	"fortio.org/tsync/txfer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// ErrSocketInUse is returned by Listen when another process serves the socket.
+var ErrSocketInUse = errors.New("control socket in use")
+
+// Service implements ControlServer for a tsnet.Server.
+type Service struct {
+	UnimplementedControlServer
+	Srv *tsnet.Server
+	// Optional inbox, whose drops in progress are listed with the transfers.
+	Box *txfer.DropBox
+	// DropFile drops the file in the peer's inbox, SendFile calls are unimplemented when nil.
+	DropFile func(ctx context.Context, peer, token, path string) error
+	// NewToken returns a one time drop token for Box and its expiration, NewDropToken calls are
+	// unimplemented when nil.
+	NewToken func() (string, time.Time)
+	mu       sync.Mutex
+	changed  chan struct{} // closed (and replaced) by Changed
+}
+
+// NewService returns the service for srv, Changed must be called from its Config.OnChange.
+func NewService(srv *tsnet.Server) *Service {
+	return &Service{Srv: srv, changed: make(chan struct{})}
+}
+
+// Changed notifies the WatchPeers calls that the peers changed.
+func (s *Service) Changed() {
+	s.mu.Lock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// Listen listens on the unix socket path, removing it first if it's left over from a previous run.
+// The socket is only accessible to the current user.
+func Listen(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrSocketInUse, path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve serves the service (and reflection) on l in the background, until the returned server is stopped.
+func Serve(l net.Listener, svc *Service) *grpc.Server {
+	gs := grpc.NewServer()
+	RegisterControlServer(gs, svc)
+	reflection.Register(gs)
+	go func() {
+		_ = gs.Serve(l) // only returns once stopped.
+	}()
+	return gs
+}
+
+// Dial returns a client connection to the control API served on the unix socket path.
+func Dial(path string) (*grpc.ClientConn, error) {
+	return grpc.NewClient("unix://"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+func (s *Service) GetIdentity(_ context.Context, _ *GetIdentityRequest) (*Identity, error) {
+	self := tstatus.NewSelf(s.Srv)
+	return &Identity{
+		Name:      self.Name,
+		PublicKey: self.PublicKey,
+		HumanHash: self.HumanHash,
+		Ip:        self.IP,
+		Port:      int32(self.Port), //nolint:gosec // ports fit.
+	}, nil
+}
+
+func newPeer(p tstatus.Peer) *Peer {
+	status, _ := tstatus.ParseStatus(p.Status)
+	return &Peer{
+		Name:           p.Name,
+		Ip:             p.IP,
+		Port:           int32(p.Port), //nolint:gosec // ports fit.
+		PublicKey:      p.PublicKey,
+		HumanHash:      p.HumanHash,
+		Status:         ConnectionStatus(status), //nolint:gosec // same values.
+		Mtu:            int32(p.MTU),             //nolint:gosec // MTUs fit.
+		LastSeenUnixMs: p.LastSeen.UnixMilli(),
+	}
+}
+
+// peers returns the peers changed since the version (all of them for 0, see tsnet.Server.PeersSince).
+func (s *Service) peers(since uint64) *ListPeersResponse {
+	diff := s.Srv.PeersSince(since)
+	resp := &ListPeersResponse{Peers: make([]*Peer, 0, len(diff.Updated)), Version: diff.Version, Full: diff.Full}
+	for i, kv := range diff.Updated {
+		resp.Peers = append(resp.Peers, newPeer(tstatus.NewPeer(i+1, kv.Key, kv.Value)))
+	}
+	for _, p := range diff.Removed {
+		resp.Removed = append(resp.Removed, &Peer{Name: p.Name, Ip: p.IP, PublicKey: p.PublicKey})
+	}
+	return resp
+}
+
+// SelfView returns the tstatus view of the identity (see GetIdentity).
+func SelfView(id *Identity) tstatus.Self {
+	return tstatus.Self{
+		Name: id.GetName(), IP: id.GetIp(), Port: int(id.GetPort()), PublicKey: id.GetPublicKey(), HumanHash: id.GetHumanHash(),
+	}
+}
+
+// PeerView returns the tstatus view of the peer listed at position id (from 1, see ListPeers).
+func PeerView(id int, p *Peer) tstatus.Peer {
+	return tstatus.Peer{
+		ID:        id,
+		Name:      p.GetName(),
+		IP:        p.GetIp(),
+		Port:      int(p.GetPort()),
+		PublicKey: p.GetPublicKey(),
+		HumanHash: p.GetHumanHash(),
+		Status:    tstatus.StatusName(tsnet.ConnectionStatus(p.GetStatus())),
+		MTU:       int(p.GetMtu()),
+		LastSeen:  time.UnixMilli(p.GetLastSeenUnixMs()),
+	}
+}
+
+// TransferView returns the tstatus view of the transfer (see ListTransfers).
+func TransferView(t *Transfer) tstatus.Transfer {
+	return tstatus.Transfer{
+		ID: t.GetId(), Peer: t.GetPeer(), Incoming: t.GetIncoming(), Bytes: t.GetBytes(), Name: t.GetName(), Size: t.GetSize(),
+	}
+}
+
+func (s *Service) ListPeers(_ context.Context, req *ListPeersRequest) (*ListPeersResponse, error) {
+	return s.peers(req.GetSinceVersion()), nil
+}
+
+func (s *Service) WatchPeers(req *WatchPeersRequest, stream grpc.ServerStreamingServer[ListPeersResponse]) error {
+	var version uint64
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+		resp := s.peers(version)
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		if req.GetChangesOnly() {
+			version = resp.GetVersion()
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// findPeer returns the (first, in ListPeers order) peer with that name.
+func (s *Service) findPeer(name string) (tsnet.Peer, tsnet.PeerData, error) {
+	kvs := s.Srv.Peers.KeysValuesSnapshot()
+	slices.SortFunc(kvs, tsnet.PeerKVSort)
+	for _, kv := range kvs {
+		if kv.Key.Name == name {
+			return kv.Key, kv.Value, nil
+		}
+	}
+	return tsnet.Peer{}, tsnet.PeerData{}, status.Errorf(codes.NotFound, "peer %q not found", name)
+}
+
+func (s *Service) Connect(ctx context.Context, req *ConnectRequest) (*Peer, error) {
+	peer, _, err := s.findPeer(req.GetPeer())
+	if err != nil {
+		return nil, err
+	}
+	if err = s.Srv.ConnectToPeer(peer); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "connecting to %q: %v", peer.Name, err)
+	}
+	if _, err = s.Srv.ProbeMTU(ctx, peer); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "probing %q MTU: %v", peer.Name, err)
+	}
+	data, _ := s.Srv.Peers.Get(peer)
+	return newPeer(tstatus.NewPeer(0, peer, data)), nil
+}
+
+func (s *Service) ListTransfers(_ context.Context, _ *ListTransfersRequest) (*ListTransfersResponse, error) {
+	resp := &ListTransfersResponse{}
+	for _, t := range tstatus.Transfers(s.Srv, s.Box) {
+		resp.Transfers = append(resp.Transfers, &Transfer{
+			Id: t.ID, Peer: t.Peer, Incoming: t.Incoming, Bytes: t.Bytes, Name: t.Name, Size: t.Size,
+		})
+	}
+	return resp, nil
+}
+
+func (s *Service) SendFile(ctx context.Context, req *SendFileRequest) (*SendFileResponse, error) {
+	if s.DropFile == nil {
+		return nil, status.Error(codes.Unimplemented, "sending files isn't available")
+	}
+	if _, _, err := s.findPeer(req.GetPeer()); err != nil {
+		return nil, err
+	}
+	if err := s.DropFile(ctx, req.GetPeer(), req.GetToken(), req.GetPath()); err != nil {
+		return nil, status.Errorf(codes.Aborted, "sending %q to %q: %v", req.GetPath(), req.GetPeer(), err)
+	}
+	return &SendFileResponse{}, nil
+}
+
+func (s *Service) NewDropToken(_ context.Context, _ *NewDropTokenRequest) (*DropToken, error) {
+	if s.NewToken == nil {
+		return nil, status.Error(codes.Unimplemented, "no inbox")
+	}
+	token, expires := s.NewToken()
+	return &DropToken{Token: token, ExpiresUnixMs: expires.UnixMilli()}, nil
+}
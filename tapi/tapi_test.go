@@ -0,0 +1,120 @@
+package tapi_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tapi"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newServer(t *testing.T, name string) *tsnet.Server {
+	t.Helper()
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := tsnet.Config{Name: name, Identity: id, NoDiscovery: true}
+	srv := cfg.NewServer()
+	if err = srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func addPeer(srv, other *tsnet.Server) tsnet.Peer {
+	addr := other.OurAddress()
+	peer := tsnet.Peer{IP: addr.IP.String(), Name: other.Name, PublicKey: other.Identity.PublicKeyToString()}
+	srv.AddPeer(peer, addr.Port)
+	return peer
+}
+
+func TestControl(t *testing.T) {
+	a := newServer(t, "apiA")
+	b := newServer(t, "apiB")
+	svc := tapi.NewService(a)
+	path := filepath.Join(t.TempDir(), "control.sock")
+	l, err := tapi.Listen(path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	gs := tapi.Serve(l, svc)
+	defer gs.Stop()
+	if _, err = tapi.Listen(path); !errors.Is(err, tapi.ErrSocketInUse) {
+		t.Errorf("Listen on a served socket should fail with ErrSocketInUse, got %v", err)
+	}
+	conn, err := tapi.Dial(path)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := tapi.NewControlClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	id, err := client.GetIdentity(ctx, &tapi.GetIdentityRequest{})
+	if err != nil {
+		t.Fatalf("GetIdentity failed: %v", err)
+	}
+	if id.GetName() != "apiA" || id.GetHumanHash() != a.Identity.HumanID() || id.GetPort() != int32(a.OurAddress().Port) {
+		t.Errorf("Unexpected identity %v", id)
+	}
+	watch, err := client.WatchPeers(ctx, &tapi.WatchPeersRequest{})
+	if err != nil {
+		t.Fatalf("WatchPeers failed: %v", err)
+	}
+	if peers, err := watch.Recv(); err != nil || len(peers.GetPeers()) != 0 {
+		t.Fatalf("Initial WatchPeers: %v %v", peers, err)
+	}
+	addPeer(b, a)
+	addPeer(a, b)
+	svc.Changed()
+	peers, err := watch.Recv()
+	if err != nil || len(peers.GetPeers()) != 1 {
+		t.Fatalf("WatchPeers after change: %v %v", peers, err)
+	}
+	got := peers.GetPeers()[0]
+	if got.GetName() != "apiB" || got.GetPublicKey() != b.Identity.PublicKeyToString() ||
+		got.GetStatus() != tapi.ConnectionStatus_NOT_LINKED {
+		t.Errorf("Unexpected peer %v", got)
+	}
+	if _, err = client.Connect(ctx, &tapi.ConnectRequest{Peer: "nope"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Connect to unknown peer should be NotFound, got %v", err)
+	}
+	connected, err := client.Connect(ctx, &tapi.ConnectRequest{Peer: "apiB"})
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if connected.GetMtu() == 0 {
+		t.Errorf("MTU not probed on Connect: %v", connected)
+	}
+	list, err := client.ListPeers(ctx, &tapi.ListPeersRequest{})
+	if err != nil || len(list.GetPeers()) != 1 {
+		t.Fatalf("ListPeers: %v %v", list, err)
+	}
+	if !list.GetFull() || list.GetVersion() == 0 {
+		t.Errorf("ListPeers without since_version should be full and versioned: %v", list)
+	}
+	since, err := client.ListPeers(ctx, &tapi.ListPeersRequest{SinceVersion: list.GetVersion()})
+	if err != nil || since.GetFull() || len(since.GetRemoved()) != 0 || since.GetVersion() < list.GetVersion() ||
+		(since.GetVersion() == list.GetVersion()) != (len(since.GetPeers()) == 0) { // updated (seen) since or unchanged.
+		t.Errorf("ListPeers since the last version should only have the changes: %v %v", since, err)
+	}
+	transfers, err := client.ListTransfers(ctx, &tapi.ListTransfersRequest{})
+	if err != nil || len(transfers.GetTransfers()) != 0 {
+		t.Errorf("ListTransfers without transfers: %v %v", transfers, err)
+	}
+	_, err = client.SendFile(ctx, &tapi.SendFileRequest{Peer: "apiB", Token: "x", Path: "/dev/null"})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("SendFile without DropFile should be Unimplemented, got %v", err)
+	}
+	if _, err = client.NewDropToken(ctx, &tapi.NewDropTokenRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("NewDropToken without NewToken should be Unimplemented, got %v", err)
+	}
+}
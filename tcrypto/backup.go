@@ -0,0 +1,207 @@
+package tcrypto
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// BackupKDFIterations is the PBKDF2-SHA256 iterations count for new backups (stored in the
+	// backup so it can be raised later).
+	BackupKDFIterations = 600_000
+	backupSaltSize      = 16
+	// Archive directories for the Storage Dir and ConfigDir files.
+	backupDataDir   = "data"
+	backupConfigDir = "config"
+	// maxBackupFile bounds the size of each restored file.
+	maxBackupFile = 16 << 20
+)
+
+var (
+	// ErrBackupPassphrase is returned by Restore when the passphrase is wrong (or the backup altered).
+	ErrBackupPassphrase = errors.New("wrong passphrase or altered backup")
+	// ErrIdentityExists is returned by Restore when there is already a different identity.
+	ErrIdentityExists = errors.New("a different identity already exists")
+)
+
+// backupDataFiles are the files of the storage Dir that are backed up (when present).
+var backupDataFiles = []string{PrivateIdentityFile, PublicIdentityFile, ValidatedPublicKeysFile}
+
+// backupKey derives the encryption key from the passphrase, keyID is the iterations (uint32)
+// followed by the salt.
+func backupKey(passphrase string, keyID []byte) ([]byte, error) {
+	if len(keyID) != 4+backupSaltSize {
+		return nil, ErrUnsupportedEnvelope
+	}
+	iterations := binary.BigEndian.Uint32(keyID)
+	if iterations == 0 || iterations > 100*BackupKDFIterations {
+		return nil, ErrUnsupportedEnvelope
+	}
+	return pbkdf2.Key(sha256.New, passphrase, keyID[4:], int(iterations), 32)
+}
+
+func addFile(tw *tar.Writer, name string, data []byte, mode os.FileMode) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name: name, Mode: int64(mode), Size: int64(len(data)), ModTime: time.Now(), Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	return err
+}
+
+// Backup returns the encrypted (with a key derived from passphrase) archive of the identity,
+// validated keys and plugins, as a text envelope (see Envelope) to restore with Restore.
+func (s *Storage) Backup(passphrase string) (string, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range backupDataFiles {
+		data, err := os.ReadFile(filepath.Join(s.Dir, name))
+		if errors.Is(err, os.ErrNotExist) && name != PrivateIdentityFile {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		mode := os.FileMode(0o644)
+		if name == PrivateIdentityFile {
+			mode = 0o600
+		}
+		if err = addFile(tw, path.Join(backupDataDir, name), data, mode); err != nil {
+			return "", err
+		}
+	}
+	plugins, err := os.ReadDir(s.Plugins())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	for _, p := range plugins {
+		if !p.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.Plugins(), p.Name()))
+		if err != nil {
+			return "", err
+		}
+		if err = addFile(tw, path.Join(backupConfigDir, PluginsDir, p.Name()), data, 0o644); err != nil {
+			return "", err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return "", err
+	}
+	keyID := binary.BigEndian.AppendUint32(nil, BackupKDFIterations)
+	keyID = append(keyID, make([]byte, backupSaltSize)...)
+	_, _ = rand.Read(keyID[4:]) // never returns an error.
+	key, err := backupKey(passphrase, keyID)
+	if err != nil {
+		return "", err
+	}
+	e, err := SealEnvelope(key, keyID, buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return e.String(), nil
+}
+
+// restoreTarget returns where an archive entry is restored, or an error for unexpected entries.
+func (s *Storage) restoreTarget(name string) (string, os.FileMode, error) {
+	dir, file := path.Split(name)
+	switch {
+	case dir == backupDataDir+"/" && (file == PrivateIdentityFile || file == PublicIdentityFile ||
+		file == ValidatedPublicKeysFile):
+		if file == PrivateIdentityFile {
+			return filepath.Join(s.Dir, file), 0o600, nil
+		}
+		return filepath.Join(s.Dir, file), 0o644, nil
+	case dir == backupConfigDir+"/"+PluginsDir+"/" && file != "" && file != "." && file != ".." &&
+		!strings.ContainsAny(file, `\:`):
+		return filepath.Join(s.Plugins(), file), 0o644, nil
+	default:
+		return "", 0, NewEncodingErr("unexpected backup entry " + name)
+	}
+}
+
+// Restore decrypts a Backup with passphrase and writes its files, returning their paths.
+// Nothing is written if the passphrase is wrong or the backup invalid, and it fails with
+// ErrIdentityExists rather than replace a different identity.
+func (s *Storage) Restore(backup, passphrase string) ([]string, error) {
+	e, err := ParseEnvelope(strings.TrimSpace(backup))
+	if err != nil {
+		return nil, err
+	}
+	if e.Kind != EnvelopeEncrypted {
+		return nil, ErrUnsupportedEnvelope
+	}
+	key, err := backupKey(passphrase, e.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := e.Open(key)
+	if errors.Is(err, ErrEnvelopeOpen) {
+		return nil, ErrBackupPassphrase
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	modes := make(map[string]os.FileMode)
+	var order []string
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		target, mode, err := s.restoreTarget(h.Name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxBackupFile+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxBackupFile {
+			return nil, NewEncodingErr("backup entry too large " + h.Name)
+		}
+		files[target], modes[target] = data, mode
+		order = append(order, target)
+	}
+	priv, pub := files[filepath.Join(s.Dir, PrivateIdentityFile)], files[filepath.Join(s.Dir, PublicIdentityFile)]
+	id, err := IdentityFromPrivateKey(strings.TrimSpace(string(priv)))
+	if err != nil || strings.TrimSpace(string(pub)) != id.PublicKeyToString() {
+		return nil, NewEncodingErr("backup identity is missing or invalid")
+	}
+	unlock, err := s.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if existing, err := s.LoadIdentity(); err == nil && existing.PublicKeyToString() != id.PublicKeyToString() {
+		return nil, fmt.Errorf("%w in %s (%s)", ErrIdentityExists, s.Dir, existing.HumanID())
+	}
+	for _, target := range order {
+		if err = os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return nil, err
+		}
+		if err = WriteFileAtomic(target, files[target], modes[target]); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,69 @@
+package tcrypto_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestBackupRestore(t *testing.T) {
+	src := &tcrypto.Storage{Dir: t.TempDir(), ConfigDir: t.TempDir()}
+	id := tcrypto.NewIdentityFromSeed([32]byte{9})
+	if err := src.SaveIdentity(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(src.Plugins(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	plugin := "on(\"file_received\", print)\n"
+	if err := os.WriteFile(filepath.Join(src.Plugins(), "log.star"), []byte(plugin), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := src.Backup("correct horse battery")
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if !strings.HasPrefix(backup, tcrypto.EnvelopePrefix) || strings.Contains(backup, id.PrivateKeyToString()) {
+		t.Errorf("Unexpected backup %q", backup)
+	}
+	dst := &tcrypto.Storage{Dir: t.TempDir(), ConfigDir: t.TempDir()}
+	if _, err = dst.Restore(backup, "wrong"); !errors.Is(err, tcrypto.ErrBackupPassphrase) {
+		t.Errorf("Wrong passphrase should be ErrBackupPassphrase, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dst.Dir); len(entries) != 0 {
+		t.Errorf("Files written despite the wrong passphrase: %v", entries)
+	}
+	files, err := dst.Restore(backup, "correct horse battery")
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if len(files) != 3 {
+		t.Errorf("Expected 3 restored files, got %v", files)
+	}
+	restored, err := dst.LoadIdentity()
+	if err != nil || restored.PublicKeyToString() != id.PublicKeyToString() {
+		t.Errorf("Identity not restored: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst.Plugins(), "log.star")); err != nil || string(got) != plugin {
+		t.Errorf("Plugin not restored: %q %v", got, err)
+	}
+	// Restoring again the same identity is fine, over a different one isn't.
+	if _, err = dst.Restore(backup, "correct horse battery"); err != nil {
+		t.Errorf("Restore over the same identity: %v", err)
+	}
+	other := &tcrypto.Storage{Dir: t.TempDir(), ConfigDir: t.TempDir()}
+	if err = other.SaveIdentity(tcrypto.NewIdentityFromSeed([32]byte{10})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.Restore(backup, "correct horse battery"); !errors.Is(err, tcrypto.ErrIdentityExists) {
+		t.Errorf("Restore over another identity should be ErrIdentityExists, got %v", err)
+	}
+	empty := &tcrypto.Storage{Dir: t.TempDir(), ConfigDir: t.TempDir()}
+	if _, err = empty.Backup("x"); err == nil {
+		t.Errorf("Backup without identity should fail")
+	}
+}
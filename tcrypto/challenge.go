@@ -0,0 +1,50 @@
+package tcrypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+)
+
+const (
+	// NoncePrefix is the prefix of encoded challenge nonces.
+	NoncePrefix = "n."
+	// NonceSize is the size of the random challenge nonces.
+	NonceSize = 32
+)
+
+// NewChallenge returns a new random (encoded) nonce, for a peer to prove it owns its identity
+// by signing it (see SignChallenge).
+func NewChallenge() string {
+	nonce := make([]byte, NonceSize)
+	_, _ = rand.Read(nonce) // never returns an error.
+	return EncodeBytes(NoncePrefix, nonce)
+}
+
+// challengeContent is what SignChallenge signs: the nonce bound to both peers' names, the capabilities
+// transcript (if any, with another context) and the key exchange offer, with a context string so the
+// signature can't be reused as any other signed message.
+func challengeContent(nonce, requester, responder, caps string, offer []byte) []byte {
+	if caps == "" {
+		return append([]byte("tsync challenge1\x00"+nonce+"\x00"+requester+"\x00"+responder+"\x00"), offer...)
+	}
+	return append([]byte("tsync challenge2\x00"+nonce+"\x00"+requester+"\x00"+responder+"\x00"+caps+"\x00"), offer...)
+}
+
+// SignChallenge returns the signature of the responder's nonce by the requester (us) of a connection,
+// along with our key exchange offer (nil if none) so it can't be swapped (see SignAccept for the reply)
+// and the transcript of the capabilities both sides advertised (empty with the peers which don't) so
+// they can't be stripped to downgrade the connection.
+func (id *Identity) SignChallenge(nonce, requester, responder, caps string, offer []byte) string {
+	return id.SignDetached(challengeContent(nonce, requester, responder, caps, offer))
+}
+
+// VerifyChallenge checks the requester's SignChallenge signature of our nonce, the capabilities
+// transcript and its offer.
+func VerifyChallenge(nonce, requester, responder, caps string, offer []byte, signature string,
+	pubKey ed25519.PublicKey,
+) error {
+	if _, err := DecodeBytes(NoncePrefix, nonce); err != nil {
+		return NewSignatureInvalidErr("invalid nonce: " + err.Error())
+	}
+	return VerifyDetached(challengeContent(nonce, requester, responder, caps, offer), signature, pubKey)
+}
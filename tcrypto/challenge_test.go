@@ -0,0 +1,57 @@
+package tcrypto_test
+
+import (
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestChallenge(t *testing.T) {
+	alice, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := tcrypto.NewChallenge()
+	offer := []byte("key exchange offer")
+	if nonce == tcrypto.NewChallenge() {
+		t.Errorf("Challenges should be random, got %q twice", nonce)
+	}
+	sig := alice.SignChallenge(nonce, "alice", "bob", "", offer)
+	if err = tcrypto.VerifyChallenge(nonce, "alice", "bob", "", offer, sig, alice.PublicKey); err != nil {
+		t.Errorf("Valid challenge response rejected: %v", err)
+	}
+	capsSig := alice.SignChallenge(nonce, "alice", "bob", "auth,quic/auth", offer)
+	if err = tcrypto.VerifyChallenge(nonce, "alice", "bob", "auth,quic/auth", offer, capsSig, alice.PublicKey); err != nil {
+		t.Errorf("Valid challenge response with capabilities rejected: %v", err)
+	}
+	tests := []struct {
+		name                        string
+		nonce, requester, responder string
+		caps                        string
+		offer                       []byte
+		sig                         string
+	}{
+		{"other nonce", tcrypto.NewChallenge(), "alice", "bob", "", offer, sig},
+		{"other requester", nonce, "mallory", "bob", "", offer, sig},
+		{"other responder", nonce, "alice", "carol", "", offer, sig},
+		{"swapped names", nonce, "bob", "alice", "", offer, sig},
+		{"other key", nonce, "alice", "bob", "", offer, mallory.SignChallenge(nonce, "alice", "bob", "", offer)},
+		{"data signature", nonce, "alice", "bob", "", offer, alice.SignDetached([]byte(nonce))},
+		{"other offer", nonce, "alice", "bob", "", []byte("other offer"), sig},
+		{"no offer", nonce, "alice", "bob", "", nil, sig},
+		{"bad nonce", "x" + nonce, "alice", "bob", "", offer, sig},
+		{"added caps", nonce, "alice", "bob", "auth", offer, sig},
+		{"stripped caps", nonce, "alice", "bob", "", offer, capsSig},
+		{"other caps", nonce, "alice", "bob", "auth/auth,quic", offer, capsSig},
+	}
+	for _, tt := range tests {
+		err := tcrypto.VerifyChallenge(tt.nonce, tt.requester, tt.responder, tt.caps, tt.offer, tt.sig, alice.PublicKey)
+		if err == nil {
+			t.Errorf("%s: challenge response should be rejected", tt.name)
+		}
+	}
+}
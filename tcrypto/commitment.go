@@ -0,0 +1,45 @@
+package tcrypto
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// CommitmentTime and CommitmentMemory (in KiB) are the argon2id costs of a Commitment: the
+	// commitment is short to fit the discovery messages, so it's memory-hard for finding another key
+	// with the same one (for a name and epoch) to be out of reach.
+	CommitmentTime   = 2
+	CommitmentMemory = 4 * 1024
+	// CommitmentSize is the size in bytes of a commitment (before its base64 encoding).
+	CommitmentSize = 9
+)
+
+// ErrCommitmentMismatch is returned by VerifyCommitment when the public key (or the name or epoch)
+// isn't the one committed to.
+var ErrCommitmentMismatch = errors.New("commitment mismatch")
+
+// commitmentSalt is the context of the commitments (fixed, so they can be recomputed by anyone).
+var commitmentSalt = []byte("tsync commitment1")
+
+// Commitment returns the short commitment binding the name, public key and epoch of a discovery
+// announcement, checked against the key a peer later proves in the connection handshake.
+func Commitment(name string, pubKey ed25519.PublicKey, epoch int32) string {
+	content := binary.BigEndian.AppendUint32([]byte(name+"\x00"), uint32(epoch)) //nolint:gosec // bits kept as is.
+	content = append(content, pubKey...)
+	sum := argon2.IDKey(content, commitmentSalt, CommitmentTime, CommitmentMemory, 1, CommitmentSize)
+	return base64.RawURLEncoding.EncodeToString(sum)
+}
+
+// VerifyCommitment checks the commitment against the name, public key and epoch.
+func VerifyCommitment(commitment, name string, pubKey ed25519.PublicKey, epoch int32) error {
+	if subtle.ConstantTimeCompare([]byte(commitment), []byte(Commitment(name, pubKey, epoch))) != 1 {
+		return ErrCommitmentMismatch
+	}
+	return nil
+}
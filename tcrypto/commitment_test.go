@@ -0,0 +1,46 @@
+package tcrypto_test
+
+import (
+	"errors"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestCommitment(t *testing.T) {
+	alice, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitment := tcrypto.Commitment("alice", alice.PublicKey, 3)
+	if commitment != tcrypto.Commitment("alice", alice.PublicKey, 3) {
+		t.Errorf("Commitment should be deterministic")
+	}
+	if len(commitment) != 12 {
+		t.Errorf("Unexpected commitment length %d for %q", len(commitment), commitment)
+	}
+	if err = tcrypto.VerifyCommitment(commitment, "alice", alice.PublicKey, 3); err != nil {
+		t.Errorf("Valid commitment rejected: %v", err)
+	}
+	tests := []struct {
+		name, commitment, peer string
+		identity               *tcrypto.Identity
+		epoch                  int32
+	}{
+		{"other key", commitment, "alice", mallory, 3},
+		{"other name", commitment, "alicf", alice, 3},
+		{"other epoch", commitment, "alice", alice, 4},
+		{"other commitment", tcrypto.Commitment("mallory", mallory.PublicKey, 3), "alice", alice, 3},
+		{"empty", "", "alice", alice, 3},
+	}
+	for _, tt := range tests {
+		err := tcrypto.VerifyCommitment(tt.commitment, tt.peer, tt.identity.PublicKey, tt.epoch)
+		if !errors.Is(err, tcrypto.ErrCommitmentMismatch) {
+			t.Errorf("%s: expected ErrCommitmentMismatch, got %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package tcrypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const (
+	// CookiePrefix is the prefix of encoded handshake cookies.
+	CookiePrefix = "c."
+	// CookieSize is the size of the (truncated) MAC in a cookie.
+	CookieSize = 16
+	// CookieRotation is how often the cookie secret changes, cookies stay valid for
+	// up to twice that (the previous secret is still accepted).
+	CookieRotation = 2 * time.Minute
+)
+
+// CookieJar makes and checks stateless handshake cookies (like WireGuard's): a MAC of the
+// requester's address keyed by a rotating secret, so a responder under load can check that
+// a requester receives what is sent to its claimed address without keeping any state for it.
+type CookieJar struct {
+	mu       sync.Mutex
+	secret   [32]byte
+	previous [32]byte
+	rotated  time.Time
+}
+
+// NewCookieJar returns a CookieJar with a new random secret.
+func NewCookieJar() *CookieJar {
+	j := &CookieJar{}
+	j.Rotate()
+	return j
+}
+
+// Rotate replaces the secret (the current one becomes the previous one), which
+// happens every CookieRotation anyway.
+func (j *CookieJar) Rotate() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.rotate()
+}
+
+func (j *CookieJar) rotate() {
+	j.previous = j.secret
+	_, _ = rand.Read(j.secret[:]) // never returns an error.
+	j.rotated = time.Now()
+}
+
+func cookieMAC(secret []byte, addr string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(addr))
+	return mac.Sum(nil)[:CookieSize]
+}
+
+// Cookie returns the current cookie for addr (e.g. the requester's ip:port).
+func (j *CookieJar) Cookie(addr string) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if time.Since(j.rotated) >= CookieRotation {
+		j.rotate()
+	}
+	return EncodeBytes(CookiePrefix, cookieMAC(j.secret[:], addr))
+}
+
+// Valid checks that cookie was made for addr with the current or previous secret.
+func (j *CookieJar) Valid(addr, cookie string) bool {
+	b, err := DecodeBytes(CookiePrefix, cookie)
+	if err != nil || len(b) != CookieSize {
+		return false
+	}
+	j.mu.Lock()
+	secret, previous := j.secret, j.previous
+	j.mu.Unlock()
+	return hmac.Equal(b, cookieMAC(secret[:], addr)) || hmac.Equal(b, cookieMAC(previous[:], addr))
+}
@@ -0,0 +1,44 @@
+package tcrypto_test
+
+import (
+	"strings"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestCookieJar(t *testing.T) {
+	jar := tcrypto.NewCookieJar()
+	cookie := jar.Cookie("192.168.1.2:4567")
+	if !strings.HasPrefix(cookie, tcrypto.CookiePrefix) {
+		t.Errorf("Unexpected cookie %q", cookie)
+	}
+	if again := jar.Cookie("192.168.1.2:4567"); again != cookie {
+		t.Errorf("Cookie should be stable before rotation: %q vs %q", again, cookie)
+	}
+	if !jar.Valid("192.168.1.2:4567", cookie) {
+		t.Errorf("Cookie should be valid for its address")
+	}
+	if jar.Valid("192.168.1.2:4568", cookie) {
+		t.Errorf("Cookie should not be valid for another address")
+	}
+	for _, bad := range []string{"", "c.", "c.AAAA", cookie[:len(cookie)-2], "x" + cookie[1:]} {
+		if jar.Valid("192.168.1.2:4567", bad) {
+			t.Errorf("Invalid cookie %q accepted", bad)
+		}
+	}
+	if tcrypto.NewCookieJar().Valid("192.168.1.2:4567", cookie) {
+		t.Errorf("Cookie should not be valid for another jar")
+	}
+	jar.Rotate()
+	if !jar.Valid("192.168.1.2:4567", cookie) {
+		t.Errorf("Cookie should still be valid after one rotation")
+	}
+	if jar.Cookie("192.168.1.2:4567") == cookie {
+		t.Errorf("Cookie should change after rotation")
+	}
+	jar.Rotate()
+	if jar.Valid("192.168.1.2:4567", cookie) {
+		t.Errorf("Cookie should be invalid after two rotations")
+	}
+}
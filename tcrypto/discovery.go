@@ -0,0 +1,20 @@
+package tcrypto
+
+import "crypto/ed25519"
+
+// discoveryContent is what SignDiscovery signs: the discovery message (up to its signature) with a
+// context string so the signature can't be reused as any other signed message.
+func discoveryContent(payload string) []byte {
+	return []byte("tsync discovery1\x00" + payload)
+}
+
+// SignDiscovery returns our signature of a discovery message's payload, proving the announced
+// public key is ours.
+func (id *Identity) SignDiscovery(payload string) string {
+	return id.SignDetached(discoveryContent(payload))
+}
+
+// VerifyDiscovery checks the SignDiscovery signature of the payload by the announced public key.
+func VerifyDiscovery(payload, signature string, pubKey ed25519.PublicKey) error {
+	return VerifyDetached(discoveryContent(payload), signature, pubKey)
+}
@@ -0,0 +1,36 @@
+package tcrypto_test
+
+import (
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestDiscoverySignature(t *testing.T) {
+	alice, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := `tsync1 "alice" key e 3`
+	sig := alice.SignDiscovery(payload)
+	if err = tcrypto.VerifyDiscovery(payload, sig, alice.PublicKey); err != nil {
+		t.Errorf("Valid discovery signature rejected: %v", err)
+	}
+	tests := []struct {
+		name, payload, sig string
+	}{
+		{"other payload", `tsync1 "alice" key e 4`, sig},
+		{"other key", payload, mallory.SignDiscovery(payload)},
+		{"data signature", payload, alice.SignDetached([]byte(payload))},
+		{"bad signature", payload, "x" + sig},
+	}
+	for _, tt := range tests {
+		if err := tcrypto.VerifyDiscovery(tt.payload, tt.sig, alice.PublicKey); err == nil {
+			t.Errorf("%s: discovery signature should be rejected", tt.name)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package tcrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// EnvelopePrefix is the prefix of encoded (String) envelopes.
+const EnvelopePrefix = "e."
+
+// EnvelopeVersion is the current envelope format version.
+const EnvelopeVersion = 1
+
+// KeyIDSize is the size of the KeyID of public keys.
+const KeyIDSize = 8
+
+// EnvelopeKind says what an envelope holds. The numeric values are used in the encoding and must not change.
+type EnvelopeKind uint8
+
+const (
+	// EnvelopeSigned is a plaintext payload with a signature.
+	EnvelopeSigned EnvelopeKind = 1
+	// EnvelopeEncrypted is an encrypted (and authenticated) payload.
+	EnvelopeEncrypted EnvelopeKind = 2
+)
+
+// Algorithm identifies the algorithm used for an envelope. The numeric values are used in the
+// encoding and must not change: new algorithms (e.g. post quantum) get new values.
+type Algorithm uint8
+
+const (
+	// AlgEd25519 signs with the identity's Ed25519 key (EnvelopeSigned).
+	AlgEd25519 Algorithm = 1
+	// AlgAES256GCM encrypts with a 32 bytes symmetric key (EnvelopeEncrypted).
+	AlgAES256GCM Algorithm = 2
+)
+
+var (
+	// ErrUnsupportedEnvelope is returned for envelopes of unknown version, kind or algorithm.
+	ErrUnsupportedEnvelope = errors.New("unsupported envelope")
+	// ErrEnvelopeKey is returned when the envelope's KeyID doesn't match the key (or the key is invalid).
+	ErrEnvelopeKey = errors.New("envelope key mismatch")
+	// ErrEnvelopeOpen is returned when decryption fails (wrong key or tampered envelope).
+	ErrEnvelopeOpen = errors.New("envelope decryption failed")
+)
+
+// Envelope is a self describing signed or encrypted blob: the version, kind, algorithm and key
+// identifier are encoded with (and authenticated with) the payload, so formats can evolve without
+// guessing from prefixes.
+type Envelope struct {
+	Version   uint8
+	Kind      EnvelopeKind
+	Algorithm Algorithm
+	// KeyID identifies the key: KeyID of the public key for signatures, chosen by the caller
+	// (e.g. a key derivation salt) for symmetric keys.
+	KeyID []byte
+	// Nonce for encryption, empty for signatures.
+	Nonce []byte
+	// Payload is the message for signatures, the ciphertext (with the tag) for encryption.
+	Payload []byte
+	// Signature for signatures, empty for encryption.
+	Signature []byte
+}
+
+// KeyID returns the short identifier of a public key used in envelopes.
+func KeyID(pubKey []byte) []byte {
+	h := sha256.Sum256(pubKey)
+	return h[:KeyIDSize]
+}
+
+// header is the authenticated part before the payload.
+func (e *Envelope) header() []byte {
+	b := []byte{e.Version, byte(e.Kind), byte(e.Algorithm)}
+	b = binary.AppendUvarint(b, uint64(len(e.KeyID)))
+	b = append(b, e.KeyID...)
+	b = binary.AppendUvarint(b, uint64(len(e.Nonce)))
+	return append(b, e.Nonce...)
+}
+
+// signedContent is what the signature covers: the header and the payload.
+func (e *Envelope) signedContent() []byte {
+	return append(e.header(), e.Payload...)
+}
+
+// SignEnvelope returns the envelope with payload signed by the identity.
+func (id *Identity) SignEnvelope(payload []byte) *Envelope {
+	e := &Envelope{
+		Version:   EnvelopeVersion,
+		Kind:      EnvelopeSigned,
+		Algorithm: AlgEd25519,
+		KeyID:     KeyID(id.PublicKey),
+		Payload:   slices.Clone(payload),
+	}
+	e.Signature = ed25519.Sign(id.PrivateKey, e.signedContent())
+	return e
+}
+
+// Verify checks a signed envelope against pubKey and returns its payload.
+func (e *Envelope) Verify(pubKey ed25519.PublicKey) ([]byte, error) {
+	if e.Version != EnvelopeVersion || e.Kind != EnvelopeSigned || e.Algorithm != AlgEd25519 {
+		return nil, fmt.Errorf("%w: version %d kind %d algorithm %d for signature",
+			ErrUnsupportedEnvelope, e.Version, e.Kind, e.Algorithm)
+	}
+	if len(pubKey) != ed25519.PublicKeySize || !slices.Equal(e.KeyID, KeyID(pubKey)) {
+		return nil, ErrEnvelopeKey
+	}
+	if !ed25519.Verify(pubKey, e.signedContent(), e.Signature) {
+		return nil, NewSignatureInvalidErr("envelope signature verification failed")
+	}
+	return e.Payload, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%w: need a 32 bytes key, got %d", ErrEnvelopeKey, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealEnvelope returns the envelope with plaintext encrypted using the 32 bytes key, identified by keyID.
+func SealEnvelope(key, keyID, plaintext []byte) (*Envelope, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	e := &Envelope{
+		Version:   EnvelopeVersion,
+		Kind:      EnvelopeEncrypted,
+		Algorithm: AlgAES256GCM,
+		KeyID:     slices.Clone(keyID),
+		Nonce:     make([]byte, aead.NonceSize()),
+	}
+	_, _ = rand.Read(e.Nonce) // never returns an error.
+	e.Payload = aead.Seal(nil, e.Nonce, plaintext, e.header())
+	return e, nil
+}
+
+// Open decrypts an encrypted envelope with key (the one for its KeyID).
+func (e *Envelope) Open(key []byte) ([]byte, error) {
+	if e.Version != EnvelopeVersion || e.Kind != EnvelopeEncrypted || e.Algorithm != AlgAES256GCM {
+		return nil, fmt.Errorf("%w: version %d kind %d algorithm %d for encryption",
+			ErrUnsupportedEnvelope, e.Version, e.Kind, e.Algorithm)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, ErrEnvelopeOpen
+	}
+	plaintext, err := aead.Open(nil, e.Nonce, e.Payload, e.header())
+	if err != nil {
+		return nil, ErrEnvelopeOpen
+	}
+	return plaintext, nil
+}
+
+// Marshal returns the binary encoding of the envelope.
+func (e *Envelope) Marshal() []byte {
+	b := e.header()
+	b = binary.AppendUvarint(b, uint64(len(e.Payload)))
+	b = append(b, e.Payload...)
+	b = binary.AppendUvarint(b, uint64(len(e.Signature)))
+	return append(b, e.Signature...)
+}
+
+// String returns the text encoding of the envelope (EnvelopePrefix and base64).
+func (e *Envelope) String() string {
+	return EncodeBytes(EnvelopePrefix, e.Marshal())
+}
+
+// UnmarshalEnvelope decodes a Marshal encoded envelope. Unknown versions are rejected
+// (ErrUnsupportedEnvelope), unknown kinds and algorithms are only rejected by Verify and Open.
+func UnmarshalEnvelope(b []byte) (*Envelope, error) {
+	if len(b) < 3 {
+		return nil, NewEncodingErr("envelope too short")
+	}
+	e := &Envelope{Version: b[0], Kind: EnvelopeKind(b[1]), Algorithm: Algorithm(b[2])}
+	if e.Version != EnvelopeVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupportedEnvelope, e.Version)
+	}
+	b = b[3:]
+	for _, field := range []*[]byte{&e.KeyID, &e.Nonce, &e.Payload, &e.Signature} {
+		n, l := binary.Uvarint(b)
+		if l <= 0 || n > uint64(len(b)-l) {
+			return nil, NewEncodingErr("truncated envelope")
+		}
+		*field = b[l : l+int(n)]
+		b = b[l+int(n):]
+	}
+	if len(b) != 0 {
+		return nil, NewEncodingErr("trailing data after envelope")
+	}
+	return e, nil
+}
+
+// ParseEnvelope decodes a String encoded envelope.
+func ParseEnvelope(s string) (*Envelope, error) {
+	b, err := DecodeBytes(EnvelopePrefix, s)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalEnvelope(b)
+}
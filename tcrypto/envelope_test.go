@@ -0,0 +1,102 @@
+package tcrypto_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestSignedEnvelope(t *testing.T) {
+	alice := tcrypto.NewIdentityFromSeed([32]byte{1})
+	bob := tcrypto.NewIdentityFromSeed([32]byte{2})
+	msg := []byte("hello envelope")
+	e := alice.SignEnvelope(msg)
+	s := e.String()
+	t.Logf("Signed envelope: %s", s)
+	parsed, err := tcrypto.ParseEnvelope(s)
+	if err != nil {
+		t.Fatalf("ParseEnvelope: %v", err)
+	}
+	if parsed.Kind != tcrypto.EnvelopeSigned || parsed.Algorithm != tcrypto.AlgEd25519 {
+		t.Errorf("Unexpected kind/algorithm %d/%d", parsed.Kind, parsed.Algorithm)
+	}
+	AssertBytesEqual(t, "KeyID", parsed.KeyID, tcrypto.KeyID(alice.PublicKey))
+	got, err := parsed.Verify(alice.PublicKey)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	AssertBytesEqual(t, "Payload", got, msg)
+	if _, err = parsed.Verify(bob.PublicKey); !errors.Is(err, tcrypto.ErrEnvelopeKey) {
+		t.Errorf("Verify with another key should be ErrEnvelopeKey, got %v", err)
+	}
+	parsed.Payload[0] ^= 1
+	var sigErr *tcrypto.SignatureInvalidError
+	if _, err = parsed.Verify(alice.PublicKey); !errors.As(err, &sigErr) {
+		t.Errorf("Verify of altered payload should fail, got %v", err)
+	}
+	parsed.Payload[0] ^= 1
+	// Algorithms are only accepted for their kind.
+	parsed.Algorithm = tcrypto.AlgAES256GCM
+	if _, err = parsed.Verify(alice.PublicKey); !errors.Is(err, tcrypto.ErrUnsupportedEnvelope) {
+		t.Errorf("Verify with wrong algorithm should be ErrUnsupportedEnvelope, got %v", err)
+	}
+	if _, err = parsed.Open(make([]byte, 32)); !errors.Is(err, tcrypto.ErrUnsupportedEnvelope) {
+		t.Errorf("Open of a signed envelope should be ErrUnsupportedEnvelope, got %v", err)
+	}
+}
+
+func TestEncryptedEnvelope(t *testing.T) {
+	key := bytes.Repeat([]byte{42}, 32)
+	msg := []byte("secret stuff")
+	e, err := tcrypto.SealEnvelope(key, []byte("salt1234"), msg)
+	if err != nil {
+		t.Fatalf("SealEnvelope: %v", err)
+	}
+	if bytes.Contains(e.Marshal(), msg) {
+		t.Errorf("Plaintext found in encrypted envelope")
+	}
+	parsed, err := tcrypto.UnmarshalEnvelope(e.Marshal())
+	if err != nil {
+		t.Fatalf("UnmarshalEnvelope: %v", err)
+	}
+	AssertBytesEqual(t, "KeyID", parsed.KeyID, []byte("salt1234"))
+	got, err := parsed.Open(key)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	AssertBytesEqual(t, "Plaintext", got, msg)
+	if _, err = parsed.Open(bytes.Repeat([]byte{43}, 32)); !errors.Is(err, tcrypto.ErrEnvelopeOpen) {
+		t.Errorf("Open with wrong key should be ErrEnvelopeOpen, got %v", err)
+	}
+	if _, err = parsed.Open(key[:16]); !errors.Is(err, tcrypto.ErrEnvelopeKey) {
+		t.Errorf("Open with short key should be ErrEnvelopeKey, got %v", err)
+	}
+	parsed.KeyID = []byte("salt1235") // the header is authenticated.
+	if _, err = parsed.Open(key); !errors.Is(err, tcrypto.ErrEnvelopeOpen) {
+		t.Errorf("Open with altered key id should be ErrEnvelopeOpen, got %v", err)
+	}
+	if _, err = tcrypto.SealEnvelope(key[:31], nil, msg); !errors.Is(err, tcrypto.ErrEnvelopeKey) {
+		t.Errorf("SealEnvelope with short key should be ErrEnvelopeKey, got %v", err)
+	}
+}
+
+func TestEnvelopeDecoding(t *testing.T) {
+	b := tcrypto.NewIdentityFromSeed([32]byte{1}).SignEnvelope([]byte("x")).Marshal()
+	for i := range len(b) {
+		if _, err := tcrypto.UnmarshalEnvelope(b[:i]); err == nil {
+			t.Errorf("Truncated envelope (%d/%d bytes) accepted", i, len(b))
+		}
+	}
+	if _, err := tcrypto.UnmarshalEnvelope(append(b, 0)); err == nil {
+		t.Errorf("Envelope with trailing data accepted")
+	}
+	b[0] = 2
+	if _, err := tcrypto.UnmarshalEnvelope(b); !errors.Is(err, tcrypto.ErrUnsupportedEnvelope) {
+		t.Errorf("Future version should be ErrUnsupportedEnvelope, got %v", err)
+	}
+	if _, err := tcrypto.ParseEnvelope("s.abc"); err == nil {
+		t.Errorf("Wrong prefix accepted")
+	}
+}
@@ -2,7 +2,8 @@ package tcrypto
 
 import (
 	"os"
-	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
 )
 
@@ -11,6 +12,24 @@ const (
 	PrivateIdentityFile     = "id"
 	PublicIdentityFile      = "id.pub"
 	ValidatedPublicKeysFile = "checked.pub"
+	InboxDir                = "inbox"
+	PluginsDir              = "plugins"
+	ControlSocketFile       = "control.sock"
+	LockFile                = "lock"
+	AuditLogFile            = "audit.log"
+	KeysFile                = "keys.json"
+	LayoutFile              = "layout.json"
+	SnapshotsDir            = "snapshots"
+	SchedulesFile           = "schedules.json"
+	ScheduleStateFile       = "schedules.state.json"
+)
+
+const (
+	// HomeEnv is the environment variable overriding the storage directory (e.g. to run several
+	// instances, or set with the -home flag).
+	HomeEnv = "TSYNC_HOME"
+	// AppDir is our directory name in the XDG base directories.
+	AppDir = "tsync"
 )
 
 func createDirectory(dir string) error {
@@ -20,42 +39,162 @@ func createDirectory(dir string) error {
 		// Exists, nothing to do
 		return nil
 	}
-	return os.Mkdir(dir, 0o755) // public readable as only PrivateIdentityFile is sensitive
+	return os.MkdirAll(dir, 0o755) // public readable as only PrivateIdentityFile is sensitive
 }
 
 type Storage struct {
-	Dir string // Full path to the .tsync directory
+	Dir string // Full path to the storage (data) directory, ~/.tsync by default (see StorageDirs)
+	// Full path to the configuration directory (plugins), same as Dir except with XDG.
+	ConfigDir string
+	// Legacy ~/.tsync directory moved to the XDG directories by InitStorage, if any.
+	Migrated string
 }
 
-func InitStorage() (s *Storage, err error) {
-	// Creates the ~/.tsync directory and files if they don't exist yet.
+// StorageDirs returns the data and config directories: $TSYNC_HOME for both when set, otherwise
+// on Linux (XDG base directories) $XDG_DATA_HOME/tsync (default ~/.local/share/tsync) and
+// $XDG_CONFIG_HOME/tsync (default ~/.config/tsync), elsewhere ~/.tsync for both.
+func StorageDirs() (data, config string, err error) {
+	if home := os.Getenv(HomeEnv); home != "" {
+		return home, home, nil
+	}
 	hdir, err := os.UserHomeDir()
 	if err != nil {
-		return nil, err
+		return "", "", err
+	}
+	if runtime.GOOS != "linux" {
+		dir := filepath.Join(hdir, TsyncDir)
+		return dir, dir, nil
+	}
+	data = os.Getenv("XDG_DATA_HOME")
+	if !filepath.IsAbs(data) { // relative paths are invalid per the spec.
+		data = filepath.Join(hdir, ".local", "share")
+	}
+	config = os.Getenv("XDG_CONFIG_HOME")
+	if !filepath.IsAbs(config) {
+		config = filepath.Join(hdir, ".config")
+	}
+	return filepath.Join(data, AppDir), filepath.Join(config, AppDir), nil
+}
+
+// migrate moves the legacy ~/.tsync to s.Dir (and its plugins to s.ConfigDir) if s.Dir doesn't
+// exist yet. If it can't be moved (e.g. different filesystems) the legacy directory keeps being used.
+func (s *Storage) migrate() error {
+	hdir, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	legacy := filepath.Join(hdir, TsyncDir)
+	if legacy == s.Dir {
+		return nil
+	}
+	if st, err := os.Stat(legacy); err != nil || !st.IsDir() {
+		return nil //nolint:nilerr // nothing to migrate.
 	}
+	if _, err = os.Stat(s.Dir); err == nil {
+		return nil // already migrated (or created), the legacy directory is left alone.
+	}
+	if err = os.MkdirAll(filepath.Dir(s.Dir), 0o755); err == nil {
+		err = os.Rename(legacy, s.Dir)
+	}
+	if err != nil {
+		if _, serr := os.Stat(s.Dir); serr == nil {
+			return nil // moved by a concurrent first run.
+		}
+		s.Dir, s.ConfigDir = legacy, legacy
+		return nil //nolint:nilerr // can't be moved, keep using it where it is.
+	}
+	s.Migrated = legacy
+	plugins := filepath.Join(s.Dir, PluginsDir)
+	if _, err = os.Stat(plugins); err != nil || s.ConfigDir == s.Dir {
+		return nil //nolint:nilerr // no plugins to move.
+	}
+	if err = createDirectory(s.ConfigDir); err != nil {
+		return err
+	}
+	if _, err = os.Stat(s.Plugins()); err == nil {
+		return nil // don't overwrite existing config.
+	}
+	return os.Rename(plugins, s.Plugins())
+}
+
+// InitStorage creates the storage directories (see StorageDirs) if they don't exist yet,
+// migrating the legacy ~/.tsync directory to the XDG ones.
+func InitStorage() (s *Storage, err error) {
 	s = &Storage{}
-	s.Dir = path.Join(hdir, TsyncDir)
+	s.Dir, s.ConfigDir, err = StorageDirs()
+	if err != nil {
+		return nil, err
+	}
+	if os.Getenv(HomeEnv) == "" {
+		if err = s.migrate(); err != nil {
+			return s, err
+		}
+	}
 	err = createDirectory(s.Dir)
 	if err != nil {
 		return s, err
 	}
-	return s, nil
+	return s, createDirectory(s.ConfigDir)
+}
+
+// WriteFileAtomic writes data to a temporary file in the same directory and renames it to name,
+// so readers (and crashes) never see a partially written file.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// Lock takes the (advisory, exclusive) lock of the storage directory, waiting for other tsync
+// instances to release it, so read-modify-write sequences of its files don't interleave.
+// The returned function releases it.
+func (s *Storage) Lock() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(s.Dir, LockFile), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil // closing releases the lock.
 }
 
+// SaveIdentity (atomically) writes the identity files. Callers creating an identity when none
+// could be loaded should hold the Lock around both.
 func (s *Storage) SaveIdentity(id *Identity) error {
-	filePath := path.Join(s.Dir, PrivateIdentityFile)
+	filePath := filepath.Join(s.Dir, PrivateIdentityFile)
 	b := []byte(id.PrivateKeyToString() + "\n")
-	err := os.WriteFile(filePath, b, 0o600) // private key only readable by user
+	err := WriteFileAtomic(filePath, b, 0o600) // private key only readable by user
 	if err != nil {
 		return err
 	}
 	b = []byte(id.PublicKeyToString() + "\n")
-	filePath = path.Join(s.Dir, PublicIdentityFile)
-	return os.WriteFile(filePath, b, 0o644) //nolint:gosec // public key readable by all
+	filePath = filepath.Join(s.Dir, PublicIdentityFile)
+	return WriteFileAtomic(filePath, b, 0o644) // public key readable by all
 }
 
 func (s *Storage) LoadIdentity() (*Identity, error) {
-	filePath := path.Join(s.Dir, PrivateIdentityFile)
+	filePath := filepath.Join(s.Dir, PrivateIdentityFile)
 	privKeyBytes, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, err
@@ -67,7 +206,7 @@ func (s *Storage) LoadIdentity() (*Identity, error) {
 		return nil, err
 	}
 	// check public key file too
-	pubFilePath := path.Join(s.Dir, PublicIdentityFile)
+	pubFilePath := filepath.Join(s.Dir, PublicIdentityFile)
 	pubKeyBytes, err := os.ReadFile(pubFilePath)
 	if err != nil {
 		return nil, err
@@ -78,3 +217,49 @@ func (s *Storage) LoadIdentity() (*Identity, error) {
 	}
 	return id, nil
 }
+
+// Inbox returns the path of the inbox directory, where files dropped by peers are stored.
+func (s *Storage) Inbox() string {
+	return filepath.Join(s.Dir, InboxDir)
+}
+
+// Plugins returns the path of the plugins directory (see package tplugin).
+func (s *Storage) Plugins() string {
+	return filepath.Join(s.ConfigDir, PluginsDir)
+}
+
+// ControlSocket returns the path of the unix socket of the control API (see package tapi).
+func (s *Storage) ControlSocket() string {
+	return filepath.Join(s.Dir, ControlSocketFile)
+}
+
+// AuditLog returns the path of the log of failed connection and trust attempts.
+func (s *Storage) AuditLog() string {
+	return filepath.Join(s.Dir, AuditLogFile)
+}
+
+// Keys returns the path of the terminal UI key bindings configuration.
+func (s *Storage) Keys() string {
+	return filepath.Join(s.ConfigDir, KeysFile)
+}
+
+// Layout returns the path of the terminal UI's saved table layouts (column order and widths).
+func (s *Storage) Layout() string {
+	return filepath.Join(s.ConfigDir, LayoutFile)
+}
+
+// Snapshots returns the path of the directory where, as a backup target, the peers' encrypted
+// snapshots are kept (see txfer.SnapshotStore).
+func (s *Storage) Snapshots() string {
+	return filepath.Join(s.Dir, SnapshotsDir)
+}
+
+// Schedules returns the path of the scheduled sync jobs configuration (see package tsched).
+func (s *Storage) Schedules() string {
+	return filepath.Join(s.ConfigDir, SchedulesFile)
+}
+
+// ScheduleState returns the path of the scheduled jobs' last runs and results.
+func (s *Storage) ScheduleState() string {
+	return filepath.Join(s.Dir, ScheduleStateFile)
+}
@@ -0,0 +1,140 @@
+package tcrypto_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "f")
+	for _, content := range []string{"first version\n", "second\n"} {
+		if err := tcrypto.WriteFileAtomic(name, []byte(content), 0o600); err != nil {
+			t.Fatalf("WriteFileAtomic: %v", err)
+		}
+		got, err := os.ReadFile(name)
+		if err != nil || string(got) != content {
+			t.Errorf("Read back %q %v, expected %q", got, err, content)
+		}
+	}
+	if st, err := os.Stat(name); err != nil || (runtime.GOOS != "windows" && st.Mode().Perm() != 0o600) {
+		t.Errorf("Unexpected mode %v %v", st.Mode(), err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Temporary files left behind: %v", entries)
+	}
+	if err := tcrypto.WriteFileAtomic(filepath.Join(dir, "nope", "f"), nil, 0o600); err == nil {
+		t.Errorf("Expected error writing in a missing directory")
+	}
+}
+
+func TestStorageLock(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "freebsd" && runtime.GOOS != "windows" {
+		t.Skip("No locking on", runtime.GOOS)
+	}
+	s := &tcrypto.Storage{Dir: t.TempDir()}
+	unlock, err := s.Lock()
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock2, err := s.Lock()
+		if err != nil {
+			t.Errorf("Second Lock: %v", err)
+		} else {
+			unlock2()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("Second Lock didn't wait for the first one")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Second Lock not obtained after unlock")
+	}
+}
+
+func TestStorageDirs(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home) // windows.
+	t.Setenv("XDG_DATA_HOME", "")
+	t.Setenv("XDG_CONFIG_HOME", "relative/is/ignored")
+	t.Setenv(tcrypto.HomeEnv, "")
+	data, config, err := tcrypto.StorageDirs()
+	if err != nil {
+		t.Fatalf("StorageDirs: %v", err)
+	}
+	wantData, wantConfig := filepath.Join(home, ".tsync"), filepath.Join(home, ".tsync")
+	if runtime.GOOS == "linux" {
+		wantData, wantConfig = filepath.Join(home, ".local", "share", "tsync"), filepath.Join(home, ".config", "tsync")
+	}
+	if data != wantData || config != wantConfig {
+		t.Errorf("Default dirs %q %q, expected %q %q", data, config, wantData, wantConfig)
+	}
+	if runtime.GOOS == "linux" {
+		t.Setenv("XDG_DATA_HOME", "/xdg/data")
+		t.Setenv("XDG_CONFIG_HOME", "/xdg/config")
+		if data, config, _ = tcrypto.StorageDirs(); data != "/xdg/data/tsync" || config != "/xdg/config/tsync" {
+			t.Errorf("XDG dirs %q %q", data, config)
+		}
+	}
+	t.Setenv(tcrypto.HomeEnv, "/custom")
+	if data, config, _ = tcrypto.StorageDirs(); data != "/custom" || config != "/custom" {
+		t.Errorf("TSYNC_HOME dirs %q %q", data, config)
+	}
+}
+
+func TestStorageMigration(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Only migrating to XDG directories on linux")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_DATA_HOME", "")
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv(tcrypto.HomeEnv, "")
+	legacy := filepath.Join(home, ".tsync")
+	if err := os.MkdirAll(filepath.Join(legacy, "plugins"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	id := tcrypto.NewIdentityFromSeed([32]byte{7})
+	if err := (&tcrypto.Storage{Dir: legacy}).SaveIdentity(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(legacy, "plugins", "p.star"), []byte("# plugin\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := tcrypto.InitStorage()
+	if err != nil {
+		t.Fatalf("InitStorage: %v", err)
+	}
+	if s.Migrated != legacy || s.Dir != filepath.Join(home, ".local", "share", "tsync") {
+		t.Errorf("Unexpected migration %+v", s)
+	}
+	if loaded, err := s.LoadIdentity(); err != nil || loaded.PublicKeyToString() != id.PublicKeyToString() {
+		t.Errorf("Identity not migrated: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(s.Plugins(), "p.star")); err != nil {
+		t.Errorf("Plugins not migrated to the config dir: %v", err)
+	}
+	if _, err = os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("Legacy directory still there: %v", err)
+	}
+	// Second time: nothing to do.
+	if s, err = tcrypto.InitStorage(); err != nil || s.Migrated != "" {
+		t.Errorf("Second InitStorage: %+v %v", s, err)
+	}
+}
@@ -0,0 +1,143 @@
+package tcrypto
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+)
+
+// HashAlgo identifies a hash algorithm. Fast non cryptographic ones are meant for chunk
+// checks over already authenticated channels and cryptographic ones for final verification.
+// The numeric values are used on the wire and must not change.
+type HashAlgo uint8
+
+const (
+	// NoHash means no hash is used/negotiated.
+	NoHash HashAlgo = iota
+	// SHA256 is the default for final verification of transferred content.
+	SHA256
+	// SHA512_256 is faster than SHA256 on 64 bits cpus without SHA extensions.
+	SHA512_256 //nolint:revive // same name as the crypto package.
+	// CRC32C (Castagnoli) is hardware accelerated on most cpus, for fast chunk checks only.
+	CRC32C
+	// BLAKE3 is cryptographic and several times faster than SHA256 (SIMD, no SHA extensions needed).
+	BLAKE3
+	// XXH3 (64 bits) is the fastest, for chunk checks only.
+	XXH3
+)
+
+// ErrNoCommonHash is returned by NegotiateHash when there is no hash supported by both sides.
+var ErrNoCommonHash = errors.New("no common hash algorithm")
+
+var (
+	hashNames     = []string{"none", "sha256", "sha512_256", "crc32c", "blake3", "xxh3"}
+	castagnoliTbl = crc32.MakeTable(crc32.Castagnoli)
+	// DefaultHashes are the hashes we support, in order of preference for final verification.
+	DefaultHashes = []HashAlgo{SHA256, BLAKE3, SHA512_256}
+	// DefaultChunkHashes are the hashes we support, in order of preference for chunk checks.
+	DefaultChunkHashes = []HashAlgo{XXH3, CRC32C, BLAKE3, SHA512_256, SHA256}
+)
+
+func (a HashAlgo) String() string {
+	if int(a) < len(hashNames) {
+		return hashNames[a]
+	}
+	return "unknown"
+}
+
+// Valid returns true for known algorithms (excluding NoHash).
+func (a HashAlgo) Valid() bool {
+	return a > NoHash && int(a) < len(hashNames)
+}
+
+// Cryptographic returns true if the algorithm is collision resistant.
+func (a HashAlgo) Cryptographic() bool {
+	return a == SHA256 || a == SHA512_256 || a == BLAKE3
+}
+
+// New returns a new hash.Hash for the algorithm (nil for NoHash or unknown ones).
+func (a HashAlgo) New() hash.Hash {
+	switch a {
+	case SHA256:
+		return sha256.New()
+	case SHA512_256:
+		return sha512.New512_256()
+	case CRC32C:
+		return crc32.New(castagnoliTbl)
+	case BLAKE3:
+		return blake3.New()
+	case XXH3:
+		return xxh3.New()
+	default:
+		return nil
+	}
+}
+
+// Sum returns the hash of data using the algorithm.
+func (a HashAlgo) Sum(data []byte) []byte {
+	h := a.New()
+	if h == nil {
+		return nil
+	}
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// SumReader returns the hash of everything read from r using the algorithm.
+func (a HashAlgo) SumReader(r io.Reader) ([]byte, error) {
+	h := a.New()
+	if h == nil {
+		return nil, errors.New("invalid hash algorithm " + a.String())
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// ParseHashAlgo returns the algorithm from its name.
+func ParseHashAlgo(name string) (HashAlgo, error) {
+	idx := slices.Index(hashNames, strings.ToLower(name))
+	if idx <= 0 {
+		return NoHash, NewEncodingErr("unknown hash algorithm " + name)
+	}
+	return HashAlgo(idx), nil //nolint:gosec // small index.
+}
+
+// FormatHashes returns the comma separated list of algorithm names, used to advertise capabilities.
+func FormatHashes(algos []HashAlgo) string {
+	names := make([]string, len(algos))
+	for i, a := range algos {
+		names[i] = a.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseHashes parses a FormatHashes list, ignoring algorithms we don't know (so peers can add new ones).
+func ParseHashes(list string) []HashAlgo {
+	var algos []HashAlgo
+	for name := range strings.SplitSeq(list, ",") {
+		if a, err := ParseHashAlgo(strings.TrimSpace(name)); err == nil {
+			algos = append(algos, a)
+		}
+	}
+	return algos
+}
+
+// NegotiateHash returns the first of our algorithms (in our order of preference) that the peer also supports.
+func NegotiateHash(ours, theirs []HashAlgo) (HashAlgo, error) {
+	for _, a := range ours {
+		if slices.Contains(theirs, a) {
+			return a, nil
+		}
+	}
+	return NoHash, ErrNoCommonHash
+}
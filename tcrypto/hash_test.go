@@ -0,0 +1,70 @@
+package tcrypto_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestHashAlgos(t *testing.T) {
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	for _, tc := range []struct {
+		algo     tcrypto.HashAlgo
+		expected string
+	}{
+		{tcrypto.SHA256, "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592"},
+		{tcrypto.SHA512_256, "dd9d67b371519c339ed8dbd25af90e976a1eeefd4ad3d889005e532fc5bef04d"},
+		{tcrypto.CRC32C, "22620404"},
+		{tcrypto.BLAKE3, "2f1514181aadccd913abd94cfa592701a5686ab23f8df1dff1b74710febc6d4a"},
+		{tcrypto.XXH3, "ce7d19a5418fb365"},
+	} {
+		got := hex.EncodeToString(tc.algo.Sum(data))
+		if got != tc.expected {
+			t.Errorf("%v: got %s expected %s", tc.algo, got, tc.expected)
+		}
+		fromReader, err := tc.algo.SumReader(bytes.NewReader(data))
+		if err != nil || hex.EncodeToString(fromReader) != tc.expected {
+			t.Errorf("%v: SumReader got %x, %v", tc.algo, fromReader, err)
+		}
+		parsed, err := tcrypto.ParseHashAlgo(tc.algo.String())
+		if err != nil || parsed != tc.algo {
+			t.Errorf("%v: parse round trip got %v, %v", tc.algo, parsed, err)
+		}
+	}
+	if tcrypto.NoHash.Sum(data) != nil || tcrypto.NoHash.Valid() || tcrypto.HashAlgo(42).Valid() {
+		t.Errorf("NoHash/unknown shouldn't be valid")
+	}
+	if _, err := tcrypto.ParseHashAlgo("none"); err == nil {
+		t.Errorf("Parsing none should fail")
+	}
+}
+
+func TestNegotiateHash(t *testing.T) {
+	advertised := tcrypto.FormatHashes(tcrypto.DefaultChunkHashes) + ",k12"
+	if advertised != "xxh3,crc32c,blake3,sha512_256,sha256,k12" {
+		t.Errorf("Unexpected capabilities %q", advertised)
+	}
+	theirs := tcrypto.ParseHashes(advertised)
+	if len(theirs) != 5 {
+		t.Errorf("Expected unknown algorithm to be ignored: %v", theirs)
+	}
+	a, err := tcrypto.NegotiateHash(tcrypto.DefaultHashes, theirs)
+	if err != nil || a != tcrypto.SHA256 {
+		t.Errorf("Expected sha256, got %v, %v", a, err)
+	}
+	a, err = tcrypto.NegotiateHash(tcrypto.DefaultChunkHashes, tcrypto.ParseHashes("sha256, sha512_256"))
+	if err != nil || a != tcrypto.SHA512_256 {
+		t.Errorf("Expected our preference sha512_256, got %v, %v", a, err)
+	}
+	a, err = tcrypto.NegotiateHash(tcrypto.DefaultChunkHashes, tcrypto.ParseHashes("crc32c,sha256"))
+	if err != nil || a != tcrypto.CRC32C {
+		t.Errorf("Expected crc32c with a peer without xxh3, got %v, %v", a, err)
+	}
+	_, err = tcrypto.NegotiateHash(tcrypto.DefaultHashes, tcrypto.ParseHashes("crc32c,xxh3"))
+	if !errors.Is(err, tcrypto.ErrNoCommonHash) {
+		t.Errorf("Expected no common hash, got %v", err)
+	}
+}
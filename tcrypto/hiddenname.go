@@ -0,0 +1,59 @@
+package tcrypto
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// HiddenNamePrefix starts the names hidden by HideName.
+	HiddenNamePrefix = "#"
+	// HiddenNameSaltSize and HiddenNameHashSize are the sizes in bytes of the salt and hash of a
+	// hidden name (before their base64 encoding).
+	HiddenNameSaltSize = 6
+	HiddenNameHashSize = 12
+)
+
+// hiddenNameHash is the argon2id hash of the name with the salt, with the Commitment costs so
+// trying a dictionary of names against it is slow.
+func hiddenNameHash(name string, salt []byte) []byte {
+	return argon2.IDKey([]byte("tsync name1\x00"+name), salt, CommitmentTime, CommitmentMemory, 1, HiddenNameHashSize)
+}
+
+// HideName returns the name hidden behind a salted hash, to be advertised instead of it:
+// HiddenNamePrefix then the base64 of a new random salt and of the hash. Only who knows (or
+// guesses) the name can match it (see MatchHiddenName), and each call gives another one.
+func HideName(name string) string {
+	salt := make([]byte, HiddenNameSaltSize)
+	_, _ = rand.Read(salt) // never returns an error.
+	return HiddenNamePrefix + base64.RawURLEncoding.EncodeToString(append(salt, hiddenNameHash(name, salt)...))
+}
+
+// hiddenName returns the salt and hash of a HideName name, false if it isn't one.
+func hiddenName(hidden string) ([]byte, []byte, bool) {
+	encoded, found := strings.CutPrefix(hidden, HiddenNamePrefix)
+	if !found {
+		return nil, nil, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(b) != HiddenNameSaltSize+HiddenNameHashSize {
+		return nil, nil, false
+	}
+	return b[:HiddenNameSaltSize], b[HiddenNameSaltSize:], true
+}
+
+// IsHiddenName returns true if name was returned by HideName.
+func IsHiddenName(name string) bool {
+	_, _, ok := hiddenName(name)
+	return ok
+}
+
+// MatchHiddenName returns true if hidden is name hidden by HideName.
+func MatchHiddenName(hidden, name string) bool {
+	salt, hash, ok := hiddenName(hidden)
+	return ok && subtle.ConstantTimeCompare(hash, hiddenNameHash(name, salt)) == 1
+}
@@ -0,0 +1,50 @@
+package tcrypto_test
+
+import (
+	"strings"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestHideName(t *testing.T) {
+	hidden := tcrypto.HideName("alice")
+	if !strings.HasPrefix(hidden, tcrypto.HiddenNamePrefix) || strings.Contains(hidden, "alice") {
+		t.Errorf("Unexpected hidden name %q", hidden)
+	}
+	if !tcrypto.IsHiddenName(hidden) {
+		t.Errorf("%q should be a hidden name", hidden)
+	}
+	if !tcrypto.MatchHiddenName(hidden, "alice") {
+		t.Errorf("%q should match alice", hidden)
+	}
+	again := tcrypto.HideName("alice")
+	if again == hidden || !tcrypto.MatchHiddenName(again, "alice") {
+		t.Errorf("Hiding again should give another (matching) name, got %q and %q", hidden, again)
+	}
+	other := hidden[:len(hidden)-1] + "A"
+	if other == hidden {
+		other = hidden[:len(hidden)-1] + "B"
+	}
+	tests := []struct {
+		name, hidden, match string
+	}{
+		{"other name", hidden, "bob"},
+		{"prefix", hidden, "alic"},
+		{"not hidden", "alice", "alice"},
+		{"no prefix", hidden[1:], "alice"},
+		{"truncated", hidden[:len(hidden)-2], "alice"},
+		{"bad encoding", hidden[:5] + "!" + hidden[6:], "alice"},
+		{"other hash", other, "alice"},
+	}
+	for _, tt := range tests {
+		if tcrypto.MatchHiddenName(tt.hidden, tt.match) {
+			t.Errorf("%s: %q shouldn't match %q", tt.name, tt.hidden, tt.match)
+		}
+	}
+	for _, name := range []string{"alice", "#alice", hidden[1:], hidden + "A"} {
+		if tcrypto.IsHiddenName(name) {
+			t.Errorf("%q shouldn't be a hidden name", name)
+		}
+	}
+}
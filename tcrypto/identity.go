@@ -41,6 +41,24 @@ func VerifySignedMessage(signedMessage string, pubKey ed25519.PublicKey) ([]byte
 	return message, nil
 }
 
+// SignDetached returns the (encoded) signature of message, to be shipped separately from it,
+// e.g. for release files (see VerifyDetached).
+func (id *Identity) SignDetached(message []byte) string {
+	return EncodeBytes(SignedPrefix, ed25519.Sign(id.PrivateKey, message))
+}
+
+// VerifyDetached checks a SignDetached signature of message.
+func VerifyDetached(message []byte, signature string, pubKey ed25519.PublicKey) error {
+	sig, err := DecodeBytes(SignedPrefix, strings.TrimSpace(signature))
+	if err != nil {
+		return NewSignatureInvalidErr("failed to decode signature: " + err.Error())
+	}
+	if len(pubKey) != ed25519.PublicKeySize || !ed25519.Verify(pubKey, message, sig) {
+		return NewSignatureInvalidErr("signature verification failed")
+	}
+	return nil
+}
+
 func NewIdentity() (*Identity, error) {
 	pub, priv, err := ed25519.GenerateKey(nil)
 	if err != nil {
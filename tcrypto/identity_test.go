@@ -81,3 +81,29 @@ func TestPrivToPublic(t *testing.T) {
 	AssertBytesEqual(t, "Alice private key", alice.PrivateKey, alice2.PrivateKey)
 	AssertBytesEqual(t, "Alice public key", alice.PublicKey, alice2.PublicKey)
 }
+
+func TestSignDetached(t *testing.T) {
+	publisher, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("abc123  tsync_1.0.0_linux_amd64.tar.gz\n")
+	sig := publisher.SignDetached(data)
+	if err = tcrypto.VerifyDetached(data, sig+"\n", publisher.PublicKey); err != nil {
+		t.Errorf("Valid signature failed to verify: %v", err)
+	}
+	if err = tcrypto.VerifyDetached(data, sig, other.PublicKey); err == nil {
+		t.Errorf("Signature verified with the wrong key")
+	}
+	data[0] = 'x'
+	if err = tcrypto.VerifyDetached(data, sig, publisher.PublicKey); err == nil {
+		t.Errorf("Signature verified for altered data")
+	}
+	if err = tcrypto.VerifyDetached(data, "garbage", publisher.PublicKey); err == nil {
+		t.Errorf("Garbage signature verified")
+	}
+}
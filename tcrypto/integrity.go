@@ -0,0 +1,74 @@
+package tcrypto
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// QuarantineDir (in the storage Dir) is where files failing their integrity check are moved.
+	QuarantineDir = "quarantine"
+	// SignatureSuffix is appended to the name of a signed file for its signature (see WriteSigned).
+	SignatureSuffix = ".sig"
+	// storagePurpose prefixes the name of signed files for their signature purpose.
+	storagePurpose = "storage/"
+)
+
+// ErrIntegrity is returned (wrapped, with the quarantine location) by ReadSigned for files that
+// are corrupted, tampered with or signed by another identity.
+var ErrIntegrity = errors.New("integrity check failed")
+
+// WriteSigned atomically writes data to name (in the storage Dir) with its signature by id, in
+// name+SignatureSuffix, so changes not made through WriteSigned are detected by ReadSigned.
+func (s *Storage) WriteSigned(id *Identity, name string, data []byte, perm os.FileMode) error {
+	signer := id.NewStreamSigner(storagePurpose + name)
+	signer.Write(data)
+	if err := WriteFileAtomic(filepath.Join(s.Dir, name), data, perm); err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(s.Dir, name+SignatureSuffix), []byte(signer.Sign()+"\n"), perm)
+}
+
+// ReadSigned reads a WriteSigned file, checking its signature by id. Files failing the check are
+// moved to the quarantine (see Quarantine) and an ErrIntegrity error is returned: callers should
+// then start afresh (repair) rather than use them. Missing files are returned as os.ErrNotExist.
+func (s *Storage) ReadSigned(id *Identity, name string) ([]byte, error) {
+	path := filepath.Join(s.Dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := os.ReadFile(path + SignatureSuffix)
+	if err == nil {
+		verifier := NewStreamVerifier(id.PublicKey, storagePurpose+name)
+		verifier.Write(data)
+		err = verifier.Verify(string(sig))
+	}
+	if err == nil {
+		return data, nil
+	}
+	dir, qerr := s.Quarantine(name, name+SignatureSuffix)
+	if qerr != nil {
+		return nil, fmt.Errorf("%w for %s (%v) and quarantine failed: %w", ErrIntegrity, name, err, qerr)
+	}
+	return nil, fmt.Errorf("%w for %s (%v), moved to %s", ErrIntegrity, name, err, dir)
+}
+
+// Quarantine moves the named files (those that exist) of the storage Dir to a new timestamped
+// directory of QuarantineDir, which is returned, for inspection instead of being used or overwritten.
+func (s *Storage) Quarantine(names ...string) (string, error) {
+	dir := filepath.Join(s.Dir, QuarantineDir, time.Now().Format("20060102-150405.000000"))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		err := os.Rename(filepath.Join(s.Dir, name), filepath.Join(dir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
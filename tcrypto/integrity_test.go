@@ -0,0 +1,67 @@
+package tcrypto_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestSignedFiles(t *testing.T) {
+	s := &tcrypto.Storage{Dir: t.TempDir()}
+	id := tcrypto.NewIdentityFromSeed([32]byte{11})
+	if _, err := s.ReadSigned(id, "history"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Missing file should be ErrNotExist, got %v", err)
+	}
+	data := []byte("peer1 p.key1\npeer2 p.key2\n")
+	if err := s.WriteSigned(id, "history", data, 0o600); err != nil {
+		t.Fatalf("WriteSigned: %v", err)
+	}
+	got, err := s.ReadSigned(id, "history")
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("ReadSigned: %q %v", got, err)
+	}
+	// Signed for another file name: the purpose includes the name.
+	if err = s.WriteSigned(id, "trust", data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := os.ReadFile(filepath.Join(s.Dir, "history.sig"))
+	if err = os.WriteFile(filepath.Join(s.Dir, "trust.sig"), sig, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.ReadSigned(id, "trust"); !errors.Is(err, tcrypto.ErrIntegrity) {
+		t.Errorf("Signature of another file should be ErrIntegrity, got %v", err)
+	}
+	// Tampered content is quarantined, the next read sees no file (so it can start afresh).
+	if err = os.WriteFile(filepath.Join(s.Dir, "history"), append(data, "evil p.key3\n"...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.ReadSigned(id, "history")
+	if !errors.Is(err, tcrypto.ErrIntegrity) || !strings.Contains(err.Error(), tcrypto.QuarantineDir) {
+		t.Fatalf("Tampered file should be ErrIntegrity and quarantined, got %v", err)
+	}
+	if _, err = s.ReadSigned(id, "history"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Quarantined file should be gone, got %v", err)
+	}
+	quarantined, _ := filepath.Glob(filepath.Join(s.Dir, tcrypto.QuarantineDir, "*", "history*"))
+	if len(quarantined) != 2 {
+		t.Errorf("Expected the file and its signature in quarantine, got %v", quarantined)
+	}
+	// Signed by another identity.
+	if err = s.WriteSigned(tcrypto.NewIdentityFromSeed([32]byte{12}), "history", data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.ReadSigned(id, "history"); !errors.Is(err, tcrypto.ErrIntegrity) {
+		t.Errorf("File signed by another identity should be ErrIntegrity, got %v", err)
+	}
+	// Missing signature.
+	if err = os.WriteFile(filepath.Join(s.Dir, "unsigned"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.ReadSigned(id, "unsigned"); !errors.Is(err, tcrypto.ErrIntegrity) {
+		t.Errorf("Unsigned file should be ErrIntegrity, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package tcrypto
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"slices"
+	"strings"
+)
+
+// KexAlgo identifies a session key exchange. The numeric values are used on the wire and must not change.
+type KexAlgo uint8
+
+const (
+	// NoKex means no key exchange is used/negotiated.
+	NoKex KexAlgo = iota
+	// KexX25519 is the classic X25519 ECDH.
+	KexX25519
+	// KexX25519MLKEM768 is the X25519 + ML-KEM-768 hybrid (post quantum), the session secret
+	// is derived from both so it's safe as long as either one is.
+	KexX25519MLKEM768
+)
+
+// SessionKeySize is the size of the secrets derived by key exchanges.
+const SessionKeySize = 32
+
+// ErrNoCommonKex is returned by NegotiateKex when there is no key exchange supported by both sides.
+var ErrNoCommonKex = errors.New("no common key exchange algorithm")
+
+var (
+	kexNames = []string{"none", "x25519", "x25519mlkem768"}
+	// DefaultKex are the key exchanges we support by default, in order of preference.
+	DefaultKex = []KexAlgo{KexX25519}
+	// HybridKex are the key exchanges preferring the post quantum hybrid, for users who want
+	// protection of long lived data against future quantum computers.
+	HybridKex = []KexAlgo{KexX25519MLKEM768, KexX25519}
+)
+
+func (a KexAlgo) String() string {
+	if int(a) < len(kexNames) {
+		return kexNames[a]
+	}
+	return "unknown"
+}
+
+// Valid returns true for known key exchanges (excluding NoKex).
+func (a KexAlgo) Valid() bool {
+	return a > NoKex && int(a) < len(kexNames)
+}
+
+// ParseKexAlgo returns the key exchange from its name.
+func ParseKexAlgo(name string) (KexAlgo, error) {
+	idx := slices.Index(kexNames, strings.ToLower(name))
+	if idx <= 0 {
+		return NoKex, NewEncodingErr("unknown key exchange " + name)
+	}
+	return KexAlgo(idx), nil //nolint:gosec // small index.
+}
+
+// FormatKex returns the comma separated list of key exchange names, used to advertise capabilities.
+func FormatKex(algos []KexAlgo) string {
+	names := make([]string, len(algos))
+	for i, a := range algos {
+		names[i] = a.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseKex parses a FormatKex list, ignoring key exchanges we don't know (so peers can add new ones).
+func ParseKex(list string) []KexAlgo {
+	var algos []KexAlgo
+	for name := range strings.SplitSeq(list, ",") {
+		if a, err := ParseKexAlgo(strings.TrimSpace(name)); err == nil {
+			algos = append(algos, a)
+		}
+	}
+	return algos
+}
+
+// NegotiateKex returns the first of our key exchanges (in our order of preference) that the peer also supports.
+func NegotiateKex(ours, theirs []KexAlgo) (KexAlgo, error) {
+	for _, a := range ours {
+		if slices.Contains(theirs, a) {
+			return a, nil
+		}
+	}
+	return NoKex, ErrNoCommonKex
+}
+
+// KexInitiator is the initiator side of a key exchange: it sends Offer to the responder
+// (see KexRespond) and gets the session secret from the reply with Finish.
+type KexInitiator struct {
+	Algo  KexAlgo
+	ecdh  *ecdh.PrivateKey
+	mlkem *mlkem.DecapsulationKey768
+	offer []byte
+}
+
+// NewKexInitiator returns the initiator for a (negotiated) key exchange, with new ephemeral keys.
+func NewKexInitiator(algo KexAlgo) (*KexInitiator, error) {
+	if !algo.Valid() {
+		return nil, ErrNoCommonKex
+	}
+	k := &KexInitiator{Algo: algo}
+	var err error
+	if k.ecdh, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		return nil, err
+	}
+	k.offer = k.ecdh.PublicKey().Bytes()
+	if algo == KexX25519MLKEM768 {
+		if k.mlkem, err = mlkem.GenerateKey768(); err != nil {
+			return nil, err
+		}
+		k.offer = append(k.offer, k.mlkem.EncapsulationKey().Bytes()...)
+	}
+	return k, nil
+}
+
+// Offer returns the initiator's message: the X25519 public key, followed for the hybrid by the
+// ML-KEM encapsulation key.
+func (k *KexInitiator) Offer() []byte {
+	return k.offer
+}
+
+// Finish returns the session secret from the responder's reply.
+func (k *KexInitiator) Finish(reply []byte) ([]byte, error) {
+	if len(reply) != kexReplySize(k.Algo) {
+		return nil, NewEncodingErr("invalid key exchange reply size")
+	}
+	peer, err := ecdh.X25519().NewPublicKey(reply[:32])
+	if err != nil {
+		return nil, err
+	}
+	secret, err := k.ecdh.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	if k.Algo == KexX25519MLKEM768 {
+		pqSecret, err := k.mlkem.Decapsulate(reply[32:])
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, pqSecret...)
+	}
+	return deriveSessionKey(k.Algo, secret, k.offer, reply)
+}
+
+// KexRespond is the responder side of a key exchange: it returns the reply to send back to the
+// initiator and the session secret.
+func KexRespond(algo KexAlgo, offer []byte) ([]byte, []byte, error) {
+	if !algo.Valid() {
+		return nil, nil, ErrNoCommonKex
+	}
+	wantSize := 32
+	if algo == KexX25519MLKEM768 {
+		wantSize += mlkem.EncapsulationKeySize768
+	}
+	if len(offer) != wantSize {
+		return nil, nil, NewEncodingErr("invalid key exchange offer size")
+	}
+	peer, err := ecdh.X25519().NewPublicKey(offer[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	reply := priv.PublicKey().Bytes()
+	if algo == KexX25519MLKEM768 {
+		ek, err := mlkem.NewEncapsulationKey768(offer[32:])
+		if err != nil {
+			return nil, nil, err
+		}
+		pqSecret, ciphertext := ek.Encapsulate()
+		secret = append(secret, pqSecret...)
+		reply = append(reply, ciphertext...)
+	}
+	key, err := deriveSessionKey(algo, secret, offer, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply, key, nil
+}
+
+func kexReplySize(algo KexAlgo) int {
+	if algo == KexX25519MLKEM768 {
+		return 32 + mlkem.CiphertextSize768
+	}
+	return 32
+}
+
+// deriveSessionKey combines the shared secrets (concatenated) with HKDF, bound to the algorithm
+// and the transcript (offer and reply) so neither can be swapped or downgraded.
+func deriveSessionKey(algo KexAlgo, secrets, offer, reply []byte) ([]byte, error) {
+	info := make([]byte, 0, 32+len(offer)+len(reply))
+	info = append(info, "tsync kex "+algo.String()+"\n"...)
+	transcript := sha256.New()
+	transcript.Write(offer)
+	transcript.Write(reply)
+	info = transcript.Sum(info)
+	return hkdf.Key(sha256.New, secrets, nil, string(info), SessionKeySize)
+}
@@ -0,0 +1,68 @@
+package tcrypto_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestKexNegotiation(t *testing.T) {
+	list := tcrypto.FormatKex(tcrypto.HybridKex)
+	if list != "x25519mlkem768,x25519" {
+		t.Errorf("Unexpected capabilities %q", list)
+	}
+	theirs := tcrypto.ParseKex(list + ",future-kem")
+	if len(theirs) != 2 {
+		t.Errorf("Unknown key exchanges should be ignored, got %v", theirs)
+	}
+	// Hybrid only when both want it, classic otherwise.
+	if a, err := tcrypto.NegotiateKex(tcrypto.HybridKex, theirs); err != nil || a != tcrypto.KexX25519MLKEM768 {
+		t.Errorf("Hybrid on both sides: %v %v", a, err)
+	}
+	if a, err := tcrypto.NegotiateKex(tcrypto.HybridKex, tcrypto.DefaultKex); err != nil || a != tcrypto.KexX25519 {
+		t.Errorf("Hybrid with default peer: %v %v", a, err)
+	}
+	if _, err := tcrypto.NegotiateKex(tcrypto.HybridKex, nil); !errors.Is(err, tcrypto.ErrNoCommonKex) {
+		t.Errorf("Expected ErrNoCommonKex, got %v", err)
+	}
+}
+
+func TestKex(t *testing.T) {
+	for _, algo := range []tcrypto.KexAlgo{tcrypto.KexX25519, tcrypto.KexX25519MLKEM768} {
+		initiator, err := tcrypto.NewKexInitiator(algo)
+		if err != nil {
+			t.Fatalf("%v: NewKexInitiator: %v", algo, err)
+		}
+		reply, respKey, err := tcrypto.KexRespond(algo, initiator.Offer())
+		if err != nil {
+			t.Fatalf("%v: KexRespond: %v", algo, err)
+		}
+		t.Logf("%v: offer %d bytes, reply %d bytes", algo, len(initiator.Offer()), len(reply))
+		initKey, err := initiator.Finish(reply)
+		if err != nil {
+			t.Fatalf("%v: Finish: %v", algo, err)
+		}
+		if len(initKey) != tcrypto.SessionKeySize {
+			t.Errorf("%v: unexpected key size %d", algo, len(initKey))
+		}
+		AssertBytesEqual(t, algo.String()+" session keys", initKey, respKey)
+		// Altering the reply (the ML-KEM ciphertext for the hybrid) changes the key.
+		reply[len(reply)-1] ^= 1
+		if altered, err := initiator.Finish(reply); err == nil && bytes.Equal(altered, initKey) {
+			t.Errorf("%v: altered reply gave the same key", algo)
+		}
+		if _, _, err = tcrypto.KexRespond(algo, initiator.Offer()[:31]); err == nil {
+			t.Errorf("%v: short offer accepted", algo)
+		}
+	}
+	// Mismatched algorithms (e.g. a downgraded offer) don't work.
+	hybrid, _ := tcrypto.NewKexInitiator(tcrypto.KexX25519MLKEM768)
+	if _, _, err := tcrypto.KexRespond(tcrypto.KexX25519, hybrid.Offer()); err == nil {
+		t.Errorf("Hybrid offer accepted as classic")
+	}
+	if _, err := tcrypto.NewKexInitiator(tcrypto.NoKex); !errors.Is(err, tcrypto.ErrNoCommonKex) {
+		t.Errorf("NoKex initiator should fail with ErrNoCommonKex, got %v", err)
+	}
+}
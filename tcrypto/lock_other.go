@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package tcrypto
+
+import "os"
+
+// lockFile is a no-op on this platform (writes are still atomic, see WriteFileAtomic).
+func lockFile(_ *os.File) error {
+	return nil
+}
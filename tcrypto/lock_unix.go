@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package tcrypto
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func lockFile(f *os.File) error {
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX) //nolint:gosec // fds fit in int.
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package tcrypto
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/gtank/ristretto255"
+)
+
+// PairingCodeDigits is the number of (random) digits of pairing codes: ~30 bits, plenty against
+// online guessing (each guess needs a full exchange with the peer) which is all a PAKE allows.
+const PairingCodeDigits = 9
+
+// PAKEMessageSize is the size of the PAKE messages.
+const PAKEMessageSize = 32
+
+// cpaceDSI is the CPace domain separation identifier.
+const cpaceDSI = "tsync CPace255"
+
+var (
+	// ErrPAKEMessage is returned for invalid (e.g. identity element) peer PAKE messages.
+	ErrPAKEMessage = errors.New("invalid PAKE message")
+	// ErrPAKEMismatch is returned by VerifyConfirm when the peer used a different code (or session).
+	ErrPAKEMismatch = errors.New("pairing code mismatch")
+)
+
+// NewPairingCode returns a new random pairing code, formatted DDD-DDD-DDD, to be shown on one
+// device and typed on the other.
+func NewPairingCode() string {
+	var digits [PairingCodeDigits]byte
+	for i := 0; i < len(digits); {
+		var b [1]byte
+		_, _ = rand.Read(b[:]) // never returns an error.
+		if b[0] >= 250 {
+			continue // avoid modulo bias.
+		}
+		digits[i] = '0' + b[0]%10
+		i++
+	}
+	return string(digits[0:3]) + "-" + string(digits[3:6]) + "-" + string(digits[6:9])
+}
+
+// normalizeCode ignores separators, spaces and case so "123 456-789" is the same as "123456789".
+func normalizeCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
+
+// lvCat appends the length prefixed (uvarint) fields.
+func lvCat(b []byte, fields ...[]byte) []byte {
+	for _, f := range fields {
+		b = binary.AppendUvarint(b, uint64(len(f)))
+		b = append(b, f...)
+	}
+	return b
+}
+
+// PAKE is one side of a CPace (draft-irtf-cfrg-cpace, on ristretto255) password authenticated key
+// exchange: both sides derive the same key from a short pairing code without revealing anything
+// allowing offline guessing of the code to eavesdroppers or to a malicious peer.
+// Exchange Message()s, call Finish with the peer's, then exchange and check Confirm tags.
+type PAKE struct {
+	initiator bool
+	sid       []byte
+	scalar    *ristretto255.Scalar
+	msg       []byte
+	key       []byte
+}
+
+// NewPAKE starts a PAKE with code for the session sid (e.g. both names, anything both sides agree on,
+// it binds the key to that session). One side must be the initiator, the other not.
+func NewPAKE(code string, sid []byte, initiator bool) *PAKE {
+	h := sha512.Sum512(lvCat(nil, []byte(cpaceDSI), []byte(normalizeCode(code)), sid))
+	generator := ristretto255.NewElement().FromUniformBytes(h[:])
+	var random [64]byte
+	_, _ = rand.Read(random[:]) // never returns an error.
+	p := &PAKE{initiator: initiator, sid: sid, scalar: ristretto255.NewScalar().FromUniformBytes(random[:])}
+	p.msg = ristretto255.NewElement().ScalarMult(p.scalar, generator).Encode(nil)
+	return p
+}
+
+// Message returns the message to send to the peer.
+func (p *PAKE) Message() []byte {
+	return p.msg
+}
+
+// Finish returns the shared key (SessionKeySize bytes) from the peer's Message. Both sides only
+// get the same key when they used the same code and sid, check with Confirm/VerifyConfirm before use.
+func (p *PAKE) Finish(peerMsg []byte) ([]byte, error) {
+	peer := ristretto255.NewElement()
+	if len(peerMsg) != PAKEMessageSize || peer.Decode(peerMsg) != nil ||
+		peer.Equal(ristretto255.NewElement().Zero()) == 1 {
+		return nil, ErrPAKEMessage
+	}
+	shared := ristretto255.NewElement().ScalarMult(p.scalar, peer).Encode(nil)
+	initMsg, respMsg := p.msg, peerMsg
+	if !p.initiator {
+		initMsg, respMsg = peerMsg, p.msg
+	}
+	info := lvCat([]byte(cpaceDSI+" ISK"), p.sid, initMsg, respMsg)
+	key, err := hkdf.Key(sha256.New, shared, nil, string(info), SessionKeySize)
+	if err != nil {
+		return nil, err
+	}
+	p.key = key
+	return key, nil
+}
+
+func confirmTag(key []byte, initiator bool) []byte {
+	mac := hmac.New(sha256.New, key)
+	if initiator {
+		mac.Write([]byte(cpaceDSI + " confirm initiator"))
+	} else {
+		mac.Write([]byte(cpaceDSI + " confirm responder"))
+	}
+	return mac.Sum(nil)
+}
+
+// Confirm returns our key confirmation tag to send to the peer (after Finish).
+func (p *PAKE) Confirm() []byte {
+	return confirmTag(p.key, p.initiator)
+}
+
+// VerifyConfirm checks the peer's Confirm tag, ErrPAKEMismatch means the codes differ
+// (a typo or an attacker's guess, either way the key must not be used).
+func (p *PAKE) VerifyConfirm(tag []byte) error {
+	if p.key == nil || !hmac.Equal(tag, confirmTag(p.key, !p.initiator)) {
+		return ErrPAKEMismatch
+	}
+	return nil
+}
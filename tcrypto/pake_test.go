@@ -0,0 +1,74 @@
+package tcrypto_test
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func pakeExchange(t *testing.T, codeA, codeB string, sidA, sidB []byte) ([]byte, []byte, error) {
+	t.Helper()
+	a := tcrypto.NewPAKE(codeA, sidA, true)
+	b := tcrypto.NewPAKE(codeB, sidB, false)
+	keyA, err := a.Finish(b.Message())
+	if err != nil {
+		t.Fatalf("Initiator Finish: %v", err)
+	}
+	keyB, err := b.Finish(a.Message())
+	if err != nil {
+		t.Fatalf("Responder Finish: %v", err)
+	}
+	errA := a.VerifyConfirm(b.Confirm())
+	errB := b.VerifyConfirm(a.Confirm())
+	if (errA == nil) != (errB == nil) {
+		t.Fatalf("Confirmations disagree: %v vs %v", errA, errB)
+	}
+	return keyA, keyB, errA
+}
+
+func TestPAKE(t *testing.T) {
+	code := tcrypto.NewPairingCode()
+	if !regexp.MustCompile(`^\d{3}-\d{3}-\d{3}$`).MatchString(code) {
+		t.Errorf("Unexpected pairing code format %q", code)
+	}
+	if code == tcrypto.NewPairingCode() {
+		t.Errorf("Pairing codes should be random")
+	}
+	sid := []byte("alice bob")
+	keyA, keyB, err := pakeExchange(t, code, code, sid, sid)
+	if err != nil {
+		t.Fatalf("Same code should confirm: %v", err)
+	}
+	AssertBytesEqual(t, "PAKE keys", keyA, keyB)
+	if len(keyA) != tcrypto.SessionKeySize {
+		t.Errorf("Unexpected key size %d", len(keyA))
+	}
+	// Separators and spaces don't matter.
+	if _, _, err = pakeExchange(t, "123-456-789", "123 456789", sid, sid); err != nil {
+		t.Errorf("Differently formatted code should confirm: %v", err)
+	}
+	keyA, keyB, err = pakeExchange(t, "123-456-789", "123-456-788", sid, sid)
+	if !errors.Is(err, tcrypto.ErrPAKEMismatch) || bytes.Equal(keyA, keyB) {
+		t.Errorf("Different codes should give ErrPAKEMismatch and different keys, got %v", err)
+	}
+	if _, _, err = pakeExchange(t, code, code, sid, []byte("alice mallory")); !errors.Is(err, tcrypto.ErrPAKEMismatch) {
+		t.Errorf("Different sessions should give ErrPAKEMismatch, got %v", err)
+	}
+	// Messages are random (no offline dictionary from eavesdropped messages).
+	if bytes.Equal(tcrypto.NewPAKE(code, sid, true).Message(), tcrypto.NewPAKE(code, sid, true).Message()) {
+		t.Errorf("PAKE messages should be random")
+	}
+	p := tcrypto.NewPAKE(code, sid, true)
+	if _, err = p.Finish(make([]byte, tcrypto.PAKEMessageSize)); !errors.Is(err, tcrypto.ErrPAKEMessage) {
+		t.Errorf("Identity element should be rejected, got %v", err)
+	}
+	if _, err = p.Finish([]byte("short")); !errors.Is(err, tcrypto.ErrPAKEMessage) {
+		t.Errorf("Short message should be rejected, got %v", err)
+	}
+	if err = p.VerifyConfirm(nil); !errors.Is(err, tcrypto.ErrPAKEMismatch) {
+		t.Errorf("VerifyConfirm before Finish should fail, got %v", err)
+	}
+}
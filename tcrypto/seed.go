@@ -0,0 +1,29 @@
+package tcrypto
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+)
+
+// Deterministic keys, for reproducible test fixtures, documentation examples and protocol golden
+// vectors. TEST ONLY: anyone knowing the seed has the private key, real keys come from
+// NewIdentity and NewEphemeralKeys.
+
+// NewIdentityFromSeed returns the identity derived from seed (test only, see above).
+func NewIdentityFromSeed(seed [32]byte) *Identity {
+	priv := ed25519.NewKeyFromSeed(seed[:])
+	return &Identity{
+		PrivateKey: priv,
+		PublicKey:  priv.Public().(ed25519.PublicKey),
+	}
+}
+
+// NewEphemeralFromSeed returns the X25519 keys using seed as private key (test only, see above).
+func NewEphemeralFromSeed(seed [32]byte) *Ephemeral {
+	curve := ecdh.X25519()
+	priv, err := curve.NewPrivateKey(seed[:])
+	if err != nil {
+		panic(err) // can't happen: any 32 bytes are a valid X25519 private key.
+	}
+	return &Ephemeral{Curve: curve, PrivateKey: priv, PublicKey: priv.PublicKey()}
+}
@@ -0,0 +1,49 @@
+package tcrypto_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+// Golden vectors: these must never change (or the protocol fixtures derived from them would).
+func TestIdentityFromSeed(t *testing.T) {
+	id := tcrypto.NewIdentityFromSeed([32]byte{1})
+	if got := id.PublicKeyToString(); got != "p.zswVB9wd3XKVlRwpCIjwla25BE0bc9aW5t8GXWg71Pw" {
+		t.Errorf("Unexpected public key %q", got)
+	}
+	if got := id.HumanID(); got != "745-1081" {
+		t.Errorf("Unexpected human id %q", got)
+	}
+	sig := "s.aGVsbG8/B9Mao911ZN0Xh2tkMplZOlMkOOBEGrwl9qiuYvIlB4TS-6OYlrfjgqXChboctVZMN6NwKNpICoCTZj6kLED5Ag"
+	if got := id.SignMessage([]byte("hello")); got != sig {
+		t.Errorf("Unexpected signature %q", got)
+	}
+	again := tcrypto.NewIdentityFromSeed([32]byte{1})
+	AssertBytesEqual(t, "Same seed private key", id.PrivateKey, again.PrivateKey)
+	other := tcrypto.NewIdentityFromSeed([32]byte{2})
+	if other.PublicKeyToString() == id.PublicKeyToString() {
+		t.Errorf("Different seeds should give different keys")
+	}
+}
+
+func TestEphemeralFromSeed(t *testing.T) {
+	alice := tcrypto.NewEphemeralFromSeed([32]byte{2})
+	bob := tcrypto.NewEphemeralFromSeed([32]byte{3})
+	if got := alice.PublicKeyToString(); got != "p.L-V9o0fNYkMVKNqsX7spBzD_9oSvxM_C7ZCZX1jLO3Q" {
+		t.Errorf("Unexpected public key %q", got)
+	}
+	s1, err := alice.SharedSecret(bob.PublicKey)
+	if err != nil {
+		t.Fatalf("Alice shared secret: %v", err)
+	}
+	s2, err := bob.SharedSecret(alice.PublicKey)
+	if err != nil {
+		t.Fatalf("Bob shared secret: %v", err)
+	}
+	AssertBytesEqual(t, "Shared secrets", s1, s2)
+	if got := hex.EncodeToString(s1); got != "93fea2a7c1aeb62cfd6452ff5badae8bdffcbd7196dc910c89944006d85dbb68" {
+		t.Errorf("Unexpected shared secret %s", got)
+	}
+}
@@ -0,0 +1,178 @@
+package tcrypto
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+const (
+	// KexPrefix is the prefix of encoded key exchange offers and replies.
+	KexPrefix = "k."
+	// SealedPrefix is the prefix of encoded Session.Seal messages.
+	SealedPrefix = "s."
+	// ReplayWindow is the number of counters before the highest received one that Session.Open
+	// still accepts (once each), as datagrams can be reordered.
+	ReplayWindow = 64
+	// SealedOverhead is the number of bytes SealBytes adds to the plaintext (counter and GCM tag).
+	SealedOverhead     = sessionCounterSize + 16
+	sessionCounterSize = 8
+)
+
+var (
+	// ErrSessionOpen is returned by Session.Open for messages which aren't from the peer's side
+	// of the session (wrong key, tampered with or truncated).
+	ErrSessionOpen = errors.New("session message authentication failed")
+	// ErrReplay is returned by Session.Open for messages already received or too old to tell.
+	ErrReplay = errors.New("replayed session message")
+)
+
+// Session is the encrypted channel of a connection: AES-256-GCM with a key per direction derived
+// from the key exchange's session key (see KexInitiator and KexRespond), nonces from a counter
+// sent along and a replay window. Safe for concurrent use.
+type Session struct {
+	send, recv cipher.AEAD
+	stream     *Session // see Stream.
+	mu         sync.Mutex
+	sent       uint64 // counter of the last sealed message.
+	highest    uint64 // highest counter opened, 0 when none.
+	window     uint64 // bit i set when highest-i was opened.
+}
+
+// NewSession returns the session for the key exchange's session key, initiator is true
+// on the KexInitiator side (each side's send key is the other's receive key).
+func NewSession(key []byte, initiator bool) (*Session, error) {
+	s, err := newSession(key, "tsync session1", initiator)
+	if err != nil {
+		return nil, err
+	}
+	if s.stream, err = newSession(key, "tsync stream1", initiator); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Stream returns the session's sub-session for a reliable stream (e.g. tsnet's TCP and QUIC
+// streams): its keys are derived separately so its counters don't interleave with the datagrams'
+// and its in-order frames don't fall behind their replay window.
+func (s *Session) Stream() *Session {
+	return s.stream
+}
+
+func newSession(key []byte, info string, initiator bool) (*Session, error) {
+	keys, err := hkdf.Key(sha256.New, key, nil, info, 2*SessionKeySize)
+	if err != nil {
+		return nil, err
+	}
+	ours, theirs := keys[:SessionKeySize], keys[SessionKeySize:]
+	if !initiator {
+		ours, theirs = theirs, ours
+	}
+	s := &Session{}
+	if s.send, err = newGCM(ours); err != nil {
+		return nil, err
+	}
+	if s.recv, err = newGCM(theirs); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func sessionNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-sessionCounterSize:], counter)
+	return nonce
+}
+
+// Seal returns the encoded (SealedPrefix) encryption of plaintext, authenticating ad too
+// (e.g. the recipient's name) which Open must be given.
+func (s *Session) Seal(plaintext, ad []byte) string {
+	return EncodeBytes(SealedPrefix, s.SealBytes(plaintext, ad))
+}
+
+// Open returns the plaintext of the peer's Seal message, checking it wasn't tampered with
+// (ErrSessionOpen) nor replayed (ErrReplay).
+func (s *Session) Open(sealed string, ad []byte) ([]byte, error) {
+	msg, err := DecodeBytes(SealedPrefix, sealed)
+	if err != nil {
+		return nil, err
+	}
+	return s.OpenBytes(msg, ad)
+}
+
+// SealBytes is Seal without the encoding, for binary channels (e.g. tsnet's TCP streams).
+func (s *Session) SealBytes(plaintext, ad []byte) []byte {
+	s.mu.Lock()
+	s.sent++
+	counter := s.sent
+	s.mu.Unlock()
+	msg := binary.BigEndian.AppendUint64(make([]byte, 0, sessionCounterSize+len(plaintext)+s.send.Overhead()), counter)
+	return s.send.Seal(msg, sessionNonce(s.send, counter), plaintext, ad)
+}
+
+// OpenBytes is Open of a SealBytes message.
+func (s *Session) OpenBytes(msg, ad []byte) ([]byte, error) {
+	if len(msg) < sessionCounterSize+s.recv.Overhead() {
+		return nil, ErrSessionOpen
+	}
+	counter := binary.BigEndian.Uint64(msg)
+	if counter == 0 {
+		return nil, ErrSessionOpen
+	}
+	plaintext, err := s.recv.Open(nil, sessionNonce(s.recv, counter), msg[sessionCounterSize:], ad)
+	if err != nil {
+		return nil, ErrSessionOpen
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case counter > s.highest:
+		shift := counter - s.highest
+		if shift >= ReplayWindow {
+			s.window = 0
+		} else {
+			s.window <<= shift
+		}
+		s.window |= 1
+		s.highest = counter
+	case s.highest-counter >= ReplayWindow:
+		return nil, ErrReplay
+	default:
+		bit := uint64(1) << (s.highest - counter)
+		if s.window&bit != 0 {
+			return nil, ErrReplay
+		}
+		s.window |= bit
+	}
+	return plaintext, nil
+}
+
+// acceptContent is what SignAccept signs: the key exchange bound to the challenge, both names and
+// the capabilities transcript (if any, with another context), with a context string so the
+// signature can't be reused as any other signed message.
+func acceptContent(nonce, requester, responder, caps string, offer, reply []byte) []byte {
+	content := []byte("tsync accept1\x00" + nonce + "\x00" + requester + "\x00" + responder + "\x00")
+	if caps != "" {
+		content = []byte("tsync accept2\x00" + nonce + "\x00" + requester + "\x00" + responder + "\x00" + caps + "\x00")
+	}
+	content = append(content, offer...)
+	return append(content, reply...)
+}
+
+// SignAccept returns the signature, by the responder (us) of a connection, of its key exchange
+// reply to the requester's offer (whose SignChallenge of the nonce covered the offer) and of the
+// capabilities transcript (see SignChallenge).
+func (id *Identity) SignAccept(nonce, requester, responder, caps string, offer, reply []byte) string {
+	return id.SignDetached(acceptContent(nonce, requester, responder, caps, offer, reply))
+}
+
+// VerifyAccept checks the responder's SignAccept signature of the key exchange and capabilities.
+func VerifyAccept(nonce, requester, responder, caps string, offer, reply []byte, signature string,
+	pubKey ed25519.PublicKey,
+) error {
+	return VerifyDetached(acceptContent(nonce, requester, responder, caps, offer, reply), signature, pubKey)
+}
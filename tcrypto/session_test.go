@@ -0,0 +1,143 @@
+package tcrypto_test
+
+import (
+	"errors"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func newSessions(t *testing.T) (*tcrypto.Session, *tcrypto.Session) {
+	t.Helper()
+	kex, err := tcrypto.NewKexInitiator(tcrypto.KexX25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, responderKey, err := tcrypto.KexRespond(tcrypto.KexX25519, kex.Offer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiatorKey, err := kex.Finish(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiator, err := tcrypto.NewSession(initiatorKey, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := tcrypto.NewSession(responderKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initiator, responder
+}
+
+func TestSession(t *testing.T) {
+	a, b := newSessions(t)
+	ad := []byte("bob")
+	sealed := a.Seal([]byte("hello bob"), ad)
+	got, err := b.Open(sealed, ad)
+	if err != nil || string(got) != "hello bob" {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+	if _, err = b.Open(sealed, ad); !errors.Is(err, tcrypto.ErrReplay) {
+		t.Errorf("Replayed message should fail with ErrReplay, got %v", err)
+	}
+	back := b.Seal([]byte("hello alice"), []byte("alice"))
+	if got, err = a.Open(back, []byte("alice")); err != nil || string(got) != "hello alice" {
+		t.Errorf("Open of the responder's message = %q, %v", got, err)
+	}
+	if _, err = a.Open(a.Seal([]byte("x"), ad), ad); !errors.Is(err, tcrypto.ErrSessionOpen) {
+		t.Errorf("Our own message should not open (per direction keys), got %v", err)
+	}
+	if _, err = b.Open(a.Seal([]byte("x"), ad), []byte("carol")); !errors.Is(err, tcrypto.ErrSessionOpen) {
+		t.Errorf("Message for another recipient should not open, got %v", err)
+	}
+	tampered := []byte(a.Seal([]byte("tamper"), ad))
+	tampered[len(tampered)-1] ^= 1
+	if _, err = b.Open(string(tampered), ad); err == nil {
+		t.Errorf("Tampered message should not open")
+	}
+	other, _ := newSessions(t)
+	if _, err = b.Open(other.Seal([]byte("x"), ad), ad); !errors.Is(err, tcrypto.ErrSessionOpen) {
+		t.Errorf("Message of another session should not open, got %v", err)
+	}
+}
+
+func TestSessionStream(t *testing.T) {
+	a, b := newSessions(t)
+	as, bs := a.Stream(), b.Stream()
+	got, err := bs.OpenBytes(as.SealBytes([]byte("frame"), nil), nil)
+	if err != nil || string(got) != "frame" {
+		t.Fatalf("Stream OpenBytes = %q, %v", got, err)
+	}
+	if _, err = b.OpenBytes(as.SealBytes([]byte("frame"), nil), nil); !errors.Is(err, tcrypto.ErrSessionOpen) {
+		t.Errorf("Stream frame should not open with the datagram session, got %v", err)
+	}
+	if _, err = bs.OpenBytes(a.SealBytes([]byte("datagram"), nil), nil); !errors.Is(err, tcrypto.ErrSessionOpen) {
+		t.Errorf("Datagram should not open with the stream session, got %v", err)
+	}
+	// The datagrams' counters don't move the stream's replay window.
+	for range tcrypto.ReplayWindow + 1 {
+		if _, err = b.Open(a.Seal(nil, nil), nil); err != nil {
+			t.Fatalf("Datagram rejected: %v", err)
+		}
+	}
+	if got, err = bs.OpenBytes(as.SealBytes([]byte("next"), nil), nil); err != nil || string(got) != "next" {
+		t.Errorf("Stream frame after the datagrams = %q, %v", got, err)
+	}
+}
+
+func TestSessionReplayWindow(t *testing.T) {
+	a, b := newSessions(t)
+	msgs := make([]string, tcrypto.ReplayWindow+10)
+	for i := range msgs {
+		msgs[i] = a.Seal([]byte{byte(i)}, nil)
+	}
+	// Out of order within the window is fine, once.
+	for _, i := range []int{3, 1, 2, 0} {
+		if _, err := b.Open(msgs[i], nil); err != nil {
+			t.Errorf("Reordered message %d rejected: %v", i, err)
+		}
+	}
+	if _, err := b.Open(msgs[2], nil); !errors.Is(err, tcrypto.ErrReplay) {
+		t.Errorf("Replay of message 2 should fail, got %v", err)
+	}
+	last := len(msgs) - 1
+	if _, err := b.Open(msgs[last], nil); err != nil {
+		t.Errorf("Message %d rejected: %v", last, err)
+	}
+	if _, err := b.Open(msgs[last-tcrypto.ReplayWindow+1], nil); err != nil {
+		t.Errorf("Oldest message in the window rejected: %v", err)
+	}
+	if _, err := b.Open(msgs[last-tcrypto.ReplayWindow], nil); !errors.Is(err, tcrypto.ErrReplay) {
+		t.Errorf("Message older than the window should fail, got %v", err)
+	}
+}
+
+func TestSignAccept(t *testing.T) {
+	bob, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := tcrypto.NewChallenge()
+	offer, reply := []byte("offer"), []byte("reply")
+	sig := bob.SignAccept(nonce, "alice", "bob", "", offer, reply)
+	if err = tcrypto.VerifyAccept(nonce, "alice", "bob", "", offer, reply, sig, bob.PublicKey); err != nil {
+		t.Errorf("Valid accept rejected: %v", err)
+	}
+	if err = tcrypto.VerifyAccept(nonce, "alice", "bob", "", offer, []byte("other reply"), sig, bob.PublicKey); err == nil {
+		t.Errorf("Accept with a swapped reply should be rejected")
+	}
+	capsSig := bob.SignAccept(nonce, "alice", "bob", "auth,quic/auth", offer, reply)
+	if err = tcrypto.VerifyAccept(nonce, "alice", "bob", "auth,quic/auth", offer, reply, capsSig, bob.PublicKey); err != nil {
+		t.Errorf("Valid accept with capabilities rejected: %v", err)
+	}
+	if err = tcrypto.VerifyAccept(nonce, "alice", "bob", "", offer, reply, capsSig, bob.PublicKey); err == nil {
+		t.Errorf("Accept with stripped capabilities should be rejected")
+	}
+	challengeSig := bob.SignChallenge(nonce, "alice", "bob", "", offer)
+	if err = tcrypto.VerifyAccept(nonce, "alice", "bob", "", offer, nil, challengeSig, bob.PublicKey); err == nil {
+		t.Errorf("Challenge signature should not verify as an accept")
+	}
+}
@@ -0,0 +1,164 @@
+package tcrypto
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+)
+
+const (
+	// MaxSnapshotSize bounds the total size of the files of a snapshot (it's built in memory).
+	MaxSnapshotSize = 512 << 20
+	// snapshotKeyInfo is the HKDF info of the snapshot key, versioned so it can change.
+	snapshotKeyInfo = "tsync snapshot1"
+)
+
+var (
+	// ErrSnapshotTooLarge is returned by Snapshot when the files exceed MaxSnapshotSize.
+	ErrSnapshotTooLarge = errors.New("snapshot too large")
+	// ErrSnapshotKey is returned by RestoreSnapshot for snapshots not made by the identity (or altered).
+	ErrSnapshotKey = errors.New("snapshot not made by this identity or altered")
+)
+
+// SnapshotKey returns the 32 bytes key encrypting the identity's snapshots, derived from its
+// private key: only the same identity (e.g. restored with Storage.Restore on a new machine) can
+// decrypt them, the backup target holding them can't.
+func (id *Identity) SnapshotKey() []byte {
+	key, err := hkdf.Key(sha256.New, id.PrivateKey.Seed(), nil, snapshotKeyInfo, 32)
+	if err != nil {
+		panic(err) // only for invalid lengths.
+	}
+	return key
+}
+
+// Snapshot returns the encrypted archive (binary Envelope, identified by the KeyID of our public
+// key) of the regular files and directories of dirs, each under its base name. Other files
+// (symlinks, devices etc) are skipped.
+func (id *Identity) Snapshot(dirs []string) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	var total int64
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		base := filepath.Base(dir)
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			name := path.Join(base, filepath.ToSlash(rel))
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			switch {
+			case d.IsDir():
+				return tw.WriteHeader(&tar.Header{
+					Name: name + "/", Mode: int64(info.Mode().Perm()), ModTime: info.ModTime(), Typeflag: tar.TypeDir,
+				})
+			case !d.Type().IsRegular():
+				return nil
+			}
+			if total += info.Size(); total > MaxSnapshotSize {
+				return fmt.Errorf("%w: more than %d bytes in %v", ErrSnapshotTooLarge, MaxSnapshotSize, dirs)
+			}
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			err = tw.WriteHeader(&tar.Header{
+				Name: name, Mode: int64(info.Mode().Perm()), Size: int64(len(data)), ModTime: info.ModTime(),
+				Typeflag: tar.TypeReg,
+			})
+			if err == nil {
+				_, err = tw.Write(data)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	e, err := SealEnvelope(id.SnapshotKey(), KeyID(id.PublicKey), buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return e.Marshal(), nil
+}
+
+// RestoreSnapshot decrypts a Snapshot of the identity and writes its files under dest, replacing
+// existing ones, returning their paths. Nothing is written if the snapshot isn't ours
+// (ErrSnapshotKey) or has entries outside of dest.
+func (id *Identity) RestoreSnapshot(snapshot []byte, dest string) ([]string, error) {
+	e, err := UnmarshalEnvelope(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Equal(e.KeyID, KeyID(id.PublicKey)) {
+		return nil, ErrSnapshotKey
+	}
+	archive, err := e.Open(id.SnapshotKey())
+	if errors.Is(err, ErrEnvelopeOpen) {
+		return nil, ErrSnapshotKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	var headers []*tar.Header
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsLocal(filepath.FromSlash(h.Name)) || (h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeDir) {
+			return nil, NewEncodingErr("unexpected snapshot entry " + h.Name)
+		}
+		headers = append(headers, h)
+	}
+	var files []string
+	tr = tar.NewReader(bytes.NewReader(archive))
+	for _, h := range headers {
+		if _, err = tr.Next(); err != nil {
+			return files, err
+		}
+		target := filepath.Join(dest, filepath.FromSlash(h.Name))
+		mode := os.FileMode(h.Mode).Perm() //nolint:gosec // permission bits only.
+		if h.Typeflag == tar.TypeDir {
+			if err = os.MkdirAll(target, mode|0o700); err != nil {
+				return files, err
+			}
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return files, err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return files, err
+		}
+		if err = WriteFileAtomic(target, data, mode); err != nil {
+			return files, err
+		}
+		files = append(files, target)
+	}
+	return files, nil
+}
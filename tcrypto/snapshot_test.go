@@ -0,0 +1,55 @@
+package tcrypto_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "docs")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("secret notes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "b.bin"), []byte{0, 1, 2}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	id := tcrypto.NewIdentityFromSeed([32]byte{3})
+	snapshot, err := id.Snapshot([]string{src})
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if bytes.Contains(snapshot, []byte("secret notes")) {
+		t.Errorf("Snapshot isn't encrypted")
+	}
+	other := tcrypto.NewIdentityFromSeed([32]byte{4})
+	dest := t.TempDir()
+	if _, err = other.RestoreSnapshot(snapshot, dest); !errors.Is(err, tcrypto.ErrSnapshotKey) {
+		t.Errorf("Other identity should get ErrSnapshotKey, got %v", err)
+	}
+	files, err := id.RestoreSnapshot(snapshot, dest)
+	if err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected 2 files restored, got %v", files)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "docs", "sub", "b.bin"))
+	if err != nil || !bytes.Equal(data, []byte{0, 1, 2}) {
+		t.Errorf("Restored b.bin: %v %v", data, err)
+	}
+	if st, err := os.Stat(filepath.Join(dest, "docs", "sub", "b.bin")); err != nil || st.Mode().Perm() != 0o600 {
+		t.Errorf("Restored mode: %v %v", st, err)
+	}
+	snapshot[len(snapshot)-20] ^= 1
+	if _, err = id.RestoreSnapshot(snapshot, t.TempDir()); !errors.Is(err, tcrypto.ErrSnapshotKey) {
+		t.Errorf("Altered snapshot should get ErrSnapshotKey, got %v", err)
+	}
+}
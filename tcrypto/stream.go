@@ -0,0 +1,102 @@
+package tcrypto
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"hash"
+	"io"
+	"strings"
+)
+
+// StreamContextPrefix prefixes the purpose given to NewStreamSigner/NewStreamVerifier to form the
+// Ed25519ph context, so a streamed signature for one purpose (e.g. "manifest") can't be replayed
+// as one for another (e.g. "content"), nor be mistaken for a SignMessage/SignDetached signature.
+const StreamContextPrefix = "tsync/"
+
+// MaxStreamPurpose is the maximum length of a stream signature purpose (Ed25519ph contexts are
+// at most 255 bytes).
+const MaxStreamPurpose = 255 - len(StreamContextPrefix)
+
+// StreamSigner signs content of any size written to it without holding it in memory:
+// it hashes (SHA-512) as it goes and Sign signs the hash (Ed25519ph, RFC 8032).
+type StreamSigner struct {
+	id      *Identity
+	h       hash.Hash
+	options ed25519.Options
+}
+
+// StreamVerifier checks a StreamSigner signature of the content written to it.
+type StreamVerifier struct {
+	pubKey  ed25519.PublicKey
+	h       hash.Hash
+	options ed25519.Options
+}
+
+func streamOptions(purpose string) ed25519.Options {
+	if len(purpose) > MaxStreamPurpose {
+		panic("tcrypto: stream signature purpose too long")
+	}
+	return ed25519.Options{Hash: crypto.SHA512, Context: StreamContextPrefix + purpose}
+}
+
+// NewStreamSigner returns a signer for content written to it, for the given purpose (domain separation).
+func (id *Identity) NewStreamSigner(purpose string) *StreamSigner {
+	return &StreamSigner{id: id, h: sha512.New(), options: streamOptions(purpose)}
+}
+
+// Write adds p to the signed content, it never fails.
+func (s *StreamSigner) Write(p []byte) (int, error) {
+	return s.h.Write(p)
+}
+
+// Sign returns the encoded signature of the content written so far (writes can continue after).
+func (s *StreamSigner) Sign() string {
+	sig, err := s.id.PrivateKey.Sign(nil, s.h.Sum(nil), &s.options)
+	if err != nil {
+		panic(err) // can't happen: options are always valid for ed25519.
+	}
+	return EncodeBytes(SignedPrefix, sig)
+}
+
+// NewStreamVerifier returns a verifier for content written to it, signed by pubKey for purpose.
+func NewStreamVerifier(pubKey ed25519.PublicKey, purpose string) *StreamVerifier {
+	return &StreamVerifier{pubKey: pubKey, h: sha512.New(), options: streamOptions(purpose)}
+}
+
+// Write adds p to the content being verified, it never fails.
+func (v *StreamVerifier) Write(p []byte) (int, error) {
+	return v.h.Write(p)
+}
+
+// Verify checks the StreamSigner signature of the content written so far.
+func (v *StreamVerifier) Verify(signature string) error {
+	sig, err := DecodeBytes(SignedPrefix, strings.TrimSpace(signature))
+	if err != nil {
+		return NewSignatureInvalidErr("failed to decode signature: " + err.Error())
+	}
+	if len(v.pubKey) != ed25519.PublicKeySize ||
+		ed25519.VerifyWithOptions(v.pubKey, v.h.Sum(nil), sig, &v.options) != nil {
+		return NewSignatureInvalidErr("signature verification failed")
+	}
+	return nil
+}
+
+// SignReader returns the streamed signature (see StreamSigner) of the content of r for purpose.
+func (id *Identity) SignReader(purpose string, r io.Reader) (string, error) {
+	s := id.NewStreamSigner(purpose)
+	if _, err := io.Copy(s, r); err != nil {
+		return "", err
+	}
+	return s.Sign(), nil
+}
+
+// VerifyReader checks the streamed signature of the content of r for purpose. Read errors are
+// returned as is, not as SignatureInvalidError.
+func VerifyReader(pubKey ed25519.PublicKey, purpose string, r io.Reader, signature string) error {
+	v := NewStreamVerifier(pubKey, purpose)
+	if _, err := io.Copy(v, r); err != nil {
+		return err
+	}
+	return v.Verify(signature)
+}
@@ -0,0 +1,61 @@
+package tcrypto_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestStreamSign(t *testing.T) {
+	alice := tcrypto.NewIdentityFromSeed([32]byte{1})
+	bob := tcrypto.NewIdentityFromSeed([32]byte{2})
+	// 10 MiB, written in chunks of varying sizes.
+	content := bytes.Repeat([]byte("0123456789abcdef"), 10<<16)
+	s := alice.NewStreamSigner("content")
+	for i, n := 0, 1; i < len(content); i, n = i+n, n*3 {
+		s.Write(content[i:min(i+n, len(content))])
+	}
+	sig := s.Sign()
+	sig2, err := alice.SignReader("content", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("SignReader: %v", err)
+	}
+	if sig != sig2 {
+		t.Errorf("Chunked and whole signatures differ: %s vs %s", sig, sig2)
+	}
+	if err = tcrypto.VerifyReader(alice.PublicKey, "content", bytes.NewReader(content), sig); err != nil {
+		t.Errorf("Valid signature not verified: %v", err)
+	}
+	var sigErr *tcrypto.SignatureInvalidError
+	if err = tcrypto.VerifyReader(bob.PublicKey, "content", bytes.NewReader(content), sig); !errors.As(err, &sigErr) {
+		t.Errorf("Signature by another key should fail, got %v", err)
+	}
+	if err = tcrypto.VerifyReader(alice.PublicKey, "manifest", bytes.NewReader(content), sig); !errors.As(err, &sigErr) {
+		t.Errorf("Signature for another purpose should fail, got %v", err)
+	}
+	content[12345] ^= 1
+	if err = tcrypto.VerifyReader(alice.PublicKey, "content", bytes.NewReader(content), sig); !errors.As(err, &sigErr) {
+		t.Errorf("Signature of altered content should fail, got %v", err)
+	}
+	// Not interchangeable with the non streamed signatures.
+	small := []byte("hello")
+	if err = tcrypto.VerifyDetached(small, alice.NewStreamSigner("").Sign(), alice.PublicKey); err == nil {
+		t.Errorf("Streamed signature of empty content accepted as detached signature")
+	}
+	detached := alice.SignDetached(small)
+	if err = tcrypto.VerifyReader(alice.PublicKey, "", bytes.NewReader(small), detached); !errors.As(err, &sigErr) {
+		t.Errorf("Detached signature accepted as streamed one, got %v", err)
+	}
+	readErr := errors.New("read failure")
+	if _, err = alice.SignReader("content", iotest.ErrReader(readErr)); !errors.Is(err, readErr) {
+		t.Errorf("Expected read error, got %v", err)
+	}
+	if err = tcrypto.VerifyReader(alice.PublicKey, "content", io.MultiReader(bytes.NewReader(small),
+		iotest.ErrReader(readErr)), sig); !errors.Is(err, readErr) {
+		t.Errorf("Expected read error, got %v", err)
+	}
+}
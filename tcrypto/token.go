@@ -0,0 +1,26 @@
+package tcrypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+const (
+	// DropTokenPrefix is the prefix of one time drop tokens.
+	DropTokenPrefix = "d."
+	dropTokenSize   = 16
+)
+
+// NewDropToken returns a new random one time token allowing a (possibly untrusted) peer to
+// drop a single file in our inbox.
+func NewDropToken() string {
+	b := make([]byte, dropTokenSize)
+	_, _ = rand.Read(b) // never returns an error.
+	return EncodeBytes(DropTokenPrefix, b)
+}
+
+// TokenKey returns the key to use to store/lookup a token (its hash), so lookups in
+// a map don't leak timing information about the secret token itself.
+func TokenKey(token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token))
+}
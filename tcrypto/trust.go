@@ -0,0 +1,176 @@
+package tcrypto
+
+import (
+	"cmp"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EndorsementPolicy says what to do with endorsements received from trusted peers.
+type EndorsementPolicy int
+
+const (
+	// EndorseIgnore ignores endorsements.
+	EndorseIgnore EndorsementPolicy = iota
+	// EndorseWarn trusts endorsed peers, marked (TrustEntry.Warn) so users can be warned to verify them.
+	EndorseWarn
+	// EndorseTrust trusts endorsed peers like directly verified ones.
+	EndorseTrust
+)
+
+var endorsementPolicyNames = []string{"ignore", "warn", "trust"}
+
+func (p EndorsementPolicy) String() string {
+	if p >= 0 && int(p) < len(endorsementPolicyNames) {
+		return endorsementPolicyNames[p]
+	}
+	return "unknown"
+}
+
+// ParseEndorsementPolicy returns the policy from its name (ignore, warn or trust).
+func ParseEndorsementPolicy(name string) (EndorsementPolicy, error) {
+	idx := slices.Index(endorsementPolicyNames, strings.ToLower(name))
+	if idx < 0 {
+		return EndorseIgnore, fmt.Errorf("unknown endorsement policy %q, expecting ignore, warn or trust", name)
+	}
+	return EndorsementPolicy(idx), nil
+}
+
+// endorsementFormat is the signed payload of endorsements: name, public key, issued unix time.
+const endorsementFormat = "endorse1 %q %s %d"
+
+// ErrEndorserNotTrusted is returned by AddEndorsement when the endorser isn't directly trusted
+// (endorsements aren't transitive).
+var ErrEndorserNotTrusted = errors.New("endorser is not directly trusted")
+
+// Endorsement is a statement, signed by the endorser's identity, that Name's public key is PublicKey.
+type Endorsement struct {
+	Name      string
+	PublicKey string
+	Issued    time.Time
+}
+
+// Endorse returns our signed endorsement (a text Envelope) of the peer's public key.
+func (id *Identity) Endorse(name, pubKey string) string {
+	return id.SignEnvelope(fmt.Appendf(nil, endorsementFormat, name, pubKey, time.Now().Unix())).String()
+}
+
+// VerifyEndorsement checks an Endorse endorsement against the endorser's public key.
+func VerifyEndorsement(endorsement string, endorser ed25519.PublicKey) (*Endorsement, error) {
+	e, err := ParseEnvelope(endorsement)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := e.Verify(endorser)
+	if err != nil {
+		return nil, err
+	}
+	var res Endorsement
+	var issued int64
+	if n, err := fmt.Sscanf(string(payload), endorsementFormat, &res.Name, &res.PublicKey, &issued); err != nil || n != 3 {
+		return nil, NewEncodingErr("invalid endorsement")
+	}
+	if _, err = IdentityPublicKeyString(res.PublicKey); err != nil {
+		return nil, err
+	}
+	res.Issued = time.Unix(issued, 0)
+	return &res, nil
+}
+
+// TrustEntry is a trusted peer key.
+type TrustEntry struct {
+	Name      string    `json:"name"`
+	PublicKey string    `json:"public_key"`
+	Added     time.Time `json:"added"`
+	// Public key of the peer whose endorsement made us trust this one, empty when directly verified.
+	EndorsedBy string `json:"endorsed_by,omitempty"`
+	// Added under EndorseWarn: users should be warned to verify it themselves.
+	Warn bool `json:"warn,omitempty"`
+}
+
+// TrustedKeys returns the trusted keys (stored, signed by id, in ValidatedPublicKeysFile), sorted
+// by name. An ErrIntegrity error means the file was quarantined (see ReadSigned).
+func (s *Storage) TrustedKeys(id *Identity) ([]TrustEntry, error) {
+	data, err := s.ReadSigned(id, ValidatedPublicKeysFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []TrustEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Trusted returns the trust entry of the public key, if trusted.
+func (s *Storage) Trusted(id *Identity, pubKey string) (TrustEntry, bool, error) {
+	entries, err := s.TrustedKeys(id)
+	idx := slices.IndexFunc(entries, func(e TrustEntry) bool { return e.PublicKey == pubKey })
+	if idx < 0 {
+		return TrustEntry{}, false, err
+	}
+	return entries[idx], true, err
+}
+
+// Trust adds the entry to the trusted keys (under the storage Lock) unless its key is already
+// trusted (added is then false, a direct trust still replaces an endorsed one).
+func (s *Storage) Trust(id *Identity, entry TrustEntry) (added bool, err error) {
+	unlock, err := s.Lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	entries, err := s.TrustedKeys(id)
+	if err != nil && !errors.Is(err, ErrIntegrity) {
+		return false, err // integrity errors: start afresh, the bad file is quarantined.
+	}
+	if entry.Added.IsZero() {
+		entry.Added = time.Now().Truncate(time.Second)
+	}
+	idx := slices.IndexFunc(entries, func(e TrustEntry) bool { return e.PublicKey == entry.PublicKey })
+	switch {
+	case idx < 0:
+		entries = append(entries, entry)
+	case entry.EndorsedBy == "" && entries[idx].EndorsedBy != "":
+		entries[idx] = entry
+	default:
+		return false, nil
+	}
+	slices.SortFunc(entries, func(a, b TrustEntry) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.PublicKey, b.PublicKey))
+	})
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	return true, s.WriteSigned(id, ValidatedPublicKeysFile, append(data, '\n'), 0o644)
+}
+
+// AddEndorsement trusts the endorsed key according to policy, if the endorser (public key string)
+// is directly trusted. Returns the entry and whether it was added.
+func (s *Storage) AddEndorsement(id *Identity, endorser string, e *Endorsement, policy EndorsementPolicy) (
+	TrustEntry, bool, error,
+) {
+	entry := TrustEntry{Name: e.Name, PublicKey: e.PublicKey, EndorsedBy: endorser, Warn: policy == EndorseWarn}
+	if policy == EndorseIgnore || e.PublicKey == id.PublicKeyToString() {
+		return entry, false, nil
+	}
+	trusted, ok, err := s.Trusted(id, endorser)
+	if err != nil {
+		return entry, false, err
+	}
+	if !ok || trusted.EndorsedBy != "" {
+		return entry, false, ErrEndorserNotTrusted
+	}
+	added, err := s.Trust(id, entry)
+	return entry, added, err
+}
@@ -0,0 +1,90 @@
+package tcrypto_test
+
+import (
+	"errors"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+func TestEndorsement(t *testing.T) {
+	alice := tcrypto.NewIdentityFromSeed([32]byte{20})
+	carol := tcrypto.NewIdentityFromSeed([32]byte{21})
+	e := alice.Endorse("carol", carol.PublicKeyToString())
+	got, err := tcrypto.VerifyEndorsement(e, alice.PublicKey)
+	if err != nil {
+		t.Fatalf("VerifyEndorsement: %v", err)
+	}
+	if got.Name != "carol" || got.PublicKey != carol.PublicKeyToString() || got.Issued.IsZero() {
+		t.Errorf("Unexpected endorsement %+v", got)
+	}
+	if _, err = tcrypto.VerifyEndorsement(e, carol.PublicKey); err == nil {
+		t.Errorf("Endorsement verified with the wrong key")
+	}
+	if _, err = tcrypto.VerifyEndorsement(alice.SignEnvelope([]byte("hello")).String(), alice.PublicKey); err == nil {
+		t.Errorf("Non endorsement envelope accepted")
+	}
+	for _, name := range []string{"ignore", "warn", "TRUST"} {
+		if p, err := tcrypto.ParseEndorsementPolicy(name); err != nil || p.String() != map[string]string{
+			"ignore": "ignore", "warn": "warn", "TRUST": "trust",
+		}[name] {
+			t.Errorf("ParseEndorsementPolicy(%q) = %v %v", name, p, err)
+		}
+	}
+	if _, err = tcrypto.ParseEndorsementPolicy("maybe"); err == nil {
+		t.Errorf("Unknown policy accepted")
+	}
+}
+
+func TestTrustStore(t *testing.T) {
+	s := &tcrypto.Storage{Dir: t.TempDir()}
+	me := tcrypto.NewIdentityFromSeed([32]byte{22})
+	alice := tcrypto.NewIdentityFromSeed([32]byte{20}).PublicKeyToString()
+	bob := tcrypto.NewIdentityFromSeed([32]byte{23}).PublicKeyToString()
+	carol := &tcrypto.Endorsement{Name: "carol", PublicKey: tcrypto.NewIdentityFromSeed([32]byte{21}).PublicKeyToString()}
+	dave := &tcrypto.Endorsement{Name: "dave", PublicKey: tcrypto.NewIdentityFromSeed([32]byte{24}).PublicKeyToString()}
+	if entries, err := s.TrustedKeys(me); err != nil || len(entries) != 0 {
+		t.Errorf("Empty store: %v %v", entries, err)
+	}
+	if _, _, err := s.AddEndorsement(me, alice, carol, tcrypto.EndorseTrust); !errors.Is(err, tcrypto.ErrEndorserNotTrusted) {
+		t.Errorf("Endorsement by unknown peer should be ErrEndorserNotTrusted, got %v", err)
+	}
+	if added, err := s.Trust(me, tcrypto.TrustEntry{Name: "alice", PublicKey: alice}); err != nil || !added {
+		t.Fatalf("Trust: %v %v", added, err)
+	}
+	if added, err := s.Trust(me, tcrypto.TrustEntry{Name: "alice", PublicKey: alice}); err != nil || added {
+		t.Errorf("Trust again: %v %v", added, err)
+	}
+	if _, added, err := s.AddEndorsement(me, alice, carol, tcrypto.EndorseIgnore); err != nil || added {
+		t.Errorf("Ignored endorsement: %v %v", added, err)
+	}
+	entry, added, err := s.AddEndorsement(me, alice, carol, tcrypto.EndorseWarn)
+	if err != nil || !added || !entry.Warn || entry.EndorsedBy != alice {
+		t.Fatalf("Endorsement with warning: %+v %v %v", entry, added, err)
+	}
+	// Not transitive: carol (endorsed) can't endorse dave.
+	if _, _, err = s.AddEndorsement(me, carol.PublicKey, dave, tcrypto.EndorseTrust); !errors.Is(err, tcrypto.ErrEndorserNotTrusted) {
+		t.Errorf("Endorsement by endorsed peer should be ErrEndorserNotTrusted, got %v", err)
+	}
+	if _, added, _ = s.AddEndorsement(me, alice, carol, tcrypto.EndorseTrust); added {
+		t.Errorf("Already trusted key added again")
+	}
+	// Direct trust replaces the endorsed one.
+	if added, err = s.Trust(me, tcrypto.TrustEntry{Name: "carol", PublicKey: carol.PublicKey}); err != nil || !added {
+		t.Errorf("Direct trust of endorsed peer: %v %v", added, err)
+	}
+	if entry, ok, err := s.Trusted(me, carol.PublicKey); err != nil || !ok || entry.EndorsedBy != "" || entry.Warn {
+		t.Errorf("Carol should now be directly trusted: %+v %v %v", entry, ok, err)
+	}
+	if _, ok, _ := s.Trusted(me, bob); ok {
+		t.Errorf("Bob shouldn't be trusted")
+	}
+	entries, err := s.TrustedKeys(me)
+	if err != nil || len(entries) != 2 || entries[0].Name != "alice" || entries[1].Name != "carol" {
+		t.Errorf("Unexpected entries %+v %v", entries, err)
+	}
+	// Signed by our identity: another identity's view is an integrity failure.
+	if _, err = s.TrustedKeys(tcrypto.NewIdentityFromSeed([32]byte{25})); !errors.Is(err, tcrypto.ErrIntegrity) {
+		t.Errorf("Trust store read with another identity should be ErrIntegrity, got %v", err)
+	}
+}
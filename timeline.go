@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/terminal/ansipixels/tcolor"
+	"fortio.org/tsync/tlayout"
+	"fortio.org/tsync/tsnet"
+)
+
+// TimelineSize is the number of events kept by the Timeline, older ones are dropped.
+const TimelineSize = 1000
+
+// Timeline only events, from the streams (tsnet.TransferManager.List) and the rejects of our
+// connection requests (tsnet.Config.OnReject).
+const (
+	EventTransferStarted = "transfer-started"
+	EventTransferDone    = "transfer-done"
+	EventPeerRejected    = "peer-rejected"
+)
+
+// TimelineEvent is an entry of the Timeline.
+type TimelineEvent struct {
+	Time  time.Time
+	Event string // EventPeerDiscovered etc.
+	Peer  string // name, "" when not about a peer.
+	Text  string
+}
+
+// Timeline is the terminal UI's list of the structured events: peers discovered, lost or changing
+// connection status, peers trusted, transfers and received files. Fed by the Hooks (OnEvent)
+// and SampleTransfers, it complements the log pane.
+type Timeline struct {
+	Back    int // lines scrolled back from the latest events, 0 follows them.
+	mu      sync.Mutex
+	events  []TimelineEvent
+	streams map[streamKey]int64 // bytes of each stream at the last sample.
+}
+
+// Add appends the event, dropping the oldest ones beyond TimelineSize.
+func (t *Timeline) Add(e TimelineEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.events) >= TimelineSize {
+		t.events = slices.Delete(t.events, 0, len(t.events)-TimelineSize+1)
+	}
+	t.events = append(t.events, e)
+}
+
+// OnEvent adds a hook event, it is the Hooks.OnEvent.
+func (t *Timeline) OnEvent(event string, details map[string]string) {
+	var text string
+	switch event {
+	case EventPeerDiscovered:
+		text = fmt.Sprintf("discovered at %s, hash %s", details["peer_ip"], details["peer_hash"])
+	case EventPeerLost:
+		text = "lost"
+	case EventPeerStatus:
+		text = details["status"]
+	case EventPeerTrusted:
+		text = "trusted, hash " + details["peer_hash"]
+	case EventFileReceived:
+		size, _ := strconv.ParseInt(details["size"], 10, 64)
+		text = fmt.Sprintf("sent us %s (%s)", details["name"], ByteSize(size))
+	case EventConflict:
+		text = fmt.Sprintf("%s renamed %s, the name was taken", details["name"], filepath.Base(details["file"]))
+	default:
+		text = event
+	}
+	t.Add(TimelineEvent{Time: time.Now(), Event: event, Peer: details["peer"], Text: text})
+}
+
+// SampleTransfers adds the streams started or done since the last call. Returns true if it did.
+func (t *Timeline) SampleTransfers(list []tsnet.Transfer, now time.Time) bool {
+	streams := make(map[streamKey]int64, len(list))
+	changed := false
+	for _, tr := range list {
+		key := streamKey{tr.ID, tr.Peer, tr.Incoming}
+		streams[key] = tr.Bytes
+		if _, ok := t.streams[key]; !ok {
+			t.Add(TimelineEvent{Time: now, Event: EventTransferStarted, Peer: tr.Peer.Name,
+				Text: fmt.Sprintf("%s stream %d started", direction(tr.Incoming), tr.ID)})
+			changed = true
+		}
+	}
+	for key, n := range t.streams {
+		if _, ok := streams[key]; !ok {
+			t.Add(TimelineEvent{Time: now, Event: EventTransferDone, Peer: key.peer.Name,
+				Text: fmt.Sprintf("%s stream %d done, %s", direction(key.incoming), key.id, ByteSize(n))})
+			changed = true
+		}
+	}
+	t.streams = streams
+	return changed
+}
+
+func direction(incoming bool) string {
+	if incoming {
+		return "incoming"
+	}
+	return "outgoing"
+}
+
+// Events returns the events about the peers (names), all of them if none are given, oldest first.
+func (t *Timeline) Events(peers ...string) []TimelineEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(peers) == 0 {
+		return slices.Clone(t.events)
+	}
+	var events []TimelineEvent
+	for _, e := range t.events {
+		if slices.Contains(peers, e.Peer) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+var eventColors = map[string]tcolor.BasicColor{
+	EventPeerDiscovered:  tcolor.BrightGreen,
+	EventPeerLost:        tcolor.BrightRed,
+	EventPeerStatus:      tcolor.BrightYellow,
+	EventPeerTrusted:     tcolor.BrightPurple,
+	EventPeerRejected:    tcolor.Red,
+	EventFileReceived:    tcolor.BrightBlue,
+	EventConflict:        tcolor.BrightRed,
+	EventTransferStarted: tcolor.Blue,
+	EventTransferDone:    tcolor.Blue,
+}
+
+// Draw draws the latest events about the peers (all if none) which fit in the area,
+// scrolled Back lines.
+func (t *Timeline) Draw(ap *ansipixels.AnsiPixels, area tlayout.Rect, peers []string) {
+	events := t.Events(peers...)
+	if len(events) == 0 {
+		msg := "No events"
+		if len(peers) > 0 {
+			msg += " for " + strings.Join(peers, ", ")
+		}
+		ap.WriteAtStr(area.X+1, area.Y, DarkGray(msg))
+		return
+	}
+	t.Back = max(0, min(t.Back, len(events)-area.H))
+	end := len(events) - t.Back
+	for i, e := range events[max(0, end-area.H):end] {
+		color, ok := eventColors[e.Event]
+		if !ok {
+			color = tcolor.White
+		}
+		text := []rune(e.Text)
+		text = text[:max(0, min(len(text), area.W-len(time.TimeOnly)-len(e.Peer)-4))] // fit in the width.
+		line := DarkGray(e.Time.Format(time.TimeOnly)) + " " + Color16(tcolor.BrightCyan, e.Peer) + " " +
+			Color16(color, string(text))
+		ap.WriteAtStr(area.X+1, area.Y+i, line)
+	}
+}
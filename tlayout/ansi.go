@@ -0,0 +1,100 @@
+package tlayout
+
+import (
+	"strings"
+
+	"fortio.org/terminal/ansipixels"
+)
+
+// escapeLen returns the length of the escape sequence s starts with, 0 if none: CSI (ESC [, up to
+// its final byte, e.g. colors), OSC (ESC ], up to BEL or ESC \, e.g. hyperlinks) or ESC and one
+// more byte. An unterminated one runs to the end of s.
+func escapeLen(s string) int {
+	if len(s) < 2 || s[0] != '\x1b' {
+		return 0
+	}
+	switch s[1] {
+	case '[':
+		for i := 2; i < len(s); i++ {
+			if s[i] >= 0x40 && s[i] <= 0x7e {
+				return i + 1
+			}
+		}
+	case ']':
+		for i := 2; i < len(s); i++ {
+			if s[i] == '\a' {
+				return i + 1
+			}
+			if s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+		}
+	default:
+		return 2
+	}
+	return len(s)
+}
+
+// isReset returns true for the escape sequences resetting the colors and attributes.
+func isReset(esc string) bool {
+	return esc == "\x1b[m" || esc == "\x1b[0m"
+}
+
+// SliceCell returns the part of the cell between the screen columns start and end (excluded),
+// keeping all its escape sequences whole, including the ones outside of that part: they take no
+// room and set the colors of (or close the hyperlink around) the part kept. A wide character
+// across start or end is dropped. more, e.g. "…", is inserted at end when the cell is cut there,
+// in the colors of the cut character.
+func SliceCell(ap *ansipixels.AnsiPixels, cell string, start, end int, more string) string {
+	var sb strings.Builder
+	col := 0
+	cut := false
+	for i := 0; i < len(cell); {
+		if n := escapeLen(cell[i:]); n > 0 {
+			sb.WriteString(cell[i : i+n])
+			i += n
+			continue
+		}
+		j := i + 1
+		for j < len(cell) && cell[j] != '\x1b' && (cell[j]&0xc0) == 0x80 {
+			j++ // the rest of the rune's bytes.
+		}
+		w := ap.ScreenWidth(cell[i:j])
+		if col >= start && col+w <= end {
+			sb.WriteString(cell[i:j])
+		} else if col+w > end && !cut && w > 0 {
+			sb.WriteString(more)
+			cut = true
+		}
+		col += w
+		i = j
+	}
+	return sb.String()
+}
+
+// CloseCell returns the cell followed by a reset if it sets colors or attributes it doesn't
+// reset, so they don't leak into the padding and the next cells.
+func CloseCell(cell string) string {
+	open := false
+	for i := strings.IndexByte(cell, '\x1b'); i >= 0 && i < len(cell); {
+		n := escapeLen(cell[i:])
+		if n == 0 {
+			i++
+		} else {
+			esc := cell[i : i+n]
+			if strings.HasSuffix(esc, "m") && strings.HasPrefix(esc, "\x1b[") {
+				open = !isReset(esc)
+			}
+			i += n
+		}
+		next := strings.IndexByte(cell[i:], '\x1b')
+		if next < 0 {
+			break
+		}
+		i += next
+	}
+	if open {
+		return cell + ansipixels.Reset
+	}
+	return cell
+}
@@ -0,0 +1,54 @@
+package tlayout_test
+
+import (
+	"testing"
+
+	"fortio.org/tsync/tlayout"
+)
+
+func TestSliceCell(t *testing.T) {
+	ap, _ := tlayout.Headless(80, 5)
+	link := "\x1b]8;;https://fortio.org\x1b\\fortio\x1b]8;;\x1b\\"
+	tests := []struct {
+		cell       string
+		start, end int
+		more       string
+		want       string
+	}{
+		{"plain text", 0, 5, "", "plain"},
+		{"plain text", 0, 4, "…", "plai…"},
+		{"plain", 0, 5, "…", "plain"},
+		{"plain text", 6, 10, "", "text"},
+		{"\x1b[31mred\x1b[0m \x1b[32mgreen\x1b[0m", 0, 5, "…", "\x1b[31mred\x1b[0m \x1b[32mg…\x1b[0m"},
+		{"\x1b[31mred\x1b[0m \x1b[32mgreen\x1b[0m", 4, 7, "", "\x1b[31m\x1b[0m\x1b[32mgre\x1b[0m"},
+		{link, 0, 3, "…", "\x1b]8;;https://fortio.org\x1b\\for…\x1b]8;;\x1b\\"},
+		{"日本語", 0, 3, "…", "日…"},
+		{"日本語", 1, 6, "", "本語"},
+		{"\x1b[3", 0, 2, "", "\x1b[3"}, // unterminated.
+	}
+	for _, tt := range tests {
+		if got := tlayout.SliceCell(ap, tt.cell, tt.start, tt.end, tt.more); got != tt.want {
+			t.Errorf("SliceCell(%q, %d, %d) = %q, want %q", tt.cell, tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestCloseCell(t *testing.T) {
+	tests := []struct {
+		cell, want string
+	}{
+		{"plain", "plain"},
+		{"\x1b[31mred\x1b[0m", "\x1b[31mred\x1b[0m"},
+		{"\x1b[31mred\x1b[m", "\x1b[31mred\x1b[m"},
+		{"\x1b[7m\x1b[31m1\x1b[0m", "\x1b[7m\x1b[31m1\x1b[0m"},
+		{"\x1b[44mblue", "\x1b[44mblue\x1b[0m"},
+		{"\x1b[0m\x1b[1mbold", "\x1b[0m\x1b[1mbold\x1b[0m"},
+		{"\x1b[0;31mred", "\x1b[0;31mred\x1b[0m"},
+		{"\x1b[2Kclear", "\x1b[2Kclear"},
+	}
+	for _, tt := range tests {
+		if got := tlayout.CloseCell(tt.cell); got != tt.want {
+			t.Errorf("CloseCell(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+	}
+}
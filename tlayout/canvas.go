@@ -0,0 +1,96 @@
+package tlayout
+
+import (
+	"strings"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/terminal/ansipixels/tcolor"
+)
+
+// Canvas is a grid of cells to compose a drawing (lines, text) before drawing it in a pane area.
+// Each cell holds one (single width) character and its color.
+type Canvas struct {
+	W, H  int
+	cells [][]string
+}
+
+// NewCanvas returns a blank w x h Canvas.
+func NewCanvas(w, h int) *Canvas {
+	c := &Canvas{W: max(0, w), H: max(0, h)}
+	c.cells = make([][]string, c.H)
+	for y := range c.cells {
+		c.cells[y] = make([]string, c.W)
+		for x := range c.cells[y] {
+			c.cells[y][x] = " "
+		}
+	}
+	return c
+}
+
+// Set sets the cell at x, y (ignored outside the canvas) to the character ch in color
+// (an escape sequence, "" for the default).
+func (c *Canvas) Set(x, y int, ch rune, color string) {
+	if x < 0 || y < 0 || x >= c.W || y >= c.H {
+		return
+	}
+	if color == "" {
+		c.cells[y][x] = string(ch)
+		return
+	}
+	c.cells[y][x] = color + string(ch) + tcolor.Reset
+}
+
+// Line draws a line of ch from x0, y0 to x1, y1 (Bresenham's algorithm).
+func (c *Canvas) Line(x0, y0, x1, y1 int, ch rune, color string) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := sign(x1-x0), sign(y1-y0)
+	err := dx + dy
+	for {
+		c.Set(x0, y0, ch, color)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+// Text writes text from x, y, clipped to the canvas.
+func (c *Canvas) Text(x, y int, text, color string) {
+	for _, r := range text {
+		c.Set(x, y, r, color)
+		x++
+	}
+}
+
+// Draw writes the canvas in the area (its top left part if the area is smaller).
+func (c *Canvas) Draw(ap *ansipixels.AnsiPixels, area Rect) {
+	for y := range min(c.H, area.H) {
+		ap.WriteAtStr(area.X, area.Y+y, strings.Join(c.cells[y][:min(c.W, area.W)], ""))
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,28 @@
+package tlayout_test
+
+import (
+	"slices"
+	"testing"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/terminal/ansipixels/tcolor"
+	"fortio.org/tsync/tlayout"
+)
+
+func TestCanvas(t *testing.T) {
+	c := tlayout.NewCanvas(8, 4)
+	c.Line(0, 0, 6, 3, '*', "")
+	c.Line(7, 3, 7, 0, '|', tcolor.Green.Foreground())
+	c.Text(5, 0, "abcdef", "")
+	c.Set(-1, 9, 'x', "")
+	got := tlayout.Snapshot(8, 4, func(ap *ansipixels.AnsiPixels) { c.Draw(ap, tlayout.Rect{W: 8, H: 4}) })
+	expected := []string{
+		"*    abc",
+		" **    |",
+		"   **  |",
+		"     **|",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Canvas %q, expected %q", got, expected)
+	}
+}
@@ -0,0 +1,132 @@
+package tlayout
+
+import (
+	"slices"
+	"time"
+
+	"fortio.org/terminal/ansipixels"
+)
+
+// Default FrameRate settings.
+const (
+	DefaultFastFPS   = 60
+	DefaultIdleFPS   = 2
+	DefaultIdleAfter = 2 * time.Second
+)
+
+// FrameRate runs the terminal UI loop (like ansipixels' FPSTicks) at Fast frames per second while
+// there is activity (input, resize, Wake or Active calls) and drops to Idle ones after IdleAfter
+// without any, so an idle UI doesn't use CPU.
+type FrameRate struct {
+	Fast      float64
+	Idle      float64
+	IdleAfter time.Duration
+	wake      chan struct{}
+	active    time.Time
+	frames    int
+	second    time.Time
+	fps       float64
+}
+
+// NewFrameRate returns a FrameRate with the default settings.
+func NewFrameRate() *FrameRate {
+	return &FrameRate{Fast: DefaultFastFPS, Idle: DefaultIdleFPS, IdleAfter: DefaultIdleAfter, wake: make(chan struct{}, 1)}
+}
+
+// Wake makes the loop call its callback right away and go back to the Fast rate, e.g. when the
+// state shown changed. Can be called from any goroutine.
+func (r *FrameRate) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default: // already pending.
+	}
+}
+
+// Active keeps the Fast rate (for IdleAfter), to be called from the callback when it had
+// something to draw.
+func (r *FrameRate) Active() {
+	r.active = time.Now()
+}
+
+// Interval returns the time until the next frame at time now.
+func (r *FrameRate) Interval(now time.Time) time.Duration {
+	if now.Sub(r.active) < r.IdleAfter {
+		return time.Duration(float64(time.Second) / r.Fast)
+	}
+	return time.Duration(float64(time.Second) / r.Idle)
+}
+
+// FPS returns the frames per second measured over the last second.
+func (r *FrameRate) FPS() float64 {
+	return r.fps
+}
+
+// Ticks calls callback with the input, if any, in ap.Data (mouse events decoded) at each frame,
+// as soon as there is input, a resize or a Wake, until it returns false. The input is read in
+// the background with the Idle interval as timeout.
+func (r *FrameRate) Ticks(ap *ansipixels.AnsiPixels, callback func() bool) error {
+	timeout := time.Duration(float64(time.Second) / r.Idle)
+	input := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			ap.SharedInput.ChangeTimeout(timeout) // select() on linux leaves the remaining time in it.
+			n, err := ap.SharedInput.ReadWithTimeout(buf)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if n == 0 {
+				select {
+				case <-done:
+					return
+				default:
+					continue
+				}
+			}
+			select {
+			case input <- slices.Clone(buf[:n]):
+			case <-done:
+				return
+			}
+		}
+	}()
+	ap.Out.Flush() // terminal modes, as FPSTicks.
+	r.Active()
+	r.second = time.Now()
+	timer := time.NewTimer(r.Interval(time.Now()))
+	defer timer.Stop()
+	for {
+		ap.Data = nil
+		select {
+		case s := <-ap.C:
+			if err := ap.HandleSignal(s); err != nil {
+				return err
+			}
+			r.Active()
+		case err := <-readErr:
+			return err
+		case <-r.wake:
+			r.Active()
+		case ap.Data = <-input:
+			if !ap.NoDecode {
+				ap.MouseDecodeAll()
+			}
+			r.Active()
+		case <-timer.C:
+		}
+		now := time.Now()
+		r.frames++
+		if elapsed := now.Sub(r.second); elapsed >= time.Second {
+			r.fps = float64(r.frames) / elapsed.Seconds()
+			r.frames, r.second = 0, now
+		}
+		if !callback() {
+			return nil
+		}
+		timer.Reset(r.Interval(time.Now()))
+	}
+}
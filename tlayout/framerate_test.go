@@ -0,0 +1,25 @@
+package tlayout_test
+
+import (
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tlayout"
+)
+
+func TestFrameRateInterval(t *testing.T) {
+	r := tlayout.NewFrameRate()
+	now := time.Now()
+	if got := r.Interval(now); got != 500*time.Millisecond {
+		t.Errorf("Never active should be idle, got %v", got)
+	}
+	r.Active()
+	if got := r.Interval(time.Now()); got != time.Second/60 {
+		t.Errorf("Active should be fast, got %v", got)
+	}
+	if got := r.Interval(time.Now().Add(tlayout.DefaultIdleAfter)); got != 500*time.Millisecond {
+		t.Errorf("Should be idle again after %v, got %v", tlayout.DefaultIdleAfter, got)
+	}
+	r.Wake()
+	r.Wake() // doesn't block when already pending.
+}
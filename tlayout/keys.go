@@ -0,0 +1,58 @@
+package tlayout
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Names of the keys which aren't a printable character, as returned by KeyName.
+var keyNames = map[string]string{
+	"\r":      "enter",
+	"\n":      "enter",
+	"\t":      "tab",
+	" ":       "space",
+	"\x1b":    "esc",
+	"\x7f":    "backspace",
+	KeyUp:     "up",
+	KeyDown:   "down",
+	"\x1b[C":  "right",
+	"\x1b[D":  "left",
+	"\x1b[H":  "home",
+	"\x1b[F":  "end",
+	"\x1b[5~": "pgup",
+	"\x1b[6~": "pgdown",
+}
+
+// KeyName returns the name of the key read from the terminal: the character itself when
+// printable, "ctrl-x" for control characters and "up", "enter", "tab", "space"... for the others
+// (see ValidKey). Returns "" for unknown escape sequences and inputs of several keys.
+func KeyName(data []byte) string {
+	if name, ok := keyNames[string(data)]; ok {
+		return name
+	}
+	r, size := utf8.DecodeRune(data)
+	switch {
+	case size == 0 || size != len(data) || r == utf8.RuneError:
+		return ""
+	case r >= 1 && r <= 26:
+		return fmt.Sprintf("ctrl-%c", 'a'+r-1)
+	case r < ' ':
+		return ""
+	default:
+		return string(r)
+	}
+}
+
+// ValidKey returns true if name is one of the names KeyName can return.
+func ValidKey(name string) bool {
+	for _, n := range keyNames {
+		if n == name {
+			return true
+		}
+	}
+	if len(name) == len("ctrl-a") && name[:5] == "ctrl-" && name[5] >= 'a' && name[5] <= 'z' {
+		return true
+	}
+	r, size := utf8.DecodeRuneInString(name)
+	return size > 0 && size == len(name) && r > ' ' && r != utf8.RuneError && r != 0x7f
+}
@@ -0,0 +1,43 @@
+package tlayout_test
+
+import (
+	"testing"
+
+	"fortio.org/tsync/tlayout"
+)
+
+func TestKeyName(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"q", "q"},
+		{"é", "é"},
+		{"\r", "enter"},
+		{"\t", "tab"},
+		{" ", "space"},
+		{"\x1b", "esc"},
+		{tlayout.KeyUp, "up"},
+		{"\x1b[D", "left"},
+		{"\x03", "ctrl-c"},
+		{"\x17", "ctrl-w"},
+		{"\x1b[99~", ""},
+		{"ab", ""},
+		{"", ""},
+		{"\x00", ""},
+	}
+	for _, tt := range tests {
+		got := tlayout.KeyName([]byte(tt.input))
+		if got != tt.expected {
+			t.Errorf("KeyName(%q) = %q, expected %q", tt.input, got, tt.expected)
+		}
+		if got != "" && !tlayout.ValidKey(got) {
+			t.Errorf("KeyName(%q) = %q isn't a ValidKey", tt.input, got)
+		}
+	}
+	for _, name := range []string{"", "ab", "ctrl-1", "ctrl-", "space2", " ", "\x7f"} {
+		if tlayout.ValidKey(name) {
+			t.Errorf("ValidKey(%q) should be false", name)
+		}
+	}
+}
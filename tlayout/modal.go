@@ -0,0 +1,210 @@
+package tlayout
+
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/terminal/ansipixels/tcolor"
+)
+
+// Key codes and sequences handled by the modals.
+const (
+	KeyEnter     = '\r'
+	KeyEscape    = 27
+	KeyBackspace = 127
+	KeyCtrlH     = 8
+	KeyCtrlU     = 21
+	KeyUp        = "\x1b[A"
+	KeyDown      = "\x1b[B"
+)
+
+// PromptWidth is the minimum width of the Prompt input field.
+const PromptWidth = 30
+
+var (
+	_ Modal = (*Confirm)(nil)
+	_ Modal = (*Prompt)(nil)
+	_ Modal = (*Choice)(nil)
+	_ Modal = (*Message)(nil)
+)
+
+// Modal is a dialog drawn, centered, over the layout and taking all the keyboard input until done.
+type Modal interface {
+	Draw(ap *ansipixels.AnsiPixels)
+	// HandleKey processes input read from the terminal, returns true when the modal is done
+	// (its callback was called) and should be removed.
+	HandleKey(data []byte) bool
+}
+
+// DrawDialog draws a box with the title and lines centered on the screen (clearing its inside)
+// and returns the area of the lines.
+func DrawDialog(ap *ansipixels.AnsiPixels, title string, lines []string) Rect {
+	width := ap.ScreenWidth(title) + 2
+	for _, l := range lines {
+		width = max(width, ap.ScreenWidth(l))
+	}
+	width = min(width, max(0, ap.W-4))
+	r := Rect{X: (ap.W - width) / 2, Y: max(1, (ap.H-len(lines))/2), W: width, H: len(lines)}
+	blank := strings.Repeat(" ", width+2)
+	for y := -1; y <= r.H; y++ {
+		ap.MoveCursor(r.X-1, r.Y+y)
+		ap.WriteString(blank)
+	}
+	ap.DrawRoundBox(r.X-2, r.Y-1, r.W+4, r.H+2)
+	ap.WriteAtStr(r.X, r.Y-1, tcolor.BrightCyan.Foreground()+" "+title+" "+tcolor.Reset)
+	for i, l := range lines {
+		ap.WriteAtStr(r.X, r.Y+i, l)
+	}
+	return r
+}
+
+// Confirm asks a yes/no question: y or Enter (when Default) confirms, n, Escape or Enter
+// (when not Default) declines.
+type Confirm struct {
+	Title   string
+	Lines   []string // the question, possibly on several lines.
+	Default bool
+	OnDone  func(ok bool)
+}
+
+func (c *Confirm) Draw(ap *ansipixels.AnsiPixels) {
+	choices := "[y/N]"
+	if c.Default {
+		choices = "[Y/n]"
+	}
+	DrawDialog(ap, c.Title, append(slices.Clone(c.Lines), "", choices))
+}
+
+func (c *Confirm) HandleKey(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	switch data[0] {
+	case 'y', 'Y':
+		c.OnDone(true)
+	case KeyEscape:
+		if len(data) > 1 { // escape sequence (arrows etc), ignored.
+			return false
+		}
+		c.OnDone(false)
+	case 'n', 'N':
+		c.OnDone(false)
+	case KeyEnter, '\n':
+		c.OnDone(c.Default)
+	default:
+		return false
+	}
+	return true
+}
+
+// Prompt asks for a line of text, Enter validates and Escape cancels; Mask hides the input
+// (e.g. for passphrases).
+type Prompt struct {
+	Title string
+	Label string
+	Value string // initial value, then what was typed.
+	Mask  bool
+	// Called with the value, ok is false when cancelled.
+	OnDone func(value string, ok bool)
+}
+
+func (p *Prompt) Draw(ap *ansipixels.AnsiPixels) {
+	shown := p.Value
+	if p.Mask {
+		shown = strings.Repeat("*", utf8.RuneCountInString(p.Value))
+	}
+	pad := strings.Repeat(" ", max(0, PromptWidth-utf8.RuneCountInString(shown)))
+	lines := []string{p.Label, tcolor.Inverse + " " + shown + "▏" + pad + tcolor.Reset}
+	DrawDialog(ap, p.Title, lines)
+}
+
+func (p *Prompt) HandleKey(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	switch data[0] {
+	case KeyEnter, '\n':
+		p.OnDone(p.Value, true)
+		return true
+	case KeyEscape:
+		if len(data) == 1 { // not an escape sequence (arrows etc, ignored).
+			p.OnDone(p.Value, false)
+			return true
+		}
+	case KeyBackspace, KeyCtrlH:
+		if _, size := utf8.DecodeLastRuneInString(p.Value); size > 0 {
+			p.Value = p.Value[:len(p.Value)-size]
+		}
+	case KeyCtrlU:
+		p.Value = ""
+	default:
+		for _, r := range string(data) {
+			if r >= ' ' && r != utf8.RuneError {
+				p.Value += string(r)
+			}
+		}
+	}
+	return false
+}
+
+// Choice asks to pick one of Options: arrows (or j/k) to move, Enter to pick, Escape to cancel,
+// 1-9 to pick directly.
+type Choice struct {
+	Title    string
+	Options  []string
+	Selected int
+	// Called with the index of the picked option, ok is false when cancelled.
+	OnDone func(idx int, ok bool)
+}
+
+func (c *Choice) Draw(ap *ansipixels.AnsiPixels) {
+	lines := make([]string, 0, len(c.Options))
+	for i, o := range c.Options {
+		if i == c.Selected {
+			lines = append(lines, tcolor.Inverse+"▶ "+o+tcolor.Reset)
+		} else {
+			lines = append(lines, "  "+o)
+		}
+	}
+	DrawDialog(ap, c.Title, lines)
+}
+
+func (c *Choice) HandleKey(data []byte) bool {
+	if len(data) == 0 || len(c.Options) == 0 {
+		return false
+	}
+	key := string(data)
+	switch {
+	case key == KeyUp || key == "k":
+		c.Selected = max(0, c.Selected-1)
+	case key == KeyDown || key == "j":
+		c.Selected = min(len(c.Options)-1, c.Selected+1)
+	case data[0] == KeyEnter || data[0] == '\n':
+		c.OnDone(c.Selected, true)
+		return true
+	case key == string(rune(KeyEscape)):
+		c.OnDone(c.Selected, false)
+		return true
+	case data[0] >= '1' && data[0] <= '9' && int(data[0]-'1') < len(c.Options):
+		c.Selected = int(data[0] - '1')
+		c.OnDone(c.Selected, true)
+		return true
+	}
+	return false
+}
+
+// Message shows lines (e.g. help) until any key is pressed.
+type Message struct {
+	Title string
+	Lines []string
+}
+
+func (m *Message) Draw(ap *ansipixels.AnsiPixels) {
+	DrawDialog(ap, m.Title, append(slices.Clone(m.Lines), "", "Press any key to close"))
+}
+
+func (m *Message) HandleKey(data []byte) bool {
+	return len(data) > 0
+}
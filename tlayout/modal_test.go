@@ -0,0 +1,91 @@
+package tlayout_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/tsync/tlayout"
+)
+
+// keys feeds each of the inputs to m, returns whether it was done and at which input.
+func keys(m tlayout.Modal, inputs ...string) (bool, int) {
+	for i, in := range inputs {
+		if m.HandleKey([]byte(in)) {
+			return true, i
+		}
+	}
+	return false, len(inputs)
+}
+
+func TestConfirm(t *testing.T) {
+	tests := []struct {
+		def      bool
+		inputs   []string
+		expected bool
+		at       int
+	}{
+		{false, []string{"x", tlayout.KeyUp, "y"}, true, 2},
+		{true, []string{"\r"}, true, 0},
+		{false, []string{"\r"}, false, 0},
+		{true, []string{"\x1b"}, false, 0},
+		{true, []string{"N"}, false, 0},
+	}
+	for _, tt := range tests {
+		var got *bool
+		c := &tlayout.Confirm{Title: "Trust", Lines: []string{"Trust bob?"}, Default: tt.def, OnDone: func(ok bool) { got = &ok }}
+		done, at := keys(c, tt.inputs...)
+		if !done || at != tt.at || got == nil || *got != tt.expected {
+			t.Errorf("Confirm(default %v) %q: done %v at %d, got %v", tt.def, tt.inputs, done, at, got)
+		}
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	var value string
+	var ok bool
+	p := &tlayout.Prompt{Title: "Name", Label: "New name:", Value: "ab", OnDone: func(v string, o bool) { value, ok = v, o }}
+	done, _ := keys(p, "c", "dé", "\x7f", tlayout.KeyUp, "\x15", "xy", "\x08", "z", "\r")
+	if !done || !ok || value != "xz" {
+		t.Errorf("Prompt: done %v ok %v value %q", done, ok, value)
+	}
+	p = &tlayout.Prompt{Title: "Name", Label: "New name:", OnDone: func(v string, o bool) { value, ok = v, o }}
+	if done, _ = keys(p, "abc", "\x1b"); !done || ok {
+		t.Errorf("Prompt escape: done %v ok %v", done, ok)
+	}
+	var buf bytes.Buffer
+	ap := ansipixels.NewAnsiPixels(0)
+	ap.W, ap.H = 80, 24
+	ap.Out = bufio.NewWriter(&buf)
+	secret := &tlayout.Prompt{Title: "Backup", Label: "Passphrase:", Value: "hunter22", Mask: true}
+	secret.Draw(ap)
+	_ = ap.Out.Flush()
+	if out := buf.String(); strings.Contains(out, "hunter22") || !strings.Contains(out, "********") ||
+		!strings.Contains(out, "Passphrase:") {
+		t.Errorf("Masked prompt output %q", out)
+	}
+}
+
+func TestChoice(t *testing.T) {
+	var idx int
+	var ok bool
+	c := &tlayout.Choice{Title: "File", Options: []string{"a", "b", "c"}, OnDone: func(i int, o bool) { idx, ok = i, o }}
+	if done, _ := keys(c, tlayout.KeyDown, "j", "j", tlayout.KeyUp, "\r"); !done || !ok || idx != 1 {
+		t.Errorf("Choice: done %v ok %v idx %d", done, ok, idx)
+	}
+	if done, _ := keys(c, "3"); !done || !ok || idx != 2 {
+		t.Errorf("Choice by number: done %v ok %v idx %d", done, ok, idx)
+	}
+	if done, _ := keys(c, "4", "\x1b"); !done || ok {
+		t.Errorf("Choice escape: done %v ok %v", done, ok)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	m := &tlayout.Message{Title: "Keys", Lines: []string{"q: quit"}}
+	if done, at := keys(m, "", "x"); !done || at != 1 {
+		t.Errorf("Message: done %v at %d", done, at)
+	}
+}
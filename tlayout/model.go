@@ -0,0 +1,68 @@
+package tlayout
+
+import "fortio.org/terminal/ansipixels"
+
+// WidthPolicy bounds the width of a TableColumn's cells: the narrower ones are padded to Min and
+// the wider ones truncated to Max (see FitCell), both 0 (the zero value) to fit their content.
+// Min == Max fixes the width.
+type WidthPolicy struct {
+	Min int
+	Max int
+}
+
+// TableColumn is a column of a TableModel of rows of type R: the Column (title, alignment and
+// priority) and how to format its cell for a row.
+type TableColumn[R any] struct {
+	Column
+	Width  WidthPolicy
+	Format func(row R) string
+}
+
+// TableModel describes a table of rows of type R (e.g. a struct of what a line shows) by its
+// columns, so callers pass the rows and get the cells instead of formatting them by hand.
+type TableModel[R any] struct {
+	Columns []TableColumn[R]
+}
+
+// Titles returns the Columns as Column, e.g. for FitColumns and ColumnLayout.
+func (m *TableModel[R]) Titles() []Column {
+	columns := make([]Column, len(m.Columns))
+	for i, c := range m.Columns {
+		columns[i] = c.Column
+	}
+	return columns
+}
+
+// Row returns the cells of the row, formatted by each column and bounded by its WidthPolicy.
+func (m *TableModel[R]) Row(ap *ansipixels.AnsiPixels, row R) []string {
+	cells := make([]string, len(m.Columns))
+	for i, c := range m.Columns {
+		cells[i] = c.Width.Apply(ap, c.Format(row), c.Align)
+	}
+	return cells
+}
+
+// Rows returns the cells of the rows (see Row).
+func (m *TableModel[R]) Rows(ap *ansipixels.AnsiPixels, rows []R) [][]string {
+	result := make([][]string, len(rows))
+	for i, row := range rows {
+		result[i] = m.Row(ap, row)
+	}
+	return result
+}
+
+// Apply returns the cell padded or truncated according to align to fit the policy.
+func (w WidthPolicy) Apply(ap *ansipixels.AnsiPixels, cell string, align ansipixels.Alignment) string {
+	if w.Min <= 0 && w.Max <= 0 {
+		return cell
+	}
+	cw := ap.ScreenWidth(cell)
+	switch {
+	case w.Max > 0 && cw > w.Max:
+		return FitCell(ap, cell, w.Max, align)
+	case cw < w.Min:
+		return FitCell(ap, cell, w.Min, align)
+	default:
+		return cell
+	}
+}
@@ -0,0 +1,49 @@
+package tlayout_test
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/tsync/tlayout"
+)
+
+type host struct {
+	name string
+	port int
+}
+
+func TestTableModel(t *testing.T) {
+	ap, _ := tlayout.Headless(80, 5)
+	model := tlayout.TableModel[host]{Columns: []tlayout.TableColumn[host]{
+		{
+			Column: tlayout.Column{Title: "Name", Priority: tlayout.MustShow},
+			Width:  tlayout.WidthPolicy{Max: 6},
+			Format: func(h host) string { return h.name },
+		},
+		{
+			Column: tlayout.Column{Title: "Port", Align: ansipixels.Right, Priority: 1},
+			Width:  tlayout.WidthPolicy{Min: 5},
+			Format: func(h host) string { return strconv.Itoa(h.port) },
+		},
+	}}
+	titles := model.Titles()
+	if len(titles) != 2 || titles[0].Title != "Name" || titles[1].Align != ansipixels.Right {
+		t.Errorf("Titles = %+v", titles)
+	}
+	rows := model.Rows(ap, []host{{"a", 80}, {"a-long-name", 29556}})
+	want := [][]string{{"a", "   80"}, {"a-lon…", "29556"}}
+	for i := range want {
+		if !slices.Equal(rows[i], want[i]) {
+			t.Errorf("Row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+	fixed := tlayout.WidthPolicy{Min: 4, Max: 4}
+	if got := fixed.Apply(ap, "ab", ansipixels.Center); got != " ab " {
+		t.Errorf("Fixed width Apply = %q", got)
+	}
+	if got := (tlayout.WidthPolicy{}).Apply(ap, "as is", ansipixels.Left); got != "as is" {
+		t.Errorf("Zero policy Apply = %q", got)
+	}
+}
@@ -0,0 +1,133 @@
+package tlayout
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/terminal/ansipixels/tcolor"
+)
+
+// PaletteLines is the maximum number of matching items shown by Palette.
+const PaletteLines = 12
+
+var _ Modal = (*Palette)(nil)
+
+// FuzzyScore returns whether all the characters of query appear, in order (ignoring case), in s
+// and, if so, a score: higher for matches at word starts and consecutive ones, and ending earlier.
+func FuzzyScore(query, s string) (int, bool) {
+	score, prev, qi := 0, -2, 0
+	q := []rune(strings.ToLower(query))
+	runes := []rune(strings.ToLower(s))
+	for i, r := range runes {
+		if qi == len(q) {
+			break
+		}
+		if r != q[qi] {
+			continue
+		}
+		switch {
+		case i == prev+1:
+			score += 3
+		case i == 0 || !unicode.IsLetter(runes[i-1]):
+			score += 2
+		default:
+			score++
+		}
+		prev = i
+		qi++
+	}
+	if qi < len(q) {
+		return 0, false
+	}
+	return 100*score - prev, true
+}
+
+// Palette is a command palette: typing filters Items (with FuzzyScore), arrows move, Enter picks
+// and Escape cancels.
+type Palette struct {
+	Title string
+	Items []string
+	Query string
+	// Called with the index in Items of the picked item, ok is false when cancelled.
+	OnDone   func(idx int, ok bool)
+	selected int // in the matches.
+}
+
+// Matches returns the indexes of the Items matching the Query, best first.
+func (p *Palette) Matches() []int {
+	type match struct{ idx, score int }
+	var matches []match
+	for i, item := range p.Items {
+		if score, ok := FuzzyScore(p.Query, item); ok {
+			matches = append(matches, match{i, score})
+		}
+	}
+	if p.Query != "" {
+		slices.SortStableFunc(matches, func(a, b match) int { return b.score - a.score })
+	}
+	idx := make([]int, len(matches))
+	for i, m := range matches {
+		idx[i] = m.idx
+	}
+	return idx
+}
+
+func (p *Palette) Draw(ap *ansipixels.AnsiPixels) {
+	matches := p.Matches()
+	p.selected = max(0, min(p.selected, len(matches)-1))
+	pad := strings.Repeat(" ", max(0, PromptWidth-utf8.RuneCountInString(p.Query)))
+	lines := []string{tcolor.Inverse + " " + p.Query + "▏" + pad + tcolor.Reset}
+	first := max(0, p.selected-PaletteLines+1)
+	for i, idx := range matches[first:min(len(matches), first+PaletteLines)] {
+		if first+i == p.selected {
+			lines = append(lines, tcolor.Inverse+"▶ "+p.Items[idx]+tcolor.Reset)
+		} else {
+			lines = append(lines, "  "+p.Items[idx])
+		}
+	}
+	if len(matches) == 0 {
+		lines = append(lines, "  (no match)")
+	}
+	DrawDialog(ap, p.Title, lines)
+}
+
+func (p *Palette) HandleKey(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	key := string(data)
+	switch {
+	case key == KeyUp:
+		p.selected = max(0, p.selected-1)
+	case key == KeyDown:
+		p.selected++ // bounded by Draw.
+	case data[0] == KeyEnter || data[0] == '\n':
+		matches := p.Matches()
+		if len(matches) == 0 {
+			return false
+		}
+		p.OnDone(matches[max(0, min(p.selected, len(matches)-1))], true)
+		return true
+	case key == string(rune(KeyEscape)):
+		p.OnDone(-1, false)
+		return true
+	case data[0] == KeyBackspace || data[0] == KeyCtrlH:
+		if _, size := utf8.DecodeLastRuneInString(p.Query); size > 0 {
+			p.Query = p.Query[:len(p.Query)-size]
+			p.selected = 0
+		}
+	case data[0] == KeyCtrlU:
+		p.Query, p.selected = "", 0
+	case data[0] != KeyEscape:
+		for _, r := range key {
+			if r >= ' ' && r != utf8.RuneError {
+				p.Query += string(r)
+				p.selected = 0
+			}
+		}
+	}
+	return false
+}
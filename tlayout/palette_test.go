@@ -0,0 +1,52 @@
+package tlayout_test
+
+import (
+	"slices"
+	"testing"
+
+	"fortio.org/tsync/tlayout"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	for _, tt := range []struct {
+		query, s string
+		ok       bool
+	}{
+		{"", "anything", true},
+		{"cn", "Connect", true},
+		{"sf", "Send a file", true},
+		{"fs", "Send a file", false},
+		{"xyz", "Connect", false},
+	} {
+		if _, ok := tlayout.FuzzyScore(tt.query, tt.s); ok != tt.ok {
+			t.Errorf("FuzzyScore(%q, %q) ok %v, expected %v", tt.query, tt.s, ok, tt.ok)
+		}
+	}
+	prefix, _ := tlayout.FuzzyScore("tr", "Trust peers")
+	inside, _ := tlayout.FuzzyScore("tr", "Show transfers")
+	scattered, _ := tlayout.FuzzyScore("tr", "Token for a drop")
+	if prefix <= inside || inside <= scattered {
+		t.Errorf("Unexpected scores order %d %d %d", prefix, inside, scattered)
+	}
+}
+
+func TestPalette(t *testing.T) {
+	items := []string{"Connect", "Trust peers", "Send a file", "Show transfers"}
+	var idx int
+	var ok bool
+	p := &tlayout.Palette{Title: "Commands", Items: items, OnDone: func(i int, o bool) { idx, ok = i, o }}
+	if got := p.Matches(); !slices.Equal(got, []int{0, 1, 2, 3}) {
+		t.Errorf("All items should match the empty query, got %v", got)
+	}
+	keys(p, "t", "r")
+	if got := p.Matches(); !slices.Equal(got, []int{1, 3}) {
+		t.Errorf("Matches for %q: %v", p.Query, got)
+	}
+	if done, _ := keys(p, tlayout.KeyDown, "\r"); !done || !ok || idx != 3 {
+		t.Errorf("Palette: done %v ok %v idx %d", done, ok, idx)
+	}
+	p = &tlayout.Palette{Title: "Commands", Items: items, OnDone: func(i int, o bool) { idx, ok = i, o }}
+	if done, _ := keys(p, "zz", "\r", "\x7f", "\x7f", "\x1b"); !done || ok {
+		t.Errorf("Palette escape: done %v ok %v (query %q)", done, ok, p.Query)
+	}
+}
@@ -0,0 +1,240 @@
+package tlayout
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"fortio.org/terminal/ansipixels"
+)
+
+// Screen is a headless terminal: it interprets what the ansipixels functions write (cursor
+// moves, clears, scroll region, text; colors are dropped) into the screen contents, so what is
+// drawn can be tested without a terminal. Text is clipped at the right edge.
+type Screen struct {
+	W, H    int
+	cells   [][]string // grapheme per cell, "" for the second half of wide characters.
+	x, y    int
+	savedX  int
+	savedY  int
+	top     int // scroll region.
+	bottom  int
+	pending []byte // incomplete escape sequence or UTF-8 at the end of the last Write.
+	ap      *ansipixels.AnsiPixels
+}
+
+// NewScreen returns a blank w x h Screen.
+func NewScreen(w, h int) *Screen {
+	s := &Screen{W: w, H: h, bottom: h - 1, ap: ansipixels.NewAnsiPixels(0)}
+	s.cells = make([][]string, h)
+	for y := range s.cells {
+		s.cells[y] = make([]string, w)
+		s.clear(y, 0, w)
+	}
+	return s
+}
+
+// Headless returns an AnsiPixels of size w x h drawing on a new Screen (flush ap.Out before
+// reading it).
+func Headless(w, h int) (*ansipixels.AnsiPixels, *Screen) {
+	s := NewScreen(w, h)
+	ap := ansipixels.NewAnsiPixels(0)
+	ap.W, ap.H = w, h
+	ap.Out = bufio.NewWriter(s)
+	return ap, s
+}
+
+// Snapshot returns the lines of a w x h Screen after draw.
+func Snapshot(w, h int, draw func(ap *ansipixels.AnsiPixels)) []string {
+	ap, s := Headless(w, h)
+	draw(ap)
+	_ = ap.Out.Flush()
+	return s.Lines()
+}
+
+// Lines returns the screen contents, one string per line without trailing spaces.
+func (s *Screen) Lines() []string {
+	lines := make([]string, s.H)
+	for y, row := range s.cells {
+		lines[y] = strings.TrimRight(strings.Join(row, ""), " ")
+	}
+	return lines
+}
+
+// String returns the Lines joined with newlines.
+func (s *Screen) String() string {
+	return strings.Join(s.Lines(), "\n")
+}
+
+func (s *Screen) clear(y, from, to int) {
+	if y < 0 || y >= s.H {
+		return
+	}
+	for x := max(0, from); x < min(to, s.W); x++ {
+		s.cells[y][x] = " "
+	}
+}
+
+func (s *Screen) lineFeed() {
+	if s.y != s.bottom {
+		s.y = min(s.y+1, s.H-1)
+		return
+	}
+	copy(s.cells[s.top:s.bottom], s.cells[s.top+1:s.bottom+1])
+	s.cells[s.bottom] = make([]string, s.W)
+	s.clear(s.bottom, 0, s.W)
+}
+
+func (s *Screen) put(r rune) {
+	str := string(r)
+	w := s.ap.ScreenWidth(str)
+	if w == 0 { // combining character.
+		if s.x > 0 && s.x <= s.W && s.y < s.H {
+			s.cells[s.y][s.x-1] += str
+		}
+		return
+	}
+	if s.x+w <= s.W && s.y < s.H {
+		s.cells[s.y][s.x] = str
+		for i := 1; i < w; i++ {
+			s.cells[s.y][s.x+i] = ""
+		}
+	}
+	s.x += w
+}
+
+// csi handles the escape sequence ESC [ params final.
+func (s *Screen) csi(params string, final byte) {
+	if strings.HasPrefix(params, "?") {
+		return // private modes (cursor, mouse, sync...).
+	}
+	args := strings.Split(params, ";")
+	arg := func(i, def int) int {
+		if i >= len(args) {
+			return def
+		}
+		if n, err := strconv.Atoi(args[i]); err == nil {
+			return n
+		}
+		return def
+	}
+	switch final {
+	case 'H', 'f':
+		s.y, s.x = max(0, min(arg(0, 1)-1, s.H-1)), max(0, arg(1, 1)-1)
+	case 'G':
+		s.x = max(0, arg(0, 1)-1)
+	case 'A':
+		s.y = max(0, s.y-arg(0, 1))
+	case 'B':
+		s.y = min(s.H-1, s.y+arg(0, 1))
+	case 'C':
+		s.x += arg(0, 1)
+	case 'D':
+		s.x = max(0, s.x-arg(0, 1))
+	case 'J':
+		from, to := s.y+1, s.H
+		switch arg(0, 0) {
+		case 0:
+			s.clear(s.y, s.x, s.W)
+		case 1:
+			s.clear(s.y, 0, s.x+1)
+			from, to = 0, s.y
+		default:
+			from = 0
+		}
+		for y := from; y < to; y++ {
+			s.clear(y, 0, s.W)
+		}
+	case 'K':
+		switch arg(0, 0) {
+		case 0:
+			s.clear(s.y, s.x, s.W)
+		case 1:
+			s.clear(s.y, 0, s.x+1)
+		default:
+			s.clear(s.y, 0, s.W)
+		}
+	case 'r':
+		s.top, s.bottom = max(0, arg(0, 1)-1), min(s.H, arg(1, s.H))-1
+		if s.top >= s.bottom {
+			s.top, s.bottom = 0, s.H-1
+		}
+		s.x, s.y = 0, 0
+	case 's':
+		s.savedX, s.savedY = s.x, s.y
+	case 'u':
+		s.x, s.y = s.savedX, s.savedY
+	}
+}
+
+// Write interprets p, it never fails.
+func (s *Screen) Write(p []byte) (int, error) {
+	n := len(p)
+	data := append(s.pending, p...)
+	s.pending = nil
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == 27:
+			end := s.escape(data[i:])
+			if end == 0 {
+				s.pending = append([]byte(nil), data[i:]...)
+				return n, nil
+			}
+			i += end
+			continue
+		case c == '\r':
+			s.x = 0
+		case c == '\n':
+			s.lineFeed()
+		case c == '\b':
+			s.x = max(0, s.x-1)
+		case c < ' ' || c == 0x7f:
+			// other control characters (bell...) are ignored.
+		default:
+			r, size := utf8.DecodeRune(data[i:])
+			if r == utf8.RuneError && !utf8.FullRune(data[i:]) {
+				s.pending = append([]byte(nil), data[i:]...)
+				return n, nil
+			}
+			s.put(r)
+			i += size
+			continue
+		}
+		i++
+	}
+	return n, nil
+}
+
+// escape handles the escape sequence at the start of data and returns its length, 0 if incomplete.
+func (s *Screen) escape(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+	switch data[1] {
+	case '[':
+		for i := 2; i < len(data); i++ {
+			if data[i] >= '@' && data[i] <= '~' {
+				s.csi(string(data[2:i]), data[i])
+				return i + 1
+			}
+		}
+		return 0
+	case ']': // OSC, up to BEL or ST.
+		for i := 2; i < len(data); i++ {
+			if data[i] == 7 {
+				return i + 1
+			}
+			if data[i] == 27 && i+1 < len(data) && data[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return 0
+	case '7':
+		s.savedX, s.savedY = s.x, s.y
+	case '8':
+		s.x, s.y = s.savedX, s.savedY
+	}
+	return 2
+}
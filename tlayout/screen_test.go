@@ -0,0 +1,66 @@
+package tlayout_test
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/terminal/ansipixels/tcolor"
+	"fortio.org/tsync/tlayout"
+)
+
+func TestScreen(t *testing.T) {
+	s := tlayout.NewScreen(10, 3)
+	for _, part := range []string{"ab\x1b[2;", "3Hc\x1b[31m", "d\xc3", "\xa9\x1b[0m\r\n🔗x", "\x1b[1;2H\x1b[K", "\x1b]52;c;eA==\x07"} {
+		if n, err := s.Write([]byte(part)); n != len(part) || err != nil {
+			t.Fatalf("Write %q: %d %v", part, n, err)
+		}
+	}
+	expected := []string{"a", "  cdé", "🔗x"}
+	if got := s.Lines(); !slices.Equal(got, expected) {
+		t.Errorf("Screen lines %q, expected %q", got, expected)
+	}
+	s.Write([]byte("\x1b[2;3r\x1b[3;1Hnext\r\nlast\r\n0123456789abc"))
+	expected = []string{"a", "last", "0123456789"}
+	if got := s.Lines(); !slices.Equal(got, expected) {
+		t.Errorf("Screen lines after scrolling %q, expected %q", got, expected)
+	}
+}
+
+func TestSnapshotGolden(t *testing.T) {
+	peers := &tlayout.Pane{Title: "Peers", Min: 3}
+	peers.Draw = func(ap *ansipixels.AnsiPixels, area tlayout.Rect) {
+		lines := [][]string{{"Id", "Name"}, {"1", tcolor.Inverse + "alice"}, {"✓2", "bob"}}
+		ap.WriteTable(area.Y, []ansipixels.Alignment{ansipixels.Right, ansipixels.Left}, 1, lines,
+			ansipixels.BorderOuterColumns)
+	}
+	transfers := &tlayout.Pane{Title: "Transfers", Draw: func(ap *ansipixels.AnsiPixels, area tlayout.Rect) {
+		ap.WriteAtStr(area.X+1, area.Y, fmt.Sprintf("f.txt ▕%s▏", tlayout.ProgressBar(4, 0.5)))
+	}}
+	logs := &tlayout.Pane{Title: "Log"}
+	l := tlayout.New(&tlayout.Split{Children: []tlayout.Node{
+		peers,
+		&tlayout.Split{Horizontal: true, Children: []tlayout.Node{transfers, logs}},
+	}})
+	l.Resize(30, 12)
+	got := tlayout.Snapshot(30, 12, l.Draw)
+	expected := []string{
+		"━ Peers ──────────────────────",
+		"        ┌────┬───────┐",
+		"        │ Id │ Name  │",
+		"        │  1 │ alice │",
+		"        │ ✓2 │ bob   │",
+		"        └────┴───────┘",
+		"─ Transfers ──│─ Log ─────────",
+		" f.txt ▕██  ▏ │",
+		"              │",
+		"              │",
+		"              │",
+		"              │",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Snapshot:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
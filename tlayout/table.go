@@ -0,0 +1,251 @@
+package tlayout
+
+import (
+	"math"
+	"slices"
+	"strings"
+
+	"fortio.org/terminal/ansipixels"
+)
+
+// MustShow is the Priority of the columns FitColumns never hides.
+const MustShow = math.MaxInt
+
+// Column describes a column of a table drawn with ansipixels' WriteTable.
+type Column struct {
+	Title string
+	Align ansipixels.Alignment
+	// When the table is too wide, the columns are hidden lowest Priority first (the rightmost
+	// first on ties), down to the MustShow ones.
+	Priority int
+}
+
+// TableWidth returns the width of a table with BorderOuterColumns borders and padding spaces
+// around the cells, whose columns are widths wide.
+func TableWidth(widths []int, padding int) int {
+	w := 1 // left border.
+	for _, cw := range widths {
+		w += cw + 2*padding + 1 // and the separator or right border.
+	}
+	return w
+}
+
+// FitColumns returns the indexes of the columns to show so the table of rows (cells of the
+// columns, e.g. a title line included) fits in width, see Column.Priority. The MustShow ones
+// are kept even if they don't fit.
+func FitColumns(ap *ansipixels.AnsiPixels, columns []Column, rows [][]string, width, padding int) []int {
+	return fitWidths(columns, ColumnWidths(ap, columns, rows, nil), width, padding)
+}
+
+// ColumnWidths returns the width of each column: the widest of its cells in rows, or the
+// layout's fixed one (layout can be nil).
+func ColumnWidths(ap *ansipixels.AnsiPixels, columns []Column, rows [][]string, layout *ColumnLayout) []int {
+	widths := make([]int, len(columns))
+	for _, row := range rows {
+		for i, cell := range row[:min(len(row), len(columns))] {
+			widths[i] = max(widths[i], ap.ScreenWidth(cell))
+		}
+	}
+	if layout != nil {
+		for i, c := range columns {
+			if w, ok := layout.Widths[c.Title]; ok {
+				widths[i] = w
+			}
+		}
+	}
+	return widths
+}
+
+func fitWidths(columns []Column, widths []int, width, padding int) []int {
+	visible := make([]int, len(columns))
+	for i := range visible {
+		visible[i] = i
+	}
+	// Hiding order: lowest priority first, rightmost first on ties.
+	order := slices.Clone(visible)
+	slices.SortStableFunc(order, func(a, b int) int {
+		if columns[a].Priority != columns[b].Priority {
+			if columns[a].Priority < columns[b].Priority {
+				return -1
+			}
+			return 1
+		}
+		return b - a
+	})
+	shown := func() []int {
+		w := make([]int, len(visible))
+		for i, c := range visible {
+			w[i] = widths[c]
+		}
+		return w
+	}
+	for _, c := range order {
+		if TableWidth(shown(), padding) <= width || columns[c].Priority == MustShow {
+			break
+		}
+		visible = slices.DeleteFunc(visible, func(v int) bool { return v == c })
+	}
+	return visible
+}
+
+// ScrollWindow returns the index of the first of n rows to show, count at a time, so the cursor
+// row stays visible, moving the previous first one as little as possible. Only building those
+// rows (and computing the widths from them) keeps huge tables cheap to draw.
+func ScrollWindow(n, count, cursor, first int) int {
+	if count <= 0 || n <= count {
+		return 0
+	}
+	first = max(min(first, cursor), cursor-count+1)
+	return max(0, min(first, n-count))
+}
+
+// SelectColumns returns the rows with only the cells of the columns (indexes, see FitColumns).
+func SelectColumns(rows [][]string, columns []int) [][]string {
+	result := make([][]string, len(rows))
+	for i, row := range rows {
+		result[i] = make([]string, len(columns))
+		for j, c := range columns {
+			result[i][j] = row[c]
+		}
+	}
+	return result
+}
+
+// ColumnLayout is the user's arrangement of a table's columns: their order and widths, by title so
+// it can be saved (as JSON) and still applies once columns are added or removed.
+type ColumnLayout struct {
+	Order  []string       `json:"order,omitempty"`  // titles in display order, the columns not in it after.
+	Widths map[string]int `json:"widths,omitempty"` // fixed widths, the cells are truncated or padded.
+}
+
+// MinColumnWidth is the smallest width Resize sets.
+const MinColumnWidth = 1
+
+// Fit is FitColumns with the layout's fixed widths, the indexes of the columns to show being
+// in the layout's order.
+func (l *ColumnLayout) Fit(ap *ansipixels.AnsiPixels, columns []Column, rows [][]string, width, padding int) []int {
+	return l.Arrange(columns, fitWidths(columns, ColumnWidths(ap, columns, rows, l), width, padding))
+}
+
+// Arrange returns the indexes of columns (e.g. the ones to show) sorted in the layout's order.
+func (l *ColumnLayout) Arrange(columns []Column, indexes []int) []int {
+	rank := func(c int) int {
+		if r := slices.Index(l.Order, columns[c].Title); r >= 0 {
+			return r
+		}
+		return len(l.Order) + c
+	}
+	result := slices.Clone(indexes)
+	slices.SortStableFunc(result, func(a, b int) int { return rank(a) - rank(b) })
+	return result
+}
+
+// MoveTo moves the column (index) to the position of the target one in shown (the indexes of the
+// columns shown, in order, see Fit), the columns in between shifting towards the column's place.
+func (l *ColumnLayout) MoveTo(columns []Column, shown []int, column, target int) {
+	from, to := slices.Index(shown, column), slices.Index(shown, target)
+	if from < 0 || to < 0 || from == to {
+		return
+	}
+	all := make([]int, len(columns))
+	for i := range all {
+		all[i] = i
+	}
+	order := l.Arrange(columns, all)
+	order = slices.DeleteFunc(order, func(c int) bool { return c == column })
+	at := slices.Index(order, target)
+	if from < to {
+		at++ // after the target when moving right.
+	}
+	order = slices.Insert(order, at, column)
+	l.Order = make([]string, len(order))
+	for i, c := range order {
+		l.Order[i] = columns[c].Title
+	}
+}
+
+// Move moves the column (index) by delta positions in shown (see MoveTo), bounded by its ends.
+func (l *ColumnLayout) Move(columns []Column, shown []int, column, delta int) {
+	pos := slices.Index(shown, column)
+	if pos < 0 {
+		return
+	}
+	l.MoveTo(columns, shown, column, shown[max(0, min(len(shown)-1, pos+delta))])
+}
+
+// Resize sets the fixed width of the column, at least MinColumnWidth.
+func (l *ColumnLayout) Resize(column Column, width int) {
+	if l.Widths == nil {
+		l.Widths = make(map[string]int)
+	}
+	l.Widths[column.Title] = max(MinColumnWidth, width)
+}
+
+// Reset forgets the order and the widths, back to the columns' order and content widths.
+func (l *ColumnLayout) Reset() {
+	l.Order, l.Widths = nil, nil
+}
+
+// Cells returns SelectColumns(rows, shown) with the cells of the fixed width columns truncated
+// (ending with …) or padded according to their alignment to that width (see FitCell), the colors
+// of the others closed (see CloseCell).
+func (l *ColumnLayout) Cells(ap *ansipixels.AnsiPixels, columns []Column, rows [][]string, shown []int) [][]string {
+	result := SelectColumns(rows, shown)
+	for j, c := range shown {
+		w, ok := l.Widths[columns[c].Title]
+		for _, row := range result {
+			if ok {
+				row[j] = FitCell(ap, row[j], w, columns[c].Align)
+			} else {
+				row[j] = CloseCell(row[j])
+			}
+		}
+	}
+	return result
+}
+
+// FitCell returns the cell truncated (ending with …) or padded with spaces according to align to
+// be width wide, its colors reset before the padding (see SliceCell and CloseCell).
+func FitCell(ap *ansipixels.AnsiPixels, cell string, width int, align ansipixels.Alignment) string {
+	cw := ap.ScreenWidth(cell)
+	if cw > width {
+		cell = SliceCell(ap, cell, 0, width-1, "…")
+		cw = ap.ScreenWidth(cell)
+	}
+	cell = CloseCell(cell)
+	pad := width - cw
+	switch align {
+	case ansipixels.Right:
+		return strings.Repeat(" ", pad) + cell
+	case ansipixels.Center:
+		return strings.Repeat(" ", pad/2) + cell + strings.Repeat(" ", pad-pad/2)
+	default:
+		return cell + strings.Repeat(" ", pad)
+	}
+}
+
+// SeparatorAt returns the index in widths (of the columns shown, in order) of the column whose
+// right border is at x, relative to the table's left border (see TableWidth), -1 if none.
+func SeparatorAt(widths []int, padding, x int) int {
+	pos := 0 // left border.
+	for i, w := range widths {
+		pos += w + 2*padding + 1
+		if x == pos {
+			return i
+		}
+	}
+	return -1
+}
+
+// ColumnAt returns the index in widths of the column whose cells (padding included) are at x,
+// relative to the table's left border, -1 if none (borders included).
+func ColumnAt(widths []int, padding, x int) int {
+	pos := 0
+	for i, w := range widths {
+		if x > pos && x <= pos+w+2*padding {
+			return i
+		}
+		pos += w + 2*padding + 1
+	}
+	return -1
+}
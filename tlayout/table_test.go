@@ -0,0 +1,144 @@
+package tlayout_test
+
+import (
+	"slices"
+	"testing"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/tsync/tlayout"
+)
+
+func TestFitColumns(t *testing.T) {
+	columns := []tlayout.Column{
+		{Title: "Id", Priority: tlayout.MustShow},
+		{Title: "Name", Priority: tlayout.MustShow},
+		{Title: "Ip", Priority: 3},
+		{Title: "Port", Priority: 1},
+		{Title: "Hash", Priority: 2},
+		{Title: "Extra", Priority: 1},
+	}
+	rows := [][]string{
+		{"Id", "Name", "Ip", "Port", "Hash", "Extra"},
+		{"1", "a-long-name", "192.168.1.2", "29556", "word-word-word", "x"},
+	}
+	ap, _ := tlayout.Headless(100, 5)
+	full := ap.WriteTable(0, make([]ansipixels.Alignment, len(columns)), 1, rows, ansipixels.BorderOuterColumns)
+	widths := []int{2, 11, 11, 5, 14, 5}
+	if got := tlayout.TableWidth(widths, 1); got != full {
+		t.Errorf("TableWidth = %d, WriteTable drew %d", got, full)
+	}
+	tests := []struct {
+		width int
+		want  []int
+	}{
+		{full, []int{0, 1, 2, 3, 4, 5}},
+		{full - 1, []int{0, 1, 2, 3, 4}}, // rightmost of the lowest priority first.
+		{full - 8, []int{0, 1, 2, 3, 4}},
+		{full - 9, []int{0, 1, 2, 4}}, // then Port.
+		{full - 17, []int{0, 1, 2}},   // then Hash.
+		{tlayout.TableWidth(widths[:2], 1), []int{0, 1}},
+		{5, []int{0, 1}}, // the MustShow ones stay.
+	}
+	for _, tt := range tests {
+		if got := tlayout.FitColumns(ap, columns, rows, tt.width, 1); !slices.Equal(got, tt.want) {
+			t.Errorf("FitColumns(%d) = %v, want %v", tt.width, got, tt.want)
+		}
+	}
+	got := tlayout.SelectColumns(rows, []int{0, 4})
+	if !slices.Equal(got[0], []string{"Id", "Hash"}) || !slices.Equal(got[1], []string{"1", "word-word-word"}) {
+		t.Errorf("SelectColumns = %q", got)
+	}
+}
+
+func TestColumnLayout(t *testing.T) {
+	columns := []tlayout.Column{
+		{Title: "Id", Align: ansipixels.Right, Priority: tlayout.MustShow},
+		{Title: "Name", Align: ansipixels.Left, Priority: tlayout.MustShow},
+		{Title: "Ip", Align: ansipixels.Center, Priority: 1},
+		{Title: "Hash", Priority: 2},
+	}
+	rows := [][]string{
+		{"Id", "Name", "Ip", "Hash"},
+		{"1", "a-long-name", "192.168.1.2", "word-word-word"},
+	}
+	ap, _ := tlayout.Headless(100, 5)
+	var l tlayout.ColumnLayout
+	shown := l.Fit(ap, columns, rows, 100, 1)
+	if !slices.Equal(shown, []int{0, 1, 2, 3}) {
+		t.Fatalf("Fit without layout = %v", shown)
+	}
+	l.Move(columns, shown, 3, -2) // Hash before Name.
+	if shown = l.Fit(ap, columns, rows, 100, 1); !slices.Equal(shown, []int{0, 3, 1, 2}) {
+		t.Errorf("Fit after Move = %v, want [0 3 1 2]", shown)
+	}
+	l.MoveTo(columns, shown, 0, 2) // Id after Ip, moving right.
+	if shown = l.Fit(ap, columns, rows, 100, 1); !slices.Equal(shown, []int{3, 1, 2, 0}) {
+		t.Errorf("Fit after MoveTo = %v, want [3 1 2 0]", shown)
+	}
+	l.Move(columns, shown, 0, 5) // already last.
+	if got := l.Fit(ap, columns, rows, 100, 1); !slices.Equal(got, shown) {
+		t.Errorf("Fit after moving the last column right = %v, want %v", got, shown)
+	}
+	l.Resize(columns[1], 6)
+	l.Resize(columns[2], 13)
+	l.Resize(columns[0], -3)
+	widths := tlayout.ColumnWidths(ap, columns, rows, &l)
+	if !slices.Equal(widths, []int{tlayout.MinColumnWidth, 6, 13, 14}) {
+		t.Errorf("ColumnWidths with the layout = %v", widths)
+	}
+	cells := l.Cells(ap, columns, rows, []int{1, 2, 0})
+	want := [][]string{{"Name  ", "     Ip      ", "…"}, {"a-lon…", " 192.168.1.2 ", "1"}}
+	for i := range want {
+		if !slices.Equal(cells[i], want[i]) {
+			t.Errorf("Cells row %d = %q, want %q", i, cells[i], want[i])
+		}
+	}
+	// Colors are kept, the escapes whole, and reset before the padding.
+	if got := tlayout.FitCell(ap, "\x1b[31mred text\x1b[0m", 4, ansipixels.Left); got != "\x1b[31mred…\x1b[0m" {
+		t.Errorf("FitCell truncating = %q", got)
+	}
+	if got := tlayout.FitCell(ap, "\x1b[31mred\x1b[0m", 5, ansipixels.Right); got != "  \x1b[31mred\x1b[0m" {
+		t.Errorf("FitCell padding = %q", got)
+	}
+	if got := tlayout.FitCell(ap, "\x1b[44mblue", 6, ansipixels.Left); got != "\x1b[44mblue\x1b[0m  " {
+		t.Errorf("FitCell of an unreset background = %q", got)
+	}
+	// Table of widths 2 and 4 with padding 1: |_xx_|_xxxx_|
+	for x, want := range map[int]int{0: -1, 4: -1, 5: 0, 6: -1, 11: -1, 12: 1} {
+		if got := tlayout.SeparatorAt([]int{2, 4}, 1, x); got != want {
+			t.Errorf("SeparatorAt(%d) = %d, want %d", x, got, want)
+		}
+	}
+	for x, want := range map[int]int{0: -1, 1: 0, 4: 0, 5: -1, 6: 1, 11: 1, 12: -1} {
+		if got := tlayout.ColumnAt([]int{2, 4}, 1, x); got != want {
+			t.Errorf("ColumnAt(%d) = %d, want %d", x, got, want)
+		}
+	}
+	l.Reset()
+	if shown = l.Fit(ap, columns, rows, 100, 1); !slices.Equal(shown, []int{0, 1, 2, 3}) {
+		t.Errorf("Fit after Reset = %v", shown)
+	}
+}
+
+func TestScrollWindow(t *testing.T) {
+	tests := []struct {
+		n, count, cursor, first, want int
+	}{
+		{5, 10, 4, 3, 0}, // all fit.
+		{100, 10, 0, 0, 0},
+		{100, 10, 9, 0, 0},
+		{100, 10, 10, 0, 1},  // just enough to show the cursor.
+		{100, 10, 50, 5, 41}, // jumped down.
+		{100, 10, 45, 41, 41},
+		{100, 10, 40, 41, 40}, // up.
+		{100, 10, 99, 0, 90},
+		{100, 10, 0, 95, 0},
+		{20, 10, 15, 18, 10}, // the table shrank.
+		{100, 0, 50, 5, 0},
+	}
+	for _, tt := range tests {
+		if got := tlayout.ScrollWindow(tt.n, tt.count, tt.cursor, tt.first); got != tt.want {
+			t.Errorf("ScrollWindow(%d, %d, %d, %d) = %d, want %d", tt.n, tt.count, tt.cursor, tt.first, got, tt.want)
+		}
+	}
+}
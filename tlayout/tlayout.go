@@ -0,0 +1,309 @@
+// Package tlayout is a small layout manager for the terminal UI: the screen is split, recursively,
+// into panes stacked or side by side, each with a title line and a content area drawn by its
+// own function. Panes can be resized (Layout.Grow) and one has the focus (for keyboard input).
+// For instance:
+//
+//	peers := &tlayout.Pane{Title: "Peers", Draw: drawPeers}
+//	logs := &tlayout.Pane{Title: "Log"} // nil Draw: content left alone (scrolling log).
+//	layout := tlayout.New(&tlayout.Split{Children: []tlayout.Node{peers, logs}})
+//	layout.Resize(ap.W, ap.H) // and on each terminal resize.
+//	layout.Draw(ap)
+package tlayout
+
+import (
+	"strings"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/terminal/ansipixels/tcolor"
+)
+
+// Rect is an area of the screen, in cells, 0 based.
+type Rect struct {
+	X, Y, W, H int
+}
+
+// Contains returns whether the cell x, y is inside r.
+func (r Rect) Contains(x, y int) bool {
+	return x >= r.X && x < r.X+r.W && y >= r.Y && y < r.Y+r.H
+}
+
+// Node is a Pane or a Split.
+type Node interface {
+	base() *node
+	place(r Rect, panes *[]*Pane)
+	minSize(horizontal bool) int
+}
+
+type node struct {
+	weight int // share of the parent's space, relative to the siblings'.
+	parent *Split
+	rect   Rect // including the title line.
+}
+
+func (n *node) base() *node { return n }
+
+// SetWeight sets the share of the parent Split's space, relative to the siblings' (default 1).
+func (n *node) SetWeight(weight int) {
+	n.weight = weight
+}
+
+// Pane is a leaf of the layout: a title line and the content area below it.
+type Pane struct {
+	node
+	Title string
+	// Draw is called by Layout.Draw with the (cleared) content area. When nil the content
+	// area is neither cleared nor drawn (e.g. for a log using a terminal scroll region).
+	Draw func(ap *ansipixels.AnsiPixels, area Rect)
+	// Min is the minimum size of the content area: lines when stacked, columns when side by side.
+	Min int
+	// Area is the content area computed by the last Layout.Resize.
+	Area Rect
+}
+
+func (p *Pane) place(r Rect, panes *[]*Pane) {
+	p.rect = r
+	p.Area = Rect{X: r.X, Y: r.Y + 1, W: r.W, H: max(0, r.H-1)}
+	*panes = append(*panes, p)
+}
+
+func (p *Pane) minSize(horizontal bool) int {
+	if horizontal {
+		return p.Min
+	}
+	return p.Min + 1 // title line.
+}
+
+// Split divides its area between its Children, stacked (top to bottom) or, when Horizontal,
+// side by side (left to right, separated by a vertical line). Initially in equal parts.
+type Split struct {
+	node
+	Horizontal bool
+	Children   []Node
+}
+
+func (s *Split) minSize(horizontal bool) int {
+	total := 0
+	for _, c := range s.Children {
+		m := c.minSize(horizontal)
+		if horizontal == s.Horizontal {
+			total += m
+		} else {
+			total = max(total, m)
+		}
+	}
+	if horizontal && s.Horizontal && len(s.Children) > 1 {
+		total += len(s.Children) - 1 // separators.
+	}
+	return total
+}
+
+func (s *Split) place(r Rect, panes *[]*Pane) {
+	s.rect = r
+	if len(s.Children) == 0 {
+		return
+	}
+	total := r.H
+	if s.Horizontal {
+		total = r.W - (len(s.Children) - 1)
+	}
+	weights := make([]int, len(s.Children))
+	mins := make([]int, len(s.Children))
+	for i, c := range s.Children {
+		weights[i] = c.base().weight
+		mins[i] = c.minSize(s.Horizontal)
+	}
+	pos := 0
+	for i, size := range Share(max(0, total), weights, mins) {
+		child := Rect{X: r.X, Y: r.Y + pos, W: r.W, H: size}
+		if s.Horizontal {
+			child = Rect{X: r.X + pos, Y: r.Y, W: size, H: r.H}
+			pos++ // separator.
+		}
+		pos += size
+		s.Children[i].place(child, panes)
+	}
+}
+
+// Share splits total between parts of the given weights, each getting at least its min
+// when possible (the last parts get less when total is too small).
+func Share(total int, weights, mins []int) []int {
+	sizes := make([]int, len(weights))
+	left := total
+	sumWeights := 0
+	for i, m := range mins {
+		sizes[i] = min(m, left)
+		left -= sizes[i]
+		sumWeights += weights[i]
+	}
+	if left == 0 || sumWeights == 0 {
+		return sizes
+	}
+	// Proportional share of the whole (so sizes equal to the weights are kept exactly),
+	// the rounding leftovers go to the last part.
+	extra := left
+	for i, w := range weights {
+		want := total * w / sumWeights
+		add := min(max(0, want-sizes[i]), extra)
+		sizes[i] += add
+		extra -= add
+	}
+	sizes[len(sizes)-1] += extra
+	return sizes
+}
+
+// Layout is the tree of panes and the focus.
+type Layout struct {
+	Root  Node
+	panes []*Pane
+	focus int
+	w, h  int
+}
+
+// New returns the layout of root, the first pane having the focus.
+func New(root Node) *Layout {
+	l := &Layout{Root: root}
+	l.init(root, nil)
+	l.Resize(0, 0)
+	return l
+}
+
+func (l *Layout) init(n Node, parent *Split) {
+	b := n.base()
+	b.parent = parent
+	if b.weight <= 0 {
+		b.weight = 1
+	}
+	if s, ok := n.(*Split); ok {
+		for _, c := range s.Children {
+			l.init(c, s)
+		}
+	}
+}
+
+// Resize computes the panes' areas for a w x h screen.
+func (l *Layout) Resize(w, h int) {
+	l.w, l.h = w, h
+	l.panes = l.panes[:0]
+	l.Root.place(Rect{W: w, H: h}, &l.panes)
+}
+
+// Panes returns the panes, in order (top to bottom, left to right).
+func (l *Layout) Panes() []*Pane {
+	return l.panes
+}
+
+// Focused returns the pane with the focus.
+func (l *Layout) Focused() *Pane {
+	if len(l.panes) == 0 {
+		return nil
+	}
+	return l.panes[l.focus]
+}
+
+// FocusNext moves the focus to the next pane (cycling), e.g. on Tab.
+func (l *Layout) FocusNext() {
+	if len(l.panes) > 0 {
+		l.focus = (l.focus + 1) % len(l.panes)
+	}
+}
+
+// Focus gives the focus to p (if it's one of the layout's panes).
+func (l *Layout) Focus(p *Pane) {
+	for i, pane := range l.panes {
+		if pane == p {
+			l.focus = i
+		}
+	}
+}
+
+// PaneAt returns the pane containing the cell x, y (0 based), nil for separators.
+func (l *Layout) PaneAt(x, y int) *Pane {
+	for _, p := range l.panes {
+		if p.rect.Contains(x, y) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Grow makes the focused pane delta lines (or columns when side by side) larger, or smaller
+// when negative, taken from (or given to) its next sibling (previous for the last one).
+// Returns false when that's not possible (single pane, minimum sizes).
+func (l *Layout) Grow(delta int) bool {
+	p := l.Focused()
+	if p == nil || p.parent == nil || len(p.parent.Children) < 2 {
+		return false
+	}
+	s := p.parent
+	idx := 0
+	for i, c := range s.Children {
+		if c == Node(p) {
+			idx = i
+		}
+	}
+	other := idx + 1
+	if other == len(s.Children) {
+		other = idx - 1
+	}
+	size := func(n Node) int {
+		if s.Horizontal {
+			return n.base().rect.W
+		}
+		return n.base().rect.H
+	}
+	// Use the current sizes as weights so the change is exact.
+	for _, c := range s.Children {
+		c.base().weight = max(1, size(c))
+	}
+	mine, theirs := p.weight+delta, s.Children[other].base().weight-delta
+	if mine < p.minSize(s.Horizontal) || theirs < s.Children[other].minSize(s.Horizontal) {
+		return false
+	}
+	p.weight, s.Children[other].base().weight = mine, theirs
+	l.Resize(l.w, l.h)
+	return true
+}
+
+// Draw clears and draws the panes (title lines, separators and contents).
+func (l *Layout) Draw(ap *ansipixels.AnsiPixels) {
+	for i, p := range l.panes {
+		if p.rect.W <= 0 || p.rect.H <= 0 {
+			continue
+		}
+		name := []rune(p.Title)
+		name = name[:min(len(name), max(0, p.rect.W-3))]
+		title := tcolor.DarkGray.Foreground() + "─ " + string(name) + " "
+		if i == l.focus {
+			title = tcolor.BrightCyan.Foreground() + "━ " + string(name) + " "
+		}
+		ap.MoveCursor(p.rect.X, p.rect.Y)
+		ap.WriteString(title + strings.Repeat("─", max(0, p.rect.W-len(name)-3)) + tcolor.Reset)
+		if p.Draw == nil {
+			continue
+		}
+		blank := strings.Repeat(" ", p.Area.W)
+		for y := range p.Area.H {
+			ap.MoveCursor(p.Area.X, p.Area.Y+y)
+			ap.WriteString(blank)
+		}
+		p.Draw(ap, p.Area)
+	}
+	l.drawSeparators(ap, l.Root)
+}
+
+func (l *Layout) drawSeparators(ap *ansipixels.AnsiPixels, n Node) {
+	s, ok := n.(*Split)
+	if !ok {
+		return
+	}
+	for i, c := range s.Children {
+		if s.Horizontal && i > 0 {
+			x := c.base().rect.X - 1
+			for y := range s.rect.H {
+				ap.MoveCursor(x, s.rect.Y+y)
+				ap.WriteString(tcolor.DarkGray.Foreground() + "│" + tcolor.Reset)
+			}
+		}
+		l.drawSeparators(ap, c)
+	}
+}
@@ -0,0 +1,120 @@
+package tlayout_test
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/tsync/tlayout"
+)
+
+func TestShare(t *testing.T) {
+	tests := []struct {
+		total         int
+		weights, mins []int
+		expected      []int
+	}{
+		{10, []int{1, 1}, []int{0, 0}, []int{5, 5}},
+		{11, []int{1, 1}, []int{0, 0}, []int{5, 6}},
+		{10, []int{3, 7}, []int{0, 0}, []int{3, 7}},
+		{10, []int{1, 1}, []int{8, 0}, []int{8, 2}},
+		{5, []int{1, 1}, []int{4, 4}, []int{4, 1}},
+		{24, []int{1, 1, 1}, []int{2, 2, 2}, []int{8, 8, 8}},
+	}
+	for _, tt := range tests {
+		got := tlayout.Share(tt.total, tt.weights, tt.mins)
+		if !slices.Equal(got, tt.expected) {
+			t.Errorf("Share(%d, %v, %v) = %v, expected %v", tt.total, tt.weights, tt.mins, got, tt.expected)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	peers := &tlayout.Pane{Title: "Peers", Min: 3}
+	transfers := &tlayout.Pane{Title: "Transfers"}
+	details := &tlayout.Pane{Title: "Details"}
+	logs := &tlayout.Pane{Title: "Log"}
+	l := tlayout.New(&tlayout.Split{Children: []tlayout.Node{
+		peers,
+		&tlayout.Split{Horizontal: true, Children: []tlayout.Node{transfers, details}},
+		logs,
+	}})
+	l.Resize(81, 30)
+	if got := l.Panes(); len(got) != 4 || got[0] != peers || got[1] != transfers || got[2] != details || got[3] != logs {
+		t.Fatalf("Unexpected panes order %v", got)
+	}
+	expected := map[*tlayout.Pane]tlayout.Rect{
+		peers:     {X: 0, Y: 1, W: 81, H: 9},
+		transfers: {X: 0, Y: 11, W: 40, H: 9},
+		details:   {X: 41, Y: 11, W: 40, H: 9},
+		logs:      {X: 0, Y: 21, W: 81, H: 9},
+	}
+	for p, r := range expected {
+		if p.Area != r {
+			t.Errorf("%s area %+v, expected %+v", p.Title, p.Area, r)
+		}
+	}
+	if l.PaneAt(45, 15) != details || l.PaneAt(40, 15) != nil || l.PaneAt(0, 0) != peers {
+		t.Errorf("Unexpected PaneAt")
+	}
+	if l.Focused() != peers {
+		t.Errorf("First pane should have the focus initially")
+	}
+	if !l.Grow(5) || peers.Area.H != 14 || transfers.Area.Y != 16 || transfers.Area.H != 4 || logs.Area.H != 9 {
+		t.Errorf("Grow: peers %+v transfers %+v logs %+v", peers.Area, transfers.Area, logs.Area)
+	}
+	if l.Grow(5) {
+		t.Errorf("Grow beyond the sibling's minimum size should fail")
+	}
+	l.FocusNext()
+	if l.Focused() != transfers {
+		t.Errorf("FocusNext: %v", l.Focused().Title)
+	}
+	if !l.Grow(-10) || transfers.Area.W != 30 || details.Area.X != 31 || details.Area.W != 50 {
+		t.Errorf("Grow side by side: transfers %+v details %+v", transfers.Area, details.Area)
+	}
+	l.Focus(logs)
+	if !l.Grow(-7) || logs.Area.H != 2 || logs.Area.Y != 28 {
+		t.Errorf("Grow last pane: %+v", logs.Area)
+	}
+	// Sizes are kept, proportionally, on resize.
+	l.Resize(81, 60)
+	if peers.Area.H <= logs.Area.H {
+		t.Errorf("Resize lost the proportions: peers %+v logs %+v", peers.Area, logs.Area)
+	}
+	l.FocusNext()
+	if l.Focused() != peers {
+		t.Errorf("FocusNext should cycle")
+	}
+	if tlayout.New(&tlayout.Pane{Title: "Single"}).Grow(1) {
+		t.Errorf("Grow of a single pane should fail")
+	}
+}
+
+func TestDraw(t *testing.T) {
+	var drawn tlayout.Rect
+	peers := &tlayout.Pane{Title: "Peers", Draw: func(ap *ansipixels.AnsiPixels, area tlayout.Rect) {
+		drawn = area
+		ap.WriteAtStr(area.X, area.Y, "peer list")
+	}}
+	logs := &tlayout.Pane{Title: "Log"}
+	l := tlayout.New(&tlayout.Split{Children: []tlayout.Node{peers, logs}})
+	l.Resize(40, 10)
+	var buf bytes.Buffer
+	ap := ansipixels.NewAnsiPixels(0)
+	ap.Out = bufio.NewWriter(&buf)
+	l.Draw(ap)
+	_ = ap.Out.Flush()
+	out := buf.String()
+	if drawn != peers.Area {
+		t.Errorf("Draw called with %+v, expected %+v", drawn, peers.Area)
+	}
+	for _, s := range []string{"━ Peers ", "─ Log ", "peer list"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Draw output %q missing %q", out, s)
+		}
+	}
+}
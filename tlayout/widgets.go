@@ -0,0 +1,135 @@
+package tlayout
+
+import (
+	"strings"
+	"time"
+)
+
+// ProgressBlocks are the partial blocks used by ProgressBar, in eighths of a cell.
+var ProgressBlocks = []rune(" ▏▎▍▌▋▊▉█")
+
+// SparkBlocks are the blocks used by Sparkline, from lowest to highest.
+var SparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// ProgressBar returns a width cells bar filled for fraction (clamped to [0, 1]), with eighth of
+// a cell resolution.
+func ProgressBar(width int, fraction float64) string {
+	if width <= 0 {
+		return ""
+	}
+	fraction = max(0, min(1, fraction))
+	eighths := int(fraction * float64(width*8))
+	full := eighths / 8
+	var sb strings.Builder
+	sb.WriteString(strings.Repeat(string(ProgressBlocks[8]), full))
+	if full < width {
+		sb.WriteRune(ProgressBlocks[eighths%8])
+		sb.WriteString(strings.Repeat(" ", width-full-1))
+	}
+	return sb.String()
+}
+
+// Sparkline returns the last width values as a line of blocks scaled to the largest of them
+// (0 is a space), padded on the left to width cells.
+func Sparkline(values []float64, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	values = values[max(0, len(values)-width):]
+	peak := 0.
+	for _, v := range values {
+		peak = max(peak, v)
+	}
+	var sb strings.Builder
+	sb.WriteString(strings.Repeat(" ", width-len(values)))
+	for _, v := range values {
+		if v <= 0 || peak == 0 {
+			sb.WriteByte(' ')
+			continue
+		}
+		idx := int(v / peak * float64(len(SparkBlocks)-1))
+		sb.WriteRune(SparkBlocks[max(0, min(idx, len(SparkBlocks)-1))])
+	}
+	return sb.String()
+}
+
+// BarChart returns height lines of width cells charting the last width values as vertical bars
+// (eighth of a cell resolution) scaled to peak (or the largest value when peak is 0), padded on
+// the left.
+func BarChart(values []float64, width, height int, peak float64) []string {
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+	values = values[max(0, len(values)-width):]
+	if peak <= 0 {
+		for _, v := range values {
+			peak = max(peak, v)
+		}
+	}
+	lines := make([]strings.Builder, height)
+	for i := range lines {
+		lines[i].WriteString(strings.Repeat(" ", width-len(values)))
+	}
+	for _, v := range values {
+		eighths := 0
+		if peak > 0 && v > 0 {
+			eighths = max(1, min(height*8, int(v/peak*float64(height*8)))) // something shows.
+		}
+		for row := range lines {
+			level := eighths - (height-1-row)*8
+			switch {
+			case level <= 0:
+				lines[row].WriteByte(' ')
+			case level >= 8:
+				lines[row].WriteRune(SparkBlocks[7])
+			default:
+				lines[row].WriteRune(SparkBlocks[level-1])
+			}
+		}
+	}
+	res := make([]string, height)
+	for i := range lines {
+		res[i] = lines[i].String()
+	}
+	return res
+}
+
+// RateHistory keeps the rates (per second) computed from successive samples of a growing total
+// (e.g. bytes transferred so far), for Sparkline.
+type RateHistory struct {
+	size  int
+	rates []float64
+	total int64
+	last  time.Time
+}
+
+// NewRateHistory returns a RateHistory keeping the last size rates.
+func NewRateHistory(size int) *RateHistory {
+	return &RateHistory{size: size}
+}
+
+// Add records the total at time now (the first sample only sets the starting point).
+func (r *RateHistory) Add(total int64, now time.Time) {
+	if !r.last.IsZero() {
+		if elapsed := now.Sub(r.last).Seconds(); elapsed > 0 {
+			r.rates = append(r.rates, float64(total-r.total)/elapsed)
+			if len(r.rates) > r.size {
+				r.rates = r.rates[len(r.rates)-r.size:]
+			}
+		}
+	}
+	r.total, r.last = total, now
+}
+
+// Rates returns the recorded rates, oldest first.
+func (r *RateHistory) Rates() []float64 {
+	return r.rates
+}
+
+// Last returns the latest rate, 0 if there isn't one yet.
+func (r *RateHistory) Last() float64 {
+	if len(r.rates) == 0 {
+		return 0
+	}
+	return r.rates[len(r.rates)-1]
+}
@@ -0,0 +1,87 @@
+package tlayout_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"fortio.org/tsync/tlayout"
+)
+
+func TestProgressBar(t *testing.T) {
+	tests := []struct {
+		width    int
+		fraction float64
+		expected string
+	}{
+		{4, 0, "    "},
+		{4, 1, "████"},
+		{4, 2, "████"},
+		{4, -1, "    "},
+		{4, 0.5, "██  "},
+		{4, 0.5 + 1./32, "██▏ "},
+		{2, 0.9, "█▊"},
+		{0, 0.5, ""},
+	}
+	for _, tt := range tests {
+		got := tlayout.ProgressBar(tt.width, tt.fraction)
+		if got != tt.expected {
+			t.Errorf("ProgressBar(%d, %v) = %q, expected %q", tt.width, tt.fraction, got, tt.expected)
+		}
+		if n := utf8.RuneCountInString(got); n != tt.width {
+			t.Errorf("ProgressBar(%d, %v) is %d cells wide", tt.width, tt.fraction, n)
+		}
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	tests := []struct {
+		values   []float64
+		width    int
+		expected string
+	}{
+		{nil, 3, "   "},
+		{[]float64{0, 0}, 2, "  "},
+		{[]float64{1, 2, 4, 8}, 4, "▁▂▄█"},
+		{[]float64{1, 2, 4, 8}, 2, "▄█"},
+		{[]float64{5}, 3, "  █"},
+		{[]float64{0, 7, 3.5}, 3, " █▄"},
+	}
+	for _, tt := range tests {
+		if got := tlayout.Sparkline(tt.values, tt.width); got != tt.expected {
+			t.Errorf("Sparkline(%v, %d) = %q, expected %q", tt.values, tt.width, got, tt.expected)
+		}
+	}
+}
+
+func TestBarChart(t *testing.T) {
+	got := tlayout.BarChart([]float64{0, 1, 2, 3, 4, 0.01}, 7, 2, 4)
+	expected := []string{"    ▄█ ", "  ▄███▁"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("BarChart %q, expected %q", got, expected)
+	}
+	if got = tlayout.BarChart([]float64{5, 10}, 1, 1, 0); !slices.Equal(got, []string{"█"}) {
+		t.Errorf("BarChart scaled to the largest %q", got)
+	}
+}
+
+func TestRateHistory(t *testing.T) {
+	r := tlayout.NewRateHistory(3)
+	now := time.Now()
+	r.Add(100, now)
+	if r.Last() != 0 || len(r.Rates()) != 0 {
+		t.Errorf("First sample should only set the start: %v", r.Rates())
+	}
+	for i, total := range []int64{1100, 3100, 3100, 7100} {
+		r.Add(total, now.Add(time.Duration(i+1)*time.Second))
+	}
+	rates := r.Rates()
+	if len(rates) != 3 || rates[0] != 2000 || rates[1] != 0 || r.Last() != 4000 {
+		t.Errorf("Unexpected rates %v", rates)
+	}
+	r.Add(8100, now.Add(4500*time.Millisecond))
+	if r.Last() != 2000 {
+		t.Errorf("Rate over half a second: %v", r.Last())
+	}
+}
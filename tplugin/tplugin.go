@@ -0,0 +1,236 @@
+// Package tplugin is tsync's plugin engine: Starlark (a small, sandboxed, Python like language)
+// scripts, typically ~/.tsync/plugins/*.star, registering handlers for events and calling
+// a restricted tsync API. For instance:
+//
+//	def on_file(event):
+//	    print("received", event.name, "from", event.peer)
+//	    tsync.set_status("last file: " + event.name)
+//
+//	on("file-received", on_file)
+//
+// Plugins can't access the file system, network or environment other than through the tsync
+// module: tsync.peers() (list of structs with name, ip, port, hash, status and mtu fields),
+// tsync.send_file(peer, token, path) (drop a file in the peer's inbox) and tsync.set_status(text).
+// print() goes to the log. Each load and handler call is bounded in steps and time.
+package tplugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+const (
+	// Ext is the extension of the plugin files.
+	Ext = ".star"
+	// DefaultMaxSteps bounds the execution steps of each plugin load or handler call.
+	DefaultMaxSteps = 10_000_000
+	// DefaultTimeout bounds the duration of each plugin load or handler call.
+	DefaultTimeout = 30 * time.Second
+)
+
+// Peer is a peer as seen by the plugins.
+type Peer struct {
+	Name      string
+	IP        string
+	Port      int
+	HumanHash string
+	Status    string
+	MTU       int
+}
+
+// Host is the tsync API available to the plugins.
+type Host interface {
+	Peers() []Peer
+	SendFile(peer, token, path string) error
+	SetStatus(status string)
+}
+
+// Engine loads plugins and calls their handlers on events.
+type Engine struct {
+	Host     Host
+	MaxSteps uint64        // DefaultMaxSteps if 0
+	Timeout  time.Duration // DefaultTimeout if 0
+	mu       sync.Mutex
+	handlers map[string][]handler // event -> handlers
+	plugins  []string
+	callMu   sync.Mutex // handlers are called one at a time
+}
+
+type handler struct {
+	plugin string
+	fn     starlark.Callable
+}
+
+// New returns an engine (without plugins) giving the plugins access to host.
+func New(host Host) *Engine {
+	return &Engine{Host: host, handlers: make(map[string][]handler)}
+}
+
+// Plugins returns the names of the loaded plugins.
+func (e *Engine) Plugins() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.plugins)
+}
+
+// LoadDir loads all the plugins (Ext files) in dir, in name order. A missing dir isn't an error.
+// Plugins failing to load are reported in the (joined) error and don't stop the others from loading.
+func (e *Engine) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+Ext))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range files {
+		src, err := os.ReadFile(f)
+		if err == nil {
+			err = e.Load(strings.TrimSuffix(filepath.Base(f), Ext), src)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("plugin %s: %w", f, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Load runs the plugin's source (string or []byte), which registers its handlers with on(event, fn).
+func (e *Engine) Load(name string, src any) error {
+	thread, done := e.thread(name)
+	defer done()
+	predeclared := starlark.StringDict{
+		"on":    starlark.NewBuiltin("on", e.on),
+		"tsync": e.module(),
+	}
+	if _, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, name+Ext, src, predeclared); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.plugins = append(e.plugins, name)
+	e.mu.Unlock()
+	log.Infof("Loaded plugin %q", name)
+	return nil
+}
+
+// thread returns a new thread for the plugin, with the step and time limits, and the function
+// to call once done with it.
+func (e *Engine) thread(plugin string) (*starlark.Thread, func()) {
+	thread := &starlark.Thread{
+		Name: plugin,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Infof("Plugin %s: %s", plugin, msg)
+		},
+	}
+	maxSteps := e.MaxSteps
+	if maxSteps == 0 {
+		maxSteps = DefaultMaxSteps
+	}
+	thread.SetMaxExecutionSteps(maxSteps)
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	timer := time.AfterFunc(timeout, func() { thread.Cancel("timeout") })
+	return thread, func() { timer.Stop() }
+}
+
+// on is the on(event, fn) builtin registering fn as handler of event.
+func (e *Engine) on(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var event string
+	var fn starlark.Callable
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "event", &event, "fn", &fn); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.handlers[event] = append(e.handlers[event], handler{plugin: thread.Name, fn: fn})
+	e.mu.Unlock()
+	return starlark.None, nil
+}
+
+// Fire calls the handlers of event with a struct of details (plus an "event" field) as argument.
+// Handler errors are logged.
+func (e *Engine) Fire(event string, details map[string]string) {
+	e.mu.Lock()
+	handlers := slices.Clone(e.handlers[event])
+	e.mu.Unlock()
+	if len(handlers) == 0 {
+		return
+	}
+	fields := starlark.StringDict{"event": starlark.String(event)}
+	for k, v := range details {
+		fields[k] = starlark.String(v)
+	}
+	arg := starlarkstruct.FromStringDict(starlarkstruct.Default, fields)
+	arg.Freeze()
+	e.callMu.Lock()
+	defer e.callMu.Unlock()
+	for _, h := range handlers {
+		thread, done := e.thread(h.plugin)
+		_, err := starlark.Call(thread, h.fn, starlark.Tuple{arg}, nil)
+		done()
+		if err != nil {
+			log.Warnf("Plugin %s handler for %s failed: %v", h.plugin, event, err)
+		}
+	}
+}
+
+// module returns the tsync module (restricted API).
+func (e *Engine) module() *starlarkstruct.Module {
+	return &starlarkstruct.Module{
+		Name: "tsync",
+		Members: starlark.StringDict{
+			"peers":      starlark.NewBuiltin("peers", e.peers),
+			"send_file":  starlark.NewBuiltin("send_file", e.sendFile),
+			"set_status": starlark.NewBuiltin("set_status", e.setStatus),
+		},
+	}
+}
+
+func (e *Engine) peers(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	peers := e.Host.Peers()
+	list := make([]starlark.Value, 0, len(peers))
+	for _, p := range peers {
+		list = append(list, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"name":   starlark.String(p.Name),
+			"ip":     starlark.String(p.IP),
+			"port":   starlark.MakeInt(p.Port),
+			"hash":   starlark.String(p.HumanHash),
+			"status": starlark.String(p.Status),
+			"mtu":    starlark.MakeInt(p.MTU),
+		}))
+	}
+	return starlark.NewList(list), nil
+}
+
+func (e *Engine) sendFile(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var peer, token, path string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "peer", &peer, "token", &token, "path", &path); err != nil {
+		return nil, err
+	}
+	if err := e.Host.SendFile(peer, token, path); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+func (e *Engine) setStatus(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var status string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "status", &status); err != nil {
+		return nil, err
+	}
+	e.Host.SetStatus(status)
+	return starlark.None, nil
+}
@@ -0,0 +1,106 @@
+package tplugin_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tplugin"
+)
+
+type fakeHost struct {
+	mu     sync.Mutex
+	status string
+	sent   []string
+}
+
+func (h *fakeHost) Peers() []tplugin.Peer {
+	return []tplugin.Peer{{Name: "alice", IP: "10.0.0.1", Port: 1234, HumanHash: "123-4567", Status: "connected", MTU: 1500}}
+}
+
+func (h *fakeHost) SendFile(peer, token, path string) error {
+	if peer != "alice" {
+		return errors.New("unknown peer")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sent = append(h.sent, peer+" "+token+" "+path)
+	return nil
+}
+
+func (h *fakeHost) SetStatus(status string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status = status
+}
+
+const plugin = `
+def on_file(event):
+    for p in tsync.peers():
+        if p.name == event.peer and p.mtu == 1500:
+            tsync.send_file(p.name, "tok", event.file)
+    tsync.set_status(event.event + ": " + event.name)
+
+on("file-received", on_file)
+`
+
+func TestPlugin(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "forward"+tplugin.Ext), []byte(plugin), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken"+tplugin.Ext), []byte("on(\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ignored.txt"), []byte("not a plugin"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	host := &fakeHost{}
+	e := tplugin.New(host)
+	err := e.LoadDir(dir)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected an error for the broken plugin, got %v", err)
+	}
+	if got := e.Plugins(); len(got) != 1 || got[0] != "forward" {
+		t.Fatalf("Plugins() = %v, want [forward]", got)
+	}
+	e.Fire("peer-lost", map[string]string{"peer": "alice"}) // no handler.
+	e.Fire("file-received", map[string]string{"peer": "alice", "file": "/in/a.txt", "name": "a.txt"})
+	if host.status != "file-received: a.txt" {
+		t.Errorf("status %q", host.status)
+	}
+	if len(host.sent) != 1 || host.sent[0] != "alice tok /in/a.txt" {
+		t.Errorf("sent %v", host.sent)
+	}
+	// Errors in handlers (here from send_file) are only logged.
+	e.Fire("file-received", map[string]string{"peer": "bob", "file": "/in/b.txt", "name": "b.txt"})
+	if len(host.sent) != 1 {
+		t.Errorf("sent %v", host.sent)
+	}
+}
+
+func TestPluginLimits(t *testing.T) {
+	e := tplugin.New(&fakeHost{})
+	e.MaxSteps = 1000
+	if err := e.Load("loop", "def f():\n    for i in range(1000000):\n        pass\nf()\n"); err == nil {
+		t.Errorf("expected the steps limit to stop the plugin")
+	}
+	e.MaxSteps = 1 << 62
+	e.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	if err := e.Load("slow", "def f():\n    for i in range(1000000000):\n        pass\nf()\n"); err == nil ||
+		!strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected the timeout to stop the plugin, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("timeout took %v", d)
+	}
+	// No access to anything but the tsync module.
+	if err := e.Load("escape", "load('os', 'system')\n"); err == nil {
+		t.Errorf("expected load() to fail")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/terminal/ansipixels/tcolor"
+	"fortio.org/tsync/tlayout"
+	"fortio.org/tsync/tsnet"
+)
+
+// TrafficLabelWidth is the width of the labels column of the traffic graph.
+const TrafficLabelWidth = 22
+
+// TrafficHistory is the number of throughput samples (one per TransferSampleInterval) kept
+// per peer and in total.
+const TrafficHistory = 300
+
+type streamKey struct {
+	id       uint32
+	peer     tsnet.Peer
+	incoming bool
+}
+
+// TrafficStats samples the progress of the streams (tsnet.TransferManager.List) into the
+// throughput histories with each peer and in total, in and out combined.
+type TrafficStats struct {
+	Peers   map[tsnet.Peer]*tlayout.RateHistory
+	Total   *tlayout.RateHistory
+	totals  map[tsnet.Peer]int64 // bytes so far, per peer.
+	total   int64
+	streams map[streamKey]int64 // bytes of each stream at the last sample.
+	sampled time.Time
+}
+
+// NewTrafficStats returns empty TrafficStats.
+func NewTrafficStats() *TrafficStats {
+	return &TrafficStats{
+		Peers:   make(map[tsnet.Peer]*tlayout.RateHistory),
+		Total:   tlayout.NewRateHistory(TrafficHistory),
+		totals:  make(map[tsnet.Peer]int64),
+		streams: make(map[streamKey]int64),
+	}
+}
+
+// Sample records the streams' progress, at most every TransferSampleInterval. Returns true when
+// it did and there is or just was traffic.
+func (t *TrafficStats) Sample(list []tsnet.Transfer, now time.Time) bool {
+	if now.Sub(t.sampled) < TransferSampleInterval {
+		return false
+	}
+	prev := t.sampled
+	t.sampled = now
+	was := t.Total.Last() > 0
+	streams := make(map[streamKey]int64, len(list))
+	for _, tr := range list {
+		key := streamKey{tr.ID, tr.Peer, tr.Incoming}
+		streams[key] = tr.Bytes
+		delta := max(0, tr.Bytes-t.streams[key]) // new streams count from 0.
+		t.totals[tr.Peer] += delta
+		t.total += delta
+		if t.Peers[tr.Peer] == nil {
+			h := tlayout.NewRateHistory(TrafficHistory)
+			h.Add(0, prev) // its streams started since.
+			t.Peers[tr.Peer] = h
+		}
+	}
+	t.streams = streams
+	for peer, h := range t.Peers {
+		h.Add(t.totals[peer], now)
+	}
+	t.Total.Add(t.total, now)
+	return was || t.Total.Last() > 0
+}
+
+// Rate returns the latest throughput with the peer, in bytes per second.
+func (t *TrafficStats) Rate(peer tsnet.Peer) float64 {
+	if h := t.Peers[peer]; h != nil {
+		return h.Last()
+	}
+	return 0
+}
+
+// DrawTrafficGraph draws the chart of the total throughput over the last TrafficHistory samples
+// and, below it, a sparkline of the throughput with each peer (as many as fit).
+func DrawTrafficGraph(ap *ansipixels.AnsiPixels, area tlayout.Rect, t *TrafficStats) {
+	total := t.Total.Rates()
+	if len(total) == 0 {
+		ap.WriteAtStr(area.X+1, area.Y, DarkGray("No traffic yet"))
+		return
+	}
+	peers := slices.SortedFunc(maps.Keys(t.Peers), func(a, b tsnet.Peer) int { return strings.Compare(a.Name, b.Name) })
+	peers = peers[:min(len(peers), area.H/2)]
+	width := max(0, area.W-TrafficLabelWidth-2)
+	labels := []string{
+		fmt.Sprintf("%-10s %9s/s", "Total", ByteSize(int64(t.Total.Last()))),
+		fmt.Sprintf("%-10s %9s/s", "peak", ByteSize(int64(slices.Max(total)))),
+	}
+	for i, line := range tlayout.BarChart(total, width, area.H-len(peers), 0) {
+		label := ""
+		if i < len(labels) {
+			label = labels[i]
+		}
+		ap.WriteAtStr(area.X+1, area.Y+i, fmt.Sprintf("%-*s %s", TrafficLabelWidth, label, Color16(tcolor.BrightGreen, line)))
+	}
+	for i, peer := range peers {
+		h := t.Peers[peer]
+		label := fmt.Sprintf("%-10.10s %9s/s", peer.Name, ByteSize(int64(h.Last())))
+		ap.WriteAtStr(area.X+1, area.Y+area.H-len(peers)+i, fmt.Sprintf("%-*s %s", TrafficLabelWidth, label,
+			Color16(tcolor.BrightCyan, tlayout.Sparkline(h.Rates(), width))))
+	}
+}
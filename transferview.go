@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/tsync/tlayout"
+	"fortio.org/tsync/txfer"
+)
+
+const (
+	// TransferSampleInterval is how often the terminal UI samples the transfers' progress for their rates.
+	TransferSampleInterval = time.Second
+	// TransferHistory is the number of rate samples kept per transfer, for its sparkline.
+	TransferHistory = 60
+)
+
+// TransferView is the terminal UI's Transfers pane: the drops being received, each with a
+// progress bar and a sparkline of its recent rate.
+type TransferView struct {
+	Box     *txfer.DropBox
+	active  []txfer.DropProgress
+	history map[uint32]*tlayout.RateHistory
+	sampled time.Time
+}
+
+// Sample records the progress of the active drops, at most every TransferSampleInterval.
+// Returns true when it did and there is something (new) to show.
+func (v *TransferView) Sample(now time.Time) bool {
+	if now.Sub(v.sampled) < TransferSampleInterval {
+		return false
+	}
+	v.sampled = now
+	hadActive := len(v.active) > 0
+	v.active = v.Box.Active()
+	slices.SortFunc(v.active, func(a, b txfer.DropProgress) int { return strings.Compare(a.Name, b.Name) })
+	if v.history == nil {
+		v.history = make(map[uint32]*tlayout.RateHistory)
+	}
+	current := make(map[uint32]*tlayout.RateHistory, len(v.active))
+	for _, d := range v.active {
+		h := v.history[d.ID]
+		if h == nil {
+			h = tlayout.NewRateHistory(TransferHistory)
+		}
+		h.Add(d.Received, now)
+		current[d.ID] = h
+	}
+	v.history = current
+	return hadActive || len(v.active) > 0
+}
+
+// Draw is the Transfers pane's tlayout.Pane.Draw.
+func (v *TransferView) Draw(ap *ansipixels.AnsiPixels, area tlayout.Rect) {
+	if len(v.active) == 0 {
+		ap.WriteAtStr(area.X+1, area.Y, DarkGray("No transfers"))
+		return
+	}
+	for i, d := range v.active[:min(len(v.active), area.H)] {
+		fraction := 0.
+		if d.Size > 0 {
+			fraction = float64(d.Received) / float64(d.Size)
+		}
+		h := v.history[d.ID]
+		label := fmt.Sprintf("%s from %s", d.Name, d.From)
+		rate := fmt.Sprintf("%3.0f%% %9s/s", 100*fraction, ByteSize(int64(h.Last())))
+		// label, bar, rate and sparkline (as wide as the bar) sharing the width.
+		barWidth := max(10, area.W/4)
+		labelWidth := max(0, area.W-2*barWidth-len(rate)-6)
+		if len(label) > labelWidth {
+			label = label[:labelWidth]
+		}
+		line := fmt.Sprintf("%-*s ▕%s▏ %s %s", labelWidth, label, tlayout.ProgressBar(barWidth, fraction), rate,
+			tlayout.Sparkline(h.Rates(), barWidth))
+		ap.WriteAtStr(area.X+1, area.Y+i, line)
+	}
+}
+
+// ByteSize formats a number of bytes with binary (KiB, MiB, ...) units.
+func ByteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// EndorsementFrame is the first byte of the data messages carrying an endorsement.
+const EndorsementFrame = 'V'
+
+// EndorsementSends is how many times an endorsement is sent (there is no ack, receiving it again is a no-op).
+const EndorsementSends = 3
+
+// Endorsements is the policy for endorsements received from directly trusted peers (-endorsements flag).
+var Endorsements = tcrypto.EndorseWarn
+
+// ReceiveEndorsement handles an endorsement from peer (sent by `tsync endorse`) according to the
+// Endorsements policy, returns false if data isn't one.
+func ReceiveEndorsement(srv *tsnet.Server, peer tsnet.Peer, data []byte) bool {
+	if len(data) == 0 || data[0] != EndorsementFrame {
+		return false
+	}
+	if Endorsements == tcrypto.EndorseIgnore {
+		log.LogVf("Ignoring endorsement from %q", peer.Name)
+		return true
+	}
+	pub, err := tcrypto.IdentityPublicKeyString(peer.PublicKey)
+	if err != nil {
+		log.Errf("Invalid public key for %q: %v", peer.Name, err)
+		return true
+	}
+	e, err := tcrypto.VerifyEndorsement(string(data[1:]), pub)
+	if err != nil {
+		log.Errf("Invalid endorsement from %q: %v", peer.Name, err)
+		srv.RecordFailure(peer.IP, peer, "invalid endorsement")
+		return true
+	}
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		log.Errf("Failed to access storage: %v", err)
+		return true
+	}
+	entry, added, err := storage.AddEndorsement(srv.Identity, peer.PublicKey, e, Endorsements)
+	switch {
+	case errors.Is(err, tcrypto.ErrEndorserNotTrusted):
+		log.Warnf("Endorsement of %q from %q not used: %v", e.Name, peer.Name, err)
+		srv.RecordFailure(peer.IP, peer, "endorsement from an untrusted peer")
+	case err != nil:
+		log.Warnf("Endorsement of %q from %q not used: %v", e.Name, peer.Name, err)
+	case !added:
+		log.LogVf("Endorsement of %q from %q: already trusted", e.Name, peer.Name)
+	case entry.Warn:
+		log.Warnf("Trusting %q (hash %s) on %q's word: verify that hash with %s",
+			e.Name, KeyHash(e.PublicKey), peer.Name, e.Name)
+	default:
+		log.Infof("Trusting %q (hash %s) endorsed by %q", e.Name, KeyHash(e.PublicKey), peer.Name)
+	}
+	return true
+}
+
+// KeyHash returns the human hash of a public key string (as shown for peers).
+func KeyHash(pubKey string) string {
+	pub, err := tcrypto.IdentityPublicKeyString(pubKey)
+	if err != nil {
+		return "BAD-PKEY"
+	}
+	return tcrypto.HumanHash(pub)
+}
+
+// TrustedLabel returns how a trusted entry was verified, for listings.
+func TrustedLabel(e tcrypto.TrustEntry) string {
+	switch {
+	case e.EndorsedBy == "":
+		return "verified"
+	case e.Warn:
+		return "endorsed by " + KeyHash(e.EndorsedBy) + " (unverified)"
+	default:
+		return "endorsed by " + KeyHash(e.EndorsedBy)
+	}
+}
+
+// Trust lists the trusted peers, or with a peer name, trusts that (discovered) peer after
+// printing its hash, to be checked against the one the peer displays.
+func Trust(cfg *tsnet.Config, args []string, timeout time.Duration) int {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return log.FErrf("Failed to access storage: %v", err)
+	}
+	switch len(args) {
+	case 0:
+		entries, err := storage.TrustedKeys(cfg.Identity)
+		if err != nil {
+			return log.FErrf("Failed to read the trusted keys: %v", err)
+		}
+		for _, e := range entries {
+			fmt.Printf("%s %s %s\n", e.Name, KeyHash(e.PublicKey), TrustedLabel(e))
+		}
+		return 0
+	case 1:
+	default:
+		return log.FErrf("Usage: tsync trust [peer-name]")
+	}
+	srv := cfg.NewServer()
+	if err = srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer srv.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	peer, err := WaitForPeer(ctx, srv, args[0])
+	cancel()
+	if err != nil {
+		log.FErrf("Peer %q not found: %v", args[0], err)
+		return ExitNoPeer
+	}
+	// args[0] rather than the hidden name of a peer with -private-name (see IsPeer).
+	added, err := storage.Trust(cfg.Identity, tcrypto.TrustEntry{Name: args[0], PublicKey: peer.PublicKey})
+	if err != nil {
+		return log.FErrf("Failed to save the trusted key: %v", err)
+	}
+	if !added {
+		log.Infof("%q (%s) is already trusted", args[0], KeyHash(peer.PublicKey))
+		return 0
+	}
+	fmt.Printf("Trusting %q at %s, hash %s: check it matches the hash displayed by %q\n",
+		args[0], peer.IP, KeyHash(peer.PublicKey), args[0])
+	return 0
+}
+
+// Endorse sends our endorsement of the (directly trusted) peer name to the peer to.
+func Endorse(cfg *tsnet.Config, to, name string, timeout time.Duration) int {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return log.FErrf("Failed to access storage: %v", err)
+	}
+	entries, err := storage.TrustedKeys(cfg.Identity)
+	if err != nil {
+		return log.FErrf("Failed to read the trusted keys: %v", err)
+	}
+	var endorsed *tcrypto.TrustEntry
+	for i, e := range entries {
+		if e.Name == name && e.EndorsedBy == "" {
+			endorsed = &entries[i]
+		}
+	}
+	if endorsed == nil {
+		log.FErrf("%q isn't directly trusted (see tsync trust), can't endorse it", name)
+		return ExitUntrusted
+	}
+	srv := cfg.NewServer()
+	if err = srv.Start(context.Background()); err != nil {
+		return log.FErrf("Failed to start tsync server: %v", err)
+	}
+	defer srv.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	peer, err := ConnectPeer(ctx, srv, to, false)
+	cancel()
+	if err != nil {
+		log.FErrf("Can't connect to %q: %v", to, err)
+		return ConnectExitCode(err)
+	}
+	frame := append([]byte{EndorsementFrame}, cfg.Identity.Endorse(endorsed.Name, endorsed.PublicKey)...)
+	for range EndorsementSends {
+		if err = srv.SendData(peer, frame); err != nil {
+			return log.FErrf("Failed to send the endorsement to %q: %v", to, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Infof("Sent our endorsement of %q (%s) to %q", name, KeyHash(endorsed.PublicKey), to)
+	return 0
+}
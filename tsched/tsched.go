@@ -0,0 +1,373 @@
+// Package tsched schedules the sync jobs (snapshots of directories pushed to a peer) with
+// expressions like "every 15m", "daily 02:00", "weekly mon 02:00" or "on-connect". A job missed
+// while tsync (or its peer) wasn't running is caught up once, as soon as both are, instead of
+// waiting for its next scheduled time. The Scheduler only decides which jobs are due, running
+// them and talking to the peers is up to the caller.
+package tsched
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+// Kind is the kind of a Schedule.
+type Kind int
+
+const (
+	// Every runs the job at a fixed interval after its previous run.
+	Every Kind = iota
+	// Daily runs the job every day at a local time.
+	Daily
+	// Weekly runs the job every week on a day at a local time.
+	Weekly
+	// OnConnect runs the job each time its peer comes online (is discovered).
+	OnConnect
+)
+
+// MinInterval is the shortest interval of an Every schedule.
+const MinInterval = time.Minute
+
+// ErrInvalidSchedule is returned by Parse for expressions it doesn't understand.
+var ErrInvalidSchedule = errors.New(`invalid schedule, expecting "every <duration>", "daily HH:MM", ` +
+	`"weekly <day> HH:MM" or "on-connect"`)
+
+// Schedule is when a job runs, see Parse.
+type Schedule struct {
+	Kind     Kind
+	Interval time.Duration // of Every.
+	Weekday  time.Weekday  // of Weekly.
+	Hour     int           // of Daily and Weekly, local time.
+	Minute   int
+}
+
+// Parse parses a schedule expression: "every <duration>" (e.g. "every 15m", at least
+// MinInterval), "daily HH:MM", "weekly <day> HH:MM" (day as "mon" or "monday") or "on-connect".
+func Parse(expr string) (Schedule, error) {
+	words := strings.Fields(strings.ToLower(expr))
+	var s Schedule
+	var err error
+	switch {
+	case len(words) == 2 && words[0] == "every":
+		s.Kind = Every
+		if s.Interval, err = time.ParseDuration(words[1]); err != nil {
+			return s, fmt.Errorf("%w: %v", ErrInvalidSchedule, err)
+		}
+		if s.Interval < MinInterval {
+			return s, fmt.Errorf("%w: interval %v shorter than %v", ErrInvalidSchedule, s.Interval, MinInterval)
+		}
+	case len(words) == 2 && words[0] == "daily":
+		s.Kind = Daily
+		s.Hour, s.Minute, err = parseTime(words[1])
+	case len(words) == 3 && words[0] == "weekly":
+		s.Kind = Weekly
+		if s.Weekday, err = parseWeekday(words[1]); err == nil {
+			s.Hour, s.Minute, err = parseTime(words[2])
+		}
+	case len(words) == 1 && words[0] == "on-connect":
+		s.Kind = OnConnect
+	default:
+		err = ErrInvalidSchedule
+	}
+	return s, err
+}
+
+func parseTime(hhmm string) (int, int, error) {
+	h, m, ok := strings.Cut(hhmm, ":")
+	hour, errH := strconv.Atoi(h)
+	minute, errM := strconv.Atoi(m)
+	if !ok || errH != nil || errM != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, 0, fmt.Errorf("%w: bad time %q", ErrInvalidSchedule, hhmm)
+	}
+	return hour, minute, nil
+}
+
+func parseWeekday(day string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if day == name || day == name[:3] {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: bad day %q", ErrInvalidSchedule, day)
+}
+
+// String returns the schedule's expression, as parsed by Parse.
+func (s Schedule) String() string {
+	switch s.Kind {
+	case Every:
+		return "every " + s.Interval.String()
+	case Daily:
+		return fmt.Sprintf("daily %02d:%02d", s.Hour, s.Minute)
+	case Weekly:
+		return fmt.Sprintf("weekly %s %02d:%02d", strings.ToLower(s.Weekday.String()[:3]), s.Hour, s.Minute)
+	default:
+		return "on-connect"
+	}
+}
+
+// MarshalText makes schedules appear as their expression in JSON.
+func (s Schedule) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText parses the expression, see Parse.
+func (s *Schedule) UnmarshalText(text []byte) error {
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+// Next returns the first scheduled time strictly after after (zero for OnConnect, which isn't
+// time based). Daily and weekly times are in after's location.
+func (s Schedule) Next(after time.Time) time.Time {
+	switch s.Kind {
+	case Every:
+		return after.Add(s.Interval)
+	case Daily, Weekly:
+		next := time.Date(after.Year(), after.Month(), after.Day(), s.Hour, s.Minute, 0, 0, after.Location())
+		if s.Kind == Weekly {
+			next = next.AddDate(0, 0, (int(s.Weekday)-int(next.Weekday())+7)%7)
+		}
+		for !next.After(after) {
+			if s.Kind == Weekly {
+				next = next.AddDate(0, 0, 7)
+			} else {
+				next = next.AddDate(0, 0, 1)
+			}
+		}
+		return next
+	default:
+		return time.Time{}
+	}
+}
+
+// Job is a directories snapshot pushed to a backup target peer (running `tsync backup-target`)
+// on a schedule.
+type Job struct {
+	Name     string   `json:"name"`
+	Schedule Schedule `json:"schedule"`
+	Peer     string   `json:"peer"`
+	Dirs     []string `json:"dirs"`
+}
+
+// LoadJobs reads the jobs file (a JSON array of Job), returning no jobs when it doesn't exist.
+func LoadJobs(file string) ([]Job, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []Job
+	if err = json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	names := make(map[string]bool, len(jobs))
+	for i, j := range jobs {
+		switch {
+		case j.Name == "":
+			err = fmt.Errorf("job %d has no name", i+1)
+		case names[j.Name]:
+			err = fmt.Errorf("duplicate job %q", j.Name)
+		case j.Peer == "":
+			err = fmt.Errorf("job %q has no peer", j.Name)
+		case len(j.Dirs) == 0:
+			err = fmt.Errorf("job %q has no dirs", j.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		names[j.Name] = true
+	}
+	return jobs, nil
+}
+
+// Result is what we remember of a job between runs of tsync.
+type Result struct {
+	// When the job was first scheduled, its first run is its first scheduled time after that.
+	Added   time.Time `json:"added"`
+	LastRun time.Time `json:"last_run,omitzero"`
+	Bytes   int64     `json:"bytes,omitempty"`       // pushed by the last run.
+	Error   string    `json:"error,omitempty"`       // of the last run, empty if it succeeded.
+	LastOK  time.Time `json:"last_success,omitzero"` // of the last successful run.
+}
+
+// State is the Result of each job, by name.
+type State map[string]*Result
+
+// LoadState reads the state file, returning an empty state when it doesn't exist.
+func LoadState(file string) (State, error) {
+	state := make(State)
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return state, nil
+}
+
+// Save writes the state file.
+func (st State) Save(file string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tcrypto.WriteFileAtomic(file, append(data, '\n'), 0o644)
+}
+
+// JobStatus is a job with its next run and last result, for the UIs.
+type JobStatus struct {
+	Job
+	// Next run, zero for on-connect jobs which aren't pending. When before now the job is due
+	// (e.g. catching up) and runs as soon as its peer is online.
+	Next   time.Time `json:"next,omitzero"`
+	Online bool      `json:"peer_online"`
+	Result
+}
+
+// Scheduler tracks the jobs' results and which of their peers are online to tell which jobs
+// are due. It's safe for concurrent use.
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    []Job
+	state   State
+	online  map[string]bool      // peer names.
+	pending map[string]time.Time // when the peer of on-connect jobs came online, by job name.
+}
+
+// New returns the scheduler of jobs, with their results so far from state (updated in place,
+// see Scheduler.State). Jobs not in state are added as of now.
+func New(jobs []Job, state State, now time.Time) *Scheduler {
+	for _, j := range jobs {
+		if state[j.Name] == nil {
+			state[j.Name] = &Result{Added: now}
+		}
+	}
+	return &Scheduler{jobs: jobs, state: state, online: make(map[string]bool), pending: make(map[string]time.Time)}
+}
+
+// Jobs returns the number of jobs.
+func (s *Scheduler) Jobs() int {
+	return len(s.jobs)
+}
+
+// Online sets the names of the peers online at now; the on-connect jobs of the ones which
+// weren't become due.
+func (s *Scheduler) Online(now time.Time, peers []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	online := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		online[p] = true
+	}
+	for _, j := range s.jobs {
+		if j.Schedule.Kind == OnConnect && online[j.Peer] && !s.online[j.Peer] {
+			s.pending[j.Name] = now
+		}
+	}
+	s.online = online
+}
+
+// next returns the job's next run, zero for a non pending on-connect one.
+func (s *Scheduler) next(j Job) time.Time {
+	if j.Schedule.Kind == OnConnect {
+		return s.pending[j.Name] // zero if not pending.
+	}
+	r := s.state[j.Name]
+	after := r.LastRun
+	if after.IsZero() {
+		after = r.Added
+	}
+	return j.Schedule.Next(after.In(time.Local))
+}
+
+// Due returns the jobs due at now whose peer is online, in order.
+func (s *Scheduler) Due(now time.Time) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []Job
+	for _, j := range s.jobs {
+		if next := s.next(j); !next.IsZero() && !next.After(now) && s.online[j.Peer] {
+			due = append(due, j)
+		}
+	}
+	return due
+}
+
+// Done records the result of the job's run at at.
+func (s *Scheduler) Done(job string, at time.Time, bytes int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.state[job]
+	if r == nil {
+		return
+	}
+	delete(s.pending, job)
+	r.LastRun, r.Bytes, r.Error = at, bytes, ""
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.LastOK = at
+	}
+}
+
+// State returns a copy of the jobs' results, e.g. to Save.
+func (s *Scheduler) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := make(State, len(s.state))
+	for name, r := range s.state {
+		c := *r
+		st[name] = &c
+	}
+	return st
+}
+
+// Status returns the jobs with their next run and last result, ordered by next run (the on-connect
+// ones last).
+func (s *Scheduler) Status() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		list = append(list, JobStatus{Job: j, Next: s.next(j), Online: s.online[j.Peer], Result: *s.state[j.Name]})
+	}
+	slices.SortStableFunc(list, func(a, b JobStatus) int {
+		switch {
+		case a.Next.IsZero() || b.Next.IsZero():
+			return boolCmp(a.Next.IsZero(), b.Next.IsZero())
+		default:
+			return a.Next.Compare(b.Next)
+		}
+	})
+	return list
+}
+
+func boolCmp(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,169 @@
+package tsched_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsched"
+)
+
+func TestParse(t *testing.T) {
+	for _, expr := range []string{"every 15m0s", "daily 02:00", "weekly mon 23:59", "on-connect"} {
+		s, err := tsched.Parse(expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", expr, err)
+			continue
+		}
+		if got := s.String(); got != expr {
+			t.Errorf("Parse(%q).String() = %q", expr, got)
+		}
+	}
+	if s, err := tsched.Parse("Weekly Friday 7:05"); err != nil || s.Weekday != time.Friday || s.Hour != 7 || s.Minute != 5 {
+		t.Errorf("Parse weekly: %+v %v", s, err)
+	}
+	for _, bad := range []string{"", "every", "every 10s", "every soon", "daily 24:00", "daily 2", "weekly 02:00",
+		"weekly moon 02:00", "hourly", "on-connect now"} {
+		if _, err := tsched.Parse(bad); !errors.Is(err, tsched.ErrInvalidSchedule) {
+			t.Errorf("Parse(%q): expected ErrInvalidSchedule, got %v", bad, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC) // the 16th is a Friday.
+	}
+	tests := []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"every 15m", at(16, 10, 0), at(16, 10, 15)},
+		{"daily 02:00", at(16, 1, 0), at(16, 2, 0)},
+		{"daily 02:00", at(16, 2, 0), at(17, 2, 0)},
+		{"daily 02:00", at(16, 10, 0), at(17, 2, 0)},
+		{"weekly fri 02:00", at(16, 1, 0), at(16, 2, 0)},
+		{"weekly fri 02:00", at(16, 2, 0), at(23, 2, 0)},
+		{"weekly mon 02:00", at(16, 10, 0), at(19, 2, 0)},
+		{"on-connect", at(16, 10, 0), time.Time{}},
+	}
+	for _, tc := range tests {
+		s, err := tsched.Parse(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Next(tc.after); !got.Equal(tc.want) {
+			t.Errorf("%q after %v: got %v, want %v", tc.expr, tc.after, got, tc.want)
+		}
+	}
+}
+
+func job(name, expr, peer string) tsched.Job {
+	s, _ := tsched.Parse(expr)
+	return tsched.Job{Name: name, Schedule: s, Peer: peer, Dirs: []string{"/data"}}
+}
+
+func names(jobs []tsched.Job) []string {
+	var list []string
+	for _, j := range jobs {
+		list = append(list, j.Name)
+	}
+	return list
+}
+
+func TestScheduler(t *testing.T) {
+	start := time.Date(2026, 10, 16, 1, 0, 0, 0, time.Local)
+	jobs := []tsched.Job{
+		job("nightly", "daily 02:00", "nas"),
+		job("often", "every 15m", "nas"),
+		job("laptop", "on-connect", "laptop"),
+	}
+	s := tsched.New(jobs, make(tsched.State), start)
+	if due := s.Due(start.Add(time.Hour)); len(due) != 0 {
+		t.Errorf("Nothing should be due while the peers are offline, got %v", names(due))
+	}
+	s.Online(start, []string{"nas"})
+	if due := names(s.Due(start.Add(10 * time.Minute))); len(due) != 0 {
+		t.Errorf("Nothing should be due yet, got %v", due)
+	}
+	now := start.Add(90 * time.Minute)
+	if due := names(s.Due(now)); len(due) != 2 || due[0] != "nightly" || due[1] != "often" {
+		t.Errorf("Expected nightly and often due, got %v", due)
+	}
+	s.Done("nightly", now, 42, nil)
+	s.Done("often", now, 0, errors.New("boom"))
+	if due := names(s.Due(now.Add(time.Minute))); len(due) != 0 {
+		t.Errorf("Nothing should be due right after the runs, got %v", due)
+	}
+	s.Online(now, []string{"nas", "laptop"})
+	if due := names(s.Due(now)); len(due) != 1 || due[0] != "laptop" {
+		t.Errorf("Expected the on-connect job due, got %v", due)
+	}
+	s.Done("laptop", now, 1, nil)
+	s.Online(now, []string{"nas", "laptop"})
+	if due := names(s.Due(now)); len(due) != 0 {
+		t.Errorf("On-connect job should only run once per connection, got %v", due)
+	}
+	status := s.Status()
+	if len(status) != 3 || status[0].Name != "often" || status[1].Name != "nightly" || status[2].Name != "laptop" {
+		t.Fatalf("Unexpected status order %+v", status)
+	}
+	if status[0].Error != "boom" || !status[0].LastOK.IsZero() || !status[0].Next.Equal(now.Add(15*time.Minute)) {
+		t.Errorf("Unexpected status of the failed job %+v", status[0])
+	}
+	if status[1].Bytes != 42 || !status[1].Next.Equal(start.Add(25*time.Hour)) {
+		t.Errorf("Unexpected status of the nightly job %+v", status[1])
+	}
+	// Restart 3 days later: the nightly job is caught up once.
+	file := filepath.Join(t.TempDir(), "state.json")
+	if err := s.State().Save(file); err != nil {
+		t.Fatal(err)
+	}
+	state, err := tsched.LoadState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := now.Add(72 * time.Hour)
+	s = tsched.New(jobs, state, later)
+	s.Online(later, []string{"nas"})
+	if due := names(s.Due(later)); len(due) != 2 || due[0] != "nightly" || due[1] != "often" {
+		t.Errorf("Expected nightly and often caught up, got %v", due)
+	}
+	s.Done("nightly", later, 42, nil)
+	if due := names(s.Due(later.Add(time.Hour))); len(due) != 1 || due[0] != "often" {
+		t.Errorf("Expected only often still due, got %v", due)
+	}
+}
+
+func TestLoadJobs(t *testing.T) {
+	dir := t.TempDir()
+	if jobs, err := tsched.LoadJobs(filepath.Join(dir, "missing.json")); err != nil || jobs != nil {
+		t.Errorf("Missing file: %v %v", jobs, err)
+	}
+	file := filepath.Join(dir, "schedules.json")
+	write := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[{"name": "docs", "schedule": "daily 02:00", "peer": "nas", "dirs": ["/home/me/docs"]}]`)
+	jobs, err := tsched.LoadJobs(file)
+	if err != nil || len(jobs) != 1 || jobs[0].Schedule.Kind != tsched.Daily || jobs[0].Dirs[0] != "/home/me/docs" {
+		t.Errorf("LoadJobs: %+v %v", jobs, err)
+	}
+	for _, bad := range []string{
+		`[{"name": "docs", "schedule": "sometimes", "peer": "nas", "dirs": ["/x"]}]`,
+		`[{"name": "docs", "schedule": "on-connect", "dirs": ["/x"]}]`,
+		`[{"name": "docs", "schedule": "on-connect", "peer": "nas"}]`,
+		`[{"name": "a", "schedule": "on-connect", "peer": "nas", "dirs": ["/x"]},
+		  {"name": "a", "schedule": "on-connect", "peer": "nas", "dirs": ["/x"]}]`,
+	} {
+		write(bad)
+		if _, err = tsched.LoadJobs(file); err == nil {
+			t.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
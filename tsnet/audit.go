@@ -0,0 +1,201 @@
+package tsnet
+
+import (
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxFailures is the number of failed attempts within FailureWindow after which
+	// a source (IP or public key) is banned (see Config.MaxFailures).
+	DefaultMaxFailures = 20
+	// FailureWindow is the period over which failed attempts are counted.
+	FailureWindow = time.Minute
+	// BanDuration is the duration of the first ban of a source, doubled for each following one
+	// up to MaxBanDuration.
+	BanDuration    = 30 * time.Second
+	MaxBanDuration = time.Hour
+	// sweepSources is the number of tracked sources above which the expired ones are removed.
+	sweepSources = 1024
+)
+
+// AuditEvent describes a failed connection, handshake or trust attempt (see Config.OnAudit).
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	IP   string    `json:"ip"`
+	// Name and public key of the peer, empty when the source isn't a known peer.
+	Name      string `json:"name,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+	Reason    string `json:"reason"`
+	// Set when this failure got the source (IP or PublicKey) banned, for that long.
+	Banned time.Duration `json:"banned,omitempty"`
+	// Set when the message didn't prove it came from the peer (e.g. an invalid signature): its source
+	// can be spoofed, so the peer's key isn't counted (see Server.RecordFailure).
+	Unproven bool `json:"unproven,omitempty"`
+}
+
+// Ban is an active ban (see Server.Bans).
+type Ban struct {
+	Source   string // "ip <address>" or "key <public key>"
+	Until    time.Time
+	Failures int // in the window which triggered the ban.
+}
+
+type failures struct {
+	start time.Time // of the current window.
+	count int
+	bans  int
+	until time.Time
+}
+
+// attempts tracks the failed attempts per source and bans the ones exceeding Config.MaxFailures.
+type attempts struct {
+	mu      sync.Mutex
+	sources map[string]*failures
+}
+
+func ipSource(ip string) string   { return "ip " + ip }
+func keySource(key string) string { return "key " + key }
+
+// banned returns whether the source is currently banned (and expires old entries).
+func (a *attempts) banned(source string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, ok := a.sources[source]
+	if !ok {
+		return false
+	}
+	if now.Before(f.until) {
+		return true
+	}
+	if f.expired(now) {
+		delete(a.sources, source)
+	}
+	return false
+}
+
+// expired returns true when f can be forgotten: its window is over and it wasn't banned
+// within MaxBanDuration (repeat offenders get longer bans).
+func (f *failures) expired(now time.Time) bool {
+	return now.Sub(f.start) >= FailureWindow && (f.bans == 0 || now.Sub(f.until) >= MaxBanDuration)
+}
+
+// fail records a failure of the source and returns the new ban duration, 0 when not banned (now).
+func (a *attempts) fail(source string, maxFailures int, now time.Time) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sources == nil {
+		a.sources = make(map[string]*failures)
+	}
+	if len(a.sources) >= sweepSources {
+		maps.DeleteFunc(a.sources, func(_ string, f *failures) bool { return f.expired(now) })
+	}
+	f, ok := a.sources[source]
+	if !ok {
+		f = &failures{start: now}
+		a.sources[source] = f
+	}
+	if now.Before(f.until) {
+		return 0 // already banned.
+	}
+	if now.Sub(f.start) >= FailureWindow {
+		f.start = now
+		f.count = 0
+	}
+	f.count++
+	if f.count < maxFailures {
+		return 0
+	}
+	ban := min(BanDuration<<f.bans, MaxBanDuration)
+	f.bans++
+	f.until = now.Add(ban)
+	return ban
+}
+
+func (a *attempts) active(now time.Time) []Ban {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var bans []Ban
+	for source, f := range a.sources {
+		if now.Before(f.until) {
+			bans = append(bans, Ban{Source: source, Until: f.until, Failures: f.count})
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int { return strings.Compare(a.Source, b.Source) })
+	return bans
+}
+
+// RecordFailure records a failed attempt from ip by peer (zero Peer if unknown), e.g. a refused trust
+// or drop token, for the audit (Config.OnAudit) and bans the ip and the peer's public key when they
+// exceed Config.MaxFailures within FailureWindow. The peer must have proven its key (the failure comes
+// from one of its authenticated messages): anyone can send messages claiming to be from a peer.
+func (s *Server) RecordFailure(ip string, peer Peer, reason string) {
+	s.recordFailure(ip, peer, reason, true)
+}
+
+// recordUnproven records a failed attempt from a message claiming to be from ip and peer, which failed
+// to prove it (invalid signature, MAC or sealed data): the source of such UDP messages can be spoofed
+// so it's only counted against the ip, and not even when a connected peer (which proved its key from
+// there) has that ip. Otherwise anyone could get a peer's ip and key banned with bad messages.
+func (s *Server) recordUnproven(ip string, peer Peer, reason string) {
+	s.recordFailure(ip, peer, reason, false)
+}
+
+func (s *Server) recordFailure(ip string, peer Peer, reason string, proven bool) {
+	maxFailures := s.MaxFailures
+	if maxFailures <= 0 {
+		maxFailures = DefaultMaxFailures
+	}
+	now := time.Now()
+	var ban time.Duration
+	if proven || !s.connectedIP(ip) {
+		ban = s.attempts.fail(ipSource(ip), maxFailures, now)
+	}
+	if proven && peer.PublicKey != "" {
+		ban = max(ban, s.attempts.fail(keySource(peer.PublicKey), maxFailures, now))
+	}
+	if ban > 0 {
+		s.log.Warnf("Banning %s (%q) for %v after %d failed attempts: %s", ip, peer.Name, ban, maxFailures, reason)
+	}
+	if s.OnAudit != nil {
+		s.OnAudit(AuditEvent{
+			Time: now, IP: ip, Name: peer.Name, PublicKey: peer.PublicKey, Reason: reason, Banned: ban, Unproven: !proven,
+		})
+	}
+}
+
+// connectedIP returns true if a peer we have a session with (so which proved its key) has the ip.
+func (s *Server) connectedIP(ip string) bool {
+	c := s.Connections
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for p := range c.sessions {
+		if s.isPeerIP(p, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Banned returns whether the ip or public key (if not empty) is currently banned: their messages are ignored.
+func (s *Server) Banned(ip, publicKey string) bool {
+	now := time.Now()
+	return s.attempts.banned(ipSource(ip), now) || (publicKey != "" && s.attempts.banned(keySource(publicKey), now))
+}
+
+// Bans returns the active bans, sorted by source.
+func (s *Server) Bans() []Ban {
+	return s.attempts.active(time.Now())
+}
+
+func (s *Server) bannedAddr(from *net.UDPAddr) bool {
+	if s.Banned(from.IP.String(), "") {
+		s.log.LogVf("Ignoring message from banned %v", from)
+		return true
+	}
+	return false
+}
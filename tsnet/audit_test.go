@@ -0,0 +1,159 @@
+package tsnet_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+func TestRecordFailure(t *testing.T) {
+	srv := newUnicastServer(t, "audit")
+	srv.MaxFailures = 3
+	var events []tsnet.AuditEvent
+	srv.OnAudit = func(ev tsnet.AuditEvent) { events = append(events, ev) }
+	peer := tsnet.Peer{IP: "192.0.2.10", Name: "mallory", PublicKey: "p.mallory"}
+	for range 2 {
+		srv.RecordFailure(peer.IP, peer, "invalid data message signature")
+	}
+	if srv.Banned(peer.IP, peer.PublicKey) || len(srv.Bans()) != 0 {
+		t.Fatalf("Banned before MaxFailures: %v", srv.Bans())
+	}
+	srv.RecordFailure(peer.IP, peer, "invalid data message signature")
+	if len(events) != 3 || events[0].Banned != 0 || events[2].Banned != tsnet.BanDuration ||
+		events[2].Name != "mallory" || events[2].PublicKey != "p.mallory" || events[2].IP != peer.IP {
+		t.Errorf("Unexpected audit events %+v", events)
+	}
+	if !srv.Banned(peer.IP, "") || !srv.Banned("192.0.2.11", peer.PublicKey) || srv.Banned("192.0.2.11", "p.other") {
+		t.Errorf("Ban should apply to the ip and the public key (separately)")
+	}
+	bans := srv.Bans()
+	if len(bans) != 2 || bans[0].Source != "ip 192.0.2.10" || bans[1].Source != "key p.mallory" || bans[0].Failures != 3 {
+		t.Errorf("Unexpected bans %+v", bans)
+	}
+	// Failures while banned don't extend the ban.
+	srv.RecordFailure(peer.IP, tsnet.Peer{}, "again")
+	if events[3].Banned != 0 {
+		t.Errorf("Failure while banned should not ban again: %+v", events[3])
+	}
+}
+
+// TestBanUnknownSource checks that repeated connect requests from an unknown source get it banned.
+func TestBanUnknownSource(t *testing.T) {
+	srv := newUnicastServer(t, "auditB")
+	srv.MaxFailures = 2
+	var mu sync.Mutex
+	var events []tsnet.AuditEvent
+	srv.OnAudit = func(ev tsnet.AuditEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer srv.Stop()
+	raw, err := net.ListenUDP("udp4", &net.UDPAddr{IP: srv.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	msg := fmt.Sprintf(tsnet.ConnectMessageFormat, "stranger", srv.Name)
+	for range 3 {
+		if _, err = raw.WriteToUDP([]byte(msg), srv.OurAddress()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !srv.Banned(srv.OurAddress().IP.String(), "") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Source not banned after repeated connect requests")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond) // the third request must be ignored.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[1].Banned != tsnet.BanDuration || events[1].Reason != "connection request from unknown source" {
+		t.Errorf("Unexpected audit events %+v", events)
+	}
+}
+
+// TestUnprovenFailures sends connect requests signed by another key from a raw socket claiming to be
+// a peer, from the ip of a connected peer: they are audited but neither the peer's key nor the ip
+// get banned, as anyone can send such messages.
+func TestUnprovenFailures(t *testing.T) {
+	srv := newUnicastServer(t, "auditU")
+	other := newUnicastServer(t, "auditU2")
+	srv.MaxFailures = 2
+	var mu sync.Mutex
+	var events []tsnet.AuditEvent
+	srv.OnAudit = func(ev tsnet.AuditEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}
+	for _, s := range []*tsnet.Server{srv, other} {
+		if err := s.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer s.Stop()
+	}
+	peerSrv, portSrv := asPeer(srv)
+	peerOther, portOther := asPeer(other)
+	srv.AddPeer(peerOther, portOther)
+	other.AddPeer(peerSrv, portSrv)
+	if err := other.ConnectToPeer(peerSrv); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := other.Connections.WaitConnected(ctx, peerSrv); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	raw, err := net.ListenUDP("udp4", &net.UDPAddr{IP: srv.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	victim, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawAddr := raw.LocalAddr().(*net.UDPAddr)
+	peer := tsnet.Peer{IP: rawAddr.IP.String(), Name: "victim", PublicKey: victim.PublicKeyToString()}
+	srv.AddPeer(peer, rawAddr.Port)
+	connect := tsnet.EncodeMessage(&tsnet.ConnectMessage{Requester: "victim", Target: srv.Name}, tsnet.WireText)
+	forged := fmt.Sprintf("%s"+tsnet.AuthSignatureFormat, connect, srv.Identity.SignDetached(connect))
+	forged = string(tsnet.PadMessage([]byte(forged), tsnet.ConnectMinSize, ' '))
+	for range 3 * srv.MaxFailures {
+		if _, err = raw.WriteToUDP([]byte(forged), srv.OurAddress()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n >= 3*srv.MaxFailures {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("Only %d failures audited", n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if bans := srv.Bans(); len(bans) != 0 {
+		t.Errorf("Forged messages shouldn't ban anything: %+v", bans)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if ev := events[0]; !ev.Unproven || ev.PublicKey != peer.PublicKey || ev.Reason != "invalid message authentication" {
+		t.Errorf("Unexpected audit event %+v", ev)
+	}
+}
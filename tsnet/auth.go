@@ -0,0 +1,200 @@
+package tsnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+// Direct message authentication: the messages which don't carry a signature or seal of their own
+// (data, accept, challenge response and restart do) are followed by a trailer authenticating their
+// encoding, before any padding: the MAC of the connection's session (Session.Seal of nothing with
+// the message as additional data, replay protected) once there is one, otherwise the signature of
+// our identity. The older versions ignore it (Sscanf ignores the trailing input), their messages
+// without one are accepted unless Config.RequireAuth is set. Only the rendezvous' answers (checked
+// by address) and the cookies (whose reply must stay smaller than the request, see ConnectMinSize;
+// a forged one only gets the request rejected) aren't authenticated.
+const (
+	AuthSignatureFormat = " sig %s" // SignDetached signature of the message before it
+	AuthMACFormat       = " mac %s" // Session.Seal of nothing, the message before it as additional data
+
+	// authSignatureMark and authMACMark start the trailer in the binary format, followed by the
+	// uvarint length of the raw signature or seal.
+	authSignatureMark = 's'
+	authMACMark       = 'm'
+	// probePadding is the ProbeMessage.Padding field of our probes, the padding to the datagram
+	// size follows the trailer.
+	probePadding = "p"
+)
+
+var (
+	// ErrUnauthenticated is the error of the direct messages without authentication trailer, dropped
+	// with Config.RequireAuth.
+	ErrUnauthenticated = errors.New("unauthenticated message")
+	// ErrAuthentication is the error of the direct messages whose trailer doesn't check out.
+	ErrAuthentication = errors.New("message authentication failed")
+)
+
+// sign returns m in our Config.Wire format followed by the signature of our identity.
+func (s *Server) sign(m Message) []byte {
+	msg := s.encode(m)
+	return appendAuth(msg, authSignatureMark, s.Identity.SignDetached(msg))
+}
+
+// authenticate returns m in our Config.Wire format followed by the MAC of our session with the
+// peer, or our signature when we aren't connected.
+func (s *Server) authenticate(peer Peer, m Message) []byte {
+	session := s.Connections.session(peer)
+	if session == nil {
+		return s.sign(m)
+	}
+	msg := s.encode(m)
+	return appendAuth(msg, authMACMark, session.Seal(nil, msg))
+}
+
+// appendAuth appends the trailer with the encoded tag (SignDetached or Seal) to msg.
+func appendAuth(msg []byte, mark byte, tag string) []byte {
+	if !IsBinaryMessage(msg) {
+		format := AuthSignatureFormat
+		if mark == authMACMark {
+			format = AuthMACFormat
+		}
+		return fmt.Appendf(msg, format, tag)
+	}
+	prefix := tcrypto.SignedPrefix
+	if mark == authMACMark {
+		prefix = tcrypto.SealedPrefix
+	}
+	raw, _ := tcrypto.DecodeBytes(prefix, tag) // we just encoded it.
+	msg = append(msg, mark)
+	msg = binary.AppendUvarint(msg, uint64(len(raw)))
+	return append(msg, raw...)
+}
+
+// splitAuth returns the encoding of the decoded message m in buf, the mark of its trailer and the
+// encoded tag, a 0 mark when there is none.
+func splitAuth(m Message, buf []byte) ([]byte, byte, string) {
+	format := WireText
+	if IsBinaryMessage(buf) {
+		format = WireBinary
+	}
+	msg := EncodeMessage(m, format)
+	rest, ok := bytes.CutPrefix(buf, msg)
+	if !ok { // not how we encode it (e.g. extra spaces): can't be authenticated.
+		return msg, 0, ""
+	}
+	if format == WireText {
+		for _, mark := range []byte{authSignatureMark, authMACMark} {
+			prefix := []byte(" sig ")
+			if mark == authMACMark {
+				prefix = []byte(" mac ")
+			}
+			if tag, ok := bytes.CutPrefix(rest, prefix); ok {
+				tag, _, _ = bytes.Cut(tag, []byte(" ")) // padding.
+				return msg, mark, string(tag)
+			}
+		}
+		return msg, 0, ""
+	}
+	if len(rest) == 0 || (rest[0] != authSignatureMark && rest[0] != authMACMark) {
+		return msg, 0, ""
+	}
+	l, n := binary.Uvarint(rest[1:])
+	if n <= 0 || l > uint64(len(rest)-1-n) {
+		return msg, 0, ""
+	}
+	raw := rest[1+n : 1+n+int(l)] //nolint:gosec // checked above.
+	if rest[0] == authMACMark {
+		return msg, authMACMark, tcrypto.EncodeBytes(tcrypto.SealedPrefix, raw)
+	}
+	return msg, authSignatureMark, tcrypto.EncodeBytes(tcrypto.SignedPrefix, raw)
+}
+
+// checkAuth verifies the trailer of the direct message m (decoded from buf) against the public
+// key (and session) of its sender: the peer of the source, or the registering (or registered
+// introduction requester) peer for the rendezvous. Returns ErrUnauthenticated without trailer,
+// ErrAuthentication (wrapped) if it doesn't check out and nil for the messages authenticated
+// otherwise or from unknown sources (which their handlers reject).
+func (s *Server) checkAuth(m Message, buf []byte, from *net.UDPAddr) error {
+	var peer Peer
+	switch m := m.(type) {
+	case *DataMessage, *AcceptMessage, *ChallengeResponseMessage, *RestartMessage, *RevealMessage:
+		return nil // signed or sealed content.
+	case *CookieMessage:
+		return nil // too small to sign.
+	case *ObservedMessage, *PunchMessage, *NoPunchMessage:
+		return nil // from the rendezvous' address.
+	case *RegisterMessage:
+		peer = Peer{Name: m.Name, PublicKey: m.PublicKey}
+	case *IntroduceMessage:
+		var ok bool
+		if peer, ok = s.NAT.registeredPeer(m.Requester); !ok {
+			return nil
+		}
+	default:
+		var ok bool
+		if peer, ok = s.Sources.Get(Source{IP: from.IP.String(), Port: from.Port}); !ok {
+			return nil
+		}
+	}
+	msg, mark, tag := splitAuth(m, buf)
+	switch mark {
+	case authSignatureMark:
+		pub, err := tcrypto.IdentityPublicKeyString(peer.PublicKey)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrAuthentication, err)
+		}
+		if err = tcrypto.VerifyDetached(msg, tag, pub); err != nil {
+			return fmt.Errorf("%w: %w", ErrAuthentication, err)
+		}
+		return nil
+	case authMACMark:
+		session := s.Connections.session(peer)
+		if session == nil {
+			return fmt.Errorf("%w: %w: no session with %q", ErrAuthentication, tcrypto.ErrSessionOpen, peer.Name)
+		}
+		if _, err := session.Open(tag, msg); err != nil {
+			return fmt.Errorf("%w: %w", ErrAuthentication, err)
+		}
+		return nil
+	}
+	return ErrUnauthenticated
+}
+
+// authenticated returns true if the direct message m (decoded from buf) can be handled: its trailer
+// checks out or it has none, Config.RequireAuth isn't set and the sender never signed CapAuth in a
+// handshake (it's then a downgrade). Invalid signatures are failed
+// attempts (see RecordFailure), connect requests are then rejected like invalid challenge
+// responses. MACs can fail after a reconnection (the session changed).
+func (s *Server) authenticated(m Message, buf []byte, from *net.UDPAddr) bool {
+	err := s.checkAuth(m, buf, from)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrUnauthenticated):
+		peer, known := s.Sources.Get(Source{IP: from.IP.String(), Port: from.Port})
+		if s.RequireAuth || (known && s.Connections.hasCap(peer, CapAuth)) {
+			s.log.LogVf("Dropping unauthenticated %T from %v", m, from)
+			return false
+		}
+		return true
+	case errors.Is(err, tcrypto.ErrSessionOpen), errors.Is(err, tcrypto.ErrReplay):
+		s.log.LogVf("Dropping %T from %v: %v", m, from, err)
+	default:
+		s.log.Warnf("Dropping %T from %v: %v", m, from, err)
+		peer, known := s.Sources.Get(Source{IP: from.IP.String(), Port: from.Port})
+		s.recordUnproven(from.IP.String(), peer, "invalid message authentication")
+		if _, connect := m.(*ConnectMessage); connect && known && s.Connections.Running() {
+			if pData, found := s.Peers.Get(peer); found {
+				pData.Status = Failed
+				s.change(s.setPeer(peer, pData))
+			}
+			s.Connections.reply(from, s.sign(&RejectMessage{Target: peer.Name, Reason: "authentication failed"}))
+		}
+	}
+	return false
+}
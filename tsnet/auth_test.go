@@ -0,0 +1,111 @@
+package tsnet_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// TestAuthRequired connects both ways between servers requiring authenticated messages: the
+// connect requests, challenges, keepalives (with the session's MAC) and MTU probes get through.
+func TestAuthRequired(t *testing.T) {
+	a := newUnicastServer(t, "authRequiredA")
+	b := newUnicastServer(t, "authRequiredB")
+	b.Wire = tsnet.WireBinary
+	interval := 20 * time.Millisecond
+	for _, srv := range []*tsnet.Server{a, b} {
+		srv.RequireAuth = true
+		srv.KeepaliveInterval = interval
+		if err := srv.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerA, portA := asPeer(a)
+	peerB, portB := asPeer(b)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	for _, p := range []struct {
+		srv  *tsnet.Server
+		peer tsnet.Peer
+	}{{a, peerB}, {b, peerA}} {
+		if mtu, err := p.srv.ProbeMTU(ctx, p.peer); err != nil || mtu <= tsnet.DefaultMTU {
+			t.Errorf("%s: ProbeMTU %d %v", p.srv.Name, mtu, err)
+		}
+	}
+	time.Sleep(3 * tsnet.MaxMissedKeepalives * interval)
+	if pd, _ := a.Peers.Get(peerB); pd.Status != tsnet.Connected {
+		t.Errorf("B should still be Connected (keepalives answered), got %v", pd.Status)
+	}
+}
+
+// TestAuthConnect sends connect requests from a raw socket known to the server as a peer: signed
+// ones get a challenge, unsigned ones are dropped (with RequireAuth) and the ones signed by another
+// key are rejected and recorded as failed attempts.
+func TestAuthConnect(t *testing.T) {
+	srv := newUnicastServer(t, "authServer")
+	srv.RequireAuth = true
+	var failures atomic.Int32
+	srv.OnAudit = func(_ tsnet.AuditEvent) { failures.Add(1) }
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer srv.Stop()
+	raw, err := net.ListenUDP("udp4", &net.UDPAddr{IP: srv.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawAddr := raw.LocalAddr().(*net.UDPAddr)
+	srv.AddPeer(tsnet.Peer{IP: rawAddr.IP.String(), Name: "raw", PublicKey: id.PublicKeyToString()}, rawAddr.Port)
+	to := srv.OurAddress()
+	connect := tsnet.EncodeMessage(&tsnet.ConnectMessage{Requester: "raw", Target: srv.Name}, tsnet.WireText)
+	signed := func(signer *tcrypto.Identity) string {
+		msg := fmt.Sprintf("%s"+tsnet.AuthSignatureFormat, connect, signer.SignDetached(connect))
+		return string(tsnet.PadMessage([]byte(msg), tsnet.ConnectMinSize, ' '))
+	}
+	if reply := exchange(t, raw, to, string(tsnet.PadMessage(connect, tsnet.ConnectMinSize, ' '))); reply != "" {
+		t.Errorf("Unauthenticated connect request answered with %q", reply)
+	}
+	reply := exchange(t, raw, to, signed(other))
+	m, err := tsnet.DecodeMessage([]byte(reply))
+	if reject, ok := m.(*tsnet.RejectMessage); err != nil || !ok || reject.Reason != "authentication failed" {
+		t.Errorf("Connect request signed by another key answered with %q (%v)", reply, err)
+	}
+	if failures.Load() == 0 {
+		t.Errorf("Invalid signature not recorded as a failed attempt")
+	}
+	reply = exchange(t, raw, to, signed(id))
+	m, err = tsnet.DecodeMessage([]byte(reply))
+	if _, ok := m.(*tsnet.ChallengeMessage); err != nil || !ok {
+		t.Fatalf("Signed connect request answered with %q (%v)", reply, err)
+	}
+	challenge, signature, found := strings.Cut(reply, fmt.Sprintf(tsnet.AuthSignatureFormat, ""))
+	pub, _ := tcrypto.IdentityPublicKeyString(srv.Identity.PublicKeyToString())
+	if !found || tcrypto.VerifyDetached([]byte(challenge), signature, pub) != nil {
+		t.Errorf("Challenge %q not signed by the server", reply)
+	}
+}
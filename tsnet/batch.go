@@ -0,0 +1,33 @@
+package tsnet
+
+import (
+	"net"
+)
+
+// Datagram is one message for BatchConn.ReadBatch.
+type Datagram struct {
+	Buf  []byte       // buffer to read into
+	N    int          // number of bytes read
+	Addr *net.UDPAddr // source address
+}
+
+// NewDatagrams returns n datagrams with buffers of size bytes, for ReadBatch.
+func NewDatagrams(n, size int) []Datagram {
+	msgs := make([]Datagram, n)
+	for i := range msgs {
+		msgs[i].Buf = make([]byte, size)
+	}
+	return msgs
+}
+
+// sameSizeSegments returns true if msgs can be sent as GSO segments: all the same size except
+// the last one which can be smaller.
+func sameSizeSegments(msgs [][]byte) bool {
+	size := len(msgs[0])
+	for i, m := range msgs[1:] {
+		if len(m) > size || (len(m) < size && i != len(msgs)-2) {
+			return false
+		}
+	}
+	return true
+}
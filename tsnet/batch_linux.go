@@ -0,0 +1,120 @@
+package tsnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ReadBatchSize is how many datagrams are read per system call (recvmmsg).
+	ReadBatchSize = 32
+	// maxGSOSegments is the kernel's limit on segments per GSO send (UDP_MAX_SEGMENTS).
+	maxGSOSegments = 64
+	maxGSOBytes    = 65507
+)
+
+// BatchConn sends and receives several datagrams per system call: sendmmsg/recvmmsg and,
+// when the kernel supports it, UDP GSO (one large send split in same size datagrams by the kernel).
+type BatchConn struct {
+	conn  *net.UDPConn
+	pc    *ipv4.PacketConn
+	gso   atomic.Bool
+	rmsgs []ipv4.Message // only used by ReadBatch, which must not be called concurrently.
+	log   logFuncs
+}
+
+// NewBatchConn wraps conn for batched I/O.
+func NewBatchConn(conn *net.UDPConn) *BatchConn {
+	return newBatchConn(conn, defaultLog)
+}
+
+func newBatchConn(conn *net.UDPConn, lg logFuncs) *BatchConn {
+	b := &BatchConn{conn: conn, pc: ipv4.NewPacketConn(conn), log: lg}
+	if rc, err := conn.SyscallConn(); err == nil {
+		_ = rc.Control(func(fd uintptr) {
+			_, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+			b.gso.Store(err == nil)
+		})
+	}
+	b.log.LogVf("UDP GSO supported: %v", b.gso.Load())
+	return b
+}
+
+// GSO returns true if UDP generic segmentation offload is used.
+func (b *BatchConn) GSO() bool {
+	return b.gso.Load()
+}
+
+// WriteBatch sends all msgs to addr. Safe for concurrent use.
+func (b *BatchConn) WriteBatch(msgs [][]byte, addr *net.UDPAddr) error {
+	wmsgs := make([]ipv4.Message, 0, len(msgs))
+	for len(msgs) > 0 {
+		if b.gso.Load() && len(msgs) > 1 && sameSizeSegments(msgs) {
+			n := min(len(msgs), maxGSOSegments, maxGSOBytes/len(msgs[0]))
+			err := b.writeGSO(msgs[:n], addr)
+			if err == nil {
+				msgs = msgs[n:]
+				continue
+			}
+			if !errors.Is(err, syscall.EIO) && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOPROTOOPT) {
+				return err
+			}
+			b.log.Warnf("UDP GSO send failed, disabling it: %v", err)
+			b.gso.Store(false)
+		}
+		wmsgs = wmsgs[:0]
+		for _, m := range msgs {
+			wmsgs = append(wmsgs, ipv4.Message{Buffers: [][]byte{m}, Addr: addr})
+		}
+		n, err := b.pc.WriteBatch(wmsgs, 0)
+		if err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+// writeGSO sends msgs (same size except possibly the last) in one system call.
+func (b *BatchConn) writeGSO(msgs [][]byte, addr *net.UDPAddr) error {
+	total := 0
+	for _, m := range msgs {
+		total += len(m)
+	}
+	buf := make([]byte, 0, total)
+	for _, m := range msgs {
+		buf = append(buf, m...)
+	}
+	oob := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(len(msgs[0]))) //nolint:gosec // at most MaxDatagramSize.
+	_, _, err := b.conn.WriteMsgUDP(buf, oob, addr)
+	return err
+}
+
+// ReadBatch reads one or more datagrams (up to len(msgs)), returns how many were read.
+func (b *BatchConn) ReadBatch(msgs []Datagram) (int, error) {
+	if cap(b.rmsgs) < len(msgs) {
+		b.rmsgs = make([]ipv4.Message, len(msgs))
+	}
+	rmsgs := b.rmsgs[:len(msgs)]
+	for i := range msgs {
+		rmsgs[i] = ipv4.Message{Buffers: [][]byte{msgs[i].Buf}}
+	}
+	n, err := b.pc.ReadBatch(rmsgs, 0)
+	for i := range n {
+		msgs[i].N = rmsgs[i].N
+		msgs[i].Addr, _ = rmsgs[i].Addr.(*net.UDPAddr)
+	}
+	return n, err
+}
@@ -0,0 +1,50 @@
+//go:build !linux
+
+package tsnet
+
+import (
+	"net"
+)
+
+// ReadBatchSize is how many datagrams are read per system call (no batching on this platform).
+const ReadBatchSize = 1
+
+// BatchConn sends and receives several datagrams per system call on Linux,
+// this is the portable fallback doing one system call per datagram.
+type BatchConn struct {
+	conn *net.UDPConn
+}
+
+// NewBatchConn wraps conn for batched I/O.
+func NewBatchConn(conn *net.UDPConn) *BatchConn {
+	return &BatchConn{conn: conn}
+}
+
+func newBatchConn(conn *net.UDPConn, _ logFuncs) *BatchConn {
+	return NewBatchConn(conn)
+}
+
+// GSO returns true if UDP generic segmentation offload is used.
+func (b *BatchConn) GSO() bool {
+	return false
+}
+
+// WriteBatch sends all msgs to addr.
+func (b *BatchConn) WriteBatch(msgs [][]byte, addr *net.UDPAddr) error {
+	for _, m := range msgs {
+		if _, err := b.conn.WriteToUDP(m, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadBatch reads one or more datagrams (up to len(msgs)), returns how many were read.
+func (b *BatchConn) ReadBatch(msgs []Datagram) (int, error) {
+	n, addr, err := b.conn.ReadFromUDP(msgs[0].Buf)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].N, msgs[0].Addr = n, addr
+	return 1, nil
+}
@@ -0,0 +1,125 @@
+package tsnet_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+func loopbackPair(t testing.TB) (*net.UDPConn, *net.UDPConn) {
+	t.Helper()
+	lo := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	sender, err := net.ListenUDP("udp4", lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := net.ListenUDP("udp4", lo)
+	if err != nil {
+		sender.Close()
+		t.Fatal(err)
+	}
+	_ = receiver.SetReadBuffer(4 << 20)
+	t.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+	return sender, receiver
+}
+
+// datagrams returns n datagrams of size bytes (the last one being shorter), or varying sizes.
+func datagrams(n, size int, varying bool) [][]byte {
+	msgs := make([][]byte, n)
+	for i := range msgs {
+		l := size
+		if varying {
+			l -= i % 2
+		}
+		if i == n-1 {
+			l = size / 2
+		}
+		msgs[i] = bytes.Repeat([]byte{byte('a' + i%26)}, l)
+	}
+	return msgs
+}
+
+func TestBatchConn(t *testing.T) {
+	sender, receiver := loopbackPair(t)
+	b := tsnet.NewBatchConn(sender)
+	t.Logf("GSO: %v, read batch size %d", b.GSO(), tsnet.ReadBatchSize)
+	msgs := datagrams(100, 1000, false)
+	msgs = append(msgs, datagrams(10, 500, true)...)
+	if err := b.WriteBatch(msgs, receiver.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	r := tsnet.NewBatchConn(receiver)
+	in := tsnet.NewDatagrams(tsnet.ReadBatchSize, tsnet.MaxDatagramSize)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < len(msgs); {
+		n, err := r.ReadBatch(in)
+		if err != nil {
+			t.Fatalf("ReadBatch failed after %d datagrams: %v", i, err)
+		}
+		for _, d := range in[:n] {
+			if !bytes.Equal(d.Buf[:d.N], msgs[i]) {
+				t.Fatalf("Datagram %d differs: got %d bytes, expected %d", i, d.N, len(msgs[i]))
+			}
+			if d.Addr.Port != sender.LocalAddr().(*net.UDPAddr).Port {
+				t.Errorf("Unexpected source %v", d.Addr)
+			}
+			i++
+		}
+	}
+}
+
+// drain reads (and discards) everything sent to conn until it's closed.
+func drain(conn *net.UDPConn) {
+	r := tsnet.NewBatchConn(conn)
+	in := tsnet.NewDatagrams(tsnet.ReadBatchSize, tsnet.MaxDatagramSize)
+	for {
+		if _, err := r.ReadBatch(in); err != nil {
+			return
+		}
+	}
+}
+
+const benchBatch = 32
+
+func benchmarkWrite(b *testing.B, batched, varying bool) {
+	sender, receiver := loopbackPair(b)
+	go drain(receiver)
+	addr := receiver.LocalAddr().(*net.UDPAddr)
+	msgs := datagrams(benchBatch, 1400, varying)
+	bc := tsnet.NewBatchConn(sender)
+	b.SetBytes(int64(benchBatch * 1400))
+	for b.Loop() {
+		if batched {
+			if err := bc.WriteBatch(msgs, addr); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, m := range msgs {
+			if _, err := sender.WriteToUDP(m, addr); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkWriteSingle is the baseline: one system call per datagram.
+func BenchmarkWriteSingle(b *testing.B) {
+	benchmarkWrite(b, false, false)
+}
+
+// BenchmarkWriteBatch uses GSO where available (same size datagrams).
+func BenchmarkWriteBatch(b *testing.B) {
+	benchmarkWrite(b, true, false)
+}
+
+// BenchmarkWriteBatchNoGSO uses sendmmsg (varying sizes prevent GSO).
+func BenchmarkWriteBatchNoGSO(b *testing.B) {
+	benchmarkWrite(b, true, true)
+}
@@ -0,0 +1,20 @@
+//go:build !unix && !windows
+
+package tsnet
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// setBroadcast isn't supported on this platform, Config.Broadcast is ignored.
+func setBroadcast(_ *net.UDPConn) error {
+	return errors.ErrUnsupported
+}
+
+// reuseAddr is a no-op on this platform: only one instance can bind the discovery port when
+// multicast isn't available.
+func reuseAddr(_, _ string, _ syscall.RawConn) error {
+	return nil
+}
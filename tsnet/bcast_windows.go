@@ -0,0 +1,36 @@
+//go:build windows
+
+package tsnet
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// setBroadcast allows sending datagrams to broadcast addresses from conn.
+func setBroadcast(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setOption(rc, windows.SO_BROADCAST)
+}
+
+// reuseAddr is a net.ListenConfig Control letting several sockets (tsync instances) bind the
+// same discovery port.
+func reuseAddr(_, _ string, rc syscall.RawConn) error {
+	return setOption(rc, windows.SO_REUSEADDR)
+}
+
+func setOption(rc syscall.RawConn, option int) error {
+	var sErr error
+	err := rc.Control(func(fd uintptr) {
+		sErr = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, option, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sErr
+}
@@ -0,0 +1,111 @@
+// Package bench has reproducible benchmarks for tsnet and the transfer engine (discovery packet
+// parsing, signing and verifying, hashing, stream throughput over in memory and loopback transports).
+//
+// Run them with
+//
+//	go test -run XXX -bench . ./tsnet/bench
+//
+// and add -cpuprofile/-memprofile to profile (see go help testflag).
+package bench
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/txfer"
+)
+
+// StreamOver sends data from a to b as a congestion controlled stream of frameSize frames
+// (the way `tsync pipe` and `tsync cat` do, minus the signing) and returns once b received it all.
+// Both transports are closed when done (which also stops the reading goroutines).
+func StreamOver(ctx context.Context, a, b tsnet.Transport, data []byte, frameSize int) error {
+	defer a.Close()
+	defer b.Close()
+	bAddr := b.LocalAddr().(*net.UDPAddr)
+	aAddr := a.LocalAddr().(*net.UDPAddr)
+	var out bytes.Buffer
+	recv := txfer.NewStreamReceiver(&out)
+	recv.Hash = tcrypto.CRC32C
+	recv.Ack = func(frame []byte) error {
+		_, err := b.WriteToUDP(frame, aAddr)
+		return err
+	}
+	recvErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, tsnet.MaxDatagramSize)
+		for {
+			n, _, err := b.ReadFromUDP(buf)
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			_ = recv.Receive(buf[:n]) // errors are reported through recv.Err().
+			select {
+			case <-recv.Done():
+				recvErr <- recv.Err()
+				return
+			default:
+			}
+		}
+	}()
+	acks := make(chan []byte, txfer.DefaultMaxWindow)
+	go func() {
+		buf := make([]byte, tsnet.MaxDatagramSize)
+		for {
+			n, _, err := a.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case acks <- append([]byte(nil), buf[:n]...):
+			default:
+			}
+		}
+	}()
+	sender := &txfer.StreamSender{
+		ID:        1,
+		FrameSize: frameSize,
+		Send: func(frame []byte) error {
+			_, err := a.WriteToUDP(frame, bAddr)
+			return err
+		},
+		Hash:       tcrypto.CRC32C,
+		Congestion: txfer.NewAIMD(0),
+		Acks:       acks,
+	}
+	if _, err := sender.Copy(ctx, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	select {
+	case err := <-recvErr:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		return errors.New("received data differs")
+	}
+	return nil
+}
+
+// LoopbackPair returns 2 UDP sockets on 127.0.0.1.
+func LoopbackPair() (*net.UDPConn, *net.UDPConn, error) {
+	lo := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	a, err := net.ListenUDP("udp4", lo)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := net.ListenUDP("udp4", lo)
+	if err != nil {
+		a.Close()
+		return nil, nil, fmt.Errorf("second socket: %w", err)
+	}
+	return a, b, nil
+}
@@ -0,0 +1,156 @@
+package bench_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tsnet/bench"
+)
+
+// randomData is reproducible (fixed seed) test data.
+func randomData(n int) []byte {
+	r := rand.New(rand.NewPCG(1, uint64(n))) //nolint:gosec // test data.
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(r.UintN(256))
+	}
+	return b
+}
+
+func TestStreamOverMem(t *testing.T) {
+	network := tsnet.NewMemNetwork()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := bench.StreamOver(ctx, network.Listen(), network.Listen(), randomData(100_000), 1000); err != nil {
+		t.Fatalf("StreamOver failed: %v", err)
+	}
+}
+
+// Reliability of the congestion controlled streams under bad network conditions.
+func TestStreamOverChaos(t *testing.T) {
+	network := tsnet.NewMemNetwork()
+	cfg := tsnet.ChaosConfig{
+		Loss: 0.05, Duplicate: 0.05, Reorder: 0.05,
+		Latency: 2 * time.Millisecond, Jitter: time.Millisecond, Seed: 42,
+	}
+	a := tsnet.NewChaosTransport(network.Listen(), cfg)
+	cfg.Seed++
+	b := tsnet.NewChaosTransport(network.Listen(), cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := bench.StreamOver(ctx, a, b, randomData(200_000), 1000); err != nil {
+		t.Fatalf("StreamOver failed: %v", err)
+	}
+}
+
+func BenchmarkDiscoveryDecode(b *testing.B) {
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg := tsnet.DiscoveryMessage(id, "some-host.local", 42, time.Now(), "nonce")
+	for b.Loop() {
+		srv := &tsnet.Server{} // a new one each time, the same message is otherwise rejected as replayed.
+		if _, _, _, err := srv.MCastMessageDecode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSign(b *testing.B) {
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := randomData(tsnet.MaxDataSize(tsnet.Peer{Name: "peer"}))
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		_ = id.SignMessage(data)
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := randomData(tsnet.MaxDataSize(tsnet.Peer{Name: "peer"}))
+	signed := id.SignMessage(data)
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		if _, err := tcrypto.VerifySignedMessage(signed, id.PublicKey); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSharedSecret(b *testing.B) {
+	ours, err := tcrypto.NewEphemeralKeys()
+	if err != nil {
+		b.Fatal(err)
+	}
+	theirs, err := tcrypto.NewEphemeralKeys()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for b.Loop() {
+		if _, err := ours.SharedSecret(theirs.PublicKey); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHash(b *testing.B) {
+	data := randomData(32 * 1024)
+	for _, algo := range []tcrypto.HashAlgo{
+		tcrypto.XXH3, tcrypto.CRC32C, tcrypto.BLAKE3, tcrypto.SHA256, tcrypto.SHA512_256,
+	} {
+		b.Run(algo.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				_ = algo.Sum(data)
+			}
+		})
+	}
+}
+
+const streamSize = 1 << 20
+
+func benchmarkStream(b *testing.B, newPair func() (tsnet.Transport, tsnet.Transport, error)) {
+	data := randomData(streamSize)
+	for _, frameSize := range []int{tsnet.BufSize, tsnet.DatagramSize(1500), tsnet.DatagramSize(9000)} {
+		b.Run(fmt.Sprintf("frame-%d", frameSize), func(b *testing.B) {
+			b.SetBytes(streamSize)
+			for b.Loop() {
+				a, c, err := newPair()
+				if err != nil {
+					b.Fatal(err)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				err = bench.StreamOver(ctx, a, c, data, frameSize)
+				cancel()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStreamMem(b *testing.B) {
+	network := tsnet.NewMemNetwork()
+	benchmarkStream(b, func() (tsnet.Transport, tsnet.Transport, error) {
+		return network.Listen(), network.Listen(), nil
+	})
+}
+
+func BenchmarkStreamLoopback(b *testing.B) {
+	benchmarkStream(b, func() (tsnet.Transport, tsnet.Transport, error) {
+		return bench.LoopbackPair()
+	})
+}
@@ -0,0 +1,150 @@
+package tsnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// BroadcastMode is when Discovery also sends our announcements to the broadcast addresses (see
+// Config.Broadcast), for the networks dropping multicast (some Wi-Fi access points and VMs).
+type BroadcastMode int
+
+const (
+	// BroadcastOff only announces us on the multicast address (the default).
+	BroadcastOff BroadcastMode = iota
+	// BroadcastAuto also broadcasts while multicast doesn't seem to work: no multicast announcement
+	// heard from a peer for BroadcastFallbackTicks intervals, a peer's broadcast heard in that time
+	// or the multicast group couldn't be joined.
+	BroadcastAuto
+	// BroadcastAlways broadcasts along with each multicast announcement.
+	BroadcastAlways
+)
+
+// BroadcastMessagePrefix precedes our discovery message (see DiscoveryMessage) when it's sent to
+// the limited (255.255.255.255) and the subnet broadcast addresses, so the peers know we need
+// broadcasts (and, in BroadcastAuto mode, broadcast too).
+const BroadcastMessagePrefix = "bcast1 "
+
+// BroadcastFallbackTicks is how many broadcast intervals without multicast announcements from
+// peers BroadcastAuto waits before broadcasting.
+const BroadcastFallbackTicks = 3
+
+var broadcastModeNames = []string{"off", "auto", "always"}
+
+func (m BroadcastMode) String() string {
+	if m >= 0 && int(m) < len(broadcastModeNames) {
+		return broadcastModeNames[m]
+	}
+	return "unknown"
+}
+
+// ParseBroadcastMode returns the BroadcastMode from its name (off, auto or always).
+func ParseBroadcastMode(name string) (BroadcastMode, error) {
+	for i, n := range broadcastModeNames {
+		if strings.EqualFold(name, n) {
+			return BroadcastMode(i), nil
+		}
+	}
+	return BroadcastOff, fmt.Errorf("unknown broadcast mode %q, must be off, auto or always", name)
+}
+
+// broadcastAddrs returns the limited broadcast address and the broadcast addresses of the subnets
+// of our interface (of all of them when we listen on all), at our discovery Port.
+func (s *Server) broadcastAddrs() []*net.UDPAddr {
+	addrs := []*net.UDPAddr{{IP: net.IPv4bcast, Port: s.Port}}
+	var ifaces []net.Interface
+	if s.Listener.iface != nil {
+		ifaces = append(ifaces, *s.Listener.iface)
+	} else {
+		ifaces, _ = net.Interfaces()
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		ifAddrs, err := iface.Addrs()
+		if err != nil {
+			s.log.Warnf("Can't get the addresses of %q: %v", iface.Name, err)
+			continue
+		}
+		for _, a := range ifAddrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			if ones, bits := ipNet.Mask.Size(); bits-ones < 2 { // /31 and /32 have no broadcast address.
+				continue
+			}
+			ip, mask := ipNet.IP.To4(), ipNet.Mask[len(ipNet.Mask)-net.IPv4len:]
+			bcast := make(net.IP, net.IPv4len)
+			for i := range bcast {
+				bcast[i] = ip[i] | ^mask[i]
+			}
+			addrs = append(addrs, &net.UDPAddr{IP: bcast, Port: s.Port})
+		}
+	}
+	return addrs
+}
+
+// Broadcasting returns true if our announcements are currently also broadcast.
+func (d *Discovery) Broadcasting() bool {
+	return d.broadcastOn.Load()
+}
+
+// wantBroadcast returns true if we should broadcast our announcement at now (see BroadcastMode).
+func (d *Discovery) wantBroadcast(now time.Time) bool {
+	switch {
+	case d.broadcast == nil:
+		return false
+	case d.s.Broadcast == BroadcastAlways || d.noMulticast:
+		return true
+	}
+	after := BroadcastFallbackTicks * d.s.BaseBroadcastInterval
+	return now.Sub(time.Unix(0, d.heardMulticast.Load())) > after || now.Sub(time.Unix(0, d.heardBroadcast.Load())) <= after
+}
+
+// sendBroadcasts sends our discovery message for epoch to the broadcast addresses, if wanted.
+func (d *Discovery) sendBroadcasts(epoch int32) {
+	s := d.s
+	want := d.wantBroadcast(time.Now())
+	if d.broadcastOn.Swap(want) != want {
+		if want {
+			s.log.Infof("Broadcasting our announcements to %v", d.broadcast)
+		} else {
+			s.log.Infof("Multicast announcements heard again, stopping the broadcasts")
+		}
+	}
+	if !want {
+		return
+	}
+	for _, addr := range d.broadcast {
+		msg := append([]byte(BroadcastMessagePrefix), s.discoveryMessage(epoch)...)
+		if _, err := s.transport.WriteToUDP(msg, addr); err != nil {
+			s.log.LogVf("Error broadcasting discovery message to %v: %v", addr, err)
+		}
+	}
+}
+
+// listenDiscovery returns the socket receiving the announcements: the multicast one or, when
+// joining the group fails and we may broadcast, one on our discovery port for the broadcasts.
+func (d *Discovery) listenDiscovery(ctx context.Context) (*net.UDPConn, error) {
+	s := d.s
+	conn, err := net.ListenMulticastUDP("udp4", s.Listener.iface, s.destAddr)
+	if err == nil {
+		s.Listener.joinGroup(conn, s.destAddr)
+	}
+	if err == nil || d.broadcast == nil {
+		return conn, err
+	}
+	s.log.Warnf("Can't join multicast group %v, only broadcasting: %v", s.destAddr, err)
+	d.noMulticast = true
+	lc := net.ListenConfig{Control: reuseAddr}
+	pc, err := lc.ListenPacket(ctx, "udp4", fmt.Sprintf(":%d", s.Port))
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
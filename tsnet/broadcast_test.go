@@ -0,0 +1,81 @@
+package tsnet_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// multicastDropper drops the datagrams sent to multicast addresses, like some Wi-Fi access points.
+type multicastDropper struct {
+	tsnet.Transport
+}
+
+func (m multicastDropper) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if addr.IP.IsMulticast() {
+		return len(b), nil
+	}
+	return m.Transport.WriteToUDP(b, addr)
+}
+
+func TestParseBroadcastMode(t *testing.T) {
+	for _, m := range []tsnet.BroadcastMode{tsnet.BroadcastOff, tsnet.BroadcastAuto, tsnet.BroadcastAlways} {
+		if got, err := tsnet.ParseBroadcastMode(m.String()); err != nil || got != m {
+			t.Errorf("ParseBroadcastMode(%q) = %v, %v", m.String(), got, err)
+		}
+	}
+	if _, err := tsnet.ParseBroadcastMode("sometimes"); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+}
+
+// TestBroadcastFallback runs 2 servers whose multicast announcements are dropped: they find each
+// other once they fall back to broadcasting.
+func TestBroadcastFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var servers []*tsnet.Server
+	for _, name := range []string{"bcastA", "bcastB"} {
+		id, err := tcrypto.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := tsnet.Config{
+			Name: name, Identity: id, Mcast: "239.255.115.119", Port: testPort + 30,
+			BaseBroadcastInterval: 50 * time.Millisecond, Broadcast: tsnet.BroadcastAuto,
+			WrapTransport: func(t tsnet.Transport) tsnet.Transport { return multicastDropper{t} },
+		}
+		srv := cfg.NewServer()
+		if err = srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+		servers = append(servers, srv)
+	}
+	a, b := servers[0], servers[1]
+	peerA, _ := asPeer(a)
+	peerB, _ := asPeer(b)
+	for _, c := range []struct {
+		srv  *tsnet.Server
+		peer tsnet.Peer
+	}{{a, peerB}, {b, peerA}} {
+		for {
+			if _, ok := c.srv.Peers.Get(c.peer); ok {
+				break
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("%s never found %s", c.srv.Name, c.peer.Name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for _, srv := range servers { // found through a broadcast of the other, once it ticked.
+		if !srv.Discovery.Broadcasting() {
+			t.Errorf("%s should be broadcasting", srv.Name)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package tsnet
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+// Capabilities: the optional features of the connection handshake and of the messages after it, a
+// comma separated list advertised by the responder in its challenge and by the requester in its
+// response. Both lists are then bound into the handshake signatures (their transcript, see
+// tcrypto.SignChallenge and SignAccept) so an on-path attacker can't strip or change them to downgrade
+// the connection without the signatures failing. They are mandatory: a handshake without them, which
+// would be signed without a transcript, is a downgrade (see ErrDowngrade).
+const (
+	ChallengeCapsFormat = "challenge1 %q %s caps %s"   // target_name (the requester), nonce, capabilities
+	ResponseCapsFormat  = "response1 %q %s %s caps %s" // target_name (the responder), signature, offer, capabilities
+
+	// CapAuth is the authentication of the direct messages (see AuthSignatureFormat): the peer's
+	// unauthenticated ones are then dropped, as with Config.RequireAuth.
+	CapAuth = "auth"
+	// CapQUIC is the responder's QUIC port ("quic=port"), which its accept must carry.
+	CapQUIC = "quic"
+	// CapKex is the key exchanges the side supports in its order of preference (Config.KeyExchanges,
+	// "kex=x25519mlkem768+x25519"): the session uses the requester's first one the responder also
+	// supports (see negotiateKex). Being signed, the hybrid can't be stripped to fall back to X25519.
+	CapKex = "kex"
+)
+
+// ErrDowngrade is the error of the connections whose handshake lacks the capabilities or whose
+// signed ones don't match what was received.
+var ErrDowngrade = errors.New("capabilities downgrade")
+
+// capabilities returns the capabilities we advertise in our handshakes. They include our key
+// exchanges, so the negotiated one is bound to the signatures: a hybrid stripped in transit to fall
+// back to X25519 fails them.
+func (s *Server) capabilities() string {
+	caps := []string{CapAuth, CapKex + "=" + strings.ReplaceAll(tcrypto.FormatKex(s.KeyExchanges), ",", "+")}
+	if port := s.QUICListener.Port(); port != 0 {
+		caps = append(caps, CapQUIC+"="+strconv.Itoa(port))
+	}
+	return strings.Join(caps, ",")
+}
+
+// CapsTranscript returns the transcript of the responder's and requester's capabilities signed in the
+// handshake ("responder/requester"), empty when either side didn't advertise any.
+func CapsTranscript(responder, requester string) string {
+	if responder == "" || requester == "" {
+		return ""
+	}
+	return responder + "/" + requester
+}
+
+// capValue returns the value of the capability name in the caps list ("" if it has none) and
+// whether it's there.
+func capValue(caps, name string) (string, bool) {
+	for c := range strings.SplitSeq(caps, ",") {
+		key, value, _ := strings.Cut(c, "=")
+		if key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// checkQUICPort returns an error if the responder's accept doesn't carry the QUIC port of its
+// capabilities (or carries one without).
+func checkQUICPort(responderCaps string, quicPort int) error {
+	want := 0
+	if value, ok := capValue(responderCaps, CapQUIC); ok {
+		want, _ = strconv.Atoi(value)
+	}
+	if quicPort != want {
+		return fmt.Errorf("%w: QUIC port %d instead of %d", ErrDowngrade, quicPort, want)
+	}
+	return nil
+}
+
+// advertisedKex returns the key exchanges of the CapKex of caps, SessionKex for the peers not
+// advertising them.
+func advertisedKex(caps string) []tcrypto.KexAlgo {
+	value, ok := capValue(caps, CapKex)
+	if !ok {
+		return []tcrypto.KexAlgo{SessionKex}
+	}
+	return tcrypto.ParseKex(strings.ReplaceAll(value, "+", ","))
+}
+
+// negotiateKex returns the key exchange of a handshake: the requester's first one (in its order of
+// preference) the responder also supports, both sides computing the same from the signed capabilities.
+func negotiateKex(requester, responder []tcrypto.KexAlgo) (tcrypto.KexAlgo, error) {
+	kex, err := tcrypto.NegotiateKex(requester, responder)
+	if err != nil {
+		return kex, fmt.Errorf("%w: %s and %s", err, tcrypto.FormatKex(requester), tcrypto.FormatKex(responder))
+	}
+	return kex, nil
+}
+
+// recordCaps remembers the capabilities the peer (its public key) signed in a handshake.
+func (c *ConnectionManager) recordCaps(peer Peer, caps string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peerCaps == nil {
+		c.peerCaps = make(map[string]string)
+	}
+	c.peerCaps[peer.PublicKey] = caps
+}
+
+// hasCap returns true if the peer signed the capability name in a handshake.
+func (c *ConnectionManager) hasCap(peer Peer, name string) bool {
+	c.mu.Lock()
+	caps, ok := c.peerCaps[peer.PublicKey]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	_, ok = capValue(caps, name)
+	return ok
+}
+
+// errNoCaps returns the ErrDowngrade of a handshake in which the peer advertised no capabilities.
+func errNoCaps(peer Peer) error {
+	return fmt.Errorf("%w: %q advertised no capabilities", ErrDowngrade, peer.Name)
+}
@@ -0,0 +1,228 @@
+package tsnet_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// TestCapsDowngrade plays a peer from a raw socket: its handshake with the capabilities transcript is
+// accepted (and the accept signs it), then one signing a challenge whose hybrid key exchange was
+// stripped in transit, and one without them (as an attacker stripping them would send) are
+// rejected, in either direction.
+func TestCapsDowngrade(t *testing.T) {
+	srv := newUnicastServer(t, "capsServer")
+	srv.KeyExchanges = tcrypto.HybridKex
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer srv.Stop()
+	raw, err := net.ListenUDP("udp4", &net.UDPAddr{IP: srv.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawAddr := raw.LocalAddr().(*net.UDPAddr)
+	rawPeer := tsnet.Peer{IP: rawAddr.IP.String(), Name: "raw", PublicKey: id.PublicKeyToString()}
+	srv.AddPeer(rawPeer, rawAddr.Port)
+	to := srv.OurAddress()
+	pub, _ := tcrypto.IdentityPublicKeyString(srv.Identity.PublicKeyToString())
+	send := func(m tsnet.Message) tsnet.Message {
+		t.Helper()
+		msg := tsnet.EncodeMessage(m, tsnet.WireText)
+		msg = fmt.Appendf(msg, tsnet.AuthSignatureFormat, id.SignDetached(msg))
+		reply := exchange(t, raw, to, string(tsnet.PadMessage(msg, tsnet.ConnectMinSize, ' ')))
+		got, err := tsnet.DecodeMessage([]byte(reply))
+		if err != nil {
+			t.Fatalf("Reply to %+v: %q %v", m, reply, err)
+		}
+		return got
+	}
+	handshake := func(withCaps, stripKex bool) tsnet.Message {
+		t.Helper()
+		challenge, ok := send(&tsnet.ConnectMessage{Requester: "raw", Target: srv.Name}).(*tsnet.ChallengeMessage)
+		if !ok || challenge.Caps != tsnet.CapAuth+","+tsnet.CapKex+"=x25519mlkem768+x25519" {
+			t.Fatalf("Unexpected challenge %+v", challenge)
+		}
+		if stripKex {
+			challenge.Caps = tsnet.CapAuth + "," + tsnet.CapKex + "=x25519"
+		}
+		kex, err := tcrypto.NewKexInitiator(tsnet.SessionKex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := &tsnet.ChallengeResponseMessage{Target: srv.Name, KexOffer: tcrypto.EncodeBytes(tcrypto.KexPrefix, kex.Offer())}
+		transcript := ""
+		if withCaps {
+			response.Caps = tsnet.CapAuth
+			transcript = tsnet.CapsTranscript(challenge.Caps, response.Caps)
+		}
+		response.Signature = id.SignChallenge(challenge.Nonce, "raw", srv.Name, transcript, kex.Offer())
+		reply := send(response)
+		if accept, ok := reply.(*tsnet.AcceptMessage); ok {
+			kexReply, _ := tcrypto.DecodeBytes(tcrypto.KexPrefix, accept.KexReply)
+			if err = tcrypto.VerifyAccept(challenge.Nonce, "raw", srv.Name, transcript, kex.Offer(), kexReply,
+				accept.Signature, pub); err != nil {
+				t.Errorf("Accept not signed with the transcript %q: %v", transcript, err)
+			}
+		}
+		return reply
+	}
+	if reply, ok := handshake(true, false).(*tsnet.AcceptMessage); !ok {
+		t.Fatalf("Handshake with capabilities answered with %+v", reply)
+	}
+	if reply, ok := handshake(true, true).(*tsnet.RejectMessage); !ok {
+		t.Errorf("Handshake with the hybrid key exchange stripped answered with %+v", reply)
+	}
+	if reply, ok := handshake(false, false).(*tsnet.RejectMessage); !ok {
+		t.Errorf("Handshake without capabilities after advertising them answered with %+v", reply)
+	}
+	// The other way: our challenge without capabilities fails the server's connection request.
+	if err = srv.ConnectToPeer(rawPeer); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	buf := make([]byte, tsnet.BufSize)
+	_ = raw.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = raw.ReadFromUDP(buf); err != nil {
+		t.Fatalf("No connect request from the server: %v", err)
+	}
+	challenge := tsnet.EncodeMessage(&tsnet.ChallengeMessage{Target: srv.Name, Nonce: tcrypto.NewChallenge()}, tsnet.WireText)
+	challenge = fmt.Appendf(challenge, tsnet.AuthSignatureFormat, id.SignDetached(challenge))
+	if _, err = raw.WriteToUDP(challenge, to); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = srv.Connections.WaitConnected(ctx, rawPeer); !errors.Is(err, tsnet.ErrDowngrade) {
+		t.Errorf("Expected ErrDowngrade connecting with a challenge without capabilities, got %v", err)
+	}
+}
+
+// TestCapsRequired checks a peer's first handshake without capabilities (nothing to remember it
+// advertised them) is rejected too, in either direction.
+func TestCapsRequired(t *testing.T) {
+	srv := newUnicastServer(t, "capsRequired")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer srv.Stop()
+	raw, err := net.ListenUDP("udp4", &net.UDPAddr{IP: srv.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawAddr := raw.LocalAddr().(*net.UDPAddr)
+	rawPeer := tsnet.Peer{IP: rawAddr.IP.String(), Name: "raw", PublicKey: id.PublicKeyToString()}
+	srv.AddPeer(rawPeer, rawAddr.Port)
+	to := srv.OurAddress()
+	signed := func(m tsnet.Message) []byte {
+		msg := tsnet.EncodeMessage(m, tsnet.WireText)
+		return fmt.Appendf(msg, tsnet.AuthSignatureFormat, id.SignDetached(msg))
+	}
+	reply := exchange(t, raw, to, string(tsnet.PadMessage(signed(&tsnet.ConnectMessage{Requester: "raw", Target: srv.Name}),
+		tsnet.ConnectMinSize, ' ')))
+	challenge, err := tsnet.DecodeMessage([]byte(reply))
+	if err != nil {
+		t.Fatalf("Reply to the connect request: %q %v", reply, err)
+	}
+	kex, err := tcrypto.NewKexInitiator(tsnet.SessionKex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := challenge.(*tsnet.ChallengeMessage).Nonce
+	response := &tsnet.ChallengeResponseMessage{
+		Target:    srv.Name,
+		Signature: id.SignChallenge(nonce, "raw", srv.Name, "", kex.Offer()),
+		KexOffer:  tcrypto.EncodeBytes(tcrypto.KexPrefix, kex.Offer()),
+	}
+	reply = exchange(t, raw, to, string(signed(response)))
+	if got, err := tsnet.DecodeMessage([]byte(reply)); err != nil {
+		t.Fatalf("Reply to the response: %q %v", reply, err)
+	} else if _, ok := got.(*tsnet.RejectMessage); !ok {
+		t.Errorf("First handshake without capabilities answered with %+v", got)
+	}
+	if err = srv.ConnectToPeer(rawPeer); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	buf := make([]byte, tsnet.BufSize)
+	_ = raw.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = raw.ReadFromUDP(buf); err != nil {
+		t.Fatalf("No connect request from the server: %v", err)
+	}
+	if _, err = raw.WriteToUDP(signed(&tsnet.ChallengeMessage{Target: srv.Name, Nonce: tcrypto.NewChallenge()}), to); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = srv.Connections.WaitConnected(ctx, rawPeer); !errors.Is(err, tsnet.ErrDowngrade) {
+		t.Errorf("Expected ErrDowngrade connecting with a first challenge without capabilities, got %v", err)
+	}
+}
+
+// TestKexNegotiation connects servers preferring the post quantum hybrid key exchange, or only
+// supporting it, to each other and to one with the default X25519.
+func TestKexNegotiation(t *testing.T) {
+	hybrid := newUnicastServer(t, "hybrid")
+	hybrid.KeyExchanges = tcrypto.HybridKex
+	pqOnly := newUnicastServer(t, "pqOnly")
+	pqOnly.KeyExchanges = []tcrypto.KexAlgo{tcrypto.KexX25519MLKEM768}
+	classic := newUnicastServer(t, "classic")
+	servers := []*tsnet.Server{hybrid, pqOnly, classic}
+	for _, srv := range servers {
+		if err := srv.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	for _, a := range servers {
+		for _, b := range servers {
+			if a != b {
+				peer, port := asPeer(b)
+				a.AddPeer(peer, port)
+			}
+		}
+	}
+	tests := []struct {
+		from, to *tsnet.Server
+		want     tcrypto.KexAlgo // NoKex: no common key exchange.
+	}{
+		{hybrid, pqOnly, tcrypto.KexX25519MLKEM768},
+		{classic, hybrid, tcrypto.KexX25519},
+		{hybrid, classic, tcrypto.KexX25519},
+		{pqOnly, classic, tcrypto.NoKex},
+		{classic, pqOnly, tcrypto.NoKex},
+	}
+	for _, tt := range tests {
+		peer, _ := asPeer(tt.to)
+		us, _ := asPeer(tt.from)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tt.from.ConnectToPeer(peer); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		err := tt.from.Connections.WaitConnected(ctx, peer)
+		cancel()
+		switch {
+		case tt.want == tcrypto.NoKex && !errors.Is(err, tcrypto.ErrNoCommonKex) && !errors.Is(err, tsnet.ErrConnectionRejected):
+			t.Errorf("%s to %s should fail without a common key exchange, got %v", tt.from.Name, tt.to.Name, err)
+		case tt.want == tcrypto.NoKex:
+		case err != nil:
+			t.Errorf("%s to %s failed: %v", tt.from.Name, tt.to.Name, err)
+		case tt.from.Kex(peer) != tt.want || tt.to.Kex(us) != tt.want:
+			t.Errorf("%s to %s used %v/%v instead of %v", tt.from.Name, tt.to.Name, tt.from.Kex(peer), tt.to.Kex(us), tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package tsnet
+
+import (
+	"net"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+// ChallengeTimeout is how long a connection request's challenge can be answered.
+const ChallengeTimeout = 10 * time.Second
+
+const (
+	ChallengeMessageFormat  = "challenge1 %q %s"   // target_name (the requester), nonce
+	ChallengeResponseFormat = "response1 %q %s %s" // target_name (the responder), signature, key exchange offer
+)
+
+type challenge struct {
+	nonce string
+	caps  string // ours, sent with it.
+	sent  time.Time
+}
+
+// newChallenge returns the nonce and our capabilities for the peer's connection request: its pending
+// one if any, the request being retransmitted, otherwise a new one. Forgets the expired ones.
+func (c *ConnectionManager) newChallenge(peer Peer) (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for p, ch := range c.challenges {
+		if now.Sub(ch.sent) > ChallengeTimeout {
+			delete(c.challenges, p)
+		}
+	}
+	if ch, ok := c.challenges[peer]; ok {
+		return ch.nonce, ch.caps
+	}
+	ch := challenge{nonce: tcrypto.NewChallenge(), caps: c.s.capabilities(), sent: now}
+	if c.challenges == nil {
+		c.challenges = make(map[Peer]challenge)
+	}
+	c.challenges[peer] = ch
+	return ch.nonce, ch.caps
+}
+
+// takeChallenge returns (and forgets) the peer's pending nonce, "" if none or expired, and the
+// capabilities we sent with it.
+func (c *ConnectionManager) takeChallenge(peer Peer) (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.challenges[peer]
+	delete(c.challenges, peer)
+	if !ok || time.Since(ch.sent) > ChallengeTimeout {
+		return "", ""
+	}
+	return ch.nonce, ch.caps
+}
+
+// handleChallenge answers the challenge of the peer we sent a connection request to with our key
+// exchange offer and the nonce, bound to the offer and to both sides' capabilities (a challenge
+// without is a downgrade), signed with our identity: proving we own the public key we advertise.
+func (c *ConnectionManager) handleChallenge(from *net.UDPAddr, targetName, nonce, peerCaps string) {
+	s := c.s
+	src := Source{IP: from.IP.String(), Port: from.Port}
+	peer, exists := s.Sources.Get(src)
+	if !exists {
+		s.log.Warnf("Challenge from unknown source %v", src)
+		return
+	}
+	if targetName != s.Name {
+		s.log.Warnf("Challenge target name %q doesn't match our name %q", targetName, s.Name)
+		return
+	}
+	if pData, found := s.Peers.Get(peer); !found || pData.Status != SentConn {
+		s.log.Warnf("Unexpected challenge from %q (no pending connect request)", peer.Name)
+		return
+	}
+	if response, ok := c.pendingResponse(peer, nonce); ok {
+		s.log.LogVf("Duplicate challenge from %q (our connect request was retransmitted)", peer.Name)
+		c.reply(from, response)
+		return
+	}
+	if peerCaps == "" {
+		err := errNoCaps(peer)
+		s.log.Warnf("Challenge from %v (%q) without capabilities: %v", src, peer.Name, err)
+		s.recordUnproven(src.IP, peer, "capabilities downgrade")
+		c.fail(peer, err)
+		return
+	}
+	caps := s.capabilities()
+	transcript := CapsTranscript(peerCaps, caps)
+	offer, err := c.startKex(peer, nonce, peerCaps, transcript)
+	if err != nil {
+		s.log.Errf("Failed to start the key exchange with %q: %v", peer.Name, err)
+		c.fail(peer, err)
+		return
+	}
+	response := s.encode(&ChallengeResponseMessage{
+		Target:    peer.Name,
+		Signature: s.Identity.SignChallenge(nonce, s.Name, peer.Name, transcript, offer),
+		KexOffer:  tcrypto.EncodeBytes(tcrypto.KexPrefix, offer),
+		Caps:      caps,
+	})
+	c.expect(peer, from, response) // until the accept or reject.
+	c.reply(from, response)
+}
+
+// handleChallengeResponse checks the requester's signature of our challenge, its key exchange offer
+// and both sides' capabilities (a response without is a downgrade)
+// against the public key it advertises (and committed to, see checkCommitment): it is then accepted
+// (see accept), otherwise it's a failed attempt and it is rejected.
+func (c *ConnectionManager) handleChallengeResponse(from *net.UDPAddr, targetName, signature, encodedOffer, peerCaps string) {
+	s := c.s
+	src := Source{IP: from.IP.String(), Port: from.Port}
+	peer, exists := s.Sources.Get(src)
+	if !exists {
+		s.log.Warnf("Challenge response from unknown source %v", src)
+		return
+	}
+	if targetName != s.Name {
+		s.log.Warnf("Challenge response target name %q doesn't match our name %q", targetName, s.Name)
+		return
+	}
+	if reply, ok := c.handledResponse(peer, signature); ok {
+		s.log.LogVf("Duplicate challenge response from %q, replying again", peer.Name)
+		c.reply(from, reply)
+		return
+	}
+	nonce, caps := c.takeChallenge(peer)
+	pData, found := s.Peers.Get(peer)
+	if nonce == "" || !found || pData.Status != ReceivedConn {
+		s.log.Warnf("Unexpected challenge response from %q (no pending challenge)", peer.Name)
+		return
+	}
+	transcript := CapsTranscript(caps, peerCaps)
+	pub, err := tcrypto.IdentityPublicKeyString(peer.PublicKey)
+	if err == nil && peerCaps == "" {
+		err = errNoCaps(peer)
+	}
+	var offer []byte
+	if err == nil {
+		offer, err = tcrypto.DecodeBytes(tcrypto.KexPrefix, encodedOffer)
+	}
+	if err == nil {
+		err = tcrypto.VerifyChallenge(nonce, peer.Name, s.Name, transcript, offer, signature, pub)
+	}
+	if err == nil {
+		err = s.checkCommitment(peer)
+	}
+	if err != nil {
+		s.log.Errf("Invalid challenge response from %v (%q): %v", src, peer.Name, err)
+		s.recordUnproven(src.IP, peer, "invalid challenge response")
+		pData.Status = Failed
+		s.change(s.setPeer(peer, pData))
+		c.answered(from, peer, signature, s.sign(&RejectMessage{Target: peer.Name, Reason: "authentication failed"}))
+		return
+	}
+	c.recordCaps(peer, peerCaps)
+	c.accept(from, peer, pData, nonce, signature, peerCaps, transcript, offer)
+}
@@ -0,0 +1,173 @@
+package tsnet
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChaosConfig configures the faults injected by a ChaosTransport.
+type ChaosConfig struct {
+	Loss      float64       // probability for a datagram to be dropped
+	Duplicate float64       // probability for a datagram to be sent twice
+	Reorder   float64       // probability for a datagram to be held back so later ones overtake it
+	Latency   time.Duration // added to every datagram
+	Jitter    time.Duration // random extra latency, up to this
+	Seed      uint64        // for reproducible runs, random if 0
+	Logger    Logger        // instead of the fortio.org/log globals when set
+}
+
+// ParseChaos parses a comma separated list of key=value, e.g. "loss=0.05,dup=0.01,reorder=0.1,latency=20ms,jitter=5ms,seed=42".
+func ParseChaos(spec string) (ChaosConfig, error) {
+	var c ChaosConfig
+	for kv := range strings.SplitSeq(spec, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return c, fmt.Errorf("invalid chaos spec %q, expecting key=value", kv)
+		}
+		var err error
+		switch key {
+		case "loss":
+			c.Loss, err = parseProbability(value)
+		case "dup":
+			c.Duplicate, err = parseProbability(value)
+		case "reorder":
+			c.Reorder, err = parseProbability(value)
+		case "latency":
+			c.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			c.Jitter, err = time.ParseDuration(value)
+		case "seed":
+			c.Seed, err = strconv.ParseUint(value, 10, 64)
+		default:
+			return c, fmt.Errorf("unknown chaos key %q (valid: loss, dup, reorder, latency, jitter, seed)", key)
+		}
+		if err != nil {
+			return c, fmt.Errorf("invalid chaos %s value %q: %w", key, value, err)
+		}
+	}
+	return c, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err == nil && (p < 0 || p > 1) {
+		err = fmt.Errorf("%v not in [0,1]", p)
+	}
+	return p, err
+}
+
+func (c ChaosConfig) String() string {
+	return fmt.Sprintf("loss=%v,dup=%v,reorder=%v,latency=%v,jitter=%v,seed=%d",
+		c.Loss, c.Duplicate, c.Reorder, c.Latency, c.Jitter, c.Seed)
+}
+
+// ChaosTransport wraps a Transport and injects faults (loss, duplication, reordering, latency)
+// on the datagrams it sends, to exercise the reliability code under bad network conditions.
+type ChaosTransport struct {
+	Transport
+	cfg    ChaosConfig
+	mu     sync.Mutex
+	rng    *rand.Rand
+	timers map[*time.Timer]struct{}
+	closed bool
+	log    logFuncs
+}
+
+// NewChaosTransport returns t with the faults from cfg injected on sends.
+func NewChaosTransport(t Transport, cfg ChaosConfig) *ChaosTransport {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = rand.Uint64() //nolint:gosec // not cryptographic.
+	}
+	lg := newLogFuncs(cfg.Logger)
+	lg.Infof("Chaos on %v: %v (seed %d)", t.LocalAddr(), cfg, seed)
+	return &ChaosTransport{
+		Transport: t,
+		cfg:       cfg,
+		rng:       rand.New(rand.NewPCG(seed, seed)), //nolint:gosec // not cryptographic.
+		timers:    make(map[*time.Timer]struct{}),
+		log:       lg,
+	}
+}
+
+// WriteToUDP sends b to addr, or not, or twice, later... depending on the configured faults.
+// Like a real network, it doesn't report datagrams lost on the way.
+func (c *ChaosTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	if c.rng.Float64() < c.cfg.Loss {
+		c.mu.Unlock()
+		c.log.LogVf("Chaos: dropping %d bytes to %v", len(b), addr)
+		return len(b), nil
+	}
+	copies := 1
+	if c.rng.Float64() < c.cfg.Duplicate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = c.cfg.Latency
+		if c.cfg.Jitter > 0 {
+			delays[i] += time.Duration(c.rng.Int64N(int64(c.cfg.Jitter)))
+		}
+		if c.rng.Float64() < c.cfg.Reorder {
+			// Held back long enough for the next few datagrams to overtake it.
+			delays[i] += max(2*(c.cfg.Latency+c.cfg.Jitter), time.Millisecond)
+		}
+	}
+	c.mu.Unlock()
+	for _, d := range delays {
+		if d <= 0 {
+			if _, err := c.Transport.WriteToUDP(b, addr); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		c.later(d, append([]byte(nil), b...), addr)
+	}
+	return len(b), nil
+}
+
+// later sends data to addr after delay, unless closed by then.
+func (c *ChaosTransport) later(delay time.Duration, data []byte, addr *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		c.mu.Lock()
+		_, pending := c.timers[timer]
+		delete(c.timers, timer)
+		c.mu.Unlock()
+		if !pending {
+			return
+		}
+		if _, err := c.Transport.WriteToUDP(data, addr); err != nil {
+			c.log.LogVf("Chaos: delayed send to %v failed: %v", addr, err)
+		}
+	})
+	c.timers[timer] = struct{}{}
+}
+
+// Close cancels the delayed datagrams and closes the underlying transport.
+func (c *ChaosTransport) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	for t := range c.timers {
+		t.Stop()
+	}
+	clear(c.timers)
+	c.mu.Unlock()
+	return c.Transport.Close()
+}
@@ -0,0 +1,99 @@
+package tsnet_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+func TestParseChaos(t *testing.T) {
+	c, err := tsnet.ParseChaos("loss=0.05, dup=0.01,reorder=0.1,latency=20ms,jitter=5ms,seed=42")
+	if err != nil {
+		t.Fatalf("ParseChaos failed: %v", err)
+	}
+	expected := tsnet.ChaosConfig{
+		Loss: 0.05, Duplicate: 0.01, Reorder: 0.1,
+		Latency: 20 * time.Millisecond, Jitter: 5 * time.Millisecond, Seed: 42,
+	}
+	if c != expected {
+		t.Errorf("Got %v, expected %v", c, expected)
+	}
+	for _, bad := range []string{"loss", "loss=2", "foo=1", "latency=abc"} {
+		if _, err := tsnet.ParseChaos(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+// chaosRun sends n numbered datagrams through a chaos transport and returns the received sequence.
+func chaosRun(t *testing.T, cfg tsnet.ChaosConfig, n int) []int {
+	t.Helper()
+	network := tsnet.NewMemNetwork()
+	sender := tsnet.NewChaosTransport(network.Listen(), cfg)
+	receiver := network.Listen()
+	defer sender.Close()
+	defer receiver.Close()
+	to := receiver.LocalAddr().(*net.UDPAddr)
+	for i := range n {
+		if _, err := sender.WriteToUDP([]byte{byte(i >> 8), byte(i)}, to); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+	}
+	var got []int
+	received := make(chan int)
+	go func() {
+		buf := make([]byte, 2)
+		for {
+			if _, _, err := receiver.ReadFromUDP(buf); err != nil {
+				close(received)
+				return
+			}
+			received <- int(buf[0])<<8 | int(buf[1])
+		}
+	}()
+	timeout := time.After(cfg.Latency + cfg.Jitter + 200*time.Millisecond)
+	for {
+		select {
+		case i := <-received:
+			got = append(got, i)
+		case <-timeout:
+			return got
+		}
+	}
+}
+
+func TestChaosTransport(t *testing.T) {
+	const n = 1000
+	got := chaosRun(t, tsnet.ChaosConfig{Seed: 1}, n)
+	if len(got) != n {
+		t.Fatalf("No chaos: expected %d datagrams, got %d", n, len(got))
+	}
+	got = chaosRun(t, tsnet.ChaosConfig{Loss: 0.1, Duplicate: 0.1, Seed: 2}, n)
+	seen := make(map[int]int)
+	for _, i := range got {
+		seen[i]++
+	}
+	dups := len(got) - len(seen)
+	lost := n - len(seen)
+	t.Logf("Lost %d, duplicated %d", lost, dups)
+	if lost < 50 || lost > 150 || dups < 50 || dups > 150 {
+		t.Errorf("Expected ~100 lost and ~100 duplicated, got %d and %d", lost, dups)
+	}
+	start := time.Now()
+	got = chaosRun(t, tsnet.ChaosConfig{Reorder: 0.2, Latency: 10 * time.Millisecond, Seed: 3}, 200)
+	if len(got) != 200 {
+		t.Fatalf("Reorder: expected 200 datagrams, got %d", len(got))
+	}
+	reordered := 0
+	for i := 1; i < len(got); i++ {
+		if got[i] < got[i-1] {
+			reordered++
+		}
+	}
+	t.Logf("Reordered %d (in %v)", reordered, time.Since(start))
+	if reordered == 0 {
+		t.Errorf("Expected some reordering")
+	}
+}
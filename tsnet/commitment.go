@@ -0,0 +1,151 @@
+package tsnet
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+// Fingerprint commitments: each discovery message carries, signed, a short memory-hard commitment
+// binding its name, public key and epoch (see tcrypto.Commitment). We remember the last one
+// announced with each key for each name on each IP, and the peer with that name and IP must then
+// prove, in the connection handshake, a key committed to: this detects an attacker answering the
+// unicast with another key than the one broadcast (e.g. one it announced over mDNS, which isn't
+// signed). Keeping one entry per key means an announcement with a spoofed IP can't replace the
+// honest one, only add its own key's: up to MaxCommittedKeys per name and IP, further keys being
+// ignored until some are forgotten, which they are, like the peers, once not announced for
+// PeerTimeout (see PeersCleanup). Only the names known otherwise (AddPeer, mDNS) aren't checked.
+
+// MaxCommittedKeys is the number of keys whose commitment we remember for each name and IP.
+const MaxCommittedKeys = 4
+
+// ErrKeyMismatch is the error of the handshakes with a peer whose key isn't one committed to in
+// the discovery messages for its name (and IP).
+var ErrKeyMismatch = errors.New("key differs from the advertised one")
+
+// errNotCommitted wraps in ErrKeyMismatch the keys without a commitment for the name and IP.
+var errNotCommitted = errors.New("no commitment announced with this key")
+
+// advertiser is the name and IP a commitment was announced for.
+type advertiser struct {
+	IP, Name string
+}
+
+// advertisedCommitment is the last commitment announced with a key for an advertiser, with its epoch
+// and when it was.
+type advertisedCommitment struct {
+	commitment string
+	epoch      int32
+	seen       time.Time
+}
+
+// commitments remembers the commitments announced (see recordCommitment) and caches ours (see
+// discoveryCommitment).
+type commitments struct {
+	mu sync.Mutex
+	// by advertiser then public key.
+	advertised map[advertiser]map[string]advertisedCommitment
+	// our last commitment, which all the discovery messages of an epoch share: computing one is
+	// deliberately costly.
+	ours struct {
+		sync.Mutex
+		name, key  string
+		epoch      int32
+		commitment string
+	}
+}
+
+// DiscoveryMessage returns the discovery message announcing name with id's public key, signed by it.
+func DiscoveryMessage(id *tcrypto.Identity, name string, epoch int32, sent time.Time, nonce string) []byte {
+	return discoveryMessage(id, name, epoch, sent, nonce, tcrypto.Commitment(name, id.PublicKey, epoch))
+}
+
+// discoveryMessage returns our discovery message for the epoch, with a new nonce.
+func (s *Server) discoveryMessage(epoch int32) []byte {
+	return discoveryMessage(s.Identity, s.Name, epoch, time.Now(), discoveryNonce(), s.discoveryCommitment(epoch))
+}
+
+func discoveryMessage(id *tcrypto.Identity, name string, epoch int32, sent time.Time, nonce, commitment string) []byte {
+	payload := fmt.Sprintf(discoveryPayloadFormat, name, id.PublicKeyToString(), epoch, sent.UnixMilli(), nonce, commitment)
+	return []byte(payload + " s " + id.SignDiscovery(payload))
+}
+
+// discoveryCommitment returns the commitment of our discovery messages for the epoch.
+func (s *Server) discoveryCommitment(epoch int32) string {
+	key := s.Identity.PublicKeyToString()
+	ours := &s.commitments.ours
+	ours.Lock()
+	defer ours.Unlock()
+	if ours.commitment == "" || ours.name != s.Name || ours.key != key || ours.epoch != epoch {
+		ours.name, ours.key, ours.epoch = s.Name, key, epoch
+		ours.commitment = tcrypto.Commitment(s.Name, s.Identity.PublicKey, epoch)
+	}
+	return ours.commitment
+}
+
+// recordCommitment remembers the commitment of the discovery message of the peer.
+func (s *Server) recordCommitment(peer Peer, epoch int32, commitment string) {
+	c := &s.commitments
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.advertised == nil {
+		c.advertised = make(map[advertiser]map[string]advertisedCommitment)
+	}
+	a := advertiser{IP: peer.IP, Name: peer.Name}
+	keys := c.advertised[a]
+	if keys == nil {
+		keys = make(map[string]advertisedCommitment)
+		c.advertised[a] = keys
+	}
+	if _, known := keys[peer.PublicKey]; !known && len(keys) >= MaxCommittedKeys {
+		return
+	}
+	keys[peer.PublicKey] = advertisedCommitment{commitment, epoch, time.Now()}
+}
+
+// expireCommitments forgets the commitments not announced again since cutoff.
+func (s *Server) expireCommitments(cutoff time.Time) {
+	c := &s.commitments
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for a, keys := range c.advertised {
+		for key, ac := range keys {
+			if ac.seen.Before(cutoff) {
+				delete(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			delete(c.advertised, a)
+		}
+	}
+}
+
+// checkCommitment returns an ErrKeyMismatch error when commitments were announced for the peer's
+// name and IP but none with its public key, or that one doesn't match it; nil when it does or there
+// were none.
+func (s *Server) checkCommitment(peer Peer) error {
+	c := &s.commitments
+	c.mu.Lock()
+	keys := c.advertised[advertiser{IP: peer.IP, Name: peer.Name}]
+	a, ok := keys[peer.PublicKey]
+	committed := len(keys) > 0
+	c.mu.Unlock()
+	if !committed {
+		return nil
+	}
+	err := errNotCommitted
+	if ok {
+		var pub ed25519.PublicKey
+		if pub, err = tcrypto.IdentityPublicKeyString(peer.PublicKey); err == nil {
+			err = tcrypto.VerifyCommitment(a.commitment, peer.Name, pub, a.epoch)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %q on %s (%w)", ErrKeyMismatch, peer.Name, peer.IP, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package tsnet_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// announceAs sends the discovery message of name with id to srv from conn and waits for it.
+func announceAs(ctx context.Context, t *testing.T, srv *tsnet.Server, conn *net.UDPConn, id *tcrypto.Identity, name,
+	nonce string,
+) {
+	t.Helper()
+	if _, err := conn.WriteToUDP(tsnet.DiscoveryMessage(id, name, 1, time.Now(), nonce), srv.OurAddress()); err != nil {
+		t.Fatal(err)
+	}
+	peer := tsnet.Peer{IP: conn.LocalAddr().(*net.UDPAddr).IP.String(), Name: name, PublicKey: id.PublicKeyToString()}
+	for _, found := srv.Peers.Get(peer); !found; _, found = srv.Peers.Get(peer) {
+		if ctx.Err() != nil {
+			t.Fatalf("Announcement never received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// commitHandshake connects to srv as "raw" from the raw socket, signing with signer, and returns
+// the answer to its challenge response.
+func commitHandshake(t *testing.T, srv *tsnet.Server, raw *net.UDPConn, signer *tcrypto.Identity) tsnet.Message {
+	t.Helper()
+	send := func(m tsnet.Message) tsnet.Message {
+		t.Helper()
+		msg := tsnet.EncodeMessage(m, tsnet.WireText)
+		msg = fmt.Appendf(msg, tsnet.AuthSignatureFormat, signer.SignDetached(msg))
+		reply := exchange(t, raw, srv.OurAddress(), string(tsnet.PadMessage(msg, tsnet.ConnectMinSize, ' ')))
+		got, err := tsnet.DecodeMessage([]byte(reply))
+		if err != nil {
+			t.Fatalf("Reply to %+v: %q %v", m, reply, err)
+		}
+		return got
+	}
+	challenge, ok := send(&tsnet.ConnectMessage{Requester: "raw", Target: srv.Name}).(*tsnet.ChallengeMessage)
+	if !ok {
+		t.Fatalf("Unexpected challenge %+v", challenge)
+	}
+	kex, err := tcrypto.NewKexInitiator(tsnet.SessionKex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript := tsnet.CapsTranscript(challenge.Caps, tsnet.CapAuth)
+	return send(&tsnet.ChallengeResponseMessage{
+		Target: srv.Name, KexOffer: tcrypto.EncodeBytes(tcrypto.KexPrefix, kex.Offer()), Caps: tsnet.CapAuth,
+		Signature: signer.SignChallenge(challenge.Nonce, "raw", srv.Name, transcript, kex.Offer()),
+	})
+}
+
+// accepted returns true if the reply is an accept.
+func accepted(reply tsnet.Message) bool {
+	_, ok := reply.(*tsnet.AcceptMessage)
+	return ok
+}
+
+// TestCommitmentMismatch plays a peer from a raw socket announcing itself (with its commitment) to
+// the server: its handshake is accepted, also after another key announced the same name from its IP
+// (as spoofed, from another port), while the one with a key never announced (known out of band,
+// as from unsigned mDNS announcements) is rejected.
+func TestCommitmentMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := tsnet.Config{Name: "commitServer", Identity: id, Mcast: "239.255.115.123", Port: testPort + 70}
+	srv := cfg.NewServer()
+	if err = srv.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer srv.Stop()
+	raw, err := net.ListenUDP("udp4", &net.UDPAddr{IP: srv.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	announced, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoofer, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawAddr := raw.LocalAddr().(*net.UDPAddr)
+	spoofing, err := net.ListenUDP("udp4", &net.UDPAddr{IP: srv.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofing.Close()
+	announceAs(ctx, t, srv, raw, announced, "raw", "n1")
+	if reply, ok := commitHandshake(t, srv, raw, announced).(*tsnet.AcceptMessage); !ok {
+		t.Fatalf("Handshake with the announced key answered with %+v", reply)
+	}
+	announceAs(ctx, t, srv, spoofing, spoofer, "raw", "n2")
+	if reply, ok := commitHandshake(t, srv, raw, announced).(*tsnet.AcceptMessage); !ok {
+		t.Errorf("Handshake with the announced key, after another key's announcement, answered with %+v", reply)
+	}
+	srv.AddPeer(tsnet.Peer{IP: rawAddr.IP.String(), Name: "raw", PublicKey: other.PublicKeyToString()}, rawAddr.Port)
+	if reply, ok := commitHandshake(t, srv, raw, other).(*tsnet.RejectMessage); !ok {
+		t.Errorf("Handshake with another key than the announced one answered with %+v", reply)
+	}
+}
+
+// TestCommitmentLimits checks the keys committed to for a name and IP are capped, the ones announced
+// beyond MaxCommittedKeys being ignored (the handshake with one is rejected while the first key's is
+// still accepted), and forgotten once not announced again for PeerTimeout.
+func TestCommitmentLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const timeout = 500 * time.Millisecond
+	cfg := tsnet.Config{Name: "commitLimits", Identity: id, Mcast: "239.255.115.125", Port: testPort + 90, PeerTimeout: timeout}
+	srv := cfg.NewServer()
+	if err = srv.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer srv.Stop()
+	raw, err := net.ListenUDP("udp4", &net.UDPAddr{IP: srv.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	spoofing, err := net.ListenUDP("udp4", &net.UDPAddr{IP: srv.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofing.Close()
+	ids := make([]*tcrypto.Identity, tsnet.MaxCommittedKeys+1)
+	for i := range ids {
+		if ids[i], err = tcrypto.NewIdentity(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	announceAs(ctx, t, srv, raw, ids[0], "raw", "n0")
+	for i := 1; i < len(ids); i++ {
+		announceAs(ctx, t, srv, spoofing, ids[i], "raw", fmt.Sprintf("n%d", i))
+	}
+	if reply := commitHandshake(t, srv, raw, ids[0]); !accepted(reply) {
+		t.Fatalf("Handshake with the first announced key answered with %+v", reply)
+	}
+	rawAddr := raw.LocalAddr().(*net.UDPAddr)
+	last := tsnet.Peer{IP: rawAddr.IP.String(), Name: "raw", PublicKey: ids[len(ids)-1].PublicKeyToString()}
+	srv.AddPeer(last, rawAddr.Port)
+	if reply := commitHandshake(t, srv, raw, ids[len(ids)-1]); accepted(reply) {
+		t.Errorf("Handshake with a key announced beyond the limit answered with %+v", reply)
+	}
+	time.Sleep(timeout + 50*time.Millisecond)
+	srv.PeersCleanup()
+	srv.AddPeer(last, rawAddr.Port)
+	if reply := commitHandshake(t, srv, raw, ids[len(ids)-1]); !accepted(reply) {
+		t.Errorf("Handshake once the commitments expired answered with %+v", reply)
+	}
+}
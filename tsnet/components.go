@@ -0,0 +1,314 @@
+package tsnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Component is a part of the Server which can be started and stopped on its own, so embedders
+// can for instance run only the Listener and Connections (adding peers with AddPeer) without
+// multicast Discovery. The other components need the Listener's socket to do anything.
+// Components can be stopped and started again (but Server.Stop is final, see Server.Restart).
+type Component interface {
+	Start(ctx context.Context) error
+	Stop()
+	Running() bool
+}
+
+// ErrNotRunning is returned when using a component which isn't started (or a component
+// whose dependency isn't started).
+var ErrNotRunning = errors.New("component not running")
+
+var (
+	_ Component = (*Listener)(nil)
+	_ Component = (*Discovery)(nil)
+	_ Component = (*ServiceDiscovery)(nil)
+	_ Component = (*ConnectionManager)(nil)
+	_ Component = (*TransferManager)(nil)
+	_ Component = (*TCPListener)(nil)
+	_ Component = (*QUICListener)(nil)
+	_ Component = (*PortMapper)(nil)
+	_ Component = (*STUNClient)(nil)
+	_ Component = (*NATTraversal)(nil)
+)
+
+// Listener owns the unicast socket: used to send everything (including the multicast announcements)
+// and to receive the direct messages from peers.
+type Listener struct {
+	s       *Server
+	running atomic.Bool
+	iface   *net.Interface // interface to reach Target, nil for all.
+	// With Config.AllInterfaces, the interfaces we announce us on and listen to (see eachInterface).
+	ifaces   []net.Interface
+	mcastMu  sync.Mutex    // serializes the changes of the multicast interface.
+	localIPs []net.IP      // our addresses, when listening on all (see isOurAddr) or with LocalSocket.
+	local    *net.UnixConn // see Config.LocalSocket.
+	localDir string
+	networks []*net.IPNet // of our interfaces, see addrScore.
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func (l *Listener) Start(ctx context.Context) error {
+	if l.Running() {
+		return nil
+	}
+	s := l.s
+	if err := s.setDefaults(); err != nil {
+		return err
+	}
+	var (
+		goodIf  *net.Interface
+		localIP *net.UDPAddr
+		err     error
+	)
+	l.ifaces = nil
+	switch {
+	case s.Interface != "":
+		if goodIf, localIP, err = interfaceByName(s.Interface); err != nil {
+			return err
+		}
+		s.log.Infof("Using configured interface %q (with local IP %v)", goodIf.Name, localIP)
+	case s.AllInterfaces:
+		l.ifaces = multicastInterfaces(s.log)
+		s.log.Infof("Using all the multicast interfaces %v", interfaceNames(l.ifaces))
+	default:
+		// Try to get the right interface to listen on
+		if goodIf, localIP, err = getInternetInterface(ctx, s.Target, s.log); err != nil {
+			s.log.Warnf("Could not get default route interface using %q as test destination, will listen on all: %v", s.Target, err)
+		} else {
+			s.log.Infof("Using interface %q (with local IP %v)", goodIf.Name, localIP)
+		}
+	}
+	l.iface = goodIf
+	if localIP == nil {
+		localIP = &net.UDPAddr{}
+	}
+	if localIP.IP == nil || s.LocalSocket {
+		l.localIPs = localIPs()
+	}
+	l.networks = ourNetworks()
+	localIP.Port = s.ListenPort
+	s.dualUDPSock, err = net.ListenUDP("udp4", localIP) // was net.DialUDP("udp4", localIP, s.destAddr)
+	if err != nil {
+		return err
+	}
+	s.sockets.Add(1)
+	if err = setDontFragment(s.dualUDPSock); err != nil {
+		s.log.Warnf("Failed to set don't fragment on %v: %v", s.dualUDPSock.LocalAddr(), err)
+	}
+	if goodIf != nil {
+		// The multicast announcements go out of it too, whatever the routes.
+		if err = ipv4.NewPacketConn(s.dualUDPSock).SetMulticastInterface(goodIf); err != nil {
+			s.log.Warnf("Failed to set the multicast interface of %v to %q: %v", s.dualUDPSock.LocalAddr(), goodIf.Name, err)
+		}
+	}
+	s.batch = newBatchConn(s.dualUDPSock, s.log)
+	s.transport = s.dualUDPSock
+	if s.LocalSocket {
+		s.transport = localTransport{Transport: s.transport, l: l}
+	}
+	if s.WrapTransport != nil {
+		s.transport = s.WrapTransport(s.transport)
+	}
+	s.transport = statsTransport{Transport: s.transport, s: s}
+	if s.Relay {
+		s.transport = relayTransport{Transport: s.transport, n: s.NAT}
+	}
+	s.ourSendAddr = s.dualUDPSock.LocalAddr().(*net.UDPAddr)
+	s.log.Infof("Unicast socket created: %s", s.ourSendAddr)
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.local = nil
+	if s.LocalSocket {
+		if err = l.startLocal(ctx); err != nil {
+			s.log.Warnf("No local socket, the servers of this host are reached over UDP: %v", err)
+		}
+	}
+	l.wg.Add(1)
+	s.goroutines.Add(1)
+	go l.runUnicastReceive(ctx)
+	l.running.Store(true)
+	return nil
+}
+
+func (l *Listener) Stop() {
+	if !l.running.CompareAndSwap(true, false) {
+		return
+	}
+	l.cancel()
+	if l.s.transport.Close() == nil { // closes dualUDPSock (and unblocks the receiver).
+		l.s.sockets.Add(-1)
+	}
+	l.stopLocal()
+	l.wg.Wait()
+}
+
+func (l *Listener) Running() bool {
+	return l.running.Load()
+}
+
+// Discovery periodically announces us on the multicast address (and to the Config.StaticPeers and
+// the broadcast addresses, see Config.Broadcast), from the Listener's socket so peers learn our
+// unicast address, and maintains the Peers from the announcements received.
+type Discovery struct {
+	s               *Server
+	running         atomic.Bool
+	broadcastListen *net.UDPConn
+	static          []*net.UDPAddr // resolved Config.StaticPeers.
+	broadcast       []*net.UDPAddr // see Config.Broadcast, nil when off.
+	noMulticast     bool           // the group couldn't be joined, only broadcasting.
+	heardMulticast  atomic.Int64   // when a peer's multicast announcement was last received (unix ns).
+	heardBroadcast  atomic.Int64   // same for the broadcast ones.
+	broadcastOn     atomic.Bool
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
+}
+
+func (d *Discovery) Start(ctx context.Context) error {
+	if d.Running() {
+		return nil
+	}
+	s := d.s
+	if !s.Listener.Running() {
+		return fmt.Errorf("discovery needs the listener: %w", ErrNotRunning)
+	}
+	addr := fmt.Sprintf("%s:%d", s.Mcast, s.Port)
+	var err error
+	s.destAddr, err = net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	if d.static, err = s.resolveStaticPeers(); err != nil {
+		return err
+	}
+	d.broadcast, d.noMulticast = nil, false
+	if s.Broadcast != BroadcastOff {
+		if err = setBroadcast(s.dualUDPSock); err != nil {
+			s.log.Warnf("Can't broadcast from %v, only using multicast: %v", s.ourSendAddr, err)
+		} else {
+			d.broadcast = s.broadcastAddrs()
+		}
+	}
+	d.heardMulticast.Store(time.Now().UnixNano())
+	d.broadcastListen, err = d.listenDiscovery(ctx)
+	if err != nil {
+		return err
+	}
+	s.sockets.Add(1)
+	// Enable multicast loopback so we can see our own packets (needed on Windows)
+	p := ipv4.NewPacketConn(d.broadcastListen)
+	if err = p.SetMulticastLoopback(true); err != nil && !d.noMulticast {
+		s.log.Warnf("Failed to enable multicast loopback: %v", err)
+	}
+	s.log.Infof("Discovery on %s -> %s, multicast listen: %s", addr, s.destAddr, d.broadcastListen.LocalAddr())
+	ctx, d.cancel = context.WithCancel(ctx)
+	d.wg.Add(2) // broadcast sender and multicast receiver
+	s.goroutines.Add(2)
+	go d.runAdv(ctx)
+	go d.runMulticastReceive(ctx)
+	d.running.Store(true)
+	return nil
+}
+
+func (d *Discovery) Stop() {
+	if !d.running.CompareAndSwap(true, false) {
+		return
+	}
+	d.cancel()
+	if d.broadcastListen.Close() == nil { // needed or read will block forever
+		d.s.sockets.Add(-1)
+	}
+	d.wg.Wait()
+}
+
+func (d *Discovery) Running() bool {
+	return d.running.Load()
+}
+
+// ConnectionManager handles the connection requests and the MTU probing of peers.
+type ConnectionManager struct {
+	s       *Server
+	mu      sync.Mutex
+	running bool
+	probes  map[probeKey]chan struct{}
+	stopCh  chan struct{} // closed by Stop to abort the pending probes
+	wg      sync.WaitGroup
+	// Stateless cookies for connect floods (see checkCookie)
+	cookies   *tcrypto.CookieJar
+	loadStart time.Time
+	load      int
+	// Nonces of the connection requests' challenges (see handleChallengeResponse).
+	challenges map[Peer]challenge
+	// Our connection requests waiting for the peer's reply (see WaitConnected).
+	connecting map[Peer]*pendingConnect
+	// Our side of the key exchanges of our connection requests, and the resulting encrypted
+	// sessions with the connected peers and their key exchange (see session.go).
+	exchanges map[Peer]keyExchange
+	sessions  map[Peer]*tcrypto.Session
+	kexes     map[Peer]tcrypto.KexAlgo
+	// Our handshake messages waiting for the peer's next step and our replies to the challenge
+	// responses, sent again when they're lost (see retransmit.go).
+	retransmits map[Peer]*retransmit
+	answers     map[Peer]answer
+	// When the Connected peers last answered our keepalives (see keepalive.go).
+	alive map[Peer]time.Time
+	// Capabilities the peers signed in their handshakes, by public key (see caps.go).
+	peerCaps map[string]string
+}
+
+func (c *ConnectionManager) Start(_ context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running {
+		return nil
+	}
+	if err := c.s.setDefaults(); err != nil {
+		return err
+	}
+	c.stopCh = make(chan struct{})
+	c.connecting = nil // the previous waiters were stopped.
+	if c.cookies == nil {
+		c.cookies = tcrypto.NewCookieJar()
+	}
+	c.alive = nil
+	if c.s.KeepaliveInterval >= 0 {
+		ticker := time.NewTicker(c.keepaliveInterval())
+		c.s.tickers.Add(1)
+		c.s.goroutines.Add(1)
+		c.wg.Add(1)
+		go c.runKeepalive(ticker, c.stopCh)
+	}
+	c.running = true
+	return nil
+}
+
+func (c *ConnectionManager) Stop() {
+	c.mu.Lock()
+	if !c.running {
+		c.mu.Unlock()
+		return
+	}
+	// Barrier so no new MTU probe starts (they check running under that lock).
+	c.running = false
+	close(c.stopCh)
+	for peer := range c.retransmits {
+		c.stopRetransmit(peer)
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+}
+
+func (c *ConnectionManager) Running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running
+}
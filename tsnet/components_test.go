@@ -0,0 +1,467 @@
+package tsnet_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// lockedBuffer is a bytes.Buffer safe to read from the test while the stream writes to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+func newUnicastServer(t *testing.T, name string) *tsnet.Server {
+	t.Helper()
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := tsnet.Config{Name: name, Identity: id, NoDiscovery: true}
+	return cfg.NewServer()
+}
+
+func asPeer(srv *tsnet.Server) (tsnet.Peer, int) {
+	addr := srv.OurAddress()
+	return tsnet.Peer{IP: addr.IP.String(), Name: srv.Name, PublicKey: srv.Identity.PublicKeyToString()}, addr.Port
+}
+
+// TestComponentsNoDiscovery runs 2 servers without multicast, knowing each other through AddPeer.
+func TestComponentsNoDiscovery(t *testing.T) {
+	a := newUnicastServer(t, "unicastA")
+	b := newUnicastServer(t, "unicastB")
+	if err := b.Discovery.Start(context.Background()); !errors.Is(err, tsnet.ErrNotRunning) {
+		t.Errorf("Discovery without Listener should fail with ErrNotRunning, got %v", err)
+	}
+	received := &lockedBuffer{}
+	done := make(chan error, 1)
+	b.OnStream = func(_ tsnet.Peer, _ uint32) io.Writer { return received }
+	b.OnStreamDone = func(_ tsnet.Peer, _ uint32, _ int64, err error) { done <- err }
+	other := make(chan string, 1)
+	b.OnData = func(_ tsnet.Peer, data []byte) { other <- string(data) }
+	ctx := context.Background()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+		if srv.Discovery.Running() || !srv.Listener.Running() || !srv.Transfers.Running() {
+			t.Errorf("Unexpected components running for %s", srv.Name)
+		}
+		if r := srv.Resources(); r.Goroutines != 2 || r.Sockets != 1 || r.Tickers != 1 { // receiver and keepalive.
+			t.Errorf("Unexpected resources without discovery: %+v", r)
+		}
+	}
+	peerB, portB := asPeer(b)
+	peerA, portA := asPeer(a)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if mtu, err := a.ProbeMTU(ctx, peerB); err != nil || mtu <= tsnet.DefaultMTU {
+		t.Errorf("ProbeMTU: %d %v", mtu, err)
+	}
+	if err := a.SendData(peerB, []byte("not a stream")); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	select {
+	case got := <-other:
+		if got != "not a stream" {
+			t.Errorf("Unexpected OnData %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timeout waiting for OnData")
+	}
+	data := make([]byte, 300_000)
+	for i := range data {
+		data[i] = byte(rand.UintN(256)) //nolint:gosec // test data.
+	}
+	n, err := a.Transfers.Send(ctx, peerB, bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Send: %d %v", n, err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Stream failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for the stream")
+	}
+	if !bytes.Equal(received.Bytes(), data) {
+		t.Errorf("Received %d bytes different from the %d sent", len(received.Bytes()), len(data))
+	}
+	// Components can be stopped and restarted on their own.
+	a.Transfers.Stop()
+	if _, err = a.Transfers.Send(ctx, peerB, bytes.NewReader(data)); !errors.Is(err, tsnet.ErrNotRunning) {
+		t.Errorf("Send on stopped Transfers should fail with ErrNotRunning, got %v", err)
+	}
+	a.Connections.Stop()
+	if err = a.ConnectToPeer(peerB); !errors.Is(err, tsnet.ErrNotRunning) {
+		t.Errorf("Connect on stopped Connections should fail with ErrNotRunning, got %v", err)
+	}
+	if err = a.Connections.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ConnectToPeer(peerB); err != nil {
+		t.Errorf("Connect after restarting Connections failed: %v", err)
+	}
+}
+
+// TestConnectReject checks the connection handshake: accepted, then rejected by OnConnectRequest,
+// whose reason the requester gets (OnReject, PeerData.Reason and WaitConnected's error).
+func TestConnectReject(t *testing.T) {
+	a := newUnicastServer(t, "handshakeA")
+	b := newUnicastServer(t, "handshakeB")
+	rejected := make(chan string, 1)
+	a.OnReject = func(_ tsnet.Peer, reason string) { rejected <- reason }
+	var reject atomic.Bool
+	b.OnConnectRequest = func(peer tsnet.Peer) error {
+		if reject.Load() {
+			return fmt.Errorf("not now %s", peer.Name)
+		}
+		return nil
+	}
+	ctx := context.Background()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerB, portB := asPeer(b)
+	peerA, portA := asPeer(a)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	waitStatus := func(srv *tsnet.Server, peer tsnet.Peer, want tsnet.ConnectionStatus) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			pd, _ := srv.Peers.Get(peer)
+			if pd.Status == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %s status %v, want %v", srv.Name, peer.Name, pd.Status, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	waitStatus(a, peerB, tsnet.Connected)
+	waitStatus(b, peerA, tsnet.Connected)
+	reject.Store(true)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	waitStatus(a, peerB, tsnet.Failed)
+	waitStatus(b, peerA, tsnet.Failed)
+	select {
+	case reason := <-rejected:
+		if reason != "not now handshakeA" {
+			t.Errorf("OnReject reason %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnReject not called")
+	}
+	if pd, _ := a.Peers.Get(peerB); pd.Reason != "not now handshakeA" {
+		t.Errorf("PeerData.Reason %q", pd.Reason)
+	}
+	if err := a.Connections.WaitConnected(ctx, peerB); !errors.Is(err, tsnet.ErrConnectionRejected) ||
+		!strings.HasSuffix(err.Error(), ": not now handshakeA") {
+		t.Errorf("WaitConnected after the reject: %v", err)
+	}
+	reject.Store(false)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	waitStatus(a, peerB, tsnet.Connected)
+	if pd, _ := a.Peers.Get(peerB); pd.Reason != "" {
+		t.Errorf("PeerData.Reason %q once connected", pd.Reason)
+	}
+}
+
+// TestConnectAuthentication checks a peer can't connect with a public key it doesn't own.
+func TestConnectAuthentication(t *testing.T) {
+	a := newUnicastServer(t, "authA")
+	b := newUnicastServer(t, "authB")
+	ctx := context.Background()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	var failures atomic.Int32
+	b.OnAudit = func(_ tsnet.AuditEvent) { failures.Add(1) }
+	other, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerB, portB := asPeer(b)
+	peerA, portA := asPeer(a)
+	peerA.PublicKey = other.PublicKeyToString() // A claims someone else's key.
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err = a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pa, _ := a.Peers.Get(peerB)
+		pb, _ := b.Peers.Get(peerA)
+		if pa.Status == tsnet.Failed && pb.Status == tsnet.Failed {
+			break
+		}
+		if pa.Status == tsnet.Connected || pb.Status == tsnet.Connected {
+			t.Fatalf("Connection with a wrong public key established: %v %v", pa.Status, pb.Status)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection not failed: %v %v", pa.Status, pb.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if failures.Load() == 0 {
+		t.Errorf("Invalid challenge response not recorded as a failed attempt")
+	}
+}
+
+// TestTCPTransport checks connected peers move their data to the TCP stream, with larger
+// messages, and fall back to datagrams once it's closed.
+func TestTCPTransport(t *testing.T) {
+	a := newUnicastServer(t, "tcpA")
+	b := newUnicastServer(t, "tcpB")
+	a.Transport, b.Transport = tsnet.TCPTransport, tsnet.TCPTransport
+	received := make(chan []byte, 10)
+	b.OnData = func(_ tsnet.Peer, data []byte) { received <- bytes.Clone(data) }
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerB, portB := asPeer(b)
+	peerA, portA := asPeer(a)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	if !a.HasTCP(peerB) {
+		t.Fatalf("No TCP stream to B after connecting")
+	}
+	if size := a.MaxDataSize(peerB); size != tsnet.TCPMaxDataSize {
+		t.Errorf("MaxDataSize with a TCP stream = %d, want %d", size, tsnet.TCPMaxDataSize)
+	}
+	want := make([]byte, tsnet.TCPMaxDataSize)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	if err := a.SendDataBatch(peerB, [][]byte{want, []byte("second")}); err != nil {
+		t.Fatalf("SendDataBatch failed: %v", err)
+	}
+	for _, w := range [][]byte{want, []byte("second")} {
+		select {
+		case got := <-received:
+			if !bytes.Equal(got, w) {
+				t.Errorf("Received %d bytes, want %d", len(got), len(w))
+			}
+		case <-ctx.Done():
+			t.Fatalf("Timeout waiting for the data over TCP")
+		}
+	}
+	if !b.HasTCP(peerA) {
+		t.Errorf("B should have A's TCP stream")
+	}
+	// Without the stream, data goes through datagrams again.
+	b.TCPListener.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for a.HasTCP(peerB) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a.HasTCP(peerB) {
+		t.Fatalf("A's TCP stream should be closed once B stopped its listener")
+	}
+	if err := a.SendData(peerB, []byte("datagram")); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	select {
+	case got := <-received:
+		if string(got) != "datagram" {
+			t.Errorf("Received %q, want datagram", got)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for the datagram")
+	}
+	for _, srv := range []*tsnet.Server{a, b} {
+		srv.Stop()
+		if err := srv.CheckReleased(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestTCPTransportConcurrent checks concurrent sends on the TCP stream, interleaved with sealed
+// datagrams, all arrive without failing the stream nor recording failed attempts.
+func TestTCPTransportConcurrent(t *testing.T) {
+	a := newUnicastServer(t, "tcpConcA")
+	b := newUnicastServer(t, "tcpConcB")
+	a.Transport, b.Transport = tsnet.TCPTransport, tsnet.TCPTransport
+	// Frequent keepalives: datagrams authenticated with the session, as the stream frames go.
+	a.KeepaliveInterval, b.KeepaliveInterval = 50*time.Millisecond, 50*time.Millisecond
+	const senders, perSender = 8, 100
+	var received, audits atomic.Int32
+	b.OnData = func(_ tsnet.Peer, _ []byte) { received.Add(1) }
+	b.OnAudit = func(_ tsnet.AuditEvent) { audits.Add(1) }
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerB, portB := asPeer(b)
+	peerA, portA := asPeer(a)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	if !a.HasTCP(peerB) {
+		t.Fatalf("No TCP stream to B after connecting")
+	}
+	var wg sync.WaitGroup
+	for range senders {
+		wg.Go(func() {
+			for range perSender {
+				if err := a.SendData(peerB, []byte("concurrent")); err != nil {
+					t.Errorf("SendData failed: %v", err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for received.Load() < senders*perSender && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := received.Load(); got != senders*perSender {
+		t.Errorf("Received %d messages, want %d", got, senders*perSender)
+	}
+	if !a.HasTCP(peerB) {
+		t.Errorf("TCP stream closed by the concurrent sends")
+	}
+	if n := audits.Load(); n != 0 {
+		t.Errorf("%d failed attempts recorded", n)
+	}
+}
+
+// TestQUICTransport checks connected peers move their data to a QUIC connection, with larger
+// messages, in both directions.
+func TestQUICTransport(t *testing.T) {
+	a := newUnicastServer(t, "quicA")
+	b := newUnicastServer(t, "quicB")
+	a.Transport, b.Transport = tsnet.QUICTransport, tsnet.QUICTransport
+	receivedA := make(chan []byte, 10)
+	receivedB := make(chan []byte, 10)
+	a.OnData = func(_ tsnet.Peer, data []byte) { receivedA <- bytes.Clone(data) }
+	b.OnData = func(_ tsnet.Peer, data []byte) { receivedB <- bytes.Clone(data) }
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerB, portB := asPeer(b)
+	peerA, portA := asPeer(a)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	if !a.HasQUIC(peerB) || a.HasTCP(peerB) {
+		t.Fatalf("No QUIC stream to B after connecting")
+	}
+	if size := a.MaxDataSize(peerB); size != tsnet.TCPMaxDataSize {
+		t.Errorf("MaxDataSize with a QUIC stream = %d, want %d", size, tsnet.TCPMaxDataSize)
+	}
+	want := make([]byte, tsnet.TCPMaxDataSize)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	if err := a.SendDataBatch(peerB, [][]byte{want, []byte("second")}); err != nil {
+		t.Fatalf("SendDataBatch failed: %v", err)
+	}
+	for _, w := range [][]byte{want, []byte("second")} {
+		select {
+		case got := <-receivedB:
+			if !bytes.Equal(got, w) {
+				t.Errorf("Received %d bytes, want %d", len(got), len(w))
+			}
+		case <-ctx.Done():
+			t.Fatalf("Timeout waiting for the data over QUIC")
+		}
+	}
+	if !b.HasQUIC(peerA) {
+		t.Fatalf("B should have A's QUIC stream")
+	}
+	if err := b.SendData(peerA, []byte("reply")); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	select {
+	case got := <-receivedA:
+		if string(got) != "reply" {
+			t.Errorf("Received %q, want reply", got)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for the reply over QUIC")
+	}
+	for _, srv := range []*tsnet.Server{a, b} {
+		srv.Stop()
+		if err := srv.CheckReleased(); err != nil {
+			t.Error(err)
+		}
+	}
+}
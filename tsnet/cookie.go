@@ -0,0 +1,91 @@
+package tsnet
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// DefaultCookieThreshold is the number of connect requests per second above which
+	// requesters must first echo a cookie (see Config.CookieThreshold).
+	DefaultCookieThreshold = 50
+	// ConnectMinSize is the size connect requests are padded to (with trailing spaces, ignored by older
+	// peers, or zeros in the binary format) and the minimum size of the requests we answer with a
+	// cookie, so the reply is never larger than the (possibly spoofed) request.
+	ConnectMinSize = 96
+)
+
+const (
+	ConnectCookieFormat = "connect1 %q %q c %s" // requester_name, target_name, cookie
+	CookieMessageFormat = "cookie1 %s"          // cookie for the requester's address
+)
+
+// underLoad counts a connect request and returns whether requests must now carry a valid cookie.
+func (c *ConnectionManager) underLoad() bool {
+	threshold := c.s.CookieThreshold
+	if threshold == 0 {
+		threshold = DefaultCookieThreshold
+	}
+	if threshold < 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.loadStart) >= time.Second {
+		c.loadStart = now
+		c.load = 0
+	}
+	c.load++
+	return c.load > threshold
+}
+
+// checkCookie returns true when the connect request (of size bytes) can be processed: either
+// we're not under load or it carries a valid cookie. Otherwise it replies with a cookie, without
+// keeping any state, if the request is large enough to not turn us into an amplifier.
+func (c *ConnectionManager) checkCookie(from *net.UDPAddr, cookie string, size int) bool {
+	if !c.underLoad() || c.cookies.Valid(from.String(), cookie) {
+		return true
+	}
+	s := c.s
+	if cookie != "" {
+		s.log.LogVf("Dropping connect request from %v with invalid cookie %q", from, cookie)
+		s.recordUnproven(from.IP.String(), Peer{}, "connect request with an invalid cookie")
+		return false
+	}
+	if size < ConnectMinSize {
+		s.log.LogVf("Dropping connect request from %v under load (%d bytes)", from, size)
+		return false
+	}
+	message := s.encode(&CookieMessage{Cookie: c.cookies.Cookie(from.String())})
+	if _, err := s.transport.WriteToUDP(message, from); err != nil {
+		s.log.Errf("Failed to send cookie to %v: %v", from, err)
+	}
+	return false
+}
+
+// handleCookie resends our pending connect request to the peer, with its cookie.
+func (c *ConnectionManager) handleCookie(from *net.UDPAddr, cookie string) {
+	s := c.s
+	src := Source{IP: from.IP.String(), Port: from.Port}
+	peer, exists := s.Sources.Get(src)
+	if !exists {
+		s.log.Warnf("Cookie from unknown source %v", src)
+		return
+	}
+	pData, found := s.Peers.Get(peer)
+	if !found || pData.Status != SentConn {
+		s.log.Warnf("Unexpected cookie from %q (no pending connect request)", peer.Name)
+		return
+	}
+	s.log.Infof("Resending connection request to %s with its cookie", peer.Name)
+	message := s.sign(&ConnectMessage{Requester: s.Name, Target: peer.Name, Cookie: cookie})
+	c.expect(peer, from, message) // the cookie acknowledged the request, this one until the challenge.
+	if _, err := s.transport.WriteToUDP(message, from); err != nil {
+		s.log.Errf("Failed to resend connect request to %q: %v", peer.Name, err)
+	}
+}
+
+// connectMessage returns the signed (padded to ConnectMinSize) connect request for peer.
+func (s *Server) connectMessage(peer Peer) []byte {
+	return PadMessage(s.sign(&ConnectMessage{Requester: s.Name, Target: peer.Name}), ConnectMinSize, ' ')
+}
@@ -0,0 +1,84 @@
+package tsnet_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// TestConnectCookie connects to a server requiring cookies for all the connect requests.
+func TestConnectCookie(t *testing.T) {
+	a := newUnicastServer(t, "cookieA")
+	b := newUnicastServer(t, "cookieB")
+	b.CookieThreshold = -1
+	ctx := context.Background()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerB, portB := asPeer(b)
+	peerA, portA := asPeer(a)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if pd, _ := a.Peers.Get(peerB); pd.Status == tsnet.Connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection request with cookie not accepted by B")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// Raw requests from an unknown address: only padded ones get a (smaller) cookie reply.
+	raw, err := net.ListenUDP("udp4", &net.UDPAddr{IP: b.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	to := b.OurAddress()
+	short := fmt.Sprintf(tsnet.ConnectMessageFormat, "spoofed", b.Name)
+	if reply := exchange(t, raw, to, short); reply != "" {
+		t.Errorf("Short connect request answered with %q", reply)
+	}
+	padded := short + strings.Repeat(" ", tsnet.ConnectMinSize-len(short))
+	reply := exchange(t, raw, to, padded)
+	var cookie string
+	if n, err := fmt.Sscanf(reply, tsnet.CookieMessageFormat, &cookie); err != nil || n != 1 ||
+		!strings.HasPrefix(cookie, tcrypto.CookiePrefix) {
+		t.Fatalf("Unexpected cookie reply %q: %v", reply, err)
+	}
+	if len(reply) > len(padded) {
+		t.Errorf("Cookie reply larger than the request: %d > %d", len(reply), len(padded))
+	}
+	bad := fmt.Sprintf(tsnet.ConnectCookieFormat, "spoofed", b.Name, tcrypto.CookiePrefix+"AAAAAAAAAAAAAAAAAAAAAA")
+	if reply = exchange(t, raw, to, bad+strings.Repeat(" ", tsnet.ConnectMinSize)); reply != "" {
+		t.Errorf("Connect request with an invalid cookie answered with %q", reply)
+	}
+}
+
+// exchange sends msg and returns the reply, if any, received within 200ms.
+func exchange(t *testing.T, conn *net.UDPConn, to *net.UDPAddr, msg string) string {
+	t.Helper()
+	if _, err := conn.WriteToUDP([]byte(msg), to); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, tsnet.BufSize)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
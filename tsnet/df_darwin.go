@@ -0,0 +1,23 @@
+package tsnet
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment sets the DF bit on the datagrams we send, so too large ones fail instead of being fragmented.
+func setDontFragment(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sErr error
+	err = rc.Control(func(fd uintptr) {
+		sErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_DONTFRAG, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sErr
+}
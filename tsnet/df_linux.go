@@ -0,0 +1,24 @@
+package tsnet
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment sets the DF bit on the datagrams we send, so too large ones fail
+// (with EMSGSIZE when the local path MTU is known to be smaller) instead of being fragmented.
+func setDontFragment(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sErr error
+	err = rc.Control(func(fd uintptr) {
+		sErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+	})
+	if err != nil {
+		return err
+	}
+	return sErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package tsnet
+
+import (
+	"net"
+)
+
+// setDontFragment isn't supported on this platform: large MTU probes may get fragmented
+// (and reassembled) instead of failing, which still works, just less efficiently.
+func setDontFragment(_ *net.UDPConn) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tsnet
+
+import (
+	"errors"
+	"net"
+)
+
+// defaultGateway isn't implemented here: the gateway is guessed (see PortMapper.gateway).
+func defaultGateway() (net.IP, error) {
+	return nil, errors.ErrUnsupported
+}
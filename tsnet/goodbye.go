@@ -0,0 +1,118 @@
+package tsnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+const (
+	LeaveMessageFormat = leavePayloadFormat + " s %s" // ..., SignDetached signature of the payload
+
+	leavePayloadFormat = "leave1 %q %s t %d n %s" // name, public key, unix time in ms, nonce
+	leaveMessagePrefix = "leave1 "
+)
+
+// LeaveMessage returns the message telling the peers that name, with id's public key, is leaving,
+// signed by it.
+func LeaveMessage(id *tcrypto.Identity, name string, sent time.Time, nonce string) []byte {
+	payload := fmt.Sprintf(leavePayloadFormat, name, id.PublicKeyToString(), sent.UnixMilli(), nonce)
+	return []byte(payload + " s " + id.SignDetached([]byte(payload)))
+}
+
+// sayGoodbye tells the peers that we're stopping, on the discovery group (or broadcast) and
+// directly to the connected peers, so they remove us right away instead of after PeerTimeout.
+func (s *Server) sayGoodbye() {
+	if !s.Listener.Running() {
+		return
+	}
+	msg := LeaveMessage(s.Identity, s.Name, time.Now(), discoveryNonce())
+	sent := 0
+	send := func(buf []byte, addr *net.UDPAddr) {
+		if _, err := s.transport.WriteToUDP(buf, addr); err != nil {
+			s.log.LogVf("Error sending goodbye to %v: %v", addr, err)
+			return
+		}
+		sent++
+	}
+	if d := s.Discovery; d.Running() {
+		if !d.noMulticast {
+			err := s.sendMulticast(func() []byte { return LeaveMessage(s.Identity, s.Name, time.Now(), discoveryNonce()) })
+			if err != nil {
+				s.log.LogVf("Error sending goodbye to %v: %v", s.destAddr, err) // can be partial.
+			}
+			sent++
+		}
+		if d.broadcastOn.Load() {
+			for _, addr := range d.broadcast {
+				send(append([]byte(BroadcastMessagePrefix), msg...), addr)
+			}
+		}
+	}
+	for _, kv := range s.Peers.KeysValuesSnapshot() {
+		if kv.Value.Status == Connected {
+			send(msg, s.peerAddr(kv.Key, kv.Value))
+		}
+	}
+	s.log.Infof("Sent %d goodbye messages", sent)
+}
+
+// decodeLeave returns the name and public key of a leave message, a tcrypto.SignatureInvalidError
+// if it isn't signed by that public key's identity and an ErrReplayed error if it's too old or
+// already received (each copy of the goodbye has the same nonce, only the first one counts).
+func (s *Server) decodeLeave(buf []byte) (string, string, error) {
+	var name, pubKeyStr, nonce, signature string
+	var unixMilli int64
+	n, err := fmt.Sscanf(string(buf), LeaveMessageFormat, &name, &pubKeyStr, &unixMilli, &nonce, &signature)
+	if err != nil {
+		return "", "", err
+	}
+	if n != 5 {
+		return "", "", fmt.Errorf("could not decode leave message %q", string(buf))
+	}
+	pub, err := tcrypto.IdentityPublicKeyString(pubKeyStr)
+	if err != nil {
+		return "", "", err
+	}
+	payload := buf[:bytes.LastIndex(buf, []byte(" s "))] // the signature has no spaces.
+	if err = tcrypto.VerifyDetached(payload, signature, pub); err != nil {
+		return "", "", err
+	}
+	if err = s.checkReplay(unixMilli, nonce); err != nil {
+		return "", "", err
+	}
+	return name, pubKeyStr, nil
+}
+
+// handleLeave removes the peer saying goodbye (from the multicast group or directly). Restarting
+// peers are kept, they announced they'll be back.
+func (s *Server) handleLeave(buf []byte, from *net.UDPAddr) {
+	name, pubKey, err := s.decodeLeave(buf)
+	if errors.Is(err, ErrReplayed) {
+		s.log.LogVf("Ignoring leave message from %v: %v", from, err)
+		return
+	}
+	if err != nil {
+		s.log.Warnf("Ignoring invalid leave message %q from %v: %v", buf, from, err)
+		return
+	}
+	// From any of the peer's addresses (see PeerData.Addrs).
+	peer, known := s.Sources.Get(Source{IP: from.IP.String(), Port: from.Port})
+	pData, found := s.Peers.Get(peer)
+	if !known || !found || peer.Name != name || peer.PublicKey != pubKey || !pData.RestartUntil.IsZero() {
+		s.log.LogVf("Ignoring leave message from %v for %q", from, name)
+		return
+	}
+	s.log.Infof("Peer %q is leaving", peer.Name)
+	v := s.deletePeers(peer)
+	s.Sources.Delete(peerSources(peer, pData)...)
+	s.Connections.dropSessions(peer)
+	s.change(v)
+	if pData.Status == Connected && s.OnDisconnect != nil {
+		s.OnDisconnect(peer)
+	}
+}
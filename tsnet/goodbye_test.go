@@ -0,0 +1,68 @@
+package tsnet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// TestGoodbye checks a stopping server's connected peers remove it right away, but keep it when it
+// announced a restart.
+func TestGoodbye(t *testing.T) {
+	a := newUnicastServer(t, "goodbyeA")
+	b := newUnicastServer(t, "goodbyeB")
+	c := newUnicastServer(t, "goodbyeC")
+	left := make(chan tsnet.Peer, 1)
+	a.OnDisconnect = func(peer tsnet.Peer) { left <- peer }
+	ctx := context.Background()
+	for _, srv := range []*tsnet.Server{a, b, c} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+	}
+	defer a.Stop()
+	peerA, portA := asPeer(a)
+	peerB, portB := asPeer(b)
+	peerC, portC := asPeer(c)
+	a.AddPeer(peerB, portB)
+	a.AddPeer(peerC, portC)
+	b.AddPeer(peerA, portA)
+	c.AddPeer(peerA, portA)
+	for _, peer := range []tsnet.Peer{peerB, peerC} {
+		if err := a.ConnectToPeer(peer); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if err := a.Connections.WaitConnected(ctx, peer); err != nil {
+			t.Fatalf("Not connected to %s: %v", peer.Name, err)
+		}
+	}
+	b.Stop()
+	select {
+	case peer := <-left:
+		if peer != peerB {
+			t.Errorf("OnDisconnect for %v, expected %v", peer, peerB)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No OnDisconnect after B said goodbye")
+	}
+	if a.Peers.Has(peerB) {
+		t.Errorf("B should be removed after its goodbye")
+	}
+	if err := c.AnnounceRestart(time.Minute); err != nil {
+		t.Fatalf("AnnounceRestart failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !a.IsRestarting(peerC) {
+		if time.Now().After(deadline) {
+			t.Fatalf("C not restarting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Stop()
+	time.Sleep(100 * time.Millisecond)
+	if !a.Peers.Has(peerC) || len(left) != 0 {
+		t.Errorf("Restarting C should be kept after its goodbye")
+	}
+}
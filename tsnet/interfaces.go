@@ -0,0 +1,120 @@
+package tsnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"golang.org/x/net/ipv4"
+)
+
+// multicastInterfaces returns the up, running and multicast capable interfaces with an IPv4
+// address, but the loopback (see Config.AllInterfaces).
+func multicastInterfaces(lg logFuncs) []net.Interface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		lg.Errf("Can't list the interfaces: %v", err)
+		return nil
+	}
+	want := net.FlagUp | net.FlagMulticast | net.FlagRunning
+	return slices.DeleteFunc(interfaces, func(iface net.Interface) bool {
+		if iface.Flags&want != want || iface.Flags&net.FlagLoopback != 0 {
+			return true
+		}
+		addrs, err := iface.Addrs()
+		return err != nil || !slices.ContainsFunc(addrs, func(a net.Addr) bool {
+			ipNet, ok := a.(*net.IPNet)
+			return ok && ipNet.IP.To4() != nil
+		})
+	})
+}
+
+// interfaceByName returns the interface (see Config.Interface) and its first IPv4 address.
+func interfaceByName(name string) (*net.Interface, *net.UDPAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("interface %q: %w", name, err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, nil, fmt.Errorf("interface %q is down", name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("interface %q: %w", name, err)
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return iface, &net.UDPAddr{IP: ipNet.IP.To4()}, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("interface %q has no IPv4 address", name)
+}
+
+// interfaceNames returns the names of the interfaces, for the logs.
+func interfaceNames(interfaces []net.Interface) []string {
+	names := make([]string, 0, len(interfaces))
+	for _, iface := range interfaces {
+		names = append(names, iface.Name)
+	}
+	return names
+}
+
+// localIPs returns the IPv4 addresses of all our interfaces.
+func localIPs() []net.IP {
+	addrs, _ := net.InterfaceAddrs()
+	var ips []net.IP
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// isOurAddr returns true if ip:port is our unicast socket, on any of our addresses when it listens
+// on all of them, e.g. for our own announcements looped back (on each interface).
+func (s *Server) isOurAddr(ip net.IP, port int) bool {
+	ours := s.ourSendAddr
+	if port != ours.Port {
+		return false
+	}
+	if !ours.IP.IsUnspecified() {
+		return ip.Equal(ours.IP)
+	}
+	return slices.ContainsFunc(s.Listener.localIPs, ip.Equal)
+}
+
+// joinGroup joins the multicast group on all the Listener's interfaces (see Config.AllInterfaces),
+// conn already being a member on the default one.
+func (l *Listener) joinGroup(conn *net.UDPConn, group *net.UDPAddr) {
+	p := ipv4.NewPacketConn(conn)
+	for i := range l.ifaces {
+		if err := p.JoinGroup(&l.ifaces[i], &net.UDPAddr{IP: group.IP}); err != nil {
+			l.s.log.LogVf("Can't join %v on %q (already joined?): %v", group.IP, l.ifaces[i].Name, err)
+		}
+	}
+}
+
+// eachInterface calls send once with the multicast interface of conn set to each of the Listener's
+// interfaces in turn (see Config.AllInterfaces), or just once as is by default.
+func (l *Listener) eachInterface(conn *net.UDPConn, send func() error) error {
+	if len(l.ifaces) == 0 {
+		return send()
+	}
+	l.mcastMu.Lock()
+	defer l.mcastMu.Unlock()
+	p := ipv4.NewPacketConn(conn)
+	var errs []error
+	for i := range l.ifaces {
+		iface := &l.ifaces[i]
+		err := p.SetMulticastInterface(iface)
+		if err == nil {
+			err = send()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", iface.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,95 @@
+package tsnet_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// TestAllInterfaces checks two servers announcing themselves on all the interfaces discover each
+// other, and only each other (not their own announcements, looped back on each interface).
+func TestAllInterfaces(t *testing.T) {
+	NoMCastOnMacInCI(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	servers := make([]*tsnet.Server, 2)
+	for i := range servers {
+		id, err := tcrypto.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := tsnet.Config{
+			Name:                  fmt.Sprintf("AllIf%d", i),
+			Port:                  testPort + 40,
+			Mcast:                 "239.255.115.120",
+			Target:                tsnet.DefaultTarget,
+			Identity:              id,
+			BaseBroadcastInterval: 100 * time.Millisecond,
+			AllInterfaces:         true,
+		}
+		servers[i] = cfg.NewServer()
+		if err := servers[i].Start(ctx); err != nil {
+			t.Fatalf("Failed to start server %d: %v", i, err)
+		}
+		defer servers[i].Stop()
+	}
+	for i, srv := range servers {
+		for srv.Peers.Len() == 0 {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("Timeout waiting for AllIf%d to discover its peer", i)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+	time.Sleep(300 * time.Millisecond) // a few more announcements.
+	for i, srv := range servers {
+		for peer := range srv.Peers.All() {
+			if peer.Name != fmt.Sprintf("AllIf%d", 1-i) {
+				t.Errorf("AllIf%d discovered unexpected peer %+v", i, peer)
+			}
+		}
+	}
+}
+
+// TestInterface checks Config.Interface binds the unicast socket to that interface's address, and
+// that unusable ones fail the start.
+func TestInterface(t *testing.T) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(interfaces, func(iface net.Interface) bool { return iface.Flags&net.FlagLoopback != 0 })
+	if i < 0 {
+		t.Skip("No loopback interface")
+	}
+	srv := newUnicastServer(t, "iface")
+	srv.Interface = interfaces[i].Name
+	if err = srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start on %q failed: %v", srv.Interface, err)
+	}
+	if ip := srv.OurAddress().IP; !ip.IsLoopback() {
+		t.Errorf("Expected a loopback address on %q, got %v", srv.Interface, ip)
+	}
+	srv.Stop()
+	for _, cfg := range []tsnet.Config{
+		{Interface: "no-such-interface"},
+		{Interface: interfaces[i].Name, AllInterfaces: true},
+	} {
+		cfg.Name, cfg.NoDiscovery = "iface", true
+		if cfg.Identity, err = tcrypto.NewIdentity(); err != nil {
+			t.Fatal(err)
+		}
+		srv := cfg.NewServer()
+		if err := srv.Start(context.Background()); err == nil {
+			srv.Stop()
+			t.Errorf("Start with %q (all interfaces %t) should have failed", cfg.Interface, cfg.AllInterfaces)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package tsnet
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// DefaultKeepaliveInterval is how often the Connected peers are pinged (see Config.KeepaliveInterval).
+	DefaultKeepaliveInterval = 5 * time.Second
+	// MaxMissedKeepalives is how many intervals without a keepalive answer a Connected peer gets
+	// before being Disconnected.
+	MaxMissedKeepalives = 3
+)
+
+const (
+	KeepaliveMessageFormat = "keepalive1 %q"   // target_name
+	KeepaliveReplyFormat   = "keepaliveok1 %q" // target_name (the pinger)
+)
+
+func (c *ConnectionManager) keepaliveInterval() time.Duration {
+	if c.s.KeepaliveInterval > 0 {
+		return c.s.KeepaliveInterval
+	}
+	return DefaultKeepaliveInterval
+}
+
+// runKeepalive pings the Connected peers every keepaliveInterval until stop is closed.
+func (c *ConnectionManager) runKeepalive(ticker *time.Ticker, stop <-chan struct{}) {
+	s := c.s
+	defer c.wg.Done()
+	defer s.goroutines.Add(-1)
+	defer func() {
+		ticker.Stop()
+		s.tickers.Add(-1)
+	}()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			c.keepalive(now)
+		}
+	}
+}
+
+// keepalive disconnects the Connected peers which didn't answer for MaxMissedKeepalives intervals
+// and pings the others (asking for their name when it's hidden, see reveal). Peers get their first
+// interval from when we first see them Connected.
+func (c *ConnectionManager) keepalive(now time.Time) {
+	s := c.s
+	timeout := MaxMissedKeepalives * c.keepaliveInterval()
+	var ping []Peer
+	var lost []Peer
+	peers := s.Peers.KeysValuesSnapshot()
+	c.mu.Lock()
+	if c.alive == nil {
+		c.alive = make(map[Peer]time.Time)
+	}
+	connected := make(map[Peer]bool, len(c.alive))
+	for _, kv := range peers {
+		peer := kv.Key
+		if kv.Value.Status != Connected {
+			continue
+		}
+		connected[peer] = true
+		last, ok := c.alive[peer]
+		switch {
+		case !ok:
+			c.alive[peer] = now
+		case now.Sub(last) > timeout:
+			lost = append(lost, peer)
+			continue
+		}
+		ping = append(ping, peer)
+	}
+	for peer := range c.alive {
+		if !connected[peer] {
+			delete(c.alive, peer)
+		}
+	}
+	for _, peer := range lost {
+		delete(c.alive, peer)
+	}
+	c.mu.Unlock()
+	for _, peer := range lost {
+		c.disconnected(peer, timeout)
+	}
+	for _, peer := range ping {
+		data, ok := s.Peers.Get(peer)
+		if !ok {
+			continue
+		}
+		addr := s.peerAddr(peer, data)
+		if _, err := s.transport.WriteToUDP(s.authenticate(peer, &KeepaliveMessage{Target: peer.Name}), addr); err != nil {
+			s.log.LogVf("Failed to send keepalive to %q: %v", peer.Name, err)
+		}
+		if wantsReveal(peer, data) {
+			c.reveal(peer, data, addr, false) // asking again, the previous one or its answer was lost.
+		}
+	}
+}
+
+// disconnected marks the peer, silent for that long, Disconnected and forgets its session.
+func (c *ConnectionManager) disconnected(peer Peer, silence time.Duration) {
+	s := c.s
+	pData, found := s.Peers.Get(peer)
+	if !found || pData.Status != Connected {
+		return
+	}
+	s.log.Warnf("No keepalive answer from %q for %v, disconnected", peer.Name, silence)
+	pData.Status = Disconnected
+	c.dropSessions(peer)
+	s.change(s.setPeer(peer, pData))
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(peer)
+	}
+}
+
+// handleKeepalive answers a keepalive from a peer we're connected to; the others get no answer
+// and thus disconnect us.
+func (c *ConnectionManager) handleKeepalive(from *net.UDPAddr, targetName string) {
+	s := c.s
+	peer, exists := s.Sources.Get(Source{IP: from.IP.String(), Port: from.Port})
+	if !exists || targetName != s.Name {
+		s.log.LogVf("Ignoring keepalive from %v for %q", from, targetName)
+		return
+	}
+	if data, ok := s.Peers.Get(peer); !ok || data.Status != Connected {
+		s.log.LogVf("Ignoring keepalive from %q, not connected", peer.Name)
+		return
+	}
+	if _, err := s.transport.WriteToUDP(s.authenticate(peer, &KeepaliveMessage{Target: peer.Name, Reply: true}), from); err != nil {
+		s.log.Errf("Failed to answer the keepalive of %q: %v", peer.Name, err)
+	}
+}
+
+// handleKeepaliveReply records that the peer is still there.
+func (c *ConnectionManager) handleKeepaliveReply(from *net.UDPAddr, targetName string) {
+	s := c.s
+	peer, exists := s.Sources.Get(Source{IP: from.IP.String(), Port: from.Port})
+	if !exists || targetName != s.Name {
+		s.log.LogVf("Unexpected keepalive answer from %v for %q", from, targetName)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.alive[peer]; ok {
+		c.alive[peer] = time.Now()
+	}
+}
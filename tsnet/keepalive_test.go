@@ -0,0 +1,69 @@
+package tsnet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// TestKeepalive checks connected peers stay Connected while answering the keepalives and become
+// Disconnected once the other side is gone.
+func TestKeepalive(t *testing.T) {
+	a := newUnicastServer(t, "keepaliveA")
+	b := newUnicastServer(t, "keepaliveB")
+	interval := 20 * time.Millisecond
+	a.KeepaliveInterval = interval
+	b.KeepaliveInterval = interval
+	disconnected := make(chan tsnet.Peer, 1)
+	a.OnDisconnect = func(peer tsnet.Peer) { disconnected <- peer }
+	ctx := context.Background()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+	}
+	defer a.Stop()
+	peerB, portB := asPeer(b)
+	peerA, portA := asPeer(a)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pa, _ := a.Peers.Get(peerB)
+		pb, _ := b.Peers.Get(peerA)
+		if pa.Status == tsnet.Connected && pb.Status == tsnet.Connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Not connected: %v %v", pa.Status, pb.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(3 * tsnet.MaxMissedKeepalives * interval)
+	for _, s := range []struct {
+		srv  *tsnet.Server
+		peer tsnet.Peer
+	}{{a, peerB}, {b, peerA}} {
+		if pd, _ := s.srv.Peers.Get(s.peer); pd.Status != tsnet.Connected {
+			t.Errorf("%s: %s should still be Connected, got %v", s.srv.Name, s.peer.Name, pd.Status)
+		}
+	}
+	defer b.Stop()
+	b.Listener.Stop() // gone silently, without saying goodbye.
+	select {
+	case peer := <-disconnected:
+		if peer != peerB {
+			t.Errorf("OnDisconnect for %v, expected %v", peer, peerB)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No OnDisconnect after B stopped")
+	}
+	if pd, _ := a.Peers.Get(peerB); pd.Status != tsnet.Disconnected {
+		t.Errorf("B should be Disconnected, got %v", pd.Status)
+	}
+}
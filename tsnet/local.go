@@ -0,0 +1,203 @@
+package tsnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const localSuffix = ".sock"
+
+// localDir returns the directory of the Config.LocalSocket sockets.
+func (s *Server) localDir() string {
+	if s.LocalDir != "" {
+		return s.LocalDir
+	}
+	return filepath.Join(DefaultLocalDir, fmt.Sprintf("tsync-%d", s.Port))
+}
+
+// startLocal binds our Config.LocalSocket, named after our unicast port, and starts its receiver.
+func (l *Listener) startLocal(ctx context.Context) error {
+	s := l.s
+	if !localSupported {
+		return fmt.Errorf("unix datagram sockets: %w", errors.ErrUnsupported)
+	}
+	dir := s.localDir()
+	if err := os.Mkdir(dir, 0o777); err == nil {
+		// Shared by the users, like /tmp (Mkdir applies the umask).
+		if err = os.Chmod(dir, 0o777|os.ModeSticky); err != nil {
+			s.log.Warnf("Can't share %s with the other users: %v", dir, err)
+		}
+	} else if !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	// Another user could otherwise have made it to remove or replace our socket.
+	if err := checkLocalDir(dir); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, strconv.Itoa(s.ourSendAddr.Port)+localSuffix)
+	_ = os.Remove(path) // left by a server which had our port and crashed.
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0o600)
+	if s.LocalShared {
+		mode = 0o666 // so the servers of the other users can send to us.
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		conn.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	l.local, l.localDir = conn, dir
+	s.sockets.Add(1)
+	s.log.Infof("Local socket created: %s", path)
+	l.wg.Add(1)
+	s.goroutines.Add(1)
+	go l.runLocalReceive(ctx)
+	return nil
+}
+
+// stopLocal closes and removes our local socket (unblocking its receiver).
+func (l *Listener) stopLocal() {
+	if l.local == nil {
+		return
+	}
+	path := l.local.LocalAddr().String()
+	if l.local.Close() == nil {
+		l.s.sockets.Add(-1)
+	}
+	_ = os.Remove(path)
+}
+
+// runLocalReceive handles the messages received on our local socket like the unicast ones, from
+// the unicast address of the sending server.
+func (l *Listener) runLocalReceive(ctx context.Context) {
+	s := l.s
+	defer l.wg.Done()
+	defer s.goroutines.Add(-1)
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Infof("Exiting local receiver after %v", ctx.Err())
+			return
+		default:
+			// we rely on Stop() closing the socket to unblock ReadFromUnix on exit.
+			n, from, err := l.local.ReadFromUnix(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					s.log.Infof("Normal local read error on exit: %v", err)
+				} else {
+					s.log.Errf("Error receiving local packet: %v", err)
+				}
+				continue
+			}
+			addr := l.localAddr(from)
+			if addr == nil {
+				s.log.LogVf("Ignoring local message from %v (not a tsync socket)", from)
+				continue
+			}
+			s.countDatagram(false, isDiscovery(buf[:n]), n, addr)
+			if s.rateLimited(buf[:n], addr) {
+				continue
+			}
+			s.log.LogVf("Received local message %d bytes from %v: %q", n, addr, buf[:n])
+			s.handleDirectMessage(buf[:n], addr)
+		}
+	}
+}
+
+// localIP returns the IP the servers of our host are seen from: the same as over the network.
+func (l *Listener) localIP() net.IP {
+	if ip := l.s.ourSendAddr.IP; !ip.IsUnspecified() {
+		return ip
+	}
+	for _, ip := range l.localIPs {
+		if !ip.IsLoopback() {
+			return ip
+		}
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// localAddr returns the unicast address of the server whose local socket is from, nil if it
+// isn't one of ours.
+func (l *Listener) localAddr(from *net.UnixAddr) *net.UDPAddr {
+	if from == nil || filepath.Dir(from.Name) != l.localDir {
+		return nil
+	}
+	port, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(from.Name), localSuffix))
+	if err != nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: l.localIP(), Port: port}
+}
+
+// isLocal returns true if addr is another server of our host and we have a local socket.
+func (l *Listener) isLocal(addr *net.UDPAddr) bool {
+	if l.local == nil || addr.Port == l.s.ourSendAddr.Port {
+		return false
+	}
+	return addr.IP.IsLoopback() || addr.IP.Equal(l.s.ourSendAddr.IP) || slices.ContainsFunc(l.localIPs, addr.IP.Equal)
+}
+
+// sendLocal sends b to the local socket of the server with the unicast port.
+func (l *Listener) sendLocal(b []byte, port int) error {
+	path := filepath.Join(l.localDir, strconv.Itoa(port)+localSuffix)
+	_, err := l.local.WriteToUnix(b, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		_ = os.Remove(path) // left by a crashed server (only works for ours).
+	}
+	return err
+}
+
+// announceLocal sends our discovery message to the other local sockets, which handle it like an
+// answer to a seed (see handleSeedAnswer): the servers of our host find each other even when the
+// multicast loopback doesn't work.
+func (l *Listener) announceLocal(epoch int32) {
+	s := l.s
+	if l.local == nil {
+		return
+	}
+	entries, err := os.ReadDir(l.localDir)
+	if err != nil {
+		s.log.Errf("Can't list the local sockets: %v", err)
+		return
+	}
+	for _, e := range entries {
+		port, err := strconv.Atoi(strings.TrimSuffix(e.Name(), localSuffix))
+		if err != nil || port == s.ourSendAddr.Port || !strings.HasSuffix(e.Name(), localSuffix) {
+			continue
+		}
+		msg := s.discoveryMessage(epoch)
+		if err = l.sendLocal(msg, port); err != nil {
+			s.log.LogVf("Error sending discovery message to local socket %s: %v", e.Name(), err)
+			continue
+		}
+		s.countDatagram(true, true, len(msg), &net.UDPAddr{IP: l.localIP(), Port: port})
+	}
+}
+
+// localTransport sends the datagrams for the other servers of our host to their local socket,
+// when they have one, instead of over UDP.
+type localTransport struct {
+	Transport
+	l *Listener
+}
+
+func (t localTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if t.l.isLocal(addr) && t.l.sendLocal(b, addr.Port) == nil {
+		return len(b), nil
+	}
+	return t.Transport.WriteToUDP(b, addr)
+}
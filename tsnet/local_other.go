@@ -0,0 +1,19 @@
+//go:build !unix
+
+package tsnet
+
+import (
+	"errors"
+	"os"
+)
+
+// DefaultLocalDir is the parent of the default Config.LocalDir (unused: Unix datagram sockets
+// aren't supported here).
+var DefaultLocalDir = os.TempDir()
+
+const localSupported = false
+
+// checkLocalDir is never called, startLocal fails first.
+func checkLocalDir(string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,117 @@
+package tsnet_test
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// TestLocalSocket runs 2 servers on different discovery ports (so they can't hear each other's
+// multicast announcements) sharing a local socket directory: they find each other and exchange
+// data through their Unix sockets, without any unicast UDP datagram.
+func TestLocalSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("No Unix datagram sockets on Windows")
+	}
+	NoMCastOnMacInCI(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	dir := t.TempDir()
+	servers := make([]*tsnet.Server, 2)
+	for i := range servers {
+		id, err := tcrypto.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := tsnet.Config{
+			Name: []string{"localA", "localB"}[i], Identity: id, Mcast: "239.255.115.121", Port: testPort + 50 + i,
+			BaseBroadcastInterval: 100 * time.Millisecond, LocalSocket: true, LocalDir: dir,
+		}
+		servers[i] = cfg.NewServer()
+		if err := servers[i].Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer servers[i].Stop()
+	}
+	a, b := servers[0], servers[1]
+	received := make(chan []byte, 1)
+	b.OnData = func(_ tsnet.Peer, data []byte) { received <- data }
+	for a.Peers.Len() == 0 || b.Peers.Len() == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Local servers didn't discover each other (%d, %d peers)", a.Peers.Len(), b.Peers.Len())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected 2 local sockets, got %v, %v", entries, err)
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err != nil || info.Mode().Perm() != 0o600 {
+			t.Errorf("Local socket %s should only be ours: %v %v", e.Name(), info.Mode(), err)
+		}
+	}
+	var peerB tsnet.Peer
+	for peer := range a.Peers.All() {
+		peerB = peer
+	}
+	if peerB.Name != "localB" {
+		t.Fatalf("Unexpected peer %+v", peerB)
+	}
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("Not connected: %v", err)
+	}
+	if err := a.SendData(peerB, []byte("over the local socket")); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	select {
+	case data := <-received:
+		if string(data) != "over the local socket" {
+			t.Errorf("Unexpected data %q", data)
+		}
+	case <-ctx.Done():
+		t.Fatal("Data not received")
+	}
+	if a.UnicastReceived() != 0 || b.UnicastReceived() != 0 {
+		t.Errorf("Expected no UDP datagrams, got %d and %d", a.UnicastReceived(), b.UnicastReceived())
+	}
+	a.Stop()
+	b.Stop()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Local sockets not removed: %v", entries)
+	}
+}
+
+// TestLocalDirUnsafe checks no local socket is created in a directory others can write in without
+// it being sticky, where they could remove or replace it.
+func TestLocalDirUnsafe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("No Unix datagram sockets on Windows")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := tsnet.Config{Name: "unsafe", Identity: id, NoDiscovery: true, LocalSocket: true, LocalDir: dir}
+	srv := cfg.NewServer()
+	if err = srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer srv.Stop()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Local socket created in an unsafe directory: %v", entries)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package tsnet
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// DefaultLocalDir is the parent of the default Config.LocalDir, shared by all the users (so not
+// os.TempDir, which is per user on macOS).
+const DefaultLocalDir = "/tmp"
+
+const localSupported = true
+
+// checkLocalDir returns an error unless dir is a directory (not a link) owned by root or us and,
+// when others can write in it, sticky: so they can't remove nor replace our socket.
+func checkLocalDir(dir string) error {
+	st, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s isn't a directory", dir)
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok && sys.Uid != 0 && int(sys.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d, not root nor us", dir, sys.Uid)
+	}
+	if st.Mode().Perm()&0o022 != 0 && st.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("%s is writable by others and not sticky", dir)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package tsnet
+
+import (
+	"fortio.org/log"
+)
+
+// Logger is what the library logs through, see Config.Logger. Embedders can pass their own
+// (adapter to their) logger or NoLogger so tsnet doesn't use the fortio.org/log globals.
+type Logger interface {
+	Debugf(format string, rest ...any)
+	LogVf(format string, rest ...any)
+	Infof(format string, rest ...any)
+	Warnf(format string, rest ...any)
+	Errf(format string, rest ...any)
+}
+
+// FortioLogger is the Logger using the fortio.org/log globals (the default).
+type FortioLogger struct{}
+
+func (FortioLogger) Debugf(format string, rest ...any) { log.Debugf(format, rest...) }
+func (FortioLogger) LogVf(format string, rest ...any)  { log.LogVf(format, rest...) }
+func (FortioLogger) Infof(format string, rest ...any)  { log.Infof(format, rest...) }
+func (FortioLogger) Warnf(format string, rest ...any)  { log.Warnf(format, rest...) }
+func (FortioLogger) Errf(format string, rest ...any)   { log.Errf(format, rest...) }
+
+type noLogger struct{}
+
+func (noLogger) Debugf(string, ...any) {}
+func (noLogger) LogVf(string, ...any)  {}
+func (noLogger) Infof(string, ...any)  {}
+func (noLogger) Warnf(string, ...any)  {}
+func (noLogger) Errf(string, ...any)   {}
+
+// NoLogger discards all the logs.
+var NoLogger Logger = noLogger{}
+
+// logFuncs are the functions we actually log with: directly the fortio.org/log ones by default
+// (so the file and line logged are still the caller's) or the methods of a Config.Logger.
+type logFuncs struct {
+	Debugf, LogVf, Infof, Warnf, Errf func(format string, rest ...any)
+}
+
+var defaultLog = logFuncs{Debugf: log.Debugf, LogVf: log.LogVf, Infof: log.Infof, Warnf: log.Warnf, Errf: log.Errf}
+
+func newLogFuncs(l Logger) logFuncs {
+	if l == nil {
+		return defaultLog
+	}
+	return logFuncs{Debugf: l.Debugf, LogVf: l.LogVf, Infof: l.Infof, Warnf: l.Warnf, Errf: l.Errf}
+}
@@ -0,0 +1,64 @@
+package tsnet_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// captureLogger records the logs (as "level: message").
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (c *captureLogger) add(level, format string, rest ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines = append(c.lines, level+": "+fmt.Sprintf(format, rest...))
+}
+
+func (c *captureLogger) Debugf(format string, rest ...any) { c.add("debug", format, rest...) }
+func (c *captureLogger) LogVf(format string, rest ...any)  { c.add("verbose", format, rest...) }
+func (c *captureLogger) Infof(format string, rest ...any)  { c.add("info", format, rest...) }
+func (c *captureLogger) Warnf(format string, rest ...any)  { c.add("warn", format, rest...) }
+func (c *captureLogger) Errf(format string, rest ...any)   { c.add("error", format, rest...) }
+
+func (c *captureLogger) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Join(c.lines, "\n")
+}
+
+func TestConfigLogger(t *testing.T) {
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &captureLogger{}
+	cfg := tsnet.Config{Name: "logged", Identity: id, NoDiscovery: true, Logger: logger}
+	srv := cfg.NewServer()
+	if err = srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	srv.AddPeer(tsnet.Peer{IP: "192.0.2.1", Name: "other", PublicKey: "bad"}, 1234)
+	srv.Stop()
+	logs := logger.String()
+	for _, want := range []string{`info: Starting tsync server "logged"`, "info: Unicast socket created", "error: Failed to decode peer"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("Missing %q in logs:\n%s", want, logs)
+		}
+	}
+	// Also check NoLogger doesn't crash.
+	cfg.Logger = tsnet.NoLogger
+	srv = cfg.NewServer()
+	if err = srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	srv.Stop()
+}
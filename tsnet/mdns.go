@@ -0,0 +1,341 @@
+package tsnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// MDNSAddress is the mDNS multicast group and port.
+	MDNSAddress = "224.0.0.251:5353"
+	// MDNSService is the DNS-SD service type ServiceDiscovery advertises and browses.
+	MDNSService = "_tsync._udp.local."
+	// MDNSTTL is the TTL, in seconds, of the records we announce.
+	MDNSTTL = 120
+	// mDNS cache flush bit of the class of unique records (RFC 6762 section 10.2).
+	mdnsCacheFlush = 0x8000
+	// Our instance names are cut to leave room for the port in the 63 bytes label.
+	maxInstanceLen = 50
+)
+
+// MDNSAnnouncement is what ServiceDiscovery advertises, in the SRV (port), TXT (name, public
+// key and epoch) and A (IP, unless unspecified) records of our DNS-SD instance of MDNSService.
+type MDNSAnnouncement struct {
+	Name      string
+	PublicKey string
+	Epoch     int32
+	IP        net.IP // nil when unknown, receivers then use the packet's source address.
+	Port      int
+}
+
+// ServiceDiscovery is the alternative (or additional, see Config.MDNS) discovery using mDNS/DNS-SD:
+// it announces us as an instance of MDNSService, answers the queries for it and browses it,
+// maintaining the Peers like Discovery. It works on networks which filter arbitrary multicast
+// groups but allow mDNS (Bonjour). When Discovery doesn't run it also ticks the epoch and
+// expires the peers.
+type ServiceDiscovery struct {
+	s       *Server
+	running atomic.Bool
+	conn    *net.UDPConn
+	group   *net.UDPAddr
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func (m *ServiceDiscovery) Start(ctx context.Context) error {
+	if m.Running() {
+		return nil
+	}
+	s := m.s
+	if !s.Listener.Running() {
+		return fmt.Errorf("mDNS discovery needs the listener: %w", ErrNotRunning)
+	}
+	var err error
+	if m.group, err = net.ResolveUDPAddr("udp4", MDNSAddress); err != nil {
+		return err
+	}
+	// Shared with the other mDNS responders (SO_REUSEADDR is set by ListenMulticastUDP).
+	if m.conn, err = net.ListenMulticastUDP("udp4", s.Listener.iface, m.group); err != nil {
+		return err
+	}
+	s.sockets.Add(1)
+	s.Listener.joinGroup(m.conn, m.group)
+	p := ipv4.NewPacketConn(m.conn)
+	if err = p.SetMulticastLoopback(true); err != nil { // for the peers on the same host.
+		s.log.Warnf("Failed to enable mDNS multicast loopback: %v", err)
+	}
+	if iface := s.Listener.iface; iface != nil {
+		if err = p.SetMulticastInterface(iface); err != nil {
+			s.log.Warnf("Failed to set the mDNS multicast interface to %q: %v", iface.Name, err)
+		}
+	}
+	s.log.Infof("mDNS discovery of %s on %s", MDNSService, m.conn.LocalAddr())
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.wg.Add(2) // announcer and receiver
+	s.goroutines.Add(2)
+	go m.runAnnounce(ctx)
+	go m.runReceive(ctx)
+	m.running.Store(true)
+	return nil
+}
+
+func (m *ServiceDiscovery) Stop() {
+	if !m.running.CompareAndSwap(true, false) {
+		return
+	}
+	m.cancel()
+	if m.conn.Close() == nil { // unblocks the receiver.
+		m.s.sockets.Add(-1)
+	}
+	m.wg.Wait()
+}
+
+func (m *ServiceDiscovery) Running() bool {
+	return m.running.Load()
+}
+
+// announcement returns our MDNSAnnouncement for the epoch.
+func (m *ServiceDiscovery) announcement(epoch int32) MDNSAnnouncement {
+	s := m.s
+	a := MDNSAnnouncement{Name: s.Name, PublicKey: s.idStr, Epoch: epoch, Port: s.ourSendAddr.Port}
+	if !s.ourSendAddr.IP.IsUnspecified() {
+		a.IP = s.ourSendAddr.IP
+	}
+	return a
+}
+
+func (m *ServiceDiscovery) send(msg []byte) {
+	err := m.s.Listener.eachInterface(m.conn, func() error {
+		if _, err := m.conn.WriteToUDP(msg, m.group); err != nil {
+			return err
+		}
+		m.s.countDatagram(true, true, len(msg), m.group)
+		return nil
+	})
+	if err != nil {
+		m.s.log.Errf("Error sending mDNS packet: %v", err)
+	}
+}
+
+func (m *ServiceDiscovery) runAnnounce(ctx context.Context) {
+	s := m.s
+	defer m.wg.Done()
+	defer s.goroutines.Add(-1)
+	ticker := time.NewTicker(s.BaseBroadcastInterval)
+	s.tickers.Add(1)
+	defer func() {
+		ticker.Stop()
+		s.tickers.Add(-1)
+	}()
+	if query, err := MDNSQuery(); err == nil { // peers already there answer right away.
+		m.send(query)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Infof("Exiting mDNS announcer %q (%v)", s.Name, ctx.Err())
+			return
+		case <-ticker.C:
+			epoch := s.epoch.Load()
+			if !s.Discovery.Running() { // otherwise it ticks the epoch and expires the peers.
+				epoch = s.epoch.Add(1)
+				s.PeersCleanup()
+			}
+			if epoch < 0 {
+				s.log.Infof("Server stopped, not sending mDNS announcement")
+				return
+			}
+			msg, err := m.announcement(epoch).Message()
+			if err != nil {
+				s.log.Errf("Error encoding mDNS announcement: %v", err)
+				continue
+			}
+			m.send(msg)
+		}
+	}
+}
+
+func (m *ServiceDiscovery) runReceive(ctx context.Context) {
+	s := m.s
+	defer m.wg.Done()
+	defer s.goroutines.Add(-1)
+	buf := make([]byte, 9000) // mDNS packets can be up to the interface MTU.
+	us := Peer{Name: s.Name, IP: s.ourSendAddr.IP.String(), PublicKey: s.idStr}
+	for {
+		// we rely on Stop() closing the socket to unblock ReadFromUDP on exit.
+		n, addr, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				s.log.Infof("Exiting mDNS receiver after %v", ctx.Err())
+				return
+			}
+			s.log.Errf("Error receiving mDNS packet: %v", err)
+			continue
+		}
+		s.countDatagram(false, true, n, addr)
+		if s.rateLimited(buf[:n], addr) {
+			continue
+		}
+		var msg dnsmessage.Message
+		if err = msg.Unpack(buf[:n]); err != nil {
+			s.log.LogVf("Ignoring invalid mDNS packet from %v: %v", addr, err)
+			continue
+		}
+		if !msg.Response {
+			if IsMDNSQuery(&msg) {
+				if reply, err := m.announcement(s.epoch.Load()).Message(); err == nil {
+					m.send(reply)
+				}
+			}
+			continue
+		}
+		for _, a := range ParseMDNS(&msg) {
+			ip := a.IP
+			if ip == nil {
+				ip = addr.IP
+			}
+			peer := Peer{Name: a.Name, IP: ip.String(), PublicKey: a.PublicKey}
+			if peer.Name == us.Name && peer.PublicKey == us.PublicKey && s.isOurAddr(ip, a.Port) {
+				continue // our own announcement.
+			}
+			s.log.LogVf("Received mDNS announcement from %v: %+v", addr, a)
+			s.discovered(peer, PeerData{Port: a.Port, Epoch: a.Epoch, LastSeen: time.Now()}, us)
+		}
+	}
+}
+
+// MDNSQuery returns the mDNS query for the MDNSService instances.
+func MDNSQuery() ([]byte, error) {
+	msg := dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name:  dnsmessage.MustNewName(MDNSService),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}}}
+	return msg.Pack()
+}
+
+// IsMDNSQuery returns whether the message asks for the MDNSService instances.
+func IsMDNSQuery(msg *dnsmessage.Message) bool {
+	for _, q := range msg.Questions {
+		if (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL) && strings.EqualFold(q.Name.String(), MDNSService) {
+			return true
+		}
+	}
+	return false
+}
+
+// instance returns the DNS-SD instance (with the service) and host names of the announcement.
+func (a MDNSAnnouncement) instance() (string, string) {
+	label := strings.NewReplacer(".", "-", "\\", "-").Replace(a.Name)
+	if len(label) > maxInstanceLen {
+		label = label[:maxInstanceLen]
+	}
+	label += "-" + strconv.Itoa(a.Port) // distinct instances on the same host.
+	return label + "." + MDNSService, label + ".local."
+}
+
+// Message returns the mDNS response announcing a.
+func (a MDNSAnnouncement) Message() ([]byte, error) {
+	instance, host := a.instance()
+	instanceName, err := dnsmessage.NewName(instance)
+	if err != nil {
+		return nil, err
+	}
+	hostName, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, err
+	}
+	unique := dnsmessage.ClassINET | mdnsCacheFlush
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name: dnsmessage.MustNewName(MDNSService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: MDNSTTL,
+				},
+				Body: &dnsmessage.PTRResource{PTR: instanceName},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: instanceName, Type: dnsmessage.TypeSRV, Class: unique, TTL: MDNSTTL},
+				Body:   &dnsmessage.SRVResource{Target: hostName, Port: uint16(a.Port)}, //nolint:gosec // a port.
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: instanceName, Type: dnsmessage.TypeTXT, Class: unique, TTL: MDNSTTL},
+				Body: &dnsmessage.TXTResource{TXT: []string{
+					"v=tsync1", "name=" + a.Name, "key=" + a.PublicKey, "e=" + strconv.Itoa(int(a.Epoch)),
+				}},
+			},
+		},
+	}
+	if ip4 := a.IP.To4(); ip4 != nil {
+		msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: hostName, Type: dnsmessage.TypeA, Class: unique, TTL: MDNSTTL},
+			Body:   &dnsmessage.AResource{A: [4]byte(ip4)},
+		})
+	}
+	return msg.Pack()
+}
+
+// ParseMDNS returns the tsync announcements (see MDNSAnnouncement.Message) in the mDNS response:
+// the instances of MDNSService with their SRV and tsync TXT records, and A record if any.
+// Goodbyes (zero TTL) and incomplete instances are skipped.
+func ParseMDNS(msg *dnsmessage.Message) []MDNSAnnouncement {
+	records := append(append([]dnsmessage.Resource(nil), msg.Answers...), msg.Additionals...)
+	var instances []string
+	srv := make(map[string]*dnsmessage.SRVResource)
+	txt := make(map[string][]string)
+	hosts := make(map[string]net.IP)
+	for _, r := range records {
+		name := strings.ToLower(r.Header.Name.String())
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == MDNSService && r.Header.TTL > 0 {
+				instances = append(instances, strings.ToLower(body.PTR.String()))
+			}
+		case *dnsmessage.SRVResource:
+			srv[name] = body
+		case *dnsmessage.TXTResource:
+			txt[name] = body.TXT
+		case *dnsmessage.AResource:
+			hosts[name] = net.IP(body.A[:])
+		}
+	}
+	var result []MDNSAnnouncement
+	for _, instance := range instances {
+		target, values := srv[instance], txt[instance]
+		if target == nil || values == nil {
+			continue
+		}
+		a := MDNSAnnouncement{Port: int(target.Port), IP: hosts[strings.ToLower(target.Target.String())]}
+		version := ""
+		for _, kv := range values {
+			k, v, _ := strings.Cut(kv, "=")
+			switch k {
+			case "v":
+				version = v
+			case "name":
+				a.Name = v
+			case "key":
+				a.PublicKey = v
+			case "e":
+				if e, err := strconv.ParseInt(v, 10, 32); err == nil {
+					a.Epoch = int32(e)
+				}
+			}
+		}
+		if version != "tsync1" || a.Name == "" || a.PublicKey == "" {
+			continue
+		}
+		result = append(result, a)
+	}
+	return result
+}
@@ -0,0 +1,119 @@
+package tsnet_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMDNSAnnouncementRoundTrip(t *testing.T) {
+	want := []tsnet.MDNSAnnouncement{
+		{Name: "host.with.dots", PublicKey: "key1", Epoch: 42, IP: net.IPv4(192, 168, 1, 2).To4(), Port: 29556},
+		{Name: "no-ip", PublicKey: "key2", Epoch: 7, Port: 1234},
+	}
+	for _, a := range want {
+		buf, err := a.Message()
+		if err != nil {
+			t.Fatalf("Message(%+v): %v", a, err)
+		}
+		var msg dnsmessage.Message
+		if err = msg.Unpack(buf); err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		if !msg.Response || tsnet.IsMDNSQuery(&msg) {
+			t.Errorf("announcement should be a response, not a query: %+v", msg.Header)
+		}
+		got := tsnet.ParseMDNS(&msg)
+		if len(got) != 1 {
+			t.Fatalf("ParseMDNS returned %d announcements, want 1: %+v", len(got), got)
+		}
+		g := got[0]
+		if g.Name != a.Name || g.PublicKey != a.PublicKey || g.Epoch != a.Epoch || g.Port != a.Port || !g.IP.Equal(a.IP) {
+			t.Errorf("ParseMDNS = %+v, want %+v", g, a)
+		}
+	}
+}
+
+func TestMDNSQuery(t *testing.T) {
+	buf, err := tsnet.MDNSQuery()
+	if err != nil {
+		t.Fatalf("MDNSQuery: %v", err)
+	}
+	var msg dnsmessage.Message
+	if err = msg.Unpack(buf); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if msg.Response || !tsnet.IsMDNSQuery(&msg) {
+		t.Errorf("expected a query for %s, got %+v", tsnet.MDNSService, msg)
+	}
+	if got := tsnet.ParseMDNS(&msg); len(got) != 0 {
+		t.Errorf("ParseMDNS of a query = %+v, want none", got)
+	}
+}
+
+func TestMDNSIgnoresOtherServices(t *testing.T) {
+	name := dnsmessage.MustNewName("printer._ipp._tcp.local.")
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("_ipp._tcp.local."), Type: dnsmessage.TypePTR,
+					Class: dnsmessage.ClassINET, TTL: 120},
+				Body: &dnsmessage.PTRResource{PTR: name},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.TXTResource{TXT: []string{"v=tsync1", "name=x", "key=y"}},
+			},
+		},
+	}
+	if got := tsnet.ParseMDNS(&msg); len(got) != 0 {
+		t.Errorf("ParseMDNS of another service = %+v, want none", got)
+	}
+}
+
+func TestMDNSDiscovery(t *testing.T) {
+	NoMCastOnMacInCI(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	servers := make([]*tsnet.Server, 2)
+	for i, name := range []string{"MDNSA", "MDNSB"} {
+		id, err := tcrypto.NewIdentity()
+		if err != nil {
+			t.Fatalf("NewIdentity: %v", err)
+		}
+		cfg := tsnet.Config{Name: name, Identity: id, NoDiscovery: true, MDNS: true, BaseBroadcastInterval: 100 * time.Millisecond}
+		servers[i] = cfg.NewServer()
+		if err = servers[i].Start(ctx); err != nil {
+			t.Skipf("Can't start mDNS discovery (port 5353 in use?): %v", err)
+		}
+		defer servers[i].Stop()
+	}
+	found := func(s *tsnet.Server, name string) bool {
+		for peer := range s.Peers.All() {
+			if peer.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	for !found(servers[0], "MDNSB") || !found(servers[1], "MDNSA") {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Peers not discovered through mDNS: A has %v, B has %v",
+				servers[0].Peers.KeysSnapshot(), servers[1].Peers.KeysSnapshot())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	for _, s := range servers {
+		s.Stop()
+		if err := s.CheckReleased(); err != nil {
+			t.Error(err)
+		}
+	}
+}
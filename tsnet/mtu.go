@@ -0,0 +1,179 @@
+package tsnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultMTU is the MTU assumed until probed (or when probing failed), it corresponds to BufSize datagrams.
+	DefaultMTU = 576
+	// ipUDPHeaderSize is the IPv4 (without options) and UDP headers size, for the MTUs we probe.
+	ipUDPHeaderSize = 20 + 8
+	// MaxDatagramSize is the largest datagram we send (and thus receive) with probed MTUs.
+	MaxDatagramSize = 9000 - ipUDPHeaderSize
+	// ProbeTimeout is how long to wait for each MTU probe reply.
+	ProbeTimeout = 300 * time.Millisecond
+	probeTries   = 2
+)
+
+// ProbeMTUs are the MTUs tried, largest first: jumbo frames and then regular ethernet.
+var ProbeMTUs = []int{9000, 1500}
+
+const (
+	ProbeMessageFormat = "probe1 %q %d %s" // target_name, mtu, padding up to the datagram size for that mtu
+	ProbeReplyFormat   = "probeok1 %q %d"  // target_name (the prober), mtu
+)
+
+// DatagramSize returns the maximum UDP payload size for the given MTU.
+func DatagramSize(mtu int) int {
+	if mtu <= DefaultMTU {
+		return BufSize
+	}
+	return min(mtu-ipUDPHeaderSize, MaxDatagramSize)
+}
+
+type probeKey struct {
+	name string
+	mtu  int
+}
+
+// ProbeMTU probes the path MTU to the peer (see ConnectionManager.ProbeMTU).
+func (s *Server) ProbeMTU(ctx context.Context, peer Peer) (int, error) {
+	return s.Connections.ProbeMTU(ctx, peer)
+}
+
+// ProbeMTU finds the largest of ProbeMTUs that reaches the peer (sending with the don't fragment bit set
+// where supported) and records it in the peer's PeerData.MTU so SendData can use larger messages.
+// Falls back to DefaultMTU when none of the probes get a reply.
+func (c *ConnectionManager) ProbeMTU(ctx context.Context, peer Peer) (int, error) {
+	s := c.s
+	for _, mtu := range ProbeMTUs {
+		ok, err := c.probe(ctx, peer, mtu)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			s.log.Infof("MTU to %q is %d", peer.Name, mtu)
+			return mtu, s.setPeerMTU(peer, mtu)
+		}
+	}
+	s.log.Infof("MTU probing to %q failed, using %d", peer.Name, DefaultMTU)
+	return DefaultMTU, s.setPeerMTU(peer, DefaultMTU)
+}
+
+func (s *Server) setPeerMTU(peer Peer, mtu int) error {
+	peerData, exists := s.Peers.Get(peer)
+	if !exists {
+		return fmt.Errorf("peer %v not found (anymore) in peer list", peer)
+	}
+	peerData.MTU = mtu
+	s.change(s.setPeer(peer, peerData))
+	return nil
+}
+
+// probe returns true if the peer replied to a probe of the datagram size for mtu.
+func (c *ConnectionManager) probe(ctx context.Context, peer Peer, mtu int) (bool, error) {
+	s := c.s
+	peerData, exists := s.Peers.Get(peer)
+	if !exists {
+		return false, fmt.Errorf("peer %v not found (anymore) in peer list", peer)
+	}
+	addr := s.peerAddr(peer, peerData)
+	size := DatagramSize(mtu)
+	key := probeKey{name: peer.Name, mtu: mtu}
+	reply := make(chan struct{}, 1)
+	c.mu.Lock()
+	if !c.running {
+		c.mu.Unlock()
+		return false, fmt.Errorf("probing %q: %w", peer.Name, ErrNotRunning)
+	}
+	if c.probes == nil {
+		c.probes = make(map[probeKey]chan struct{})
+	}
+	c.probes[key] = reply
+	c.wg.Add(1) // so Stop waits for us to be done (which is quick thanks to stopCh).
+	stopCh := c.stopCh
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.probes, key)
+		c.mu.Unlock()
+		c.wg.Done()
+	}()
+	for range probeTries {
+		message := s.probeMessage(peer, mtu) // authenticated each time: the session MACs can't be replayed.
+		if len(message) > size {
+			return false, nil
+		}
+		if _, err := s.transport.WriteToUDP(message, addr); err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				s.log.LogVf("MTU %d too large for the local path to %q", mtu, peer.Name)
+				return false, nil
+			}
+			return false, err
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-stopCh:
+			return false, net.ErrClosed
+		case <-reply:
+			return true, nil
+		case <-time.After(ProbeTimeout):
+		}
+	}
+	return false, nil
+}
+
+// handleProbe answers a probe from a known peer, if it arrived whole.
+func (c *ConnectionManager) handleProbe(from *net.UDPAddr, targetName string, mtu, size int) {
+	s := c.s
+	src := Source{IP: from.IP.String(), Port: from.Port}
+	peer, exists := s.Sources.Get(src)
+	if !exists {
+		s.log.Errf("MTU probe from unknown source %v (not in source to peer map)", src)
+		return
+	}
+	if targetName != s.Name || size != DatagramSize(mtu) {
+		s.log.Warnf("Invalid MTU probe from %q: %q %d (%d bytes)", peer.Name, targetName, mtu, size)
+		return
+	}
+	message := s.authenticate(peer, &ProbeReplyMessage{Target: peer.Name, MTU: mtu})
+	if _, err := s.transport.WriteToUDP(message, from); err != nil {
+		s.log.Errf("Failed to reply to MTU probe from %q: %v", peer.Name, err)
+	}
+}
+
+// handleProbeReply notifies the pending probe, if any.
+func (c *ConnectionManager) handleProbeReply(from *net.UDPAddr, targetName string, mtu int) {
+	s := c.s
+	src := Source{IP: from.IP.String(), Port: from.Port}
+	peer, exists := s.Sources.Get(src)
+	if !exists || targetName != s.Name {
+		s.log.Warnf("Unexpected MTU probe reply from %v for %q", src, targetName)
+		return
+	}
+	c.mu.Lock()
+	reply, ok := c.probes[probeKey{name: peer.Name, mtu: mtu}]
+	c.mu.Unlock()
+	if !ok {
+		s.log.LogVf("Late MTU probe reply from %q for %d", peer.Name, mtu)
+		return
+	}
+	select {
+	case reply <- struct{}{}:
+	default:
+	}
+}
+
+// probeMessage returns the authenticated probe for mtu, padded after the trailer to its datagram
+// size (with spaces in the text format: the older versions only read the probePadding field).
+func (s *Server) probeMessage(peer Peer, mtu int) []byte {
+	message := s.authenticate(peer, &ProbeMessage{Target: peer.Name, MTU: mtu, Padding: probePadding})
+	return PadMessage(message, DatagramSize(mtu), ' ')
+}
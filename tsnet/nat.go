@@ -0,0 +1,654 @@
+package tsnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+// NAT traversal messages: peers register with a rendezvous (a reachable tsync running with
+// Config.RendezvousServer), which tells them the address it sees them from. A peer asks it to
+// introduce it to another registered peer and the rendezvous sends each of them the other's
+// address at the same time: both then send holes to each other, opening the mapping of their NAT
+// (or stateful firewall) for the other's packets (simultaneous open, "hole punching"), and the
+// regular connection handshake follows. When the holes don't get through (e.g. symmetric NATs)
+// and both peers use Config.Relay, their datagrams go through a rendezvous running with
+// Config.RelayServer instead, prefixed with the relay headers.
+const (
+	RegisterMessageFormat  = "register1 %q %s"  // name, public key (to the rendezvous)
+	ObservedMessageFormat  = "observed1 %s"     // ip:port the rendezvous sees the registered peer from
+	IntroduceMessageFormat = "introduce1 %q %q" // requester_name, target_name (to the rendezvous)
+	PunchMessageFormat     = "punch1 %q %s %s"  // peer name, public key, ip:port (from the rendezvous)
+	NoPunchMessageFormat   = "nopunch1 %q"      // target_name isn't registered (from the rendezvous)
+	HoleMessageFormat      = "hole1 %q"         // sender name, opens and keeps open the NAT mappings
+	RelayMessageFormat     = "relay1 %s "       // target ip:port, followed by the datagram to forward (to the relay)
+	RelayedMessageFormat   = "relayed1 %s "     // source ip:port, followed by the forwarded datagram (from the relay)
+
+	// Registration with the external address of our port mapping (see PortMapper), the older
+	// rendezvous only scan the RegisterMessageFormat part.
+	RegisterMappedMessageFormat = "register1 %q %s m %s"
+	// Registration and introduction with the external address signed by the peer (see STUNClient),
+	// after the port mapping if any.
+	RegisterExternalFormat       = "register1 %q %s x %s"
+	RegisterMappedExternalFormat = "register1 %q %s m %s x %s"
+	PunchExternalFormat          = "punch1 %q %s %s x %s"
+
+	relayPrefix   = "relay1 "
+	relayedPrefix = "relayed1 "
+)
+
+const (
+	// DefaultNATKeepalive is the interval of the registrations with the rendezvous and of the holes
+	// sent to the punched peers, short enough to keep the NAT mappings open (see Config.NATKeepalive).
+	DefaultNATKeepalive = 15 * time.Second
+	// MaxRendezvousPeers bounds how many registrations a rendezvous keeps.
+	MaxRendezvousPeers = 4096
+	// PunchTimeout is how long Punch waits for the rendezvous' answer before asking again.
+	PunchTimeout = time.Second
+	punchTries   = 3
+	// holePunches is how many holes are sent when punching, in case the first ones arrive before
+	// the peer opened its side.
+	holePunches = 3
+	// RelayAfter is how long after punching, without a hole from the peer, its datagrams start
+	// going through the relay (with Config.Relay).
+	RelayAfter = 2 * time.Second
+	// DefaultRendezvousPort is the usual Config.ListenPort of a rendezvous (e.g. `tsync relay`),
+	// which peers need to reach at a known address.
+	DefaultRendezvousPort = DefaultDiscoveryPort + 1
+)
+
+var (
+	// ErrNoRendezvous is returned by Punch when there is no Config.Rendezvous.
+	ErrNoRendezvous = errors.New("no rendezvous configured")
+	// ErrNotRegistered is returned by Punch when the peer isn't registered with the rendezvous.
+	ErrNotRegistered = errors.New("peer not registered with the rendezvous")
+)
+
+// registration is a peer registered with us as rendezvous.
+type registration struct {
+	peer     Peer // IP is the one we see it from.
+	port     int
+	mapped   int    // external port of its port mapping (on its IP), 0 if none.
+	external string // its signed external address (see STUNClient), forwarded as is.
+	seen     time.Time
+}
+
+// reachAt returns the address to introduce the registered peer at: its port mapping, if any.
+func (r registration) reachAt() *net.UDPAddr {
+	addr := &net.UDPAddr{IP: net.ParseIP(r.peer.IP), Port: r.port}
+	if r.mapped != 0 {
+		addr.Port = r.mapped
+	}
+	return addr
+}
+
+// registeredPeer returns the peer registered with us (as rendezvous) with the name.
+func (n *NATTraversal) registeredPeer(name string) (Peer, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r, ok := n.registered[name]
+	return r.peer, ok
+}
+
+// punched is a peer we punched a hole to.
+type punched struct {
+	peer     Peer
+	addr     *net.UDPAddr
+	external *net.UDPAddr // the other address it signed (see STUNClient), also sent holes.
+	heard    bool         // got a hole from it: the direct path works.
+}
+
+// NATTraversal lets peers behind NATs, or on other (routed) subnets multicast doesn't reach, find
+// and connect to each other through the Config.Rendezvous: it registers us there, learning our
+// external address, punches holes to the Config.PunchPeers (and on demand with Punch) and keeps
+// the NAT mappings open with a keepalive. The punched peers are added to the Peers, to connect to
+// as usual. The rendezvous side (Config.RendezvousServer) works without starting it.
+type NATTraversal struct {
+	s          *Server
+	running    atomic.Bool
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	mu         sync.Mutex
+	rendezvous *net.UDPAddr
+	external   *net.UDPAddr
+	punched    map[string]punched
+	waiters    map[string]chan error // Punch calls waiting for the rendezvous, by peer name.
+	registered map[string]registration
+	byAddr     map[netip.AddrPort]string // registered names by address, for the relay.
+	relayed    map[netip.AddrPort]bool   // addresses of the peers we relay to (see Config.Relay).
+	forwarded  atomic.Int64              // datagrams relayed, as RelayServer.
+}
+
+func (n *NATTraversal) natKeepalive() time.Duration {
+	if n.s.NATKeepalive > 0 {
+		return n.s.NATKeepalive
+	}
+	return DefaultNATKeepalive
+}
+
+func (n *NATTraversal) Start(ctx context.Context) error {
+	if n.Running() {
+		return nil
+	}
+	s := n.s
+	if !s.Listener.Running() {
+		return fmt.Errorf("NAT traversal needs the listener: %w", ErrNotRunning)
+	}
+	if s.Rendezvous == "" {
+		return ErrNoRendezvous
+	}
+	addr, err := net.ResolveUDPAddr("udp4", s.Rendezvous)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.rendezvous = addr
+	if n.punched == nil {
+		n.punched = make(map[string]punched)
+		n.waiters = make(map[string]chan error)
+		n.relayed = make(map[netip.AddrPort]bool)
+	}
+	n.mu.Unlock()
+	s.log.Infof("NAT traversal through rendezvous %v, punching to %v", addr, s.PunchPeers)
+	ctx, n.cancel = context.WithCancel(ctx)
+	ticker := time.NewTicker(n.natKeepalive())
+	s.tickers.Add(1)
+	n.wg.Add(1)
+	s.goroutines.Add(1)
+	go n.run(ctx, ticker)
+	n.running.Store(true)
+	return nil
+}
+
+func (n *NATTraversal) Stop() {
+	if !n.running.CompareAndSwap(true, false) {
+		return
+	}
+	n.cancel()
+	n.wg.Wait()
+}
+
+func (n *NATTraversal) Running() bool {
+	return n.running.Load()
+}
+
+// run does the keepalive right away and then every NATKeepalive.
+func (n *NATTraversal) run(ctx context.Context, ticker *time.Ticker) {
+	s := n.s
+	defer n.wg.Done()
+	defer s.goroutines.Add(-1)
+	defer func() {
+		ticker.Stop()
+		s.tickers.Add(-1)
+	}()
+	for {
+		n.keepalive()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// keepalive registers us with the rendezvous, asks it for the PunchPeers not punched yet and
+// sends holes to the punched ones.
+func (n *NATTraversal) keepalive() {
+	s := n.s
+	n.mu.Lock()
+	rendezvous := n.rendezvous
+	var missing []string
+	for _, name := range s.PunchPeers {
+		if _, ok := n.punched[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	punchedPeers := slices.Collect(maps.Values(n.punched))
+	n.mu.Unlock()
+	n.register()
+	for _, name := range missing {
+		n.send(rendezvous, s.sign(&IntroduceMessage{Requester: s.Name, Target: name}))
+	}
+	for _, p := range punchedPeers {
+		n.sendDirect(p.addr, s.authenticate(p.peer, &HoleMessage{Name: s.Name}))
+		if p.external != nil {
+			n.sendDirect(p.external, s.authenticate(p.peer, &HoleMessage{Name: s.Name}))
+		}
+	}
+}
+
+// register registers us with the rendezvous, with our port mapping and our signed external address
+// if we have them.
+func (n *NATTraversal) register() {
+	s := n.s
+	n.mu.Lock()
+	rendezvous := n.rendezvous
+	n.mu.Unlock()
+	register := &RegisterMessage{Name: s.Name, PublicKey: s.idStr, External: s.STUN.SignedExternal()}
+	if mapped := s.PortMap.External(); mapped != nil {
+		register.Mapped = mapped.String()
+	}
+	n.send(rendezvous, s.sign(register))
+}
+
+func (n *NATTraversal) send(to *net.UDPAddr, message []byte) {
+	if _, err := n.s.transport.WriteToUDP(message, to); err != nil {
+		n.s.log.Errf("Failed to send %q to %v: %v", message, to, err)
+	}
+}
+
+// sendDirect sends the message to the peer even if we relay to it (holes probe the direct path).
+func (n *NATTraversal) sendDirect(to *net.UDPAddr, message []byte) {
+	t := n.s.transport
+	if r, ok := t.(relayTransport); ok {
+		t = r.Transport
+	}
+	if _, err := t.WriteToUDP(message, to); err != nil {
+		n.s.log.Errf("Failed to send %q to %v: %v", message, to, err)
+	}
+}
+
+// ExternalAddress returns our address as seen by the rendezvous (our NAT's external address and
+// port for it), nil until it answered our registration.
+func (n *NATTraversal) ExternalAddress() *net.UDPAddr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.external
+}
+
+// Punch asks the rendezvous to introduce us to the peer named name and returns it once the holes
+// are punched (it's then in the Peers, ready for Connect). Fails with ErrNotRegistered when the
+// peer isn't registered with the rendezvous and ErrNoReply if the rendezvous doesn't answer.
+func (n *NATTraversal) Punch(ctx context.Context, name string) (Peer, error) {
+	if !n.Running() {
+		return Peer{}, fmt.Errorf("punching to %q: %w", name, ErrNotRunning)
+	}
+	ch := make(chan error, 1)
+	n.mu.Lock()
+	n.waiters[name] = ch
+	rendezvous := n.rendezvous
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.waiters, name)
+		n.mu.Unlock()
+	}()
+	for range punchTries {
+		n.send(rendezvous, n.s.sign(&IntroduceMessage{Requester: n.s.Name, Target: name}))
+		select {
+		case <-ctx.Done():
+			return Peer{}, ctx.Err()
+		case err := <-ch:
+			if err != nil {
+				return Peer{}, err
+			}
+			n.mu.Lock()
+			p := n.punched[name]
+			n.mu.Unlock()
+			return p.peer, nil
+		case <-time.After(PunchTimeout):
+		}
+	}
+	return Peer{}, fmt.Errorf("%w from rendezvous %v", ErrNoReply, rendezvous)
+}
+
+// fromRendezvous returns true if from is our rendezvous, the only source of observed and punch messages.
+func (n *NATTraversal) fromRendezvous(from *net.UDPAddr) bool {
+	if n.isRendezvous(from) {
+		return true
+	}
+	n.s.log.Warnf("Ignoring NAT traversal message from %v, not our rendezvous %v", from, n.rendezvous)
+	return false
+}
+
+// isRendezvous returns true if addr is our rendezvous.
+func (n *NATTraversal) isRendezvous(addr *net.UDPAddr) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rendezvous != nil && n.rendezvous.IP.Equal(addr.IP) && n.rendezvous.Port == addr.Port
+}
+
+// isRegistered returns true if a peer registered with us (as rendezvous) from addr.
+func (n *NATTraversal) isRegistered(addr *net.UDPAddr) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.byAddr[addrPort(addr)]
+	return ok
+}
+
+// handleRegister records (as rendezvous) the peer's registration, with the external address of its
+// port mapping if any (only on the IP we see it from, so it can't make us introduce others to a
+// third party) and the external address it signed if valid, and tells it its observed address.
+func (n *NATTraversal) handleRegister(from *net.UDPAddr, name, pubKey, mapped, external string) {
+	s := n.s
+	if !s.RendezvousServer {
+		s.log.LogVf("Ignoring registration of %q from %v, not a rendezvous", name, from)
+		return
+	}
+	if _, err := tcrypto.IdentityPublicKeyString(pubKey); err != nil {
+		s.log.Warnf("Invalid public key in the registration of %q from %v: %v", name, from, err)
+		return
+	}
+	mappedPort := 0
+	if mapped != "" {
+		ap, err := netip.ParseAddrPort(mapped)
+		if err != nil || ap.Addr().Unmap() != addrPort(from).Addr() {
+			s.log.Warnf("Ignoring the port mapping %q of %q registering from %v", mapped, name, from)
+		} else {
+			mappedPort = int(ap.Port())
+		}
+	}
+	if external != "" {
+		if _, err := verifyExternal(external, name, pubKey); err != nil {
+			s.log.Warnf("Ignoring the external address of %q registering from %v: %v", name, from, err)
+			external = ""
+		}
+	}
+	now := time.Now()
+	expiry := 3 * n.natKeepalive()
+	n.mu.Lock()
+	if n.registered == nil {
+		n.registered = make(map[string]registration)
+	}
+	old, exists := n.registered[name]
+	switch {
+	case exists && old.peer.PublicKey != pubKey && now.Sub(old.seen) < expiry:
+		n.mu.Unlock()
+		s.log.Warnf("Registration of %q from %v with another public key than %v's", name, from, old.peer.IP)
+		return
+	case !exists && len(n.registered) >= MaxRendezvousPeers:
+		for other, r := range n.registered {
+			if now.Sub(r.seen) >= expiry {
+				delete(n.registered, other)
+				delete(n.byAddr, netip.AddrPortFrom(netip.MustParseAddr(r.peer.IP), uint16(r.port))) //nolint:gosec // a port.
+			}
+		}
+		if len(n.registered) >= MaxRendezvousPeers {
+			n.mu.Unlock()
+			s.log.Warnf("Too many registrations, ignoring %q from %v", name, from)
+			return
+		}
+	}
+	if n.byAddr == nil {
+		n.byAddr = make(map[netip.AddrPort]string)
+	}
+	if exists {
+		delete(n.byAddr, netip.AddrPortFrom(netip.MustParseAddr(old.peer.IP), uint16(old.port))) //nolint:gosec // a port.
+	}
+	n.registered[name] = registration{
+		peer: Peer{IP: from.IP.String(), Name: name, PublicKey: pubKey}, port: from.Port,
+		mapped: mappedPort, external: external, seen: now,
+	}
+	n.byAddr[addrPort(from)] = name
+	n.mu.Unlock()
+	if !exists {
+		s.log.Infof("Registered %q at %v", name, from)
+	}
+	n.send(from, s.encode(&ObservedMessage{Address: from.String()}))
+}
+
+// handleIntroduce sends (as rendezvous) each of the requester and target peers the other's
+// address, when both are registered, the requester from the address it asks from.
+func (n *NATTraversal) handleIntroduce(from *net.UDPAddr, requesterName, targetName string) {
+	s := n.s
+	if !s.RendezvousServer {
+		return
+	}
+	expiry := 3 * n.natKeepalive()
+	n.mu.Lock()
+	requester, okR := n.registered[requesterName]
+	target, okT := n.registered[targetName]
+	n.mu.Unlock()
+	if !okR || requester.peer.IP != from.IP.String() || requester.port != from.Port {
+		s.log.Warnf("Introduction request from %v for unregistered %q", from, requesterName)
+		return
+	}
+	if !okT || time.Since(target.seen) > expiry {
+		n.send(from, s.encode(&NoPunchMessage{Target: targetName}))
+		return
+	}
+	targetAddr := &net.UDPAddr{IP: net.ParseIP(target.peer.IP), Port: target.port}
+	s.log.Infof("Introducing %q (%v) and %q (%v)", requesterName, requester.reachAt(), targetName, target.reachAt())
+	n.send(targetAddr, s.encode(&PunchMessage{
+		Name: requesterName, PublicKey: requester.peer.PublicKey, Address: requester.reachAt().String(),
+		External: requester.external,
+	}))
+	n.send(from, s.encode(&PunchMessage{
+		Name: targetName, PublicKey: target.peer.PublicKey, Address: target.reachAt().String(),
+		External: target.external,
+	}))
+}
+
+// handleObserved records our external address from the rendezvous' answer to our registration.
+func (n *NATTraversal) handleObserved(from *net.UDPAddr, observed string) {
+	if !n.fromRendezvous(from) {
+		return
+	}
+	ap, err := netip.ParseAddrPort(observed)
+	if err != nil {
+		n.s.log.Warnf("Invalid observed address %q from the rendezvous: %v", observed, err)
+		return
+	}
+	addr := net.UDPAddrFromAddrPort(ap)
+	n.mu.Lock()
+	changed := n.external == nil || n.external.String() != addr.String()
+	n.external = addr
+	n.mu.Unlock()
+	if changed {
+		n.s.log.Infof("External address (seen by the rendezvous): %v", addr)
+	}
+}
+
+// handlePunch adds the peer the rendezvous introduced us to, sends it holes (to the external
+// address it signed too, added as another of its addresses when on another IP) and wakes up Punch.
+func (n *NATTraversal) handlePunch(from *net.UDPAddr, name, pubKey, address, signedExternal string) {
+	s := n.s
+	if !n.fromRendezvous(from) {
+		return
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		s.log.Warnf("Invalid address %q of %q from the rendezvous: %v", address, name, err)
+		return
+	}
+	addr := net.UDPAddrFromAddrPort(ap)
+	peer := Peer{IP: addr.IP.String(), Name: name, PublicKey: pubKey}
+	if data, exists := s.Peers.Get(peer); exists && data.Port == addr.Port {
+		data.LastSeen = time.Now()
+		s.change(s.setPeer(peer, data))
+	} else {
+		s.AddPeer(peer, addr.Port)
+	}
+	var external *net.UDPAddr
+	if signedExternal != "" {
+		if external, err = verifyExternal(signedExternal, name, pubKey); err != nil {
+			s.log.Warnf("Ignoring the external address of %q from the rendezvous: %v", name, err)
+		} else if external.String() == addr.String() {
+			external = nil
+		} else if !external.IP.Equal(addr.IP) {
+			s.mergeAddr(Peer{IP: external.IP.String(), Name: name, PublicKey: pubKey},
+				PeerData{Port: external.Port, LastSeen: time.Now()})
+		}
+	}
+	s.log.Infof("Punching a hole to %q at %v (and %v)", name, addr, external)
+	for range holePunches { // authenticated each time: the session MACs can't be replayed.
+		n.sendDirect(addr, s.authenticate(peer, &HoleMessage{Name: s.Name}))
+		if external != nil {
+			n.sendDirect(external, s.authenticate(peer, &HoleMessage{Name: s.Name}))
+		}
+	}
+	n.mu.Lock()
+	heard := n.punched[name].heard && n.punched[name].addr.String() == addr.String()
+	n.punched[name] = punched{peer: peer, addr: addr, external: external, heard: heard}
+	ch := n.waiters[name]
+	n.mu.Unlock()
+	if s.Relay && !heard {
+		time.AfterFunc(RelayAfter, func() { n.checkDirect(name) })
+	}
+	if ch != nil {
+		select {
+		case ch <- nil:
+		default:
+		}
+	}
+}
+
+// handleNoPunch fails the Punch to the peer unknown to the rendezvous.
+func (n *NATTraversal) handleNoPunch(from *net.UDPAddr, name string) {
+	if !n.fromRendezvous(from) {
+		return
+	}
+	n.mu.Lock()
+	ch := n.waiters[name]
+	n.mu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- fmt.Errorf("%w: %q", ErrNotRegistered, name):
+		default:
+		}
+	}
+}
+
+// handleHole refreshes the punched peer sending it, so it doesn't expire.
+func (n *NATTraversal) handleHole(from *net.UDPAddr, name string) {
+	s := n.s
+	peer, exists := s.Sources.Get(Source{IP: from.IP.String(), Port: from.Port})
+	if !exists || peer.Name != name {
+		s.log.LogVf("Hole from unknown %q (%v)", name, from)
+		return
+	}
+	if data, ok := s.Peers.Get(peer); ok {
+		data.LastSeen = time.Now()
+		s.change(s.setPeer(peer, data))
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if p, ok := n.punched[name]; ok && (p.addr.String() == from.String() || p.external.String() == from.String()) {
+		p.heard = true
+		n.punched[name] = p
+	}
+	if n.relayed[addrPort(from)] {
+		delete(n.relayed, addrPort(from))
+		s.log.Infof("Direct path to %q (%v) works, not relaying anymore", name, from)
+	}
+}
+
+func addrPort(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// checkDirect starts relaying to the punched peer if we didn't get any hole from it.
+func (n *NATTraversal) checkDirect(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	p, ok := n.punched[name]
+	if !ok || p.heard || n.relayed[addrPort(p.addr)] {
+		return
+	}
+	n.relayed[addrPort(p.addr)] = true
+	n.s.log.Infof("No direct path to %q (%v) after %v, relaying through the rendezvous", name, p.addr, RelayAfter)
+}
+
+// relayVia returns the rendezvous to send the datagrams to addr through, if we relay to it.
+func (n *NATTraversal) relayVia(addr *net.UDPAddr) (*net.UDPAddr, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rendezvous, n.relayed[addrPort(addr)]
+}
+
+// Relayed returns the number of datagrams forwarded as relay (see Config.RelayServer).
+func (n *NATTraversal) Relayed() int64 {
+	return n.forwarded.Load()
+}
+
+// cutRelayHeader parses the relay header (prefix, ip:port and a space) of buf.
+func cutRelayHeader(buf []byte, prefix string) (*net.UDPAddr, []byte, bool) {
+	rest, ok := bytes.CutPrefix(buf, []byte(prefix))
+	if !ok {
+		return nil, nil, false
+	}
+	address, payload, ok := bytes.Cut(rest, []byte(" "))
+	if !ok {
+		return nil, nil, false
+	}
+	ap, err := netip.ParseAddrPort(string(address))
+	if err != nil {
+		return nil, nil, false
+	}
+	return net.UDPAddrFromAddrPort(ap), payload, true
+}
+
+// handleRelay forwards (as RelayServer) a datagram between 2 registered peers.
+func (n *NATTraversal) handleRelay(from, to *net.UDPAddr, payload []byte) {
+	s := n.s
+	if !s.RelayServer {
+		s.log.LogVf("Ignoring datagram to relay from %v, not a relay", from)
+		return
+	}
+	n.mu.Lock()
+	sender, okFrom := n.byAddr[addrPort(from)]
+	target, okTo := n.byAddr[addrPort(to)]
+	n.mu.Unlock()
+	if !okFrom || !okTo {
+		s.log.Warnf("Not relaying from %v (%q) to %v (%q): both need to be registered", from, sender, to, target)
+		return
+	}
+	msg := append([]byte(fmt.Sprintf(RelayedMessageFormat, from)), payload...)
+	if _, err := s.transport.WriteToUDP(msg, to); err != nil {
+		s.log.Errf("Failed to relay from %q to %q: %v", sender, target, err)
+		return
+	}
+	n.forwarded.Add(1)
+}
+
+// handleRelayed handles a datagram the rendezvous relayed from a peer as if it came from it
+// directly, relaying our answers to it too.
+func (n *NATTraversal) handleRelayed(from, source *net.UDPAddr, payload []byte) {
+	s := n.s
+	if !s.Relay {
+		s.log.LogVf("Ignoring relayed datagram from %v, relaying not enabled", source)
+		return
+	}
+	if !n.fromRendezvous(from) {
+		return
+	}
+	n.mu.Lock()
+	if !n.relayed[addrPort(source)] {
+		n.relayed[addrPort(source)] = true
+		s.log.Infof("Relaying to %v through the rendezvous, as it does to us", source)
+	}
+	n.mu.Unlock()
+	if s.rateLimited(payload, source) {
+		return
+	}
+	s.handleDirectMessage(payload, source)
+}
+
+// relayTransport sends the datagrams to the peers we relay to through the rendezvous (see Config.Relay).
+type relayTransport struct {
+	Transport
+	n *NATTraversal
+}
+
+func (r relayTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	rendezvous, relay := r.n.relayVia(addr)
+	if !relay {
+		return r.Transport.WriteToUDP(b, addr)
+	}
+	msg := append([]byte(fmt.Sprintf(RelayMessageFormat, addr)), b...)
+	if _, err := r.Transport.WriteToUDP(msg, rendezvous); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
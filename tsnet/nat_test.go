@@ -0,0 +1,144 @@
+package tsnet_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// TestNATPunch introduces 2 servers, which don't know each other, through a third one acting as
+// rendezvous: they find each other's address, punch holes and connect.
+func TestNATPunch(t *testing.T) {
+	r := newUnicastServer(t, "rendezvous")
+	r.RendezvousServer = true
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := r.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer r.Stop()
+	a := newUnicastServer(t, "natA")
+	b := newUnicastServer(t, "natB")
+	if err := a.NAT.Start(ctx); !errors.Is(err, tsnet.ErrNotRunning) {
+		t.Errorf("NAT without Listener should fail with ErrNotRunning, got %v", err)
+	}
+	for _, srv := range []*tsnet.Server{a, b} {
+		srv.Rendezvous = r.OurAddress().String()
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+		if res := srv.Resources(); res.Goroutines != 3 || res.Tickers != 2 {
+			t.Errorf("Unexpected resources with NAT traversal: %+v", res)
+		}
+	}
+	for _, srv := range []*tsnet.Server{a, b} {
+		for srv.NAT.ExternalAddress() == nil {
+			if ctx.Err() != nil {
+				t.Fatalf("%s never registered", srv.Name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got, want := srv.NAT.ExternalAddress().String(), srv.OurAddress().String(); got != want {
+			t.Errorf("%s external address %s, want %s", srv.Name, got, want)
+		}
+	}
+	if _, err := a.NAT.Punch(ctx, "nobody"); !errors.Is(err, tsnet.ErrNotRegistered) {
+		t.Errorf("Punch to an unregistered peer: got %v, want ErrNotRegistered", err)
+	}
+	peerB, err := a.NAT.Punch(ctx, "natB")
+	if err != nil {
+		t.Fatalf("Punch failed: %v", err)
+	}
+	if want, _ := asPeer(b); peerB != want {
+		t.Errorf("Punched %+v, want %+v", peerB, want)
+	}
+	if err = a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err = a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	peerA, _ := asPeer(a)
+	if pd, ok := b.Peers.Get(peerA); !ok || pd.Status != tsnet.Connected {
+		t.Errorf("B: A %+v (found %v), want Connected", pd, ok)
+	}
+}
+
+// directBlocker drops the datagrams not sent to the rendezvous, like NATs holes can't get through.
+type directBlocker struct {
+	tsnet.Transport
+	rendezvous string
+}
+
+func (d directBlocker) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if addr.String() != d.rendezvous {
+		return len(b), nil
+	}
+	return d.Transport.WriteToUDP(b, addr)
+}
+
+// TestNATRelay connects 2 servers which can't reach each other directly through the rendezvous
+// relaying their datagrams.
+func TestNATRelay(t *testing.T) {
+	r := newUnicastServer(t, "relay")
+	r.RendezvousServer, r.RelayServer, r.ListenPort = true, true, testPort+20
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := r.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer r.Stop()
+	if got := r.OurAddress().Port; got != testPort+20 {
+		t.Errorf("Relay listening on port %d, want %d", got, testPort+20)
+	}
+	rendezvous := r.OurAddress().String()
+	received := make(chan string, 1)
+	a := newUnicastServer(t, "relayA")
+	b := newUnicastServer(t, "relayB")
+	b.OnData = func(_ tsnet.Peer, data []byte) {
+		received <- string(data)
+	}
+	for _, srv := range []*tsnet.Server{a, b} {
+		srv.Rendezvous, srv.Relay = rendezvous, true
+		srv.WrapTransport = func(t tsnet.Transport) tsnet.Transport { return directBlocker{t, rendezvous} }
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+		for srv.NAT.ExternalAddress() == nil {
+			if ctx.Err() != nil {
+				t.Fatalf("%s never registered", srv.Name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	peerB, err := a.NAT.Punch(ctx, "relayB")
+	if err != nil {
+		t.Fatalf("Punch failed: %v", err)
+	}
+	if err = a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err = a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	if err = a.SendData(peerB, []byte("through the relay")); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	select {
+	case got := <-received:
+		if got != "through the relay" {
+			t.Errorf("Received %q", got)
+		}
+	case <-ctx.Done():
+		t.Fatal("Data never received")
+	}
+	if r.NAT.Relayed() == 0 {
+		t.Errorf("Nothing relayed")
+	}
+}
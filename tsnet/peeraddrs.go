@@ -0,0 +1,129 @@
+package tsnet
+
+import (
+	"net"
+	"slices"
+	"time"
+)
+
+// PeerAddr is another address a peer was seen at (see PeerData.Addrs).
+type PeerAddr struct {
+	IP       string
+	Port     int
+	LastSeen time.Time
+}
+
+// samePeer returns the known peer with the name and public key of peer but another IP.
+func (s *Server) samePeer(peer Peer) (Peer, PeerData, bool) {
+	for known, data := range s.Peers.All() {
+		if known.PublicKey == peer.PublicKey && known.Name == peer.Name && known.IP != peer.IP {
+			return known, data, true
+		}
+	}
+	return Peer{}, PeerData{}, false
+}
+
+// mergeAddr records the address of peer's announcement as another address of the known peer with
+// the same name and public key (seen from another of its interfaces) so a multi-homed host is a
+// single peer. Returns false if there is no such peer.
+func (s *Server) mergeAddr(peer Peer, data PeerData) bool {
+	known, v, ok := s.samePeer(peer)
+	if !ok {
+		return false
+	}
+	addr := PeerAddr{IP: peer.IP, Port: data.Port, LastSeen: data.LastSeen}
+	v.Addrs = slices.Clone(v.Addrs) // not shared with the readers of the previous value.
+	if i := slices.IndexFunc(v.Addrs, func(a PeerAddr) bool { return a.IP == peer.IP }); i < 0 {
+		s.log.Infof("Peer %q also seen at %s:%d", known.Name, peer.IP, data.Port)
+		v.Addrs = append(v.Addrs, addr)
+	} else {
+		if v.Addrs[i].Port != data.Port {
+			s.Sources.Delete(Source{IP: peer.IP, Port: v.Addrs[i].Port})
+		}
+		v.Addrs[i] = addr
+	}
+	s.Sources.Set(Source{IP: peer.IP, Port: data.Port}, known)
+	s.change(s.setPeer(known, v))
+	return true
+}
+
+// expireAddrs removes the other addresses of the peer not seen for PeerTimeout, returning their
+// sources.
+func (s *Server) expireAddrs(peer Peer, data PeerData, now time.Time) []Source {
+	var expired []Source
+	addrs := slices.DeleteFunc(slices.Clone(data.Addrs), func(a PeerAddr) bool {
+		if now.Sub(a.LastSeen) <= s.PeerTimeout {
+			return false
+		}
+		expired = append(expired, Source{IP: a.IP, Port: a.Port})
+		return true
+	})
+	if len(expired) > 0 {
+		s.log.Infof("Peer %q not seen at %v anymore", peer.Name, expired)
+		data.Addrs = addrs
+		s.change(s.setPeer(peer, data))
+	}
+	return expired
+}
+
+// peerSources returns the sources of all the addresses of the peer.
+func peerSources(peer Peer, data PeerData) []Source {
+	sources := []Source{{IP: peer.IP, Port: data.Port}}
+	for _, a := range data.Addrs {
+		sources = append(sources, Source{IP: a.IP, Port: a.Port})
+	}
+	return sources
+}
+
+// isPeerIP returns true if ip is one of the peer's addresses.
+func (s *Server) isPeerIP(peer Peer, ip string) bool {
+	if peer.IP == ip {
+		return true
+	}
+	data, _ := s.Peers.Get(peer)
+	return slices.ContainsFunc(data.Addrs, func(a PeerAddr) bool { return a.IP == ip })
+}
+
+// addrScore ranks the addresses to reach a peer at: the same host first, then on one of our
+// networks, then private ones.
+func (l *Listener) addrScore(ip net.IP) int {
+	switch {
+	case ip.IsLoopback():
+		return 3
+	case slices.ContainsFunc(l.networks, func(n *net.IPNet) bool { return n.Contains(ip) }):
+		return 2
+	case ip.IsPrivate():
+		return 1
+	default:
+		return 0
+	}
+}
+
+// peerAddr returns the address to send to the peer at: the best one (see addrScore) of the one it
+// was first seen at and its other ones (see PeerData.Addrs).
+func (s *Server) peerAddr(peer Peer, data PeerData) *net.UDPAddr {
+	best := &net.UDPAddr{IP: net.ParseIP(peer.IP), Port: data.Port}
+	if len(data.Addrs) == 0 {
+		return best
+	}
+	score := s.Listener.addrScore(best.IP)
+	for _, a := range data.Addrs {
+		ip := net.ParseIP(a.IP)
+		if sc := s.Listener.addrScore(ip); sc > score {
+			best, score = &net.UDPAddr{IP: ip, Port: a.Port}, sc
+		}
+	}
+	return best
+}
+
+// ourNetworks returns the IPv4 networks of our interfaces.
+func ourNetworks() []*net.IPNet {
+	addrs, _ := net.InterfaceAddrs()
+	var networks []*net.IPNet
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			networks = append(networks, ipNet)
+		}
+	}
+	return networks
+}
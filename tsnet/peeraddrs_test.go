@@ -0,0 +1,116 @@
+package tsnet_test
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// multicastRecorder records (instead of sending) the datagrams sent to multicast addresses.
+type multicastRecorder struct {
+	tsnet.Transport
+	sent chan<- []byte
+}
+
+func (m multicastRecorder) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if addr.IP.IsMulticast() {
+		select {
+		case m.sent <- append([]byte(nil), b...):
+		default:
+		}
+		return len(b), nil
+	}
+	return m.Transport.WriteToUDP(b, addr)
+}
+
+// TestMultiHomedPeer announces the same peer from 2 addresses, with what MCastMessageSend sends on
+// 2 interfaces (Config.AllInterfaces): it's a single peer with another address (neither announcement
+// being dropped as a replay of the other), and leaving from that one removes it.
+func TestMultiHomedPeer(t *testing.T) {
+	NoMCastOnMacInCI(t)
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(interfaces, func(iface net.Interface) bool { return iface.Flags&net.FlagLoopback != 0 })
+	if i < 0 {
+		t.Skip("No loopback interface")
+	}
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With Discovery to handle the announcements sent directly (like seed answers).
+	cfg := tsnet.Config{Name: "multiB", Identity: id, Mcast: "239.255.115.122", Port: testPort + 60, Interface: interfaces[i].Name}
+	b := cfg.NewServer()
+	if err = b.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer b.Stop()
+	var conns []*net.UDPConn
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(ip)})
+		if err != nil {
+			t.Skipf("Can't listen on %s: %v", ip, err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	if id, err = tcrypto.NewIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan []byte, 16)
+	cfg = tsnet.Config{
+		Name: "multi", Identity: id, Mcast: "239.255.115.124", Port: testPort + 80, AllInterfaces: true,
+		BaseBroadcastInterval: time.Hour, // only our MCastMessageSend.
+		WrapTransport:         func(t tsnet.Transport) tsnet.Transport { return multicastRecorder{t, sent} },
+	}
+	multi := cfg.NewServer()
+	if err = multi.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer multi.Stop()
+	if err = multi.MCastMessageSend(1); err != nil {
+		t.Fatalf("MCastMessageSend failed: %v", err)
+	}
+	if len(sent) < 2 {
+		t.Skipf("Needs 2 multicast interfaces, announced on %d", len(sent))
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timeout waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for n, conn := range conns {
+		if _, err = conn.WriteToUDP(<-sent, b.OurAddress()); err != nil {
+			t.Fatal(err)
+		}
+		waitFor("the announcement", func() bool { return b.Sources.Len() == n+1 })
+	}
+	if b.Peers.Len() != 1 {
+		t.Fatalf("Expected a single peer, got %d", b.Peers.Len())
+	}
+	for peer, data := range b.Peers.All() {
+		second := conns[1].LocalAddr().(*net.UDPAddr)
+		if peer.IP != "127.0.0.1" || len(data.Addrs) != 1 || data.Addrs[0].IP != "127.0.0.2" || data.Addrs[0].Port != second.Port {
+			t.Errorf("Unexpected peer %+v %+v", peer, data)
+		}
+	}
+	if _, err = conns[1].WriteToUDP(tsnet.LeaveMessage(id, "multi", time.Now(), "n3"), b.OurAddress()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the peer to leave", func() bool { return b.Peers.Len() == 0 })
+	if b.Sources.Len() != 0 {
+		t.Errorf("Expected no sources left, got %d", b.Sources.Len())
+	}
+}
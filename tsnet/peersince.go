@@ -0,0 +1,108 @@
+package tsnet
+
+import (
+	"slices"
+	"sync"
+
+	"fortio.org/smap"
+)
+
+// MaxPeerRemovals is how many removed peers the Server remembers for PeersSince, older versions
+// get the full list.
+const MaxPeerRemovals = 1024
+
+// PeersDiff is what changed in the Server's Peers since a version (see PeersSince).
+type PeersDiff struct {
+	// Version of Peers the diff brings the caller to, to pass to the next PeersSince.
+	Version uint64
+	// Updated are all the peers (and Removed is empty): the version was 0, too old to know the
+	// removed peers or from before a Restart.
+	Full bool
+	// Added or updated peers with their current data, sorted with PeerKVSort.
+	Updated []smap.KV[Peer, PeerData]
+	// Removed peers (expired or cleared).
+	Removed []Peer
+}
+
+// peerVersions records the version of each peer's last change and of the last removals, for
+// PeersSince. Changes of Peers go through setPeer, deletePeers and clearPeers to keep it in sync.
+type peerVersions struct {
+	mu      sync.Mutex
+	changed map[Peer]uint64
+	removed []peerRemoval // oldest first.
+	floor   uint64        // the removals before this version are forgotten.
+}
+
+type peerRemoval struct {
+	peer    Peer
+	version uint64
+}
+
+// setPeer sets the peer's data, returning the new version of Peers.
+func (s *Server) setPeer(peer Peer, data PeerData) uint64 {
+	pv := &s.peerVersions
+	pv.mu.Lock()
+	defer pv.mu.Unlock()
+	v := s.Peers.Set(peer, data)
+	if pv.changed == nil {
+		pv.changed = make(map[Peer]uint64)
+	}
+	pv.changed[peer] = v
+	return v
+}
+
+// deletePeers removes the peers, returning the new version of Peers.
+func (s *Server) deletePeers(peers ...Peer) uint64 {
+	pv := &s.peerVersions
+	pv.mu.Lock()
+	defer pv.mu.Unlock()
+	v := s.Peers.Delete(peers...)
+	s.forgetStats(peers...)
+	for _, peer := range peers {
+		delete(pv.changed, peer)
+		pv.removed = slices.DeleteFunc(pv.removed, func(r peerRemoval) bool { return r.peer == peer })
+		pv.removed = append(pv.removed, peerRemoval{peer, v})
+	}
+	if extra := len(pv.removed) - MaxPeerRemovals; extra > 0 {
+		pv.floor = max(pv.floor, pv.removed[extra-1].version)
+		pv.removed = slices.Delete(pv.removed, 0, extra)
+	}
+	return v
+}
+
+// clearPeers removes all the peers, returning the new version of Peers.
+func (s *Server) clearPeers() uint64 {
+	pv := &s.peerVersions
+	pv.mu.Lock()
+	defer pv.mu.Unlock()
+	v := s.Peers.Clear()
+	s.clearStats()
+	pv.changed, pv.removed, pv.floor = nil, nil, v
+	return v
+}
+
+// PeersSince returns the peers added, updated or removed since version (the Version of a previous
+// PeersDiff, or 0 for all the peers), so API clients can poll without getting the whole list
+// each time. Only the changes made by the Server are tracked, not direct Peers.Set calls.
+func (s *Server) PeersSince(version uint64) PeersDiff {
+	pv := &s.peerVersions
+	pv.mu.Lock()
+	defer pv.mu.Unlock()
+	diff := PeersDiff{Version: s.Peers.Version()}
+	diff.Full = version == 0 || version < pv.floor || version > diff.Version
+	for peer, data := range s.Peers.All() {
+		if diff.Full || pv.changed[peer] > version {
+			diff.Updated = append(diff.Updated, smap.KV[Peer, PeerData]{Key: peer, Value: data})
+		}
+	}
+	slices.SortFunc(diff.Updated, PeerKVSort)
+	if diff.Full {
+		return diff
+	}
+	for _, r := range pv.removed {
+		if r.version > version && !s.Peers.Has(r.peer) {
+			diff.Removed = append(diff.Removed, r.peer)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,59 @@
+package tsnet_test
+
+import (
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+func diffNames(diff tsnet.PeersDiff) (updated, removed []string) {
+	for _, kv := range diff.Updated {
+		updated = append(updated, kv.Key.Name)
+	}
+	for _, p := range diff.Removed {
+		removed = append(removed, p.Name)
+	}
+	return updated, removed
+}
+
+func TestPeersSince(t *testing.T) {
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := tsnet.Config{Name: "since", Identity: id, NoDiscovery: true, Logger: tsnet.NoLogger, PeerTimeout: time.Millisecond}
+	srv := cfg.NewServer() // not started, AddPeer and PeersCleanup are enough.
+	peer := func(name string) tsnet.Peer { return tsnet.Peer{IP: "192.0.2.1", Name: name, PublicKey: "x"} }
+	srv.AddPeer(peer("b"), 1)
+	srv.AddPeer(peer("a"), 2)
+	diff := srv.PeersSince(0)
+	updated, removed := diffNames(diff)
+	if !diff.Full || len(updated) != 2 || updated[0] != "a" || updated[1] != "b" || len(removed) != 0 {
+		t.Errorf("PeersSince(0) = %+v", diff)
+	}
+	if diff.Version != srv.Peers.Version() {
+		t.Errorf("PeersSince version %d, Peers at %d", diff.Version, srv.Peers.Version())
+	}
+	v := diff.Version
+	if diff = srv.PeersSince(v); diff.Full || len(diff.Updated) != 0 || len(diff.Removed) != 0 || diff.Version != v {
+		t.Errorf("PeersSince(current) = %+v", diff)
+	}
+	srv.AddPeer(peer("c"), 3)
+	diff = srv.PeersSince(v)
+	if updated, _ = diffNames(diff); diff.Full || len(updated) != 1 || updated[0] != "c" {
+		t.Errorf("PeersSince after adding c = %+v", diff)
+	}
+	time.Sleep(5 * time.Millisecond)
+	srv.PeersCleanup() // all expire.
+	srv.AddPeer(peer("d"), 4)
+	diff = srv.PeersSince(v)
+	updated, removed = diffNames(diff)
+	if diff.Full || len(updated) != 1 || updated[0] != "d" || len(removed) != 3 {
+		t.Errorf("PeersSince after the cleanup = %+v", diff)
+	}
+	if diff = srv.PeersSince(diff.Version + 100); !diff.Full || len(diff.Updated) != 1 {
+		t.Errorf("PeersSince a future version should be full: %+v", diff)
+	}
+}
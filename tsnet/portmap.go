@@ -0,0 +1,262 @@
+package tsnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// NATPMPPort is the port of the NAT-PMP server of the gateway (RFC 6886).
+	NATPMPPort = 5351
+	// PortMappingLifetime is the lifetime requested for the port mappings, renewed at half of the
+	// one granted.
+	PortMappingLifetime = 2 * time.Hour
+	// PortMappingRetry is how long after failing to get a mapping it's tried again.
+	PortMappingRetry = 5 * time.Minute
+
+	natPMPTries   = 4 // 250ms, 500ms, 1s and 2s timeouts.
+	natPMPTimeout = 250 * time.Millisecond
+)
+
+// PortMapper asks our gateway, with NAT-PMP or else UPnP IGD, to forward a port of its external
+// address to our unicast socket (see Config.PortMapping), so the peers outside of our network can
+// reach us directly, without hole punching nor relay. The mapping is renewed before it expires,
+// sent to the Rendezvous in our registrations (so the peers it introduces us to use it) and
+// removed by Stop.
+type PortMapper struct {
+	s        *Server
+	running  atomic.Bool
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	external *net.UDPAddr
+	protocol string      // of the current mapping: "NAT-PMP" or "UPnP".
+	upnp     *upnpClient // discovered on the first NAT-PMP failure.
+}
+
+func (m *PortMapper) Start(ctx context.Context) error {
+	if m.Running() {
+		return nil
+	}
+	s := m.s
+	if !s.Listener.Running() {
+		return fmt.Errorf("port mapping needs the listener: %w", ErrNotRunning)
+	}
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.wg.Add(1)
+	s.goroutines.Add(1)
+	go m.run(ctx)
+	m.running.Store(true)
+	return nil
+}
+
+func (m *PortMapper) Stop() {
+	if !m.running.CompareAndSwap(true, false) {
+		return
+	}
+	m.cancel()
+	m.wg.Wait()
+}
+
+func (m *PortMapper) Running() bool {
+	return m.running.Load()
+}
+
+// External returns the external address of our port mapping, nil while there is none.
+func (m *PortMapper) External() *net.UDPAddr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.external
+}
+
+// run maps the port, renews the mapping at half its lifetime (or retries after PortMappingRetry)
+// and removes it when ctx is done.
+func (m *PortMapper) run(ctx context.Context) {
+	s := m.s
+	defer m.wg.Done()
+	defer s.goroutines.Add(-1)
+	failed := false
+	for {
+		wait := PortMappingRetry
+		external, protocol, lifetime, err := m.mapPort(ctx, PortMappingLifetime)
+		switch {
+		case ctx.Err() != nil:
+		case err != nil:
+			if !failed {
+				s.log.Warnf("No port mapping from the gateway (will retry every %v): %v", PortMappingRetry, err)
+			} else {
+				s.log.LogVf("Still no port mapping: %v", err)
+			}
+			failed = true
+		default:
+			failed = false
+			wait = max(lifetime/2, time.Minute)
+			m.mu.Lock()
+			changed := m.external == nil || m.external.String() != external.String()
+			m.external, m.protocol = external, protocol
+			m.mu.Unlock()
+			if changed {
+				s.log.Infof("Port %d mapped to %v by the gateway (%s, for %v)", s.ourSendAddr.Port, external, protocol, lifetime)
+				if s.NAT.Running() {
+					s.NAT.register()
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			m.unmap()
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// unmap removes our mapping, if any.
+func (m *PortMapper) unmap() {
+	s := m.s
+	m.mu.Lock()
+	external, protocol := m.external, m.protocol
+	m.external = nil
+	m.mu.Unlock()
+	if external == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var err error
+	if protocol == "UPnP" {
+		err = m.upnp.deleteMapping(ctx, external.Port)
+	} else {
+		var gw *net.UDPAddr
+		if gw, err = m.gateway(); err == nil {
+			_, _, err = m.natPMPMap(ctx, gw, 0)
+		}
+	}
+	if err != nil {
+		s.log.Warnf("Failed to remove the port mapping %v (%s): %v", external, protocol, err)
+		return
+	}
+	s.log.Infof("Removed the port mapping %v (%s)", external, protocol)
+}
+
+// mapPort asks the gateway for a mapping of our port with NAT-PMP, then with UPnP, returning the
+// external address, the protocol used and the lifetime granted.
+func (m *PortMapper) mapPort(ctx context.Context, lifetime time.Duration) (*net.UDPAddr, string, time.Duration, error) {
+	gw, err := m.gateway()
+	if err == nil {
+		var external *net.UDPAddr
+		external, lifetime, err = m.natPMPMap(ctx, gw, lifetime)
+		if err == nil {
+			return external, "NAT-PMP", lifetime, nil
+		}
+	}
+	pmpErr := fmt.Errorf("NAT-PMP: %w", err)
+	if m.upnp == nil {
+		if m.upnp, err = discoverUPnP(ctx, m.s.log); err != nil {
+			return nil, "", 0, errors.Join(pmpErr, fmt.Errorf("UPnP: %w", err))
+		}
+	}
+	external, lifetime, err := m.upnp.addMapping(ctx, m.s.ourSendAddr.Port, lifetime)
+	if err != nil {
+		m.upnp = nil // discovered again next time, the gateway may have changed.
+		return nil, "", 0, errors.Join(pmpErr, fmt.Errorf("UPnP: %w", err))
+	}
+	return external, "UPnP", lifetime, nil
+}
+
+// gateway returns the NAT-PMP address of the gateway: Config.Gateway, or the default route's
+// gateway (guessed as the .1 of our address when that's unknown).
+func (m *PortMapper) gateway() (*net.UDPAddr, error) {
+	s := m.s
+	if s.Gateway != "" {
+		hostPort := s.Gateway
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			hostPort = net.JoinHostPort(hostPort, strconv.Itoa(NATPMPPort))
+		}
+		return net.ResolveUDPAddr("udp4", hostPort)
+	}
+	ip, err := defaultGateway()
+	if err != nil {
+		ours := s.Listener.localIP().To4()
+		if ours == nil || ours.IsLoopback() {
+			return nil, fmt.Errorf("no gateway: %w", err)
+		}
+		ip = net.IPv4(ours[0], ours[1], ours[2], 1)
+	}
+	return &net.UDPAddr{IP: ip, Port: NATPMPPort}, nil
+}
+
+// natPMPMap asks the NAT-PMP gateway for a mapping of our UDP port for lifetime (0 removes it) and
+// for its external address, returning the mapped address and the lifetime granted.
+func (m *PortMapper) natPMPMap(ctx context.Context, gw *net.UDPAddr, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	s := m.s
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.sockets.Add(1)
+	defer func() {
+		if conn.Close() == nil {
+			s.sockets.Add(-1)
+		}
+	}()
+	port := s.ourSendAddr.Port
+	req := make([]byte, 12)
+	req[1] = 1                                                      // map UDP
+	binary.BigEndian.PutUint16(req[4:], uint16(port))               //nolint:gosec // a port.
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime.Seconds())) //nolint:gosec // at most PortMappingLifetime.
+	if lifetime > 0 {
+		binary.BigEndian.PutUint16(req[6:], uint16(port)) //nolint:gosec // a port, suggested external one.
+	}
+	resp, err := natPMPRequest(ctx, conn, gw, req, 16)
+	if err != nil || lifetime == 0 {
+		return nil, 0, err
+	}
+	mapped := int(binary.BigEndian.Uint16(resp[10:]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+	resp, err = natPMPRequest(ctx, conn, gw, []byte{0, 0}, 12)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &net.UDPAddr{IP: net.IP(resp[8:12]), Port: mapped}, granted, nil
+}
+
+// natPMPRequest sends the NAT-PMP request to the gateway, retrying with doubling timeouts, and
+// returns its successful answer (at least size bytes, opcode of the request + 128).
+func natPMPRequest(ctx context.Context, conn *net.UDPConn, gw *net.UDPAddr, req []byte, size int) ([]byte, error) {
+	buf := make([]byte, 64)
+	timeout := natPMPTimeout
+	for range natPMPTries {
+		if _, err := conn.WriteToUDP(req, gw); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break // timeout, try again.
+			}
+			if !from.IP.Equal(gw.IP) || n < size || buf[0] != 0 || buf[1] != req[1]+128 {
+				continue
+			}
+			if result := binary.BigEndian.Uint16(buf[2:]); result != 0 {
+				return nil, fmt.Errorf("NAT-PMP gateway %v refused opcode %d: result code %d", gw, req[1], result)
+			}
+			return buf[:n], nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("%w from NAT-PMP gateway %v", ErrNoReply, gw)
+}
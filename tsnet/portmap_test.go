@@ -0,0 +1,87 @@
+package tsnet_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// fakeNATPMP answers the NAT-PMP requests as a gateway with external address 203.0.113.7 mapping
+// the requested ports to 40000, sending the lifetimes requested on lifetimes.
+func fakeNATPMP(t *testing.T, lifetimes chan<- uint32) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var resp []byte
+			switch {
+			case n == 2 && buf[1] == 0:
+				resp = make([]byte, 12)
+				copy(resp[8:], net.IPv4(203, 0, 113, 7).To4())
+			case n == 12 && buf[1] == 1:
+				resp = make([]byte, 16)
+				copy(resp[8:10], buf[4:6])                   // internal port
+				binary.BigEndian.PutUint16(resp[10:], 40000) // mapped port
+				copy(resp[12:], buf[8:12])                   // lifetime
+				lifetimes <- binary.BigEndian.Uint32(buf[8:])
+			default:
+				continue
+			}
+			resp[1] = buf[1] + 128
+			_, _ = conn.WriteToUDP(resp, from)
+		}
+	}()
+	return conn
+}
+
+// TestPortMapping maps the unicast port with a fake NAT-PMP gateway and checks the mapping is
+// removed on Stop.
+func TestPortMapping(t *testing.T) {
+	lifetimes := make(chan uint32, 10)
+	gw := fakeNATPMP(t, lifetimes)
+	defer gw.Close()
+	srv := newUnicastServer(t, "portmap")
+	srv.PortMapping = true
+	srv.Gateway = gw.LocalAddr().String()
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.PortMap.External() == nil {
+		if time.Now().After(deadline) {
+			srv.Stop()
+			t.Fatal("No port mapping")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := srv.PortMap.External().String(); got != "203.0.113.7:40000" {
+		t.Errorf("Unexpected mapping %s", got)
+	}
+	if got := <-lifetimes; got != uint32(tsnet.PortMappingLifetime.Seconds()) {
+		t.Errorf("Unexpected lifetime requested %d", got)
+	}
+	srv.Stop()
+	if srv.PortMap.External() != nil {
+		t.Errorf("Mapping %v still there after Stop", srv.PortMap.External())
+	}
+	select {
+	case got := <-lifetimes:
+		if got != 0 {
+			t.Errorf("Expected the mapping removal (lifetime 0), got %d", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Mapping not removed on Stop")
+	}
+}
@@ -0,0 +1,90 @@
+package tsnet
+
+import (
+	"net"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+// Name privacy (Config.PrivateName): our Name is replaced, for the whole run, by a salted hash of
+// it (tcrypto.HideName) which is all the discovery messages, mDNS, the rendezvous and the handshakes
+// carry. Once connected, the requester sends its name (or an empty one when it isn't private, only
+// asking for the peer's) sealed with the session in a reveal, which private responders answer with
+// theirs; the name is only recorded (PeerData.RealName) when it matches the hidden one. Either side
+// missing the other's name asks again with its keepalives.
+const (
+	RevealMessageFormat = "reveal1 %q %s"   // target_name, our name (empty when not private) sealed with the session
+	RevealReplyFormat   = "revealok1 %q %s" // target_name (the asker), our name sealed with the session
+)
+
+// RealName returns our name: Name unless Config.PrivateName replaced it with its hidden form.
+func (s *Server) RealName() string {
+	if s.realName != "" {
+		return s.realName
+	}
+	return s.Name
+}
+
+// wantsReveal returns true when the peer's name is hidden and it didn't reveal it yet.
+func wantsReveal(peer Peer, data PeerData) bool {
+	return data.RealName == "" && tcrypto.IsHiddenName(peer.Name)
+}
+
+// reveal sends our name to the connected peer (or answers its reveal with Reply) when ours is
+// private, or asks for its name when it's hidden and not revealed yet.
+func (c *ConnectionManager) reveal(peer Peer, data PeerData, to *net.UDPAddr, reply bool) {
+	s := c.s
+	if !s.PrivateName && (reply || !wantsReveal(peer, data)) {
+		return
+	}
+	session := c.session(peer)
+	if session == nil {
+		return
+	}
+	name := ""
+	if s.PrivateName {
+		name = s.realName
+	}
+	msg := s.encode(&RevealMessage{Target: peer.Name, Name: session.Seal([]byte(name), []byte(peer.Name)), Reply: reply})
+	if _, err := s.transport.WriteToUDP(msg, to); err != nil {
+		s.log.LogVf("Failed to send our name to %q: %v", peer.Name, err)
+	}
+}
+
+// handleReveal records the name a connected peer revealed, when it matches its hidden one, and
+// answers with ours when it's not a reply.
+func (c *ConnectionManager) handleReveal(from *net.UDPAddr, targetName, sealed string, reply bool) {
+	s := c.s
+	src := Source{IP: from.IP.String(), Port: from.Port}
+	peer, exists := s.Sources.Get(src)
+	if !exists || targetName != s.Name {
+		s.log.LogVf("Ignoring reveal from %v for %q", from, targetName)
+		return
+	}
+	data, ok := s.Peers.Get(peer)
+	session := c.session(peer)
+	if !ok || data.Status != Connected || session == nil {
+		s.log.LogVf("Ignoring reveal from %q, not connected", peer.Name)
+		return
+	}
+	name, err := session.Open(sealed, []byte(s.Name))
+	if err != nil {
+		s.log.Errf("Invalid reveal from %v (%q): %v", src, peer.Name, err)
+		s.recordUnproven(src.IP, peer, "invalid reveal message")
+		return
+	}
+	switch {
+	case len(name) == 0 || !tcrypto.IsHiddenName(peer.Name) || data.RealName == string(name):
+		// only asking for ours, or nothing new.
+	case !tcrypto.MatchHiddenName(peer.Name, string(name)):
+		s.log.Warnf("Name %q revealed by %q doesn't match its hidden name", name, peer.Name)
+		s.RecordFailure(src.IP, peer, "revealed name doesn't match")
+	default:
+		s.log.Infof("Peer %q revealed its name %q", peer.Name, name)
+		data.RealName = string(name)
+		s.change(s.setPeer(peer, data))
+	}
+	if !reply {
+		c.reveal(peer, data, from, true)
+	}
+}
@@ -0,0 +1,71 @@
+package tsnet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// TestPrivateName connects 2 servers with PrivateName, then one without to one of them: the
+// private names are only advertised hidden and revealed to the connected peers.
+func TestPrivateName(t *testing.T) {
+	a := newUnicastServer(t, "privateA")
+	b := newUnicastServer(t, "privateB")
+	c := newUnicastServer(t, "publicC")
+	a.PrivateName, b.PrivateName = true, true
+	b.Wire = tsnet.WireBinary
+	for _, srv := range []*tsnet.Server{a, b, c} {
+		if err := srv.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	if !tcrypto.MatchHiddenName(a.Name, "privateA") || a.RealName() != "privateA" {
+		t.Errorf("Private name %q (%q) isn't privateA hidden", a.Name, a.RealName())
+	}
+	if c.Name != "publicC" || c.RealName() != "publicC" {
+		t.Errorf("Public name changed to %q (%q)", c.Name, c.RealName())
+	}
+	peerA, portA := asPeer(a)
+	peerB, portB := asPeer(b)
+	peerC, portC := asPeer(c)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	b.AddPeer(peerC, portC)
+	c.AddPeer(peerB, portB)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, p := range []struct {
+		srv  *tsnet.Server
+		peer tsnet.Peer
+	}{{a, peerB}, {c, peerB}} {
+		if err := p.srv.ConnectToPeer(p.peer); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if err := p.srv.Connections.WaitConnected(ctx, p.peer); err != nil {
+			t.Fatalf("WaitConnected failed: %v", err)
+		}
+	}
+	for _, r := range []struct {
+		srv  *tsnet.Server
+		peer tsnet.Peer
+		want string
+	}{{a, peerB, "privateB"}, {b, peerA, "privateA"}, {c, peerB, "privateB"}} {
+		for {
+			pd, _ := r.srv.Peers.Get(r.peer)
+			if pd.RealName == r.want {
+				break
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("%s: %s never revealed %q (%q)", r.srv.RealName(), r.peer.Name, r.want, pd.RealName)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if pd, _ := b.Peers.Get(peerC); pd.RealName != "" {
+		t.Errorf("Public peer with a revealed name %q", pd.RealName)
+	}
+}
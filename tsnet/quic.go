@@ -0,0 +1,199 @@
+package tsnet
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// AcceptQUICFormat is AcceptMessageFormat from a peer with a QUICListener: the port of its
+	// QUIC connections follows (parsed first as Sscanf ignores the trailing input).
+	AcceptQUICFormat = "accept1 %q %s %s quic %d" // target_name, key exchange reply, signature, QUIC port
+	// QUICProtocol is the ALPN protocol of the QUIC connections.
+	QUICProtocol = "tsync1"
+	// QUICIdleTimeout closes the QUIC connections which stopped answering (keep alives are sent
+	// at half of it).
+	QUICIdleTimeout = 30 * time.Second
+)
+
+// QUICListener is the QUIC side of QUICTransport: it accepts the QUIC connections of the peers
+// connected to us, on its own UDP port, and holds the ones we dialed. Each connection carries one
+// stream with the same hello and sealed frames as TCPTransport's (QUIC's TLS isn't authenticated,
+// its self-signed certificate is ephemeral: the session is what identifies the peer).
+type QUICListener struct {
+	dataStreams
+	tr     *quic.Transport
+	ln     *quic.Listener
+	cancel context.CancelFunc
+	tls    *tls.Config
+}
+
+// quicStream is the net.Conn of a QUIC connection's stream, closing it closes the connection.
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (qs quicStream) Close() error {
+	return qs.conn.CloseWithError(0, "closed")
+}
+
+func (qs quicStream) LocalAddr() net.Addr {
+	return qs.conn.LocalAddr()
+}
+
+func (qs quicStream) RemoteAddr() net.Addr {
+	return qs.conn.RemoteAddr()
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: TCPTimeout,
+		MaxIdleTimeout:       QUICIdleTimeout,
+		KeepAlivePeriod:      QUICIdleTimeout / 2,
+	}
+}
+
+// quicTLS returns the TLS configuration of both sides with a new self-signed certificate.
+func quicTLS() (*tls.Config, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tsync"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * 365 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		NextProtos:         []string{QUICProtocol},
+		InsecureSkipVerify: true, //nolint:gosec // the hello sealed with the session authenticates the stream.
+		MinVersion:         tls.VersionTLS13,
+	}, nil
+}
+
+func (l *QUICListener) Start(ctx context.Context) error {
+	if l.Running() {
+		return nil
+	}
+	s := l.s
+	if !s.Listener.Running() {
+		return fmt.Errorf("QUIC listener needs the listener: %w", ErrNotRunning)
+	}
+	var err error
+	if l.tls, err = quicTLS(); err != nil {
+		return err
+	}
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: s.ourSendAddr.IP})
+	if err != nil {
+		return err
+	}
+	s.sockets.Add(1)
+	l.tr = &quic.Transport{Conn: udpConn}
+	if l.ln, err = l.tr.Listen(l.tls, quicConfig()); err != nil {
+		_ = l.tr.Close()
+		if udpConn.Close() == nil {
+			s.sockets.Add(-1)
+		}
+		return err
+	}
+	s.log.Infof("QUIC connections on %s", l.ln.Addr())
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.wg.Add(1)
+	s.goroutines.Add(1)
+	go l.runAccept(ctx)
+	l.running.Store(true)
+	return nil
+}
+
+func (l *QUICListener) Stop() {
+	if !l.running.CompareAndSwap(true, false) {
+		return
+	}
+	l.cancel()
+	_ = l.ln.Close()
+	l.closeAll()
+	l.wg.Wait()
+	_ = l.tr.Close()
+	if l.tr.Conn.Close() == nil {
+		l.s.sockets.Add(-1)
+	}
+}
+
+// Port returns the UDP port of the QUIC connections, 0 when not running.
+func (l *QUICListener) Port() int {
+	if !l.Running() {
+		return 0
+	}
+	return l.ln.Addr().(*net.UDPAddr).Port
+}
+
+func (l *QUICListener) runAccept(ctx context.Context) {
+	s := l.s
+	defer l.wg.Done()
+	defer s.goroutines.Add(-1)
+	for {
+		conn, err := l.ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				s.log.Infof("Exiting QUIC listener after %v", ctx.Err())
+				return
+			}
+			s.log.Errf("Error accepting QUIC connection: %v", err)
+			return // the listener is closed.
+		}
+		l.wg.Add(1)
+		s.goroutines.Add(1)
+		go func() {
+			defer l.wg.Done()
+			defer s.goroutines.Add(-1)
+			sctx, cancel := context.WithTimeout(ctx, TCPTimeout)
+			stream, err := conn.AcceptStream(sctx)
+			cancel()
+			if err != nil {
+				s.log.Warnf("No stream from QUIC connection %v: %v", conn.RemoteAddr(), err)
+				_ = conn.CloseWithError(0, "no stream")
+				return
+			}
+			s.sockets.Add(1) // the connection counts as a socket until closed, like TCP's.
+			l.accept(ctx, quicStream{Stream: stream, conn: conn}, conn.RemoteAddr().(*net.UDPAddr).IP.String())
+		}()
+	}
+}
+
+// dial opens the QUIC connection and its stream to the peer's QUICListener at addr.
+func (l *QUICListener) dial(addr *net.UDPAddr) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), TCPTimeout)
+	defer cancel()
+	conn, err := l.tr.Dial(ctx, addr, l.tls, quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		_ = conn.CloseWithError(0, "no stream")
+		return nil, err
+	}
+	return quicStream{Stream: stream, conn: conn}, nil
+}
+
+// HasQUIC returns true when the data with the peer goes through a QUIC stream (see QUICTransport).
+func (s *Server) HasQUIC(peer Peer) bool {
+	return s.QUICListener.conn(peer) != nil
+}
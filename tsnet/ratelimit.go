@@ -0,0 +1,97 @@
+package tsnet
+
+import (
+	"bytes"
+	"maps"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimit is the number of messages per second accepted from a source IP (see
+// Config.RateLimit), bursts of up to twice as many are allowed.
+const DefaultRateLimit = 100
+
+// Messages not rate limited as they come at the transfers' rate: the data of known peers (whose
+// signature or session failures get them banned), the datagrams to relay from the peers registered
+// with us and those relayed by our rendezvous (whose payload is limited by its source instead, see
+// handleRelayed).
+var dataPrefixes = [][]byte{
+	[]byte("data1 "), []byte("sdata1 "),
+	{WireMagic, WireVersion, byte(KindData)}, {WireMagic, WireVersion, byte(KindSealedData)},
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time // of the last refill.
+	limited bool      // messages were dropped since it was last full.
+}
+
+// rateLimiter is a token bucket per source IP.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// allow takes a token from the bucket of ip, refilled at rate tokens per second up to 2*rate,
+// returning false if it was empty and whether it's the first time since the bucket was full.
+func (r *rateLimiter) allow(ip string, rate int, now time.Time) (bool, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	burst := float64(2 * rate)
+	if r.buckets == nil {
+		r.buckets = make(map[string]*bucket)
+	}
+	if len(r.buckets) >= sweepSources {
+		maps.DeleteFunc(r.buckets, func(_ string, b *bucket) bool {
+			return b.tokens+now.Sub(b.last).Seconds()*float64(rate) >= burst
+		})
+	}
+	b, ok := r.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		r.buckets[ip] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*float64(rate))
+	b.last = now
+	if b.tokens >= burst {
+		b.limited = false
+	}
+	if b.tokens < 1 {
+		first := !b.limited
+		b.limited = true
+		return false, first
+	}
+	b.tokens--
+	return true, false
+}
+
+// rateLimited returns true when the message b from addr is over Config.RateLimit and must be
+// dropped (before any parsing or logging), counting it in Stats.RateLimited.
+func (s *Server) rateLimited(b []byte, addr *net.UDPAddr) bool {
+	rate := s.RateLimit
+	if rate == 0 {
+		rate = DefaultRateLimit
+	}
+	if rate < 0 {
+		return false
+	}
+	if bytes.HasPrefix(b, []byte(relayPrefix)) && s.RelayServer && s.NAT.isRegistered(addr) ||
+		bytes.HasPrefix(b, []byte(relayedPrefix)) && s.NAT.isRendezvous(addr) {
+		return false
+	}
+	for _, prefix := range dataPrefixes {
+		if bytes.HasPrefix(b, prefix) && s.Sources.Has(Source{IP: addr.IP.String(), Port: addr.Port}) {
+			return false
+		}
+	}
+	ok, first := s.limiter.allow(addr.IP.String(), rate, time.Now())
+	if ok {
+		return false
+	}
+	if first {
+		s.log.Warnf("Rate limiting %v: more than %d messages per second", addr.IP, rate)
+	}
+	s.countAddr(addr, func(st *Stats) { st.RateLimited++ })
+	return true
+}
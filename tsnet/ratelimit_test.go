@@ -0,0 +1,77 @@
+package tsnet_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// TestRateLimit floods a server with control and relay messages from one source: those above the
+// burst are dropped and counted, the data messages of known peers aren't limited.
+func TestRateLimit(t *testing.T) {
+	a := newUnicastServer(t, "rateA")
+	b := newUnicastServer(t, "rateB")
+	b.RateLimit = 10
+	received := make(chan struct{}, 100)
+	b.OnData = func(_ tsnet.Peer, _ []byte) { received <- struct{}{} }
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	raw, err := net.ListenUDP("udp4", &net.UDPAddr{IP: b.OurAddress().IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	send := func(msg string, count int) tsnet.Stats {
+		t.Helper()
+		start := b.TotalStats().PacketsReceived
+		for range count {
+			if _, err := raw.WriteToUDP([]byte(msg), b.OurAddress()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for b.TotalStats().PacketsReceived < start+int64(count) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Only %d of %d datagrams received", b.TotalStats().PacketsReceived-start, count)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return b.TotalStats()
+	}
+	st := send(fmt.Sprintf(tsnet.KeepaliveMessageFormat, "flooder"), 200)
+	// The burst is 2*RateLimit, some tokens may be refilled while sending.
+	if st.RateLimited < 150 || st.RateLimited > 200-2*10 {
+		t.Errorf("Unexpected number of rate limited datagrams: %d of 200", st.RateLimited)
+	}
+	limited := st.RateLimited
+	// Nor are relay messages from a source which isn't registered with b.
+	st = send("relay1 "+a.OurAddress().String()+" "+fmt.Sprintf(tsnet.KeepaliveMessageFormat, "flooder"), 200)
+	if st.RateLimited-limited < 150 {
+		t.Errorf("Unregistered relay messages should be rate limited, got %d of 200", st.RateLimited-limited)
+	}
+	limited = st.RateLimited
+	peerA, portA := asPeer(a)
+	peerB, portB := asPeer(b)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	for i := range 100 {
+		if err := a.SendData(peerB, []byte{byte(i)}); err != nil {
+			t.Fatalf("SendData failed: %v", err)
+		}
+	}
+	for i := range 100 {
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Only %d of 100 data messages received (%d rate limited)", i, b.TotalStats().RateLimited-limited)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package tsnet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDiscoveryMaxAge is how old (or, with clock skew, how far in the future) a discovery
+	// message can be before it's rejected as replayed (see Config.DiscoveryMaxAge).
+	DefaultDiscoveryMaxAge = 30 * time.Second
+	// DiscoveryNonceSize is the size of the random nonce of each discovery message.
+	DiscoveryNonceSize = 12
+)
+
+// ErrReplayed is returned by MCastMessageDecode for discovery messages too old (or too far in the
+// future) or whose nonce was already seen: captured and sent again.
+var ErrReplayed = errors.New("replayed discovery message")
+
+// discoveryNonce returns a new random (hex encoded) nonce for a discovery message.
+func discoveryNonce() string {
+	nonce := make([]byte, DiscoveryNonceSize)
+	_, _ = rand.Read(nonce) // never returns an error.
+	return hex.EncodeToString(nonce)
+}
+
+// replayGuard remembers the nonces of the discovery messages received within the max age. The
+// older ones are rejected by their timestamp, so 2 generations of nonces, swapped every max age,
+// are enough.
+type replayGuard struct {
+	mu       sync.Mutex
+	seen     map[string]struct{}
+	previous map[string]struct{}
+	rotated  time.Time
+}
+
+func (s *Server) discoveryMaxAge() time.Duration {
+	if s.DiscoveryMaxAge > 0 {
+		return s.DiscoveryMaxAge
+	}
+	return DefaultDiscoveryMaxAge
+}
+
+// checkReplay returns an ErrReplayed error if the message sent at unixMilli is too old or its
+// nonce was already seen, otherwise records the nonce.
+func (s *Server) checkReplay(unixMilli int64, nonce string) error {
+	maxAge := s.discoveryMaxAge()
+	now := time.Now()
+	if age := now.Sub(time.UnixMilli(unixMilli)); age > maxAge || age < -maxAge {
+		return fmt.Errorf("%w: sent %v ago", ErrReplayed, age.Round(time.Millisecond))
+	}
+	g := &s.replays
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.rotated) > maxAge {
+		g.previous, g.seen, g.rotated = g.seen, make(map[string]struct{}), now
+	}
+	if _, dup := g.seen[nonce]; dup {
+		return fmt.Errorf("%w: nonce %s already seen", ErrReplayed, nonce)
+	}
+	if _, dup := g.previous[nonce]; dup {
+		return fmt.Errorf("%w: nonce %s already seen", ErrReplayed, nonce)
+	}
+	g.seen[nonce] = struct{}{}
+	return nil
+}
@@ -0,0 +1,88 @@
+package tsnet_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+func TestDiscoveryReplay(t *testing.T) {
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &tsnet.Server{}
+	srv.DiscoveryMaxAge = time.Minute
+	msg := func(sent time.Time, nonce string) []byte {
+		return tsnet.DiscoveryMessage(id, "host", 7, sent, nonce)
+	}
+	now := time.Now()
+	name, key, epoch, err := srv.MCastMessageDecode(msg(now, "n1"))
+	if err != nil || name != "host" || key != id.PublicKeyToString() || epoch != 7 {
+		t.Fatalf("Decode = %q %q %d %v", name, key, epoch, err)
+	}
+	if _, _, _, err = srv.MCastMessageDecode(msg(now, "n2")); err != nil {
+		t.Errorf("Decode of a new nonce failed: %v", err)
+	}
+	tests := []struct {
+		name  string
+		sent  time.Time
+		nonce string
+	}{
+		{"same nonce", now, "n1"},
+		{"too old", now.Add(-2 * time.Minute), "n3"},
+		{"in the future", now.Add(2 * time.Minute), "n4"},
+	}
+	for _, tt := range tests {
+		if _, _, _, err = srv.MCastMessageDecode(msg(tt.sent, tt.nonce)); !errors.Is(err, tsnet.ErrReplayed) {
+			t.Errorf("%s: got %v, want ErrReplayed", tt.name, err)
+		}
+	}
+	if _, _, _, err = srv.MCastMessageDecode(fmt.Appendf(nil, "tsync1 %q %s e %d", "host", id.PublicKeyToString(), 7)); err == nil {
+		t.Errorf("Decode of a message without timestamp, nonce and signature succeeded")
+	}
+}
+
+func TestDiscoverySignature(t *testing.T) {
+	alice, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &tsnet.Server{}
+	// Mallory announcing itself with Alice's public key.
+	msg := string(tsnet.DiscoveryMessage(mallory, "alice", 1, time.Now(), "n1"))
+	spoofed := strings.Replace(msg, mallory.PublicKeyToString(), alice.PublicKeyToString(), 1)
+	var invalid *tcrypto.SignatureInvalidError
+	if _, _, _, err = srv.MCastMessageDecode([]byte(spoofed)); !errors.As(err, &invalid) {
+		t.Errorf("Spoofed discovery message: got %v, want a SignatureInvalidError", err)
+	}
+	// Alice's message with another name or epoch.
+	msg = string(tsnet.DiscoveryMessage(alice, "alice", 1, time.Now(), "n2"))
+	for _, forged := range []string{strings.Replace(msg, `"alice"`, `"bob"`, 1), strings.Replace(msg, " e 1 ", " e 2 ", 1)} {
+		if _, _, _, err = srv.MCastMessageDecode([]byte(forged)); !errors.As(err, &invalid) {
+			t.Errorf("Forged discovery message %q: got %v, want a SignatureInvalidError", forged, err)
+		}
+	}
+	if _, _, _, err = srv.MCastMessageDecode([]byte(msg)); err != nil {
+		t.Errorf("Valid discovery message rejected: %v", err)
+	}
+	// A message signed without commitment, and one with its commitment stripped.
+	legacy := fmt.Sprintf("tsync1 %q %s e %d t %d n %s", "alice", alice.PublicKeyToString(), 1, time.Now().UnixMilli(), "n3")
+	if _, _, _, err = srv.MCastMessageDecode([]byte(legacy + " s " + alice.SignDiscovery(legacy))); err == nil {
+		t.Errorf("Discovery message without commitment accepted")
+	}
+	msg = string(tsnet.DiscoveryMessage(alice, "alice", 1, time.Now(), "n4"))
+	stripped := msg[:strings.Index(msg, " c ")] + msg[strings.Index(msg, " s "):]
+	if _, _, _, err = srv.MCastMessageDecode([]byte(stripped)); err == nil {
+		t.Errorf("Discovery message with its commitment stripped accepted")
+	}
+}
@@ -0,0 +1,115 @@
+package tsnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+const (
+	RestartMessageFormat = "restart1 %q %s" // target_name, signed expected downtime in milliseconds
+	// MaxRestartDowntime caps the downtime announced by AnnounceRestart (and accepted from peers).
+	MaxRestartDowntime = 5 * time.Minute
+)
+
+// ErrPeerRestarting is returned for transfers interrupted by the peer's restart (see AnnounceRestart)
+// which can't be resumed.
+var ErrPeerRestarting = errors.New("peer is restarting")
+
+// AnnounceRestart tells all the known peers that we are about to restart (e.g. for an upgrade) and
+// expect to be back, with the same identity, within downtime (capped to MaxRestartDowntime).
+// Until then they keep us in their Peers with the Restarting status, pause their transfers to us
+// and resume them once we announce ourselves again, instead of failing them.
+func (s *Server) AnnounceRestart(downtime time.Duration) error {
+	if !s.Listener.Running() {
+		return fmt.Errorf("announcing restart: %w", ErrNotRunning)
+	}
+	ms := strconv.FormatInt(min(downtime, MaxRestartDowntime).Milliseconds(), 10)
+	signed := s.Identity.SignMessage([]byte(ms))
+	var errs []error
+	for _, kv := range s.Peers.KeysValuesSnapshot() {
+		peer := kv.Key
+		addr := s.peerAddr(peer, kv.Value)
+		message := s.encode(&RestartMessage{Target: peer.Name, Signed: signed})
+		if _, err := s.transport.WriteToUDP(message, addr); err != nil {
+			errs = append(errs, fmt.Errorf("restart announcement to %q: %w", peer.Name, err))
+		}
+	}
+	s.log.Infof("Announced restart within %s ms to %d peers", ms, s.Peers.Len())
+	return errors.Join(errs...)
+}
+
+// handleRestart processes a peer's restart announcement.
+func (s *Server) handleRestart(from *net.UDPAddr, targetName, signedDowntime string) {
+	src := Source{IP: from.IP.String(), Port: from.Port}
+	peer, exists := s.Sources.Get(src)
+	if !exists {
+		s.log.Errf("Restart announcement from unknown source %v (not in source to peer map)", src)
+		return
+	}
+	if targetName != s.Name {
+		s.log.Warnf("Restart announcement target name %q doesn't match our name %q", targetName, s.Name)
+		return
+	}
+	pub, err := tcrypto.IdentityPublicKeyString(peer.PublicKey)
+	if err != nil {
+		s.log.Errf("Failed to decode peer %q public key %q: %v", peer.Name, peer.PublicKey, err)
+		return
+	}
+	data, err := tcrypto.VerifySignedMessage(signedDowntime, pub)
+	if err != nil {
+		s.log.Errf("Invalid restart announcement from %v (%q): %v", src, peer.Name, err)
+		return
+	}
+	ms, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil || ms < 0 {
+		s.log.Errf("Invalid restart downtime %q from %q", data, peer.Name)
+		return
+	}
+	downtime := min(time.Duration(ms)*time.Millisecond, MaxRestartDowntime)
+	pData, found := s.Peers.Get(peer)
+	if !found {
+		return
+	}
+	pData.Status = Restarting
+	pData.RestartUntil = time.Now().Add(downtime)
+	s.log.Infof("Peer %q is restarting, expected back within %v", peer.Name, downtime)
+	s.change(s.setPeer(peer, pData))
+	s.Transfers.pause(peer)
+}
+
+// IsRestarting returns true while the peer is restarting (see AnnounceRestart).
+func (s *Server) IsRestarting(peer Peer) bool {
+	data, ok := s.Peers.Get(peer)
+	return ok && !data.RestartUntil.IsZero()
+}
+
+// WaitRestarted waits until the peer is back if it's restarting (see AnnounceRestart).
+// Returns an error if it didn't come back in time (and thus expired) or ctx is done.
+func (s *Server) WaitRestarted(ctx context.Context, peer Peer) error {
+	if !s.IsRestarting(peer) {
+		return nil
+	}
+	s.log.Infof("Waiting for restarting peer %q to be back", peer.Name)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		data, ok := s.Peers.Get(peer)
+		if !ok {
+			return fmt.Errorf("%w: %q didn't come back", ErrPeerRestarting, peer.Name)
+		}
+		if data.RestartUntil.IsZero() {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package tsnet_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// pacedReader is a slow io.ReadSeeker, so the stream is still in progress when the peer restarts.
+type pacedReader struct {
+	*bytes.Reader
+}
+
+func (p pacedReader) Read(b []byte) (int, error) {
+	time.Sleep(200 * time.Microsecond)
+	return p.Reader.Read(b)
+}
+
+// TestAnnounceRestart checks that transfers to a restarting peer are paused and resumed once it's back.
+func TestAnnounceRestart(t *testing.T) {
+	a := newUnicastServer(t, "restartA")
+	b := newUnicastServer(t, "restartB")
+	var mu sync.Mutex
+	streams := make(map[uint32]*lockedBuffer)
+	done := make(chan uint32, 10)
+	b.OnStream = func(_ tsnet.Peer, id uint32) io.Writer {
+		mu.Lock()
+		defer mu.Unlock()
+		streams[id] = &lockedBuffer{}
+		return streams[id]
+	}
+	b.OnStreamDone = func(_ tsnet.Peer, id uint32, _ int64, err error) {
+		if err == nil {
+			done <- id
+		}
+	}
+	ctx := context.Background()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerB, portB := asPeer(b)
+	peerA, portA := asPeer(a)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	data := make([]byte, 300_000)
+	for i := range data {
+		data[i] = byte(rand.UintN(256)) //nolint:gosec // test data.
+	}
+	type result struct {
+		n   int64
+		err error
+	}
+	sent := make(chan result, 1)
+	go func() {
+		n, err := a.Transfers.Send(ctx, peerB, pacedReader{bytes.NewReader(data)})
+		sent <- result{n, err}
+	}()
+	time.Sleep(20 * time.Millisecond) // let the stream start.
+	if err := b.AnnounceRestart(10 * time.Second); err != nil {
+		t.Fatalf("AnnounceRestart failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !a.IsRestarting(peerB) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Restart announcement not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d, _ := a.Peers.Get(peerB); d.Status != tsnet.Restarting {
+		t.Errorf("Restarting peer status %v", d.Status)
+	}
+	if err := b.Restart(ctx); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	select {
+	case r := <-sent:
+		t.Fatalf("Send to a restarting peer returned before it's back: %+v", r)
+	case <-time.After(300 * time.Millisecond):
+	}
+	peerB, portB = asPeer(b)
+	b.AddPeer(peerA, portA)
+	a.AddPeer(peerB, portB) // same peer (identity) back, with a new port.
+	if a.IsRestarting(peerB) {
+		t.Errorf("Peer still restarting once back")
+	}
+	select {
+	case r := <-sent:
+		if r.err != nil || r.n != int64(len(data)) {
+			t.Fatalf("Send after restart: %d %v", r.n, r.err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timeout waiting for the resumed Send")
+	}
+	select {
+	case id := <-done:
+		mu.Lock()
+		got := streams[id].Bytes()
+		mu.Unlock()
+		if !bytes.Equal(got, data) {
+			t.Errorf("Received %d bytes different from the %d sent", len(got), len(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for the stream")
+	}
+}
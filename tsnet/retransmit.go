@@ -0,0 +1,145 @@
+package tsnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultRetransmitTimeout is how long we wait for the peer's next handshake step before
+	// sending our last message again (see Config.RetransmitTimeout), doubling after each attempt.
+	DefaultRetransmitTimeout = 250 * time.Millisecond
+	// MaxRetransmits is how many times a handshake message is sent again before giving up:
+	// the peer is then Unreachable.
+	MaxRetransmits = 6
+)
+
+// ErrNoReply is returned by WaitConnected when the peer didn't answer our connection request,
+// even after MaxRetransmits retransmissions.
+var ErrNoReply = errors.New("no reply")
+
+// retransmit is our last handshake message to a peer, sent again until its next step (which
+// acknowledges it) arrives: the connect request until the challenge (or cookie), the challenge
+// response until the accept or reject. The peer answers the duplicates it already handled with its
+// same reply (see handledResponse), so a lost datagram only delays the connection.
+type retransmit struct {
+	to       *net.UDPAddr
+	message  []byte
+	attempts int
+	timer    *time.Timer // of the next retransmission.
+}
+
+// answer is our reply to a peer's challenge response (accept or reject), sent again if the
+// response is retransmitted as the requester didn't get it.
+type answer struct {
+	signature string // of the response.
+	reply     []byte
+}
+
+func (c *ConnectionManager) retransmitTimeout() time.Duration {
+	if c.s.RetransmitTimeout > 0 {
+		return c.s.RetransmitTimeout
+	}
+	return DefaultRetransmitTimeout
+}
+
+// expect records our handshake message to the peer, to be retransmitted until settle.
+func (c *ConnectionManager) expect(peer Peer, to *net.UDPAddr, message []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.retransmits == nil {
+		c.retransmits = make(map[Peer]*retransmit)
+	}
+	c.stopRetransmit(peer)
+	r := &retransmit{to: to, message: message}
+	r.timer = time.AfterFunc(c.retransmitTimeout(), func() { c.retransmitTo(peer, r) })
+	c.retransmits[peer] = r
+}
+
+// settle stops retransmitting to the peer, its reply arrived.
+func (c *ConnectionManager) settle(peer Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopRetransmit(peer)
+}
+
+// stopRetransmit forgets the peer's retransmission, c.mu must be held.
+func (c *ConnectionManager) stopRetransmit(peer Peer) {
+	if r := c.retransmits[peer]; r != nil {
+		r.timer.Stop()
+		delete(c.retransmits, peer)
+	}
+}
+
+// retransmitTo sends our message to the peer again, with exponential backoff, unless its reply
+// arrived (or we stopped) meanwhile. Gives up after MaxRetransmits: the peer is then Unreachable.
+func (c *ConnectionManager) retransmitTo(peer Peer, r *retransmit) {
+	s := c.s
+	c.mu.Lock()
+	if !c.running || c.retransmits[peer] != r {
+		c.mu.Unlock()
+		return
+	}
+	if r.attempts >= MaxRetransmits {
+		delete(c.retransmits, peer)
+		c.mu.Unlock()
+		c.unreachable(peer)
+		return
+	}
+	r.attempts++
+	attempt := r.attempts
+	r.timer.Reset(c.retransmitTimeout() << attempt)
+	c.mu.Unlock()
+	s.log.LogVf("Retransmitting %q to %v (attempt %d)", r.message, r.to, attempt)
+	if _, err := s.transport.WriteToUDP(r.message, r.to); err != nil {
+		s.log.Errf("Failed to retransmit to %v: %v", r.to, err)
+	}
+}
+
+func (c *ConnectionManager) unreachable(peer Peer) {
+	s := c.s
+	pData, found := s.Peers.Get(peer)
+	if !found || pData.Status != SentConn {
+		return
+	}
+	s.log.Warnf("No reply from %q to our connection request after %d retransmissions", peer.Name, MaxRetransmits)
+	pData.Status = Unreachable
+	c.dropSessions(peer)
+	s.change(s.setPeer(peer, pData))
+	c.resolve(peer, fmt.Errorf("%w from %q", ErrNoReply, peer.Name))
+}
+
+// pendingResponse returns our challenge response to the peer if it's for the same challenge
+// (nonce), which was then retransmitted, and we're still waiting for the peer's reply.
+func (c *ConnectionManager) pendingResponse(peer Peer, nonce string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ex, ok := c.exchanges[peer]
+	r := c.retransmits[peer]
+	if !ok || ex.nonce != nonce || r == nil {
+		return nil, false
+	}
+	return r.message, true
+}
+
+// handledResponse returns our reply to the peer's challenge response if we already answered
+// it (it's then retransmitted).
+func (c *ConnectionManager) handledResponse(peer Peer, signature string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.answers[peer]
+	return a.reply, ok && a.signature == signature
+}
+
+// answered records our reply to the peer's challenge response and sends it.
+func (c *ConnectionManager) answered(to *net.UDPAddr, peer Peer, signature string, reply []byte) {
+	c.mu.Lock()
+	if c.answers == nil {
+		c.answers = make(map[Peer]answer)
+	}
+	c.answers[peer] = answer{signature: signature, reply: reply}
+	c.mu.Unlock()
+	c.reply(to, reply)
+}
@@ -0,0 +1,100 @@
+package tsnet_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// dropFirst is a transport losing the first datagram sent starting with each of the prefixes.
+type dropFirst struct {
+	tsnet.Transport
+	mu       sync.Mutex
+	prefixes []string
+}
+
+func (d *dropFirst) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	d.mu.Lock()
+	for i, p := range d.prefixes {
+		if strings.HasPrefix(string(b), p) {
+			d.prefixes = append(d.prefixes[:i], d.prefixes[i+1:]...)
+			d.mu.Unlock()
+			return len(b), nil
+		}
+	}
+	d.mu.Unlock()
+	return d.Transport.WriteToUDP(b, addr)
+}
+
+// TestConnectRetransmit loses one of each handshake message: the connection is still established.
+func TestConnectRetransmit(t *testing.T) {
+	a := newUnicastServer(t, "retransmitA")
+	b := newUnicastServer(t, "retransmitB")
+	a.RetransmitTimeout, b.RetransmitTimeout = 20*time.Millisecond, 20*time.Millisecond
+	a.WrapTransport = func(t tsnet.Transport) tsnet.Transport {
+		return &dropFirst{Transport: t, prefixes: []string{"connect1", "response1"}}
+	}
+	b.WrapTransport = func(t tsnet.Transport) tsnet.Transport {
+		return &dropFirst{Transport: t, prefixes: []string{"challenge1", "accept1"}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerB, portB := asPeer(b)
+	peerA, portA := asPeer(a)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	if !a.Encrypted(peerB) || !b.Encrypted(peerA) {
+		t.Errorf("No session after the retransmitted handshake: %v %v", a.Encrypted(peerB), b.Encrypted(peerA))
+	}
+	if pd, _ := b.Peers.Get(peerA); pd.Status != tsnet.Connected {
+		t.Errorf("B: A status %v, want Connected", pd.Status)
+	}
+}
+
+// TestConnectUnreachable connects to a stopped server: the peer ends up Unreachable.
+func TestConnectUnreachable(t *testing.T) {
+	a := newUnicastServer(t, "unreachableA")
+	b := newUnicastServer(t, "unreachableB")
+	a.RetransmitTimeout = 5 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+	}
+	defer a.Stop()
+	peerB, portB := asPeer(b)
+	a.AddPeer(peerB, portB)
+	b.Stop()
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := a.Connections.WaitConnected(ctx, peerB); !errors.Is(err, tsnet.ErrNoReply) {
+		t.Fatalf("WaitConnected to a stopped peer: got %v, want ErrNoReply", err)
+	}
+	if pd, _ := a.Peers.Get(peerB); pd.Status != tsnet.Unreachable {
+		t.Errorf("Status %v, want Unreachable", pd.Status)
+	}
+	if err := a.Connections.WaitConnected(ctx, peerB); !errors.Is(err, tsnet.ErrNoReply) {
+		t.Errorf("WaitConnected once Unreachable: got %v, want ErrNoReply", err)
+	}
+}
@@ -0,0 +1,200 @@
+package tsnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+// SessionKex is the key exchange of the connection handshakes with the peers not advertising theirs
+// (CapKex); its offer is in the challenge response and its reply in the accept (see
+// handleChallenge and accept).
+const SessionKex = tcrypto.KexX25519
+
+// SealedDataFormat is DataMessageFormat for connected peers: the data encrypted with the
+// connection's tcrypto.Session instead of signed.
+const SealedDataFormat = "sdata1 %q %s" // target_name, sealed_data
+
+// keyExchange is our side of the key exchange of a connection request we sent.
+type keyExchange struct {
+	kex        *tcrypto.KexInitiator
+	nonce      string // of the peer's challenge, the accept's signature covers it.
+	caps       string // the peer's, from its challenge.
+	transcript string // of the capabilities (see CapsTranscript), the accept's signature covers it too.
+}
+
+// startKex returns the encoded offer of a new key exchange with the peer, answering its challenge
+// (with its capabilities and their transcript): our first one it supports (see negotiateKex).
+func (c *ConnectionManager) startKex(peer Peer, nonce, caps, transcript string) ([]byte, error) {
+	algo, err := negotiateKex(c.s.KeyExchanges, advertisedKex(caps))
+	if err != nil {
+		return nil, err
+	}
+	kex, err := tcrypto.NewKexInitiator(algo)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.exchanges == nil {
+		c.exchanges = make(map[Peer]keyExchange)
+	}
+	c.exchanges[peer] = keyExchange{kex: kex, nonce: nonce, caps: caps, transcript: transcript}
+	return kex.Offer(), nil
+}
+
+// finishKex checks the peer's signature of its key exchange reply (which accepted our connection
+// request) and of the capabilities, its key against the commitment it advertised and the QUIC port
+// of its accept against the capabilities, then sets up the session with it.
+func (c *ConnectionManager) finishKex(peer Peer, encodedReply, signature string, quicPort int) error {
+	c.mu.Lock()
+	ex, ok := c.exchanges[peer]
+	delete(c.exchanges, peer)
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no key exchange with %q", peer.Name)
+	}
+	reply, err := tcrypto.DecodeBytes(tcrypto.KexPrefix, encodedReply)
+	if err != nil {
+		return err
+	}
+	pub, err := tcrypto.IdentityPublicKeyString(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err = tcrypto.VerifyAccept(ex.nonce, c.s.Name, peer.Name, ex.transcript, ex.kex.Offer(), reply, signature, pub); err != nil {
+		return err
+	}
+	if err = c.s.checkCommitment(peer); err != nil {
+		return err
+	}
+	if err = checkQUICPort(ex.caps, quicPort); err != nil {
+		return err
+	}
+	c.recordCaps(peer, ex.caps)
+	key, err := ex.kex.Finish(reply)
+	if err != nil {
+		return err
+	}
+	session, err := tcrypto.NewSession(key, true)
+	if err != nil {
+		return err
+	}
+	c.setSession(peer, session, ex.kex.Algo)
+	return nil
+}
+
+// respondKex returns the encoded reply to the peer's key exchange offer and its signature (with the
+// capabilities transcript), setting up the session with it. The key exchange is the one the peer
+// picked from its capabilities and ours (see negotiateKex).
+func (c *ConnectionManager) respondKex(peer Peer, nonce, peerCaps, transcript string, offer []byte) (string, string, error) {
+	algo, err := negotiateKex(advertisedKex(peerCaps), c.s.KeyExchanges)
+	if err != nil {
+		return "", "", err
+	}
+	reply, key, err := tcrypto.KexRespond(algo, offer)
+	if err != nil {
+		return "", "", err
+	}
+	session, err := tcrypto.NewSession(key, false)
+	if err != nil {
+		return "", "", err
+	}
+	c.setSession(peer, session, algo)
+	signature := c.s.Identity.SignAccept(nonce, peer.Name, c.s.Name, transcript, offer, reply)
+	return tcrypto.EncodeBytes(tcrypto.KexPrefix, reply), signature, nil
+}
+
+func (c *ConnectionManager) setSession(peer Peer, session *tcrypto.Session, kex tcrypto.KexAlgo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions == nil {
+		c.sessions = make(map[Peer]*tcrypto.Session)
+		c.kexes = make(map[Peer]tcrypto.KexAlgo)
+	}
+	c.sessions[peer] = session
+	c.kexes[peer] = kex
+}
+
+// session returns the encrypted session with the peer, nil when not connected.
+func (c *ConnectionManager) session(peer Peer) *tcrypto.Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessions[peer]
+}
+
+// dropSessions forgets the sessions (and key exchanges, retransmissions, TCP and QUIC streams) with the
+// peers, failed or expired.
+func (c *ConnectionManager) dropSessions(peers ...Peer) {
+	c.mu.Lock()
+	for _, peer := range peers {
+		delete(c.sessions, peer)
+		delete(c.kexes, peer)
+		delete(c.exchanges, peer)
+		c.stopRetransmit(peer)
+		delete(c.answers, peer)
+	}
+	c.mu.Unlock()
+	c.s.TCPListener.drop(peers...)
+	c.s.QUICListener.drop(peers...)
+}
+
+// ErrNotEncrypted is returned by SendData and SendDataBatch, with Config.RequireEncryption, for
+// a peer without an encrypted session (not Connected).
+var ErrNotEncrypted = errors.New("no encrypted session")
+
+// Encrypted returns true when the data sent to and received from the peer goes through
+// the encrypted session set up by the connection handshake.
+func (s *Server) Encrypted(peer Peer) bool {
+	return s.Connections.session(peer) != nil
+}
+
+// Kex returns the key exchange of the session with the peer, tcrypto.NoKex without one.
+func (s *Server) Kex(peer Peer) tcrypto.KexAlgo {
+	c := s.Connections
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.kexes[peer]
+}
+
+// dataMessage returns the message carrying data to the peer: sealed with the connection's
+// session if there is one, signed with our identity otherwise.
+func (s *Server) dataMessage(peer Peer, data []byte) []byte {
+	if session := s.Connections.session(peer); session != nil {
+		return s.encode(&DataMessage{Target: peer.Name, Data: session.Seal(data, []byte(peer.Name)), Sealed: true})
+	}
+	return s.encode(&DataMessage{Target: peer.Name, Data: s.Identity.SignMessage(data)})
+}
+
+// handleSealedData decrypts the data messages of connected peers and passes the payload on
+// like handleDataMessage.
+func (s *Server) handleSealedData(from *net.UDPAddr, targetName, sealed string) {
+	src := Source{IP: from.IP.String(), Port: from.Port}
+	peer, exists := s.Sources.Get(src)
+	if !exists {
+		s.log.Errf("Sealed data message from unknown source %v (not in source to peer map)", src)
+		return
+	}
+	if s.Banned(src.IP, peer.PublicKey) {
+		s.log.LogVf("Ignoring sealed data message from banned %q", peer.Name)
+		return
+	}
+	if targetName != s.Name {
+		s.log.Warnf("Sealed data message target name %q doesn't match our name %q", targetName, s.Name)
+		return
+	}
+	session := s.Connections.session(peer)
+	if session == nil { // e.g. we restarted, it needs to connect again.
+		s.log.Warnf("Sealed data message from %q without a session, ignored", peer.Name)
+		return
+	}
+	data, err := session.Open(sealed, []byte(s.Name))
+	if err != nil {
+		s.log.Errf("Invalid sealed data message from %v (%q): %v", src, peer.Name, err)
+		s.recordUnproven(src.IP, peer, "invalid sealed data message")
+		return
+	}
+	s.deliver(peer, data)
+}
@@ -0,0 +1,69 @@
+package tsnet_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// TestRequireEncryption checks a server with RequireEncryption neither sends nor accepts data
+// before the connection sets up the session, and does after.
+func TestRequireEncryption(t *testing.T) {
+	a := newUnicastServer(t, "sealedA")
+	b := newUnicastServer(t, "plainB")
+	a.RequireEncryption = true
+	received := make(chan string, 1)
+	a.OnData = func(_ tsnet.Peer, data []byte) { received <- string(data) }
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerA, portA := asPeer(a)
+	peerB, portB := asPeer(b)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err := a.SendData(peerB, []byte("plain")); !errors.Is(err, tsnet.ErrNotEncrypted) {
+		t.Errorf("SendData without a session should fail with ErrNotEncrypted, got %v", err)
+	}
+	if err := a.SendDataBatch(peerB, [][]byte{[]byte("plain")}); !errors.Is(err, tsnet.ErrNotEncrypted) {
+		t.Errorf("SendDataBatch without a session should fail with ErrNotEncrypted, got %v", err)
+	}
+	if err := b.SendData(peerA, []byte("plain")); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	select {
+	case data := <-received:
+		t.Errorf("Unencrypted data %q should have been dropped", data)
+	case <-time.After(300 * time.Millisecond):
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.ConnectToPeer(peerA); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := b.Connections.WaitConnected(ctx, peerA); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	if err := b.SendData(peerA, []byte("sealed")); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	select {
+	case data := <-received:
+		if data != "sealed" {
+			t.Errorf("Received %q instead of sealed", data)
+		}
+	case <-ctx.Done():
+		t.Errorf("Sealed data not received")
+	}
+	for !a.Encrypted(peerB) && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := a.SendData(peerB, []byte("sealed")); err != nil {
+		t.Errorf("SendData once connected failed: %v", err)
+	}
+}
@@ -0,0 +1,450 @@
+// Package soak runs many in process tsync nodes which discover each other, transfer random data
+// to each other and randomly restart, while checking invariants: no goroutine leaks, no stuck
+// transfers, bounded peer maps and correct (hash verified) data.
+// It's used by a (short) test and the `tsync soak` long running mode.
+package soak
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/txfer"
+)
+
+// Defaults for Options.
+const (
+	DefaultNodes             = 5
+	DefaultPort              = tsnet.DefaultDiscoveryPort + 2
+	DefaultMcast             = "239.255.116.117"
+	DefaultBroadcastInterval = 100 * time.Millisecond
+	DefaultTransferInterval  = 200 * time.Millisecond
+	DefaultMaxTransferSize   = 256 * 1024
+	DefaultMaxConcurrent     = 2
+	DefaultTransferTimeout   = 10 * time.Second
+	DefaultRestartInterval   = 2 * time.Second
+	// warmup is how long a node must be up before being used for transfers, so that peers know
+	// about each other (otherwise the data would be dropped as coming from an unknown source).
+	warmup = 2500 * time.Millisecond
+	// goroutineSettle is how long we wait for goroutines to exit after stopping everything.
+	goroutineSettle = 3 * time.Second
+)
+
+// ErrInvariant is returned by Run when invariants were violated (see Report.Violations).
+var ErrInvariant = errors.New("soak invariants violated")
+
+// Options configures a soak run, zero values are replaced by the defaults.
+type Options struct {
+	Nodes             int
+	Duration          time.Duration // how long to run (until ctx is done if 0)
+	Port              int
+	Mcast             string
+	Target            string
+	BroadcastInterval time.Duration
+	TransferInterval  time.Duration // per node, between attempts to start a new transfer
+	MaxTransferSize   int
+	MaxConcurrent     int           // outgoing transfers per node
+	TransferTimeout   time.Duration // a transfer taking longer is considered stuck
+	RestartInterval   time.Duration // a random node is restarted at this interval, negative for none
+	// Optional transport wrapper for all the nodes, e.g. a tsnet.ChaosTransport.
+	WrapTransport func(t tsnet.Transport) tsnet.Transport
+}
+
+func (o *Options) setDefaults() {
+	if o.Nodes <= 0 {
+		o.Nodes = DefaultNodes
+	}
+	if o.Port == 0 {
+		o.Port = DefaultPort
+	}
+	if o.Mcast == "" {
+		o.Mcast = DefaultMcast
+	}
+	if o.BroadcastInterval <= 0 {
+		o.BroadcastInterval = DefaultBroadcastInterval
+	}
+	if o.TransferInterval <= 0 {
+		o.TransferInterval = DefaultTransferInterval
+	}
+	if o.MaxTransferSize <= 0 {
+		o.MaxTransferSize = DefaultMaxTransferSize
+	}
+	if o.MaxConcurrent <= 0 {
+		o.MaxConcurrent = DefaultMaxConcurrent
+	}
+	if o.TransferTimeout <= 0 {
+		o.TransferTimeout = DefaultTransferTimeout
+	}
+	if o.RestartInterval == 0 {
+		o.RestartInterval = DefaultRestartInterval
+	}
+}
+
+// Report is the outcome of a soak run.
+type Report struct {
+	Transfers  atomic.Int64 // started
+	Completed  atomic.Int64 // fully acknowledged
+	Failed     atomic.Int64 // sender side errors (expected when the receiver restarts)
+	Received   atomic.Int64 // hash verified on the receiving side
+	Abandoned  atomic.Int64 // incoming streams dropped after their sender went away
+	Bytes      atomic.Int64 // received and verified
+	Restarts   atomic.Int64
+	mu         sync.Mutex
+	Violations []string
+}
+
+func (r *Report) violation(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Errf("Soak invariant violation: %s", msg)
+	r.mu.Lock()
+	r.Violations = append(r.Violations, msg)
+	r.mu.Unlock()
+}
+
+func (r *Report) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprintf("transfers %d: completed %d, failed %d, received %d (%d bytes), abandoned %d; restarts %d; %d violations",
+		r.Transfers.Load(), r.Completed.Load(), r.Failed.Load(), r.Received.Load(), r.Bytes.Load(),
+		r.Abandoned.Load(), r.Restarts.Load(), len(r.Violations))
+}
+
+type streamKey struct {
+	from string
+	id   uint32
+}
+
+type inStream struct {
+	recv *txfer.StreamReceiver
+	last time.Time
+}
+
+type node struct {
+	opts    *Options
+	report  *Report
+	cfg     tsnet.Config
+	rng     *rand.Rand // only used by the node's loop goroutine
+	mu      sync.Mutex
+	srv     *tsnet.Server // nil while restarting
+	started time.Time
+	life    context.Context    // of the current server
+	cancel  context.CancelFunc // cancels life, so the transfers of the current server
+	wg      sync.WaitGroup     // transfers of the current server
+	active  int
+	streams map[streamKey]*inStream
+	acks    map[uint32]chan []byte
+}
+
+// Run runs the soak test until opts.Duration elapsed or ctx is done, then stops all the nodes
+// and checks that everything was released. The returned error wraps ErrInvariant if any
+// invariant was violated.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	opts.setDefaults()
+	baseline := runtime.NumGoroutine()
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+	report := &Report{}
+	nodes := make([]*node, opts.Nodes)
+	for i := range nodes {
+		n, err := newNode(i, &opts, report)
+		if err != nil {
+			stopAll(nodes[:i])
+			return report, err
+		}
+		nodes[i] = n
+	}
+	log.Infof("Soak test with %d nodes on %s:%d for %v", opts.Nodes, opts.Mcast, opts.Port, opts.Duration)
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Go(func() { n.loop(ctx, nodes) })
+	}
+	if opts.RestartInterval > 0 {
+		wg.Go(func() { restarter(ctx, nodes) })
+	}
+	wg.Wait()
+	stopAll(nodes)
+	checkGoroutines(report, baseline)
+	log.Infof("Soak test done: %v", report)
+	if len(report.Violations) > 0 {
+		return report, fmt.Errorf("%w: %s", ErrInvariant, strings.Join(report.Violations, "; "))
+	}
+	return report, nil
+}
+
+func newNode(i int, opts *Options, report *Report) (*node, error) {
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	n := &node{
+		opts:    opts,
+		report:  report,
+		rng:     rand.New(rand.NewPCG(uint64(i), 42)), //nolint:gosec // test data.
+		streams: make(map[streamKey]*inStream),
+		acks:    make(map[uint32]chan []byte),
+	}
+	n.cfg = tsnet.Config{
+		Name:                  fmt.Sprintf("soak%d", i),
+		Port:                  opts.Port,
+		Mcast:                 opts.Mcast,
+		Target:                opts.Target,
+		Identity:              id,
+		BaseBroadcastInterval: opts.BroadcastInterval,
+		OnData:                n.onData,
+		WrapTransport:         opts.WrapTransport,
+	}
+	return n, n.start()
+}
+
+// start (re)starts the node's server, keeping its identity.
+func (n *node) start() error {
+	srv := n.cfg.NewServer()
+	if err := srv.Start(context.Background()); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.srv = srv
+	n.started = time.Now()
+	n.life, n.cancel = context.WithCancel(context.Background())
+	n.mu.Unlock()
+	return nil
+}
+
+// stop stops the server and its transfers (must not be called with n.mu held as the server's
+// goroutines may be waiting for it in onData).
+func (n *node) stop() {
+	n.mu.Lock()
+	srv, cancel := n.srv, n.cancel
+	n.srv, n.cancel = nil, nil
+	n.mu.Unlock()
+	if srv == nil {
+		return
+	}
+	cancel()
+	n.wg.Wait()
+	srv.Stop()
+	if err := srv.CheckReleased(); err != nil {
+		n.report.violation("%s: %v", n.cfg.Name, err)
+	}
+}
+
+func stopAll(nodes []*node) {
+	for _, n := range nodes {
+		n.stop()
+	}
+}
+
+func restarter(ctx context.Context, nodes []*node) {
+	r := rand.New(rand.NewPCG(7, 7)) //nolint:gosec // test.
+	ticker := time.NewTicker(nodes[0].opts.RestartInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n := nodes[r.IntN(len(nodes))]
+			log.Infof("Soak: restarting %s", n.cfg.Name)
+			n.stop()
+			if err := n.start(); err != nil {
+				n.report.violation("restart of %s failed: %v", n.cfg.Name, err)
+				continue
+			}
+			n.report.Restarts.Add(1)
+		}
+	}
+}
+
+// onData routes acks to our outgoing transfers and frames to incoming streams.
+func (n *node) onData(peer tsnet.Peer, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.srv == nil || len(data) < txfer.StreamHeaderSize {
+		return
+	}
+	id := uint32(data[1])<<24 | uint32(data[2])<<16 | uint32(data[3])<<8 | uint32(data[4])
+	if txfer.IsStreamAck(data) {
+		if acks, ok := n.acks[id]; ok {
+			select {
+			case acks <- append([]byte(nil), data...):
+			default:
+			}
+		}
+		return
+	}
+	key := streamKey{from: peer.Name, id: id}
+	s, ok := n.streams[key]
+	if !ok {
+		srv := n.srv
+		s = &inStream{recv: txfer.NewStreamReceiver(&bytes.Buffer{})}
+		s.recv.Hash = tcrypto.SHA256
+		s.recv.Ack = func(frame []byte) error {
+			return srv.SendData(peer, frame)
+		}
+		n.streams[key] = s
+	}
+	s.last = time.Now()
+	_ = s.recv.Receive(data) // errors are checked once done.
+	select {
+	case <-s.recv.Done():
+	default:
+		return
+	}
+	delete(n.streams, key)
+	if err := s.recv.Err(); err != nil {
+		n.report.violation("%s: stream %d from %s failed: %v", n.cfg.Name, id, peer.Name, err)
+		return
+	}
+	n.report.Received.Add(1)
+	n.report.Bytes.Add(s.recv.Total())
+}
+
+// loop periodically starts transfers to random (warmed up) nodes and checks the invariants.
+func (n *node) loop(ctx context.Context, nodes []*node) {
+	ticker := time.NewTicker(n.opts.TransferInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.check()
+		target := nodes[n.rng.IntN(len(nodes))]
+		if target == n || !target.warm() {
+			continue
+		}
+		data := make([]byte, 1+n.rng.IntN(n.opts.MaxTransferSize))
+		for i := range data {
+			data[i] = byte(n.rng.UintN(256))
+		}
+		n.transfer(target, n.rng.Uint32(), data)
+	}
+}
+
+func (n *node) warm() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.srv != nil && time.Since(n.started) > warmup
+}
+
+func (n *node) startTime() time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.started
+}
+
+// transfer starts sending data to the target, if we are warmed up, know it and aren't too busy.
+func (n *node) transfer(target *node, id uint32, data []byte) {
+	peerName := target.cfg.Name
+	targetStart := target.startTime()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.srv == nil || time.Since(n.started) < warmup || n.active >= n.opts.MaxConcurrent {
+		return
+	}
+	var peer tsnet.Peer
+	found := false
+	for p := range n.srv.Peers.Keys() {
+		if p.Name == peerName {
+			peer, found = p, true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	srv := n.srv
+	acks := make(chan []byte, txfer.DefaultMaxWindow)
+	n.acks[id] = acks
+	n.active++
+	ctx, cancel := context.WithTimeout(n.life, n.opts.TransferTimeout)
+	n.report.Transfers.Add(1)
+	n.wg.Go(func() {
+		defer cancel()
+		sender := &txfer.StreamSender{
+			ID:        id,
+			FrameSize: srv.MaxDataSize(peer),
+			Send: func(frame []byte) error {
+				return srv.SendData(peer, frame)
+			},
+			SendBatch: func(frames [][]byte) error {
+				return srv.SendDataBatch(peer, frames)
+			},
+			Hash:       tcrypto.SHA256,
+			Congestion: txfer.NewAIMD(0),
+			Acks:       acks,
+		}
+		_, err := sender.Copy(ctx, bytes.NewReader(data))
+		n.mu.Lock()
+		delete(n.acks, id)
+		n.active--
+		n.mu.Unlock()
+		switch {
+		case err == nil:
+			n.report.Completed.Add(1)
+		case errors.Is(err, context.DeadlineExceeded) && target.startTime().Equal(targetStart):
+			// (a restarted target lost the stream state, the sender can only time out)
+			n.report.violation("%s: transfer %d to %s stuck for %v", n.cfg.Name, id, peerName, n.opts.TransferTimeout)
+		default:
+			log.LogVf("%s: transfer %d to %s failed: %v", n.cfg.Name, id, peerName, err)
+			n.report.Failed.Add(1)
+		}
+	})
+}
+
+// check verifies the maps are bounded and sweeps the incoming streams whose sender went away.
+func (n *node) check() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.srv == nil {
+		return
+	}
+	if l := n.srv.Peers.Len(); l > n.opts.Nodes-1 {
+		n.report.violation("%s: %d peers for %d nodes", n.cfg.Name, l, n.opts.Nodes)
+	}
+	if l := n.srv.Sources.Len(); l > n.opts.Nodes-1 {
+		n.report.violation("%s: %d sources for %d nodes", n.cfg.Name, l, n.opts.Nodes)
+	}
+	for key, s := range n.streams {
+		if time.Since(s.last) > n.opts.TransferTimeout {
+			delete(n.streams, key)
+			n.report.Abandoned.Add(1)
+		}
+	}
+	if maxStreams := (n.opts.Nodes - 1) * n.opts.MaxConcurrent * 4; len(n.streams) > maxStreams {
+		n.report.violation("%s: %d incoming streams (max %d)", n.cfg.Name, len(n.streams), maxStreams)
+	}
+}
+
+// checkGoroutines checks that all the goroutines started since baseline exited.
+func checkGoroutines(report *Report, baseline int) {
+	deadline := time.Now().Add(goroutineSettle)
+	for {
+		num := runtime.NumGoroutine()
+		if num <= baseline {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 64*1024)
+			buf = buf[:runtime.Stack(buf, true)]
+			log.Errf("Goroutines still running:\n%s", buf)
+			report.violation("goroutine leak: %d goroutines vs %d at start", num, baseline)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
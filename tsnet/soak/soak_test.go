@@ -0,0 +1,29 @@
+package soak_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet/soak"
+)
+
+func TestSoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping soak test in short mode")
+	}
+	duration := 5 * time.Second
+	report, err := soak.Run(context.Background(), soak.Options{
+		Nodes:           4,
+		Duration:        duration,
+		MaxTransferSize: 64 * 1024,
+		RestartInterval: 2 * time.Second,
+	})
+	t.Logf("Soak report: %v", report)
+	if err != nil {
+		t.Fatalf("Soak failed: %v", err)
+	}
+	if report.Received.Load() == 0 || report.Restarts.Load() == 0 {
+		t.Errorf("Expected some transfers and restarts: %v", report)
+	}
+}
@@ -0,0 +1,65 @@
+package tsnet
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// SeedMessagePrefix precedes our discovery message (see DiscoveryMessage) when it's sent unicast
+// to the discovery port of a Config.StaticPeers address instead of the multicast group. The peer's
+// Discovery handles it like a multicast one and answers with its own (plain) discovery message,
+// to our unicast socket, so both learn about each other even when multicast is blocked.
+const SeedMessagePrefix = "seed1 "
+
+const discoveryMessagePrefix = "tsync1 " // see discoveryPayloadFormat.
+
+// resolveStaticPeers resolves the Config.StaticPeers addresses, ip or host with an optional
+// :port (our discovery Port by default).
+func (s *Server) resolveStaticPeers() ([]*net.UDPAddr, error) {
+	addrs := make([]*net.UDPAddr, 0, len(s.StaticPeers))
+	for _, hostPort := range s.StaticPeers {
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			hostPort = net.JoinHostPort(hostPort, strconv.Itoa(s.Port))
+		}
+		addr, err := net.ResolveUDPAddr("udp4", hostPort)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// sendSeeds sends our discovery message for epoch to each of the static peers.
+func (d *Discovery) sendSeeds(epoch int32) {
+	s := d.s
+	for _, addr := range d.static {
+		msg := append([]byte(SeedMessagePrefix), s.discoveryMessage(epoch)...)
+		if _, err := s.transport.WriteToUDP(msg, addr); err != nil {
+			s.log.Errf("Error sending discovery message to static peer %v: %v", addr, err)
+		}
+	}
+}
+
+// answerSeed replies to the seed of a peer with our discovery message.
+func (d *Discovery) answerSeed(to *net.UDPAddr) {
+	s := d.s
+	msg := s.discoveryMessage(s.epoch.Load())
+	if _, err := s.transport.WriteToUDP(msg, to); err != nil {
+		s.log.Errf("Error answering the discovery seed of %v: %v", to, err)
+	}
+}
+
+// handleSeedAnswer adds or updates the peer from the discovery message it answered our seed with.
+func (s *Server) handleSeedAnswer(buf []byte, from *net.UDPAddr) {
+	a, err := s.decodeDiscovery(buf)
+	if err != nil {
+		s.log.Warnf("Ignoring unicast discovery message %q from %v: %v", buf, from, err)
+		return
+	}
+	us := Peer{Name: s.Name, IP: s.ourSendAddr.IP.String(), PublicKey: s.idStr}
+	peer := Peer{Name: a.name, IP: from.IP.String(), PublicKey: a.pubKey}
+	s.recordCommitment(peer, a.epoch, a.commitment)
+	s.discovered(peer, PeerData{Port: from.Port, Epoch: a.epoch, LastSeen: time.Now()}, us)
+}
@@ -0,0 +1,69 @@
+package tsnet_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// TestStaticPeers runs 2 servers on different multicast groups and ports, so they can't hear each
+// other's announcements: A seeds B's address and both find each other.
+func TestStaticPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	newServer := func(name, mcast string, port int) *tsnet.Server {
+		id, err := tcrypto.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := tsnet.Config{Name: name, Identity: id, Mcast: mcast, Port: port, BaseBroadcastInterval: 50 * time.Millisecond}
+		return cfg.NewServer()
+	}
+	b := newServer("staticB", "239.255.115.118", testPort+11)
+	if err := b.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer b.Stop()
+	a := newServer("staticA", "239.255.115.117", testPort+10)
+	a.StaticPeers = []string{"no such host:port"}
+	if err := a.Start(ctx); err == nil {
+		t.Errorf("Start with an invalid static peer should fail")
+	}
+	a = newServer("staticA", "239.255.115.117", testPort+10)
+	a.StaticPeers = []string{net.JoinHostPort(b.OurAddress().IP.String(), strconv.Itoa(testPort+11))}
+	if err := a.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer a.Stop()
+	peerA, portA := asPeer(a)
+	peerB, portB := asPeer(b)
+	for _, c := range []struct {
+		srv  *tsnet.Server
+		peer tsnet.Peer
+		port int
+	}{{a, peerB, portB}, {b, peerA, portA}} {
+		for {
+			if pd, ok := c.srv.Peers.Get(c.peer); ok {
+				if pd.Port != c.port {
+					t.Errorf("%s found %s with port %d, want %d", c.srv.Name, c.peer.Name, pd.Port, c.port)
+				}
+				break
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("%s never found %s: %v", c.srv.Name, c.peer.Name, c.srv.Peers.Len())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package tsnet
+
+import (
+	"bytes"
+	"net"
+	"sync"
+)
+
+// Stats are the counters of the traffic with a peer (see Server.Stats) or with everyone, unknown
+// sources and discovery groups included (see Server.TotalStats).
+type Stats struct {
+	// UDP datagrams and their bytes, direct messages and discovery announcements alike.
+	PacketsSent, PacketsReceived int64
+	BytesSent, BytesReceived     int64
+	// Data messages (SendData, SendDataBatch and the delivered ones) and their payload bytes,
+	// whatever the transport (UDP, TCP or QUIC).
+	MessagesSent, MessagesReceived   int64
+	DataBytesSent, DataBytesReceived int64
+	// Discovery announcements (multicast, broadcast, seeds and mDNS).
+	DiscoverySent, DiscoveryReceived int64
+	// Datagrams received but dropped for exceeding Config.RateLimit.
+	RateLimited int64
+}
+
+// traffic holds the Stats of the known peers and the totals.
+type traffic struct {
+	mu    sync.Mutex
+	peers map[Peer]*Stats
+	total Stats
+}
+
+// count updates the totals and, when known, the peer's stats with fn.
+func (s *Server) count(peer Peer, known bool, fn func(st *Stats)) {
+	t := &s.traffic
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn(&t.total)
+	if !known {
+		return
+	}
+	if t.peers == nil {
+		t.peers = make(map[Peer]*Stats)
+	}
+	st := t.peers[peer]
+	if st == nil {
+		st = &Stats{}
+		t.peers[peer] = st
+	}
+	fn(st)
+}
+
+// countAddr is count for the peer at addr, if any.
+func (s *Server) countAddr(addr *net.UDPAddr, fn func(st *Stats)) {
+	peer, known := s.Sources.Get(Source{IP: addr.IP.String(), Port: addr.Port})
+	s.count(peer, known, fn)
+}
+
+// countDatagram counts the size bytes datagram sent to or received from addr.
+func (s *Server) countDatagram(sent, discovery bool, size int, addr *net.UDPAddr) {
+	s.countAddr(addr, func(st *Stats) {
+		if sent {
+			st.PacketsSent++
+			st.BytesSent += int64(size)
+		} else {
+			st.PacketsReceived++
+			st.BytesReceived += int64(size)
+		}
+		switch {
+		case !discovery:
+		case sent:
+			st.DiscoverySent++
+		default:
+			st.DiscoveryReceived++
+		}
+	})
+}
+
+// countData counts the data messages sent to or received from the peer.
+func (s *Server) countData(sent bool, peer Peer, data ...[]byte) {
+	s.count(peer, true, func(st *Stats) {
+		for _, d := range data {
+			if sent {
+				st.MessagesSent++
+				st.DataBytesSent += int64(len(d))
+			} else {
+				st.MessagesReceived++
+				st.DataBytesReceived += int64(len(d))
+			}
+		}
+	})
+}
+
+// forgetStats drops the stats of the removed peers, the totals are kept.
+func (s *Server) forgetStats(peers ...Peer) {
+	t := &s.traffic
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, peer := range peers {
+		delete(t.peers, peer)
+	}
+}
+
+// clearStats drops the stats of all the peers, the totals are kept.
+func (s *Server) clearStats() {
+	t := &s.traffic
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers = nil
+}
+
+// Stats returns the traffic counters of the peer, false if there was no traffic with it (since
+// it's known).
+func (s *Server) Stats(peer Peer) (Stats, bool) {
+	t := &s.traffic
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.peers[peer]
+	if !ok {
+		return Stats{}, false
+	}
+	return *st, true
+}
+
+// TotalStats returns the traffic counters with everyone since the server was created.
+func (s *Server) TotalStats() Stats {
+	t := &s.traffic
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
+
+// isDiscovery returns true for the discovery announcements (possibly broadcast or seeded).
+func isDiscovery(b []byte) bool {
+	b, _ = bytes.CutPrefix(b, []byte(SeedMessagePrefix))
+	b, _ = bytes.CutPrefix(b, []byte(BroadcastMessagePrefix))
+	return bytes.HasPrefix(b, []byte("tsync1 "))
+}
+
+// statsTransport counts the datagrams sent (see Stats). It's below relayTransport so the relayed
+// datagrams count as sent to the rendezvous server. The received ones are counted by the receive
+// loops as batched reads bypass the Transport.
+type statsTransport struct {
+	Transport
+	s *Server
+}
+
+func (t statsTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	n, err := t.Transport.WriteToUDP(b, addr)
+	if err == nil {
+		t.s.countDatagram(true, isDiscovery(b), len(b), addr)
+	}
+	return n, err
+}
@@ -0,0 +1,81 @@
+package tsnet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// TestStats checks the data messages and datagrams exchanged are counted for the peer and in the
+// totals, and that the peer's stats are dropped with it.
+func TestStats(t *testing.T) {
+	a := newUnicastServer(t, "statsA")
+	b := newUnicastServer(t, "statsB")
+	received := make(chan []byte, 10)
+	b.OnData = func(_ tsnet.Peer, data []byte) { received <- data }
+	ctx := context.Background()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerA, portA := asPeer(a)
+	peerB, portB := asPeer(b)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if _, ok := a.Stats(peerB); ok {
+		t.Errorf("No stats expected before any traffic")
+	}
+	if err := a.SendData(peerB, []byte("hello")); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	if err := a.SendDataBatch(peerB, [][]byte{[]byte("one"), []byte("two"), []byte("three")}); err != nil {
+		t.Fatalf("SendDataBatch failed: %v", err)
+	}
+	for range 4 {
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Data not received")
+		}
+	}
+	sent, ok := a.Stats(peerB)
+	if !ok || sent.MessagesSent != 4 || sent.DataBytesSent != 16 || sent.PacketsSent != 4 {
+		t.Errorf("Unexpected stats of A for B: %+v", sent)
+	}
+	if sent.BytesSent <= sent.DataBytesSent || sent.MessagesReceived != 0 || sent.DiscoverySent != 0 {
+		t.Errorf("Unexpected stats of A for B: %+v", sent)
+	}
+	got, ok := b.Stats(peerA)
+	if !ok || got.MessagesReceived != 4 || got.DataBytesReceived != 16 || got.PacketsReceived != 4 ||
+		got.BytesReceived != sent.BytesSent {
+		t.Errorf("Unexpected stats of B for A: %+v (sent %+v)", got, sent)
+	}
+	if total := b.TotalStats(); total.MessagesReceived != 4 || total.PacketsReceived < 4 {
+		t.Errorf("Unexpected total stats of B: %+v", total)
+	}
+	// A's goodbye removes it from B's peers (once connected, see sayGoodbye).
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("Not connected: %v", err)
+	}
+	a.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for b.Peers.Has(peerA) {
+		if time.Now().After(deadline) {
+			t.Fatalf("A not removed after its goodbye")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok = b.Stats(peerA); ok {
+		t.Errorf("Stats of removed peer A should be dropped")
+	}
+	if total := b.TotalStats(); total.MessagesReceived != 4 {
+		t.Errorf("Totals should be kept, got %+v", total)
+	}
+}
@@ -0,0 +1,306 @@
+package tsnet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+const (
+	// DefaultSTUNPort is the port of the Config.STUNServers without one.
+	DefaultSTUNPort = 3478
+	// STUNInterval is how often the STUN servers are asked for our external address.
+	STUNInterval = 30 * time.Second
+	// STUNTimeout is how long the answers of the STUN servers are waited for.
+	STUNTimeout = 2 * time.Second
+	// MaxExternalAge is how old (or in the future, for clock skew) a signed external address can be.
+	MaxExternalAge = 5 * time.Minute
+
+	// ExternalPayloadFormat is the signed (Identity.SignMessage) external address sent to the
+	// rendezvous in our registrations and forwarded to the peers it introduces us to.
+	ExternalPayloadFormat = "external1 %q %s %d" // name, ip:port, unix time in ms
+
+	stunMagicCookie       = 0x2112a442
+	stunHeaderSize        = 20
+	stunBindingRequest    = 0x0001
+	stunBindingSuccess    = 0x0101
+	stunMappedAddress     = 0x0001
+	stunXorMappedAddress  = 0x0020
+	stunFamilyIPv4        = 0x01
+	stunTransactionIDSize = 12
+)
+
+// STUNClient learns our external address (our NAT's address and port for our unicast socket) by
+// sending STUN (RFC 5389) binding requests to the Config.STUNServers from the unicast socket, every
+// STUNInterval. When the servers see different ports, our NAT maps each destination to another
+// port (symmetric NAT) and holes won't get through: there is then no external address. The
+// address is signed in our registrations with the rendezvous (see SignedExternal), the peers it
+// introduces us to send holes to it too: it helps when the rendezvous doesn't see our public
+// address (e.g. it's on our network) or we're multi-homed.
+type STUNClient struct {
+	s         *Server
+	running   atomic.Bool
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	pending   map[[stunTransactionIDSize]byte]string // server of the requests of the current round.
+	answers   map[string]*net.UDPAddr                // mapped addresses of the current round, by server.
+	external  *net.UDPAddr
+	symmetric bool
+}
+
+func (c *STUNClient) Start(ctx context.Context) error {
+	if c.Running() {
+		return nil
+	}
+	s := c.s
+	if !s.Listener.Running() {
+		return fmt.Errorf("STUN needs the listener: %w", ErrNotRunning)
+	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.wg.Add(1)
+	s.goroutines.Add(1)
+	go c.run(ctx)
+	c.running.Store(true)
+	return nil
+}
+
+func (c *STUNClient) Stop() {
+	if !c.running.CompareAndSwap(true, false) {
+		return
+	}
+	c.cancel()
+	c.wg.Wait()
+}
+
+func (c *STUNClient) Running() bool {
+	return c.running.Load()
+}
+
+// External returns our external address according to the STUN servers, nil while unknown or
+// behind a symmetric NAT.
+func (c *STUNClient) External() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.external
+}
+
+// Symmetric returns true when the STUN servers saw us from different ports.
+func (c *STUNClient) Symmetric() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.symmetric
+}
+
+// SignedExternal returns our external address signed by our identity (see ExternalPayloadFormat),
+// empty if unknown.
+func (c *STUNClient) SignedExternal() string {
+	external := c.External()
+	if external == nil {
+		return ""
+	}
+	s := c.s
+	return s.Identity.SignMessage(fmt.Appendf(nil, ExternalPayloadFormat, s.Name, external, time.Now().UnixMilli()))
+}
+
+// run queries the servers right away and then every STUNInterval.
+func (c *STUNClient) run(ctx context.Context) {
+	s := c.s
+	defer c.wg.Done()
+	defer s.goroutines.Add(-1)
+	failed := false
+	for {
+		c.query(ctx)
+		external, symmetric, answered := c.result()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case answered == 0:
+			if !failed {
+				s.log.Warnf("No answer from the STUN servers %v (will retry every %v)", s.STUNServers, STUNInterval)
+			}
+			failed = true
+		default:
+			failed = false
+		}
+		c.mu.Lock()
+		changed := (c.external == nil) != (external == nil) || (external != nil && c.external.String() != external.String())
+		wasSymmetric := c.symmetric
+		c.external, c.symmetric = external, symmetric
+		c.mu.Unlock()
+		if symmetric && !wasSymmetric {
+			s.log.Warnf("The STUN servers see us from different ports (symmetric NAT): holes won't get through, use a relay")
+		}
+		if changed && external != nil {
+			s.log.Infof("External address (seen by %d STUN servers): %v", answered, external)
+			if s.NAT.Running() {
+				s.NAT.register()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(STUNInterval):
+		}
+	}
+}
+
+// query sends a binding request to each server and waits STUNTimeout for the answers.
+func (c *STUNClient) query(ctx context.Context) {
+	s := c.s
+	c.mu.Lock()
+	c.pending = make(map[[stunTransactionIDSize]byte]string)
+	c.answers = make(map[string]*net.UDPAddr)
+	c.mu.Unlock()
+	for _, server := range s.STUNServers {
+		hostPort := server
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			hostPort = net.JoinHostPort(hostPort, strconv.Itoa(DefaultSTUNPort))
+		}
+		addr, err := net.ResolveUDPAddr("udp4", hostPort)
+		if err != nil {
+			s.log.LogVf("Can't resolve STUN server %q: %v", server, err)
+			continue
+		}
+		var id [stunTransactionIDSize]byte
+		_, _ = rand.Read(id[:]) // never returns an error.
+		c.mu.Lock()
+		c.pending[id] = addr.String()
+		c.mu.Unlock()
+		if _, err := s.transport.WriteToUDP(stunRequest(id), addr); err != nil {
+			s.log.LogVf("Failed to send the STUN request to %v: %v", addr, err)
+		}
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(STUNTimeout):
+	}
+}
+
+// result returns the external address the servers agree on (nil if they don't), whether they
+// disagree and how many answered the current round.
+func (c *STUNClient) result() (*net.UDPAddr, bool, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var external *net.UDPAddr
+	for _, mapped := range c.answers {
+		if external != nil && external.String() != mapped.String() {
+			return nil, true, len(c.answers)
+		}
+		external = mapped
+	}
+	return external, false, len(c.answers)
+}
+
+// stunRequest returns the binding request with the transaction id.
+func stunRequest(id [stunTransactionIDSize]byte) []byte {
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req, stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	copy(req[8:], id[:])
+	return req
+}
+
+// isSTUNMessage returns true if buf is a STUN message (the 2 first bits are 0, which no text or
+// binary message starts with, and it has the magic cookie).
+func isSTUNMessage(buf []byte) bool {
+	return len(buf) >= stunHeaderSize && buf[0]&0xc0 == 0 && binary.BigEndian.Uint32(buf[4:]) == stunMagicCookie
+}
+
+// handleSTUN records the mapped address of the answer to one of our binding requests.
+func (c *STUNClient) handleSTUN(from *net.UDPAddr, buf []byte) {
+	s := c.s
+	var id [stunTransactionIDSize]byte
+	copy(id[:], buf[8:stunHeaderSize])
+	c.mu.Lock()
+	server, ok := c.pending[id]
+	c.mu.Unlock()
+	if !ok || server != from.String() || binary.BigEndian.Uint16(buf) != stunBindingSuccess {
+		s.log.LogVf("Ignoring unexpected STUN message from %v", from)
+		return
+	}
+	mapped, err := stunMapped(buf)
+	if err != nil {
+		s.log.Warnf("Invalid STUN answer from %v: %v", from, err)
+		return
+	}
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.answers[server] = mapped
+	c.mu.Unlock()
+}
+
+// stunMapped returns the (XOR-)MAPPED-ADDRESS of the binding success response.
+func stunMapped(buf []byte) (*net.UDPAddr, error) {
+	size := int(binary.BigEndian.Uint16(buf[2:]))
+	if len(buf) < stunHeaderSize+size {
+		return nil, fmt.Errorf("truncated message (%d bytes, %d announced)", len(buf), stunHeaderSize+size)
+	}
+	var mapped *net.UDPAddr
+	attrs := buf[stunHeaderSize : stunHeaderSize+size]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs)
+		l := int(binary.BigEndian.Uint16(attrs[2:]))
+		padded := (l + 3) &^ 3
+		if len(attrs) < 4+l {
+			return nil, fmt.Errorf("truncated attribute %#x", typ)
+		}
+		value := attrs[4 : 4+l]
+		if (typ == stunXorMappedAddress || typ == stunMappedAddress) && l >= 8 && value[1] == stunFamilyIPv4 {
+			port := binary.BigEndian.Uint16(value[2:])
+			ip := net.IPv4(value[4], value[5], value[6], value[7])
+			if typ == stunXorMappedAddress {
+				port ^= stunMagicCookie >> 16
+				cookie := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+				for i := range 4 {
+					ip[12+i] ^= cookie[i]
+				}
+				return &net.UDPAddr{IP: ip, Port: int(port)}, nil // preferred.
+			}
+			mapped = &net.UDPAddr{IP: ip, Port: int(port)}
+		}
+		attrs = attrs[min(4+padded, len(attrs)):]
+	}
+	if mapped == nil {
+		return nil, fmt.Errorf("no IPv4 mapped address")
+	}
+	return mapped, nil
+}
+
+// verifyExternal returns the external address signed by the peer (see SignedExternal) with the
+// name and public key, if the signature is valid and not older than MaxExternalAge.
+func verifyExternal(signed, name, pubKey string) (*net.UDPAddr, error) {
+	pub, err := tcrypto.IdentityPublicKeyString(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := tcrypto.VerifySignedMessage(signed, pub)
+	if err != nil {
+		return nil, err
+	}
+	var signer, address string
+	var unixMilli int64
+	if n, err := fmt.Sscanf(string(payload), ExternalPayloadFormat, &signer, &address, &unixMilli); err != nil || n != 3 {
+		return nil, fmt.Errorf("invalid external address payload %q", payload)
+	}
+	if signer != name {
+		return nil, fmt.Errorf("external address signed by %q instead of %q", signer, name)
+	}
+	if age := time.Since(time.UnixMilli(unixMilli)); age > MaxExternalAge || age < -MaxExternalAge {
+		return nil, fmt.Errorf("external address signed %v ago", age.Round(time.Second))
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, err
+	}
+	return net.UDPAddrFromAddrPort(ap), nil
+}
@@ -0,0 +1,127 @@
+package tsnet_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// fakeSTUN answers the binding requests with mapped as XOR-MAPPED-ADDRESS.
+func fakeSTUN(t *testing.T, mapped *net.UDPAddr) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n != 20 || binary.BigEndian.Uint16(buf) != 0x0001 {
+				continue
+			}
+			resp := make([]byte, 32)
+			binary.BigEndian.PutUint16(resp, 0x0101)
+			binary.BigEndian.PutUint16(resp[2:], 12)
+			copy(resp[4:20], buf[4:20]) // magic cookie and transaction id.
+			binary.BigEndian.PutUint16(resp[20:], 0x0020)
+			binary.BigEndian.PutUint16(resp[22:], 8)
+			resp[25] = 0x01
+			binary.BigEndian.PutUint16(resp[26:], uint16(mapped.Port)^0x2112) //nolint:gosec // a port.
+			for i, b := range mapped.IP.To4() {
+				resp[28+i] = b ^ buf[4+i]
+			}
+			_, _ = conn.WriteToUDP(resp, from)
+		}
+	}()
+	return conn
+}
+
+// TestSTUN learns the external address of a peer from 2 STUN servers, sent signed through the
+// rendezvous to the peer punching to it, which adds it as another of its addresses.
+func TestSTUN(t *testing.T) {
+	external := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 41000}
+	var servers []string
+	for range 2 {
+		conn := fakeSTUN(t, external)
+		defer conn.Close()
+		servers = append(servers, conn.LocalAddr().String())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r := newUnicastServer(t, "rendezvous")
+	r.RendezvousServer = true
+	if err := r.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer r.Stop()
+	a := newUnicastServer(t, "stunA")
+	a.STUNServers = servers
+	b := newUnicastServer(t, "stunB")
+	for _, srv := range []*tsnet.Server{a, b} {
+		srv.Rendezvous = r.OurAddress().String()
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	for a.STUN.External() == nil {
+		if ctx.Err() != nil {
+			t.Fatal("No external address from the STUN servers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := a.STUN.External().String(); got != external.String() || a.STUN.Symmetric() {
+		t.Errorf("External address %s (symmetric %v), want %v", got, a.STUN.Symmetric(), external)
+	}
+	peerA, _ := asPeer(a)
+	for {
+		if _, err := b.NAT.Punch(ctx, "stunA"); err != nil {
+			t.Fatalf("Punch failed: %v", err)
+		}
+		data, _ := b.Peers.Get(peerA)
+		if slices.ContainsFunc(data.Addrs, func(pa tsnet.PeerAddr) bool {
+			return pa.IP == external.IP.String() && pa.Port == external.Port
+		}) {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("External address of A never introduced to B: %+v", data)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestSTUNSymmetric detects the servers seeing different ports: there is no external address.
+func TestSTUNSymmetric(t *testing.T) {
+	var servers []string
+	for i := range 2 {
+		conn := fakeSTUN(t, &net.UDPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 41000 + i})
+		defer conn.Close()
+		servers = append(servers, conn.LocalAddr().String())
+	}
+	srv := newUnicastServer(t, "symmetric")
+	srv.STUNServers = servers
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer srv.Stop()
+	deadline := time.Now().Add(2*tsnet.STUNTimeout + time.Second)
+	for !srv.STUN.Symmetric() {
+		if time.Now().After(deadline) {
+			t.Fatal("Symmetric NAT not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ext := srv.STUN.External(); ext != nil {
+		t.Errorf("Unexpected external address %v behind a symmetric NAT", ext)
+	}
+}
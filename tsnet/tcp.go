@@ -0,0 +1,437 @@
+package tsnet
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+)
+
+// TransportKind selects how the data of connected peers is carried (see Config.Transport).
+type TransportKind int
+
+const (
+	// UDPTransport sends the data as datagrams on the Listener's socket (the default).
+	UDPTransport TransportKind = iota
+	// TCPTransport also listens for TCP streams (TCPListener) and, once connected to a peer,
+	// dials one to it: their data then goes through the stream, sealed with the connection's session,
+	// in frames up to TCPMaxDataSize. Peers not accepting TCP keep using datagrams.
+	TCPTransport
+	// QUICTransport is TCPTransport over a QUIC connection (QUICListener) instead: on its own UDP
+	// port, announced in the accept, with QUIC's congestion control and loss recovery.
+	QUICTransport
+)
+
+var transportNames = []string{"udp", "tcp", "quic"}
+
+func (k TransportKind) String() string {
+	if k >= 0 && int(k) < len(transportNames) {
+		return transportNames[k]
+	}
+	return "unknown"
+}
+
+// ParseTransport returns the TransportKind from its name (udp, tcp or quic).
+func ParseTransport(name string) (TransportKind, error) {
+	for i, n := range transportNames {
+		if strings.EqualFold(name, n) {
+			return TransportKind(i), nil
+		}
+	}
+	return UDPTransport, fmt.Errorf("unknown transport %q, must be udp, tcp or quic", name)
+}
+
+const (
+	// TCPMaxDataSize is the maximum payload size SendData sends to a peer with a TCP (or QUIC) stream.
+	TCPMaxDataSize = 64 << 10
+	// TCPHelloFormat is the first frame of a TCP or QUIC stream, the hello sealed with the session
+	// authenticates it as the requester's (see ConnectionManager.Connect).
+	TCPHelloFormat = "tcp1 %q %q %s" // requester_name, target_name, sealed hello
+	// TCPTimeout bounds the dialing, the hello and each write of the TCP and QUIC streams.
+	TCPTimeout = 5 * time.Second
+	tcpHello   = "tcp1 hello"
+	// frames are a 4 bytes length followed by the SealBytes of the data.
+	maxTCPFrame = TCPMaxDataSize + tcrypto.SealedOverhead
+)
+
+// ErrTCPClosed is returned when sending on a peer's TCP or QUIC stream which was closed.
+var ErrTCPClosed = errors.New("TCP connection closed")
+
+// dataStreams holds the streams with the connected peers of a stream transport, TCPTransport's
+// or QUICTransport's: their hello, frames and registration are the same.
+type dataStreams struct {
+	s       *Server
+	kind    string // TCP or QUIC, for the logs.
+	running atomic.Bool
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	conns   map[Peer]*streamConn
+}
+
+// streamConn is the stream with a connected peer.
+type streamConn struct {
+	conn    net.Conn
+	session *tcrypto.Session
+	wmu     sync.Mutex // serializes the writes of frames.
+	closed  atomic.Bool
+}
+
+// TCPListener is the TCP side of TCPTransport: it accepts the streams of the peers connected
+// to us, on the Listener's port number, and holds the ones we dialed.
+type TCPListener struct {
+	dataStreams
+	ln     *net.TCPListener
+	cancel context.CancelFunc
+}
+
+func (l *TCPListener) Start(ctx context.Context) error {
+	if l.Running() {
+		return nil
+	}
+	s := l.s
+	if !s.Listener.Running() {
+		return fmt.Errorf("TCP listener needs the listener: %w", ErrNotRunning)
+	}
+	var err error
+	l.ln, err = net.ListenTCP("tcp4", &net.TCPAddr{IP: s.ourSendAddr.IP, Port: s.ourSendAddr.Port})
+	if err != nil {
+		return err
+	}
+	s.sockets.Add(1)
+	s.log.Infof("TCP streams on %s", l.ln.Addr())
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.wg.Add(1)
+	s.goroutines.Add(1)
+	go l.runAccept(ctx)
+	l.running.Store(true)
+	return nil
+}
+
+func (l *TCPListener) Stop() {
+	if !l.running.CompareAndSwap(true, false) {
+		return
+	}
+	l.cancel()
+	if l.ln.Close() == nil { // unblocks the accept loop.
+		l.s.sockets.Add(-1)
+	}
+	l.closeAll()
+	l.wg.Wait()
+}
+
+func (d *dataStreams) Running() bool {
+	return d.running.Load()
+}
+
+func (l *TCPListener) runAccept(ctx context.Context) {
+	s := l.s
+	defer l.wg.Done()
+	defer s.goroutines.Add(-1)
+	for {
+		conn, err := l.ln.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				s.log.Infof("Exiting TCP stream listener after %v", ctx.Err())
+				return
+			}
+			s.log.Errf("Error accepting TCP stream: %v", err)
+			continue
+		}
+		s.sockets.Add(1)
+		l.wg.Add(1)
+		s.goroutines.Add(1)
+		go func() {
+			defer l.wg.Done()
+			defer s.goroutines.Add(-1)
+			l.accept(ctx, conn, conn.RemoteAddr().(*net.TCPAddr).IP.String())
+		}()
+	}
+}
+
+// accept authenticates the hello of the incoming stream from ip (counted in sockets) then
+// reads its frames.
+func (d *dataStreams) accept(ctx context.Context, conn net.Conn, ip string) {
+	s := d.s
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(TCPTimeout))
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) }) // not in streams yet.
+	peer, sc, err := d.hello(ip, conn, r)
+	stop()
+	if err != nil {
+		s.log.Warnf("Rejecting %s stream from %v: %v", d.kind, conn.RemoteAddr(), err)
+		if conn.Close() == nil {
+			s.sockets.Add(-1)
+		}
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if !d.add(peer, sc) {
+		return
+	}
+	s.log.Infof("Accepted %s stream from %q (%v)", d.kind, peer.Name, conn.RemoteAddr())
+	d.read(peer, sc, r)
+}
+
+// hello reads the first frame of a stream from ip: the connected peer whose session opens it.
+func (d *dataStreams) hello(ip string, conn net.Conn, r io.Reader) (Peer, *streamConn, error) {
+	s := d.s
+	frame, err := readFrame(r)
+	if err != nil {
+		return Peer{}, nil, err
+	}
+	var requester, target, sealed string
+	if n, err := fmt.Sscanf(string(frame), TCPHelloFormat, &requester, &target, &sealed); err != nil || n != 3 {
+		return Peer{}, nil, fmt.Errorf("invalid hello %q", frame)
+	}
+	if target != s.Name {
+		return Peer{}, nil, fmt.Errorf("hello target name %q doesn't match our name %q", target, s.Name)
+	}
+	var peer Peer
+	var session *tcrypto.Session
+	c := s.Connections
+	c.mu.Lock()
+	for p, ses := range c.sessions {
+		if p.Name == requester && s.isPeerIP(p, ip) {
+			peer, session = p, ses
+		}
+	}
+	c.mu.Unlock()
+	if session == nil {
+		return Peer{}, nil, fmt.Errorf("no session with %q at %s", requester, ip)
+	}
+	if s.Banned(ip, peer.PublicKey) {
+		return Peer{}, nil, fmt.Errorf("%q is banned", peer.Name)
+	}
+	session = session.Stream()
+	if hello, err := session.Open(sealed, []byte(s.Name)); err != nil || string(hello) != tcpHello {
+		s.recordUnproven(ip, peer, "invalid "+d.kind+" hello")
+		return Peer{}, nil, fmt.Errorf("invalid hello from %q: %v", peer.Name, err)
+	}
+	return peer, &streamConn{conn: conn, session: session}, nil
+}
+
+// dialStream dials, in the background, the stream (TCP to addr, QUIC to the peer's announced
+// quicPort) to the peer which accepted our connection request then wakes up WaitConnected
+// (the data goes through datagrams if that fails).
+func (c *ConnectionManager) dialStream(peer Peer, addr *net.UDPAddr, quicPort int) {
+	s := c.s
+	d, dial := &s.TCPListener.dataStreams, func() (net.Conn, error) {
+		return net.DialTimeout("tcp4", (&net.TCPAddr{IP: addr.IP, Port: addr.Port}).String(), TCPTimeout)
+	}
+	if s.Transport == QUICTransport {
+		d, dial = &s.QUICListener.dataStreams, func() (net.Conn, error) {
+			return s.QUICListener.dial(&net.UDPAddr{IP: addr.IP, Port: quicPort})
+		}
+	}
+	d.wg.Add(1)
+	s.goroutines.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer s.goroutines.Add(-1)
+		if err := d.dial(peer, dial); err != nil {
+			s.log.Warnf("No %s stream to %q, using datagrams: %v", d.kind, peer.Name, err)
+		}
+		c.resolve(peer, nil)
+	}()
+}
+
+// dial opens our stream to the connected peer, with the dial function, and sends the hello.
+func (d *dataStreams) dial(peer Peer, dial func() (net.Conn, error)) error {
+	s := d.s
+	session := s.Connections.session(peer)
+	if session == nil {
+		return fmt.Errorf("no session with %q", peer.Name)
+	}
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	s.sockets.Add(1)
+	session = session.Stream()
+	sc := &streamConn{conn: conn, session: session}
+	hello := fmt.Sprintf(TCPHelloFormat, s.Name, peer.Name, session.Seal([]byte(tcpHello), []byte(peer.Name)))
+	if err = sc.write([]byte(hello)); err != nil {
+		if conn.Close() == nil {
+			s.sockets.Add(-1)
+		}
+		return err
+	}
+	d.wg.Add(1)
+	s.goroutines.Add(1)
+	if !d.add(peer, sc) {
+		d.wg.Done()
+		s.goroutines.Add(-1)
+		return ErrNotRunning
+	}
+	s.log.Infof("%s stream to %q (%v) established", d.kind, peer.Name, conn.RemoteAddr())
+	go func() {
+		defer d.wg.Done()
+		defer s.goroutines.Add(-1)
+		d.read(peer, sc, bufio.NewReader(conn))
+	}()
+	return nil
+}
+
+// add registers the peer's stream, replacing (closing) its previous one. Returns false,
+// having closed sc, once stopped.
+func (d *dataStreams) add(peer Peer, sc *streamConn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.Running() {
+		d.closeConn(peer, sc)
+		return false
+	}
+	if old := d.conns[peer]; old != nil {
+		d.closeConn(peer, old)
+	}
+	if d.conns == nil {
+		d.conns = make(map[Peer]*streamConn)
+	}
+	d.conns[peer] = sc
+	return true
+}
+
+// closeConn closes sc and forgets it if it's the peer's current stream, d.mu must be held.
+func (d *dataStreams) closeConn(peer Peer, sc *streamConn) {
+	if d.conns[peer] == sc {
+		delete(d.conns, peer)
+	}
+	if sc.closed.CompareAndSwap(false, true) && sc.conn.Close() == nil {
+		d.s.sockets.Add(-1)
+	}
+}
+
+// closeAll closes all the streams, when stopping.
+func (d *dataStreams) closeAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for peer, sc := range d.conns {
+		d.closeConn(peer, sc)
+	}
+}
+
+// drop closes the streams with the peers (failed or expired).
+func (d *dataStreams) drop(peers ...Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, peer := range peers {
+		if sc := d.conns[peer]; sc != nil {
+			d.closeConn(peer, sc)
+		}
+	}
+}
+
+// conn returns the stream with the peer, nil if none.
+func (d *dataStreams) conn(peer Peer) *streamConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.conns[peer]
+}
+
+// HasTCP returns true when the data with the peer goes through a TCP stream (see TCPTransport).
+func (s *Server) HasTCP(peer Peer) bool {
+	return s.TCPListener.conn(peer) != nil
+}
+
+// dataStream returns the TCP or QUIC stream with the peer and what holds it, nil if none.
+func (s *Server) dataStream(peer Peer) (*dataStreams, *streamConn) {
+	for _, d := range []*dataStreams{&s.TCPListener.dataStreams, &s.QUICListener.dataStreams} {
+		if sc := d.conn(peer); sc != nil {
+			return d, sc
+		}
+	}
+	return nil, nil
+}
+
+// read passes the peer's frames on (like handleSealedData) until the stream fails or is closed.
+func (d *dataStreams) read(peer Peer, sc *streamConn, r io.Reader) {
+	s := d.s
+	defer func() {
+		d.mu.Lock()
+		d.closeConn(peer, sc)
+		d.mu.Unlock()
+	}()
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			if !sc.closed.Load() && !errors.Is(err, io.EOF) {
+				s.log.Warnf("%s stream with %q failed: %v", d.kind, peer.Name, err)
+			}
+			return
+		}
+		data, err := sc.session.OpenBytes(frame, []byte(s.Name))
+		if errors.Is(err, tcrypto.ErrReplay) {
+			s.log.Warnf("Dropping replayed %s stream frame from %q", d.kind, peer.Name)
+			continue
+		}
+		if err != nil {
+			s.log.Errf("Invalid %s stream frame from %q: %v", d.kind, peer.Name, err)
+			s.RecordFailure(peer.IP, peer, "invalid "+d.kind+" frame")
+			return
+		}
+		s.deliver(peer, data)
+	}
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxTCPFrame {
+		return nil, fmt.Errorf("frame too large: %d > %d", n, maxTCPFrame)
+	}
+	frame := make([]byte, n)
+	_, err := io.ReadFull(r, frame)
+	return frame, err
+}
+
+// write sends the frames (as is, see send).
+func (sc *streamConn) write(frames ...[]byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	return sc.writeLocked(frames)
+}
+
+// writeLocked is write with sc.wmu held.
+func (sc *streamConn) writeLocked(frames [][]byte) error {
+	bufs := make(net.Buffers, 0, 2*len(frames))
+	for _, f := range frames {
+		bufs = append(bufs, binary.BigEndian.AppendUint32(nil, uint32(len(f))), f) //nolint:gosec // bounded.
+	}
+	if sc.closed.Load() {
+		return ErrTCPClosed
+	}
+	_ = sc.conn.SetWriteDeadline(time.Now().Add(TCPTimeout))
+	_, err := bufs.WriteTo(sc.conn)
+	return err
+}
+
+// send seals the data for the peer and writes it, closing the stream on error (the data
+// then goes through datagrams again). The frames are sealed under sc.wmu so their counters
+// go out in order.
+func (d *dataStreams) send(peer Peer, sc *streamConn, data ...[]byte) error {
+	frames := make([][]byte, len(data))
+	sc.wmu.Lock()
+	for i, dt := range data {
+		frames[i] = sc.session.SealBytes(dt, []byte(peer.Name))
+	}
+	err := sc.writeLocked(frames)
+	sc.wmu.Unlock()
+	if err != nil {
+		d.mu.Lock()
+		d.closeConn(peer, sc)
+		d.mu.Unlock()
+	}
+	return err
+}
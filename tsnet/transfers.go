@@ -0,0 +1,346 @@
+package tsnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/txfer"
+)
+
+const (
+	// DefaultStreamHash is the hash used to verify the whole content of the TransferManager's streams.
+	DefaultStreamHash = tcrypto.SHA256
+	// StreamTimeout is how long an incoming stream can go without frames before being forgotten.
+	StreamTimeout = 30 * time.Second
+)
+
+// ErrStreamTimeout is passed to Config.OnStreamDone for incoming streams abandoned by their sender.
+var ErrStreamTimeout = errors.New("no frames for StreamTimeout")
+
+// TransferManager sends and receives congestion controlled streams (see txfer.StreamSender)
+// over data messages. While running it consumes the acks of the streams it sends and, when
+// Config.OnStream is set, all the incoming stream frames; other data goes to Config.OnData.
+type TransferManager struct {
+	s        *Server
+	mu       sync.Mutex
+	running  bool
+	life     context.Context //nolint:containedctx // cancels the Sends in progress on Stop.
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup // Sends in progress
+	acks     map[uint32]chan []byte
+	incoming map[streamKey]*incomingStream
+	sending  map[uint32]outgoingStream // to pause the Sends to restarting peers
+}
+
+type outgoingStream struct {
+	peer   Peer
+	cancel context.CancelCauseFunc
+	read   *atomic.Int64 // bytes read from the source so far
+}
+
+type streamKey struct {
+	peer Peer
+	id   uint32
+}
+
+type incomingStream struct {
+	recv *txfer.StreamReceiver // nil for ignored streams
+	last time.Time
+}
+
+func (t *TransferManager) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running {
+		return nil
+	}
+	t.life, t.cancel = context.WithCancel(ctx)
+	t.acks = make(map[uint32]chan []byte)
+	t.incoming = make(map[streamKey]*incomingStream)
+	t.sending = make(map[uint32]outgoingStream)
+	t.running = true
+	return nil
+}
+
+// Stop aborts the Sends in progress (and waits for them to return) and forgets the incoming streams.
+func (t *TransferManager) Stop() {
+	t.mu.Lock()
+	if !t.running {
+		t.mu.Unlock()
+		return
+	}
+	t.running = false
+	t.cancel()
+	unfinished := t.sweep(time.Now().Add(StreamTimeout + time.Second)) // sweeps all of them.
+	t.mu.Unlock()
+	t.wg.Wait()
+	for key, recv := range unfinished {
+		t.done(key, recv, net.ErrClosed)
+	}
+}
+
+func (t *TransferManager) Running() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.running
+}
+
+// Transfer is a stream in progress, see List.
+type Transfer struct {
+	ID       uint32
+	Peer     Peer
+	Incoming bool
+	Bytes    int64 // written for incoming streams, read from the source for outgoing ones.
+}
+
+// List returns the streams in progress, outgoing (Sends) and incoming (unfinished).
+func (t *TransferManager) List() []Transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]Transfer, 0, len(t.sending)+len(t.incoming))
+	for id, out := range t.sending {
+		list = append(list, Transfer{ID: id, Peer: out.peer, Bytes: out.read.Load()})
+	}
+	for key, in := range t.incoming {
+		if in.recv == nil || isDone(in.recv) {
+			continue
+		}
+		list = append(list, Transfer{ID: key.id, Peer: key.peer, Incoming: true, Bytes: in.recv.Total()})
+	}
+	return list
+}
+
+// Send streams r to the peer, which needs a running TransferManager with Config.OnStream set,
+// until EOF. Returns the number of bytes sent (and acknowledged once there is no error).
+// Sends to a restarting peer (see Server.AnnounceRestart) wait for it to be back. When r is an
+// io.Seeker, a stream interrupted by the peer's restart is sent again from the start once it's back,
+// otherwise the error is ErrPeerRestarting.
+func (t *TransferManager) Send(ctx context.Context, peer Peer, r io.Reader) (int64, error) {
+	seeker, _ := r.(io.Seeker)
+	start := int64(-1)
+	if seeker != nil {
+		if pos, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			start = pos
+		}
+	}
+	for {
+		if err := t.s.WaitRestarted(ctx, peer); err != nil {
+			return 0, err
+		}
+		if start < 0 {
+			return t.send(ctx, peer, r)
+		}
+		// The stream's reading goroutine may still be reading when send returns, it must be done before we seek.
+		attempt := &attemptReader{r: r}
+		n, err := t.send(ctx, peer, attempt)
+		attempt.close()
+		if !errors.Is(err, ErrPeerRestarting) {
+			return n, err
+		}
+		t.s.log.Infof("Stream to %q interrupted after %d bytes by its restart, will resend it once back", peer.Name, n)
+		if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// attemptReader reads from r until closed.
+type attemptReader struct {
+	mu     sync.Mutex
+	r      io.Reader
+	closed bool
+}
+
+func (a *attemptReader) Read(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return a.r.Read(p)
+}
+
+func (a *attemptReader) close() {
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+}
+
+// countingReader counts the bytes read from r (for List).
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// send is one attempt of Send.
+func (t *TransferManager) send(ctx context.Context, peer Peer, r io.Reader) (int64, error) {
+	acks := make(chan []byte, txfer.DefaultMaxWindow)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	t.mu.Lock()
+	if !t.running {
+		t.mu.Unlock()
+		return 0, ErrNotRunning
+	}
+	id := rand.Uint32() //nolint:gosec // not cryptographic, just to tell streams apart.
+	for t.acks[id] != nil {
+		id = rand.Uint32() //nolint:gosec // same.
+	}
+	t.acks[id] = acks
+	read := &atomic.Int64{}
+	t.sending[id] = outgoingStream{peer: peer, cancel: cancel, read: read}
+	t.wg.Add(1)
+	life := t.life
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.acks, id)
+		delete(t.sending, id)
+		t.mu.Unlock()
+		t.wg.Done()
+	}()
+	defer context.AfterFunc(life, func() { cancel(nil) })()
+	s := t.s
+	sender := &txfer.StreamSender{
+		ID:        id,
+		FrameSize: s.MaxDataSize(peer),
+		Send: func(frame []byte) error {
+			return s.SendData(peer, frame)
+		},
+		SendBatch: func(frames [][]byte) error {
+			return s.SendDataBatch(peer, frames)
+		},
+		Hash:       DefaultStreamHash,
+		Congestion: txfer.NewAIMD(0),
+		Acks:       acks,
+	}
+	t.s.log.LogVf("Sending stream %d to %q", id, peer.Name)
+	n, err := sender.Copy(ctx, countingReader{r: r, n: read})
+	if err != nil && errors.Is(context.Cause(ctx), ErrPeerRestarting) {
+		err = ErrPeerRestarting
+	}
+	return n, err
+}
+
+// pause interrupts the Sends to the restarting peer (to be resumed by Send).
+func (t *TransferManager) pause(peer Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, out := range t.sending {
+		if out.peer == peer {
+			out.cancel(ErrPeerRestarting)
+		}
+	}
+}
+
+// handle processes the stream frames (from the unicast receive goroutine), returns false if data
+// isn't for us.
+func (t *TransferManager) handle(peer Peer, data []byte) bool {
+	id, ok := txfer.StreamID(data)
+	if !ok {
+		return false
+	}
+	t.mu.Lock()
+	if !t.running {
+		t.mu.Unlock()
+		return false
+	}
+	if txfer.IsStreamAck(data) {
+		acks, ok := t.acks[id]
+		t.mu.Unlock()
+		if ok {
+			select {
+			case acks <- append([]byte(nil), data...):
+			default: // same as a lost ack.
+			}
+		}
+		return ok
+	}
+	onStream := t.s.OnStream
+	if onStream == nil {
+		t.mu.Unlock()
+		return false
+	}
+	key := streamKey{peer: peer, id: id}
+	in, ok := t.incoming[key]
+	now := time.Now()
+	if !ok {
+		abandoned := t.sweep(now)
+		in = &incomingStream{}
+		t.incoming[key] = in
+		t.mu.Unlock()
+		for k, recv := range abandoned {
+			t.done(k, recv, ErrStreamTimeout)
+		}
+		var recv *txfer.StreamReceiver
+		if w := onStream(peer, id); w != nil {
+			recv = txfer.NewStreamReceiver(w)
+			recv.Hash = DefaultStreamHash
+			recv.Ack = func(frame []byte) error {
+				return t.s.SendData(peer, frame)
+			}
+		}
+		t.mu.Lock()
+		in.recv = recv
+	}
+	in.last = now
+	recv := in.recv
+	t.mu.Unlock()
+	if recv == nil || isDone(recv) {
+		return true // ignored stream or late (repeated end) frames.
+	}
+	_ = recv.Receive(data) // errors are reported once done.
+	if isDone(recv) {
+		t.done(key, recv, recv.Err())
+	}
+	return true
+}
+
+func isDone(recv *txfer.StreamReceiver) bool {
+	select {
+	case <-recv.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// sweep forgets the incoming streams without frames for StreamTimeout (finished ones are kept
+// until then to ignore their late frames) and returns the unfinished ones. Must be called with mu held.
+func (t *TransferManager) sweep(now time.Time) map[streamKey]*txfer.StreamReceiver {
+	var abandoned map[streamKey]*txfer.StreamReceiver
+	for key, in := range t.incoming {
+		if now.Sub(in.last) <= StreamTimeout {
+			continue
+		}
+		delete(t.incoming, key)
+		if in.recv != nil && !isDone(in.recv) {
+			if abandoned == nil {
+				abandoned = make(map[streamKey]*txfer.StreamReceiver)
+			}
+			abandoned[key] = in.recv
+		}
+	}
+	return abandoned
+}
+
+// done calls OnStreamDone, if set, for an unfinished or just finished stream.
+func (t *TransferManager) done(key streamKey, recv *txfer.StreamReceiver, err error) {
+	if recv == nil || t.s.OnStreamDone == nil {
+		return
+	}
+	t.s.OnStreamDone(key.peer, key.id, recv.Total(), err)
+}
@@ -0,0 +1,118 @@
+package tsnet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Transport is what is needed from a datagram socket. It's implemented by *net.UDPConn
+// and by MemTransport (in memory, for tests and benchmarks).
+type Transport interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+var _ Transport = (*net.UDPConn)(nil)
+
+// DefaultMemQueueSize is how many datagrams a MemTransport buffers before dropping (like a socket buffer).
+const DefaultMemQueueSize = 1024
+
+// MemNetwork is an in memory network connecting MemTransports by address.
+type MemNetwork struct {
+	QueueSize int // per transport, DefaultMemQueueSize if 0
+	mu        sync.Mutex
+	conns     map[string]*MemTransport
+	nextPort  int
+}
+
+// NewMemNetwork returns a new, empty, in memory network.
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{conns: make(map[string]*MemTransport), nextPort: 10000}
+}
+
+type memPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// MemTransport is an in memory Transport, see MemNetwork.
+type MemTransport struct {
+	network   *MemNetwork
+	addr      *net.UDPAddr
+	in        chan memPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen returns a new transport on the network, with a 127.0.0.1 address and unique port.
+func (n *MemNetwork) Listen() *MemTransport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	size := n.QueueSize
+	if size <= 0 {
+		size = DefaultMemQueueSize
+	}
+	t := &MemTransport{
+		network: n,
+		addr:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: n.nextPort},
+		in:      make(chan memPacket, size),
+		closed:  make(chan struct{}),
+	}
+	n.nextPort++
+	n.conns[t.addr.String()] = t
+	return t
+}
+
+// ReadFromUDP blocks until a datagram is received or the transport is closed.
+func (t *MemTransport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case p := <-t.in:
+		return copy(b, p.data), p.from, nil
+	case <-t.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteToUDP sends a copy of b to addr. Like UDP, datagrams to unknown addresses or to full
+// queues are silently dropped.
+func (t *MemTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	t.network.mu.Lock()
+	dest, ok := t.network.conns[addr.String()]
+	t.network.mu.Unlock()
+	if !ok {
+		return len(b), nil
+	}
+	select {
+	case dest.in <- memPacket{data: append([]byte(nil), b...), from: t.addr}:
+	default:
+	}
+	return len(b), nil
+}
+
+// LocalAddr returns the transport's address.
+func (t *MemTransport) LocalAddr() net.Addr {
+	return t.addr
+}
+
+// Close removes the transport from the network and unblocks pending reads.
+func (t *MemTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.network.mu.Lock()
+		delete(t.network.conns, t.addr.String())
+		t.network.mu.Unlock()
+		close(t.closed)
+	})
+	return nil
+}
+
+func (t *MemTransport) String() string {
+	return fmt.Sprintf("mem:%v", t.addr)
+}
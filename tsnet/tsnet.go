@@ -2,21 +2,22 @@
 package tsnet
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand/v2"
 	"net"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"fortio.org/log"
 	"fortio.org/smap"
 	"fortio.org/tsync/tcrypto"
-	"golang.org/x/net/ipv4"
 )
 
 const (
@@ -46,6 +47,137 @@ type Config struct {
 	Identity              *tcrypto.Identity // long term identity for this server
 	BaseBroadcastInterval time.Duration     // default to 1.5s if 0
 	PeerTimeout           time.Duration     // default to 10s if 0
+	// Callback called with the (signature verified or decrypted) payload of data messages received
+	// from known peers. Called from the unicast receive goroutine or the TCP and QUIC stream readers,
+	// one at a time, must not block for long and must copy data if it needs to keep it.
+	OnData func(peer Peer, data []byte)
+	// Optional wrapper for the unicast socket (which also sends the multicast announcements),
+	// e.g. to inject faults with NewChaosTransport. Batched I/O is disabled when set.
+	WrapTransport func(t Transport) Transport
+	// Don't start the multicast Discovery in Start: peers must then be added with AddPeer
+	// (or found by ServiceDiscovery, see MDNS).
+	NoDiscovery bool
+	// Optional callback called (from the unicast receive goroutine) for each new incoming stream
+	// (see TransferManager), returning where to write it or nil to ignore that stream.
+	// When set, all the stream frames are handled by the Transfers instead of being passed to OnData.
+	OnStream func(peer Peer, id uint32) io.Writer
+	// Optional callback called once an incoming stream is done, err is nil when it was fully
+	// received and verified.
+	OnStreamDone func(peer Peer, id uint32, n int64, err error)
+	// Logger to use instead of the fortio.org/log globals (e.g. NoLogger), nil for the default.
+	Logger Logger
+	// Connect requests per second above which requesters must echo a stateless cookie first
+	// (see CookieMessageFormat), 0 for DefaultCookieThreshold, negative to always require it.
+	CookieThreshold int
+	// Optional callback called with each failed connection, handshake or trust attempt (see Server.RecordFailure),
+	// e.g. to write an audit log. Must not block for long.
+	OnAudit func(event AuditEvent)
+	// Failed attempts within FailureWindow after which the source IP and public key are banned,
+	// 0 for DefaultMaxFailures.
+	MaxFailures int
+	// Also start the mDNS/DNS-SD ServiceDiscovery in Start (alone with NoDiscovery), for
+	// networks filtering the Mcast group but not mDNS.
+	MDNS bool
+	// Optional callback deciding whether to accept a connection request from a known peer: a non nil
+	// error rejects it, the error being the reason sent back. All are accepted when not set.
+	// Called from the unicast receive goroutine, must not block for long.
+	OnConnectRequest func(peer Peer) error
+	// Optional callback called when a connection request of ours failed: the peer rejected it, with
+	// the reason it sent back (e.g. its OnConnectRequest error), or its reply didn't verify. The
+	// reason is also kept in the peer's PeerData.Reason. Must not block for long.
+	OnReject func(peer Peer, reason string)
+	// How the data of connected peers is carried, UDPTransport by default. With TCPTransport the
+	// TCPListener is started too and Connect dials a TCP stream once the peer accepted, with
+	// QUICTransport it's the QUICListener and a QUIC connection.
+	Transport TransportKind
+	// How long to wait for the peer's next handshake step before sending our last message again,
+	// doubling after each retransmission, 0 for DefaultRetransmitTimeout.
+	RetransmitTimeout time.Duration
+	// How old (or far in the future, for clock skew) a discovery message can be before it's rejected
+	// as replayed, 0 for DefaultDiscoveryMaxAge. Peers' clocks must agree within it.
+	DiscoveryMaxAge time.Duration
+	// Address (host:port) of a reachable tsync running with RendezvousServer, through which peers
+	// behind NATs or on other subnets find and punch holes to each other (see NATTraversal, started
+	// when set).
+	Rendezvous string
+	// Act as rendezvous: answer the registrations and introduction requests of the peers using us
+	// as their Rendezvous.
+	RendezvousServer bool
+	// Names of the peers to punch holes to through the Rendezvous (see NATTraversal.Punch).
+	PunchPeers []string
+	// Interval of the registrations with the Rendezvous and of the holes keeping the NAT mappings
+	// to the punched peers open, 0 for DefaultNATKeepalive.
+	NATKeepalive time.Duration
+	// Addresses (ip or host, with a :port when their discovery Port isn't ours) of peers Discovery
+	// also sends our announcements to, unicast, for networks where multicast is blocked. They answer
+	// with theirs (see SeedMessagePrefix), so only one side needs the other's address.
+	StaticPeers []string
+	// As rendezvous, also forward the datagrams between registered peers using Relay.
+	RelayServer bool
+	// Send the datagrams to the punched peers our holes don't get through to (after RelayAfter)
+	// through the Rendezvous, which must run with RelayServer; the peer needs Relay too.
+	Relay bool
+	// Ask the gateway (NAT-PMP, then UPnP IGD) to forward a port of its external address to our
+	// unicast socket, so the peers outside of our network reach us directly (see PortMapper).
+	PortMapping bool
+	// NAT-PMP address (ip[:port], NATPMPPort by default) of the gateway for PortMapping, the default
+	// route's gateway if empty.
+	Gateway string
+	// STUN servers (host[:port], DefaultSTUNPort by default) to learn our external address from, sent
+	// signed to the Rendezvous so the peers it introduces us to also try it (see STUNClient).
+	STUNServers []string
+	// Port of the unicast socket, 0 for an ephemeral one. A rendezvous needs a known one, see
+	// DefaultRendezvousPort.
+	ListenPort int
+	// When to also send our announcements to the broadcast addresses, for the networks dropping
+	// multicast (see BroadcastMode), off by default.
+	Broadcast BroadcastMode
+	// Encoding of the direct messages we send, WireText by default for the older peers (the
+	// received ones are decoded in either format).
+	Wire WireFormat
+	// Drop the direct messages without authentication trailer (see AuthSignatureFormat) instead of
+	// accepting them from the older peers.
+	RequireAuth bool
+	// Only exchange data with the Connected peers, through the encrypted session: SendData and
+	// SendDataBatch fail with ErrNotEncrypted instead of sending signed plaintext, and the received
+	// plaintext data messages are dropped.
+	RequireEncryption bool
+	// The key exchanges of the connection handshakes, in order of preference (see CapKex):
+	// tcrypto.DefaultKex if empty, tcrypto.HybridKex to prefer the post quantum hybrid.
+	KeyExchanges []tcrypto.KexAlgo
+	// Advertise (in the discovery messages, mDNS and to the Rendezvous) and use on the wire only a
+	// salted hash of Name (see tcrypto.HideName), so observers can't list the machines' names. It's
+	// revealed, sealed, to each peer once connected (see RevealMessageFormat), see RealName.
+	PrivateName bool
+	// How often the Connected peers are pinged, 0 for DefaultKeepaliveInterval, negative for never.
+	// Those not answering for MaxMissedKeepalives intervals become Disconnected.
+	KeepaliveInterval time.Duration
+	// Optional callback called when a Connected peer stopped answering our keepalives (it's then
+	// Disconnected) or left (it's then removed, see LeaveMessage). Must not block for long.
+	OnDisconnect func(peer Peer)
+	// Name of the network interface to use (multicast group membership and unicast socket address)
+	// instead of the one reaching Target, for air-gapped or multi-homed hosts. It must be up and have
+	// an IPv4 address. Exclusive with AllInterfaces.
+	Interface string
+	// Announce us and listen for the announcements on every up, multicast capable interface (but the
+	// loopback) instead of only the one reaching Target, for hosts on several networks (Ethernet and
+	// Wi-Fi, VPN and LAN). The unicast socket then listens on all our addresses.
+	AllInterfaces bool
+	// Also talk to the servers of the same host (other profiles, other users with LocalShared)
+	// through Unix datagram sockets in LocalDir instead of UDP: faster, and they find each other even when the multicast
+	// loopback doesn't work. Not supported on Windows (falls back to UDP).
+	LocalSocket bool
+	// Directory of the LocalSocket sockets, shared by the servers using the same discovery Port,
+	// DefaultLocalDir/tsync-<Port> if empty. It must be owned by root or us and, when others can
+	// write in it, sticky.
+	LocalDir string
+	// Let the servers of the other users send to our LocalSocket (0666 instead of 0600, only the
+	// servers of our user otherwise).
+	LocalShared bool
+	// Discovery and control messages per second accepted from each source IP, the extra ones being
+	// dropped (see Stats.RateLimited), 0 for DefaultRateLimit, negative for no limit. The data of
+	// known peers and the relay datagrams of registered peers or our rendezvous aren't limited.
+	RateLimit int
 }
 
 type ConnectionStatus int
@@ -53,30 +185,84 @@ type ConnectionStatus int
 const (
 	// NotLinked is the initial state once discovered.
 	NotLinked ConnectionStatus = iota
-	// SentConn is the state when a connection is being established.
+	// SentConn is the state when a connection is being established (request sent, waiting for
+	// the peer's accept or reject).
 	SentConn
-	// ReceivedConn is the state when a connection request has been received.
+	// ReceivedConn is the state when a connection request has been received (while deciding
+	// whether to accept it, see Config.OnConnectRequest).
 	ReceivedConn
-	// Connected is the state when a connection has been established.
+	// Connected is the state when a connection has been established: we accepted the peer's request
+	// or it accepted ours.
 	Connected
-	// Failed is the state when a connection has failed.
+	// Failed is the state when a connection has failed: sending the request failed or it was rejected
+	// (by either side).
 	Failed
+	// Restarting is the state of a peer which announced it's restarting (see AnnounceRestart).
+	Restarting
+	// Unreachable is the state when the peer didn't answer our connection request, even after
+	// retransmitting it (see MaxRetransmits).
+	Unreachable
+	// Disconnected is the state when a Connected peer stopped answering our keepalives (see
+	// Config.KeepaliveInterval); connecting again is needed.
+	Disconnected
 )
 
 type Server struct {
 	// Our copy of the input config.
 	Config
 	// internal state
-	ourSendAddr     *net.UDPAddr
-	destAddr        *net.UDPAddr
-	broadcastListen *net.UDPConn
-	dualUDPSock     *net.UDPConn // used for both sending (to multicast/unicast) and receiving (unicast)
-	cancel          context.CancelFunc
-	wg              sync.WaitGroup
-	Peers           *smap.Map[Peer, PeerData]
-	Sources         *smap.Map[Source, Peer] // maps ip,port to peer
-	idStr           string
-	epoch           atomic.Int32 // set to negative when stopped, panics after 2B ticks/if it wraps.
+	ourSendAddr *net.UDPAddr
+	destAddr    *net.UDPAddr
+	dualUDPSock *net.UDPConn // used for both sending (to multicast/unicast) and receiving (unicast)
+	Peers       *smap.Map[Peer, PeerData]
+	Sources     *smap.Map[Source, Peer] // maps ip,port to peer
+	idStr       string
+	epoch       atomic.Int32 // set to negative when stopped, panics after 2B ticks/if it wraps.
+	// Batched I/O on dualUDPSock
+	batch *BatchConn
+	// dualUDPSock or its WrapTransport wrapper, counted (see Stats) and possibly relayed.
+	transport Transport
+	// Resources tracking (see Resources and CheckReleased)
+	goroutines atomic.Int32
+	sockets    atomic.Int32
+	tickers    atomic.Int32
+	// Components started by Start (in that order) and stopped, in reverse order, by Stop.
+	Listener    *Listener
+	Connections *ConnectionManager
+	Transfers   *TransferManager
+	Discovery   *Discovery
+	// Started after Discovery when Config.MDNS is set.
+	ServiceDiscovery *ServiceDiscovery
+	// Started after Transfers when Config.Transport is TCPTransport.
+	TCPListener *TCPListener
+	// Started after Transfers when Config.Transport is QUICTransport.
+	QUICListener *QUICListener
+	// Started after those when Config.PortMapping is set.
+	PortMap *PortMapper
+	// Started after those when Config.STUNServers is set.
+	STUN *STUNClient
+	// Started after those when Config.Rendezvous is set.
+	NAT *NATTraversal
+	// Serializes the data passed to the Transfers and OnData (see deliver).
+	deliverMu sync.Mutex
+	// Config.Logger's functions, or fortio.org/log ones.
+	log logFuncs
+	// Number of unicast datagrams received (see UnicastReceived)
+	unicastReceived atomic.Int64
+	// Failed attempts and bans (see RecordFailure)
+	attempts attempts
+	// Nonces of the discovery messages received (see checkReplay)
+	replays replayGuard
+	// Fingerprint commitments of the discovery messages received (see checkCommitment)
+	commitments commitments
+	// Our name when Config.PrivateName hides it (see RealName)
+	realName string
+	// Versions of the peers' changes and removals (see PeersSince)
+	peerVersions peerVersions
+	// Traffic counters (see Stats)
+	traffic traffic
+	// Token buckets of the sources (see Config.RateLimit)
+	limiter rateLimiter
 }
 
 type Source struct {
@@ -96,24 +282,53 @@ type PeerData struct {
 	Epoch     int32
 	LastSeen  time.Time
 	Status    ConnectionStatus
+	MTU       int // probed MTU (see ProbeMTU), 0 if not probed yet
+	// Until when the peer is expected back after announcing a restart, zero when not restarting.
+	RestartUntil time.Time
+	// The other addresses the peer (same name and public key) announced itself from, when it's on
+	// several of our networks. Messages from them are its, we send to the best one (see peerAddr).
+	Addrs []PeerAddr
+	// Why our last connection request to the peer failed (see Config.OnReject), empty otherwise.
+	Reason string
+	// The name of a peer advertising a hidden one (see Config.PrivateName), once it revealed it.
+	RealName string
 }
 
 func (c *Config) NewServer() *Server {
-	return &Server{
+	s := &Server{
 		Config:  *c,
 		Peers:   smap.New[Peer, PeerData](),
 		Sources: smap.New[Source, Peer](),
+		log:     newLogFuncs(c.Logger),
 	}
+	s.Listener = &Listener{s: s}
+	s.Connections = &ConnectionManager{s: s}
+	s.Transfers = &TransferManager{s: s}
+	s.Discovery = &Discovery{s: s}
+	s.ServiceDiscovery = &ServiceDiscovery{s: s}
+	s.TCPListener = &TCPListener{dataStreams: dataStreams{s: s, kind: "TCP"}}
+	s.QUICListener = &QUICListener{dataStreams: dataStreams{s: s, kind: "QUIC"}}
+	s.PortMap = &PortMapper{s: s}
+	s.STUN = &STUNClient{s: s}
+	s.NAT = &NATTraversal{s: s}
+	return s
 }
 
-func (s *Server) Start(ctx context.Context) error {
+// setDefaults fills in the defaults of the configuration (needed by each component's Start).
+func (s *Server) setDefaults() error {
 	s.idStr = s.Identity.PublicKeyToString()
-	var err error
 	if s.Name == "" {
-		s.Name, err = os.Hostname()
+		name, err := os.Hostname()
 		if err != nil {
 			return err
 		}
+		s.Name = name
+	}
+	if s.PrivateName && s.realName == "" {
+		s.realName, s.Name = s.Name, tcrypto.HideName(s.Name)
+	}
+	if len(s.KeyExchanges) == 0 {
+		s.KeyExchanges = tcrypto.DefaultKex
 	}
 	if s.BaseBroadcastInterval <= 0 {
 		s.BaseBroadcastInterval = DefaultBroadcastInterval
@@ -121,101 +336,124 @@ func (s *Server) Start(ctx context.Context) error {
 	if s.PeerTimeout <= 0 {
 		s.PeerTimeout = DefaultPeerTimeout
 	}
+	if s.Interface != "" && s.AllInterfaces {
+		return fmt.Errorf("interface %q and all interfaces are exclusive", s.Interface)
+	}
 	if s.Target == "" {
 		s.Target = DefaultTarget
 	}
 	if strings.IndexByte(s.Target, ':') < 0 {
 		s.Target += ":53" // default to dns port (even though we don't really use the port for target)
 	}
-	addr := fmt.Sprintf("%s:%d", s.Mcast, s.Port)
-	s.destAddr, err = net.ResolveUDPAddr("udp4", addr)
-	if err != nil {
+	return nil
+}
+
+// Start starts the Listener, Connections, Transfers, PortMap if Config.PortMapping is set, STUN if
+// Config.STUNServers is set, NAT if Config.Rendezvous is set and, unless Config.NoDiscovery is set,
+// Discovery, then ServiceDiscovery if Config.MDNS is set.
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.setDefaults(); err != nil {
 		return err
 	}
-	log.Infof("Starting tsync server %q on %s -> %s", s.Name, addr, s.destAddr)
-	// Try to get the right interface to listen on
-	goodIf, localIP, err := GetInternetInterface(ctx, s.Target)
-	if err != nil {
-		log.Warnf("Could not get default route interface using %q as test destination, will listen on all: %v", s.Target, err)
-	} else {
-		log.Infof("Using interface %q for multicast (with local IP %v)", goodIf.Name, localIP)
+	s.log.Infof("Starting tsync server %q (discovery %v, mDNS %v)", s.Name, !s.NoDiscovery, s.MDNS)
+	components := []Component{s.Listener, s.Connections, s.Transfers}
+	switch s.Transport {
+	case TCPTransport:
+		components = append(components, s.TCPListener)
+	case QUICTransport:
+		components = append(components, s.QUICListener)
+	case UDPTransport:
 	}
-	s.broadcastListen, err = net.ListenMulticastUDP("udp4", goodIf, s.destAddr)
-	if err != nil {
-		return err
+	if s.PortMapping {
+		components = append(components, s.PortMap)
 	}
-	// Enable multicast loopback so we can see our own packets (needed on Windows)
-	p := ipv4.NewPacketConn(s.broadcastListen)
-	if err = p.SetMulticastLoopback(true); err != nil {
-		log.Warnf("Failed to enable multicast loopback: %v", err)
+	if len(s.STUNServers) > 0 {
+		components = append(components, s.STUN)
 	}
-	s.dualUDPSock, err = net.ListenUDP("udp4", localIP) // was net.DialUDP("udp4", localIP, s.destAddr)
-	if err != nil {
-		s.broadcastListen.Close()
-		return err
+	if s.Rendezvous != "" {
+		components = append(components, s.NAT)
+	}
+	if !s.NoDiscovery {
+		components = append(components, s.Discovery)
+	}
+	if s.MDNS {
+		components = append(components, s.ServiceDiscovery)
+	}
+	for i, c := range components {
+		if err := c.Start(ctx); err != nil {
+			for _, started := range slices.Backward(components[:i]) {
+				started.Stop()
+			}
+			return err
+		}
 	}
-	s.ourSendAddr = s.dualUDPSock.LocalAddr().(*net.UDPAddr)
-	log.Infof("Sockets created - unicast: %s, multicast listen: %s",
-		s.ourSendAddr, s.broadcastListen.LocalAddr())
-
-	// get a cancelable context
-	ctx, s.cancel = context.WithCancel(ctx)
-	s.wg.Add(3) // broadcast sender, multicast receiver, and unicast receiver
-	go s.runAdv(ctx)
-	go s.runMulticastReceive(ctx)
-	go s.runUnicastReceive(ctx)
 	return nil
 }
 
+// Stop tells the peers we're leaving (see LeaveMessage) and stops all the components, in reverse
+// order of Start. A stopped server can only be started again with Restart.
 func (s *Server) Stop() {
 	if s.Stopped() {
 		return
 	}
+	s.sayGoodbye()
 	s.epoch.Store(epochStopMarker)
-	if s.cancel == nil {
-		return
-	}
-	s.cancel()
-	s.cancel = nil
-	s.broadcastListen.Close() // needed or write will block forever
-	s.dualUDPSock.Close()
-	s.wg.Wait()
+	s.ServiceDiscovery.Stop()
+	s.Discovery.Stop()
+	s.NAT.Stop()
+	s.STUN.Stop()
+	s.PortMap.Stop()
+	s.QUICListener.Stop()
+	s.TCPListener.Stop()
+	s.Transfers.Stop()
+	s.Connections.Stop()
+	s.Listener.Stop()
 }
 
 func (s *Server) Stopped() bool {
 	return s.epoch.Load() < 0 // we may stop with -999 and some extra Add(1) happens but stays negative.
 }
 
-func (s *Server) runAdv(ctx context.Context) {
-	defer s.wg.Done()
+func (d *Discovery) runAdv(ctx context.Context) {
+	s := d.s
+	defer d.wg.Done()
+	defer s.goroutines.Add(-1)
 	// broadcast interval + 1-1023 msec jitter
 	jitter := 1 + rand.IntN(1024) //nolint:gosec // not cryptographic
 	interval := s.BaseBroadcastInterval + time.Duration(jitter)*time.Millisecond
 	ticker := time.NewTicker(interval)
-	log.Infof("Starting tsync broadcast sender %q (%v) with %v interval (jitter %d ms)",
+	s.tickers.Add(1)
+	s.log.Infof("Starting tsync broadcast sender %q (%v) with %v interval (jitter %d ms)",
 		s.Name, s.ourSendAddr, interval, jitter)
-	defer ticker.Stop()
+	defer func() {
+		ticker.Stop()
+		s.tickers.Add(-1)
+	}()
 	epoch := s.epoch.Load()
 	for {
 		select {
 		case <-ctx.Done():
-			log.Infof("Exiting tsync sender %q after %d ticks (%v)", s.Name, epoch, ctx.Err())
+			s.log.Infof("Exiting tsync sender %q after %d ticks (%v)", s.Name, epoch, ctx.Err())
 			return
 		case <-ticker.C:
 			newEpoch := s.epoch.Add(1)
-			log.LogVf("Tick %d -> %d", epoch, newEpoch)
+			s.log.LogVf("Tick %d -> %d", epoch, newEpoch)
 			if newEpoch < epochStopMarker {
 				panic("ticks wrapped, server ran for over 2B ticks??")
 			}
 			if newEpoch < 0 {
-				log.Infof("Server stopped, not sending message")
+				s.log.Infof("Server stopped, not sending message")
 				return
 			}
 			epoch = newEpoch
-			err := s.MCastMessageSend(epoch)
-			if err != nil {
-				log.Errf("Error sending UDP packet: %v", err)
+			if !d.noMulticast {
+				if err := s.MCastMessageSend(epoch); err != nil {
+					s.log.Errf("Error sending UDP packet: %v", err)
+				}
 			}
+			d.sendBroadcasts(epoch)
+			d.sendSeeds(epoch)
+			s.Listener.announceLocal(epoch)
 			// Run some cleanup/expire entries
 			s.PeersCleanup()
 		}
@@ -227,17 +465,26 @@ func (s *Server) PeersCleanup() {
 	var toDeleteSources []Source
 	now := time.Now()
 	for peer, data := range s.Peers.All() {
-		if now.Sub(data.LastSeen) > s.PeerTimeout {
+		if now.Sub(data.LastSeen) > s.PeerTimeout && now.After(data.RestartUntil) {
 			toDelete = append(toDelete, peer)
-			src := Source{IP: peer.IP, Port: data.Port}
-			toDeleteSources = append(toDeleteSources, src)
+			toDeleteSources = append(toDeleteSources, peerSources(peer, data)...)
+		} else if len(data.Addrs) > 0 {
+			s.Sources.Delete(s.expireAddrs(peer, data, now)...)
 		}
 	}
 	if len(toDelete) > 0 {
-		log.Infof("Removing %d expired peers: %v", len(toDelete), toDelete)
-		s.Peers.Delete(toDelete...)
+		s.log.Infof("Removing %d expired peers: %v", len(toDelete), toDelete)
+		s.deletePeers(toDelete...)
 		s.Sources.Delete(toDeleteSources...) // TODO share lock/transaction.
+		s.Connections.dropSessions(toDelete...)
 	}
+	s.expireCommitments(now.Add(-s.PeerTimeout))
+}
+
+// UnicastReceived returns how many unicast datagrams (from any source) we received so far,
+// 0 while peers are discovered usually means inbound UDP is blocked by a firewall.
+func (s *Server) UnicastReceived() int64 {
+	return s.unicastReceived.Load()
 }
 
 func (s *Server) OurAddress() *net.UDPAddr {
@@ -250,119 +497,210 @@ func (s *Server) change(version uint64) {
 	}
 }
 
+// readBatch reads from the transport, in batches unless it's wrapped.
+func (s *Server) readBatch(msgs []Datagram) (int, error) {
+	if s.WrapTransport == nil {
+		return s.batch.ReadBatch(msgs)
+	}
+	n, addr, err := s.transport.ReadFromUDP(msgs[0].Buf)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].N, msgs[0].Addr = n, addr
+	return 1, nil
+}
+
 // runUnicastReceive handles incoming unicast messages (direct peer connections).
-func (s *Server) runUnicastReceive(ctx context.Context) {
-	defer s.wg.Done()
-	buf := make([]byte, BufSize)
-	log.Infof("Starting unicast receiver %q on %s with %d bytes buffer",
-		s.Name, s.dualUDPSock.LocalAddr(), BufSize)
+func (l *Listener) runUnicastReceive(ctx context.Context) {
+	s := l.s
+	defer l.wg.Done()
+	defer s.goroutines.Add(-1)
+	msgs := NewDatagrams(ReadBatchSize, MaxDatagramSize)
+	s.log.Infof("Starting unicast receiver %q on %s with %dx%d bytes buffers",
+		s.Name, s.dualUDPSock.LocalAddr(), ReadBatchSize, MaxDatagramSize)
 	for {
 		select {
 		case <-ctx.Done():
-			log.Infof("Exiting unicast receiver after %v", ctx.Err())
+			s.log.Infof("Exiting unicast receiver after %v", ctx.Err())
 			return
 		default:
-			// we rely on Stop() closing the socket to unblock ReadFromUDP on exit.
-			n, addr, err := s.dualUDPSock.ReadFromUDP(buf)
+			// we rely on Stop() closing the socket to unblock ReadBatch on exit.
+			count, err := s.readBatch(msgs)
 			if err != nil {
 				if ctx.Err() != nil {
-					log.Infof("Normal unicast read error on exit: %v", err)
+					s.log.Infof("Normal unicast read error on exit: %v", err)
 				} else {
-					log.Errf("Error receiving unicast packet: %v", err)
+					s.log.Errf("Error receiving unicast packet: %v", err)
 				}
 				continue
 			}
-			// Unicast messages are always from other peers, never from ourselves
-			log.LogVf("Received unicast message %d bytes from %v: %q", n, addr, buf[:n])
-			// Process as direct message
-			s.handleDirectMessage(buf[:n], addr)
+			s.unicastReceived.Add(int64(count))
+			for _, msg := range msgs[:count] {
+				buf := msg.Buf[:msg.N]
+				// Unicast messages are always from other peers, never from ourselves
+				s.countDatagram(false, isDiscovery(buf), msg.N, msg.Addr)
+				if s.rateLimited(buf, msg.Addr) {
+					continue
+				}
+				s.log.LogVf("Received unicast message %d bytes from %v: %q", msg.N, msg.Addr, buf)
+				// Process as direct message
+				s.handleDirectMessage(buf, msg.Addr)
+			}
 		}
 	}
 }
 
-func (s *Server) runMulticastReceive(ctx context.Context) {
-	defer s.wg.Done()
+func (d *Discovery) runMulticastReceive(ctx context.Context) {
+	s := d.s
+	defer d.wg.Done()
+	defer s.goroutines.Add(-1)
 	buf := make([]byte, BufSize)
-	log.Infof("Starting tsync broadcast receiver %q on %s with %d bytes buffer",
-		s.Name, s.broadcastListen.LocalAddr(), BufSize)
+	s.log.Infof("Starting tsync broadcast receiver %q on %s with %d bytes buffer",
+		s.Name, d.broadcastListen.LocalAddr(), BufSize)
 	ourAddr := s.ourSendAddr
 	us := Peer{Name: s.Name, IP: ourAddr.IP.String(), PublicKey: s.Identity.PublicKeyToString()}
 	for {
 		select {
 		case <-ctx.Done():
-			log.Infof("Exiting tsync receiver after %v", ctx.Err())
+			s.log.Infof("Exiting tsync receiver after %v", ctx.Err())
 			return
 		default:
 			// we rely on Stop() closing the socket to unblock ReadFromUDP on exit.
-			n, addr, err := s.broadcastListen.ReadFromUDP(buf)
+			n, addr, err := d.broadcastListen.ReadFromUDP(buf)
 			if err != nil {
 				if ctx.Err() != nil {
-					log.Infof("Normal read from closed error on exit: %v", err)
+					s.log.Infof("Normal read from closed error on exit: %v", err)
 				} else {
-					log.Errf("Error receiving UDP packet: %v", err)
+					s.log.Errf("Error receiving UDP packet: %v", err)
 				}
 				continue
 			}
-			if addr.IP.Equal(ourAddr.IP) && addr.Port == ourAddr.Port {
-				log.Debugf("Ignoring our own packet (%q)", buf[:n])
+			if s.isOurAddr(addr.IP, addr.Port) {
+				s.log.Debugf("Ignoring our own packet (%q)", buf[:n])
 				continue
 			}
-			log.LogVf("Received %d bytes from %v: %q", n, addr, buf[:n])
-			name, pubKey, theirEpoch, err := s.MCastMessageDecode(buf[:n])
-			if err != nil {
-				log.Errf("Error decoding UDP packet %q from %v: %v", buf[:n], addr, err)
+			s.countDatagram(false, isDiscovery(buf[:n]), n, addr)
+			if s.rateLimited(buf[:n], addr) {
 				continue
 			}
-			data := PeerData{Port: addr.Port, Epoch: theirEpoch, LastSeen: time.Now()}
-			peer := Peer{Name: name, IP: addr.IP.String(), PublicKey: pubKey}
-			if peer == us {
-				if theirEpoch <= s.epoch.Load() {
-					log.FErrf("Duplicate newer name,ip,pubkey detected... exiting (%v %v)", peer, data)
-					s.Stop()
-				} else {
-					log.Warnf("Duplicate older name,ip,pubkey detected... ignoring - they should exit (%v %v)", peer, data)
-				}
+			s.log.LogVf("Received %d bytes from %v: %q", n, addr, buf[:n])
+			msg, seeded := bytes.CutPrefix(buf[:n], []byte(SeedMessagePrefix))
+			msg, broadcast := bytes.CutPrefix(msg, []byte(BroadcastMessagePrefix))
+			if bytes.HasPrefix(msg, []byte(leaveMessagePrefix)) {
+				s.handleLeave(msg, addr)
 				continue
 			}
-			if v, ok := s.Peers.Get(peer); ok {
-				log.S(log.Verbose, "Already known peer", log.Any("Peer", peer), log.Any("OldData", v), log.Any("NewData", data))
-				// Transfer the human hash (same pub key so same human hash)
-				data.HumanHash = v.HumanHash
-				// as well as the status
-				data.Status = v.Status
-				// Check if this is an updated port
-				if v.Port != data.Port {
-					log.Infof("Peer %q port changed from %d to %d", peer, v.Port, data.Port)
-					data.Status = NotLinked
-					src := Source{IP: peer.IP, Port: v.Port} // old source to delete
-					s.Sources.Delete(src)
-					src.Port = data.Port
-					s.Sources.Set(src, peer)
-				}
-				// Update last seen and epoch
-				s.change(s.Peers.Set(peer, data))
+			a, err := s.decodeDiscovery(msg)
+			var spoofed *tcrypto.SignatureInvalidError
+			if errors.Is(err, ErrReplayed) || errors.As(err, &spoofed) {
+				s.log.Warnf("Ignoring discovery message %q from %v: %v", buf[:n], addr, err)
 				continue
 			}
-			pub, err := tcrypto.IdentityPublicKeyString(peer.PublicKey)
-			data.HumanHash = tcrypto.HumanHash(pub)
 			if err != nil {
-				log.Errf("Failed to decode peer %q public key %q: %v", peer.Name, peer.PublicKey, err)
-				data.HumanHash = "BAD-PKEY"
+				s.log.Errf("Error decoding UDP packet %q from %v: %v", buf[:n], addr, err)
+				continue
+			}
+			data := PeerData{Port: addr.Port, Epoch: a.epoch, LastSeen: time.Now()}
+			peer := Peer{Name: a.name, IP: addr.IP.String(), PublicKey: a.pubKey}
+			s.recordCommitment(peer, a.epoch, a.commitment)
+			s.discovered(peer, data, us)
+			switch {
+			case broadcast:
+				d.heardBroadcast.Store(data.LastSeen.UnixNano())
+			case !seeded:
+				d.heardMulticast.Store(data.LastSeen.UnixNano())
+			}
+			if seeded {
+				d.answerSeed(addr)
 			}
-			nv := s.Peers.Set(peer, data)
-			src := Source{IP: peer.IP, Port: data.Port}
+		}
+	}
+}
+
+// discovered adds or updates the peer from its announcement (received by Discovery or
+// ServiceDiscovery), us being our own Peer.
+func (s *Server) discovered(peer Peer, data PeerData, us Peer) {
+	theirEpoch := data.Epoch
+	if peer == us {
+		if theirEpoch <= s.epoch.Load() {
+			s.log.Errf("Duplicate newer name,ip,pubkey detected... exiting (%v %v)", peer, data)
+			go s.Stop() // not inline as Stop waits for this goroutine.
+		} else {
+			s.log.Warnf("Duplicate older name,ip,pubkey detected... ignoring - they should exit (%v %v)", peer, data)
+		}
+		return
+	}
+	v, ok := s.Peers.Get(peer)
+	if !ok && s.mergeAddr(peer, data) {
+		return
+	}
+	if ok {
+		s.log.LogVf("Already known peer %v old data %+v new data %+v", peer, v, data)
+		// Transfer the human hash (same pub key so same human hash)
+		data.HumanHash = v.HumanHash
+		// as well as the status and MTU
+		data.Status = v.Status
+		data.MTU = v.MTU
+		data.Reason = v.Reason
+		data.RealName = v.RealName
+		data.Addrs = v.Addrs
+		// Restarting peers are back once a new instance announces itself (lower epoch or new port),
+		// until then these are the late announcements of the old one.
+		if !v.RestartUntil.IsZero() {
+			if theirEpoch >= v.Epoch && v.Port == data.Port {
+				data.RestartUntil = v.RestartUntil
+			} else {
+				s.log.Infof("Restarting peer %q is back", peer.Name)
+				data.Status = NotLinked
+			}
+		}
+		// Check if this is an updated port
+		if v.Port != data.Port {
+			s.log.Infof("Peer %q port changed from %d to %d", peer, v.Port, data.Port)
+			data.Status = NotLinked
+			src := Source{IP: peer.IP, Port: v.Port} // old source to delete
+			s.Sources.Delete(src)
+			src.Port = data.Port
 			s.Sources.Set(src, peer)
-			log.S(log.Info, "New peer", log.Any("count", s.Peers.Len()),
-				log.Any("Peer", peer), log.Any("Data", data))
-			s.change(nv)
 		}
+		// Update last seen and epoch
+		s.change(s.setPeer(peer, data))
+		return
 	}
+	s.addPeer(peer, data)
+}
+
+// addPeer records a new peer (and its source) with its human hash.
+func (s *Server) addPeer(peer Peer, data PeerData) {
+	pub, err := tcrypto.IdentityPublicKeyString(peer.PublicKey)
+	data.HumanHash = tcrypto.HumanHash(pub)
+	if err != nil {
+		s.log.Errf("Failed to decode peer %q public key %q: %v", peer.Name, peer.PublicKey, err)
+		data.HumanHash = "BAD-PKEY"
+	}
+	nv := s.setPeer(peer, data)
+	src := Source{IP: peer.IP, Port: data.Port}
+	s.Sources.Set(src, peer)
+	s.log.Infof("New peer (count %d) %v %+v", s.Peers.Len(), peer, data)
+	s.change(nv)
+}
+
+// AddPeer adds a peer known out of band (e.g. when running without Discovery), listening on port.
+// Its PublicKey must be the string form of its identity's public key (see Identity.PublicKeyToString)
+// for its messages to be verified. Peers added while Discovery runs expire like discovered ones,
+// unless they also announce themselves.
+func (s *Server) AddPeer(peer Peer, port int) {
+	s.addPeer(peer, PeerData{Port: port, LastSeen: time.Now()})
 }
 
 // GetInternetInterface returns the interface used to reach a public IP (default route).
 // Windows tend to pick somehow the wrong interface instead of listening to all/correct
 // default one so we try to guess the right one by connecting to an external address.
 func GetInternetInterface(ctx context.Context, target string) (*net.Interface, *net.UDPAddr, error) {
+	return getInternetInterface(ctx, target, defaultLog)
+}
+
+func getInternetInterface(ctx context.Context, target string, lg logFuncs) (*net.Interface, *net.UDPAddr, error) {
 	dialer := net.Dialer{}
 	conn, err := dialer.DialContext(ctx, "udp4", target)
 	if err != nil {
@@ -373,13 +711,13 @@ func GetInternetInterface(ctx context.Context, target string) (*net.Interface, *
 	// clear the port as it's the current port for this test and not something useful to return.
 	localAddr.Port = 0
 	localIP := localAddr.IP
-	log.Debugf("Local address used to reach %q is %v", target, localAddr)
+	lg.Debugf("Local address used to reach %q is %v", target, localAddr)
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return nil, nil, err
 	}
 	for _, iface := range interfaces {
-		log.Debugf("Checking interface %q flags %v", iface.Name, iface.Flags)
+		lg.Debugf("Checking interface %q flags %v", iface.Name, iface.Flags)
 		want := net.FlagUp | net.FlagMulticast | net.FlagRunning
 		if iface.Flags&want != want {
 			continue
@@ -393,7 +731,7 @@ func GetInternetInterface(ctx context.Context, target string) (*net.Interface, *
 			continue
 		}
 		for _, addr := range addrs {
-			log.Debugf("  Checking addr %q", addr.String())
+			lg.Debugf("  Checking addr %q", addr.String())
 			ipnet, ok := addr.(*net.IPNet)
 			if !ok || ipnet.IP == nil || ipnet.IP.To4() == nil {
 				continue
@@ -407,31 +745,70 @@ func GetInternetInterface(ctx context.Context, target string) (*net.Interface, *
 }
 
 const (
-	DiscoveryMessageFormat = "tsync1 %q %s e %d" // name, public key, epoch
-	ConnectMessageFormat   = "connect1 %q %q"    // requester_name, target_name
-	AcceptMessageFormat    = "accept1 %q"        // target_name
-	RejectMessageFormat    = "reject1 %q %q"     // target_name, reason
-	DataMessageFormat      = "data1 %q %s"       // target_name, signed_data
+	DiscoveryMessageFormat = discoveryPayloadFormat + " s %s" // ..., SignDiscovery signature of the payload
+	ConnectMessageFormat   = "connect1 %q %q"                 // requester_name, target_name
+	AcceptMessageFormat    = "accept1 %q %s %s"               // target_name (the requester), key exchange reply, signature
+	RejectMessageFormat    = "reject1 %q %q"                  // target_name (the requester), reason
+	DataMessageFormat      = "data1 %q %s"                    // target_name, signed_data
+
+	// name, public key, epoch, unix time in ms, nonce, fingerprint commitment (see tcrypto.Commitment).
+	discoveryPayloadFormat = "tsync1 %q %s e %d t %d n %s c %s"
 )
 
 func (s *Server) MCastMessageSend(epoch int32) error {
-	payload := fmt.Sprintf(DiscoveryMessageFormat, s.Name, s.idStr, epoch)
-	_, err := s.dualUDPSock.WriteToUDP([]byte(payload), s.destAddr)
-	return err
+	return s.sendMulticast(func() []byte {
+		return s.discoveryMessage(epoch)
+	})
 }
 
+// sendMulticast sends a message from newMsg to the discovery group, on each interface with
+// Config.AllInterfaces: a new one (nonce) for each, as a multi-homed peer receiving them on several
+// interfaces would drop the same one as a replay.
+func (s *Server) sendMulticast(newMsg func() []byte) error {
+	return s.Listener.eachInterface(s.dualUDPSock, func() error {
+		_, err := s.transport.WriteToUDP(newMsg(), s.destAddr)
+		return err
+	})
+}
+
+// announcement is a decoded discovery message (see decodeDiscovery).
+type announcement struct {
+	name, pubKey string
+	epoch        int32
+	commitment   string
+}
+
+// MCastMessageDecode returns the name, public key and epoch of a discovery message, a
+// tcrypto.SignatureInvalidError if it isn't signed by that public key's identity (spoofed) and an
+// ErrReplayed error if it's too old (see Config.DiscoveryMaxAge) or a duplicate of one already received.
 func (s *Server) MCastMessageDecode(buf []byte) (string, string, int32, error) {
-	var name string
-	var pubKeyStr string
-	var epoch int32
-	n, err := fmt.Sscanf(string(buf), DiscoveryMessageFormat, &name, &pubKeyStr, &epoch)
+	a, err := s.decodeDiscovery(buf)
+	return a.name, a.pubKey, a.epoch, err
+}
+
+// decodeDiscovery is MCastMessageDecode also returning the fingerprint commitment.
+func (s *Server) decodeDiscovery(buf []byte) (announcement, error) {
+	var a announcement
+	var unixMilli int64
+	var nonce string
+	var signature string
+	_, err := fmt.Sscanf(string(buf), DiscoveryMessageFormat, &a.name, &a.pubKey, &a.epoch, &unixMilli, &nonce,
+		&a.commitment, &signature)
 	if err != nil {
-		return "", "", 0, err
+		return announcement{}, err
 	}
-	if n != 3 {
-		return "", "", 0, fmt.Errorf("could not decode message %q", string(buf))
+	pub, err := tcrypto.IdentityPublicKeyString(a.pubKey)
+	if err != nil {
+		return announcement{}, err
 	}
-	return name, pubKeyStr, epoch, nil
+	payload := string(buf[:bytes.LastIndex(buf, []byte(" s "))]) // the signature has no spaces.
+	if err = tcrypto.VerifyDiscovery(payload, signature, pub); err != nil {
+		return announcement{}, err
+	}
+	if err = s.checkReplay(unixMilli, nonce); err != nil {
+		return announcement{}, err
+	}
+	return a, nil
 }
 
 // PeerLess sort function for smap.AllSorted.
@@ -458,65 +835,504 @@ func PeerKVSort(a, b smap.KV[Peer, PeerData]) int {
 	return 1
 }
 
-// ConnectToPeer initiates a connection to the specified peer.
+// ConnectToPeer initiates a connection to the specified peer (see ConnectionManager.Connect).
 func (s *Server) ConnectToPeer(peer Peer) error {
+	return s.Connections.Connect(peer)
+}
+
+// Connect initiates a connection to the specified peer.
+func (c *ConnectionManager) Connect(peer Peer) error {
+	if !c.Running() {
+		return fmt.Errorf("connecting to %q: %w", peer.Name, ErrNotRunning)
+	}
+	s := c.s
 	// Get peer's address from discovery data
 	peerData, exists := s.Peers.Get(peer)
 	if !exists {
 		return fmt.Errorf("peer %v not found (anymore) in peer list", peer)
 	}
-	directPeerAddr := &net.UDPAddr{
-		IP:   net.ParseIP(peer.IP),
-		Port: peerData.Port, // use the same port as discovery
-	}
+	directPeerAddr := s.peerAddr(peer, peerData) // use the same port as discovery
 	// Send connection request using shared socket
-	message := fmt.Sprintf(ConnectMessageFormat, s.Name, peer.Name)
-	_, err := s.dualUDPSock.WriteToUDP([]byte(message), directPeerAddr)
+	message := s.connectMessage(peer)
+	_, err := s.transport.WriteToUDP(message, directPeerAddr)
 	if err != nil {
 		peerData.Status = Failed
-		s.Peers.Set(peer, peerData)
+		s.change(s.setPeer(peer, peerData))
 		return err
 	}
 	// Update status to sent = connecting
 	peerData.Status = SentConn
-	s.Peers.Set(peer, peerData)
-	log.Infof("Connection request sent to %s (%s)", peer.Name, peer.IP)
+	peerData.Reason = ""
+	c.mu.Lock()
+	if c.connecting == nil {
+		c.connecting = make(map[Peer]*pendingConnect)
+	}
+	if c.connecting[peer] == nil {
+		c.connecting[peer] = &pendingConnect{done: make(chan struct{})}
+	}
+	c.mu.Unlock()
+	s.change(s.setPeer(peer, peerData))
+	c.expect(peer, directPeerAddr, message) // until the challenge.
+	s.log.Infof("Connection request sent to %s (%s)", peer.Name, peer.IP)
 	return nil
 }
 
 // handleDirectMessage processes incoming direct connection messages.
 func (s *Server) handleDirectMessage(buf []byte, from *net.UDPAddr) {
-	msgStr := string(buf)
-
-	// Try to parse as connection request
-	var requesterName, targetName string
-	if n, err := fmt.Sscanf(msgStr, ConnectMessageFormat, &requesterName, &targetName); err == nil && n == 2 {
-		s.handleConnectionRequest(from, requesterName, targetName)
+	if s.bannedAddr(from) {
+		return
+	}
+	if bytes.HasPrefix(buf, []byte(leaveMessagePrefix)) {
+		s.handleLeave(buf, from)
+		return
+	}
+	if isSTUNMessage(buf) {
+		s.STUN.handleSTUN(from, buf)
+		return
+	}
+	// NAT traversal relaying (followed by the forwarded datagram)
+	if to, payload, ok := cutRelayHeader(buf, relayPrefix); ok {
+		s.NAT.handleRelay(from, to, payload)
+		return
+	}
+	if source, payload, ok := cutRelayHeader(buf, relayedPrefix); ok {
+		s.NAT.handleRelayed(from, source, payload)
+		return
+	}
+	// Or a peer answering our discovery seed (see Config.StaticPeers)
+	if bytes.HasPrefix(buf, []byte(discoveryMessagePrefix)) {
+		if s.Discovery.Running() {
+			s.handleSeedAnswer(buf, from)
+		}
 		return
 	}
 
-	log.Warnf("Unknown direct message format from %v: %q", from, msgStr)
+	msg, err := DecodeMessage(buf)
+	if err != nil {
+		s.log.Warnf("Unknown direct message format from %v: %q (%v)", from, buf, err)
+		return
+	}
+	if !s.authenticated(msg, buf, from) {
+		return
+	}
+	switch m := msg.(type) {
+	// Connection requests
+	case *ConnectMessage:
+		if s.Connections.Running() && s.Connections.checkCookie(from, m.Cookie, len(buf)) {
+			s.Connections.handleConnectionRequest(from, m.Requester, m.Target)
+		}
+	case *AcceptMessage:
+		if s.Connections.Running() {
+			s.Connections.handleConnectionReply(from, m.Target, true, "", m.KexReply, m.Signature, m.QUICPort)
+		}
+	case *RejectMessage:
+		if s.Connections.Running() {
+			s.Connections.handleConnectionReply(from, m.Target, false, m.Reason, "", "", 0)
+		}
+	case *ChallengeMessage:
+		if s.Connections.Running() {
+			s.Connections.handleChallenge(from, m.Target, m.Nonce, m.Caps)
+		}
+	case *ChallengeResponseMessage:
+		if s.Connections.Running() {
+			s.Connections.handleChallengeResponse(from, m.Target, m.Signature, m.KexOffer, m.Caps)
+		}
+	case *CookieMessage:
+		if s.Connections.Running() {
+			s.Connections.handleCookie(from, m.Cookie)
+		}
+	// NAT traversal
+	case *RegisterMessage:
+		s.NAT.handleRegister(from, m.Name, m.PublicKey, m.Mapped, m.External)
+	case *ObservedMessage:
+		s.NAT.handleObserved(from, m.Address)
+	case *IntroduceMessage:
+		s.NAT.handleIntroduce(from, m.Requester, m.Target)
+	case *PunchMessage:
+		s.NAT.handlePunch(from, m.Name, m.PublicKey, m.Address, m.External)
+	case *NoPunchMessage:
+		s.NAT.handleNoPunch(from, m.Target)
+	case *HoleMessage:
+		s.NAT.handleHole(from, m.Name)
+	// Data, restart announcement, keepalive and MTU probing
+	case *DataMessage:
+		if m.Sealed {
+			s.handleSealedData(from, m.Target, m.Data)
+		} else {
+			s.handleDataMessage(from, m.Target, m.Data)
+		}
+	case *RestartMessage:
+		s.handleRestart(from, m.Target, m.Signed)
+	case *KeepaliveMessage:
+		if m.Reply {
+			s.Connections.handleKeepaliveReply(from, m.Target)
+		} else if s.Connections.Running() {
+			s.Connections.handleKeepalive(from, m.Target)
+		}
+	case *ProbeMessage:
+		if s.Connections.Running() {
+			s.Connections.handleProbe(from, m.Target, m.MTU, len(buf))
+		}
+	case *ProbeReplyMessage:
+		s.Connections.handleProbeReply(from, m.Target, m.MTU)
+	case *RevealMessage:
+		s.Connections.handleReveal(from, m.Target, m.Name, m.Reply)
+	}
 }
 
-// handleConnectionRequest processes incoming connection requests.
-func (s *Server) handleConnectionRequest(from *net.UDPAddr, requesterName, targetName string) {
-	log.Infof("Received connection request from %v: %v to %v", from, requesterName, targetName)
+// handleConnectionRequest processes incoming connection requests: the ones from known peers, for
+// our name, are answered with a challenge (see handleChallengeResponse for the rest), the others
+// with a reject.
+func (c *ConnectionManager) handleConnectionRequest(from *net.UDPAddr, requesterName, targetName string) {
+	s := c.s
+	s.log.Infof("Received connection request from %v: %v to %v", from, requesterName, targetName)
 	src := Source{IP: from.IP.String(), Port: from.Port}
 	peer, exists := s.Sources.Get(src)
 	if !exists {
-		log.Errf("Connection request from unknown source %v (not in source to peer map)", src)
+		s.log.Errf("Connection request from unknown source %v (not in source to peer map)", src)
+		s.recordUnproven(src.IP, Peer{}, "connection request from unknown source")
+		return
+	}
+	if s.Banned(src.IP, peer.PublicKey) {
+		s.log.LogVf("Ignoring connection request from banned %q", peer.Name)
 		return
 	}
 	pData, found := s.Peers.Get(peer)
 	if !found {
-		log.Errf("Connection request from unknown peer %v (not in discovery map)", peer)
+		s.log.Errf("Connection request from unknown peer %v (not in discovery map)", peer)
 		return
 	}
-	pData.Status = ReceivedConn
-	s.Peers.Set(peer, pData)
 	// Check if the target name matches our name
 	if targetName != s.Name {
-		log.Warnf("Connection request target name %q doesn't match our name %q", targetName, s.Name)
+		s.log.Warnf("Connection request target name %q doesn't match our name %q", targetName, s.Name)
+		s.recordUnproven(src.IP, peer, "connection request for another name")
+		c.reply(from, s.sign(&RejectMessage{Target: peer.Name, Reason: "wrong name"}))
+		return
+	}
+	pData.Status = ReceivedConn
+	s.change(s.setPeer(peer, pData))
+	nonce, caps := c.newChallenge(peer)
+	c.reply(from, s.sign(&ChallengeMessage{Target: peer.Name, Nonce: nonce, Caps: caps}))
+}
+
+// accept answers the connection request of the peer, which proved it owns its public key
+// (see handleChallengeResponse), with an accept carrying our key exchange reply to its offer, signed
+// with the capabilities transcript, unless Config.OnConnectRequest rejects it. The data is then
+// sealed with the session.
+func (c *ConnectionManager) accept(from *net.UDPAddr, peer Peer, pData PeerData, nonce, response, peerCaps, transcript string,
+	offer []byte,
+) {
+	s := c.s
+	var err error
+	if s.OnConnectRequest != nil {
+		err = s.OnConnectRequest(peer)
+	}
+	var kexReply, signature string
+	if err == nil {
+		if kexReply, signature, err = c.respondKex(peer, nonce, peerCaps, transcript, offer); err != nil {
+			err = fmt.Errorf("invalid key exchange: %w", err)
+		}
+	}
+	if err != nil {
+		s.log.Infof("Rejecting connection request from %q: %v", peer.Name, err)
+		c.dropSessions(peer)
+		pData.Status = Failed
+		s.change(s.setPeer(peer, pData))
+		c.answered(from, peer, response, s.sign(&RejectMessage{Target: peer.Name, Reason: err.Error()}))
+		return
+	}
+	pData.Status = Connected
+	s.change(s.setPeer(peer, pData))
+	s.log.Infof("Accepted connection request from %q", peer.Name)
+	if port := s.QUICListener.Port(); port != 0 {
+		accept := &AcceptMessage{Target: peer.Name, KexReply: kexReply, Signature: signature, QUICPort: port}
+		c.answered(from, peer, response, s.encode(accept))
+		return
+	}
+	c.answered(from, peer, response, s.encode(&AcceptMessage{Target: peer.Name, KexReply: kexReply, Signature: signature}))
+}
+
+func (c *ConnectionManager) reply(to *net.UDPAddr, message []byte) {
+	if _, err := c.s.transport.WriteToUDP(message, to); err != nil {
+		c.s.log.Errf("Failed to reply to the connection request from %v: %v", to, err)
+	}
+}
+
+// handleConnectionReply processes the accept (with the key exchange reply and its signature, the
+// peer's QUIC port if any) or reject of our connection request: the peer is then Connected, with an
+// encrypted session, or Failed.
+func (c *ConnectionManager) handleConnectionReply(from *net.UDPAddr, targetName string, accepted bool,
+	reason, kexReply, signature string, quicPort int,
+) {
+	s := c.s
+	src := Source{IP: from.IP.String(), Port: from.Port}
+	peer, exists := s.Sources.Get(src)
+	if !exists {
+		s.log.Warnf("Connection reply from unknown source %v", src)
+		return
+	}
+	if targetName != s.Name {
+		s.log.Warnf("Connection reply target name %q doesn't match our name %q", targetName, s.Name)
+		return
+	}
+	pData, found := s.Peers.Get(peer)
+	if found && accepted && pData.Status == Connected {
+		s.log.LogVf("Duplicate connection accept from %q (our response was retransmitted)", peer.Name)
 		return
 	}
+	if !found || pData.Status != SentConn {
+		s.log.Warnf("Unexpected connection reply from %q (no pending connect request)", peer.Name)
+		return
+	}
+	c.settle(peer)
+	if accepted {
+		if err := c.finishKex(peer, kexReply, signature, quicPort); err != nil {
+			s.log.Errf("Invalid connection accept from %v (%q): %v", src, peer.Name, err)
+			s.recordUnproven(src.IP, peer, "invalid connection accept")
+			accepted, reason = false, "invalid key exchange: "+err.Error()
+		}
+	}
+	var err error
+	if accepted {
+		pData.Status = Connected
+		s.log.Infof("Connected to %q", peer.Name)
+	} else {
+		pData.Status, pData.Reason = Failed, reason
+		c.dropSessions(peer)
+		err = fmt.Errorf("%w by %q: %s", ErrConnectionRejected, peer.Name, reason)
+		s.log.Warnf("Connection to %q rejected: %s", peer.Name, reason)
+	}
+	s.change(s.setPeer(peer, pData))
+	if !accepted && s.OnReject != nil {
+		s.OnReject(peer, reason)
+	}
+	if accepted {
+		c.reveal(peer, pData, from, false)
+	}
+	if accepted && ((s.Transport == TCPTransport && s.TCPListener.Running()) ||
+		(s.Transport == QUICTransport && s.QUICListener.Running() && quicPort != 0)) {
+		c.dialStream(peer, from, quicPort) // resolves once dialed.
+		return
+	}
+	c.resolve(peer, err)
+}
+
+// fail gives up our connection request to the peer before its reply: it's Failed (err being the
+// reason, see Config.OnReject) and WaitConnected returns err.
+func (c *ConnectionManager) fail(peer Peer, err error) {
+	s := c.s
+	c.dropSessions(peer)
+	if pData, ok := s.Peers.Get(peer); ok {
+		pData.Status, pData.Reason = Failed, err.Error()
+		s.change(s.setPeer(peer, pData))
+	}
+	c.resolve(peer, err)
+	if s.OnReject != nil {
+		s.OnReject(peer, err.Error())
+	}
+}
+
+// resolve wakes up the WaitConnected for the peer, with the reject error if any.
+func (c *ConnectionManager) resolve(peer Peer, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p := c.connecting[peer]; p != nil {
+		p.err = err
+		close(p.done)
+		delete(c.connecting, peer)
+	}
+}
+
+// ErrConnectionRejected is returned by WaitConnected when the peer rejected our connection request.
+var ErrConnectionRejected = errors.New("connection rejected")
+
+// pendingConnect is a connection request waiting for the peer's reply (see WaitConnected).
+type pendingConnect struct {
+	done chan struct{} // closed once replied.
+	err  error         // the reject, set before done is closed.
+}
+
+// WaitConnected waits for the reply to our connection request to the peer (see Connect): returns nil
+// once it's Connected, an ErrConnectionRejected error if it rejected us (including when we failed
+// its challenge), an ErrNoReply error if it never answered (see MaxRetransmits) or the context's error.
+func (c *ConnectionManager) WaitConnected(ctx context.Context, peer Peer) error {
+	c.mu.Lock()
+	p, stop := c.connecting[peer], c.stopCh
+	c.mu.Unlock()
+	if p == nil {
+		if pd, ok := c.s.Peers.Get(peer); ok && pd.Status == Connected {
+			return nil
+		} else if ok && pd.Status == Failed && pd.Reason != "" { // already replied.
+			return fmt.Errorf("%w by %q: %s", ErrConnectionRejected, peer.Name, pd.Reason)
+		} else if ok && pd.Status == Failed {
+			return fmt.Errorf("%w by %q", ErrConnectionRejected, peer.Name)
+		} else if ok && pd.Status == Unreachable {
+			return fmt.Errorf("%w from %q", ErrNoReply, peer.Name)
+		}
+		return fmt.Errorf("no pending connection request to %q", peer.Name)
+	}
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stop:
+		return fmt.Errorf("waiting for %q: %w", peer.Name, ErrNotRunning)
+	}
+}
+
+// signatureEncodedSize is the size of the base64 encoded ed25519 signature plus the "/" separator.
+const signatureEncodedSize = 1 + 86
+
+// MaxDataSize returns the maximum payload size that SendData can send to the given peer
+// in a single message (depends on the length of the peer's name) before MTU probing.
+func MaxDataSize(peer Peer) int {
+	return maxDataSize(peer, BufSize)
+}
+
+func maxDataSize(peer Peer, datagramSize int) int {
+	// The sealed messages (SealedDataFormat) of connected peers, and the binary ones (WireBinary),
+	// are smaller than the signed text ones.
+	overhead := len(fmt.Sprintf(DataMessageFormat, peer.Name, "")) + len(tcrypto.SignedPrefix) + signatureEncodedSize
+	return (datagramSize - overhead) * 3 / 4 // base64 expansion
+}
+
+// MaxDataSize returns the maximum payload size that SendData can send to the given peer,
+// TCPMaxDataSize when there is a TCP or QUIC stream with it, otherwise using the peer's probed MTU
+// if available (see ProbeMTU).
+func (s *Server) MaxDataSize(peer Peer) int {
+	if _, sc := s.dataStream(peer); sc != nil {
+		return TCPMaxDataSize
+	}
+	peerData, _ := s.Peers.Get(peer)
+	return maxDataSize(peer, DatagramSize(peerData.MTU))
+}
+
+// SendData sends a data message to the peer: encrypted with the session once connected (through
+// the TCP or QUIC stream if any, see TCPTransport), signed with our identity otherwise.
+// data must not be larger than s.MaxDataSize(peer).
+func (s *Server) SendData(peer Peer, data []byte) error {
+	peerData, exists := s.Peers.Get(peer)
+	if !exists {
+		return fmt.Errorf("peer %v not found (anymore) in peer list", peer)
+	}
+	if s.RequireEncryption && !s.Encrypted(peer) {
+		return fmt.Errorf("sending to %q: %w", peer.Name, ErrNotEncrypted)
+	}
+	if d, sc := s.dataStream(peer); sc != nil && len(data) <= TCPMaxDataSize {
+		if err := d.send(peer, sc, data); err != nil {
+			return err
+		}
+		s.countData(true, peer, data)
+		return nil
+	}
+	if maxSize := maxDataSize(peer, DatagramSize(peerData.MTU)); len(data) > maxSize {
+		return fmt.Errorf("data too large for peer %q: %d > %d", peer.Name, len(data), maxSize)
+	}
+	directPeerAddr := s.peerAddr(peer, peerData)
+	if _, err := s.transport.WriteToUDP(s.dataMessage(peer, data), directPeerAddr); err != nil {
+		return err
+	}
+	s.countData(true, peer, data)
+	return nil
+}
+
+// SendDataBatch sends several data messages to the peer, with as few system calls as possible
+// (see BatchConn). Each data must not be larger than s.MaxDataSize(peer).
+func (s *Server) SendDataBatch(peer Peer, data [][]byte) error {
+	peerData, exists := s.Peers.Get(peer)
+	if !exists {
+		return fmt.Errorf("peer %v not found (anymore) in peer list", peer)
+	}
+	if s.RequireEncryption && !s.Encrypted(peer) {
+		return fmt.Errorf("sending to %q: %w", peer.Name, ErrNotEncrypted)
+	}
+	if ds, sc := s.dataStream(peer); sc != nil {
+		for _, d := range data {
+			if len(d) > TCPMaxDataSize {
+				return fmt.Errorf("data too large for peer %q: %d > %d", peer.Name, len(d), TCPMaxDataSize)
+			}
+		}
+		if err := ds.send(peer, sc, data...); err != nil {
+			return err
+		}
+		s.countData(true, peer, data...)
+		return nil
+	}
+	maxSize := maxDataSize(peer, DatagramSize(peerData.MTU))
+	msgs := make([][]byte, 0, len(data))
+	for _, d := range data {
+		if len(d) > maxSize {
+			return fmt.Errorf("data too large for peer %q: %d > %d", peer.Name, len(d), maxSize)
+		}
+		msgs = append(msgs, s.dataMessage(peer, d))
+	}
+	directPeerAddr := s.peerAddr(peer, peerData)
+	if _, relayed := s.NAT.relayVia(directPeerAddr); s.WrapTransport != nil || relayed || s.Listener.isLocal(directPeerAddr) {
+		for _, m := range msgs {
+			if _, err := s.transport.WriteToUDP(m, directPeerAddr); err != nil {
+				return err
+			}
+		}
+		s.countData(true, peer, data...)
+		return nil
+	}
+	if err := s.batch.WriteBatch(msgs, directPeerAddr); err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		s.countDatagram(true, false, len(m), directPeerAddr)
+	}
+	s.countData(true, peer, data...)
+	return nil
+}
+
+// handleDataMessage verifies incoming data messages against the sender's public key
+// and passes the payload to the OnData callback.
+func (s *Server) handleDataMessage(from *net.UDPAddr, targetName, signedData string) {
+	src := Source{IP: from.IP.String(), Port: from.Port}
+	peer, exists := s.Sources.Get(src)
+	if !exists {
+		s.log.Errf("Data message from unknown source %v (not in source to peer map)", src)
+		return
+	}
+	if s.Banned(src.IP, peer.PublicKey) {
+		s.log.LogVf("Ignoring data message from banned %q", peer.Name)
+		return
+	}
+	if targetName != s.Name {
+		s.log.Warnf("Data message target name %q doesn't match our name %q", targetName, s.Name)
+		return
+	}
+	if s.RequireEncryption {
+		s.log.Warnf("Ignoring unencrypted data message from %q", peer.Name)
+		return
+	}
+	pub, err := tcrypto.IdentityPublicKeyString(peer.PublicKey)
+	if err != nil {
+		s.log.Errf("Failed to decode peer %q public key %q: %v", peer.Name, peer.PublicKey, err)
+		return
+	}
+	data, err := tcrypto.VerifySignedMessage(signedData, pub)
+	if err != nil {
+		s.log.Errf("Invalid data message from %v (%q): %v", src, peer.Name, err)
+		s.recordUnproven(src.IP, peer, "invalid data message signature")
+		return
+	}
+	s.deliver(peer, data)
+}
+
+// deliver passes the verified data of the peer to the transfers or the OnData callback, one at
+// a time as it's called from the unicast receive goroutine and the TCP and QUIC stream readers.
+func (s *Server) deliver(peer Peer, data []byte) {
+	s.deliverMu.Lock()
+	defer s.deliverMu.Unlock()
+	s.log.LogVf("Received %d bytes of data from %q", len(data), peer.Name)
+	s.countData(false, peer, data)
+	if s.Transfers.handle(peer, data) {
+		return
+	}
+	if s.OnData != nil {
+		s.OnData(peer, data)
+	}
 }
@@ -60,6 +60,10 @@ func TestPeerDiscovery(t *testing.T) { //nolint:gocognit // it's a test.
 		Identity:              identityB,
 		BaseBroadcastInterval: cfgA.BaseBroadcastInterval, // Same interval
 	}
+	received := make(chan int, 1)
+	cfgB.OnData = func(_ tsnet.Peer, data []byte) {
+		received <- len(data)
+	}
 
 	// Start Host A
 	serverA := cfgA.NewServer()
@@ -133,19 +137,44 @@ func TestPeerDiscovery(t *testing.T) { //nolint:gocognit // it's a test.
 	// Wait a bit for the connection message to be received
 	time.Sleep(200 * time.Millisecond)
 
-	// Check that the connection was created on A's side
+	// Check that B accepted the connection and A got the accept
 	connA, exists := serverA.Peers.Get(peerB)
-	if !exists || connA.Status != tsnet.SentConn {
-		t.Fatal("Connection from A to B not found in A's connection map")
+	if !exists || connA.Status != tsnet.Connected {
+		t.Fatalf("Connection from A to B not established on A's side: %+v", connA)
 	}
-	t.Logf("✓ Connection created on A's side: status %v", connA.Status)
+	t.Logf("✓ Connection established on A's side: status %v", connA.Status)
 
-	// Check that the connection was received on B's side
 	connB, exists := serverB.Peers.Get(peerA)
-	if !exists || connB.Status != tsnet.ReceivedConn {
-		t.Fatal("Connection from A to B not found in B's connection map")
+	if !exists || connB.Status != tsnet.Connected {
+		t.Fatalf("Connection from A to B not accepted on B's side: %+v", connB)
+	}
+	t.Logf("✓ Connection accepted on B's side: status %v", connB.Status)
+	if !serverA.Encrypted(peerB) || !serverB.Encrypted(peerA) {
+		t.Errorf("Connection should have set up an encrypted session on both sides: %v %v",
+			serverA.Encrypted(peerB), serverB.Encrypted(peerA))
+	}
+
+	// MTU probing and data messages using the probed size.
+	mtu, err := serverA.ProbeMTU(ctx, peerB)
+	if err != nil || mtu < tsnet.DefaultMTU {
+		t.Fatalf("ProbeMTU returned %d, %v", mtu, err)
+	}
+	if pd, _ := serverA.Peers.Get(peerB); pd.MTU != mtu {
+		t.Errorf("Probed MTU %d not recorded in peer data: %+v", mtu, pd)
+	}
+	size := serverA.MaxDataSize(peerB)
+	t.Logf("✓ MTU to B is %d, max data size %d (vs default %d)", mtu, size, tsnet.MaxDataSize(peerB))
+	if err = serverA.SendData(peerB, make([]byte, size)); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	select {
+	case n := <-received:
+		if n != size {
+			t.Errorf("Received %d bytes instead of %d", n, size)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Data message not received by B")
 	}
-	t.Logf("✓ Connection received on B's side: status %v", connB.Status)
 
 	t.Log("✓ Test completed successfully!")
 }
@@ -223,3 +252,54 @@ func TestMultiplePeersDiscovery(t *testing.T) {
 		}
 	}
 }
+
+func TestStopReleasesAndRestart(t *testing.T) {
+	NoMCastOnMacInCI(t)
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline := runtime.NumGoroutine()
+	cfg := tsnet.Config{
+		Name:                  "Restarter",
+		Port:                  testPort,
+		Mcast:                 testMultiCastAddr,
+		Identity:              id,
+		BaseBroadcastInterval: 50 * time.Millisecond,
+	}
+	srv := cfg.NewServer()
+	ctx := context.Background()
+	if err = srv.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if r := srv.Resources(); r.Goroutines != 4 || r.Sockets != 2 || r.Tickers != 2 {
+		t.Errorf("Unexpected resources while running: %+v", r)
+	}
+	if srv.CheckReleased() == nil {
+		t.Errorf("CheckReleased should fail on a running server")
+	}
+	firstAddr := srv.OurAddress().String()
+	srv.Peers.Set(tsnet.Peer{Name: "stale"}, tsnet.PeerData{})
+	if err = srv.Restart(ctx); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	if srv.Stopped() || srv.Peers.Len() != 0 || srv.Identity != id {
+		t.Errorf("Restart should keep the identity and clear the peers: stopped %v, %d peers",
+			srv.Stopped(), srv.Peers.Len())
+	}
+	t.Logf("Restarted: %s -> %s", firstAddr, srv.OurAddress())
+	srv.Stop()
+	if err = srv.CheckReleased(); err != nil {
+		t.Errorf("Leak after Stop: %v", err)
+	}
+	for range 20 {
+		if runtime.NumGoroutine() <= baseline {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("Goroutine leak: %d vs %d before", n, baseline)
+	}
+}
@@ -0,0 +1,252 @@
+package tsnet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddr    = "239.255.255.250:1900"
+	ssdpTimeout = 3 * time.Second
+	upnpTimeout = 5 * time.Second
+	// upnpMaxBody bounds the size of the device descriptions and SOAP answers read.
+	upnpMaxBody = 1 << 20
+	// UPnP error code of the gateways only accepting permanent mappings.
+	upnpOnlyPermanentLeases = "725"
+)
+
+// upnpClient is the WAN connection service of an Internet Gateway Device (UPnP IGD).
+type upnpClient struct {
+	control string // URL of the service's SOAP actions.
+	service string // its type, e.g. urn:schemas-upnp-org:service:WANIPConnection:1.
+	local   net.IP // our address on the gateway's network.
+	http    *http.Client
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+// wanService returns the first WAN IP (or PPP) connection service of the device or its children.
+func (d *upnpDevice) wanService() (upnpService, bool) {
+	for _, svc := range d.Services {
+		if strings.Contains(svc.ServiceType, ":WANIPConnection:") || strings.Contains(svc.ServiceType, ":WANPPPConnection:") {
+			return svc, true
+		}
+	}
+	for i := range d.Devices {
+		if svc, ok := d.Devices[i].wanService(); ok {
+			return svc, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// discoverUPnP looks for an Internet Gateway Device with SSDP and returns a client of its WAN
+// connection service.
+func discoverUPnP(ctx context.Context, lg logFuncs) (*upnpClient, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dest, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: " + ssdpAddr + "\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n"
+	if _, err = conn.WriteToUDP([]byte(search), dest); err != nil {
+		return nil, err
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(ssdpTimeout)); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: upnpTimeout}
+	buf := make([]byte, 2048)
+	var errs []error
+	for ctx.Err() == nil {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		resp.Body.Close()
+		if location == "" {
+			continue
+		}
+		u, err := newUPnPClient(ctx, client, location)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", location, err))
+			continue
+		}
+		lg.Infof("UPnP gateway %s (%s)", location, u.service)
+		return u, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no UPnP gateway answered")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// newUPnPClient reads the device description at location for its WAN connection service.
+func newUPnPClient(ctx context.Context, client *http.Client, location string) (*upnpClient, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err = xml.NewDecoder(io.LimitReader(resp.Body, upnpMaxBody)).Decode(&root); err != nil {
+		return nil, err
+	}
+	svc, ok := root.Device.wanService()
+	if !ok {
+		return nil, errors.New("no WAN connection service")
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+	control, err := base.Parse(svc.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+	// Our address on the gateway's network, the one to forward to.
+	probe, err := net.Dial("udp4", net.JoinHostPort(control.Hostname(), "1900"))
+	if err != nil {
+		return nil, err
+	}
+	defer probe.Close()
+	return &upnpClient{
+		control: control.String(), service: svc.ServiceType, local: probe.LocalAddr().(*net.UDPAddr).IP, http: client,
+	}, nil
+}
+
+// call invokes the SOAP action with the arguments (name, value pairs) and returns the answer.
+func (u *upnpClient) call(ctx context.Context, action string, args ...string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"` +
+		` s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		_ = xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.control, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.service+"#"+action+`"`)
+	resp, err := u.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, upnpMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upnpError{action: action, status: resp.Status, code: soapValue(answer, "errorCode")}
+	}
+	return answer, nil
+}
+
+// upnpError is the failure of a SOAP action, with the UPnP error code when the gateway gave one.
+type upnpError struct {
+	action, status, code string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("%s: %s (error code %q)", e.action, e.status, e.code)
+}
+
+// soapValue returns the text of the first element named name in the SOAP answer.
+func soapValue(answer []byte, name string) string {
+	d := xml.NewDecoder(bytes.NewReader(answer))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local == name {
+			var value string
+			if d.DecodeElement(&value, &start) != nil {
+				return ""
+			}
+			return strings.TrimSpace(value)
+		}
+	}
+}
+
+// addMapping forwards the same external UDP port to our port for lifetime (or permanently when the
+// gateway only supports that, then renewed every PortMappingLifetime) and returns the external
+// address and the lifetime.
+func (u *upnpClient) addMapping(ctx context.Context, port int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	add := func(lease time.Duration) error {
+		_, err := u.call(ctx, "AddPortMapping", "NewRemoteHost", "", "NewExternalPort", strconv.Itoa(port),
+			"NewProtocol", "UDP", "NewInternalPort", strconv.Itoa(port), "NewInternalClient", u.local.String(),
+			"NewEnabled", "1", "NewPortMappingDescription", "tsync",
+			"NewLeaseDuration", strconv.Itoa(int(lease.Seconds())))
+		return err
+	}
+	err := add(lifetime)
+	if uerr := (*upnpError)(nil); errors.As(err, &uerr) && uerr.code == upnpOnlyPermanentLeases {
+		err = add(0)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	answer, err := u.call(ctx, "GetExternalIPAddress")
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(soapValue(answer, "NewExternalIPAddress"))
+	if ip == nil {
+		return nil, 0, errors.New("no external IP address")
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, lifetime, nil
+}
+
+// deleteMapping removes the forwarding of the external UDP port.
+func (u *upnpClient) deleteMapping(ctx context.Context, port int) error {
+	_, err := u.call(ctx, "DeletePortMapping", "NewRemoteHost", "", "NewExternalPort", strconv.Itoa(port), "NewProtocol", "UDP")
+	return err
+}
@@ -0,0 +1,11 @@
+// Package wifidirect is an experimental discovery backend for laptops without a common LAN (plane,
+// field work): it drives wpa_supplicant's Wi-Fi Direct (P2P) support, through its control socket,
+// to find another tsync advertising the ServiceURN UPnP service and form a P2P group with it. The
+// group's interface is then a regular network for the tsnet discovery and UDP transport (see
+// tsnet.Config.Interface).
+//
+// It's only built with the wifidirect build tag, on Linux, and needs access to the control socket
+// (root or the wpa_supplicant ctrl_interface group). The group interface needs an IPv4 address:
+// given by the group owner (wpa_supplicant's ip_addr_go, ip_addr_start and ip_addr_end settings)
+// or configured by the system (link-local, NetworkManager shared mode...).
+package wifidirect
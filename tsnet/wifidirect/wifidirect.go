@@ -0,0 +1,294 @@
+//go:build wifidirect && linux
+
+package wifidirect
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/log"
+)
+
+// ServiceURN is the UPnP service the tsync devices advertise and look for.
+const ServiceURN = "urn:fortio-org:service:tsync:1"
+
+// DefaultControl is wpa_supplicant's usual P2P device control socket.
+const DefaultControl = "/var/run/wpa_supplicant/p2p-dev-wlan0"
+
+// requestTimeout bounds the wait for the reply to a control command.
+const requestTimeout = 5 * time.Second
+
+// ErrFormation is returned when the group negotiation with the peer failed.
+var ErrFormation = errors.New("wi-fi direct group formation failed")
+
+// Config of Connect.
+type Config struct {
+	// Control socket of wpa_supplicant's P2P device, DefaultControl if empty.
+	Control string
+	// How long to look for a peer and form the group, no limit (but the context's) if 0.
+	Timeout time.Duration
+	// How long to wait for the group interface to get an IPv4 address, 30s if 0.
+	AddressTimeout time.Duration
+}
+
+// Group is the P2P group formed with a peer.
+type Group struct {
+	Interface string // e.g. p2p-wlan0-0.
+	Owner     bool   // we're the group owner (access point).
+	Peer      string // P2P device address of the peer.
+	IP        net.IP // our IPv4 address on Interface.
+	ctrl      *ctrl
+	service   string
+}
+
+// ctrl is a connection to the wpa_supplicant control socket.
+type ctrl struct {
+	conn  *net.UnixConn
+	local string
+}
+
+var ctrlSeq atomic.Int64
+
+func dialCtrl(path string) (*ctrl, error) {
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("tsync-wpa-%d-%d", os.Getpid(), ctrlSeq.Add(1)))
+	_ = os.Remove(local)
+	conn, err := net.DialUnix("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"},
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &ctrl{conn: conn, local: local}, nil
+}
+
+func (c *ctrl) Close() error {
+	err := c.conn.Close()
+	_ = os.Remove(c.local)
+	return err
+}
+
+// request sends the command and returns its reply, an error for FAIL and UNKNOWN COMMAND.
+func (c *ctrl) request(cmd string) (string, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return "", err
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", cmd, err)
+		}
+		if n > 0 && buf[0] == '<' {
+			continue // event, on an attached connection.
+		}
+		reply := strings.TrimSpace(string(buf[:n]))
+		if strings.HasPrefix(reply, "FAIL") || strings.HasPrefix(reply, "UNKNOWN COMMAND") {
+			return reply, fmt.Errorf("%s: %s", cmd, reply)
+		}
+		return reply, nil
+	}
+}
+
+// events reads the events of the attached c, without their <level> prefix, until it's closed or
+// done is.
+func (c *ctrl) events(ch chan<- string, done <-chan struct{}) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if msg, ok := bytes.CutPrefix(buf[:n], []byte("<")); ok {
+			if _, event, ok := bytes.Cut(msg, []byte(">")); ok {
+				select {
+				case ch <- string(event):
+				case <-done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// field returns the value of key=value in the event or status fields, without quotes.
+func field(fields []string, key string) string {
+	for _, f := range fields {
+		if v, ok := strings.CutPrefix(f, key+"="); ok {
+			return strings.Trim(v, `"'`)
+		}
+	}
+	return ""
+}
+
+// Connect advertises us, looks for another tsync device and forms a group with it (the lowest P2P
+// device address initiates, the other one authorizes, using push button configuration), then waits
+// for our IPv4 address on the group interface.
+func Connect(ctx context.Context, cfg Config) (*Group, error) {
+	if cfg.Control == "" {
+		cfg.Control = DefaultControl
+	}
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	c, err := dialCtrl(cfg.Control)
+	if err != nil {
+		return nil, err
+	}
+	events, err := dialCtrl(cfg.Control)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	defer events.Close()
+	g, err := connect(ctx, c, events)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err = g.waitAddress(ctx, cfg.AddressTimeout); err != nil {
+		g.Close()
+		return nil, err
+	}
+	log.Infof("Wi-Fi Direct group on %s with %s (owner %t), our IP %v", g.Interface, g.Peer, g.Owner, g.IP)
+	return g, nil
+}
+
+func connect(ctx context.Context, c, events *ctrl) (*Group, error) {
+	if _, err := events.request("ATTACH"); err != nil {
+		return nil, err
+	}
+	if err := events.conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	status, err := c.request("STATUS")
+	if err != nil {
+		return nil, err
+	}
+	us := field(strings.Fields(status), "p2p_device_address")
+	uuid := make([]byte, 16)
+	_, _ = rand.Read(uuid)
+	g := &Group{ctrl: c, service: fmt.Sprintf("uuid:%x-%x-%x-%x-%x::%s", uuid[:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:], ServiceURN)}
+	if _, err = c.request("P2P_SERVICE_ADD upnp 10 " + g.service); err != nil {
+		return nil, err
+	}
+	query, err := c.request("P2P_SERV_DISC_REQ 00:00:00:00:00:00 upnp 10 " + ServiceURN)
+	if err == nil {
+		_, err = c.request("P2P_FIND")
+	}
+	defer func() {
+		_, _ = c.request("P2P_STOP_FIND")
+		_, _ = c.request("P2P_SERV_DISC_CANCEL_REQ " + query)
+	}()
+	if err != nil {
+		g.unadvertise()
+		return nil, err
+	}
+	log.Infof("Looking for tsync Wi-Fi Direct peers (we're %s)", us)
+	ch, done := make(chan string, 16), make(chan struct{})
+	defer close(done)
+	go events.events(ch, done)
+	for {
+		var event string
+		select {
+		case <-ctx.Done():
+			g.unadvertise()
+			return nil, ctx.Err()
+		case event = <-ch:
+		}
+		fields := strings.Fields(event)
+		if len(fields) < 2 {
+			continue
+		}
+		log.LogVf("wpa_supplicant event: %s", event)
+		switch fields[0] {
+		case "P2P-SERV-DISC-RESP":
+			if g.Peer != "" || len(fields) < 4 || !hasService(fields[3]) {
+				continue
+			}
+			g.Peer = fields[1]
+			cmd := "P2P_CONNECT " + g.Peer + " pbc"
+			if us > g.Peer {
+				cmd += " auth" // the peer initiates.
+			}
+			log.Infof("Found tsync Wi-Fi Direct peer %s, %s", g.Peer, cmd)
+			if _, err = c.request(cmd); err != nil {
+				g.unadvertise()
+				return nil, err
+			}
+		case "P2P-GO-NEG-FAILURE", "P2P-GROUP-FORMATION-FAILURE":
+			g.unadvertise()
+			return nil, fmt.Errorf("%w: %s", ErrFormation, event)
+		case "P2P-GROUP-STARTED":
+			if len(fields) < 3 {
+				continue
+			}
+			g.Interface, g.Owner = fields[1], fields[2] == "GO"
+			return g, nil
+		}
+	}
+}
+
+// hasService returns true if the hex encoded service discovery response TLVs mention ServiceURN.
+func hasService(tlvs string) bool {
+	b, err := hex.DecodeString(tlvs)
+	return err == nil && bytes.Contains(b, []byte(ServiceURN))
+}
+
+// waitAddress waits for an IPv4 address on the group interface (the one given by the owner in the
+// group started event is configured by the system too).
+func (g *Group) waitAddress(ctx context.Context, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		if g.IP = ipv4Of(g.Interface); g.IP != nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no IPv4 address on %s: %w", g.Interface, ctx.Err())
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func ipv4Of(name string) net.IP {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, _ := iface.Addrs()
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4()
+		}
+	}
+	return nil
+}
+
+func (g *Group) unadvertise() {
+	_, _ = g.ctrl.request("P2P_SERVICE_DEL upnp 10 " + g.service)
+}
+
+// Close removes the group and our service advertisement.
+func (g *Group) Close() error {
+	_, err := g.ctrl.request("P2P_GROUP_REMOVE " + g.Interface)
+	g.unadvertise()
+	return errors.Join(err, g.ctrl.Close())
+}
@@ -0,0 +1,92 @@
+//go:build wifidirect && linux
+
+package wifidirect_test
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet/wifidirect"
+)
+
+// fakeSupplicant answers the control commands like wpa_supplicant and sends the events of a peer
+// advertising tsync being found and of the group (on the loopback interface) being started.
+type fakeSupplicant struct {
+	conn     *net.UnixConn
+	mu       sync.Mutex
+	commands []string
+}
+
+func (f *fakeSupplicant) run() {
+	buf := make([]byte, 4096)
+	var attached *net.UnixAddr
+	for {
+		n, from, err := f.conn.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+		cmd := string(buf[:n])
+		f.mu.Lock()
+		f.commands = append(f.commands, cmd)
+		f.mu.Unlock()
+		reply, event := "OK\n", ""
+		switch {
+		case cmd == "ATTACH":
+			attached = from
+		case cmd == "STATUS":
+			reply = "p2p_device_address=02:00:00:00:00:01\nwpa_state=DISCONNECTED\n"
+		case strings.HasPrefix(cmd, "P2P_SERV_DISC_REQ"):
+			reply = "1234"
+		case cmd == "P2P_FIND":
+			tlvs := append([]byte{0, 0, 2, 1, 0, 0x10}, "uuid:x::"+wifidirect.ServiceURN...)
+			event = "<3>P2P-SERV-DISC-RESP 02:00:00:00:00:02 0 " + hex.EncodeToString(tlvs)
+		case strings.HasPrefix(cmd, "P2P_CONNECT"):
+			event = `<3>P2P-GROUP-STARTED lo GO ssid="DIRECT-ts" freq=2412 go_dev_addr=02:00:00:00:00:01`
+		}
+		_, _ = f.conn.WriteToUnix([]byte(reply), from)
+		if event != "" && attached != nil {
+			_, _ = f.conn.WriteToUnix([]byte(event), attached)
+		}
+	}
+}
+
+func (f *fakeSupplicant) sent(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.DeleteFunc(slices.Clone(f.commands), func(cmd string) bool { return !strings.HasPrefix(cmd, prefix) })
+}
+
+func TestConnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "p2p-dev-wlan0")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fake := &fakeSupplicant{conn: conn}
+	go fake.run()
+	g, err := wifidirect.Connect(context.Background(), wifidirect.Config{Control: path, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if g.Interface != "lo" || !g.Owner || g.Peer != "02:00:00:00:00:02" || !g.IP.IsLoopback() {
+		t.Errorf("Unexpected group %+v", g)
+	}
+	// We have the lowest address: we initiate.
+	if got := fake.sent("P2P_CONNECT"); !slices.Equal(got, []string{"P2P_CONNECT 02:00:00:00:00:02 pbc"}) {
+		t.Errorf("Unexpected connect commands %q", got)
+	}
+	if err = g.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if len(fake.sent("P2P_GROUP_REMOVE lo")) != 1 || len(fake.sent("P2P_SERVICE_DEL upnp 10 uuid:")) != 1 {
+		t.Errorf("Group or service not removed: %q", fake.sent(""))
+	}
+}
@@ -0,0 +1,529 @@
+package tsnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// WireFormat is the encoding of the direct (unicast) messages we send (see Config.Wire), the ones
+// received are decoded in either.
+type WireFormat int
+
+const (
+	// WireText sends the historical text messages (the *Format constants, parsed with Sscanf),
+	// understood by all versions (the default).
+	WireText WireFormat = iota
+	// WireBinary sends the compact binary encoding: WireMagic, WireVersion, the MessageKind then
+	// each field, strings prefixed with their uvarint length and integers as varints. Only for
+	// peers of this version or later.
+	WireBinary
+)
+
+const (
+	// WireMagic starts the binary messages, it can't start a text one (which are ASCII).
+	WireMagic = 0xb7
+	// WireVersion is the version of the binary encoding, messages with a later one are rejected.
+	WireVersion = 1
+)
+
+// ErrWireVersion is returned when decoding a binary message of a later WireVersion.
+var ErrWireVersion = errors.New("unsupported wire version")
+
+var wireFormatNames = []string{"text", "binary"}
+
+func (f WireFormat) String() string {
+	if f >= 0 && int(f) < len(wireFormatNames) {
+		return wireFormatNames[f]
+	}
+	return "unknown"
+}
+
+// ParseWireFormat returns the WireFormat from its name (text or binary).
+func ParseWireFormat(name string) (WireFormat, error) {
+	for i, n := range wireFormatNames {
+		if strings.EqualFold(name, n) {
+			return WireFormat(i), nil
+		}
+	}
+	return WireText, fmt.Errorf("unknown wire format %q, must be text or binary", name)
+}
+
+// MessageKind is the type of a direct message, its byte in the binary encoding.
+type MessageKind byte
+
+const (
+	KindConnect MessageKind = iota + 1
+	KindConnectCookie
+	KindAccept
+	KindAcceptQUIC
+	KindReject
+	KindChallenge
+	KindChallengeResponse
+	KindCookie
+	KindRegister
+	KindRegisterMapped
+	KindObserved
+	KindIntroduce
+	KindPunch
+	KindNoPunch
+	KindHole
+	KindData
+	KindSealedData
+	KindRestart
+	KindKeepalive
+	KindKeepaliveReply
+	KindProbe
+	KindProbeReply
+	KindRegisterExternal
+	KindRegisterMappedExternal
+	KindPunchExternal
+	KindChallengeCaps
+	KindChallengeResponseCaps
+	KindReveal
+	KindRevealReply
+)
+
+// textFormats are the text formats of the message kinds. Those sharing their first word are tried
+// in this order, the longer first as Sscanf ignores the trailing input.
+var textFormats = []struct {
+	kind   MessageKind
+	format string
+}{
+	{KindConnectCookie, ConnectCookieFormat},
+	{KindConnect, ConnectMessageFormat},
+	{KindAcceptQUIC, AcceptQUICFormat},
+	{KindAccept, AcceptMessageFormat},
+	{KindReject, RejectMessageFormat},
+	{KindChallengeCaps, ChallengeCapsFormat},
+	{KindChallenge, ChallengeMessageFormat},
+	{KindChallengeResponseCaps, ResponseCapsFormat},
+	{KindChallengeResponse, ChallengeResponseFormat},
+	{KindCookie, CookieMessageFormat},
+	{KindRegisterMappedExternal, RegisterMappedExternalFormat},
+	{KindRegisterMapped, RegisterMappedMessageFormat},
+	{KindRegisterExternal, RegisterExternalFormat},
+	{KindRegister, RegisterMessageFormat},
+	{KindObserved, ObservedMessageFormat},
+	{KindIntroduce, IntroduceMessageFormat},
+	{KindPunchExternal, PunchExternalFormat},
+	{KindPunch, PunchMessageFormat},
+	{KindNoPunch, NoPunchMessageFormat},
+	{KindHole, HoleMessageFormat},
+	{KindData, DataMessageFormat},
+	{KindSealedData, SealedDataFormat},
+	{KindRestart, RestartMessageFormat},
+	{KindKeepalive, KeepaliveMessageFormat},
+	{KindKeepaliveReply, KeepaliveReplyFormat},
+	{KindProbe, ProbeMessageFormat},
+	{KindProbeReply, ProbeReplyFormat},
+	{KindReveal, RevealMessageFormat},
+	{KindRevealReply, RevealReplyFormat},
+}
+
+// textFormat returns the text format of kind.
+func textFormat(kind MessageKind) string {
+	for _, f := range textFormats {
+		if f.kind == kind {
+			return f.format
+		}
+	}
+	return ""
+}
+
+// Message is a direct message, encoded with EncodeMessage and decoded with DecodeMessage.
+type Message interface {
+	Kind() MessageKind
+	// fields returns pointers to the *string and *int fields, in the order of the kind's format.
+	fields() []any
+}
+
+// ConnectMessage asks the Target for a connection, with the Cookie it gave us under load if any.
+type ConnectMessage struct{ Requester, Target, Cookie string }
+
+// AcceptMessage accepts the connection of Target with our key exchange reply and its signature,
+// and our QUICPort if we accept QUIC connections (0 otherwise).
+type AcceptMessage struct {
+	Target, KexReply, Signature string
+	QUICPort                    int
+}
+
+// RejectMessage rejects the connection of Target.
+type RejectMessage struct{ Target, Reason string }
+
+// ChallengeMessage asks the Target (the requester) to sign the Nonce, with our Caps (see
+// capabilities).
+type ChallengeMessage struct{ Target, Nonce, Caps string }
+
+// ChallengeResponseMessage answers the challenge of the Target (the responder), with our Caps if
+// it advertised its own.
+type ChallengeResponseMessage struct{ Target, Signature, KexOffer, Caps string }
+
+// CookieMessage gives the requester the cookie to resend its connection request with.
+type CookieMessage struct{ Cookie string }
+
+// RegisterMessage registers Name to the rendezvous, with the Mapped ip:port of its port mapping
+// and its signed External address (see STUNClient.SignedExternal) if any.
+type RegisterMessage struct{ Name, PublicKey, Mapped, External string }
+
+// ObservedMessage tells the registered peer the Address the rendezvous sees it from.
+type ObservedMessage struct{ Address string }
+
+// IntroduceMessage asks the rendezvous to introduce the Requester and the Target.
+type IntroduceMessage struct{ Requester, Target string }
+
+// PunchMessage tells the introduced peer the public key and address of Name, and the External
+// address it signed if any.
+type PunchMessage struct{ Name, PublicKey, Address, External string }
+
+// NoPunchMessage tells the requester the Target isn't registered.
+type NoPunchMessage struct{ Target string }
+
+// HoleMessage opens (and keeps open) the NAT mappings between the peers.
+type HoleMessage struct{ Name string }
+
+// DataMessage carries the signed, or Sealed with the connection's session, data to the Target.
+type DataMessage struct {
+	Target, Data string
+	Sealed       bool
+}
+
+// RestartMessage tells the Target our signed expected downtime.
+type RestartMessage struct{ Target, Signed string }
+
+// KeepaliveMessage pings the Target, or answers its ping with Reply.
+type KeepaliveMessage struct {
+	Target string
+	Reply  bool
+}
+
+// ProbeMessage probes the path to Target for a datagram of the MTU's size (see PadMessage).
+type ProbeMessage struct {
+	Target  string
+	MTU     int
+	Padding string
+}
+
+// RevealMessage carries our Name to the Target, sealed with the connection's session (see
+// Config.PrivateName), or answers its reveal with Reply.
+type RevealMessage struct {
+	Target, Name string
+	Reply        bool
+}
+
+// ProbeReplyMessage tells the Target (the prober) its probe for MTU arrived.
+type ProbeReplyMessage struct {
+	Target string
+	MTU    int
+}
+
+func (m *ConnectMessage) Kind() MessageKind {
+	if m.Cookie != "" {
+		return KindConnectCookie
+	}
+	return KindConnect
+}
+
+func (m *ConnectMessage) fields() []any {
+	if m.Cookie != "" {
+		return []any{&m.Requester, &m.Target, &m.Cookie}
+	}
+	return []any{&m.Requester, &m.Target}
+}
+
+func (m *AcceptMessage) Kind() MessageKind {
+	if m.QUICPort != 0 {
+		return KindAcceptQUIC
+	}
+	return KindAccept
+}
+
+func (m *AcceptMessage) fields() []any {
+	if m.QUICPort != 0 {
+		return []any{&m.Target, &m.KexReply, &m.Signature, &m.QUICPort}
+	}
+	return []any{&m.Target, &m.KexReply, &m.Signature}
+}
+
+func (m *RegisterMessage) Kind() MessageKind {
+	switch {
+	case m.Mapped != "" && m.External != "":
+		return KindRegisterMappedExternal
+	case m.Mapped != "":
+		return KindRegisterMapped
+	case m.External != "":
+		return KindRegisterExternal
+	}
+	return KindRegister
+}
+
+func (m *RegisterMessage) fields() []any {
+	fields := []any{&m.Name, &m.PublicKey}
+	if m.Mapped != "" {
+		fields = append(fields, &m.Mapped)
+	}
+	if m.External != "" {
+		fields = append(fields, &m.External)
+	}
+	return fields
+}
+
+func (m *PunchMessage) Kind() MessageKind {
+	if m.External != "" {
+		return KindPunchExternal
+	}
+	return KindPunch
+}
+
+func (m *PunchMessage) fields() []any {
+	if m.External != "" {
+		return []any{&m.Name, &m.PublicKey, &m.Address, &m.External}
+	}
+	return []any{&m.Name, &m.PublicKey, &m.Address}
+}
+
+func (m *DataMessage) Kind() MessageKind {
+	if m.Sealed {
+		return KindSealedData
+	}
+	return KindData
+}
+
+func (m *KeepaliveMessage) Kind() MessageKind {
+	if m.Reply {
+		return KindKeepaliveReply
+	}
+	return KindKeepalive
+}
+
+func (m *RevealMessage) Kind() MessageKind {
+	if m.Reply {
+		return KindRevealReply
+	}
+	return KindReveal
+}
+
+func (m *ChallengeMessage) Kind() MessageKind {
+	if m.Caps != "" {
+		return KindChallengeCaps
+	}
+	return KindChallenge
+}
+
+func (m *ChallengeMessage) fields() []any {
+	if m.Caps != "" {
+		return []any{&m.Target, &m.Nonce, &m.Caps}
+	}
+	return []any{&m.Target, &m.Nonce}
+}
+
+func (m *ChallengeResponseMessage) Kind() MessageKind {
+	if m.Caps != "" {
+		return KindChallengeResponseCaps
+	}
+	return KindChallengeResponse
+}
+
+func (m *ChallengeResponseMessage) fields() []any {
+	if m.Caps != "" {
+		return []any{&m.Target, &m.Signature, &m.KexOffer, &m.Caps}
+	}
+	return []any{&m.Target, &m.Signature, &m.KexOffer}
+}
+
+func (m *RejectMessage) Kind() MessageKind     { return KindReject }
+func (m *CookieMessage) Kind() MessageKind     { return KindCookie }
+func (m *ObservedMessage) Kind() MessageKind   { return KindObserved }
+func (m *IntroduceMessage) Kind() MessageKind  { return KindIntroduce }
+func (m *NoPunchMessage) Kind() MessageKind    { return KindNoPunch }
+func (m *HoleMessage) Kind() MessageKind       { return KindHole }
+func (m *RestartMessage) Kind() MessageKind    { return KindRestart }
+func (m *ProbeMessage) Kind() MessageKind      { return KindProbe }
+func (m *ProbeReplyMessage) Kind() MessageKind { return KindProbeReply }
+
+func (m *RejectMessage) fields() []any     { return []any{&m.Target, &m.Reason} }
+func (m *CookieMessage) fields() []any     { return []any{&m.Cookie} }
+func (m *ObservedMessage) fields() []any   { return []any{&m.Address} }
+func (m *IntroduceMessage) fields() []any  { return []any{&m.Requester, &m.Target} }
+func (m *NoPunchMessage) fields() []any    { return []any{&m.Target} }
+func (m *HoleMessage) fields() []any       { return []any{&m.Name} }
+func (m *DataMessage) fields() []any       { return []any{&m.Target, &m.Data} }
+func (m *RestartMessage) fields() []any    { return []any{&m.Target, &m.Signed} }
+func (m *KeepaliveMessage) fields() []any  { return []any{&m.Target} }
+func (m *ProbeMessage) fields() []any      { return []any{&m.Target, &m.MTU, &m.Padding} }
+func (m *ProbeReplyMessage) fields() []any { return []any{&m.Target, &m.MTU} }
+func (m *RevealMessage) fields() []any     { return []any{&m.Target, &m.Name} }
+
+// newMessage returns the empty message of kind, nil if unknown.
+func newMessage(kind MessageKind) Message {
+	switch kind {
+	case KindConnect:
+		return &ConnectMessage{}
+	case KindConnectCookie:
+		return &ConnectMessage{Cookie: "?"} // for fields() to include it.
+	case KindAccept:
+		return &AcceptMessage{}
+	case KindAcceptQUIC:
+		return &AcceptMessage{QUICPort: -1}
+	case KindReject:
+		return &RejectMessage{}
+	case KindChallenge:
+		return &ChallengeMessage{}
+	case KindChallengeCaps:
+		return &ChallengeMessage{Caps: "?"}
+	case KindChallengeResponse:
+		return &ChallengeResponseMessage{}
+	case KindChallengeResponseCaps:
+		return &ChallengeResponseMessage{Caps: "?"}
+	case KindCookie:
+		return &CookieMessage{}
+	case KindRegister:
+		return &RegisterMessage{}
+	case KindRegisterMapped:
+		return &RegisterMessage{Mapped: "?"}
+	case KindRegisterExternal:
+		return &RegisterMessage{External: "?"}
+	case KindRegisterMappedExternal:
+		return &RegisterMessage{Mapped: "?", External: "?"}
+	case KindObserved:
+		return &ObservedMessage{}
+	case KindIntroduce:
+		return &IntroduceMessage{}
+	case KindPunch:
+		return &PunchMessage{}
+	case KindPunchExternal:
+		return &PunchMessage{External: "?"}
+	case KindNoPunch:
+		return &NoPunchMessage{}
+	case KindHole:
+		return &HoleMessage{}
+	case KindData:
+		return &DataMessage{}
+	case KindSealedData:
+		return &DataMessage{Sealed: true}
+	case KindRestart:
+		return &RestartMessage{}
+	case KindKeepalive:
+		return &KeepaliveMessage{}
+	case KindKeepaliveReply:
+		return &KeepaliveMessage{Reply: true}
+	case KindProbe:
+		return &ProbeMessage{}
+	case KindProbeReply:
+		return &ProbeReplyMessage{}
+	case KindReveal:
+		return &RevealMessage{}
+	case KindRevealReply:
+		return &RevealMessage{Reply: true}
+	}
+	return nil
+}
+
+// EncodeMessage returns m in the given format.
+func EncodeMessage(m Message, format WireFormat) []byte {
+	fields := m.fields()
+	if format != WireBinary {
+		args := make([]any, len(fields))
+		for i, f := range fields {
+			switch v := f.(type) {
+			case *string:
+				args[i] = *v
+			case *int:
+				args[i] = *v
+			}
+		}
+		return fmt.Appendf(nil, textFormat(m.Kind()), args...)
+	}
+	buf := []byte{WireMagic, WireVersion, byte(m.Kind())}
+	for _, f := range fields {
+		switch v := f.(type) {
+		case *string:
+			buf = binary.AppendUvarint(buf, uint64(len(*v)))
+			buf = append(buf, *v...)
+		case *int:
+			buf = binary.AppendVarint(buf, int64(*v))
+		}
+	}
+	return buf
+}
+
+// IsBinaryMessage returns true if buf is in the binary wire format.
+func IsBinaryMessage(buf []byte) bool {
+	return len(buf) > 0 && buf[0] == WireMagic
+}
+
+// DecodeMessage returns the message in buf, in either format. Like Sscanf for the text ones, the
+// bytes after the last field (padding) are ignored.
+func DecodeMessage(buf []byte) (Message, error) {
+	if IsBinaryMessage(buf) {
+		return decodeBinary(buf)
+	}
+	msgStr := string(buf)
+	word, _, found := strings.Cut(msgStr, " ")
+	if !found {
+		return nil, errors.New("not a message")
+	}
+	word += " "
+	for _, f := range textFormats {
+		if !strings.HasPrefix(f.format, word) {
+			continue
+		}
+		m := newMessage(f.kind)
+		fields := m.fields()
+		if n, err := fmt.Sscanf(msgStr, f.format, fields...); err == nil && n == len(fields) {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown %q message", word)
+}
+
+func decodeBinary(buf []byte) (Message, error) {
+	if len(buf) < 3 {
+		return nil, errors.New("truncated binary message")
+	}
+	if buf[1] != WireVersion {
+		return nil, fmt.Errorf("%w %d", ErrWireVersion, buf[1])
+	}
+	m := newMessage(MessageKind(buf[2]))
+	if m == nil {
+		return nil, fmt.Errorf("unknown binary message kind %d", buf[2])
+	}
+	rest := buf[3:]
+	for i, f := range m.fields() {
+		switch v := f.(type) {
+		case *string:
+			l, n := binary.Uvarint(rest)
+			if n <= 0 || l > uint64(len(rest)-n) {
+				return nil, fmt.Errorf("invalid field %d of binary message kind %d", i, buf[2])
+			}
+			*v = string(rest[n : n+int(l)]) //nolint:gosec // checked above.
+			rest = rest[n+int(l):]          //nolint:gosec // checked above.
+		case *int:
+			x, n := binary.Varint(rest)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid field %d of binary message kind %d", i, buf[2])
+			}
+			*v = int(x)
+			rest = rest[n:]
+		}
+	}
+	return m, nil
+}
+
+// PadMessage pads msg to size bytes (ConnectMinSize, the probed datagram size): with filler for the
+// text format (space, or non space for a trailing %s), zeros for the binary one.
+func PadMessage(msg []byte, size int, filler byte) []byte {
+	if IsBinaryMessage(msg) {
+		filler = 0
+	}
+	for len(msg) < size {
+		msg = append(msg, filler)
+	}
+	return msg
+}
+
+// encode returns m in our Config.Wire format.
+func (s *Server) encode(m Message) []byte {
+	return EncodeMessage(m, s.Wire)
+}
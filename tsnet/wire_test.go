@@ -0,0 +1,144 @@
+package tsnet_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+)
+
+// TestWireRoundTrip encodes and decodes each kind of message in both formats, including names the
+// text format needs to quote.
+func TestWireRoundTrip(t *testing.T) {
+	name := `a "quoted" name with spaces`
+	messages := []tsnet.Message{
+		&tsnet.ConnectMessage{Requester: name, Target: "b"},
+		&tsnet.ConnectMessage{Requester: name, Target: "b", Cookie: "c00kie"},
+		&tsnet.AcceptMessage{Target: name, KexReply: "k.reply", Signature: "sig"},
+		&tsnet.AcceptMessage{Target: name, KexReply: "k.reply", Signature: "sig", QUICPort: 4433},
+		&tsnet.RejectMessage{Target: name, Reason: "wrong name"},
+		&tsnet.ChallengeMessage{Target: name, Nonce: "nonce"},
+		&tsnet.ChallengeMessage{Target: name, Nonce: "nonce", Caps: "auth,quic=4433"},
+		&tsnet.ChallengeResponseMessage{Target: name, Signature: "sig", KexOffer: "k.offer"},
+		&tsnet.ChallengeResponseMessage{Target: name, Signature: "sig", KexOffer: "k.offer", Caps: "auth"},
+		&tsnet.CookieMessage{Cookie: "c00kie"},
+		&tsnet.RegisterMessage{Name: name, PublicKey: "pub"},
+		&tsnet.RegisterMessage{Name: name, PublicKey: "pub", Mapped: "203.0.113.7:40000"},
+		&tsnet.RegisterMessage{Name: name, PublicKey: "pub", External: "s.signed/ext"},
+		&tsnet.RegisterMessage{Name: name, PublicKey: "pub", Mapped: "203.0.113.7:40000", External: "s.signed/ext"},
+		&tsnet.ObservedMessage{Address: "203.0.113.7:1234"},
+		&tsnet.IntroduceMessage{Requester: name, Target: "b"},
+		&tsnet.PunchMessage{Name: name, PublicKey: "pub", Address: "203.0.113.7:1234"},
+		&tsnet.PunchMessage{Name: name, PublicKey: "pub", Address: "203.0.113.7:1234", External: "s.signed/ext"},
+		&tsnet.NoPunchMessage{Target: name},
+		&tsnet.HoleMessage{Name: name},
+		&tsnet.DataMessage{Target: name, Data: "signed/data"},
+		&tsnet.DataMessage{Target: name, Data: "sealed", Sealed: true},
+		&tsnet.RestartMessage{Target: name, Signed: "1000/sig"},
+		&tsnet.KeepaliveMessage{Target: name},
+		&tsnet.KeepaliveMessage{Target: name, Reply: true},
+		&tsnet.ProbeMessage{Target: name, MTU: 1500, Padding: "xxx"},
+		&tsnet.ProbeReplyMessage{Target: name, MTU: 9000},
+		&tsnet.RevealMessage{Target: name, Name: "sealed"},
+		&tsnet.RevealMessage{Target: name, Name: "sealed", Reply: true},
+	}
+	for _, format := range []tsnet.WireFormat{tsnet.WireText, tsnet.WireBinary} {
+		for _, m := range messages {
+			buf := tsnet.EncodeMessage(m, format)
+			if tsnet.IsBinaryMessage(buf) != (format == tsnet.WireBinary) {
+				t.Errorf("%v encoding of %+v: %q", format, m, buf)
+			}
+			got, err := tsnet.DecodeMessage(buf)
+			if err != nil {
+				t.Errorf("Decoding %v %q: %v", format, buf, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, m) {
+				t.Errorf("%v round trip of %+v gave %+v", format, m, got)
+			}
+		}
+	}
+}
+
+// TestWireCompatibility checks the binary messages are smaller, the text ones are the historical
+// formats and the padding and later versions are handled.
+func TestWireCompatibility(t *testing.T) {
+	m := &tsnet.KeepaliveMessage{Target: "peer"}
+	text := tsnet.EncodeMessage(m, tsnet.WireText)
+	if want := fmt.Sprintf(tsnet.KeepaliveMessageFormat, "peer"); string(text) != want {
+		t.Errorf("Text encoding %q, expected %q", text, want)
+	}
+	bin := tsnet.EncodeMessage(m, tsnet.WireBinary)
+	if len(bin) >= len(text) {
+		t.Errorf("Binary encoding %q not smaller than %q", bin, text)
+	}
+	connect := &tsnet.ConnectMessage{Requester: "a", Target: "b"}
+	for _, format := range []tsnet.WireFormat{tsnet.WireText, tsnet.WireBinary} {
+		padded := tsnet.PadMessage(tsnet.EncodeMessage(connect, format), tsnet.ConnectMinSize, ' ')
+		if len(padded) != tsnet.ConnectMinSize {
+			t.Errorf("Padded %v message is %d bytes", format, len(padded))
+		}
+		if got, err := tsnet.DecodeMessage(padded); err != nil || !reflect.DeepEqual(got, connect) {
+			t.Errorf("Padded %v message decoded as %+v, %v", format, got, err)
+		}
+	}
+	later := append([]byte{}, bin...)
+	later[1] = tsnet.WireVersion + 1
+	if _, err := tsnet.DecodeMessage(later); !errors.Is(err, tsnet.ErrWireVersion) {
+		t.Errorf("Expected ErrWireVersion for a later version, got %v", err)
+	}
+	for _, bad := range [][]byte{bin[:len(bin)-1], {tsnet.WireMagic, tsnet.WireVersion, 255}, []byte("unknown1 \"x\"")} {
+		if got, err := tsnet.DecodeMessage(bad); err == nil {
+			t.Errorf("Expected an error decoding %q, got %+v", bad, got)
+		}
+	}
+	if f, err := tsnet.ParseWireFormat("Binary"); err != nil || f != tsnet.WireBinary || f.String() != "binary" {
+		t.Errorf("ParseWireFormat: %v %v", f, err)
+	}
+}
+
+// TestWireBinary connects a server sending binary messages to one sending text ones.
+func TestWireBinary(t *testing.T) {
+	a := newUnicastServer(t, `binary "A"`)
+	a.Wire = tsnet.WireBinary
+	b := newUnicastServer(t, "textB")
+	received := make(chan string, 1)
+	b.OnData = func(_ tsnet.Peer, data []byte) { received <- string(data) }
+	ctx := context.Background()
+	for _, srv := range []*tsnet.Server{a, b} {
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer srv.Stop()
+	}
+	peerA, portA := asPeer(a)
+	peerB, portB := asPeer(b)
+	a.AddPeer(peerB, portB)
+	b.AddPeer(peerA, portA)
+	if err := a.ConnectToPeer(peerB); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := a.Connections.WaitConnected(ctx, peerB); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	if mtu, err := a.ProbeMTU(ctx, peerB); err != nil || mtu <= tsnet.DefaultMTU {
+		t.Errorf("ProbeMTU: %d %v", mtu, err)
+	}
+	if err := a.SendData(peerB, []byte("binary data")); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	select {
+	case got := <-received:
+		if got != "binary data" {
+			t.Errorf("Unexpected data %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for the data")
+	}
+}
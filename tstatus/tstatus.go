@@ -0,0 +1,174 @@
+// Package tstatus is the view model of a running tsync: our identity, the peers, the transfers in
+// progress and a few totals as plain structs with stable JSON names, built from the tsnet.Server
+// by Snapshot. The terminal UI's peers table, `tsync peers -json` and the control API (tapi) all
+// show these so they can't drift apart.
+package tstatus
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/txfer"
+)
+
+// Status is everything the UIs show.
+type Status struct {
+	Self      Self       `json:"self"`
+	Peers     []Peer     `json:"peers"`
+	Transfers []Transfer `json:"transfers"`
+	Stats     Stats      `json:"stats"`
+}
+
+// Self is our identity and address.
+type Self struct {
+	Name      string `json:"name"`
+	IP        string `json:"ip"`
+	Port      int    `json:"port"`
+	PublicKey string `json:"public_key"`
+	HumanHash string `json:"human_hash"`
+}
+
+// Peer is a discovered (or added) peer.
+type Peer struct {
+	ID        int       `json:"id"` // position in the sorted peers, from 1, as numbered in the terminal UI.
+	Name      string    `json:"name"`
+	IP        string    `json:"ip"`
+	Port      int       `json:"port"`
+	PublicKey string    `json:"public_key"`
+	HumanHash string    `json:"human_hash"`
+	Status    string    `json:"status"` // see StatusName.
+	MTU       int       `json:"mtu"`    // 0 until probed.
+	LastSeen  time.Time `json:"last_seen"`
+	Addrs     []string  `json:"addrs,omitempty"`     // ip:port of its other addresses (multi-homed peers).
+	Reason    string    `json:"reason,omitempty"`    // why our last connection request failed.
+	RealName  string    `json:"real_name,omitempty"` // revealed by peers advertising a hidden Name.
+}
+
+// Transfer is a stream, or a drop to our inbox, in progress.
+type Transfer struct {
+	ID       uint32 `json:"id"`
+	Peer     string `json:"peer"` // name.
+	Incoming bool   `json:"incoming"`
+	Bytes    int64  `json:"bytes"`          // received, or read from the source for outgoing ones.
+	Name     string `json:"name,omitempty"` // file name of drops to our inbox.
+	Size     int64  `json:"size,omitempty"` // announced size of drops, 0 if unknown.
+}
+
+// Stats are the totals of the peers and transfers (see NewStats).
+type Stats struct {
+	Peers     int   `json:"peers"`
+	Connected int   `json:"connected"`
+	Transfers int   `json:"transfers"`
+	Bytes     int64 `json:"bytes"` // of the transfers in progress.
+}
+
+var statusNames = map[tsnet.ConnectionStatus]string{
+	tsnet.NotLinked:    "not-linked",
+	tsnet.SentConn:     "connecting",
+	tsnet.ReceivedConn: "requested",
+	tsnet.Connected:    "connected",
+	tsnet.Failed:       "failed",
+	tsnet.Restarting:   "restarting",
+	tsnet.Unreachable:  "unreachable",
+	tsnet.Disconnected: "disconnected",
+}
+
+// StatusName returns the stable name of the connection status, e.g. "connected".
+func StatusName(status tsnet.ConnectionStatus) string {
+	return statusNames[status]
+}
+
+// ParseStatus returns the connection status named name (see StatusName), false if unknown.
+func ParseStatus(name string) (tsnet.ConnectionStatus, bool) {
+	for status, n := range statusNames {
+		if n == name {
+			return status, true
+		}
+	}
+	return tsnet.NotLinked, false
+}
+
+// NewPeer returns the view of the peer, id being its position in the sorted peers (from 1).
+func NewPeer(id int, peer tsnet.Peer, data tsnet.PeerData) Peer {
+	var addrs []string
+	for _, a := range data.Addrs {
+		addrs = append(addrs, net.JoinHostPort(a.IP, strconv.Itoa(a.Port)))
+	}
+	return Peer{
+		ID:        id,
+		Name:      peer.Name,
+		IP:        peer.IP,
+		Port:      data.Port,
+		PublicKey: peer.PublicKey,
+		HumanHash: data.HumanHash,
+		Status:    StatusName(data.Status),
+		MTU:       data.MTU,
+		LastSeen:  data.LastSeen,
+		Addrs:     addrs,
+		Reason:    data.Reason,
+		RealName:  data.RealName,
+	}
+}
+
+// Peers returns the server's peers, sorted with tsnet.PeerKVSort.
+func Peers(srv *tsnet.Server) []Peer {
+	kvs := srv.Peers.KeysValuesSnapshot()
+	slices.SortFunc(kvs, tsnet.PeerKVSort)
+	peers := make([]Peer, len(kvs))
+	for i, kv := range kvs {
+		peers[i] = NewPeer(i+1, kv.Key, kv.Value)
+	}
+	return peers
+}
+
+// Transfers returns the server's streams and the box's drops (box can be nil) in progress,
+// sorted by ID.
+func Transfers(srv *tsnet.Server, box *txfer.DropBox) []Transfer {
+	transfers := []Transfer{}
+	for _, t := range srv.Transfers.List() {
+		transfers = append(transfers, Transfer{ID: t.ID, Peer: t.Peer.Name, Incoming: t.Incoming, Bytes: t.Bytes})
+	}
+	if box != nil {
+		for _, d := range box.Active() {
+			transfers = append(transfers, Transfer{
+				ID: d.ID, Peer: d.From, Incoming: true, Bytes: d.Received, Name: d.Name, Size: d.Size,
+			})
+		}
+	}
+	slices.SortFunc(transfers, func(a, b Transfer) int { return cmp.Compare(a.ID, b.ID) })
+	return transfers
+}
+
+// NewSelf returns our view, without address when the server isn't running.
+func NewSelf(srv *tsnet.Server) Self {
+	self := Self{Name: srv.Name, PublicKey: srv.Identity.PublicKeyToString(), HumanHash: srv.Identity.HumanID()}
+	if addr := srv.OurAddress(); addr != nil {
+		self.IP, self.Port = addr.IP.String(), addr.Port
+	}
+	return self
+}
+
+// NewStats returns the totals of the peers and transfers.
+func NewStats(peers []Peer, transfers []Transfer) Stats {
+	stats := Stats{Peers: len(peers), Transfers: len(transfers)}
+	for _, p := range peers {
+		if p.Status == StatusName(tsnet.Connected) {
+			stats.Connected++
+		}
+	}
+	for _, t := range transfers {
+		stats.Bytes += t.Bytes
+	}
+	return stats
+}
+
+// Snapshot returns the status of the server and the box's drops (box can be nil).
+func Snapshot(srv *tsnet.Server, box *txfer.DropBox) *Status {
+	st := &Status{Self: NewSelf(srv), Peers: Peers(srv), Transfers: Transfers(srv, box)}
+	st.Stats = NewStats(st.Peers, st.Transfers)
+	return st
+}
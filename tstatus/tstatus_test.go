@@ -0,0 +1,63 @@
+package tstatus_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tstatus"
+)
+
+func TestSnapshot(t *testing.T) {
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := tsnet.Config{Name: "self", Identity: id, NoDiscovery: true}
+	srv := cfg.NewServer()
+	srv.AddPeer(tsnet.Peer{IP: "10.0.0.2", Name: "b", PublicKey: id.PublicKeyToString()}, 1002)
+	srv.AddPeer(tsnet.Peer{IP: "10.0.0.1", Name: "a", PublicKey: id.PublicKeyToString()}, 1001)
+	peerB := tsnet.Peer{IP: "10.0.0.2", Name: "b", PublicKey: id.PublicKeyToString()}
+	data, _ := srv.Peers.Get(peerB)
+	data.Status = tsnet.Connected
+	srv.Peers.Set(peerB, data)
+	st := tstatus.Snapshot(srv, nil)
+	if st.Self.Name != "self" || st.Self.HumanHash != id.HumanID() {
+		t.Errorf("Self = %+v", st.Self)
+	}
+	if len(st.Peers) != 2 || st.Peers[0].Name != "a" || st.Peers[0].ID != 1 || st.Peers[1].ID != 2 {
+		t.Fatalf("Peers = %+v", st.Peers)
+	}
+	if st.Peers[1].Status != "connected" || st.Peers[1].Port != 1002 || st.Peers[0].Status != "not-linked" {
+		t.Errorf("Peer b = %+v", st.Peers[1])
+	}
+	if st.Stats != (tstatus.Stats{Peers: 2, Connected: 1}) {
+		t.Errorf("Stats = %+v", st.Stats)
+	}
+	out, err := json.Marshal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"self":`, `"public_key":`, `"human_hash":`, `"peers":[{"id":1,`, `"last_seen":`, `"transfers":[]`, `"connected":1`} {
+		if !strings.Contains(string(out), field) {
+			t.Errorf("JSON %s doesn't contain %s", out, field)
+		}
+	}
+}
+
+func TestStatusNames(t *testing.T) {
+	for status := tsnet.NotLinked; status <= tsnet.Disconnected; status++ {
+		name := tstatus.StatusName(status)
+		if name == "" {
+			t.Errorf("No name for status %d", status)
+		}
+		if got, ok := tstatus.ParseStatus(name); !ok || got != status {
+			t.Errorf("ParseStatus(%q) = %v, %v, want %v", name, got, ok, status)
+		}
+	}
+	if _, ok := tstatus.ParseStatus("bogus"); ok {
+		t.Errorf("ParseStatus of an unknown name succeeded")
+	}
+}
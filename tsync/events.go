@@ -0,0 +1,82 @@
+package tsync
+
+// DefaultEventBuffer is the channel buffer size used by Subscribe when 0 is passed.
+const DefaultEventBuffer = 64
+
+// EventType is the type of an Event.
+type EventType int
+
+const (
+	// PeersChanged is sent when a peer is discovered, updated or expired (see Node.Peers).
+	PeersChanged EventType = iota
+	// StreamReceived is sent when an incoming stream is done, Err is nil if it was fully
+	// received and verified.
+	StreamReceived
+	// DataReceived is sent for (signature verified) data messages which aren't part of streams.
+	DataReceived
+	// PeerDisconnected is sent when a connected peer stopped answering the keepalives (its Status
+	// is then Disconnected) or left.
+	PeerDisconnected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PeersChanged:
+		return "PeersChanged"
+	case StreamReceived:
+		return "StreamReceived"
+	case DataReceived:
+		return "DataReceived"
+	case PeerDisconnected:
+		return "PeerDisconnected"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is sent to the subscribers (see Subscribe), only the fields relevant to the Type are set.
+type Event struct {
+	Type     EventType
+	Peer     Peer
+	StreamID uint32
+	Size     int64 // bytes received for StreamReceived
+	Err      error
+	Data     []byte // for DataReceived
+}
+
+type subscription struct {
+	ch chan Event
+}
+
+// Subscribe returns a channel receiving the node's events and a function to unsubscribe
+// (which closes the channel, as does Stop). Events are dropped (and logged) when the channel's
+// buffer (of the given size, DefaultEventBuffer if 0) is full, so receivers must keep up.
+func (n *Node) Subscribe(buffer int) (<-chan Event, func()) {
+	if buffer <= 0 {
+		buffer = DefaultEventBuffer
+	}
+	sub := &subscription{ch: make(chan Event, buffer)}
+	n.mu.Lock()
+	n.subs[sub] = struct{}{}
+	n.mu.Unlock()
+	return sub.ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if _, ok := n.subs[sub]; ok {
+			delete(n.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+func (n *Node) publish(e Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for sub := range n.subs {
+		select {
+		case sub.ch <- e:
+		default:
+			n.log.Warnf("Subscriber too slow, dropping %v event", e.Type)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package tsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// LoadIdentity loads our identity from the storage directory (see tcrypto.StorageDirs), creating (and saving) a new one the first time.
+func LoadIdentity() (*tcrypto.Identity, error) {
+	return loadIdentity(tsnet.FortioLogger{})
+}
+
+func loadIdentity(logger tsnet.Logger) (*tcrypto.Identity, error) {
+	storage, err := tcrypto.InitStorage()
+	if err != nil {
+		return nil, err
+	}
+	if storage.Migrated != "" {
+		logger.Warnf("Moved %s to %s (plugins to %s)", storage.Migrated, storage.Dir, storage.ConfigDir)
+	}
+	// Locked so concurrent first runs agree on a single identity.
+	unlock, err := storage.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	// Try to load existing identity
+	op := "Loaded"
+	logf := logger.Infof
+	id, err := storage.LoadIdentity()
+	if err != nil {
+		if _, serr := os.Stat(filepath.Join(storage.Dir, tcrypto.PrivateIdentityFile)); serr == nil {
+			// Corrupted, mismatched or incomplete: kept aside rather than overwritten.
+			dir, qerr := storage.Quarantine(tcrypto.PrivateIdentityFile, tcrypto.PublicIdentityFile)
+			if qerr != nil {
+				return nil, fmt.Errorf("invalid identity (%w) and quarantine failed: %w", err, qerr)
+			}
+			logger.Errf("Invalid identity, moved to %s: %v", dir, err)
+		}
+		logger.Infof("No existing identity found, creating new one: %v", err)
+		id, err = tcrypto.NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		err = storage.SaveIdentity(id)
+		if err != nil {
+			return nil, err
+		}
+		op = "Created"
+		logf = logger.Warnf
+	}
+	logf("%s identity with public key: %s", op, id.PublicKeyToString())
+	return id, nil
+}
@@ -0,0 +1,285 @@
+// Package tsync is the API to embed tsync peer discovery and transfers in other Go programs.
+// It wraps the lower level (and less stable) tsnet and txfer packages:
+//
+//	node, err := tsync.NewNode(tsync.Options{Name: "myapp"})
+//	...
+//	err = node.Start(ctx)
+//	defer node.Stop()
+//	peer, err := node.WaitForPeer(ctx, "otherhost")
+//	err = node.Connect(ctx, peer)
+//	n, err := node.Send(ctx, peer, reader)
+//
+// with the receiving node's Options.Receive returning where to write the incoming streams
+// and Subscribe to get notified of peer changes, streams received and data messages.
+package tsync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsnet"
+)
+
+// DefaultMcast is the multicast address used for discovery (239.255."t"."s").
+const DefaultMcast = "239.255.116.115"
+
+// ErrStreamRefused is reported by a StreamReceived event for streams Options.Receive didn't accept.
+var ErrStreamRefused = errors.New("stream refused")
+
+// Options configures a Node, the zero value is valid and uses the same defaults as the tsync command.
+type Options struct {
+	// Name to use, if empty hostname will be used.
+	Name string
+	// Discovery multicast port and address (defaults to tsnet.DefaultDiscoveryPort and DefaultMcast).
+	Port  int
+	Mcast string
+	// Which ip:port we try to resolve to find our address and interface (default tsnet.DefaultTarget).
+	Target string
+	// Identity to use, the one from ~/.tsync (created if needed, see LoadIdentity) when nil.
+	Identity          *tcrypto.Identity
+	BroadcastInterval time.Duration // default tsnet.DefaultBroadcastInterval
+	PeerTimeout       time.Duration // default tsnet.DefaultPeerTimeout
+	// Don't use multicast discovery, peers must then be added with AddPeer.
+	NoDiscovery bool
+	// Receive returns where to write a stream sent by the peer (with Send), nil to refuse it.
+	// Called from the network receive goroutine, as are the writes, so they must not block for long.
+	// Streams are refused when Receive isn't set.
+	Receive func(from Peer, id uint32) io.Writer
+	// Logger to use instead of the fortio.org/log globals (e.g. tsnet.NoLogger), nil for the default.
+	Logger tsnet.Logger
+}
+
+// ConnectionStatus is the status of our connection to a peer.
+type ConnectionStatus = tsnet.ConnectionStatus
+
+const (
+	NotLinked    = tsnet.NotLinked
+	SentConn     = tsnet.SentConn
+	ReceivedConn = tsnet.ReceivedConn
+	Connected    = tsnet.Connected
+	Failed       = tsnet.Failed
+	Restarting   = tsnet.Restarting
+	Unreachable  = tsnet.Unreachable
+	Disconnected = tsnet.Disconnected
+)
+
+// Peer is a (discovered or added) peer.
+type Peer struct {
+	Name      string
+	IP        string
+	Port      int
+	PublicKey string // string form of the peer identity's public key.
+	HumanHash string // short human readable hash of PublicKey, to be compared out of band.
+	MTU       int    // probed path MTU (see Connect), 0 if not probed yet.
+	Status    ConnectionStatus
+	LastSeen  time.Time
+}
+
+func (p Peer) key() tsnet.Peer {
+	return tsnet.Peer{IP: p.IP, Name: p.Name, PublicKey: p.PublicKey}
+}
+
+func newPeer(peer tsnet.Peer, data tsnet.PeerData) Peer {
+	return Peer{
+		Name:      peer.Name,
+		IP:        peer.IP,
+		Port:      data.Port,
+		PublicKey: peer.PublicKey,
+		HumanHash: data.HumanHash,
+		MTU:       data.MTU,
+		Status:    data.Status,
+		LastSeen:  data.LastSeen,
+	}
+}
+
+// Node is a tsync peer: it discovers the other peers and sends/receives streams to/from them.
+type Node struct {
+	srv     *tsnet.Server
+	receive func(from Peer, id uint32) io.Writer
+	mu      sync.Mutex
+	subs    map[*subscription]struct{}
+	log     tsnet.Logger
+}
+
+// NewNode creates a node from the options, see Start.
+func NewNode(opts Options) (*Node, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = tsnet.FortioLogger{}
+	}
+	id := opts.Identity
+	if id == nil {
+		var err error
+		id, err = loadIdentity(logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Port == 0 {
+		opts.Port = tsnet.DefaultDiscoveryPort
+	}
+	if opts.Mcast == "" {
+		opts.Mcast = DefaultMcast
+	}
+	n := &Node{receive: opts.Receive, subs: make(map[*subscription]struct{}), log: logger}
+	cfg := tsnet.Config{
+		Name:                  opts.Name,
+		Port:                  opts.Port,
+		Mcast:                 opts.Mcast,
+		Target:                opts.Target,
+		Identity:              id,
+		BaseBroadcastInterval: opts.BroadcastInterval,
+		PeerTimeout:           opts.PeerTimeout,
+		NoDiscovery:           opts.NoDiscovery,
+		OnChange:              n.onChange,
+		OnData:                n.onData,
+		OnStream:              n.onStream,
+		OnStreamDone:          n.onStreamDone,
+		OnDisconnect:          n.onDisconnect,
+		Logger:                opts.Logger,
+	}
+	n.srv = cfg.NewServer()
+	return n, nil
+}
+
+// Start starts the node's networking (and discovery unless Options.NoDiscovery).
+func (n *Node) Start(ctx context.Context) error {
+	return n.srv.Start(ctx)
+}
+
+// Stop stops the node, aborting the Sends in progress, and closes the subscriptions.
+func (n *Node) Stop() {
+	n.srv.Stop()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for sub := range n.subs {
+		delete(n.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Name returns our name (the hostname unless Options.Name was set), valid once started.
+func (n *Node) Name() string {
+	return n.srv.Name
+}
+
+// Self returns ourselves as a Peer (e.g. to be given to AddPeer of other nodes), valid once started.
+func (n *Node) Self() Peer {
+	addr := n.srv.OurAddress()
+	id := n.srv.Identity
+	return Peer{
+		Name:      n.srv.Name,
+		IP:        addr.IP.String(),
+		Port:      addr.Port,
+		PublicKey: id.PublicKeyToString(),
+		HumanHash: id.HumanID(),
+	}
+}
+
+// Peers returns the current peers, sorted by IP, name and public key.
+func (n *Node) Peers() []Peer {
+	kvs := n.srv.Peers.KeysValuesSnapshot()
+	slices.SortFunc(kvs, tsnet.PeerKVSort)
+	peers := make([]Peer, 0, len(kvs))
+	for _, kv := range kvs {
+		peers = append(peers, newPeer(kv.Key, kv.Value))
+	}
+	return peers
+}
+
+// FindPeer returns the first (in Peers order) peer with that name.
+func (n *Node) FindPeer(name string) (Peer, bool) {
+	for _, peer := range n.Peers() {
+		if peer.Name == name {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+// WaitForPeer waits for a peer with that name to be discovered (or ctx to be done).
+func (n *Node) WaitForPeer(ctx context.Context, name string) (Peer, error) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if peer, ok := n.FindPeer(name); ok {
+			return peer, nil
+		}
+		select {
+		case <-ctx.Done():
+			return Peer{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// AddPeer adds a peer known out of band (typically when running with Options.NoDiscovery).
+func (n *Node) AddPeer(peer Peer) {
+	n.srv.AddPeer(peer.key(), peer.Port)
+}
+
+// Connect sends a connection request to the peer, waits for it to be accepted (after proving we
+// own our identity, see tsnet.ConnectionManager.WaitConnected) and probes the path MTU to it so Send
+// uses the largest possible datagrams. MTU probing failures aren't errors (the safe default is used).
+func (n *Node) Connect(ctx context.Context, peer Peer) error {
+	if err := n.srv.ConnectToPeer(peer.key()); err != nil {
+		return err
+	}
+	if err := n.srv.Connections.WaitConnected(ctx, peer.key()); err != nil {
+		return err
+	}
+	if _, err := n.srv.ProbeMTU(ctx, peer.key()); err != nil {
+		n.log.Warnf("MTU probing to %q failed: %v", peer.Name, err)
+	}
+	return nil
+}
+
+// Send streams r, until EOF, to the peer (whose Options.Receive must accept it) with congestion
+// control and whole content hash verification. Returns the number of bytes sent.
+// Sends to a peer which announced a restart wait for it to be back (see AnnounceRestart).
+func (n *Node) Send(ctx context.Context, peer Peer, r io.Reader) (int64, error) {
+	return n.srv.Transfers.Send(ctx, peer.key(), r)
+}
+
+// AnnounceRestart tells the peers we are about to restart (e.g. to upgrade) and will be back, with
+// the same identity, within downtime: they pause their Sends to us until then instead of failing them.
+func (n *Node) AnnounceRestart(downtime time.Duration) error {
+	return n.srv.AnnounceRestart(downtime)
+}
+
+func (n *Node) onChange(_ uint64) {
+	n.publish(Event{Type: PeersChanged})
+}
+
+func (n *Node) onData(peer tsnet.Peer, data []byte) {
+	n.publish(Event{Type: DataReceived, Peer: n.peer(peer), Data: append([]byte(nil), data...)})
+}
+
+func (n *Node) onStream(peer tsnet.Peer, id uint32) io.Writer {
+	var w io.Writer
+	if n.receive != nil {
+		w = n.receive(n.peer(peer), id)
+	}
+	if w == nil {
+		n.publish(Event{Type: StreamReceived, Peer: n.peer(peer), StreamID: id, Err: ErrStreamRefused})
+	}
+	return w
+}
+
+func (n *Node) onStreamDone(peer tsnet.Peer, id uint32, size int64, err error) {
+	n.publish(Event{Type: StreamReceived, Peer: n.peer(peer), StreamID: id, Size: size, Err: err})
+}
+
+func (n *Node) onDisconnect(peer tsnet.Peer) {
+	n.publish(Event{Type: PeerDisconnected, Peer: n.peer(peer)})
+}
+
+func (n *Node) peer(peer tsnet.Peer) Peer {
+	data, _ := n.srv.Peers.Get(peer)
+	return newPeer(peer, data)
+}
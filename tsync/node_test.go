@@ -0,0 +1,106 @@
+package tsync_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tsync"
+)
+
+func newNode(t *testing.T, name string, receive func(from tsync.Peer, id uint32) io.Writer) *tsync.Node {
+	t.Helper()
+	id, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := tsync.NewNode(tsync.Options{Name: name, Identity: id, NoDiscovery: true, Receive: receive})
+	if err != nil {
+		t.Fatalf("NewNode failed: %v", err)
+	}
+	if err = node.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(node.Stop)
+	return node
+}
+
+// waitEvent returns the next event of that type (skipping the others).
+func waitEvent(t *testing.T, events <-chan tsync.Event, typ tsync.EventType) tsync.Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("Events closed while waiting for %v", typ)
+			}
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for %v event", typ)
+		}
+	}
+}
+
+func TestNodeSend(t *testing.T) {
+	var received bytes.Buffer // only written and then read after the StreamReceived event.
+	alice := newNode(t, "alice", nil)
+	bob := newNode(t, "bob", func(from tsync.Peer, _ uint32) io.Writer {
+		if from.Name != "alice" {
+			return nil
+		}
+		return &received
+	})
+	bobEvents, unsubscribe := bob.Subscribe(0)
+	defer unsubscribe()
+	aliceEvents, _ := alice.Subscribe(0)
+	alice.AddPeer(bob.Self())
+	bob.AddPeer(alice.Self())
+	waitEvent(t, aliceEvents, tsync.PeersChanged)
+	peer, err := alice.WaitForPeer(context.Background(), "bob")
+	if err != nil {
+		t.Fatalf("WaitForPeer failed: %v", err)
+	}
+	if peer.HumanHash != bob.Self().HumanHash || peer.Port != bob.Self().Port {
+		t.Errorf("Peer %+v doesn't match bob %+v", peer, bob.Self())
+	}
+	if err = alice.Connect(context.Background(), peer); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if p, _ := alice.FindPeer("bob"); p.Status != tsync.Connected || p.MTU == 0 {
+		t.Errorf("Unexpected peer state after Connect: %+v", p)
+	}
+	data := bytes.Repeat([]byte("tsync embedding "), 10_000)
+	n, err := alice.Send(context.Background(), peer, bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Send: %d %v", n, err)
+	}
+	e := waitEvent(t, bobEvents, tsync.StreamReceived)
+	if e.Err != nil || e.Size != int64(len(data)) || e.Peer.Name != "alice" {
+		t.Fatalf("Unexpected stream event %+v", e)
+	}
+	if !bytes.Equal(received.Bytes(), data) {
+		t.Errorf("Received data differs")
+	}
+	// Refused stream: bob doesn't accept streams from carol.
+	carol := newNode(t, "carol", nil)
+	carol.AddPeer(bob.Self())
+	bob.AddPeer(carol.Self())
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err = carol.Send(ctx, bob.Self(), bytes.NewReader(data)); err == nil {
+		t.Errorf("Send to a refusing peer should fail")
+	}
+	if e = waitEvent(t, bobEvents, tsync.StreamReceived); !errors.Is(e.Err, tsync.ErrStreamRefused) {
+		t.Errorf("Expected a refused stream event, got %+v", e)
+	}
+	alice.Stop()
+	for range aliceEvents { //nolint:revive // returns once Stop closed the channel.
+	}
+}
@@ -0,0 +1,360 @@
+// Package tupdate implements tsync's self update: find the latest GitHub release, check it was
+// signed by the publisher (see tcrypto.SignDetached) and atomically replace the running binary.
+//
+// Releases must include a "*checksums.txt" asset (sha256 and file name per line, as produced by
+// goreleaser), its signature as "*checksums.txt.sig" and a .tar.gz or .zip archive per os/arch
+// containing the binary, named with the release version like goreleaser does (name_1.2.3_linux_amd64.tar.gz):
+// as the names are in the signed checksums, this binds the version to the signature so an older
+// release can't be served under a newer tag.
+package tupdate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+)
+
+const (
+	// DefaultRepo is the GitHub owner/repository releases are fetched from.
+	DefaultRepo = "fortio/tsync"
+	// DefaultAPIURL is the GitHub API base URL.
+	DefaultAPIURL   = "https://api.github.com"
+	ChecksumsSuffix = "checksums.txt"
+	SignatureSuffix = ".sig"
+	// MaxDownloadSize bounds what we download (archives and metadata).
+	MaxDownloadSize = 200 << 20
+)
+
+// PublisherKey is the public key (tcrypto string form, "p.…") of the release signer, embedded
+// at build time with -ldflags "-X fortio.org/tsync/tupdate.PublisherKey=p.…".
+// Updates are refused by builds without it.
+var PublisherKey = ""
+
+var (
+	ErrNoPublisherKey = errors.New("no release publisher key in this build, update manually")
+	ErrNoAsset        = errors.New("release asset not found")
+	ErrChecksum       = errors.New("checksum mismatch")
+	ErrVersion        = errors.New("release tag doesn't match its signed archive's version")
+)
+
+// Asset is a file attached to a release.
+type Asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// Release is the part of the GitHub release API response we use.
+type Release struct {
+	Tag    string  `json:"tag_name"`
+	Assets []Asset `json:"assets"`
+}
+
+// Version returns the release version without the leading "v".
+func (r *Release) Version() string {
+	return strings.TrimPrefix(r.Tag, "v")
+}
+
+// Updater checks for and downloads verified releases.
+type Updater struct {
+	Repo      string // default DefaultRepo
+	APIURL    string // default DefaultAPIURL
+	Client    *http.Client
+	Publisher ed25519.PublicKey
+	GOOS      string // default runtime.GOOS
+	GOARCH    string // default runtime.GOARCH
+	Binary    string // name of the binary in the archives, default "tsync" (plus ".exe" on windows)
+}
+
+// New returns an Updater for the default repository verifying releases with publisherKey
+// (typically PublisherKey).
+func New(publisherKey string) (*Updater, error) {
+	if publisherKey == "" {
+		return nil, ErrNoPublisherKey
+	}
+	pub, err := tcrypto.IdentityPublicKeyString(publisherKey)
+	if err == nil && len(pub) != ed25519.PublicKeySize {
+		err = tcrypto.NewEncodingErr("invalid public key size")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid publisher key %q: %w", publisherKey, err)
+	}
+	return &Updater{Publisher: pub}, nil
+}
+
+func (u *Updater) setDefaults() {
+	if u.Repo == "" {
+		u.Repo = DefaultRepo
+	}
+	if u.APIURL == "" {
+		u.APIURL = DefaultAPIURL
+	}
+	if u.Client == nil {
+		u.Client = http.DefaultClient
+	}
+	if u.GOOS == "" {
+		u.GOOS = runtime.GOOS
+	}
+	if u.GOARCH == "" {
+		u.GOARCH = runtime.GOARCH
+	}
+	if u.Binary == "" {
+		u.Binary = "tsync"
+		if u.GOOS == "windows" {
+			u.Binary += ".exe"
+		}
+	}
+}
+
+func (u *Updater) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxDownloadSize+1))
+	if err == nil && len(data) > MaxDownloadSize {
+		err = fmt.Errorf("GET %s: more than %d bytes", url, MaxDownloadSize)
+	}
+	return data, err
+}
+
+// Latest returns the latest release.
+func (u *Updater) Latest(ctx context.Context) (*Release, error) {
+	u.setDefaults()
+	data, err := u.get(ctx, fmt.Sprintf("%s/repos/%s/releases/latest", u.APIURL, u.Repo))
+	if err != nil {
+		return nil, err
+	}
+	var rel Release
+	if err = json.Unmarshal(data, &rel); err != nil {
+		return nil, fmt.Errorf("invalid release response: %w", err)
+	}
+	return &rel, nil
+}
+
+func (r *Release) find(match func(name string) bool) (Asset, error) {
+	for _, a := range r.Assets {
+		if match(a.Name) {
+			return a, nil
+		}
+	}
+	return Asset{}, ErrNoAsset
+}
+
+// archive returns the archive asset for our os/arch (macOS universal binaries are "darwin_all").
+func (u *Updater) archive(rel *Release) (Asset, error) {
+	arches := []string{u.GOARCH}
+	if u.GOOS == "darwin" {
+		arches = append(arches, "all")
+	}
+	for _, arch := range arches {
+		platform := "_" + u.GOOS + "_" + arch
+		a, err := rel.find(func(name string) bool {
+			base := strings.TrimSuffix(strings.TrimSuffix(name, ".tar.gz"), ".zip")
+			return base != name && strings.HasSuffix(base, platform)
+		})
+		if err == nil {
+			return a, nil
+		}
+	}
+	return Asset{}, fmt.Errorf("%w: no archive for %s/%s in %s", ErrNoAsset, u.GOOS, u.GOARCH, rel.Tag)
+}
+
+// Download fetches the release's binary for our os/arch, after verifying the checksums file's
+// signature, that the (signed) archive name has the release's version and the archive's checksum.
+func (u *Updater) Download(ctx context.Context, rel *Release) ([]byte, error) {
+	u.setDefaults()
+	sums, err := rel.find(func(name string) bool { return strings.HasSuffix(name, ChecksumsSuffix) })
+	if err != nil {
+		return nil, fmt.Errorf("%w: no checksums in %s", err, rel.Tag)
+	}
+	sig, err := rel.find(func(name string) bool { return name == sums.Name+SignatureSuffix })
+	if err != nil {
+		return nil, fmt.Errorf("%w: release %s isn't signed", err, rel.Tag)
+	}
+	archive, err := u.archive(rel)
+	if err != nil {
+		return nil, err
+	}
+	sumsData, err := u.get(ctx, sums.URL)
+	if err != nil {
+		return nil, err
+	}
+	sigData, err := u.get(ctx, sig.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err = tcrypto.VerifyDetached(sumsData, string(sigData), u.Publisher); err != nil {
+		return nil, fmt.Errorf("release %s: %w", rel.Tag, err)
+	}
+	if !strings.Contains(archive.Name, "_"+rel.Version()+"_") {
+		return nil, fmt.Errorf("%w: %s for %s", ErrVersion, archive.Name, rel.Tag)
+	}
+	want, err := checksum(sumsData, archive.Name)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Downloading %s", archive.URL)
+	data, err := u.get(ctx, archive.URL)
+	if err != nil {
+		return nil, err
+	}
+	if got := sha256.Sum256(data); !bytes.Equal(got[:], want) {
+		return nil, fmt.Errorf("%w for %s", ErrChecksum, archive.Name)
+	}
+	return extract(archive.Name, data, u.Binary)
+}
+
+// checksum finds name's sha256 in the checksums file.
+func checksum(sums []byte, name string) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == name {
+			return hex.DecodeString(fields[0])
+		}
+	}
+	return nil, fmt.Errorf("%w: %s not in checksums", ErrNoAsset, name)
+}
+
+// extract returns the content of the binary file in the .tar.gz or .zip archive.
+func extract(archiveName string, data []byte, binary string) ([]byte, error) {
+	if strings.HasSuffix(archiveName, ".zip") {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if filepath.Base(f.Name) != binary {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return io.ReadAll(io.LimitReader(r, MaxDownloadSize))
+		}
+		return nil, fmt.Errorf("%w: %s not in %s", ErrNoAsset, binary, archiveName)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %s not in %s", ErrNoAsset, binary, archiveName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg && filepath.Base(h.Name) == binary {
+			return io.ReadAll(io.LimitReader(tr, MaxDownloadSize))
+		}
+	}
+}
+
+// Replace atomically replaces the executable exe with binary: written next to it and renamed
+// over it (on Windows the running exe is moved aside first, to exe.old, as it can't be overwritten).
+func Replace(exe string, binary []byte) error {
+	st, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), filepath.Base(exe)+".new*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once renamed.
+	if _, err = tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpName, st.Mode().Perm()); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		_ = os.Remove(old) // from a previous update.
+		if err = os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err = os.Rename(tmpName, exe); err != nil {
+			_ = os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(tmpName, exe)
+}
+
+// Newer returns true if version latest is newer than current (x.y.z with optional "v" prefix
+// and ignoring pre-release/build suffixes). Unparsable current versions (e.g. "dev") are older.
+func Newer(current, latest string) bool {
+	c, okC := parseVersion(current)
+	l, okL := parseVersion(latest)
+	if !okL {
+		return false
+	}
+	if !okC {
+		return true
+	}
+	for i := range c {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var res [3]int
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+ "); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return res, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return res, false
+		}
+		res[i] = n
+	}
+	return res, true
+}
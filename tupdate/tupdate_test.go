@@ -0,0 +1,197 @@
+package tupdate_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/tupdate"
+)
+
+func tarGz(t *testing.T, name string, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{{"README.md", []byte("readme")}, {name, content}} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o755, Size: int64(len(f.content))}); err != nil {
+			t.Fatalf("tar header: %v", err)
+		}
+		if _, err := tw.Write(f.content); err != nil {
+			t.Fatalf("tar write: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gzip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// releaseServer serves a fake GitHub latest release API with files (name -> content).
+func releaseServer(t *testing.T, tag string, files map[string][]byte) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	rel := tupdate.Release{Tag: tag}
+	for name, content := range files {
+		rel.Assets = append(rel.Assets, tupdate.Asset{Name: name, URL: srv.URL + "/download/" + name})
+		mux.HandleFunc("/download/"+name, func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write(content)
+		})
+	}
+	mux.HandleFunc("/repos/"+tupdate.DefaultRepo+"/releases/latest", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(rel)
+	})
+	return srv
+}
+
+func TestUpdate(t *testing.T) {
+	publisher, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatalf("NewIdentity: %v", err)
+	}
+	binary := []byte("#!/bin/sh\necho new tsync\n")
+	archive := tarGz(t, "tsync", binary)
+	archiveName := "tsync_1.2.0_linux_amd64.tar.gz"
+	sum := sha256.Sum256(archive)
+	sums := fmt.Appendf(nil, "%s  %s\n%s  %s\n", hex.EncodeToString(make([]byte, 32)), "tsync_1.2.0_windows_amd64.zip",
+		hex.EncodeToString(sum[:]), archiveName)
+	sumsName := "tsync_1.2.0_checksums.txt"
+	files := map[string][]byte{
+		archiveName:                        archive,
+		sumsName:                           sums,
+		sumsName + tupdate.SignatureSuffix: []byte(publisher.SignDetached(sums) + "\n"),
+	}
+	srv := releaseServer(t, "v1.2.0", files)
+	u, err := tupdate.New(publisher.PublicKeyToString())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	u.APIURL, u.GOOS, u.GOARCH = srv.URL, "linux", "amd64"
+	ctx := context.Background()
+	rel, err := u.Latest(ctx)
+	if err != nil {
+		t.Fatalf("Latest: %v", err)
+	}
+	if rel.Version() != "1.2.0" {
+		t.Errorf("Version() = %q, want 1.2.0", rel.Version())
+	}
+	got, err := u.Download(ctx, rel)
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if !bytes.Equal(got, binary) {
+		t.Errorf("Download got %q, want %q", got, binary)
+	}
+	// No archive for that platform.
+	u.GOARCH = "arm64"
+	if _, err = u.Download(ctx, rel); !errors.Is(err, tupdate.ErrNoAsset) {
+		t.Errorf("Download for linux/arm64 error %v, want ErrNoAsset", err)
+	}
+	u.GOARCH = "amd64"
+	// Signed by someone else.
+	other, err := tcrypto.NewIdentity()
+	if err != nil {
+		t.Fatalf("NewIdentity: %v", err)
+	}
+	u.Publisher = other.PublicKey
+	if _, err = u.Download(ctx, rel); err == nil {
+		t.Errorf("Download succeeded with the wrong publisher key")
+	}
+	// Rollback: the (signed) 1.2.0 release served as a newer one.
+	u.Publisher = publisher.PublicKey
+	srv = releaseServer(t, "v1.3.0", files)
+	u.APIURL = srv.URL
+	if rel, err = u.Latest(ctx); err != nil {
+		t.Fatalf("Latest: %v", err)
+	}
+	if _, err = u.Download(ctx, rel); !errors.Is(err, tupdate.ErrVersion) {
+		t.Errorf("Download of 1.2.0 tagged v1.3.0 error %v, want ErrVersion", err)
+	}
+	// Tampered archive (with a validly signed checksums file).
+	files[archiveName] = tarGz(t, "tsync", []byte("evil"))
+	srv = releaseServer(t, "v1.2.0", files)
+	u.APIURL = srv.URL
+	if rel, err = u.Latest(ctx); err != nil {
+		t.Fatalf("Latest: %v", err)
+	}
+	if _, err = u.Download(ctx, rel); !errors.Is(err, tupdate.ErrChecksum) {
+		t.Errorf("Download of tampered archive error %v, want ErrChecksum", err)
+	}
+}
+
+func TestNewNoPublisherKey(t *testing.T) {
+	if _, err := tupdate.New(""); !errors.Is(err, tupdate.ErrNoPublisherKey) {
+		t.Errorf("New(\"\") error %v, want ErrNoPublisherKey", err)
+	}
+	if _, err := tupdate.New("p.invalid"); err == nil {
+		t.Errorf("New with an invalid key succeeded")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	exe := filepath.Join(t.TempDir(), "tsync")
+	if err := os.WriteFile(exe, []byte("old"), 0o750); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := tupdate.Replace(exe, []byte("new")); err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(data) != "new" {
+		t.Errorf("after Replace got %q, want \"new\"", data)
+	}
+	st, err := os.Stat(exe)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if st.Mode().Perm() != 0o750 {
+		t.Errorf("after Replace mode %v, want 0750", st.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(exe))
+	if len(entries) != 1 {
+		t.Errorf("Replace left %d files, want 1", len(entries))
+	}
+}
+
+func TestNewer(t *testing.T) {
+	tests := []struct {
+		current, latest string
+		want            bool
+	}{
+		{"1.2.3", "v1.2.4", true},
+		{"v1.2.3", "1.2.3", false},
+		{"1.10.0", "1.9.9", false},
+		{"1.9.9", "2.0.0", true},
+		{"1.2.3-pre", "1.2.3", false},
+		{"dev", "0.1.0", true},
+		{"1.0.0", "garbage", false},
+	}
+	for _, tt := range tests {
+		if got := tupdate.Newer(tt.current, tt.latest); got != tt.want {
+			t.Errorf("Newer(%q, %q) = %v, want %v", tt.current, tt.latest, got, tt.want)
+		}
+	}
+}
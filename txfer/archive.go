@@ -0,0 +1,311 @@
+package txfer
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"fortio.org/log"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// ArchiveExt is the extension of the directory archives made by PackDir: tar compressed with zstd.
+	ArchiveExt = ".tar.zst"
+	// ArchiveMinFiles is the minimum number of files for which PreferArchive packs a directory.
+	ArchiveMinFiles = 32
+	// ArchiveMaxAvgSize is the maximum average file size for which PreferArchive packs a directory.
+	ArchiveMaxAvgSize = 64 * 1024
+)
+
+// ArchiveMode is when directories are transferred as a single archive instead of file by file.
+type ArchiveMode int
+
+const (
+	// ArchiveAuto packs the directories with many small files (see PreferArchive).
+	ArchiveAuto ArchiveMode = iota
+	// ArchiveAlways packs all the directories.
+	ArchiveAlways
+	// ArchiveOff transfers the files one by one.
+	ArchiveOff
+)
+
+var archiveModeNames = []string{"auto", "always", "off"}
+
+func (m ArchiveMode) String() string {
+	if int(m) < len(archiveModeNames) {
+		return archiveModeNames[m]
+	}
+	return fmt.Sprintf("ArchiveMode(%d)", int(m))
+}
+
+// ParseArchiveMode parses auto, always or off.
+func ParseArchiveMode(s string) (ArchiveMode, error) {
+	for i, name := range archiveModeNames {
+		if s == name {
+			return ArchiveMode(i), nil
+		}
+	}
+	return ArchiveAuto, fmt.Errorf("invalid archive mode %q, expecting auto, always or off", s)
+}
+
+// stagingSeq numbers the staging files of the extracted files.
+var stagingSeq atomic.Uint64
+
+// PreferArchive returns true when, in mode, files totaling size bytes are better sent as an archive:
+// always, or in auto mode when there are many small files whose per file round trips would
+// dominate the transfer time.
+func PreferArchive(mode ArchiveMode, files int, size int64) bool {
+	switch mode {
+	case ArchiveAlways:
+		return true
+	case ArchiveAuto:
+		return files >= ArchiveMinFiles && size/int64(files) <= ArchiveMaxAvgSize
+	default:
+		return false
+	}
+}
+
+// archivable returns true for the entries PackDir packs: directories and regular files, but the
+// staging directories of the drops.
+func archivable(d fs.DirEntry) bool {
+	return d.Name() != PartialDir && (d.IsDir() || d.Type().IsRegular())
+}
+
+// DirStats returns the number of files and their total size in fsys, as packed by PackDir.
+func DirStats(fsys fs.FS) (int, int64, error) {
+	files, size := 0, int64(0)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == "." || !archivable(d) {
+			return skipEntry(d, err)
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		size += info.Size()
+		return nil
+	})
+	return files, size, err
+}
+
+// skipEntry returns what to do with an entry not to pack: errors stop the walk, the skipped
+// directories aren't walked.
+func skipEntry(d fs.DirEntry, err error) error {
+	if err != nil {
+		return err
+	}
+	if d.IsDir() && d.Name() == PartialDir {
+		return fs.SkipDir
+	}
+	return nil
+}
+
+// PackDir writes to w the directories and regular files of fsys (e.g. an os.Root's FS) as a zstd
+// compressed tar, returning the number of files and their total size. Symbolic links, special
+// files and the files locked by other processes (see ErrLocked) are skipped.
+func PackDir(ctx context.Context, w io.Writer, fsys fs.FS) (int, int64, error) {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return 0, 0, err
+	}
+	tw := tar.NewWriter(zw)
+	files, size := 0, int64(0)
+	err = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == "." || !archivable(d) {
+			return skipEntry(d, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = p
+		hdr.Uname, hdr.Gname, hdr.Uid, hdr.Gid = "", "", 0, 0
+		if d.IsDir() {
+			hdr.Name += "/"
+			return tw.WriteHeader(hdr)
+		}
+		f, err := retryLocked(p, func() (fs.File, error) { return fsys.Open(p) })
+		if errors.Is(err, ErrLocked) {
+			log.Warnf("Not packing %v", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		n, err := io.Copy(tw, f)
+		if err != nil {
+			return err
+		}
+		if n != hdr.Size {
+			return fmt.Errorf("%s changed while packing (%d bytes instead of %d)", p, n, hdr.Size)
+		}
+		files++
+		size += n
+		return nil
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if cErr := zw.Close(); err == nil {
+		err = cErr
+	}
+	return files, size, err
+}
+
+// Unpacker extracts the archives made by PackDir, for instance received in a DropBox.
+type Unpacker struct {
+	// Who sent the archive (peer name), for Scan and the logs.
+	From string
+	// Optional check of each extracted file, while still in staging (as for DropBox.Scan).
+	Scan ScanFunc
+	// Free space to keep in the destination, DefaultFreeSpaceMargin if 0, negative for none.
+	Margin int64
+}
+
+// Unpack extracts the archive read from r into the directory dest (created if needed). Entries
+// can't leave dest, existing files aren't overwritten (a -N suffix is added as for the drops) and
+// only directories and regular files are extracted. It returns the number of files and bytes
+// extracted (so far on errors).
+func (u *Unpacker) Unpack(ctx context.Context, r io.Reader, dest string) (int, int64, error) {
+	if err := os.MkdirAll(filepath.Join(dest, PartialDir), 0o700); err != nil {
+		return 0, 0, err
+	}
+	root, err := os.OpenRoot(LongPath(dest))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer root.Close()
+	defer root.Remove(PartialDir) //nolint:errcheck // only if empty.
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	margin := u.Margin
+	if margin == 0 {
+		margin = DefaultFreeSpaceMargin
+	}
+	files, size := 0, int64(0)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, size, nil
+		}
+		if err != nil {
+			return files, size, err
+		}
+		if ctx.Err() != nil {
+			return files, size, ctx.Err()
+		}
+		name, err := archiveName(hdr.Name)
+		if err != nil {
+			return files, size, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = root.MkdirAll(name, 0o755); err != nil {
+				return files, size, err
+			}
+		case tar.TypeReg:
+			// Checked for each file as the compressed size tells nothing of the extracted one.
+			if err = CheckSpace(dest, hdr.Size, max(margin, 0)); err != nil {
+				return files, size, err
+			}
+			if err = u.extract(ctx, root, dest, name, hdr, tr); err != nil {
+				return files, size, fmt.Errorf("%s: %w", name, err)
+			}
+			files++
+			size += hdr.Size
+		default:
+			log.Warnf("Skipping %q (type %c) of the archive from %q", hdr.Name, hdr.Typeflag, u.From)
+		}
+	}
+}
+
+// archiveName checks the name of an archive entry is a clean relative path of plain file names,
+// returning it with the OS separators.
+func archiveName(name string) (string, error) {
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name {
+		return "", fmt.Errorf("%w: %q in archive", ErrInvalidName, name)
+	}
+	for part := range strings.SplitSeq(name, "/") {
+		if clean, err := SanitizeName(part); err != nil || clean != part {
+			return "", fmt.Errorf("%w: %q in archive", ErrInvalidName, name)
+		}
+	}
+	return filepath.FromSlash(name), nil
+}
+
+// extract writes the file name of the archive in staging, scans it and moves it into place.
+func (u *Unpacker) extract(ctx context.Context, root *os.Root, dest, name string, hdr *tar.Header, r io.Reader) error {
+	if dir := filepath.Dir(name); dir != "." {
+		if err := root.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	staging := filepath.Join(PartialDir, fmt.Sprintf("archive-%d-%d", os.Getpid(), stagingSeq.Add(1)))
+	f, err := root.OpenFile(staging, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, hdr.Size))
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil && n != hdr.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && u.Scan != nil {
+		err = u.Scan(ctx, filepath.Join(dest, staging), &Drop{From: u.From, Name: name, Size: hdr.Size})
+	}
+	if err == nil {
+		err = renameNoOverwrite(root, staging, name)
+	}
+	if err != nil {
+		_ = root.Remove(staging)
+		return err
+	}
+	_ = root.Chtimes(name, hdr.ModTime, hdr.ModTime) // best effort.
+	return nil
+}
+
+// renameNoOverwrite is moveNoOverwrite within root.
+func renameNoOverwrite(root *os.Root, src, dst string) error {
+	ext := filepath.Ext(dst)
+	base := strings.TrimSuffix(dst, ext)
+	for i := 1; ; i++ {
+		if _, err := root.Lstat(dst); errors.Is(err, os.ErrNotExist) {
+			return root.Rename(src, dst)
+		}
+		if i > 1000 {
+			return fmt.Errorf("too many existing files named like %q", dst)
+		}
+		dst = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
@@ -0,0 +1,145 @@
+package txfer_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fortio.org/tsync/txfer"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestArchiveMode(t *testing.T) {
+	for _, m := range []txfer.ArchiveMode{txfer.ArchiveAuto, txfer.ArchiveAlways, txfer.ArchiveOff} {
+		if got, err := txfer.ParseArchiveMode(m.String()); err != nil || got != m {
+			t.Errorf("ParseArchiveMode(%q) = %v, %v", m.String(), got, err)
+		}
+	}
+	if _, err := txfer.ParseArchiveMode("sometimes"); err == nil {
+		t.Errorf("Expected an error for an invalid archive mode")
+	}
+	tests := []struct {
+		mode  txfer.ArchiveMode
+		files int
+		size  int64
+		want  bool
+	}{
+		{txfer.ArchiveAuto, 1000, 1000 * 1024, true},
+		{txfer.ArchiveAuto, 3, 3 * 1024, false},            // few files.
+		{txfer.ArchiveAuto, 100, 100 * 1024 * 1024, false}, // large files.
+		{txfer.ArchiveAlways, 0, 0, true},
+		{txfer.ArchiveOff, 1000, 1000 * 1024, false},
+		{txfer.ArchiveAuto, txfer.ArchiveMinFiles, 0, true}, // empty files.
+	}
+	for _, tt := range tests {
+		if got := txfer.PreferArchive(tt.mode, tt.files, tt.size); got != tt.want {
+			t.Errorf("PreferArchive(%v, %d, %d) = %v", tt.mode, tt.files, tt.size, got)
+		}
+	}
+}
+
+func TestPackUnpack(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"a.txt":             "hello",
+		"sub/b.txt":         "world!",
+		"sub/deeper/c.bin":  strings.Repeat("compressible ", 100*1000/13),
+		".partial/skip.txt": "staging",
+	}
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(src, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	n, size, err := txfer.DirStats(root.FS())
+	want := int64(len(files["a.txt"]) + len(files["sub/b.txt"]) + len(files["sub/deeper/c.bin"]))
+	if err != nil || n != 3 || size != want {
+		t.Errorf("DirStats = %d, %d, %v", n, size, err)
+	}
+	var buf bytes.Buffer
+	if n, size, err = txfer.PackDir(context.Background(), &buf, root.FS()); err != nil || n != 3 || size != want {
+		t.Fatalf("PackDir = %d, %d, %v", n, size, err)
+	}
+	if int64(buf.Len()) >= want {
+		t.Errorf("Archive not compressed: %d bytes for %d", buf.Len(), want)
+	}
+	dest := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dest, "a.txt"), []byte("existing"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u := &txfer.Unpacker{From: "peer", Margin: -1}
+	if n, size, err = u.Unpack(context.Background(), bytes.NewReader(buf.Bytes()), dest); err != nil || n != 3 || size != want {
+		t.Fatalf("Unpack = %d, %d, %v", n, size, err)
+	}
+	for name, content := range map[string]string{
+		"a.txt": "existing", "a-1.txt": "hello", "sub/b.txt": "world!", "sub/deeper/c.bin": files["sub/deeper/c.bin"],
+	} {
+		got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: %d bytes, %v", name, len(got), err)
+		}
+	}
+	for _, name := range []string{"link", txfer.PartialDir} {
+		if _, err = os.Lstat(filepath.Join(dest, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s shouldn't be extracted: %v", name, err)
+		}
+	}
+	if st, err := os.Stat(filepath.Join(dest, "empty")); err != nil || !st.IsDir() {
+		t.Errorf("Empty directory not extracted: %v", err)
+	}
+	// A rejecting scan stops the extraction.
+	u.Scan = func(_ context.Context, _ string, d *txfer.Drop) error {
+		if d.Name == filepath.Join("sub", "b.txt") && d.From == "peer" {
+			return txfer.ErrRejected
+		}
+		return nil
+	}
+	if _, _, err = u.Unpack(context.Background(), bytes.NewReader(buf.Bytes()), t.TempDir()); !errors.Is(err, txfer.ErrRejected) {
+		t.Errorf("Unpack with a rejecting scan should fail with ErrRejected, got %v", err)
+	}
+}
+
+func TestUnpackInvalidNames(t *testing.T) {
+	for _, name := range []string{"../escape.txt", "/abs.txt", "a/../../b.txt", "sub/.partial/x"} {
+		var buf bytes.Buffer
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw := tar.NewWriter(zw)
+		if err = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: 1, Mode: 0o644}); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = tw.Write([]byte("x"))
+		tw.Close()
+		zw.Close()
+		dest := t.TempDir()
+		u := &txfer.Unpacker{Margin: -1}
+		if _, _, err = u.Unpack(context.Background(), &buf, filepath.Join(dest, "in")); !errors.Is(err, txfer.ErrInvalidName) {
+			t.Errorf("Unpack of %q should fail with ErrInvalidName, got %v", name, err)
+		}
+		if _, err = os.Stat(filepath.Join(dest, "escape.txt")); err == nil {
+			t.Errorf("%q escaped the destination", name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package txfer
+
+import (
+	"sync"
+)
+
+// Congestion window defaults, in frames.
+const (
+	DefaultInitialWindow = 16
+	DefaultMinWindow     = 2
+	// DefaultMaxWindow is kept below DefaultMaxPending so a receiver never gives up on a gap
+	// a windowed sender can still fill.
+	DefaultMaxWindow = 512
+)
+
+// AIMD is a window based congestion controller (additive increase, multiplicative decrease, like TCP Reno):
+// starting with slow start (window doubling every round trip) until the first loss, then growing
+// by one frame per round trip and halving on loss, so the send rate adapts to the link.
+// It's safe for concurrent use.
+type AIMD struct {
+	MinWindow int // defaults to DefaultMinWindow
+	MaxWindow int // defaults to DefaultMaxWindow
+	mu        sync.Mutex
+	window    float64
+	ssthresh  float64
+}
+
+// NewAIMD returns a controller starting with the given window (DefaultInitialWindow if 0).
+func NewAIMD(initial int) *AIMD {
+	if initial <= 0 {
+		initial = DefaultInitialWindow
+	}
+	return &AIMD{
+		MinWindow: DefaultMinWindow,
+		MaxWindow: DefaultMaxWindow,
+		window:    float64(initial),
+		ssthresh:  float64(DefaultMaxWindow),
+	}
+}
+
+func (c *AIMD) bounds() (float64, float64) {
+	minW, maxW := c.MinWindow, c.MaxWindow
+	if minW <= 0 {
+		minW = DefaultMinWindow
+	}
+	if maxW <= 0 {
+		maxW = DefaultMaxWindow
+	}
+	return float64(minW), float64(max(minW, maxW))
+}
+
+func (c *AIMD) clamp() {
+	minW, maxW := c.bounds()
+	c.window = min(max(c.window, minW), maxW)
+}
+
+// Window returns the current number of frames allowed in flight.
+func (c *AIMD) Window() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.window)
+}
+
+// OnAck grows the window for n newly acknowledged frames.
+func (c *AIMD) OnAck(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for range n {
+		if c.window < c.ssthresh {
+			c.window++ // slow start: +1 per ack, i.e. doubling every round trip.
+		} else {
+			c.window += 1 / c.window // congestion avoidance: +1 per round trip.
+		}
+	}
+	c.clamp()
+}
+
+// OnLoss halves the window, to be called once per loss event (not per lost frame).
+func (c *AIMD) OnLoss() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.window /= 2
+	c.clamp()
+	c.ssthresh = c.window
+}
+
+// OnTimeout is for when nothing got acknowledged for a while: restart from the minimum window
+// with slow start up to half the previous window.
+func (c *AIMD) OnTimeout() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	minW, _ := c.bounds()
+	c.ssthresh = max(c.window/2, minW)
+	c.window = minW
+}
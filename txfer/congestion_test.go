@@ -0,0 +1,145 @@
+package txfer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/txfer"
+)
+
+func TestAIMD(t *testing.T) {
+	c := txfer.NewAIMD(4)
+	c.OnAck(4) // slow start: doubles.
+	if w := c.Window(); w != 8 {
+		t.Errorf("Expected window 8 after slow start round, got %d", w)
+	}
+	c.OnLoss()
+	if w := c.Window(); w != 4 {
+		t.Errorf("Expected window 4 after loss, got %d", w)
+	}
+	c.OnAck(4) // congestion avoidance: +1 per window worth of acks.
+	if w := c.Window(); w != 4 && w != 5 {
+		t.Errorf("Expected window ~5 after one round, got %d", w)
+	}
+	c.OnTimeout()
+	if w := c.Window(); w != txfer.DefaultMinWindow {
+		t.Errorf("Expected min window after timeout, got %d", w)
+	}
+	c.MaxWindow = 10
+	c.OnAck(1000)
+	if w := c.Window(); w != 10 {
+		t.Errorf("Expected window capped at 10, got %d", w)
+	}
+	for range 10 {
+		c.OnLoss()
+	}
+	if w := c.Window(); w != txfer.DefaultMinWindow {
+		t.Errorf("Expected window floored at min, got %d", w)
+	}
+}
+
+// lossyLink connects a sender and receiver, losing the given fraction of frames and acks.
+func lossyLink(sender *txfer.StreamSender, recv *txfer.StreamReceiver, loss float64) {
+	var mu sync.Mutex
+	r := rand.New(rand.NewPCG(3, 4)) //nolint:gosec // test.
+	lost := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return r.Float64() < loss
+	}
+	acks := make(chan []byte, 2*txfer.DefaultMaxWindow)
+	sender.Acks = acks
+	recv.Ack = func(frame []byte) error {
+		if !lost() {
+			acks <- frame
+		}
+		return nil
+	}
+	sender.Send = func(frame []byte) error {
+		if lost() {
+			return nil
+		}
+		return recv.Receive(frame)
+	}
+}
+
+func TestStreamBatch(t *testing.T) {
+	data := randomData(100_000)
+	var out bytes.Buffer
+	recv := txfer.NewStreamReceiver(&out)
+	sender := &txfer.StreamSender{ID: 3, FrameSize: 100, Congestion: txfer.NewAIMD(0)}
+	lossyLink(sender, recv, 0.02)
+	maxBatch := 0
+	sender.SendBatch = func(frames [][]byte) error {
+		maxBatch = max(maxBatch, len(frames))
+		for _, f := range frames {
+			if err := sender.Send(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	n, err := sender.Copy(context.Background(), bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Copy returned %d, %v", n, err)
+	}
+	<-recv.Done()
+	if recv.Err() != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("Received data differs (%d vs %d bytes): %v", recv.Total(), len(data), recv.Err())
+	}
+	t.Logf("Max batch size %d", maxBatch)
+	if maxBatch < 2 {
+		t.Errorf("Expected some batching, max batch was %d", maxBatch)
+	}
+}
+
+func TestStreamCongestion(t *testing.T) {
+	for _, loss := range []float64{0, 0.05} {
+		data := randomData(60_000)
+		var out bytes.Buffer
+		recv := txfer.NewStreamReceiver(&out)
+		recv.Hash = tcrypto.SHA256
+		cc := txfer.NewAIMD(0)
+		sender := &txfer.StreamSender{ID: 9, FrameSize: 100, Hash: tcrypto.SHA256, Congestion: cc}
+		lossyLink(sender, recv, loss)
+		n, err := sender.Copy(context.Background(), bytes.NewReader(data))
+		if err != nil || n != int64(len(data)) {
+			t.Fatalf("loss %v: Copy returned %d, %v", loss, n, err)
+		}
+		select {
+		case <-recv.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("loss %v: receiver not done", loss)
+		}
+		if recv.Err() != nil || !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("loss %v: received data differs (%d vs %d bytes): %v", loss, recv.Total(), len(data), recv.Err())
+		}
+		w := cc.Window()
+		t.Logf("loss %v: final window %d", loss, w)
+		if loss == 0 && w <= txfer.DefaultInitialWindow {
+			t.Errorf("Window should have grown without loss, got %d", w)
+		}
+		if loss > 0 && w >= txfer.DefaultMaxWindow {
+			t.Errorf("Window should have shrunk with loss, got %d", w)
+		}
+	}
+}
+
+func TestStreamNoAck(t *testing.T) {
+	sender := &txfer.StreamSender{
+		ID: 1, FrameSize: 100, Congestion: txfer.NewAIMD(0), Acks: make(chan []byte),
+		Send: func([]byte) error { return nil }, // black hole.
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := sender.Copy(ctx, bytes.NewReader(randomData(1000)))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
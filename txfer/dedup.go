@@ -0,0 +1,128 @@
+package txfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+)
+
+// Duplicate detection: a drop header can carry the digest of the content (see ContentDigest), a
+// DropBox with Dedup then answers with a duplicate frame ('D' + id + name of the file it has) instead of
+// receiving it again when a file it received with that digest is still in its directory, unchanged.
+// It remembers the digests of the files it received in SumsFile, one "size mtime digest name" line
+// each (modification time in unix ns), entries of files since removed or changed being dropped.
+const (
+	dropDuplicate byte = 'D'
+	// SumsFile is where, in PartialDir, a DropBox remembers the digests of the files it received
+	// (the staging files start with their stream id so can't clash with it).
+	SumsFile = "sums"
+)
+
+// ErrDuplicate is returned by SendDrop when the receiver already has the content (the drop is then
+// done without anything sent).
+var ErrDuplicate = errors.New("identical file already in the inbox")
+
+// ContentDigest returns the digest of f's content for SendDrop ("algo:hex", with our preferred
+// tcrypto.DefaultHashes), reading it from the start and seeking back there.
+func ContentDigest(f *os.File) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	algo := tcrypto.DefaultHashes[0]
+	sum, err := algo.SumReader(f)
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return formatDigest(algo, sum), nil
+}
+
+func formatDigest(algo tcrypto.HashAlgo, sum []byte) string {
+	return algo.String() + ":" + hex.EncodeToString(sum)
+}
+
+// sumEntry is a line of the SumsFile.
+type sumEntry struct {
+	size, mtime int64
+	digest      string
+	name        string
+}
+
+// current returns true if the entry's file is still in dir as it was received.
+func (e sumEntry) current(dir string) bool {
+	st, err := os.Lstat(filepath.Join(dir, e.name))
+	return err == nil && st.Mode().IsRegular() && st.Size() == e.size && st.ModTime().UnixNano() == e.mtime
+}
+
+// readSums returns the entries of the SumsFile, skipping the invalid lines.
+func (d *DropBox) readSums() []sumEntry {
+	f, err := os.Open(filepath.Join(d.Dir, PartialDir, SumsFile))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var entries []sumEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 4) // the name can have spaces.
+		if len(fields) != 4 {
+			continue
+		}
+		e := sumEntry{digest: fields[2]}
+		var sizeErr, mtimeErr error
+		e.size, sizeErr = strconv.ParseInt(fields[0], 10, 64)
+		e.mtime, mtimeErr = strconv.ParseInt(fields[1], 10, 64)
+		if e.name, err = SanitizeName(fields[3]); err == nil && sizeErr == nil && mtimeErr == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// duplicate returns the path of the file of size bytes with the digest we received, "" if none.
+// d.mu must be held.
+func (d *DropBox) duplicate(size int64, digest string) string {
+	for _, e := range d.readSums() {
+		if e.size == size && e.digest == digest && e.current(d.Dir) {
+			return filepath.Join(d.Dir, e.name)
+		}
+	}
+	return ""
+}
+
+// recordSum remembers the digest of the drop moved to its final path, dropping the entries of the
+// files removed or changed since. d.mu must be held.
+func (d *DropBox) recordSum(drop *Drop) {
+	sum := drop.recv.Sum()
+	st, err := os.Lstat(drop.Path)
+	if sum == nil || err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	for _, e := range d.readSums() {
+		if e.current(d.Dir) && filepath.Join(d.Dir, e.name) != drop.Path {
+			fmt.Fprintf(&buf, "%d %d %s %s\n", e.size, e.mtime, e.digest, e.name)
+		}
+	}
+	fmt.Fprintf(&buf, "%d %d %s %s\n", st.Size(), st.ModTime().UnixNano(), formatDigest(drop.recv.Hash, sum),
+		filepath.Base(drop.Path))
+	path := filepath.Join(d.Dir, PartialDir, SumsFile)
+	if err = os.WriteFile(path+".tmp", buf.Bytes(), 0o600); err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Warnf("Failed to record the digest of %q: %v", drop.Path, err)
+	}
+}
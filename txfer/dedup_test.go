@@ -0,0 +1,108 @@
+package txfer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/txfer"
+)
+
+// TestDropDuplicate checks a Dedup box answers the drop of content it already has, unchanged, with
+// the name of its file (using up the token, nothing sent), and receives it normally otherwise.
+func TestDropDuplicate(t *testing.T) {
+	dir := t.TempDir()
+	box, err := txfer.NewDropBox(filepath.Join(dir, "inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	box.Dedup = true
+	var drops []*txfer.Drop
+	box.OnDrop = func(d *txfer.Drop, _ int64, err error) {
+		if err != nil {
+			t.Errorf("Drop error: %v", err)
+		}
+		drops = append(drops, d)
+	}
+	data := randomData(5000)
+	path := filepath.Join(dir, "file.bin")
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	digest, err := txfer.ContentDigest(f)
+	if err != nil || !strings.Contains(digest, ":") {
+		t.Fatalf("ContentDigest = %q, %v", digest, err)
+	}
+	id := uint32(0)
+	send := func(box *txfer.DropBox, token, digest string) (int64, error) {
+		id++
+		sender, replies := dropSender(box, id, "alice", nil)
+		n, err := txfer.SendDrop(context.Background(), sender, token, "file.bin", digest, int64(len(data)),
+			bytes.NewReader(data), replies)
+		box.Wait()
+		return n, err
+	}
+	if n, err := send(box, box.NewToken(time.Minute), digest); err != nil || n != int64(len(data)) {
+		t.Fatalf("First drop = %d, %v", n, err)
+	}
+	if _, err = os.Stat(filepath.Join(box.Dir, txfer.PartialDir, txfer.SumsFile)); err != nil {
+		t.Errorf("Digest of the drop not recorded: %v", err)
+	}
+	token := box.NewToken(time.Minute)
+	n, err := send(box, token, digest)
+	if !errors.Is(err, txfer.ErrDuplicate) || n != 0 || !strings.Contains(err.Error(), `"file.bin"`) {
+		t.Errorf("Drop of the same content = %d, %v", n, err)
+	}
+	if last := drops[len(drops)-1]; !last.Duplicate || last.Path != filepath.Join(box.Dir, "file.bin") {
+		t.Errorf("Unexpected duplicate drop %+v", last)
+	}
+	var refused *txfer.RefusedError
+	if _, err = send(box, token, digest); !errors.As(err, &refused) {
+		t.Errorf("Expected the token of the duplicate to be used up, got %v", err)
+	}
+	// Without the digest it's received again, and remembered too.
+	if n, err = send(box, box.NewToken(time.Minute), ""); err != nil || n != int64(len(data)) {
+		t.Errorf("Drop without digest = %d, %v", n, err)
+	}
+	if last := drops[len(drops)-1]; last.Duplicate || last.Path != filepath.Join(box.Dir, "file-1.bin") {
+		t.Errorf("Unexpected drop without digest %+v", last)
+	}
+	// The changed files don't count.
+	if err = os.WriteFile(filepath.Join(box.Dir, "file.bin"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = send(box, box.NewToken(time.Minute), digest); !errors.Is(err, txfer.ErrDuplicate) ||
+		!strings.Contains(err.Error(), `"file-1.bin"`) {
+		t.Errorf("Expected the unchanged copy to be found, got %v", err)
+	}
+	if err = os.Remove(filepath.Join(box.Dir, "file-1.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = send(box, box.NewToken(time.Minute), digest); err != nil || n != int64(len(data)) {
+		t.Errorf("Drop once the copies are gone = %d, %v", n, err)
+	}
+	// Boxes without Dedup ignore the digest.
+	plain, err := txfer.NewDropBox(filepath.Join(dir, "plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if n, err = send(plain, plain.NewToken(time.Minute), digest); err != nil || n != int64(len(data)) {
+			t.Errorf("Drop to a box without Dedup = %d, %v", n, err)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Join(plain.Dir, txfer.PartialDir))
+	if len(entries) != 0 {
+		t.Errorf("Expected empty staging directory without Dedup, got %v", entries)
+	}
+}
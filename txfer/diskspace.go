@@ -0,0 +1,40 @@
+package txfer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultFreeSpaceMargin is how much space is kept free on the destination on top of what a transfer needs.
+const DefaultFreeSpaceMargin = 64 * 1024 * 1024
+
+// ErrNoFreeSpaceInfo is returned by FreeSpace on platforms where we can't get the available space.
+var ErrNoFreeSpaceInfo = errors.New("free space information not available on this platform")
+
+// InsufficientSpaceError is returned when the destination doesn't have enough space for a transfer.
+type InsufficientSpaceError struct {
+	Dir       string
+	Needed    int64
+	Available int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("not enough space in %s: need %d bytes (including margin) but only %d available",
+		e.Dir, e.Needed, e.Available)
+}
+
+// CheckSpace checks there is room for size more bytes in dir while keeping margin bytes free.
+// Platforms where we can't tell the free space always pass the check.
+func CheckSpace(dir string, size, margin int64) error {
+	avail, err := FreeSpace(dir)
+	if errors.Is(err, ErrNoFreeSpaceInfo) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if needed := size + margin; needed > avail {
+		return &InsufficientSpaceError{Dir: dir, Needed: needed, Available: avail}
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package txfer
+
+// FreeSpace returns ErrNoFreeSpaceInfo on this platform.
+func FreeSpace(_ string) (int64, error) {
+	return 0, ErrNoFreeSpaceInfo
+}
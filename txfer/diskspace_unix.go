@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package txfer
+
+import "golang.org/x/sys/unix"
+
+// FreeSpace returns the number of bytes available to us in the filesystem holding dir.
+func FreeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil //nolint:gosec,unconvert // types vary by OS.
+}
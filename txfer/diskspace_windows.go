@@ -0,0 +1,16 @@
+package txfer
+
+import "golang.org/x/sys/windows"
+
+// FreeSpace returns the number of bytes available to us in the filesystem holding dir.
+func FreeSpace(dir string) (int64, error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var avail, total, free uint64
+	if err = windows.GetDiskFreeSpaceEx(p, &avail, &total, &free); err != nil {
+		return 0, err
+	}
+	return int64(avail), nil //nolint:gosec // won't overflow for a while.
+}
@@ -0,0 +1,493 @@
+package txfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+)
+
+// Drop header frame: 'H', 4 bytes stream id, then "token\nfilename\nsize\nhashes\nchunk hashes\ndigest" (the
+// sender's supported hash algorithms for final verification and for chunk checks, see tcrypto.FormatHashes,
+// and the optional digest of the content, see ContentDigest). The receiver answers with an accept ('A' + id +
+// "hash\nchunk hash" as negotiated, the chunk hash empty when there is none in common), refuse ('R' + id +
+// reason) or duplicate (see dedup.go) frame and, once accepted, the file content follows as a regular stream
+// (see StreamSender) with the same id.
+// The whole content is always verified: a header without a hash in common is refused.
+const (
+	streamHeader byte = 'H'
+	dropAccept   byte = 'A'
+	dropRefuse   byte = 'R'
+	// PartialDir is the staging directory (inside the inbox) where drops are written until complete.
+	PartialDir = ".partial"
+	// DropReplyTimeout is how long SendDrop waits for an answer before resending the header.
+	DropReplyTimeout = 2 * time.Second
+	dropHeaderTries  = 3
+)
+
+var (
+	// ErrInvalidToken is returned when a drop uses an unknown, expired or already used token.
+	ErrInvalidToken = errors.New("invalid or already used drop token")
+	// ErrInvalidName is returned when a drop file name isn't a plain file name.
+	ErrInvalidName = errors.New("invalid drop file name")
+	// ErrNoReply is returned by SendDrop when the receiver never answered the drop header.
+	ErrNoReply = errors.New("no answer from receiver")
+)
+
+// RefusedError is returned by SendDrop when the receiver refused the drop.
+type RefusedError struct {
+	Reason string
+}
+
+func (e *RefusedError) Error() string {
+	return "drop refused: " + e.Reason
+}
+
+// DropFrame returns the header frame for dropping file name of size bytes (with the content's digest,
+// if not empty) using token, on stream id.
+func DropFrame(id uint32, token, name string, size int64, hashes, chunkHashes []tcrypto.HashAlgo, digest string) []byte {
+	buf := make([]byte, 5, 5+len(token)+1+len(name)+1+20+1+32+1+48+1+len(digest))
+	buf[0] = streamHeader
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	buf = append(buf, token...)
+	buf = append(buf, '\n')
+	buf = append(buf, name...)
+	buf = append(buf, '\n')
+	buf = strconv.AppendInt(buf, size, 10)
+	buf = append(buf, '\n')
+	buf = append(buf, tcrypto.FormatHashes(hashes)...)
+	buf = append(buf, '\n')
+	buf = append(buf, tcrypto.FormatHashes(chunkHashes)...)
+	buf = append(buf, '\n')
+	return append(buf, digest...)
+}
+
+func replyFrame(t byte, id uint32, reason string) []byte {
+	buf := make([]byte, 5, 5+len(reason))
+	buf[0] = t
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	return append(buf, reason...)
+}
+
+// IsDropReply returns true if the frame is an answer to a drop header (for the sender side).
+func IsDropReply(frame []byte) bool {
+	return len(frame) >= 5 && (frame[0] == dropAccept || frame[0] == dropRefuse || frame[0] == dropDuplicate)
+}
+
+// SendDrop sends r, of size bytes, as file name to a peer's DropBox using a token the peer gave us.
+// The header is sent first and the content only once the peer accepted it, answers are read from
+// replies (frames received from the peer). The hashes negotiated with the peer are set in sender.Hash
+// and sender.ChunkHash. With the content's digest (see ContentDigest), a receiver already having it
+// answers so and the error is ErrDuplicate, nothing being sent.
+func SendDrop(ctx context.Context, sender *StreamSender, token, name, digest string, size int64,
+	r io.Reader, replies <-chan []byte,
+) (int64, error) {
+	header := DropFrame(sender.ID, token, name, size, tcrypto.DefaultHashes, tcrypto.DefaultChunkHashes, digest)
+	accept, err := waitForAccept(ctx, sender, header, replies)
+	if err != nil {
+		return 0, err
+	}
+	if accept[0] == dropDuplicate {
+		return 0, fmt.Errorf("%w: %s as %q", ErrDuplicate, name, accept[5:])
+	}
+	hashName, chunkHashName, ok := bytes.Cut(accept[5:], []byte{'\n'})
+	if !ok {
+		return 0, errors.New("invalid drop accept")
+	}
+	if sender.Hash, err = tcrypto.ParseHashAlgo(string(hashName)); err != nil {
+		return 0, err
+	}
+	sender.ChunkHash = tcrypto.NoHash
+	if len(chunkHashName) > 0 {
+		if sender.ChunkHash, err = tcrypto.ParseHashAlgo(string(chunkHashName)); err != nil {
+			return 0, err
+		}
+	}
+	return sender.Copy(ctx, r)
+}
+
+// waitForAccept sends the header until the receiver accepts (returning its accept, or duplicate,
+// frame) or refuses.
+func waitForAccept(ctx context.Context, sender *StreamSender, header []byte, replies <-chan []byte) ([]byte, error) {
+	for range dropHeaderTries {
+		if err := sender.Send(header); err != nil {
+			return nil, err
+		}
+		timer := time.NewTimer(DropReplyTimeout)
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+				waiting = false
+			case frame := <-replies:
+				if !IsDropReply(frame) || binary.BigEndian.Uint32(frame[1:5]) != sender.ID {
+					continue
+				}
+				timer.Stop()
+				if frame[0] == dropRefuse {
+					return nil, &RefusedError{Reason: string(frame[5:])}
+				}
+				return frame, nil
+			}
+		}
+	}
+	return nil, ErrNoReply
+}
+
+// Drop is the state of a file being dropped in a DropBox.
+type Drop struct {
+	From    string // who is sending (peer name)
+	Name    string // sanitized file name
+	Path    string // final path once complete
+	Size    int64  // announced size
+	staging string
+	file    *os.File
+	recv    *StreamReceiver
+	ack     []byte    // pending stream ack to reply with
+	token   [32]byte  // key of the token used, restored if the sender retries (see discard).
+	expires time.Time // of the token.
+
+	// Duplicate is set when the file was already in the inbox, at Path (see dedup.go): nothing was received.
+	Duplicate bool
+}
+
+// DropBox is a sandboxed inbox directory where peers holding a one time token can each drop
+// exactly one file. Files are written to the PartialDir staging directory and moved to the
+// inbox once complete (and accepted by the Scan hook if set).
+type DropBox struct {
+	Dir string
+	// Called (from the receiving goroutine) once a drop is complete or failed.
+	OnDrop func(d *Drop, n int64, err error)
+	// Optional check (e.g. ScanCommand) of complete drops while still in staging.
+	Scan ScanFunc
+	// Remember the digests of the files received and answer the drops of content already in Dir
+	// as duplicates (see dedup.go).
+	Dedup bool
+	// Free space to keep in Dir when accepting drops, DefaultFreeSpaceMargin if 0, negative for none.
+	Margin   int64
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	tokens   map[[32]byte]time.Time // token key -> expiration
+	active   map[uint32]*Drop
+	dups     map[uint32]*Drop
+	reserved int64 // sum of the sizes of the active drops
+}
+
+// NewDropBox creates the inbox (and its staging) directory if needed.
+func NewDropBox(dir string) (*DropBox, error) {
+	if err := os.MkdirAll(filepath.Join(dir, PartialDir), 0o700); err != nil {
+		return nil, err
+	}
+	return &DropBox{
+		Dir:    dir,
+		tokens: make(map[[32]byte]time.Time),
+		active: make(map[uint32]*Drop),
+		dups:   make(map[uint32]*Drop),
+	}, nil
+}
+
+// NewToken creates a one time token valid for ttl.
+func (d *DropBox) NewToken(ttl time.Duration) string {
+	token := tcrypto.NewDropToken()
+	d.mu.Lock()
+	d.tokens[tcrypto.TokenKey(token)] = time.Now().Add(ttl)
+	d.mu.Unlock()
+	return token
+}
+
+// checkToken returns true if the token is valid (known and not expired).
+func (d *DropBox) checkToken(token string) bool {
+	expires, ok := d.tokens[tcrypto.TokenKey(token)]
+	return ok && time.Now().Before(expires)
+}
+
+// SanitizeName returns the base name of name, rejecting names which aren't plain file names
+// (including, on Windows, names of alternate data streams).
+func SanitizeName(name string) (string, error) {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" || name == "" || name == PartialDir ||
+		strings.ContainsAny(name, "\x00\n"+streamSeparator) {
+		return "", ErrInvalidName
+	}
+	return name, nil
+}
+
+// Receive processes a frame from peer from: a drop header or a frame of an active drop.
+// Frames of unknown streams are rejected, so only token holders can write anything.
+// The returned reply frame, if any, must be sent back to the peer: accept or refuse (with the reason)
+// for headers and stream acks (for congestion control) for content frames.
+func (d *DropBox) Receive(from string, frame []byte) ([]byte, error) {
+	if len(frame) < 5 {
+		return nil, fmt.Errorf("frame too short: %d", len(frame))
+	}
+	id := binary.BigEndian.Uint32(frame[1:5])
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if frame[0] == streamHeader {
+		drop, err := d.start(from, id, frame[5:])
+		if err != nil {
+			return replyFrame(dropRefuse, id, err.Error()), err
+		}
+		if drop.Duplicate {
+			return replyFrame(dropDuplicate, id, filepath.Base(drop.Path)), nil
+		}
+		hashes := drop.recv.Hash.String() + "\n"
+		if drop.recv.ChunkHash != tcrypto.NoHash {
+			hashes += drop.recv.ChunkHash.String()
+		}
+		return replyFrame(dropAccept, id, hashes), nil
+	}
+	drop, ok := d.active[id]
+	if !ok && (frame[0] == streamEnd || frame[0] == streamAbort) {
+		return nil, nil // repeated end frame of a completed drop.
+	}
+	if !ok || drop.From != from {
+		return nil, fmt.Errorf("frame for unknown drop %d from %q", id, from)
+	}
+	err := drop.recv.Receive(frame)
+	if errors.Is(err, ErrChecksumMismatch) && !drop.recv.isDone() {
+		log.Warnf("Dropping corrupted frame of %q from %q: %v", drop.Name, from, err)
+		err = nil // the ack makes the sender send it again.
+	}
+	reply := drop.ack
+	drop.ack = nil
+	select {
+	case <-drop.recv.Done():
+		delete(d.active, id)
+		var aborted *AbortedError
+		if errors.As(err, &aborted) && aborted.Retry {
+			d.discard(drop)
+			return nil, nil
+		}
+		// Scanning can take a while, don't block the receiving goroutine.
+		d.wg.Add(1)
+		go d.finish(drop)
+	default:
+	}
+	return reply, err
+}
+
+// discard removes the drop its sender aborted to send it again (e.g. the file was modified while
+// being sent, see SendDropFile): its token can be used again, until it expires.
+func (d *DropBox) discard(drop *Drop) {
+	_ = drop.file.Close()
+	_ = os.Remove(drop.staging)
+	d.reserved -= drop.Size
+	d.tokens[drop.token] = drop.expires
+	log.Warnf("Drop %q from %q aborted by the sender, waiting for it again", drop.Name, drop.From)
+}
+
+// Owns returns true if the frame from peer from is for this box: a drop header with one of its
+// tokens or a frame of one of its active drops. This tells apart the drops to several boxes.
+func (d *DropBox) Owns(from string, frame []byte) bool {
+	if len(frame) < 5 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if frame[0] == streamHeader {
+		token, _, _ := bytes.Cut(frame[5:], []byte{'\n'})
+		dup, ok := d.dups[binary.BigEndian.Uint32(frame[1:5])]
+		return d.checkToken(string(token)) || (ok && dup.From == from)
+	}
+	drop, ok := d.active[binary.BigEndian.Uint32(frame[1:5])]
+	return ok && drop.From == from
+}
+
+func (d *DropBox) start(from string, id uint32, header []byte) (*Drop, error) {
+	parts := bytes.Split(header, []byte{'\n'})
+	if len(parts) != 6 {
+		return nil, errors.New("invalid drop header")
+	}
+	if drop, dup := d.active[id]; dup && drop.From == from {
+		return drop, nil // header resent, already accepted.
+	}
+	if drop, dup := d.dups[id]; dup && drop.From == from {
+		return drop, nil // header resent, already answered.
+	}
+	token := string(parts[0])
+	if !d.checkToken(token) {
+		log.Warnf("Drop attempt from %q with invalid token", from)
+		return nil, ErrInvalidToken
+	}
+	sName, err := SanitizeName(string(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(string(parts[2]), 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid drop size %q", parts[2])
+	}
+	if digest := string(parts[5]); d.Dedup && digest != "" {
+		if path := d.duplicate(size, digest); path != "" {
+			return d.startDuplicate(from, id, token, sName, path, size), nil
+		}
+	}
+	hashAlgo, err := tcrypto.NegotiateHash(tcrypto.DefaultHashes, tcrypto.ParseHashes(string(parts[3])))
+	if err != nil {
+		log.Warnf("Refusing drop %q from %q: %v in %q", sName, from, err, parts[3])
+		return nil, err
+	}
+	// Chunk checks are optional, the whole content is verified anyway.
+	chunkHash, _ := tcrypto.NegotiateHash(tcrypto.DefaultChunkHashes, tcrypto.ParseHashes(string(parts[4])))
+	margin := d.Margin
+	if margin == 0 {
+		margin = DefaultFreeSpaceMargin
+	}
+	if err = CheckSpace(d.Dir, d.reserved+size, max(margin, 0)); err != nil {
+		log.Warnf("Refusing drop %q (%d bytes) from %q: %v", sName, size, from, err)
+		return nil, err // token isn't used up in this case, so it can be retried after making room.
+	}
+	key := tcrypto.TokenKey(token)
+	drop := &Drop{
+		From:    from,
+		Name:    sName,
+		Path:    filepath.Join(d.Dir, sName),
+		Size:    size,
+		staging: filepath.Join(d.Dir, PartialDir, fmt.Sprintf("%08x-%s", id, sName)),
+		token:   key,
+		expires: d.tokens[key],
+	}
+	delete(d.tokens, key)
+	drop.file, err = os.OpenFile(drop.staging, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	drop.recv = NewStreamReceiver(&limitWriter{w: drop.file, remaining: size})
+	drop.recv.Hash = hashAlgo
+	drop.recv.ChunkHash = chunkHash
+	drop.recv.Ack = func(frame []byte) error {
+		drop.ack = frame
+		return nil
+	}
+	d.active[id] = drop
+	d.reserved += size
+	log.Infof("Receiving drop %q (%d bytes, %v hash, %v chunk hash) from %q", sName, size, hashAlgo, chunkHash, from)
+	return drop, nil
+}
+
+// startDuplicate uses up the token of the drop whose content is already at path, and passes the
+// drop to OnDrop as is (see Drop.Duplicate). It's remembered in dups to answer the resent headers,
+// until its token would have expired.
+func (d *DropBox) startDuplicate(from string, id uint32, token, name, path string, size int64) *Drop {
+	key := tcrypto.TokenKey(token)
+	drop := &Drop{From: from, Name: name, Path: path, Size: size, Duplicate: true, expires: d.tokens[key]}
+	delete(d.tokens, key)
+	now := time.Now()
+	for dupID, dup := range d.dups {
+		if now.After(dup.expires) {
+			delete(d.dups, dupID)
+		}
+	}
+	d.dups[id] = drop
+	log.Infof("Drop %q (%d bytes) from %q is already in the inbox as %q", name, size, from, path)
+	if d.OnDrop != nil {
+		d.wg.Go(func() { d.OnDrop(drop, 0, nil) })
+	}
+	return drop
+}
+
+// DropProgress is the progress of an active drop, see Active.
+type DropProgress struct {
+	ID       uint32
+	From     string
+	Name     string
+	Size     int64 // announced
+	Received int64
+}
+
+// Active returns the progress of the drops being received.
+func (d *DropBox) Active() []DropProgress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]DropProgress, 0, len(d.active))
+	for id, drop := range d.active {
+		list = append(list, DropProgress{ID: id, From: drop.From, Name: drop.Name, Size: drop.Size, Received: drop.recv.Total()})
+	}
+	return list
+}
+
+// limitWriter fails writes beyond the announced size.
+type limitWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining {
+		return 0, errors.New("more data than announced")
+	}
+	l.remaining -= int64(len(p))
+	return l.w.Write(p)
+}
+
+// Wait waits for the completed drops to be scanned and moved to the inbox.
+func (d *DropBox) Wait() {
+	d.wg.Wait()
+}
+
+// finish closes the drop, scans it and moves it to the inbox (without overwriting existing files).
+func (d *DropBox) finish(drop *Drop) {
+	defer d.wg.Done()
+	defer func() {
+		d.mu.Lock()
+		d.reserved -= drop.Size
+		d.mu.Unlock()
+	}()
+	err := drop.recv.Err()
+	if cErr := drop.file.Close(); err == nil {
+		err = cErr
+	}
+	if total := drop.recv.Total(); err == nil && total != drop.Size {
+		err = fmt.Errorf("received %d bytes but %d were announced", total, drop.Size)
+	}
+	if err == nil && d.Scan != nil {
+		err = d.Scan(context.Background(), drop.staging, drop)
+	}
+	if err == nil {
+		drop.Path, err = moveNoOverwrite(drop.staging, drop.Path)
+	}
+	if err == nil && d.Dedup {
+		d.mu.Lock()
+		d.recordSum(drop)
+		d.mu.Unlock()
+	}
+	if err != nil {
+		_ = os.Remove(drop.staging)
+		log.Errf("Drop %q from %q failed: %v", drop.Name, drop.From, err)
+	} else {
+		log.Infof("Received drop %q from %q (%d bytes)", drop.Path, drop.From, drop.recv.Total())
+	}
+	if d.OnDrop != nil {
+		d.OnDrop(drop, drop.recv.Total(), err)
+	}
+}
+
+// moveNoOverwrite renames src to dst, or dst with a -N suffix if dst already exists.
+// Returns the final destination.
+func moveNoOverwrite(src, dst string) (string, error) {
+	ext := filepath.Ext(dst)
+	base := strings.TrimSuffix(dst, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dst); errors.Is(err, os.ErrNotExist) {
+			return dst, os.Rename(src, dst)
+		}
+		if i > 1000 {
+			return "", fmt.Errorf("too many existing files named like %q", dst)
+		}
+		dst = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
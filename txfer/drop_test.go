@@ -0,0 +1,342 @@
+package txfer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/txfer"
+)
+
+// dropSender returns a sender to the box, the way 2 peers would be connected over the network
+// (minus the network), with congestion control, and the channel to get the drop replies from.
+// alter, if not nil, can modify the frames before they are received.
+func dropSender(box *txfer.DropBox, id uint32, from string, alter func([]byte) []byte) (*txfer.StreamSender, chan []byte) {
+	replies := make(chan []byte, 1)
+	acks := make(chan []byte, txfer.DefaultMaxWindow)
+	sender := &txfer.StreamSender{ID: id, FrameSize: 200, Congestion: txfer.NewAIMD(0), Acks: acks}
+	sender.Send = func(frame []byte) error {
+		if alter != nil {
+			frame = alter(frame)
+		}
+		reply, err := box.Receive(from, frame)
+		switch {
+		case txfer.IsStreamAck(reply):
+			select {
+			case acks <- reply:
+			default: // like a lost ack.
+			}
+		case reply != nil:
+			replies <- reply
+			return nil
+		}
+		return err
+	}
+	return sender, replies
+}
+
+// dropTo drops data to the box.
+func dropTo(box *txfer.DropBox, id uint32, from, token, name string, data []byte) (int64, error) {
+	sender, replies := dropSender(box, id, from, nil)
+	return txfer.SendDrop(context.Background(), sender, token, name, "", int64(len(data)), bytes.NewReader(data), replies)
+}
+
+func TestDropBox(t *testing.T) {
+	dir := t.TempDir()
+	box, err := txfer.NewDropBox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dropped []string
+	box.OnDrop = func(d *txfer.Drop, _ int64, err error) {
+		if err != nil {
+			t.Errorf("Drop error: %v", err)
+		}
+		dropped = append(dropped, d.Path)
+	}
+	token := box.NewToken(time.Minute)
+	data := randomData(3000)
+	send := func(id uint32, from, token, name string, data []byte) (int64, error) {
+		return dropTo(box, id, from, token, name, data)
+	}
+	n, err := send(1, "alice", token, "../../etc/evil.txt", data)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("SendDrop returned %d, %v", n, err)
+	}
+	box.Wait()
+	expected := filepath.Join(dir, "evil.txt")
+	if len(dropped) != 1 || dropped[0] != expected {
+		t.Fatalf("Expected drop to %q, got %v", expected, dropped)
+	}
+	got, err := os.ReadFile(expected)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Dropped file content differs: %v", err)
+	}
+	// Token is one time only.
+	_, err = send(2, "alice", token, "again.txt", data)
+	var refused *txfer.RefusedError
+	if !errors.As(err, &refused) || refused.Reason != txfer.ErrInvalidToken.Error() {
+		t.Errorf("Expected ErrInvalidToken on reuse, got %v", err)
+	}
+	// No token: data frames of unknown streams are rejected.
+	sender := &txfer.StreamSender{ID: 3, FrameSize: 200, Send: func(frame []byte) error {
+		_, err := box.Receive("mallory", frame)
+		return err
+	}}
+	_, err = sender.Copy(context.Background(), bytes.NewReader(data))
+	if err == nil {
+		t.Errorf("Expected error for stream without drop header")
+	}
+	// Same name again doesn't overwrite.
+	token = box.NewToken(time.Minute)
+	if _, err = send(4, "bob", token, "evil.txt", data[:10]); err != nil {
+		t.Fatal(err)
+	}
+	box.Wait()
+	if len(dropped) != 2 || dropped[1] != filepath.Join(dir, "evil-1.txt") {
+		t.Errorf("Expected second drop to be renamed, got %v", dropped)
+	}
+	// Expired token.
+	token = box.NewToken(-time.Second)
+	_, err = send(5, "bob", token, "late.txt", data)
+	if !errors.As(err, &refused) {
+		t.Errorf("Expected ErrInvalidToken for expired token, got %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, txfer.PartialDir))
+	if len(entries) != 0 {
+		t.Errorf("Expected empty staging directory, got %v", entries)
+	}
+}
+
+func TestDropBoxOwns(t *testing.T) {
+	inbox, err := txfer.NewDropBox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := txfer.NewDropBox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := other.NewToken(time.Minute)
+	header := txfer.DropFrame(7, token, "f.txt", 3, tcrypto.DefaultHashes, nil, "")
+	if inbox.Owns("alice", header) || !other.Owns("alice", header) {
+		t.Errorf("Only the box of the token should own the header")
+	}
+	if _, err = other.Receive("alice", header); err != nil {
+		t.Fatal(err)
+	}
+	data := txfer.DropFrame(7, "", "", 0, nil, nil, "") // any frame of stream 7.
+	data[0] = 'D'
+	if inbox.Owns("alice", data) || !other.Owns("alice", data) || other.Owns("bob", data) {
+		t.Errorf("Only the box of the active drop should own its frames from its sender")
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+		ok      bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"dir/b.txt", "b.txt", true},
+		{`c:\windows\c.txt`, "c.txt", true},
+		{"..", "", false},
+		{"/", "", false},
+		{"", "", false},
+		{txfer.PartialDir, "", false},
+	} {
+		got, err := txfer.SanitizeName(tc.in)
+		if got != tc.out || (err == nil) != tc.ok {
+			t.Errorf("SanitizeName(%q) = %q, %v", tc.in, got, err)
+		}
+	}
+}
+
+func TestDropBoxScan(t *testing.T) {
+	dir := t.TempDir()
+	box, err := txfer.NewDropBox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []error
+	box.OnDrop = func(_ *txfer.Drop, _ int64, err error) {
+		results = append(results, err)
+	}
+	box.Scan = func(_ context.Context, path string, d *txfer.Drop) error {
+		if filepath.Dir(path) != filepath.Join(dir, txfer.PartialDir) {
+			t.Errorf("Scan should happen in staging, got %q", path)
+		}
+		if d.Name == "virus.exe" {
+			return txfer.ErrRejected
+		}
+		return nil
+	}
+	for i, name := range []string{"ok.txt", "virus.exe"} {
+		if _, err = dropTo(box, uint32(i), "peer", box.NewToken(time.Minute), name, randomData(500)); err != nil {
+			t.Fatal(err)
+		}
+		box.Wait()
+	}
+	if len(results) != 2 || results[0] != nil || !errors.Is(results[1], txfer.ErrRejected) {
+		t.Errorf("Unexpected scan results %v", results)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "virus.exe")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Rejected file should not be in the inbox: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, txfer.PartialDir))
+	if len(entries) != 0 {
+		t.Errorf("Expected rejected file to be removed from staging, got %v", entries)
+	}
+}
+
+func TestScanCommand(t *testing.T) {
+	if _, err := exec.LookPath("false"); err != nil {
+		t.Skip("No true/false commands on this system")
+	}
+	d := &txfer.Drop{Name: "x", From: "y"}
+	scan, err := txfer.ScanCommand("true", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = scan(context.Background(), "/dev/null", d); err != nil {
+		t.Errorf("Expected true to accept the file: %v", err)
+	}
+	if scan, err = txfer.ScanCommand("false --ignored", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = scan(context.Background(), "/dev/null", d); !errors.Is(err, txfer.ErrRejected) {
+		t.Errorf("Expected false to reject the file: %v", err)
+	}
+	if _, err = txfer.ScanCommand(" \t", 0); !errors.Is(err, txfer.ErrNoScanCommand) {
+		t.Errorf("Expected a blank scan command to be refused, got %v", err)
+	}
+}
+
+func TestDropBoxSpace(t *testing.T) {
+	dir := t.TempDir()
+	avail, err := txfer.FreeSpace(dir)
+	if errors.Is(err, txfer.ErrNoFreeSpaceInfo) {
+		t.Skip("No free space information on this platform")
+	}
+	if err != nil || avail <= 0 {
+		t.Fatalf("FreeSpace returned %d, %v", avail, err)
+	}
+	box, err := txfer.NewDropBox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := box.NewToken(time.Minute)
+	// Announce more than what is available, without sending it.
+	replies := make(chan []byte, 1)
+	sender := &txfer.StreamSender{ID: 1, FrameSize: 200, Send: func(frame []byte) error {
+		reply, _ := box.Receive("greedy", frame)
+		replies <- reply
+		return nil
+	}}
+	_, err = txfer.SendDrop(context.Background(), sender, token, "huge.bin", "", avail+1, bytes.NewReader(nil), replies)
+	var refused *txfer.RefusedError
+	if !errors.As(err, &refused) || !strings.Contains(refused.Reason, "not enough space") {
+		t.Fatalf("Expected refusal for lack of space, got %v", err)
+	}
+	t.Logf("Got expected refusal: %v", err)
+	// Token is still usable after a refusal for lack of space, and more data than announced is rejected.
+	if _, err = dropTo(box, 2, "greedy", token, "small.bin", randomData(10)); err != nil {
+		t.Errorf("Token should still be valid: %v", err)
+	}
+	box.Wait()
+	if err = txfer.CheckSpace(dir, avail+1, 0); err == nil {
+		t.Errorf("CheckSpace should have failed")
+	}
+}
+
+func TestDropHashNegotiation(t *testing.T) {
+	box, err := txfer.NewDropBox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dropErr error
+	box.OnDrop = func(_ *txfer.Drop, _ int64, err error) {
+		dropErr = err
+	}
+	data := randomData(1000)
+	var sender *txfer.StreamSender
+	corrupt := 0 // frames to corrupt: their chunk hash doesn't match anymore.
+	fixSum := false
+	sender, replies := dropSender(box, 5, "alice", func(frame []byte) []byte {
+		if corrupt == 0 || frame[0] != 'D' || len(frame) <= txfer.StreamHeaderSize {
+			return frame
+		}
+		corrupt--
+		frame = append([]byte(nil), frame...)
+		frame[txfer.StreamHeaderSize] ^= 1
+		if fixSum { // only the final verification can tell then.
+			size := len(sender.ChunkHash.Sum(nil))
+			copy(frame[len(frame)-size:], sender.ChunkHash.Sum(frame[txfer.StreamHeaderSize:len(frame)-size]))
+		}
+		return frame
+	})
+	drop := func(id uint32, name string) {
+		t.Helper()
+		sender.ID = id
+		_, err := txfer.SendDrop(context.Background(), sender, box.NewToken(time.Minute), name, "",
+			int64(len(data)), bytes.NewReader(data), replies)
+		if err != nil {
+			t.Fatalf("SendDrop error: %v", err)
+		}
+		box.Wait()
+	}
+	drop(5, "a.bin")
+	if sender.Hash != tcrypto.DefaultHashes[0] || sender.ChunkHash != tcrypto.DefaultChunkHashes[0] {
+		t.Errorf("Expected negotiated hashes %v and %v, got %v and %v",
+			tcrypto.DefaultHashes[0], tcrypto.DefaultChunkHashes[0], sender.Hash, sender.ChunkHash)
+	}
+	if dropErr != nil {
+		t.Errorf("Drop error: %v", dropErr)
+	}
+	corrupt = 2
+	drop(6, "b.bin")
+	got, err := os.ReadFile(filepath.Join(box.Dir, "b.bin"))
+	if dropErr != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected the corrupted frames to be sent again, got %v, %d bytes", dropErr, len(got))
+	}
+	corrupt, fixSum = 1, true
+	sender.ID = 7
+	_, _ = txfer.SendDrop(context.Background(), sender, box.NewToken(time.Minute), "c.bin", "",
+		int64(len(data)), bytes.NewReader(data), replies)
+	box.Wait()
+	if !errors.Is(dropErr, txfer.ErrChecksumMismatch) {
+		t.Errorf("Expected checksum mismatch for corrupted drop, got %v", dropErr)
+	}
+}
+
+func TestDropNeedsCommonHash(t *testing.T) {
+	box, err := txfer.NewDropBox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := box.NewToken(time.Minute)
+	for _, header := range [][]byte{
+		txfer.DropFrame(3, token, "f.txt", 3, nil, tcrypto.DefaultChunkHashes, ""),
+		txfer.DropFrame(3, token, "f.txt", 3, []tcrypto.HashAlgo{tcrypto.CRC32C}, nil, ""),
+	} {
+		reply, err := box.Receive("alice", header)
+		if !errors.Is(err, tcrypto.ErrNoCommonHash) || len(reply) == 0 || reply[0] != 'R' {
+			t.Errorf("Expected a drop without a common hash to be refused, got %q, %v", reply, err)
+		}
+	}
+	header := txfer.DropFrame(3, token, "f.txt", 3, tcrypto.DefaultHashes, nil, "")
+	noHashesLine, _, _ := bytes.Cut(header, []byte("\n"+tcrypto.FormatHashes(tcrypto.DefaultHashes)))
+	if _, err = box.Receive("alice", noHashesLine); err == nil {
+		t.Errorf("Expected a header without the hashes line to be refused")
+	}
+	if _, err = box.Receive("alice", header); err != nil {
+		t.Errorf("The token should still be usable after the refusals: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package txfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"fortio.org/log"
+)
+
+// MaxModifiedRetries is how many times SendDropFile sends a file again after it was modified while
+// being sent.
+const MaxModifiedRetries = 3
+
+var (
+	// ErrModified is returned by SendDropFile when the file kept being modified while it was sent.
+	ErrModified = errors.New("file modified while being sent")
+	// ModifiedRetryDelay is how long SendDropFile waits before sending a modified file again.
+	ModifiedRetryDelay = time.Second
+)
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// modified returns why f, whose n first bytes were read since it was st, changed, "" if it didn't.
+func modified(f *os.File, st os.FileInfo, n int64) string {
+	now, err := f.Stat()
+	switch {
+	case err != nil:
+		return err.Error()
+	case now.Size() != st.Size():
+		return fmt.Sprintf("size changed from %d to %d", st.Size(), now.Size())
+	case n != st.Size():
+		return fmt.Sprintf("read %d bytes of %d", n, st.Size())
+	case !now.ModTime().Equal(st.ModTime()):
+		return fmt.Sprintf("modification time changed from %v to %v", st.ModTime(), now.ModTime())
+	default:
+		return ""
+	}
+}
+
+// SendDropFile sends f as file name to a peer's DropBox (see SendDrop) using a new stream of
+// newSender for each try. A file modified while being sent (its size or modification time changed
+// by the end) isn't delivered torn: the drop is aborted, discarded by the receiver, and the file
+// sent again up to MaxModifiedRetries times, after which the error is ErrModified. With f's digest
+// (see ContentDigest), a receiver already having it answers so instead (ErrDuplicate).
+func SendDropFile(ctx context.Context, newSender func() *StreamSender, token, name, digest string, f *os.File,
+	replies <-chan []byte,
+) (int64, error) {
+	for try := 0; ; try++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		sender := newSender()
+		r := &countingReader{r: io.LimitReader(f, st.Size())}
+		sender.Check = func() error {
+			if reason := modified(f, st, r.n); reason != "" {
+				return &AbortedError{Reason: fmt.Sprintf("%s: %v: %s", name, ErrModified, reason), Retry: try < MaxModifiedRetries}
+			}
+			return nil
+		}
+		n, err := SendDrop(ctx, sender, token, name, digest, st.Size(), r, replies)
+		var aborted *AbortedError
+		if !errors.As(err, &aborted) {
+			return n, err
+		}
+		if !aborted.Retry {
+			return n, fmt.Errorf("%w: %s after %d tries", ErrModified, name, try+1)
+		}
+		log.Warnf("%s, sending it again in %v", aborted.Reason, ModifiedRetryDelay)
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case <-time.After(ModifiedRetryDelay):
+		}
+	}
+}
+
+// DropDest is one of the DropBoxes FanOutDropFile drops a file in.
+type DropDest struct {
+	Name      string               // of the peer, for the progress and logs
+	Token     string               // the peer gave us
+	NewSender func() *StreamSender // returns a new stream to the peer, for each try
+	Replies   <-chan []byte        // frames received from the peer
+}
+
+// dropTarget is the FanOut Target feeding the chunks, in order, to a drop's stream through a pipe.
+type dropTarget struct {
+	name string
+	pw   *io.PipeWriter
+	done chan struct{}
+	n    int64
+	err  error
+}
+
+func (t *dropTarget) Name() string {
+	return t.name
+}
+
+func (t *dropTarget) SendChunk(_ context.Context, c Chunk) error {
+	_, err := t.pw.Write(c.Data)
+	return err
+}
+
+// startDrop starts the drop of f (as it was when st, with its digest if known) as file name to d,
+// reading the content from the returned target.
+func startDrop(ctx context.Context, d DropDest, name, digest string, f *os.File, st os.FileInfo, try int) *dropTarget {
+	pr, pw := io.Pipe()
+	t := &dropTarget{name: d.Name, pw: pw, done: make(chan struct{})}
+	sender := d.NewSender()
+	r := &countingReader{r: pr}
+	sender.Check = func() error {
+		if reason := modified(f, st, r.n); reason != "" {
+			return &AbortedError{Reason: fmt.Sprintf("%s: %v: %s", name, ErrModified, reason), Retry: try < MaxModifiedRetries}
+		}
+		return nil
+	}
+	go func() {
+		t.n, t.err = SendDrop(ctx, sender, d.Token, name, digest, st.Size(), r, d.Replies)
+		pr.CloseWithError(t.err) // fails the chunks the drop won't read.
+		close(t.done)
+	}()
+	return t
+}
+
+// finish ends the content, with the FanOut's error for the target if any, and returns the result
+// of the drop.
+func (t *dropTarget) finish(err error) (int64, error) {
+	t.pw.CloseWithError(err)
+	<-t.done
+	return t.n, t.err
+}
+
+// FanOutDropFile drops f as file name in several DropBoxes at once: each chunk is read once for
+// all of them (see FanOut) and fed to a drop to each (see SendDrop). Like with SendDropFile, a file
+// modified while being sent is sent again, to the destinations which got it torn, up to
+// MaxModifiedRetries times. With f's digest (see ContentDigest), the destinations already having it
+// are skipped. It returns the progress of each destination, in the same order as dests, with Bytes
+// the bytes dropped, Skipped set when it already had the file and Err when its drop failed.
+func FanOutDropFile(ctx context.Context, name, digest string, f *os.File, dests ...DropDest) []Progress {
+	res := make([]Progress, len(dests))
+	todo := make([]int, len(dests)) // indexes in dests still to drop to.
+	for i := range todo {
+		todo[i] = i
+	}
+	for try := 0; ; try++ {
+		st, err := f.Stat()
+		if err != nil {
+			for _, i := range todo {
+				res[i] = Progress{Target: dests[i].Name, Err: err, Done: true}
+			}
+			return res
+		}
+		drops := make([]*dropTarget, len(todo))
+		targets := make([]Target, len(todo))
+		for j, i := range todo {
+			drops[j] = startDrop(ctx, dests[i], name, digest, f, st, try)
+			targets[j] = drops[j]
+		}
+		// A failed chunk means a failed drop (or pipe), there is no point retrying it.
+		progress := (&FanOut{MaxRetries: -1}).Send(ctx, f, st.Size(), targets...)
+		var again []int
+		for j, i := range todo {
+			p := progress[j]
+			p.Bytes, p.Err = drops[j].finish(p.Err)
+			var aborted *AbortedError
+			if errors.Is(p.Err, ErrDuplicate) {
+				p.Err, p.Skipped = nil, true
+			} else if errors.As(p.Err, &aborted) {
+				if aborted.Retry {
+					again = append(again, i)
+				} else {
+					p.Err = fmt.Errorf("%w: %s after %d tries", ErrModified, name, try+1)
+				}
+			}
+			res[i] = p
+		}
+		if len(again) == 0 {
+			return res
+		}
+		log.Warnf("%s modified while being sent, sending it again to %d peer(s) in %v", name, len(again), ModifiedRetryDelay)
+		select {
+		case <-ctx.Done():
+			for _, i := range again {
+				res[i].Err = ctx.Err()
+			}
+			return res
+		case <-time.After(ModifiedRetryDelay):
+		}
+		todo = again
+	}
+}
@@ -0,0 +1,174 @@
+package txfer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/txfer"
+)
+
+// TestSendDropFileModified checks a file modified while being dropped is sent again, and that a
+// file which keeps changing fails with ErrModified, without torn content reaching the inbox.
+func TestSendDropFileModified(t *testing.T) {
+	txfer.ModifiedRetryDelay = time.Millisecond
+	for _, modifications := range []int{1, txfer.MaxModifiedRetries + 1} {
+		dir := t.TempDir()
+		box, err := txfer.NewDropBox(filepath.Join(dir, "inbox"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dropErrs []error
+		box.OnDrop = func(_ *txfer.Drop, _ int64, err error) { dropErrs = append(dropErrs, err) }
+		path := filepath.Join(dir, "file.bin")
+		data := randomData(3000)
+		if err = os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		left, modified := modifications, uint32(0)
+		// Rewrites the file (same size, new content and time) during the first data frame of each try.
+		alter := func(frame []byte) []byte {
+			if id, _ := txfer.StreamID(frame); left > 0 && frame[0] == 'D' && id != modified {
+				left, modified = left-1, id
+				data = randomData(len(data))
+				if err := os.WriteFile(path, data, 0o644); err != nil {
+					t.Error(err)
+				}
+				later := time.Now().Add(time.Duration(modifications-left) * time.Hour)
+				if err := os.Chtimes(path, later, later); err != nil {
+					t.Error(err)
+				}
+			}
+			return frame
+		}
+		replies := make(chan []byte, 1)
+		id := uint32(0)
+		newSender := func() *txfer.StreamSender {
+			id++
+			sender, senderReplies := dropSender(box, id, "alice", alter)
+			send := sender.Send
+			sender.Send = func(frame []byte) error {
+				err := send(frame)
+				select {
+				case reply := <-senderReplies:
+					replies <- reply
+				default:
+				}
+				return err
+			}
+			return sender
+		}
+		token := box.NewToken(time.Minute)
+		n, err := txfer.SendDropFile(context.Background(), newSender, token, "file.bin", "", f, replies)
+		box.Wait()
+		if modifications > txfer.MaxModifiedRetries {
+			var aborted *txfer.AbortedError
+			if !errors.Is(err, txfer.ErrModified) || len(dropErrs) != 1 || !errors.As(dropErrs[0], &aborted) || aborted.Retry {
+				t.Errorf("Expected ErrModified and an aborted drop, got %v, %v", err, dropErrs)
+			}
+			if _, err = os.Stat(filepath.Join(box.Dir, "file.bin")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Modified file shouldn't be in the inbox: %v", err)
+			}
+		} else {
+			if err != nil || n != int64(len(data)) || len(dropErrs) != 1 || dropErrs[0] != nil {
+				t.Fatalf("SendDropFile = %d, %v (drops %v)", n, err, dropErrs)
+			}
+			got, err := os.ReadFile(filepath.Join(box.Dir, "file.bin"))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("Dropped file isn't the modified one: %v", err)
+			}
+		}
+		if entries, _ := os.ReadDir(filepath.Join(box.Dir, txfer.PartialDir)); len(entries) != 0 {
+			t.Errorf("Expected empty staging directory, got %v", entries)
+		}
+		if id != uint32(min(modifications, txfer.MaxModifiedRetries)+1) {
+			t.Errorf("%d tries for %d modifications", id, modifications)
+		}
+	}
+}
+
+// TestFanOutDropFile drops a file in 2 inboxes at once, a third refusing it (wrong token) failing alone,
+// then again with its digest, skipped by the inbox remembering it (Dedup).
+func TestFanOutDropFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.bin")
+	data := randomData(100*1000 + 3)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var boxes []*txfer.DropBox
+	var dests []txfer.DropDest
+	for i, name := range []string{"alice", "bob", "mallory"} {
+		box, err := txfer.NewDropBox(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		box.Dedup = name == "alice"
+		boxes = append(boxes, box)
+		token := box.NewToken(time.Minute)
+		if name == "mallory" {
+			token = "wrong"
+		}
+		replies := make(chan []byte, 1)
+		newSender := func() *txfer.StreamSender {
+			sender, senderReplies := dropSender(box, uint32(i+1), "sender", nil)
+			send := sender.Send
+			sender.Send = func(frame []byte) error {
+				err := send(frame)
+				select {
+				case reply := <-senderReplies:
+					replies <- reply
+				default:
+				}
+				return err
+			}
+			return sender
+		}
+		dests = append(dests, txfer.DropDest{Name: name, Token: token, NewSender: newSender, Replies: replies})
+	}
+	res := txfer.FanOutDropFile(context.Background(), "file.bin", "", f, dests...)
+	for i, box := range boxes[:2] {
+		box.Wait()
+		if res[i].Err != nil || res[i].Bytes != int64(len(data)) || res[i].Target != dests[i].Name {
+			t.Errorf("Unexpected result for %s: %+v", dests[i].Name, res[i])
+		}
+		got, err := os.ReadFile(filepath.Join(box.Dir, "file.bin"))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s didn't receive the file: %v", dests[i].Name, err)
+		}
+	}
+	var refused *txfer.RefusedError
+	if !errors.As(res[2].Err, &refused) {
+		t.Errorf("Expected the wrong token to be refused, got %+v", res[2])
+	}
+	digest, err := txfer.ContentDigest(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dests = dests[:2]
+	for i := range dests {
+		dests[i].Token = boxes[i].NewToken(time.Minute)
+	}
+	res = txfer.FanOutDropFile(context.Background(), "file.bin", digest, f, dests...)
+	boxes[1].Wait()
+	if res[0].Err != nil || !res[0].Skipped || res[0].Bytes != 0 {
+		t.Errorf("Expected alice to be skipped, got %+v", res[0])
+	}
+	if res[1].Err != nil || res[1].Skipped || res[1].Bytes != int64(len(data)) {
+		t.Errorf("Expected bob to receive the file again, got %+v", res[1])
+	}
+}
@@ -0,0 +1,307 @@
+// Package txfer is the transport agnostic transfer engine for tsync: content is split
+// in chunks which are read once and sent to one or more targets (typically peers).
+package txfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+)
+
+const (
+	// DefaultChunkSize is the size of chunks read from the source (last one may be shorter).
+	DefaultChunkSize = 32 * 1024
+	// DefaultMaxRetries is how many times sending a chunk to a target is retried before giving up on that target.
+	DefaultMaxRetries = 3
+	// DefaultRetryDelay is the base delay between retries (multiplied by the attempt number).
+	DefaultRetryDelay = 250 * time.Millisecond
+	// DefaultWindow is how many chunks can be queued for a target ahead of it sending them.
+	DefaultWindow = 8
+)
+
+// Chunk is a piece of a transfer. Data must be treated as read only as it is shared between targets.
+type Chunk struct {
+	Index  int
+	Offset int64
+	Data   []byte
+	Sum    []byte // hash of Data when a ChunkHash is configured, for targets to check.
+}
+
+// ErrChecksumMismatch is returned when received content doesn't match its hash.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Verify checks the chunk's Sum using algo (no-op if algo is tcrypto.NoHash).
+func (c Chunk) Verify(algo tcrypto.HashAlgo) error {
+	if algo == tcrypto.NoHash {
+		return nil
+	}
+	if !bytes.Equal(algo.Sum(c.Data), c.Sum) {
+		return fmt.Errorf("%w: %v of chunk %d", ErrChecksumMismatch, algo, c.Index)
+	}
+	return nil
+}
+
+// Target is where chunks are sent to, typically a peer.
+type Target interface {
+	// Name identifies the target in progress reports and logs.
+	Name() string
+	// SendChunk sends one chunk. On error the same chunk will be retried (up to MaxRetries).
+	SendChunk(ctx context.Context, c Chunk) error
+}
+
+// Progress is the state of a transfer for one target.
+type Progress struct {
+	Target      string
+	Chunks      int // chunks successfully sent so far
+	TotalChunks int
+	Bytes       int64 // bytes successfully sent so far
+	TotalBytes  int64
+	Retries     int
+	Err         error // set when the target failed permanently (and Done is also true)
+	Done        bool
+	Skipped     bool // the target already had the content, nothing was sent (see ErrDuplicate)
+}
+
+// FanOut sends the same content to multiple targets at once. Each chunk is read once
+// from the source and handed to all the targets, each with independent retries and progress.
+// A failed target doesn't stop the others; a slow target slows the reading (and thus the others)
+// once its Window is full.
+type FanOut struct {
+	ChunkSize  int           // default DefaultChunkSize if 0
+	MaxRetries int           // default DefaultMaxRetries if 0, negative for no retries
+	RetryDelay time.Duration // default DefaultRetryDelay if 0
+	Window     int           // default DefaultWindow if 0
+	// Hash set in each Chunk's Sum, for instance tcrypto.CRC32C, for the targets to check. Drops
+	// (FanOutDropFile) check their stream frames instead, see StreamSender.ChunkHash.
+	ChunkHash tcrypto.HashAlgo
+	// Called on each progress update, from per target goroutines so must be concurrent safe and
+	// not block for long.
+	OnProgress func(p Progress)
+}
+
+// ErrAllTargetsFailed is returned by SendFile when no target received the full content.
+var ErrAllTargetsFailed = errors.New("all targets failed")
+
+// withDefaults returns a copy of f with the defaults resolved, leaving f as configured so it can
+// be reused (a negative MaxRetries stays "no retries").
+func (f *FanOut) withDefaults() *FanOut {
+	r := *f
+	if r.ChunkSize <= 0 {
+		r.ChunkSize = DefaultChunkSize
+	}
+	switch {
+	case r.MaxRetries == 0:
+		r.MaxRetries = DefaultMaxRetries
+	case r.MaxRetries < 0:
+		r.MaxRetries = 0
+	}
+	if r.RetryDelay <= 0 {
+		r.RetryDelay = DefaultRetryDelay
+	}
+	if r.Window <= 0 {
+		r.Window = DefaultWindow
+	}
+	return &r
+}
+
+// NumChunks returns the number of chunks needed for size bytes.
+func NumChunks(size int64, chunkSize int) int {
+	return int((size + int64(chunkSize) - 1) / int64(chunkSize))
+}
+
+// fanTarget is the per target state of a FanOut.
+type fanTarget struct {
+	Target
+	queue    chan Chunk
+	progress Progress
+	mu       sync.Mutex
+	failed   bool
+}
+
+func (ft *fanTarget) snapshot() Progress {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.progress
+}
+
+func (ft *fanTarget) isFailed() bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.failed
+}
+
+func (ft *fanTarget) update(fn func(p *Progress)) Progress {
+	ft.mu.Lock()
+	fn(&ft.progress)
+	if ft.progress.Err != nil {
+		ft.failed = true
+		ft.progress.Done = true
+	}
+	p := ft.progress
+	ft.mu.Unlock()
+	return p
+}
+
+// Send reads size bytes from src, each chunk once, and sends them to all the targets.
+// It returns the final progress of each target, in the same order as targets.
+func (f *FanOut) Send(ctx context.Context, src io.ReaderAt, size int64, targets ...Target) []Progress {
+	f = f.withDefaults()
+	numChunks := NumChunks(size, f.ChunkSize)
+	fts := make([]*fanTarget, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		ft := &fanTarget{
+			Target: t,
+			queue:  make(chan Chunk, f.Window),
+			progress: Progress{
+				Target:      t.Name(),
+				TotalChunks: numChunks,
+				TotalBytes:  size,
+			},
+		}
+		fts[i] = ft
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.runTarget(ctx, ft)
+		}()
+	}
+	readErr := f.readLoop(ctx, src, size, numChunks, fts)
+	for _, ft := range fts {
+		close(ft.queue)
+	}
+	wg.Wait()
+	res := make([]Progress, len(fts))
+	for i, ft := range fts {
+		wasDone := false
+		p := ft.update(func(p *Progress) {
+			if p.Done {
+				wasDone = true
+				return
+			}
+			switch {
+			case readErr != nil:
+				p.Err = readErr
+			case ctx.Err() != nil:
+				p.Err = ctx.Err()
+			}
+			p.Done = true
+		})
+		if !wasDone && f.OnProgress != nil {
+			f.OnProgress(p)
+		}
+		res[i] = p
+	}
+	return res
+}
+
+// readLoop reads each chunk once and queues it to all the targets still alive.
+func (f *FanOut) readLoop(ctx context.Context, src io.ReaderAt, size int64, numChunks int, fts []*fanTarget) error {
+	for i := range numChunks {
+		offset := int64(i) * int64(f.ChunkSize)
+		buf := make([]byte, min(int64(f.ChunkSize), size-offset))
+		n, err := src.ReadAt(buf, offset)
+		if n != len(buf) {
+			if err == nil || errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			log.Errf("Error reading chunk %d at offset %d: %v", i, offset, err)
+			return err
+		}
+		c := Chunk{Index: i, Offset: offset, Data: buf, Sum: f.ChunkHash.Sum(buf)}
+		alive := 0
+		for _, ft := range fts {
+			if ft.isFailed() {
+				continue
+			}
+			alive++
+			select {
+			case ft.queue <- c:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if alive == 0 {
+			log.Warnf("All %d targets failed, stopping at chunk %d/%d", len(fts), i, numChunks)
+			return nil
+		}
+	}
+	return nil
+}
+
+// runTarget sends the queued chunks to one target, with retries. Once failed it keeps
+// draining the queue so the reader is never blocked by a dead target.
+func (f *FanOut) runTarget(ctx context.Context, ft *fanTarget) {
+	for c := range ft.queue {
+		if ft.isFailed() {
+			continue
+		}
+		err := f.sendWithRetries(ctx, ft, c)
+		p := ft.update(func(p *Progress) {
+			if err != nil {
+				p.Err = err
+				return
+			}
+			p.Chunks++
+			p.Bytes += int64(len(c.Data))
+			p.Done = p.Chunks == p.TotalChunks
+		})
+		if err != nil {
+			log.Warnf("Giving up on target %q at chunk %d: %v", ft.Name(), c.Index, err)
+		}
+		if f.OnProgress != nil {
+			f.OnProgress(p)
+		}
+	}
+}
+
+func (f *FanOut) sendWithRetries(ctx context.Context, ft *fanTarget, c Chunk) error {
+	for attempt := 0; ; attempt++ {
+		err := ft.SendChunk(ctx, c)
+		if err == nil {
+			return nil
+		}
+		if attempt >= f.MaxRetries {
+			return err
+		}
+		ft.update(func(p *Progress) { p.Retries++ })
+		log.LogVf("Retrying chunk %d to %q (attempt %d): %v", c.Index, ft.Name(), attempt+1, err)
+		select {
+		case <-time.After(f.RetryDelay * time.Duration(attempt+1)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SendFile sends the file at path to all the targets using f (or the defaults if f is nil).
+// It returns ErrAllTargetsFailed if no target received the whole file.
+func SendFile(ctx context.Context, f *FanOut, path string, targets ...Target) ([]Progress, error) {
+	if f == nil {
+		f = &FanOut{}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	res := f.Send(ctx, file, st.Size(), targets...)
+	for _, p := range res {
+		if p.Err == nil {
+			return res, nil
+		}
+	}
+	return res, ErrAllTargetsFailed
+}
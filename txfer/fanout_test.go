@@ -0,0 +1,161 @@
+package txfer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/txfer"
+)
+
+// memTarget reassembles the chunks it receives in memory and can be told to fail.
+type memTarget struct {
+	name     string
+	failures int  // number of initial SendChunk calls that fail
+	dead     bool // always fail
+	mu       sync.Mutex
+	buf      []byte
+	calls    int
+}
+
+var errInjected = errors.New("injected failure")
+
+func (m *memTarget) Name() string {
+	return m.name
+}
+
+func (m *memTarget) SendChunk(_ context.Context, c txfer.Chunk) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.dead || m.calls <= m.failures {
+		return errInjected
+	}
+	end := int(c.Offset) + len(c.Data)
+	if end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+	copy(m.buf[c.Offset:], c.Data)
+	return nil
+}
+
+// countingReader counts the ReadAt calls to check chunks are only read once.
+type countingReader struct {
+	*bytes.Reader
+	reads atomic.Int32
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	c.reads.Add(1)
+	return c.Reader.ReadAt(p, off)
+}
+
+func randomData(n int) []byte {
+	r := rand.New(rand.NewPCG(42, uint64(n))) //nolint:gosec // test data.
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(r.UintN(256))
+	}
+	return b
+}
+
+func TestFanOut(t *testing.T) {
+	data := randomData(10*1000 + 7)
+	src := &countingReader{Reader: bytes.NewReader(data)}
+	good := &memTarget{name: "good"}
+	flaky := &memTarget{name: "flaky", failures: 2}
+	dead := &memTarget{name: "dead", dead: true}
+	var updates atomic.Int32
+	f := &txfer.FanOut{
+		ChunkSize:  1000,
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+		Window:     2,
+		OnProgress: func(_ txfer.Progress) { updates.Add(1) },
+	}
+	res := f.Send(context.Background(), src, int64(len(data)), good, flaky, dead)
+	if len(res) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(res))
+	}
+	for i, tgt := range []*memTarget{good, flaky} {
+		p := res[i]
+		if p.Err != nil || !p.Done {
+			t.Errorf("Target %q unexpected result %+v", tgt.name, p)
+		}
+		if p.Chunks != 11 || p.TotalChunks != 11 || p.Bytes != int64(len(data)) {
+			t.Errorf("Target %q unexpected counts %+v", tgt.name, p)
+		}
+		if !bytes.Equal(tgt.buf, data) {
+			t.Errorf("Target %q received different data", tgt.name)
+		}
+	}
+	if res[1].Retries != 2 {
+		t.Errorf("Expected 2 retries for flaky target, got %d", res[1].Retries)
+	}
+	if !errors.Is(res[2].Err, errInjected) || !res[2].Done {
+		t.Errorf("Expected dead target to fail, got %+v", res[2])
+	}
+	if dead.calls != 3 {
+		t.Errorf("Expected dead target to be tried 3 times (1 + 2 retries), got %d", dead.calls)
+	}
+	if r := src.reads.Load(); r != 11 {
+		t.Errorf("Expected each of the 11 chunks to be read once, got %d reads", r)
+	}
+	if updates.Load() < 23 {
+		t.Errorf("Expected at least 23 progress updates, got %d", updates.Load())
+	}
+}
+
+func TestFanOutEmptyAndAllFailed(t *testing.T) {
+	f := &txfer.FanOut{}
+	res := f.Send(context.Background(), bytes.NewReader(nil), 0, &memTarget{name: "empty"})
+	if !res[0].Done || res[0].Err != nil || res[0].TotalChunks != 0 {
+		t.Errorf("Unexpected result for empty transfer %+v", res[0])
+	}
+	f = &txfer.FanOut{ChunkSize: 10, MaxRetries: -1}
+	data := randomData(1000)
+	src := &countingReader{Reader: bytes.NewReader(data)}
+	res = f.Send(context.Background(), src, int64(len(data)), &memTarget{name: "d1", dead: true},
+		&memTarget{name: "d2", dead: true})
+	for _, p := range res {
+		if p.Err == nil || !p.Done {
+			t.Errorf("Expected failure, got %+v", p)
+		}
+	}
+	if r := src.reads.Load(); r > 10 {
+		t.Errorf("Expected reading to stop early once all targets failed, got %d reads", r)
+	}
+	// Reusing f: still no retries, and its configuration unchanged.
+	dead := &memTarget{name: "d3", dead: true}
+	f.Send(context.Background(), bytes.NewReader(data), int64(len(data)), dead)
+	if dead.calls != 1 || f.MaxRetries != -1 || f.Window != 0 {
+		t.Errorf("Reused FanOut: %d calls to the dead target, now %+v", dead.calls, *f)
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	data := randomData(5000)
+	path := filepath.Join(t.TempDir(), "f.bin")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, b := &memTarget{name: "a"}, &memTarget{name: "b"}
+	res, err := txfer.SendFile(context.Background(), &txfer.FanOut{ChunkSize: 999}, path, a, b)
+	if err != nil {
+		t.Fatalf("SendFile failed: %v (%+v)", err, res)
+	}
+	if !bytes.Equal(a.buf, data) || !bytes.Equal(b.buf, data) {
+		t.Errorf("Targets received different data")
+	}
+	_, err = txfer.SendFile(context.Background(), nil, path, &memTarget{name: "dead", dead: true})
+	if !errors.Is(err, txfer.ErrAllTargetsFailed) {
+		t.Errorf("Expected ErrAllTargetsFailed, got %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package txfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"fortio.org/log"
+)
+
+// DefaultScanTimeout is the maximum time a scan command can run before the file is rejected.
+const DefaultScanTimeout = 5 * time.Minute
+
+var (
+	// ErrRejected is returned (wrapped) when a scan command rejects a received file.
+	ErrRejected = errors.New("rejected by scan")
+	// ErrNoScanCommand is returned by ScanCommand for a command line without any command.
+	ErrNoScanCommand = errors.New("empty scan command")
+)
+
+// ScanFunc checks a received file, still in staging, before it is moved to its destination.
+// Returning an error rejects (and deletes) the file.
+type ScanFunc func(ctx context.Context, path string, d *Drop) error
+
+// ScanCommand returns a ScanFunc running the given command line (e.g. a virus scanner or
+// a validator) with the staged file path as last argument and TSYNC_FILE, TSYNC_NAME and
+// TSYNC_FROM environment variables set. A non zero exit status rejects the file.
+// Returns ErrNoScanCommand when command is only spaces.
+func ScanCommand(command string, timeout time.Duration) (ScanFunc, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, ErrNoScanCommand
+	}
+	if timeout <= 0 {
+		timeout = DefaultScanTimeout
+	}
+	return func(ctx context.Context, path string, d *Drop) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], append(args[1:], path)...) //nolint:gosec // user configured command.
+		cmd.Env = append(os.Environ(), "TSYNC_FILE="+path, "TSYNC_NAME="+d.Name, "TSYNC_FROM="+d.From)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Warnf("Scan of %q from %q failed: %v: %s", d.Name, d.From, err, out)
+			return fmt.Errorf("%w: %v: %s", ErrRejected, err, strings.TrimSpace(string(out)))
+		}
+		log.LogVf("Scan of %q ok: %s", d.Name, out)
+		return nil
+	}, nil
+}
@@ -0,0 +1,233 @@
+package txfer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoShare is returned for paths outside of the shares.
+	ErrNoShare = errors.New("no such share")
+	// ErrReadOnly is returned by Shares.WriteDir for read-only shares.
+	ErrReadOnly = errors.New("read-only share")
+)
+
+// Share is a local directory exposed to the trusted peers under Name, read-only unless Writable.
+type Share struct {
+	Name     string `json:"name"`
+	Dir      string `json:"dir"`
+	Writable bool   `json:"writable,omitempty"`
+}
+
+// ParseShares parses the comma separated shares of the -share flag: [name=]dir[:rw], the name
+// defaulting to the directory's base name, read-write with the :rw suffix.
+func ParseShares(spec string) ([]Share, error) {
+	var shares []Share
+	for item := range strings.SplitSeq(spec, ",") {
+		var sh Share
+		dir, rw := strings.CutSuffix(strings.TrimSpace(item), ":rw")
+		sh.Writable = rw
+		if name, d, ok := strings.Cut(dir, "="); ok {
+			sh.Name, dir = name, d
+		} else {
+			sh.Name = filepath.Base(dir)
+		}
+		if dir == "" {
+			return nil, fmt.Errorf("share %q without a directory", item)
+		}
+		sh.Dir = dir
+		shares = append(shares, sh)
+	}
+	return shares, nil
+}
+
+// ShareEntry is a file or directory of a share, or a share itself at the root, as listed by
+// Shares.List.
+type ShareEntry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	ModTime  time.Time `json:"mtime,omitzero"`
+	Writable bool      `json:"writable,omitempty"` // of the shares.
+}
+
+// Shares is the virtual filesystem the trusted peers can browse: each share is a top level
+// directory, e.g. "/docs/report.pdf" is report.pdf in the docs share. Paths use slashes and can't
+// leave their share (symbolic links included).
+type Shares struct {
+	shares map[string]Share
+	names  []string // in order.
+}
+
+// NewShares checks the shares' names (unique plain file names) and directories.
+func NewShares(list []Share) (*Shares, error) {
+	s := &Shares{shares: make(map[string]Share, len(list))}
+	for _, sh := range list {
+		if name, err := SanitizeName(sh.Name); err != nil || name != sh.Name {
+			return nil, fmt.Errorf("invalid share name %q", sh.Name)
+		}
+		if _, dup := s.shares[sh.Name]; dup {
+			return nil, fmt.Errorf("duplicate share %q", sh.Name)
+		}
+		sh.Dir = LongPath(sh.Dir)
+		if st, err := os.Stat(sh.Dir); err != nil || !st.IsDir() {
+			return nil, fmt.Errorf("share %q: not a directory: %q (%v)", sh.Name, sh.Dir, err)
+		}
+		s.shares[sh.Name] = sh
+		s.names = append(s.names, sh.Name)
+	}
+	return s, nil
+}
+
+// Len returns the number of shares.
+func (s *Shares) Len() int {
+	return len(s.names)
+}
+
+// resolve returns the share of the virtual path p and the (slash separated, "." for the
+// share's directory) path relative to it. The root is the empty share.
+func (s *Shares) resolve(p string) (Share, string, error) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return Share{}, "", nil
+	}
+	if strings.ContainsAny(p, streamSeparator) {
+		return Share{}, "", fmt.Errorf("%w: %q", ErrInvalidName, p)
+	}
+	name, rel, _ := strings.Cut(p, "/")
+	sh, ok := s.shares[name]
+	if !ok {
+		return sh, "", fmt.Errorf("%w %q", ErrNoShare, name)
+	}
+	if rel == "" {
+		rel = "."
+	}
+	return sh, rel, nil
+}
+
+// List returns the entries of the directory at the virtual path p (the shares for "/"), in name
+// order. Symbolic links are followed when they stay in the share, omitted otherwise.
+func (s *Shares) List(p string) ([]ShareEntry, error) {
+	sh, rel, err := s.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if sh.Name == "" {
+		list := make([]ShareEntry, 0, len(s.names))
+		for _, name := range s.names {
+			list = append(list, ShareEntry{Name: name, Dir: true, Writable: s.shares[name].Writable})
+		}
+		return list, nil
+	}
+	root, err := os.OpenRoot(sh.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	dir, err := root.Open(filepath.FromSlash(rel))
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	list := make([]ShareEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Name() == PartialDir {
+			continue
+		}
+		info, err := root.Stat(filepath.FromSlash(path.Join(rel, e.Name())))
+		if err != nil { // dangling or leaving the share.
+			continue
+		}
+		entry := ShareEntry{Name: e.Name(), Dir: info.IsDir(), ModTime: info.ModTime().UTC()}
+		if info.Mode().IsRegular() {
+			entry.Size = info.Size()
+		} else if !info.IsDir() {
+			continue // devices, sockets...
+		}
+		list = append(list, entry)
+	}
+	return list, nil
+}
+
+// Open opens the regular file at the virtual path p for reading.
+func (s *Shares) Open(p string) (*os.File, error) {
+	sh, rel, err := s.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if sh.Name == "" || rel == "." {
+		return nil, fmt.Errorf("%q is a directory", p)
+	}
+	root, err := os.OpenRoot(sh.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	f, err := retryLocked(p, func() (*os.File, error) { return root.Open(filepath.FromSlash(rel)) })
+	if err != nil {
+		return nil, err
+	}
+	if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%q: %w", p, fs.ErrInvalid)
+	}
+	return f, nil
+}
+
+// WriteDir returns the local directory of the virtual path p for files to be dropped into (see
+// DropBox), ErrReadOnly unless its share is Writable.
+func (s *Shares) WriteDir(p string) (string, error) {
+	sh, rel, err := s.resolve(p)
+	if err != nil {
+		return "", err
+	}
+	if sh.Name == "" {
+		return "", fmt.Errorf("%w: files go in a share", ErrNoShare)
+	}
+	if !sh.Writable {
+		return "", fmt.Errorf("%w %q", ErrReadOnly, sh.Name)
+	}
+	root, err := os.OpenRoot(sh.Dir)
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+	st, err := root.Stat(filepath.FromSlash(rel))
+	if err != nil {
+		return "", err
+	}
+	if !st.IsDir() {
+		return "", fmt.Errorf("%q is not a directory", p)
+	}
+	return filepath.Join(sh.Dir, filepath.FromSlash(rel)), nil
+}
+
+// OpenDir opens the directory at the virtual path p of a share, e.g. to pack it (see PackDir with
+// its FS). The caller must close it.
+func (s *Shares) OpenDir(p string) (*os.Root, error) {
+	sh, rel, err := s.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if sh.Name == "" {
+		return nil, fmt.Errorf("%w: the root can't be opened", ErrNoShare)
+	}
+	root, err := os.OpenRoot(sh.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.OpenRoot(filepath.FromSlash(rel))
+}
@@ -0,0 +1,100 @@
+package txfer_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fortio.org/tsync/txfer"
+)
+
+func TestParseShares(t *testing.T) {
+	shares, err := txfer.ParseShares("/home/me/docs,music=/srv/music:rw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []txfer.Share{{Name: "docs", Dir: "/home/me/docs"}, {Name: "music", Dir: "/srv/music", Writable: true}}
+	if len(shares) != len(want) || shares[0] != want[0] || shares[1] != want[1] {
+		t.Errorf("ParseShares = %+v, want %+v", shares, want)
+	}
+	if _, err = txfer.ParseShares("docs=,x"); err == nil {
+		t.Errorf("Expected an error for a share without a directory")
+	}
+}
+
+func TestShares(t *testing.T) {
+	base := t.TempDir()
+	docs, inbox, outside := filepath.Join(base, "docs"), filepath.Join(base, "inbox"), filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(docs, "sub"), inbox, outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, content := range map[string]string{
+		filepath.Join(docs, "a.txt"):         "hello",
+		filepath.Join(docs, "sub", "b.txt"):  "world!",
+		filepath.Join(outside, "secret.txt"): "secret",
+	} {
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(docs, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(docs, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txfer.NewShares([]txfer.Share{{Name: "x", Dir: docs}, {Name: "x", Dir: inbox}}); err == nil {
+		t.Errorf("Expected an error for duplicate shares")
+	}
+	if _, err := txfer.NewShares([]txfer.Share{{Name: "x", Dir: filepath.Join(docs, "a.txt")}}); err == nil {
+		t.Errorf("Expected an error for a share which isn't a directory")
+	}
+	shares, err := txfer.NewShares([]txfer.Share{{Name: "docs", Dir: docs}, {Name: "inbox", Dir: inbox, Writable: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := shares.List("/")
+	if err != nil || len(list) != 2 || list[0].Name != "docs" || !list[1].Dir || !list[1].Writable {
+		t.Errorf("List(/) = %+v %v", list, err)
+	}
+	list, err = shares.List("/docs")
+	var names []string
+	for _, e := range list {
+		names = append(names, e.Name)
+	}
+	if err != nil || len(list) != 3 || names[0] != "a.txt" || names[1] != "link.txt" || names[2] != "sub" ||
+		list[0].Size != 5 || list[1].Size != 5 || !list[2].Dir {
+		t.Errorf("List(/docs) = %+v %v", list, err)
+	}
+	if list, err = shares.List("docs/sub/"); err != nil || len(list) != 1 || list[0].Size != 6 {
+		t.Errorf("List(docs/sub/) = %+v %v", list, err)
+	}
+	if _, err = shares.List("/docs/../../outside"); !errors.Is(err, txfer.ErrNoShare) {
+		t.Errorf("List outside: expected ErrNoShare, got %v", err)
+	}
+	f, err := shares.Open("/docs/sub/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(f)
+	f.Close()
+	if string(content) != "world!" {
+		t.Errorf("Open read %q", content)
+	}
+	for _, bad := range []string{"/docs/escape.txt", "/docs/sub", "/docs", "/", "/nope/a.txt", "/docs/missing"} {
+		if f, err = shares.Open(bad); err == nil {
+			f.Close()
+			t.Errorf("Open(%q) should fail", bad)
+		}
+	}
+	if _, err = shares.WriteDir("/docs"); !errors.Is(err, txfer.ErrReadOnly) {
+		t.Errorf("WriteDir of a read-only share: expected ErrReadOnly, got %v", err)
+	}
+	if dir, err := shares.WriteDir("/inbox"); err != nil || dir != inbox {
+		t.Errorf("WriteDir(/inbox) = %q %v", dir, err)
+	}
+}
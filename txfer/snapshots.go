@@ -0,0 +1,144 @@
+package txfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+)
+
+const (
+	// SnapshotExt is the extension of the snapshot files kept by a SnapshotStore.
+	SnapshotExt = ".tsnap"
+	// DefaultSnapshotKeep is how many snapshots of each peer a SnapshotStore keeps by default.
+	DefaultSnapshotKeep = 7
+	snapshotTimeFormat  = "20060102T150405Z"
+)
+
+// ErrNoSnapshot is returned by SnapshotStore.Latest when there is no snapshot of the owner.
+var ErrNoSnapshot = errors.New("no snapshot")
+
+// SnapshotName returns the file name of a snapshot taken at t: they sort by time.
+func SnapshotName(t time.Time) string {
+	return t.UTC().Format(snapshotTimeFormat) + SnapshotExt
+}
+
+// SnapshotStore keeps the (encrypted, see tcrypto.Identity.Snapshot) snapshots pushed by peers,
+// each owner (e.g. peer key hash) in its own DropBox directory, pruned to the Keep latest ones.
+type SnapshotStore struct {
+	Dir string
+	// How many snapshots of each owner to keep, DefaultSnapshotKeep if 0.
+	Keep  int
+	mu    sync.Mutex
+	boxes map[string]*DropBox
+}
+
+// NewSnapshotStore creates the store's directory if needed.
+func NewSnapshotStore(dir string, keep int) (*SnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &SnapshotStore{Dir: dir, Keep: keep, boxes: make(map[string]*DropBox)}, nil
+}
+
+// checkOwner returns an error unless owner is a plain file name.
+func checkOwner(owner string) error {
+	if sName, err := SanitizeName(owner); err != nil || sName != owner {
+		return fmt.Errorf("invalid snapshot owner %q", owner)
+	}
+	return nil
+}
+
+// Box returns the DropBox receiving the owner's snapshots, pruning them as new ones complete.
+func (s *SnapshotStore) Box(owner string) (*DropBox, error) {
+	if err := checkOwner(owner); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if box := s.boxes[owner]; box != nil {
+		return box, nil
+	}
+	box, err := NewDropBox(filepath.Join(s.Dir, owner))
+	if err != nil {
+		return nil, err
+	}
+	box.OnDrop = func(d *Drop, _ int64, err error) {
+		if err != nil {
+			return
+		}
+		if !strings.HasSuffix(d.Path, SnapshotExt) {
+			log.Warnf("Removing %q from %q: not a snapshot", d.Path, d.From)
+			_ = os.Remove(d.Path)
+			return
+		}
+		if _, err := s.Prune(owner); err != nil {
+			log.Errf("Failed to prune the snapshots of %q: %v", owner, err)
+		}
+	}
+	s.boxes[owner] = box
+	return box, nil
+}
+
+// List returns the paths of the owner's snapshots, oldest first.
+func (s *SnapshotStore) List(owner string) ([]string, error) {
+	if err := checkOwner(owner); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(s.Dir, owner)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, e := range entries { // sorted by name, so by time.
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), SnapshotExt) {
+			list = append(list, filepath.Join(dir, e.Name()))
+		}
+	}
+	return list, nil
+}
+
+// Latest returns the path of the owner's latest snapshot, ErrNoSnapshot if there is none.
+func (s *SnapshotStore) Latest(owner string) (string, error) {
+	list, err := s.List(owner)
+	if err != nil {
+		return "", err
+	}
+	if len(list) == 0 {
+		return "", fmt.Errorf("%w of %q", ErrNoSnapshot, owner)
+	}
+	return list[len(list)-1], nil
+}
+
+// Prune removes the owner's snapshots beyond the Keep latest ones, returning their paths.
+func (s *SnapshotStore) Prune(owner string) ([]string, error) {
+	list, err := s.List(owner)
+	if err != nil {
+		return nil, err
+	}
+	keep := s.Keep
+	if keep <= 0 {
+		keep = DefaultSnapshotKeep
+	}
+	if len(list) <= keep {
+		return nil, nil
+	}
+	removed := slices.Clone(list[:len(list)-keep])
+	for _, p := range removed {
+		if err = os.Remove(p); err != nil {
+			return nil, err
+		}
+		log.Infof("Pruned snapshot %q", p)
+	}
+	return removed, nil
+}
@@ -0,0 +1,52 @@
+package txfer_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fortio.org/tsync/txfer"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	store, err := txfer.NewSnapshotStore(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Latest("alice-key"); !errors.Is(err, txfer.ErrNoSnapshot) {
+		t.Errorf("Expected ErrNoSnapshot, got %v", err)
+	}
+	if _, err = store.Box("../escape"); err == nil {
+		t.Errorf("Expected an error for an owner that isn't a plain name")
+	}
+	box, err := store.Box("alice-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	var names []string
+	for i := range 3 {
+		name := txfer.SnapshotName(start.Add(time.Duration(i) * time.Hour))
+		names = append(names, name)
+		if _, err = dropTo(box, uint32(i+1), "alice", box.NewToken(time.Minute), name, randomData(500)); err != nil {
+			t.Fatalf("Drop %d: %v", i, err)
+		}
+		box.Wait()
+	}
+	if _, err = dropTo(box, 9, "alice", box.NewToken(time.Minute), "notes.txt", randomData(10)); err != nil {
+		t.Fatal(err)
+	}
+	box.Wait()
+	list, err := store.List("alice-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || filepath.Base(list[0]) != names[1] || filepath.Base(list[1]) != names[2] {
+		t.Errorf("Expected the 2 latest snapshots %v, got %v", names[1:], list)
+	}
+	latest, err := store.Latest("alice-key")
+	if err != nil || filepath.Base(latest) != names[2] {
+		t.Errorf("Latest: %q %v", latest, err)
+	}
+}
@@ -0,0 +1,621 @@
+package txfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tcrypto"
+)
+
+// Stream frames: 1 byte type, 4 bytes stream id, 4 bytes sequence number, then the payload.
+// With a chunk hash (StreamSender.ChunkHash) data frames end with the hash of their payload.
+// The end frame's sequence number is the total number of data frames in the stream and its
+// optional payload is the hash algorithm (1 byte) and the hash of the whole stream.
+// Abort frames replace the end frame when the sender's Check failed, their payload is 1 byte (1
+// if the sender will send the content again, see AbortedError) and the reason.
+// Ack frames (receiver to sender) have no payload and their sequence number is the next expected frame.
+const (
+	StreamHeaderSize      = 1 + 4 + 4
+	streamData       byte = 'D'
+	streamEnd        byte = 'E'
+	streamAck        byte = 'K'
+	streamAbort      byte = 'X'
+	// DefaultMaxPending is how many out of order frames a StreamReceiver buffers before giving up.
+	DefaultMaxPending = 1024
+	endFrameRepeat    = 3
+	readAhead         = 64 // frames read ahead (and thus max batch size) in congestion controlled mode.
+	// DefaultMaxTimeouts is how many retransmission timeouts in a row a windowed StreamSender
+	// tolerates before giving up.
+	DefaultMaxTimeouts = 8
+	initialRTO         = 500 * time.Millisecond
+	minRTO             = 50 * time.Millisecond
+	maxRTO             = 5 * time.Second
+	dupAckThreshold    = 3
+)
+
+var (
+	// ErrStreamGap is returned by a StreamReceiver when too many frames are missing.
+	ErrStreamGap = errors.New("stream frames lost")
+	// ErrNoAck is returned by a windowed StreamSender when the receiver stopped acknowledging frames.
+	ErrNoAck = errors.New("no acknowledgment from receiver")
+)
+
+// AbortedError is returned by a StreamReceiver when the sender aborted the stream, and by the
+// StreamSender whose Check failed with it.
+type AbortedError struct {
+	Reason string
+	// The sender will send the same content again (in a new stream).
+	Retry bool
+}
+
+func (e *AbortedError) Error() string {
+	if e.Retry {
+		return "stream aborted by sender (retrying): " + e.Reason
+	}
+	return "stream aborted by sender: " + e.Reason
+}
+
+// IsStreamAck returns true if the frame is a stream ack (to be passed to StreamSender.Acks).
+func IsStreamAck(frame []byte) bool {
+	return len(frame) == StreamHeaderSize && frame[0] == streamAck
+}
+
+// StreamID returns the stream id of a stream frame (data, end or ack), false if frame isn't one.
+func StreamID(frame []byte) (uint32, bool) {
+	if len(frame) < StreamHeaderSize {
+		return 0, false
+	}
+	switch frame[0] {
+	case streamData, streamEnd, streamAck, streamAbort:
+		return binary.BigEndian.Uint32(frame[1:5]), true
+	default:
+		return 0, false
+	}
+}
+
+// StreamSender copies a reader to a peer as a sequence of frames (for instance stdin for `tsync pipe`).
+type StreamSender struct {
+	ID        uint32
+	FrameSize int                      // maximum size of each frame, including the StreamHeaderSize header
+	Send      func(frame []byte) error // sends one frame (copies it if needed)
+	Interval  time.Duration            // pacing delay between frames, 0 for none
+	// Hash of the whole content sent in the end frame for final verification (tcrypto.NoHash for none).
+	Hash tcrypto.HashAlgo
+	// ChunkHash, when set, ends each data frame with the hash of its payload, so the receiver
+	// (with the same StreamReceiver.ChunkHash) drops corrupted frames instead of failing the whole stream.
+	ChunkHash tcrypto.HashAlgo
+	// Congestion control: when set, frames are sent within its window, acks from the receiver
+	// (see StreamReceiver.Ack) must be fed to Acks and lost frames are retransmitted.
+	Congestion *AIMD
+	Acks       <-chan []byte
+	// SendBatch, when set (and with Congestion), is used to send several new frames at once (e.g. with sendmmsg).
+	SendBatch func(frames [][]byte) error
+	// Check, when set, is called once all the content was read (and, with Congestion, acknowledged):
+	// an error aborts the stream instead of ending it (the receiver fails with an AbortedError,
+	// retrying if Check's error is one with Retry) and is returned by Copy.
+	Check func() error
+}
+
+// payloadSize returns the maximum payload of a data frame, leaving room for the chunk hash.
+func (s *StreamSender) payloadSize() int {
+	if h := s.ChunkHash.New(); h != nil {
+		return s.FrameSize - StreamHeaderSize - h.Size()
+	}
+	return s.FrameSize - StreamHeaderSize
+}
+
+// appendChunkSum appends the chunk hash of the frame's payload, if any.
+func (s *StreamSender) appendChunkSum(frame []byte) []byte {
+	if s.ChunkHash == tcrypto.NoHash {
+		return frame
+	}
+	return append(frame, s.ChunkHash.Sum(frame[StreamHeaderSize:])...)
+}
+
+func encodeFrame(buf []byte, t byte, id, seq uint32) {
+	buf[0] = t
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint32(buf[5:9], seq)
+}
+
+// Copy reads r until EOF and sends all of it as frames followed by an end frame.
+// Returns the number of payload bytes sent.
+func (s *StreamSender) Copy(ctx context.Context, r io.Reader) (int64, error) {
+	payloadSize := s.payloadSize()
+	if payloadSize <= 0 {
+		return 0, fmt.Errorf("frame size %d too small", s.FrameSize)
+	}
+	if s.Congestion != nil {
+		return s.copyWindowed(ctx, r, payloadSize)
+	}
+	buf := make([]byte, s.FrameSize)
+	var seq uint32
+	var total int64
+	h := s.Hash.New()
+	for {
+		if ctx.Err() != nil {
+			return total, ctx.Err()
+		}
+		n, err := r.Read(buf[StreamHeaderSize : StreamHeaderSize+payloadSize])
+		if n > 0 {
+			if h != nil {
+				h.Write(buf[StreamHeaderSize : StreamHeaderSize+n])
+			}
+			encodeFrame(buf, streamData, s.ID, seq)
+			if sErr := s.Send(s.appendChunkSum(buf[:StreamHeaderSize+n])); sErr != nil {
+				return total, sErr
+			}
+			seq++
+			total += int64(n)
+			if s.Interval > 0 {
+				time.Sleep(s.Interval)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, s.sendEnd(buf, seq, h)
+}
+
+// sendEnd sends the end frame (or the abort frame if Check fails) for a stream of seq data frames,
+// a few times: it's tiny and losing it would leave the receiver hanging.
+func (s *StreamSender) sendEnd(buf []byte, seq uint32, h hash.Hash) error {
+	var checkErr error
+	if s.Check != nil {
+		checkErr = s.Check()
+	}
+	end := buf[:StreamHeaderSize]
+	switch {
+	case checkErr != nil:
+		encodeFrame(buf, streamAbort, s.ID, seq)
+		var aborted *AbortedError
+		retry := byte(0)
+		if errors.As(checkErr, &aborted) && aborted.Retry {
+			retry = 1
+		}
+		reason := checkErr.Error()
+		end = append(end, retry)
+		end = append(end, reason[:min(len(reason), s.FrameSize-StreamHeaderSize-1)]...)
+	case h != nil:
+		encodeFrame(buf, streamEnd, s.ID, seq)
+		end = append(end, byte(s.Hash))
+		end = h.Sum(end)
+	default:
+		encodeFrame(buf, streamEnd, s.ID, seq)
+	}
+	for range endFrameRepeat {
+		if err := s.Send(end); err != nil {
+			return err
+		}
+	}
+	return checkErr
+}
+
+// inFlight is a sent but not yet acknowledged frame of a windowed stream.
+type inFlight struct {
+	frame         []byte
+	sent          time.Time
+	retransmitted bool
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// copyWindowed is Copy with congestion control: at most Congestion.Window() frames are unacknowledged,
+// lost frames are retransmitted (after 3 duplicate acks or a timeout) and the window adjusted.
+// The end frame is only sent once all the data has been acknowledged.
+func (s *StreamSender) copyWindowed(ctx context.Context, r io.Reader, payloadSize int) (int64, error) {
+	// Reading happens in its own goroutine so a blocking reader (e.g. stdin) doesn't delay retransmissions.
+	reads := make(chan readResult, readAhead)
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		for {
+			buf := make([]byte, s.FrameSize)
+			n, err := r.Read(buf[StreamHeaderSize : StreamHeaderSize+payloadSize])
+			select {
+			case reads <- readResult{data: buf[:StreamHeaderSize+n], err: err}:
+			case <-readCtx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	cc := s.Congestion
+	h := s.Hash.New()
+	var (
+		frames     []*inFlight // frames[i] has sequence number base+i
+		base, seq  uint32
+		total      int64
+		eof        bool
+		srtt       time.Duration
+		rttVar     time.Duration
+		rto        = initialRTO
+		dupAcks    int
+		recoverSeq uint32 // losses before this sequence number belong to the current loss event
+		timeouts   int
+	)
+	send := func(f *inFlight) error {
+		f.sent = time.Now()
+		return s.Send(f.frame)
+	}
+	retransmit := func() error {
+		f := frames[0]
+		f.retransmitted = true
+		log.LogVf("Stream %d: retransmitting frame %d (window %d)", s.ID, base, cc.Window())
+		return send(f)
+	}
+	timer := time.NewTimer(rto)
+	defer timer.Stop()
+	for !eof || len(frames) > 0 {
+		readCh := reads
+		if eof || len(frames) >= cc.Window() {
+			readCh = nil
+		}
+		if len(frames) > 0 {
+			timer.Reset(time.Until(frames[0].sent.Add(rto)))
+		} else {
+			timer.Reset(maxRTO)
+		}
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case res := <-readCh:
+			// Take as many frames as are ready and fit in the window, to send them as one batch.
+			var batch []*inFlight
+			for {
+				if n := len(res.data) - StreamHeaderSize; n > 0 {
+					if h != nil {
+						h.Write(res.data[StreamHeaderSize:])
+					}
+					encodeFrame(res.data, streamData, s.ID, seq)
+					f := &inFlight{frame: s.appendChunkSum(res.data)}
+					batch = append(batch, f)
+					frames = append(frames, f)
+					seq++
+					total += int64(n)
+				}
+				if res.err != nil || s.SendBatch == nil || len(frames) >= cc.Window() || !tryRead(reads, &res) {
+					break
+				}
+			}
+			if err := s.sendBatch(batch); err != nil {
+				return total, err
+			}
+			if s.Interval > 0 && len(batch) > 0 {
+				time.Sleep(s.Interval)
+			}
+			if errors.Is(res.err, io.EOF) {
+				eof = true
+			} else if res.err != nil {
+				return total, res.err
+			}
+		case ack := <-s.Acks:
+			if !IsStreamAck(ack) || binary.BigEndian.Uint32(ack[1:5]) != s.ID {
+				continue
+			}
+			next := binary.BigEndian.Uint32(ack[5:9])
+			switch {
+			case next > base && next <= seq:
+				newly := next - base
+				if last := frames[newly-1]; !last.retransmitted { // Karn's algorithm.
+					srtt, rttVar = updateRTT(srtt, rttVar, time.Since(last.sent))
+					rto = min(max(srtt+4*rttVar, minRTO), maxRTO)
+				}
+				frames = frames[newly:]
+				base = next
+				dupAcks, timeouts = 0, 0
+				cc.OnAck(int(newly))
+				if base < recoverSeq && len(frames) > 0 {
+					// Partial ack: more than one frame was lost in that window.
+					if err := retransmit(); err != nil {
+						return total, err
+					}
+				}
+			case next == base && len(frames) > 0:
+				dupAcks++
+				if dupAcks != dupAckThreshold {
+					continue
+				}
+				if base >= recoverSeq {
+					cc.OnLoss()
+					recoverSeq = seq
+				}
+				if err := retransmit(); err != nil {
+					return total, err
+				}
+			}
+		case <-timer.C:
+			if len(frames) == 0 {
+				continue
+			}
+			timeouts++
+			if timeouts > DefaultMaxTimeouts {
+				return total, fmt.Errorf("%w: frame %d after %d timeouts", ErrNoAck, base, DefaultMaxTimeouts)
+			}
+			cc.OnTimeout()
+			recoverSeq = seq
+			rto = min(2*rto, maxRTO)
+			if err := retransmit(); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, s.sendEnd(make([]byte, StreamHeaderSize), seq, h)
+}
+
+// tryRead gets the next read result, if one is ready.
+func tryRead(reads <-chan readResult, res *readResult) bool {
+	select {
+	case *res = <-reads:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendBatch sends new frames, with a single SendBatch call when set.
+func (s *StreamSender) sendBatch(batch []*inFlight) error {
+	now := time.Now()
+	for _, f := range batch {
+		f.sent = now
+	}
+	if s.SendBatch == nil || len(batch) == 1 {
+		for _, f := range batch {
+			if err := s.Send(f.frame); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	frames := make([][]byte, len(batch))
+	for i, f := range batch {
+		frames[i] = f.frame
+	}
+	return s.SendBatch(frames)
+}
+
+// updateRTT updates the smoothed round trip time and its variation with a new sample (RFC 6298).
+func updateRTT(srtt, rttVar, sample time.Duration) (time.Duration, time.Duration) {
+	if srtt == 0 {
+		return sample, sample / 2
+	}
+	diff := srtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	return (7*srtt + sample) / 8, (3*rttVar + diff) / 4
+}
+
+// StreamReceiver reassembles the frames of a stream (possibly received out of order)
+// and writes the payload, in order, to the underlying writer.
+// The first frame received determines which stream id is accepted.
+type StreamReceiver struct {
+	MaxPending int // default DefaultMaxPending if 0
+	// Expected hash of the whole stream (must be set before the first frame), tcrypto.NoHash to not check.
+	Hash    tcrypto.HashAlgo
+	h       hash.Hash
+	endSum  []byte
+	w       io.Writer
+	mu      sync.Mutex
+	started bool
+	id      uint32
+	next    uint32
+	total   int64 // bytes written
+	end     int64 // number of data frames once the end frame was received, -1 before
+	pending map[uint32][]byte
+	done    chan struct{}
+	err     error
+	// Ack, when set, is called with an ack frame to send back to the sender after each data frame
+	// (needed by senders using congestion control, see StreamSender.Congestion).
+	Ack func(frame []byte) error
+	// Hash ending each data frame, as set in the sender's StreamSender.ChunkHash. A frame not matching
+	// it is dropped (and retransmitted, with acks) or, without acks, fails the stream.
+	ChunkHash tcrypto.HashAlgo
+}
+
+// NewStreamReceiver returns a receiver writing to w.
+func NewStreamReceiver(w io.Writer) *StreamReceiver {
+	return &StreamReceiver{
+		w:       w,
+		end:     -1,
+		pending: make(map[uint32][]byte),
+		done:    make(chan struct{}),
+	}
+}
+
+// Receive processes one frame. Frames of other streams are ignored.
+func (r *StreamReceiver) Receive(frame []byte) error {
+	if len(frame) < StreamHeaderSize {
+		return fmt.Errorf("frame too short: %d", len(frame))
+	}
+	t := frame[0]
+	id := binary.BigEndian.Uint32(frame[1:5])
+	seq := binary.BigEndian.Uint32(frame[5:9])
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.isDone() {
+		return r.err
+	}
+	if !r.started {
+		r.started = true
+		r.id = id
+		r.h = r.Hash.New()
+	}
+	if id != r.id {
+		log.LogVf("Ignoring frame for stream %d while receiving stream %d", id, r.id)
+		return nil
+	}
+	switch t {
+	case streamEnd:
+		r.end = int64(seq)
+		r.endSum = append([]byte(nil), frame[StreamHeaderSize:]...)
+	case streamAbort:
+		payload := frame[StreamHeaderSize:]
+		aborted := &AbortedError{}
+		if len(payload) > 0 {
+			aborted.Retry, aborted.Reason = payload[0] == 1, string(payload[1:])
+		}
+		r.finish(aborted)
+		return r.err
+	case streamData:
+		if r.Ack != nil {
+			defer r.ack()
+		}
+		payload, err := r.checkChunk(seq, frame[StreamHeaderSize:])
+		if err != nil {
+			if r.Ack == nil {
+				r.finish(err)
+			}
+			return err
+		}
+		if seq < r.next {
+			return nil // duplicate
+		}
+		if seq > r.next {
+			maxPending := r.MaxPending
+			if maxPending <= 0 {
+				maxPending = DefaultMaxPending
+			}
+			if len(r.pending) >= maxPending {
+				r.finish(fmt.Errorf("%w: waiting for %d, got %d", ErrStreamGap, r.next, seq))
+				return r.err
+			}
+			r.pending[seq] = append([]byte(nil), payload...)
+			return nil
+		}
+		if err = r.write(payload); err != nil {
+			return err
+		}
+		for {
+			p, ok := r.pending[r.next]
+			if !ok {
+				break
+			}
+			delete(r.pending, r.next)
+			if err := r.write(p); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown frame type %q", t)
+	}
+	if r.end >= 0 && int64(r.next) == r.end {
+		r.finish(r.verify())
+		return r.err
+	}
+	return nil
+}
+
+// checkChunk verifies the chunk hash ending a data frame's payload, returning the payload without it.
+func (r *StreamReceiver) checkChunk(seq uint32, payload []byte) ([]byte, error) {
+	if r.ChunkHash == tcrypto.NoHash {
+		return payload, nil
+	}
+	h := r.ChunkHash.New()
+	if h == nil || len(payload) < h.Size() {
+		return nil, fmt.Errorf("%w: frame %d too short for its %v chunk hash", ErrChecksumMismatch, seq, r.ChunkHash)
+	}
+	data, sum := payload[:len(payload)-h.Size()], payload[len(payload)-h.Size():]
+	h.Write(data)
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return nil, fmt.Errorf("%w: %v of frame %d", ErrChecksumMismatch, r.ChunkHash, seq)
+	}
+	return data, nil
+}
+
+// verify checks the hash of the whole stream against the one in the end frame.
+func (r *StreamReceiver) verify() error {
+	if r.h == nil {
+		return nil
+	}
+	if len(r.endSum) == 0 || tcrypto.HashAlgo(r.endSum[0]) != r.Hash {
+		return fmt.Errorf("%w: expected a %v hash in end frame", ErrChecksumMismatch, r.Hash)
+	}
+	if !bytes.Equal(r.h.Sum(nil), r.endSum[1:]) {
+		return fmt.Errorf("%w: %v of the whole stream", ErrChecksumMismatch, r.Hash)
+	}
+	return nil
+}
+
+// ack sends the cumulative ack (next expected frame), also when out of order frames are received
+// so the sender can detect losses from the duplicate acks.
+func (r *StreamReceiver) ack() {
+	frame := make([]byte, StreamHeaderSize)
+	encodeFrame(frame, streamAck, r.id, r.next)
+	if err := r.Ack(frame); err != nil {
+		log.Warnf("Failed to ack stream %d: %v", r.id, err)
+	}
+}
+
+func (r *StreamReceiver) write(p []byte) error {
+	if r.h != nil {
+		r.h.Write(p)
+	}
+	n, err := r.w.Write(p)
+	r.total += int64(n)
+	r.next++
+	if err != nil {
+		r.finish(err)
+	}
+	return err
+}
+
+func (r *StreamReceiver) isDone() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *StreamReceiver) finish(err error) {
+	r.err = err
+	close(r.done)
+}
+
+// Done is closed when the whole stream has been written (or on error, see Err).
+func (r *StreamReceiver) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the error which ended the stream, if any.
+func (r *StreamReceiver) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Sum returns the hash (Hash) of the whole stream once it ended verified, nil otherwise.
+func (r *StreamReceiver) Sum() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.isDone() || r.err != nil || r.h == nil {
+		return nil
+	}
+	return r.endSum[1:]
+}
+
+// Total returns the number of bytes written so far.
+func (r *StreamReceiver) Total() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.total
+}
@@ -0,0 +1,168 @@
+package txfer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"testing"
+
+	"fortio.org/tsync/tcrypto"
+	"fortio.org/tsync/txfer"
+)
+
+func TestStream(t *testing.T) {
+	data := randomData(10_000)
+	var frames [][]byte
+	s := &txfer.StreamSender{
+		ID:        42,
+		FrameSize: 100,
+		Send: func(frame []byte) error {
+			frames = append(frames, append([]byte(nil), frame...))
+			return nil
+		},
+	}
+	n, err := s.Copy(context.Background(), bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Copy returned %d, %v", n, err)
+	}
+	// Shuffle (including the end frame) and add a duplicate and a frame from another stream.
+	r := rand.New(rand.NewPCG(1, 2)) //nolint:gosec // test.
+	r.Shuffle(len(frames), func(i, j int) { frames[i], frames[j] = frames[j], frames[i] })
+	other := append([]byte(nil), frames[3]...)
+	other[4] = 43 // stream id 43
+	frames = append([][]byte{frames[5]}, frames...)
+	frames = append(frames[:7], append([][]byte{other}, frames[7:]...)...)
+	var out bytes.Buffer
+	recv := txfer.NewStreamReceiver(&out)
+	for i, f := range frames {
+		select {
+		case <-recv.Done():
+			t.Fatalf("Receiver done early at frame %d/%d", i, len(frames))
+		default:
+		}
+		if err := recv.Receive(f); err != nil {
+			t.Fatalf("Receive error on frame %d: %v", i, err)
+		}
+	}
+	<-recv.Done()
+	if recv.Err() != nil {
+		t.Errorf("Unexpected error %v", recv.Err())
+	}
+	if !bytes.Equal(out.Bytes(), data) || recv.Total() != int64(len(data)) {
+		t.Errorf("Received data differs (%d vs %d bytes)", recv.Total(), len(data))
+	}
+}
+
+func TestStreamGap(t *testing.T) {
+	var frames [][]byte
+	s := &txfer.StreamSender{FrameSize: 20, Send: func(frame []byte) error {
+		frames = append(frames, append([]byte(nil), frame...))
+		return nil
+	}}
+	if _, err := s.Copy(context.Background(), bytes.NewReader(randomData(1000))); err != nil {
+		t.Fatal(err)
+	}
+	recv := txfer.NewStreamReceiver(&bytes.Buffer{})
+	recv.MaxPending = 5
+	var err error
+	for _, f := range frames[1:] { // first frame lost
+		if err = recv.Receive(f); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, txfer.ErrStreamGap) || !errors.Is(recv.Err(), txfer.ErrStreamGap) {
+		t.Errorf("Expected gap error, got %v / %v", err, recv.Err())
+	}
+}
+
+func TestStreamHash(t *testing.T) {
+	data := randomData(5000)
+	var frames [][]byte
+	s := &txfer.StreamSender{ID: 7, FrameSize: 100, Hash: tcrypto.SHA256, Send: func(frame []byte) error {
+		frames = append(frames, append([]byte(nil), frame...))
+		return nil
+	}}
+	if _, err := s.Copy(context.Background(), bytes.NewReader(data)); err != nil {
+		t.Fatalf("Copy error: %v", err)
+	}
+	receive := func(hash tcrypto.HashAlgo, frames [][]byte) error {
+		recv := txfer.NewStreamReceiver(&bytes.Buffer{})
+		recv.Hash = hash
+		for _, f := range frames {
+			if err := recv.Receive(f); err != nil {
+				return err
+			}
+		}
+		<-recv.Done()
+		return recv.Err()
+	}
+	if err := receive(tcrypto.SHA256, frames); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := receive(tcrypto.SHA512_256, frames); !errors.Is(err, txfer.ErrChecksumMismatch) {
+		t.Errorf("Expected checksum mismatch for a different algorithm, got %v", err)
+	}
+	frames[2][txfer.StreamHeaderSize] ^= 1 // same size, corrupted content.
+	if err := receive(tcrypto.SHA256, frames); !errors.Is(err, txfer.ErrChecksumMismatch) {
+		t.Errorf("Expected checksum mismatch for corrupted data, got %v", err)
+	}
+}
+
+func TestStreamChunkHash(t *testing.T) {
+	data := randomData(5000)
+	for _, algo := range tcrypto.DefaultChunkHashes {
+		var frames [][]byte
+		s := &txfer.StreamSender{ID: 3, FrameSize: 100, ChunkHash: algo, Send: func(frame []byte) error {
+			if len(frame) > 100 {
+				t.Errorf("%v: frame of %d bytes", algo, len(frame))
+			}
+			frames = append(frames, append([]byte(nil), frame...))
+			return nil
+		}}
+		if _, err := s.Copy(context.Background(), bytes.NewReader(data)); err != nil {
+			t.Fatalf("%v: Copy error: %v", algo, err)
+		}
+		var out bytes.Buffer
+		recv := txfer.NewStreamReceiver(&out)
+		recv.ChunkHash = algo
+		for _, f := range frames {
+			if err := recv.Receive(f); err != nil {
+				t.Fatalf("%v: unexpected error %v", algo, err)
+			}
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("%v: received content differs", algo)
+		}
+		// Without acks there is no retransmission: a corrupted frame fails the stream.
+		frames[1][txfer.StreamHeaderSize] ^= 1
+		recv = txfer.NewStreamReceiver(&bytes.Buffer{})
+		recv.ChunkHash = algo
+		for _, f := range frames {
+			if recv.Receive(f) != nil {
+				break
+			}
+		}
+		firstFrame := int64(len(frames[0]) - txfer.StreamHeaderSize - len(algo.Sum(nil)))
+		if !errors.Is(recv.Err(), txfer.ErrChecksumMismatch) || recv.Total() != firstFrame {
+			t.Errorf("%v: expected a checksum mismatch after the first frame, got %v (%d bytes)", algo, recv.Err(), recv.Total())
+		}
+	}
+}
+
+func TestChunkVerify(t *testing.T) {
+	for _, algo := range tcrypto.DefaultChunkHashes {
+		c := txfer.Chunk{Data: randomData(1000)}
+		c.Sum = algo.Sum(c.Data)
+		if err := c.Verify(algo); err != nil {
+			t.Errorf("%v: unexpected error %v", algo, err)
+		}
+		c.Data[10] ^= 0x80
+		if err := c.Verify(algo); !errors.Is(err, txfer.ErrChecksumMismatch) {
+			t.Errorf("%v: expected checksum mismatch, got %v", algo, err)
+		}
+	}
+	if err := (txfer.Chunk{Data: []byte("x")}).Verify(tcrypto.NoHash); err != nil {
+		t.Errorf("NoHash should not fail: %v", err)
+	}
+}
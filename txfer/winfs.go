@@ -0,0 +1,48 @@
+package txfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"fortio.org/log"
+)
+
+// Windows specific file handling: long paths (see LongPath), files locked by other processes (see
+// ErrLocked) and alternate data streams ("name:stream", rejected there, see SanitizeName).
+
+// LockedRetries is how many times opening a file locked by another process is retried.
+const LockedRetries = 3
+
+var (
+	// ErrLocked is returned when a file stayed locked by another process (e.g. an open Office
+	// document or a database on Windows) after LockedRetries retries.
+	ErrLocked = errors.New("file locked by another process")
+	// LockedRetryDelay is the delay before the first retry of opening a locked file, doubling after.
+	LockedRetryDelay = 200 * time.Millisecond
+)
+
+// retryLocked calls open until it doesn't fail because the file name is locked by another
+// process, up to LockedRetries times, the error then wrapping ErrLocked.
+func retryLocked[T any](name string, open func() (T, error)) (T, error) {
+	delay := LockedRetryDelay
+	for try := 0; ; try++ {
+		f, err := open()
+		if err == nil || !isLocked(err) {
+			return f, err
+		}
+		if try >= LockedRetries {
+			return f, fmt.Errorf("%w: %s: %w", ErrLocked, name, err)
+		}
+		log.LogVf("%s is locked, retrying in %v: %v", name, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// OpenFile opens the file name for reading (as a LongPath), retrying while it's locked by another
+// process (see ErrLocked).
+func OpenFile(name string) (*os.File, error) {
+	return retryLocked(name, func() (*os.File, error) { return os.Open(LongPath(name)) })
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package txfer
+
+// streamSeparator is empty: only Windows has alternate data streams.
+const streamSeparator = ""
+
+// LongPath returns p: only Windows limits the length of paths.
+func LongPath(p string) string {
+	return p
+}
+
+// isLocked returns false: files aren't (mandatorily) locked by other processes here.
+func isLocked(_ error) bool {
+	return false
+}
@@ -0,0 +1,35 @@
+package txfer
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// streamSeparator separates a file name from its alternate data stream ("name:stream:$DATA"), so
+// names we receive can't write to or read the hidden streams of files (nor name drives).
+const streamSeparator = ":"
+
+// LongPath returns the extended-length form of the path, made absolute (\\?\C:\dir, or
+// \\?\UNC\server\share for \\server\share), whose length isn't limited to MAX_PATH (260).
+func LongPath(p string) string {
+	if p == "" || strings.HasPrefix(p, `\\?\`) || strings.HasPrefix(p, `\\.\`) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// isLocked returns true for the errors of opening a file another process has open without
+// sharing it, or a locked region of.
+func isLocked(err error) bool {
+	return errors.Is(err, windows.ERROR_SHARING_VIOLATION) || errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
@@ -0,0 +1,76 @@
+package txfer_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fortio.org/tsync/txfer"
+	"golang.org/x/sys/windows"
+)
+
+func TestLongPath(t *testing.T) {
+	for in, want := range map[string]string{
+		`C:\dir\file.txt`:      `\\?\C:\dir\file.txt`,
+		`C:\dir\..\file.txt`:   `\\?\C:\file.txt`,
+		`\\server\share\f.txt`: `\\?\UNC\server\share\f.txt`,
+		`\\?\C:\already\long`:  `\\?\C:\already\long`,
+		`\\.\pipe\not-a-file`:  `\\.\pipe\not-a-file`,
+	} {
+		if got := txfer.LongPath(in); got != want {
+			t.Errorf("LongPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+	// Deeper than MAX_PATH.
+	dir := filepath.Join(t.TempDir(), strings.Repeat(`d123456789\`, 30))
+	if err := os.MkdirAll(txfer.LongPath(dir), 0o755); err != nil {
+		t.Fatalf("MkdirAll of a long path: %v", err)
+	}
+	if err := os.WriteFile(txfer.LongPath(filepath.Join(dir, "f.txt")), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := txfer.OpenFile(filepath.Join(dir, "f.txt"))
+	if err != nil {
+		t.Fatalf("OpenFile of a long path: %v", err)
+	}
+	f.Close()
+}
+
+func TestAlternateDataStreams(t *testing.T) {
+	for _, name := range []string{"file.txt:hidden", "file.txt::$DATA", "C:evil"} {
+		if _, err := txfer.SanitizeName(name); !errors.Is(err, txfer.ErrInvalidName) {
+			t.Errorf("SanitizeName(%q) should fail with ErrInvalidName, got %v", name, err)
+		}
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("visible"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	shares, err := txfer.NewShares([]txfer.Share{{Name: "docs", Dir: dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = shares.Open("/docs/a.txt::$DATA"); !errors.Is(err, txfer.ErrInvalidName) {
+		t.Errorf("Opening a data stream should fail with ErrInvalidName, got %v", err)
+	}
+}
+
+func TestLockedFile(t *testing.T) {
+	txfer.LockedRetryDelay = 0
+	name := filepath.Join(t.TempDir(), "locked.txt")
+	p, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Created without any sharing, as some applications do.
+	h, err := windows.CreateFile(p, windows.GENERIC_WRITE, 0, nil, windows.CREATE_NEW, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer windows.CloseHandle(h)
+	if _, err = txfer.OpenFile(name); !errors.Is(err, txfer.ErrLocked) {
+		t.Errorf("Opening a locked file should fail with ErrLocked, got %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fortio.org/smap"
+	"fortio.org/terminal/ansipixels"
+	"fortio.org/terminal/ansipixels/tcolor"
+	"fortio.org/tsync/tlayout"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tstatus"
+)
+
+// PeerTable formats the peers table's rows (the tstatus view of the peers, like the API), the lowest
+// priority columns are hidden when the terminal is too narrow. MTU stays as our line has the status
+// in its cell. The Id is colored by the connection status (see StatusColor).
+var PeerTable = tlayout.TableModel[tstatus.Peer]{Columns: []tlayout.TableColumn[tstatus.Peer]{
+	{
+		Column: tlayout.Column{Title: "Id", Align: ansipixels.Right, Priority: tlayout.MustShow},
+		Format: func(p tstatus.Peer) string {
+			idx := strconv.Itoa(p.ID)
+			status, _ := tstatus.ParseStatus(p.Status)
+			if color, ok := StatusColor(status); ok {
+				return tcolor.Inverse + Color16(color, idx)
+			}
+			return idx
+		},
+	},
+	{
+		Column: tlayout.Column{Title: "Name", Align: ansipixels.Center, Priority: tlayout.MustShow},
+		Format: func(p tstatus.Peer) string {
+			if p.RealName != "" { // revealed private name, see tsnet.Config.PrivateName.
+				return Color16(tcolor.BrightCyan, p.RealName)
+			}
+			return Color16(tcolor.BrightCyan, p.Name)
+		},
+	},
+	{
+		Column: tlayout.Column{Title: "Ip", Align: ansipixels.Left, Priority: 3},
+		Format: func(p tstatus.Peer) string { return Color16(tcolor.BrightGreen, p.IP) },
+	},
+	{
+		Column: tlayout.Column{Title: "Port", Align: ansipixels.Right, Priority: 1},
+		Format: func(p tstatus.Peer) string { return Color16f(tcolor.Blue, "%d", p.Port) },
+	},
+	{
+		Column: tlayout.Column{Title: "Hash", Align: ansipixels.Right, Priority: 2},
+		Format: func(p tstatus.Peer) string { return Color16(tcolor.BrightYellow, p.HumanHash) },
+	},
+	{
+		Column: tlayout.Column{Title: "MTU", Align: ansipixels.Right, Priority: tlayout.MustShow},
+		Format: func(p tstatus.Peer) string { return MTUString(p.MTU) },
+	},
+}}
+
+// PeerColumns are the columns of the peers table (see PeerTable), the user can reorder and
+// resize them (see UI.Layouts).
+var PeerColumns = PeerTable.Titles()
+
+// HeaderLine returns the column titles line of the peers table.
+func HeaderLine() []string {
+	line := make([]string, len(PeerColumns))
+	for i, c := range PeerColumns {
+		line[i] = DarkGray(c.Title)
+	}
+	line[1] = "🔗 " + line[1]
+	return line
+}
+
+// UIState is a snapshot of what the terminal UI shows.
+type UIState struct {
+	OurLine   []string                              // see OurLine, the status (plugins, bans) in its last cell.
+	Peers     []smap.KV[tsnet.Peer, tsnet.PeerData] // sorted with tsnet.PeerKVSort.
+	Selection *Selection
+	Transfers *TransferView // nil when there are none.
+	Modal     tlayout.Modal // drawn over the panes, if set.
+	FPS       string        // shown top right, if set (-show-fps).
+	Name      string        // ours, for the map.
+	Map       bool          // peers shown as a map (DrawPeerMap) instead of the table.
+	Traffic   *TrafficStats // throughput with the peers, for the map and graph, nil if unknown.
+	Graph     bool          // traffic graph (DrawTrafficGraph) instead of the transfers.
+	Timeline  *Timeline     // shown instead of the transfers (and graph), if set.
+	Filter    []string      // names of the peers the Timeline shows the events of, all when empty.
+}
+
+// UI is the terminal UI's screen: the Peers, Transfers and Log panes, drawn by Render.
+type UI struct {
+	Layout        *tlayout.Layout
+	PeersPane     *tlayout.Pane
+	TransfersPane *tlayout.Pane
+	LogPane       *tlayout.Pane // nil Draw, the log scrolls in its area (see LogRegion).
+	TableWidth    int           // of the last drawn peers table, for mouse clicks.
+	Layouts       TableLayouts  // the order and widths of the peers table's columns (PeersView).
+	Column        int           // of PeerColumns selected to be moved or resized, -1 for none.
+	state         *UIState
+	rows          [][]string // of the peers table, all the columns, only the peers shown.
+	first         int        // index of the first peer shown, the table scrolls with the cursor.
+	columns       []int      // of PeerColumns shown, in order (see tlayout.ColumnLayout.Fit).
+	widths        []int      // of the columns shown, as drawn.
+	tableX        int        // left border of the last drawn peers table.
+}
+
+// NewUI returns the terminal UI layout, the log pane titled logTitle. Resize its Layout before
+// the first Render.
+func NewUI(logTitle string) *UI {
+	u := &UI{Layouts: make(TableLayouts), Column: -1}
+	u.PeersPane = &tlayout.Pane{Title: "Peers", Min: 4, Draw: u.drawPeers}
+	u.TransfersPane = &tlayout.Pane{Title: "Transfers", Min: 1, Draw: u.drawTransfers}
+	u.LogPane = &tlayout.Pane{Title: logTitle, Min: 3}
+	u.PeersPane.SetWeight(2)
+	u.LogPane.SetWeight(2)
+	u.Layout = tlayout.New(&tlayout.Split{Children: []tlayout.Node{u.PeersPane, u.TransfersPane, u.LogPane}})
+	return u
+}
+
+func (u *UI) drawPeers(ap *ansipixels.AnsiPixels, area tlayout.Rect) {
+	if u.state.Map {
+		u.TableWidth = 0 // no table to click on.
+		DrawPeerMap(ap, area, u.state)
+		return
+	}
+	alignment := make([]ansipixels.Alignment, len(u.columns))
+	shown := make([]tlayout.Column, len(u.columns))
+	for i, c := range u.columns {
+		alignment[i], shown[i] = PeerColumns[c].Align, PeerColumns[c]
+	}
+	lines := u.Layouts.Get(PeersView).Cells(ap, PeerColumns, u.rows, u.columns)
+	u.widths = tlayout.ColumnWidths(ap, shown, lines, nil)
+	u.TableWidth = ap.WriteTable(area.Y, alignment, 1, lines, ansipixels.BorderOuterColumns)
+	u.tableX = (ap.W - u.TableWidth) / 2
+}
+
+// headerLine returns the screen line of the peers table's titles, -1 when not shown.
+func (u *UI) headerLine() int {
+	if u.TableWidth == 0 || u.PeersPane.Area.H < 4 {
+		return -1
+	}
+	return u.PeersPane.Area.Y + 2 // top border and our line.
+}
+
+// SeparatorAt returns the index in PeerColumns of the column whose right border, in the titles
+// line, is at x, y (screen coordinates, from 0), -1 if none. Dragging it resizes the column.
+func (u *UI) SeparatorAt(x, y int) int {
+	if y != u.headerLine() {
+		return -1
+	}
+	if i := tlayout.SeparatorAt(u.widths, 1, x-u.tableX); i >= 0 {
+		return u.columns[i]
+	}
+	return -1
+}
+
+// HeaderAt returns the index in PeerColumns of the column whose title is at x, y (screen
+// coordinates, from 0), -1 if none. Dragging it onto another title moves it there.
+func (u *UI) HeaderAt(x, y int) int {
+	if y != u.headerLine() {
+		return -1
+	}
+	if i := tlayout.ColumnAt(u.widths, 1, x-u.tableX); i >= 0 {
+		return u.columns[i]
+	}
+	return -1
+}
+
+// SelectNextColumn selects the next column shown, none after the last.
+func (u *UI) SelectNextColumn() {
+	i := slices.Index(u.columns, u.Column)
+	switch {
+	case len(u.columns) == 0 || i == len(u.columns)-1:
+		u.Column = -1
+	case i < 0:
+		u.Column = u.columns[0]
+	default:
+		u.Column = u.columns[i+1]
+	}
+}
+
+// MoveColumn moves the column (index in PeerColumns) by delta positions among the shown ones.
+func (u *UI) MoveColumn(column, delta int) {
+	u.Layouts.Get(PeersView).Move(PeerColumns, u.columns, column, delta)
+}
+
+// MoveColumnTo moves the column (index in PeerColumns) to the target one's position.
+func (u *UI) MoveColumnTo(column, target int) {
+	u.Layouts.Get(PeersView).MoveTo(PeerColumns, u.columns, column, target)
+}
+
+// ResizeColumn changes the width of the shown column (index in PeerColumns) by delta, fixing it.
+func (u *UI) ResizeColumn(column, delta int) {
+	i := slices.Index(u.columns, column)
+	if i < 0 || i >= len(u.widths) {
+		return
+	}
+	u.Layouts.Get(PeersView).Resize(PeerColumns[column], u.widths[i]+delta)
+}
+
+// ResetColumns puts the peers table's columns back in their order and content widths.
+func (u *UI) ResetColumns() {
+	u.Layouts.Get(PeersView).Reset()
+}
+
+// ShownPeers returns the index of the first peer in the table and how many are shown.
+func (u *UI) ShownPeers() (int, int) {
+	return u.first, max(0, len(u.rows)-2)
+}
+
+// peerRows returns the lines of the peers table: ours, the titles and count peers from the first.
+func peerRows(ap *ansipixels.AnsiPixels, state *UIState, first, count int) [][]string {
+	peers := state.Peers[first:min(len(state.Peers), first+count)]
+	lines := make([][]string, 0, len(peers)+2)
+	lines = append(lines, state.OurLine, HeaderLine())
+	for j, kv := range peers {
+		i := first + j
+		line := PeerTable.Row(ap, tstatus.NewPeer(i+1, kv.Key, kv.Value))
+		if state.Selection != nil {
+			line = state.Selection.Decorate(line, i, kv.Key)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (u *UI) drawTransfers(ap *ansipixels.AnsiPixels, area tlayout.Rect) {
+	if u.state.Timeline != nil {
+		u.state.Timeline.Draw(ap, area, u.state.Filter)
+		return
+	}
+	if u.state.Graph && u.state.Traffic != nil {
+		DrawTrafficGraph(ap, area, u.state.Traffic)
+		return
+	}
+	transfers := u.state.Transfers
+	if transfers == nil {
+		transfers = &TransferView{}
+	}
+	transfers.Draw(ap, area)
+}
+
+// Render draws the state: the panes, the FPS and the modal.
+func (u *UI) Render(ap *ansipixels.AnsiPixels, state *UIState) {
+	u.state = state
+	u.PeersPane.Title = "Peers"
+	if state.Map {
+		u.PeersPane.Title = "Peers map"
+	} else {
+		// Borders, our line and the titles take 4 lines: only the peers which fit are formatted
+		// and measured, around the cursor, so thousands of peers are as fast to draw as a few.
+		count, cursor := max(0, u.PeersPane.Area.H-4), u.first
+		if state.Selection != nil {
+			cursor = state.Selection.Cursor
+		}
+		u.first = tlayout.ScrollWindow(len(state.Peers), count, cursor, u.first)
+		u.rows = peerRows(ap, state, u.first, count)
+		if u.Column >= 0 && u.Column < len(PeerColumns) {
+			header := slices.Clone(u.rows[1])
+			header[u.Column] = strings.Replace(header[u.Column], tcolor.DarkGray.Foreground(), tcolor.BrightCyan.Foreground(), 1)
+			u.rows[1] = header
+		}
+		u.columns = u.Layouts.Get(PeersView).Fit(ap, PeerColumns, u.rows, u.PeersPane.Area.W, 1)
+		var hidden []string
+		for i, c := range PeerColumns {
+			if !slices.Contains(u.columns, i) {
+				hidden = append(hidden, c.Title)
+			}
+		}
+		if len(hidden) > 0 {
+			u.PeersPane.Title += " (hidden: " + strings.Join(hidden, ", ") + ")"
+		}
+		if shown := len(u.rows) - 2; shown < len(state.Peers) {
+			u.PeersPane.Title += fmt.Sprintf(" (%d-%d of %d)", u.first+1, u.first+shown, len(state.Peers))
+		}
+		if u.Column >= 0 && u.Column < len(PeerColumns) {
+			u.PeersPane.Title += " (column: " + PeerColumns[u.Column].Title + ")"
+		}
+	}
+	u.TransfersPane.Title = "Transfers"
+	switch {
+	case state.Timeline != nil && len(state.Filter) > 0:
+		u.TransfersPane.Title = "Timeline of " + strings.Join(state.Filter, ", ")
+	case state.Timeline != nil:
+		u.TransfersPane.Title = "Timeline"
+	case state.Graph:
+		u.TransfersPane.Title = "Traffic"
+	}
+	u.Layout.Draw(ap)
+	if state.FPS != "" {
+		ap.WriteAtStr(ap.W-len(state.FPS)-1, 0, DarkGray(state.FPS))
+	}
+	if state.Modal != nil {
+		state.Modal.Draw(ap)
+	}
+}
+
+// RenderScreen returns the lines of the terminal UI showing state on a w x h terminal, e.g.
+// to check the layout (columns, selection, panes) without a terminal.
+func RenderScreen(state *UIState, logTitle string, w, h int) []string {
+	u := NewUI(logTitle)
+	u.Layout.Resize(w, h)
+	return tlayout.Snapshot(w, h, func(ap *ansipixels.AnsiPixels) { u.Render(ap, state) })
+}
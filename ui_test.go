@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fortio.org/smap"
+	"fortio.org/tsync/tlayout"
+	"fortio.org/tsync/tsnet"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/ with the current output")
+
+// screenState is a fixed UIState: us and 3 peers, the 2nd one under the cursor and marked.
+func screenState() *UIState {
+	peers := []smap.KV[tsnet.Peer, tsnet.PeerData]{
+		{
+			Key:   tsnet.Peer{IP: "192.168.1.10", Name: "laptop", PublicKey: "key-1"},
+			Value: tsnet.PeerData{HumanHash: "427-5636", Port: 29557, Status: tsnet.Connected, MTU: 1500},
+		},
+		{
+			Key:   tsnet.Peer{IP: "192.168.1.11", Name: "desktop", PublicKey: "key-2"},
+			Value: tsnet.PeerData{HumanHash: "133-2240", Port: 29558},
+		},
+		{
+			Key:   tsnet.Peer{IP: "10.0.0.7", Name: "raspberrypi", PublicKey: "key-3"},
+			Value: tsnet.PeerData{HumanHash: "905-1178", Port: 29556, Status: tsnet.Connected, MTU: 1280},
+		},
+	}
+	sel := &Selection{Cursor: 1}
+	sel.Toggle(peers)
+	return &UIState{
+		OurLine:   []string{"🏠", "us", "192.168.1.2", "29556", "741-0652", ""},
+		Peers:     peers,
+		Selection: sel,
+	}
+}
+
+// TestRenderScreen compares the rendered screens with testdata/screen_*.golden, run
+// `go test -run TestRenderScreen -update` to regenerate them after an intended change.
+func TestRenderScreen(t *testing.T) {
+	tests := []struct {
+		name  string
+		w, h  int
+		modal tlayout.Modal
+	}{
+		{name: "peers", w: 80, h: 20},
+		{name: "modal", w: 80, h: 20, modal: &tlayout.Choice{Title: "Send to", Options: []string{"laptop", "desktop"}}},
+		{name: "narrow", w: 40, h: 16},
+		{name: "narrow_modal", w: 40, h: 16, modal: &tlayout.Confirm{Title: "Trust", Lines: []string{"Trust laptop?"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := screenState()
+			state.Modal = tt.modal
+			got := strings.Join(RenderScreen(state, "Log", tt.w, tt.h), "\n") + "\n"
+			golden := filepath.Join("testdata", "screen_"+tt.name+".golden")
+			if *update {
+				if err := os.MkdirAll("testdata", 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("%dx%d screen differs from %s:\n%s\nwant:\n%s", tt.w, tt.h, golden, got, want)
+			}
+		})
+	}
+}
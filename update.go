@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"fortio.org/cli"
+	"fortio.org/log"
+	"fortio.org/tsync/tsync"
+	"fortio.org/tsync/tupdate"
+)
+
+// UpdateCheckTimeout bounds the TUI's background check for a newer release.
+const UpdateCheckTimeout = 30 * time.Second
+
+// Update checks for a newer release and, unless the "check" argument is given, replaces our
+// binary with it once verified. "sign file" is for the publisher: it signs the release's checksums
+// file (writing file.sig) with our identity, whose public key releases must embed (see tupdate.PublisherKey).
+func Update(args []string) int {
+	if len(args) == 2 && args[0] == "sign" {
+		return SignRelease(args[1])
+	}
+	checkOnly := len(args) == 1 && args[0] == "check"
+	if len(args) > 1 || (len(args) == 1 && !checkOnly) {
+		return log.FErrf("Usage: tsync update [check | sign checksums-file]")
+	}
+	u, err := tupdate.New(tupdate.PublisherKey)
+	if err != nil {
+		return log.FErrf("Can't update: %v", err)
+	}
+	ctx := context.Background()
+	rel, err := u.Latest(ctx)
+	if err != nil {
+		return log.FErrf("Failed to get the latest release: %v", err)
+	}
+	if !tupdate.Newer(cli.ShortVersion, rel.Version()) {
+		log.Infof("Already up to date: %s (latest release %s)", cli.ShortVersion, rel.Tag)
+		return 0
+	}
+	log.Infof("Newer release %s available (we are %s)", rel.Tag, cli.ShortVersion)
+	if checkOnly {
+		return 0
+	}
+	exe, err := executable()
+	if err != nil {
+		return log.FErrf("Can't find our executable: %v", err)
+	}
+	binary, err := u.Download(ctx, rel)
+	if err != nil {
+		log.FErrf("Failed to download %s: %v", rel.Tag, err)
+		return UpdateExitCode(err)
+	}
+	if err = tupdate.Replace(exe, binary); err != nil {
+		return log.FErrf("Failed to replace %s: %v", exe, err)
+	}
+	log.Infof("Updated %s to %s", exe, rel.Tag)
+	return 0
+}
+
+// SignRelease writes the detached signature of file (the release checksums) to file.sig.
+func SignRelease(file string) int {
+	id, err := tsync.LoadIdentity()
+	if err != nil {
+		return log.FErrf("Failed to load or create identity: %v", err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return log.FErrf("Failed to read %s: %v", file, err)
+	}
+	sigFile := file + tupdate.SignatureSuffix
+	if err = os.WriteFile(sigFile, []byte(id.SignDetached(data)+"\n"), 0o644); err != nil { //nolint:gosec // public.
+		return log.FErrf("Failed to write %s: %v", sigFile, err)
+	}
+	log.Infof("Wrote %s, build with -ldflags \"-X fortio.org/tsync/tupdate.PublisherKey=%s\"",
+		sigFile, id.PublicKeyToString())
+	return 0
+}
+
+// CheckUpdateNotify checks (in the background) for a newer release and logs a notification in
+// the TUI when there is one. Silent on errors (e.g. offline or no publisher key in this build).
+func CheckUpdateNotify() {
+	u, err := tupdate.New(tupdate.PublisherKey)
+	if err != nil {
+		log.LogVf("No update check: %v", err)
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), UpdateCheckTimeout)
+		defer cancel()
+		rel, err := u.Latest(ctx)
+		if err != nil {
+			log.LogVf("Update check failed: %v", err)
+			return
+		}
+		if tupdate.Newer(cli.ShortVersion, rel.Version()) {
+			log.Infof("Update available: %s (we are %s), run `tsync update`", rel.Tag, cli.ShortVersion)
+		}
+	}()
+}
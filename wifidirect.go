@@ -0,0 +1,37 @@
+//go:build wifidirect && linux
+
+package main
+
+import (
+	"context"
+	"flag"
+
+	"fortio.org/log"
+	"fortio.org/tsync/tsnet"
+	"fortio.org/tsync/tsnet/wifidirect"
+)
+
+// WiFiDirectFlags defines the experimental -wifi-direct flags and returns the function forming
+// the group (see package wifidirect) before the server starts, and then returning its cleanup.
+func WiFiDirectFlags() func(cfg *tsnet.Config) (func(), error) {
+	fControl := flag.String("wifi-direct", "",
+		"Experimental: form a Wi-Fi Direct group with another tsync first, through this wpa_supplicant P2P control socket"+
+			" (e.g. "+wifidirect.DefaultControl+"), for machines without a common network")
+	fTimeout := flag.Duration("wifi-direct-timeout", 0, "How long to look for a Wi-Fi Direct peer, 0 for no limit")
+	return func(cfg *tsnet.Config) (func(), error) {
+		if *fControl == "" {
+			return func() {}, nil
+		}
+		g, err := wifidirect.Connect(context.Background(), wifidirect.Config{Control: *fControl, Timeout: *fTimeout})
+		if err != nil {
+			return nil, err
+		}
+		// The group's interface isn't the one reaching the Target.
+		cfg.Interface, cfg.AllInterfaces = g.Interface, false
+		return func() {
+			if err := g.Close(); err != nil {
+				log.Warnf("Error removing the Wi-Fi Direct group %s: %v", g.Interface, err)
+			}
+		}, nil
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(wifidirect && linux)
+
+package main
+
+import "fortio.org/tsync/tsnet"
+
+// WiFiDirectFlags is a no-op without the wifidirect build tag (on Linux).
+func WiFiDirectFlags() func(cfg *tsnet.Config) (func(), error) {
+	return func(*tsnet.Config) (func(), error) { return func() {}, nil }
+}